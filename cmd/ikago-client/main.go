@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -10,31 +12,77 @@
 	"github.com/xtaci/kcp-go"
 	"ikago/internal/addr"
 	"ikago/internal/config"
+	"ikago/internal/control"
 	"ikago/internal/crypto"
+	"ikago/internal/daemon"
+	"ikago/internal/divert"
 	"ikago/internal/exec"
+	"ikago/internal/hook"
 	"ikago/internal/log"
+	"ikago/internal/obfs"
 	"ikago/internal/pcap"
+	"ikago/internal/privilege"
+	"ikago/internal/prof"
+	"ikago/internal/route"
+	"ikago/internal/shape"
 	"ikago/internal/stat"
+	"ikago/internal/tun"
+	"ikago/internal/worker"
 	"io"
 	"math/rand"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"runtime"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
+// hostDevice describes a device exchanging IP packets of sources with the host, like a TUN device.
+type hostDevice interface {
+	io.ReadWriteCloser
+	Name() string
+}
+
 type natIndicator struct {
 	srcHardwareAddr net.HardwareAddr
-	conn            *pcap.RawConn
+	vlan            uint16
+	conn            pcap.PacketConn
+}
+
+// clientState describes the state saved in the state file, so the server still finds mappings of the client after a
+// quick restart.
+type clientState struct {
+	Port  uint16          `json:"port"`
+	Token string          `json:"token,omitempty"`
+	NAT   []natEntryState `json:"nat"`
+}
+
+// natEntryState describes a source in NAT in the state file.
+type natEntryState struct {
+	Source          string `json:"source"`
+	SrcHardwareAddr string `json:"source-hardware-addr"`
+	VLAN            uint16 `json:"vlan"`
+	Device          string `json:"device"`
 }
 
 const name string = "IkaGo-client"
 
+const keepInjected time.Duration = 2 * time.Second
+const checkDrops time.Duration = 10 * time.Second
+
+// minResolveServer and maxResolveServer bound the interval of re-resolving the server by the TTL of its records.
+const (
+	minResolveServer time.Duration = 30 * time.Second
+	maxResolveServer time.Duration = 10 * time.Minute
+	speedTestWindow                = 256
+	speedTestTimeout time.Duration = 2 * time.Second
+)
+
 var (
 	version     = ""
 	build       = ""
@@ -45,17 +93,78 @@ type natIndicator struct {
 
 var (
 	argListDevs       = flag.Bool("list-devices", false, "List all valid devices in current computer.")
+	argService        = flag.String("service", "", "Install, uninstall or print the unit of the service.")
 	argConfig         = flag.String("c", "", "Configuration file.")
+	argReplay         = flag.String("replay", "", "Pcap file for replaying.")
+	argDryRun         = flag.Bool("dry-run", false, "Print packets instead of sending them.")
+	argSpeedTest      = flag.Int("speedtest", 0, "Seconds of testing speed with the server.")
+	argBackend        = flag.String("backend", "pcap", "Backend of sources.")
+	argRoute          = flag.Bool("route", false, "Route all traffic of the host to the TUN device.")
 	argListenDevs     = flag.String("listen-devices", "", "Devices for listening.")
 	argUpDev          = flag.String("upstream-device", "", "Device for routing upstream to.")
+	argMulticast      = flag.Bool("multicast", false, "Tunnel multicast and broadcast packets.")
 	argGateway        = flag.String("gateway", "", "Gateway address.")
+	argStaticMAC      = flag.String("static-mac", "", "Static hardware addresses of next hops.")
+	argPaths          = flag.String("paths", "", "Additional paths for routing upstream in multipath.")
+	argMultipath      = flag.String("multipath", "stripe", "Mode of multipath.")
+	argVLAN           = flag.Int("vlan", 0, "VLAN identifier of upstream device.")
+	argPPPoE          = flag.Bool("pppoe", false, "Route upstream in the PPPoE session of upstream device.")
+	argFilter         = flag.String("f", "", "Custom BPF filter.")
+	argMode           = flag.String("mode", "faketcp", "Mode.")
 	argMethod         = flag.String("method", "plain", "Method of encryption.")
+	argObfs           = flag.String("obfs", "none", "Method of obfuscation.")
+	argIPId           = flag.String("ip-id", "random", "Strategy of IPv4 Id.")
+	argTTL            = flag.Int("ttl", 0, "TTL of crafted packets.")
+	argTCPWindow      = flag.Int("tcp-window", 65535, "Window of TCP segments.")
+	argTCPMSS         = flag.Int("tcp-mss", 0, "MSS option of TCP SYN segments.")
+	argTCPWScale      = flag.Int("tcp-window-scale", 0, "Window scale option of TCP SYN segments.")
+	argTCPTimestamps  = flag.Bool("tcp-timestamps", false, "Timestamps option of TCP segments.")
+	argCopyToS        = flag.String("copy-tos", "none", "Mode of copying ToS of embedded packets.")
+	argClampMSS       = flag.Bool("clamp-mss", false, "Clamp MSS of TCP SYN segments.")
+	argClampWindow    = flag.Bool("clamp-window", false, "Clamp receive window of TCP segments.")
 	argPassword       = flag.String("password", "", "Password of encryption.")
 	argRule           = flag.Bool("rule", false, "Add firewall rule.")
 	argVerbose        = flag.Bool("v", false, "Print verbose messages.")
 	argLog            = flag.String("log", "", "Log.")
+	argLogFile        = flag.String("log-file", "", "Log file.")
+	argLogJSON        = flag.Bool("log-json", false, "Print messages in JSON.")
+	argLogQuiet       = flag.Bool("log-quiet", false, "Suppress per-packet messages.")
+	argColor          = flag.String("color", "auto", "Mode of colorizing messages.")
+	argStatus         = flag.Int("status", 1, "Interval of refreshing the status line.")
+	argLogSample      = flag.Int("log-sample", 1, "Print per-packet messages 1 in n.")
+	argLogFlows       = flag.Bool("log-flows", false, "Print summaries of flows when they are closed.")
+	argIPFIX          = flag.String("ipfix", "", "Collector of flows in IPFIX.")
+	argDump           = flag.String("dump", "", "Pcapng file for dumping packets.")
+	argSnapLen        = flag.Int("snap-len", pcap.DefaultSnapLen, "Snap length of capturing.")
+	argPcapImmediate  = flag.Bool("pcap-immediate", false, "Capture in immediate mode.")
+	argPcapBuffer     = flag.Int("pcap-buffer", 0, "Buffer size of capturing.")
+	argPcapTimeout    = flag.Int("pcap-timeout", 0, "Read timeout of capturing.")
+	argPcapNoPromisc  = flag.String("pcap-no-promisc", "", "Devices capturing without promiscuous mode.")
+	argPcapTstamp     = flag.String("pcap-tstamp", "", "Timestamp source of capturing.")
+	argPcapRing       = flag.Int("pcap-ring", 0, "Packets buffered between capturing and handling.")
+	argPcapMmap       = flag.Bool("pcap-mmap", false, "Capture by mapping the ring of the kernel directly.")
 	argMonitor        = flag.Int("monitor", 0, "Port for monitoring.")
+	argControl        = flag.String("control", "", "Address of control API.")
+	argControlToken   = flag.String("control-token", "", "Token of control API.")
+	argPprof          = flag.String("pprof", "", "Address of serving runtime profiles.")
+	argStats          = flag.Int("stats", 0, "Interval of printing statistics.")
+	argBatch          = flag.Int("batch", 0, "Max size of a batch.")
+	argBatchInterval  = flag.Int("batch-interval", 1, "Interval of flushing a batch.")
+	argWorkers        = flag.Int("workers", 1, "Number of workers handling packets.")
+	argFrame          = flag.Bool("frame", false, "Frame packets.")
+	argId             = flag.String("id", "", "Id presented to the server.")
+	argKey            = flag.String("key", "", "Key of the user in the id.")
+	argLimit          = flag.String("limit", "", "Max throughput.")
+	argLimitPerFlow   = flag.String("limit-per-flow", "", "Max throughput per flow.")
+	argPriority       = flag.String("priority", "", "Rules of classifying packets in priority.")
+	argHooks          = flag.String("hooks", "", "Go plugins of hooks.")
 	argMTU            = flag.Int("mtu", 0, "MTU.")
+	argMTUDiscovery   = flag.Int("mtu-discovery", 0, "Interval of discovering MTU.")
+	argReorderWindow  = flag.Int("reorder-window", 0, "Window of reordering segments.")
+	argReorderTimeout = flag.Int("reorder-timeout", 50, "Timeout of reordering segments.")
+	argFECDataShard   = flag.Int("fec-datashard", 0, "Data shards of forward error correction.")
+	argFECParityShard = flag.Int("fec-parityshard", 3, "Parity shards of forward error correction.")
+	argPacing         = flag.Bool("pacing", false, "Pace frames by delivery rates measured by the peer.")
 	argKCP            = flag.Bool("kcp", false, "Enable KCP.")
 	argKCPMTU         = flag.Int("kcp-mtu", kcp.IKCP_MTU_DEF, "KCP tuning option mtu.")
 	argKCPSendWindow  = flag.Int("kcp-sndwnd", kcp.IKCP_WND_SND, "KCP tuning option sndwnd.")
@@ -67,38 +176,91 @@ type natIndicator struct {
 	argKCPInterval    = flag.Int("kcp-interval", kcp.IKCP_INTERVAL, "KCP tuning option interval.")
 	argKCPResend      = flag.Int("kcp-resend", 0, "KCP tuning option resend.")
 	argKCPNC          = flag.Int("kcp-nc", 0, "KCP tuning option nc.")
-	argPublish        = flag.String("publish", "", "ARP publishing address.")
+	argWSPath         = flag.String("ws-path", "/", "Path of WebSocket.")
+	argWSHost         = flag.String("ws-host", "", "Host of WebSocket.")
+	argWSTLS          = flag.Bool("ws-tls", false, "WebSocket in TLS.")
+	argWSInsecure     = flag.Bool("ws-insecure", false, "Skip verifying the certificate of WebSocket.")
+	argPublish        = flag.String("publish", "", "ARP publishing addresses.")
 	argUpPort         = flag.Int("p", 0, "Port for routing upstream.")
+	argState          = flag.String("state", "", "File to save state in for restoring after restarts.")
+	argHop            = flag.Int("hop", 0, "Interval of hopping ports.")
+	argHopPorts       = flag.Int("hop-ports", 1024, "Number of ports in hopping.")
+	argRekey          = flag.Int("rekey", 0, "Interval of rotating keys.")
+	argStrict         = flag.Bool("strict", false, "Validate inbound packets strictly.")
+	argAntiReplay     = flag.Bool("anti-replay", false, "Drop replayed packets between the client and the server.")
+	argRekeySize      = flag.Int("rekey-size", 0, "Size of data in MB of rotating keys.")
 	argSources        = flag.String("r", "", "Sources.")
 	argServer         = flag.String("s", "", "Server.")
 )
 
 var (
-	publishIP  *net.IPAddr
-	upPort     uint16
-	sources    []*net.IPAddr
-	serverIP   net.IP
-	serverPort uint16
-	listenDevs []*pcap.Device
-	upDev      *pcap.Device
-	gatewayDev *pcap.Device
-	mode       string
-	crypt      crypto.Crypt
-	mtu        int
-	isKCP      bool
-	kcpConfig  *config.KCPConfig
+	publishIPs    []net.IP
+	upPort        uint16
+	statePath     string
+	sources       []*net.IPAddr
+	isTun         bool
+	isDivert      bool
+	isRoute       bool
+	routes        *route.Manager
+	serverIP      net.IP
+	serverPort    uint16
+	serverHost    string
+	serverLock    sync.Mutex
+	isRule        bool
+	listenDevs    []*pcap.Device
+	upDev         *pcap.Device
+	gatewayDev    *pcap.Device
+	paths         []pcap.TunnelPath
+	multipathMode pcap.MultipathMode
+	mode          string
+	crypt         crypto.Crypt
+	auth          *crypto.Auth
+	batch         int
+	batchInterval time.Duration
+	isFrame       bool
+	id            string
+	userAuth      *crypto.Auth
+	mtu           int
+	mtuDiscovery  time.Duration
+	rekeyInterval time.Duration
+	rekeySize     uint64
+	isStrict      bool
+	isMulticast   bool
+	clampMSS      uint16
+	windowClamp   *pcap.WindowClamp
+	speedTest     *pcap.SpeedTest
+	isKCP         bool
+	kcpConfig     *config.KCPConfig
+	wsConfig      *config.WebSocketConfig
+	hop           *crypto.Hop
 )
 
 var (
-	isClosed    bool
-	listenConns []*pcap.RawConn
-	upConn      net.Conn
-	c           chan pcap.ConnPacket
-	natLock     sync.RWMutex
-	nat         map[string]*natIndicator
-	monitor     *stat.TrafficMonitor
-	dnsLock     sync.RWMutex
-	dns         map[string]string
+	isClosed      bool
+	isRSTRule     bool
+	listenLock    sync.RWMutex
+	listenConns   []pcap.PacketConn
+	tunDev        hostDevice
+	upLock        sync.RWMutex
+	upConn        *pcap.TunnelConn
+	c             chan pcap.ConnPacket
+	loopGuard     *pcap.LoopGuard
+	natLock       sync.RWMutex
+	nat           map[string]*natIndicator
+	monitor       *stat.TrafficMonitor
+	controlServer *control.Server
+	flows         *stat.FlowRecorder
+	limiter       *shape.Limiter
+	priorityRules []*shape.Rule
+	scheduler     *shape.Scheduler
+	hooks         *hook.Chain
+	dumper        *pcap.Dumper
+	pool          *worker.Pool
+	customFilter  string
+	corrupted     uint64
+	dnsLock       sync.RWMutex
+	dns           map[string]string
+	savedToken    []byte
 )
 
 func init() {
@@ -122,22 +284,12 @@ func init() {
 	// Start time
 	startTime = time.Now()
 
-	// Parse arguments
-	flag.Parse()
-
-	// Load config.json by default
-	if len(os.Args) <= 1 {
-		_, err := os.Stat("config.json")
-		if err == nil {
-			*argConfig = "config.json"
-		}
-	}
-
 	sources = make([]*net.IPAddr, 0)
 	listenDevs = make([]*pcap.Device, 0)
 
-	listenConns = make([]*pcap.RawConn, 0)
+	listenConns = make([]pcap.PacketConn, 0)
 	c = make(chan pcap.ConnPacket, 1000)
+	loopGuard = pcap.NewLoopGuard(keepInjected)
 	nat = make(map[string]*natIndicator)
 	dns = make(map[string]string)
 }
@@ -149,6 +301,17 @@ func main() {
 		gateway net.IP
 	)
 
+	// Parse arguments
+	flag.Parse()
+
+	// Load config.json by default
+	if len(os.Args) <= 1 {
+		_, err := os.Stat("config.json")
+		if err == nil {
+			*argConfig = "config.json"
+		}
+	}
+
 	// Configuration
 	if *argConfig != "" {
 		cfg, err = config.ParseFile(*argConfig)
@@ -158,16 +321,75 @@ func main() {
 		log.Infof("Load configuration from %s\n", *argConfig)
 	} else {
 		cfg = config.NewConfig()
+		cfg.Backend = *argBackend
+		cfg.Route = *argRoute
 		cfg.ListenDevs = splitArg(*argListenDevs)
 		cfg.UpDev = *argUpDev
+		cfg.Multicast = *argMulticast
 		cfg.Gateway = *argGateway
+		cfg.StaticMAC = splitArg(*argStaticMAC)
+		cfg.Paths = splitArg(*argPaths)
+		cfg.Multipath = *argMultipath
+		cfg.VLAN = *argVLAN
+		cfg.PPPoE = *argPPPoE
+		cfg.Filter = *argFilter
+		cfg.Mode = *argMode
 		cfg.Method = *argMethod
 		cfg.Password = *argPassword
+		cfg.Obfs = *argObfs
+		cfg.IPId = *argIPId
+		cfg.TTL = *argTTL
+		cfg.TCPWindow = *argTCPWindow
+		cfg.TCPMSS = *argTCPMSS
+		cfg.TCPWindowScale = *argTCPWScale
+		cfg.TCPTimestamps = *argTCPTimestamps
+		cfg.CopyToS = *argCopyToS
+		cfg.ClampMSS = *argClampMSS
+		cfg.ClampWindow = *argClampWindow
 		cfg.Rule = *argRule
 		cfg.Verbose = *argVerbose
 		cfg.Log = *argLog
+		if *argLogFile != "" {
+			cfg.Log = *argLogFile
+		}
+		cfg.LogJSON = *argLogJSON
+		cfg.LogQuiet = *argLogQuiet
+		cfg.LogSample = *argLogSample
+		cfg.LogFlows = *argLogFlows
+		cfg.Color = *argColor
+		cfg.Status = *argStatus
+		cfg.IPFIX = *argIPFIX
+		cfg.Dump = *argDump
+		cfg.SnapLen = *argSnapLen
+		cfg.PcapConfig.Immediate = *argPcapImmediate
+		cfg.PcapConfig.Buffer = *argPcapBuffer
+		cfg.PcapConfig.Timeout = *argPcapTimeout
+		cfg.PcapConfig.NoPromisc = splitArg(*argPcapNoPromisc)
+		cfg.PcapConfig.Tstamp = *argPcapTstamp
+		cfg.PcapConfig.Ring = *argPcapRing
+		cfg.PcapConfig.Mmap = *argPcapMmap
 		cfg.Monitor = *argMonitor
+		cfg.Control = *argControl
+		cfg.ControlToken = *argControlToken
+		cfg.Pprof = *argPprof
+		cfg.Stats = *argStats
+		cfg.Batch = *argBatch
+		cfg.BatchInterval = *argBatchInterval
+		cfg.Workers = *argWorkers
+		cfg.Frame = *argFrame
+		cfg.Id = *argId
+		cfg.Key = *argKey
+		cfg.Limit = *argLimit
+		cfg.LimitPerFlow = *argLimitPerFlow
+		cfg.Priority = splitArg(*argPriority)
+		cfg.Hooks = splitArg(*argHooks)
 		cfg.MTU = *argMTU
+		cfg.MTUDiscovery = *argMTUDiscovery
+		cfg.ReorderWindow = *argReorderWindow
+		cfg.ReorderTimeout = *argReorderTimeout
+		cfg.FECDataShard = *argFECDataShard
+		cfg.FECParityShard = *argFECParityShard
+		cfg.Pacing = *argPacing
 		cfg.KCP = *argKCP
 		cfg.KCPConfig = *config.NewKCPConfig()
 		cfg.KCPConfig.MTU = *argKCPMTU
@@ -180,14 +402,37 @@ func main() {
 		cfg.KCPConfig.Interval = *argKCPInterval
 		cfg.KCPConfig.Resend = *argKCPResend
 		cfg.KCPConfig.NC = *argKCPNC
+		cfg.WebSocket = *config.NewWebSocketConfig()
+		cfg.WebSocket.Path = *argWSPath
+		cfg.WebSocket.Host = *argWSHost
+		cfg.WebSocket.TLS = *argWSTLS
+		cfg.WebSocket.Insecure = *argWSInsecure
 		cfg.Publish = *argPublish
 		cfg.Port = *argUpPort
+		cfg.State = *argState
+		cfg.Hop = *argHop
+		cfg.HopPorts = *argHopPorts
+		cfg.Rekey = *argRekey
+		cfg.Strict = *argStrict
+		cfg.AntiReplay = *argAntiReplay
+		cfg.RekeySize = *argRekeySize
 		cfg.Sources = splitArg(*argSources)
 		cfg.Server = *argServer
 	}
 
 	// Log
 	log.SetVerbose(cfg.Verbose || *argVerbose)
+	log.SetJSON(cfg.LogJSON || *argLogJSON)
+	log.SetQuiet(cfg.LogQuiet || *argLogQuiet)
+	colorMode, err := log.ParseColorMode(cfg.Color)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse color: %w", err))
+	}
+	log.SetColor(colorMode)
+	if cfg.LogSample < 0 {
+		log.Fatalln(fmt.Errorf("log sample %d out of range", cfg.LogSample))
+	}
+	log.SetSample(cfg.LogSample)
 	err = log.SetLog(cfg.Log)
 	if err != nil {
 		log.Fatalln(fmt.Errorf("log %s: %w", cfg.Log, err))
@@ -196,45 +441,39 @@ func main() {
 		log.Infof("Save log to file %s\n", cfg.Log)
 	}
 
-	// Check permission
-	switch runtime.GOOS {
-	case "linux":
-		if os.Geteuid() != 0 {
-			ex, err := os.Executable()
-			if err != nil {
-				ex = "path_to_ikago"
-			}
-
-			log.Infoln("You are running IkaGo as non-root, if IkaGo does not work, please run")
-			log.Infof("  sudo setcap cap_net_raw+ep \"%s\"\n", ex)
-			log.Infoln("  before opening IkaGo, or just run as root with sudo.")
-		}
-	case "windows":
-		break
-	default:
-		if os.Geteuid() != 0 {
-			log.Infoln("You are running IkaGo as non-root, if IkaGo does not work, please run IkaGo as root with sudo.")
-		}
-	}
-
 	// Exclusive commands
 	if *argListDevs {
-		log.Infoln("Available devices are listed below, use -listen-devices [devices] or -upstream-device [device] to designate device:")
+		log.Infoln("Available devices are listed below, use -listen-devices [devices] or -upstream-device [device] to designate device by index, name or pattern:")
 		devs, err := pcap.FindAllDevs()
 		if err != nil {
 			log.Fatalln(fmt.Errorf("list devices: %w", err))
 		}
-		for _, dev := range devs {
-			log.Infof("  %s\n", dev)
+		for i, dev := range devs {
+			log.Infof("  [%d] %s\n", i, dev.Detail())
+		}
+		os.Exit(0)
+	}
+	if *argService != "" {
+		err := service(*argService)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("service: %w", err))
 		}
 		os.Exit(0)
 	}
 
+	// Check privileges, which are not required in replaying
+	if *argReplay == "" {
+		err := privilege.Check()
+		if err != nil {
+			log.Fatalln(fmt.Errorf("check privileges: %w", err))
+		}
+	}
+
 	// Verify parameters
-	if len(cfg.Sources) <= 0 {
+	if len(cfg.Sources) <= 0 && *argReplay == "" {
 		log.Fatalln("Please provide sources by -r addresses.")
 	}
-	if cfg.Server == "" {
+	if cfg.Server == "" && *argReplay == "" {
 		log.Fatalln("Please provide server by -s address.")
 	}
 	if cfg.Gateway != "" {
@@ -246,7 +485,28 @@ func main() {
 	if cfg.Monitor < 0 || cfg.Monitor > 65535 {
 		log.Fatalln(fmt.Errorf("monitor port %d out of range", cfg.Monitor))
 	}
-	if cfg.MTU < 576 || cfg.MTU > pcap.MaxMTU {
+	if cfg.Stats < 0 {
+		log.Fatalln(fmt.Errorf("statistics interval %d out of range", cfg.Stats))
+	}
+	if cfg.Status < 0 {
+		log.Fatalln(fmt.Errorf("status interval %d out of range", cfg.Status))
+	}
+	if cfg.Batch < 0 || cfg.Batch > 65535 {
+		log.Fatalln(fmt.Errorf("batch size %d out of range", cfg.Batch))
+	}
+	if cfg.BatchInterval <= 0 {
+		log.Fatalln(fmt.Errorf("batch interval %d out of range", cfg.BatchInterval))
+	}
+	if cfg.VLAN < 0 || cfg.VLAN > 4094 {
+		log.Fatalln(fmt.Errorf("vlan %d out of range", cfg.VLAN))
+	}
+	if cfg.PPPoE && cfg.UpDev == "" {
+		log.Fatalln(errors.New("pppoe requires upstream device"))
+	}
+	if cfg.PPPoE && cfg.VLAN > 0 {
+		log.Fatalln(errors.New("pppoe with vlan not support"))
+	}
+	if cfg.MTU < pcap.MinMTU || cfg.MTU > pcap.MaxMTU {
 		if cfg.MTU == 0 {
 			cfg.MTU = pcap.MaxMTU
 		} else {
@@ -281,6 +541,21 @@ func main() {
 		log.Fatalln(fmt.Errorf("upstream port %d out of range", cfg.Port))
 	}
 
+	// Reuse the upstream port in the state
+	statePath = cfg.State
+	if statePath != "" && cfg.Port == 0 {
+		var state clientState
+		err := config.LoadState(statePath, &state)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				log.Errorln(fmt.Errorf("load state: %w", err))
+			}
+		} else if state.Port != 0 && int(state.Port) != cfg.Monitor {
+			cfg.Port = int(state.Port)
+			log.Infof("Restore upstream port %d from %s\n", cfg.Port, statePath)
+		}
+	}
+
 	// Randomize upstream port
 	if cfg.Port == 0 {
 		s := rand.NewSource(time.Now().UnixNano())
@@ -292,65 +567,498 @@ func main() {
 	upPort = uint16(cfg.Port)
 
 	// Sources
-	for _, source := range cfg.Sources {
-		ip := net.ParseIP(source)
-		if ip == nil {
-			log.Fatalln(fmt.Errorf("invalid source %s", source))
-		}
-		sources = append(sources, &net.IPAddr{IP: ip})
+	sources, err = parseSources(cfg.Sources)
+	if err != nil {
+		log.Fatalln(err)
 	}
 
-	// Server
-	serverAddr, err := addr.ParseTCPAddr(cfg.Server)
-	if err != nil {
-		log.Fatalln(fmt.Errorf("parse server %s: %w", cfg.Server, err))
+	// Backend
+	switch cfg.Backend {
+	case "pcap":
+		break
+	case "tun":
+		isTun = true
+		log.Infoln("Route sources through TUN device")
+	case "windivert":
+		isTun = true
+		isDivert = true
+		log.Infoln("Intercept sources through WinDivert")
+	default:
+		log.Fatalln(fmt.Errorf("backend %s not support", cfg.Backend))
 	}
-	serverIP = serverAddr.IP
-	serverPort = uint16(serverAddr.Port)
 
-	// Add firewall rule
-	if cfg.Rule {
-		err := exec.AddSpecificFirewallRule(serverIP, serverPort)
+	// Routes
+	isRoute = cfg.Route && *argReplay == "" && !*argDryRun
+	if isRoute {
+		if cfg.Backend != "tun" {
+			log.Fatalln(errors.New("routing all traffic requires backend tun"))
+		}
+
+		// Routes left by a previous run which did not exit normally
+		n, err := route.Recover(routeJournal())
 		if err != nil {
-			log.Errorln(fmt.Errorf("add firewall rule: %w", err))
-		} else {
-			log.Infoln("Add firewall rule")
+			log.Errorln(fmt.Errorf("recover routes: %w", err))
+		} else if n > 0 {
+			log.Infof("Recover %d routes left by a previous run\n", n)
 		}
 	}
 
-	// Publish
-	if cfg.Publish != "" {
-		ip := net.ParseIP(cfg.Publish)
-		if ip == nil {
-			log.Errorln(fmt.Errorf("invalid publish %s", cfg.Publish))
+	// Server, which is not required in replay
+	var serverAddr *net.TCPAddr
+	if *argReplay == "" {
+		serverAddr, err = addr.ParseTCPAddr(cfg.Server)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse server %s: %w", cfg.Server, err))
 		}
-		publishIP = &net.IPAddr{IP: ip}
-	}
-	if publishIP != nil {
-		log.Infof("Publish %s\n", publishIP.IP)
+		serverIP = serverAddr.IP
+		serverPort = uint16(serverAddr.Port)
+		serverHost = hostOf(cfg.Server)
 	}
+	isRule = cfg.Rule && *argReplay == "" && !*argDryRun
 
 	// Mode
 	switch cfg.Mode {
 	case "faketcp":
 		mode = "faketcp"
 		log.Infoln("Use fake TCP")
+	case "kcp":
+		// Mode kcp is normalized to fake TCP with KCP, so checks below see the values it takes
+		cfg.Mode = "faketcp"
+		cfg.KCP = true
+		mode = "faketcp"
+		log.Infoln("Use fake TCP with KCP")
 	case "tcp":
 		mode = "tcp"
 		log.Infoln("Use standard TCP (experimental)")
+	case "websocket":
+		mode = "websocket"
+		log.Infoln("Use WebSocket")
+	case "udp":
+		mode = "udp"
+		log.Infoln("Use UDP")
 	default:
 		log.Fatalln(fmt.Errorf("mode %s not support", cfg.Mode))
 	}
 
+	// Hop
+	if cfg.Hop < 0 {
+		log.Fatalln(fmt.Errorf("hop interval %d out of range", cfg.Hop))
+	}
+	if cfg.Hop > 0 && *argReplay == "" {
+		if cfg.HopPorts <= 0 || int(serverPort)+cfg.HopPorts-1 > 65535 {
+			log.Fatalln(fmt.Errorf("hop ports %d out of range", cfg.HopPorts))
+		}
+		if cfg.Mode != "faketcp" || cfg.KCP {
+			log.Fatalln(errors.New("hopping is only supported in fake TCP without KCP"))
+		}
+		if cfg.Password == "" {
+			log.Fatalln(errors.New("hopping requires a password"))
+		}
+		hop = crypto.CreateHop(cfg.Password, time.Duration(cfg.Hop)*time.Second, serverPort, uint16(cfg.HopPorts))
+		min, max := hop.Range()
+		log.Infof("Hop in ports %d-%d every %d seconds\n", min, max, cfg.Hop)
+	}
+
+	// Dry run
+	if *argDryRun {
+		pcap.SetDryRun(true)
+		log.Infoln("Dry run, packets are printed instead of being sent")
+	}
+
+	// Add firewall rule
+	if cfg.Rule && *argReplay == "" && !*argDryRun {
+		err := exec.AddSpecificFirewallRule(serverIP, serverPort)
+		if err != nil {
+			log.Errorln(fmt.Errorf("add firewall rule: %w", err))
+		} else {
+			log.Infoln("Add firewall rule")
+		}
+	}
+
+	// Drop RST segments of the upstream port sent by the kernel
+	if cfg.Rule && *argReplay == "" && !*argDryRun {
+		err := exec.AddRSTRule(upPort)
+		if err != nil {
+			log.Errorln(fmt.Errorf("add rst rule: %w", err))
+		} else {
+			isRSTRule = true
+			log.Infof("Drop RST segments from :%d\n", upPort)
+		}
+	}
+
+	// Publish
+	for _, s := range splitArg(cfg.Publish) {
+		ip := net.ParseIP(s)
+		if ip == nil || ip.To4() == nil {
+			log.Fatalln(fmt.Errorf("invalid publish %s", s))
+		}
+		publishIPs = append(publishIPs, ip.To4())
+	}
+	if len(publishIPs) > 0 {
+		strs := make([]string, 0, len(publishIPs))
+		for _, ip := range publishIPs {
+			strs = append(strs, ip.String())
+		}
+		log.Infof("Publish %s\n", strings.Join(strs, ", "))
+	}
+
+	// Key rotation
+	if cfg.Rekey < 0 {
+		log.Fatalln(fmt.Errorf("rekey interval %d out of range", cfg.Rekey))
+	}
+	if cfg.RekeySize < 0 {
+		log.Fatalln(fmt.Errorf("rekey size %d out of range", cfg.RekeySize))
+	}
+	rekeyInterval = time.Duration(cfg.Rekey) * time.Second
+	rekeySize = uint64(cfg.RekeySize) << 20
+	isRekey := rekeyInterval > 0 || rekeySize > 0
+	if isRekey {
+		if cfg.Mode != "faketcp" || cfg.KCP {
+			log.Fatalln(errors.New("key rotation is only supported in fake TCP without KCP"))
+		}
+		if cfg.Password == "" {
+			log.Fatalln(errors.New("key rotation requires a password"))
+		}
+	}
+
+	// Multicast
+	isMulticast = cfg.Multicast
+	if isMulticast {
+		log.Infoln("Tunnel multicast and broadcast packets from sources")
+	}
+
+	// Strict validation
+	isStrict = cfg.Strict
+	if isStrict {
+		if cfg.Password == "" {
+			log.Fatalln(errors.New("strict validation requires a password"))
+		}
+		pcap.SetStrict(true)
+		log.Infoln("Validate inbound packets strictly")
+	}
+
 	// Crypt
-	crypt, err = crypto.ParseCrypt(cfg.Method, cfg.Password)
+	if isRekey {
+		crypt, err = crypto.CreateRotatingCrypt(cfg.Method, cfg.Password)
+	} else {
+		crypt, err = crypto.ParseCrypt(cfg.Method, cfg.Password)
+	}
 	if err != nil {
 		log.Fatalln(fmt.Errorf("parse crypt: %w", err))
 	}
+	if cfg.AntiReplay {
+		if mode != "faketcp" {
+			log.Fatalln(errors.New("anti-replay is only supported in fake TCP"))
+		}
+		// Sequence numbers in malleable methods, like AES-CFB, can be forged
+		if !crypt.Method().IsAEAD() && !isStrict {
+			log.Fatalln(errors.New("anti-replay requires an aead method or strict validation"))
+		}
+		crypt = crypto.WrapReplay(crypt)
+		log.Infof("Drop replayed packets in a window of %d packets\n", crypto.ReplayWindow)
+	}
+	if isStrict {
+		crypt = crypto.WrapMAC(crypt, cfg.Password)
+	}
 	method := crypt.Method()
 	if method != crypto.MethodPlain {
 		log.Infof("Encrypt with %s\n", method)
 	}
+	if rekeyInterval > 0 {
+		log.Infof("Rotate keys every %s\n", rekeyInterval)
+	}
+	if rekeySize > 0 {
+		log.Infof("Rotate keys every %d MB\n", cfg.RekeySize)
+	}
+
+	// Obfuscation
+	o, err := obfs.ParseObfs(cfg.Obfs)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse obfs: %w", err))
+	}
+	if o.Method() != obfs.MethodNone {
+		log.Infof("Obfuscate with %s\n", o.Method())
+	}
+	crypt = obfs.WrapCrypt(crypt, o)
+
+	// IPv4 Id
+	idStrategy, err := pcap.ParseIdStrategy(cfg.IPId)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse ip id: %w", err))
+	}
+	pcap.SetIdStrategy(idStrategy)
+	if idStrategy != pcap.IdStrategyRandom {
+		log.Infof("Generate IPv4 Id in %s\n", idStrategy)
+	}
+
+	// TTL of crafted packets
+	if cfg.TTL < 0 || cfg.TTL > 255 {
+		log.Fatalln(fmt.Errorf("ttl %d out of range", cfg.TTL))
+	}
+	if cfg.TTL > 0 {
+		pcap.SetTTL(uint8(cfg.TTL))
+		log.Infof("Craft packets in TTL %d\n", cfg.TTL)
+	}
+
+	// TCP options
+	if cfg.TCPWindow <= 0 || cfg.TCPWindow > 65535 {
+		log.Fatalln(fmt.Errorf("tcp window %d out of range", cfg.TCPWindow))
+	}
+	if cfg.TCPMSS < 0 || cfg.TCPMSS > 65535 {
+		log.Fatalln(fmt.Errorf("tcp mss %d out of range", cfg.TCPMSS))
+	}
+	if cfg.TCPWindowScale < 0 || cfg.TCPWindowScale > 14 {
+		log.Fatalln(fmt.Errorf("tcp window scale %d out of range", cfg.TCPWindowScale))
+	}
+	pcap.SetTCPOptions(uint16(cfg.TCPWindow), uint16(cfg.TCPMSS), uint8(cfg.TCPWindowScale), cfg.TCPTimestamps)
+	if cfg.TCPWindow != 65535 {
+		log.Infof("Set TCP window to %d\n", cfg.TCPWindow)
+	}
+	if cfg.TCPMSS > 0 {
+		log.Infof("Set TCP MSS option to %d Bytes\n", cfg.TCPMSS)
+	}
+	if cfg.TCPWindowScale > 0 {
+		log.Infof("Set TCP window scale option to %d\n", cfg.TCPWindowScale)
+	}
+	if cfg.TCPTimestamps {
+		log.Infoln("Enable TCP timestamps option")
+	}
+
+	// ToS
+	tosMode, err := pcap.ParseToSMode(cfg.CopyToS)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse copy tos: %w", err))
+	}
+	pcap.SetToSMode(tosMode)
+	if tosMode != pcap.ToSModeNone {
+		log.Infof("Copy %s of embedded packets to the tunnel\n", strings.ToUpper(cfg.CopyToS))
+	}
+
+	// Custom filter, which needs to be validated after the snap length is set
+	if cfg.Filter != "" {
+		err := pcap.ValidateBPFFilter(cfg.Filter)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse filter %s: %w", cfg.Filter, err))
+		}
+		customFilter = cfg.Filter
+		log.Infof("Filter with %s\n", customFilter)
+	}
+
+	// Workers
+	if cfg.Workers < 1 {
+		log.Fatalln(fmt.Errorf("workers %d out of range", cfg.Workers))
+	}
+	pool = worker.NewPool(cfg.Workers)
+	if cfg.Workers > 1 {
+		log.Infof("Handle packets in %d workers\n", cfg.Workers)
+	}
+
+	// Snap length
+	if cfg.SnapLen < pcap.DefaultSnapLen || cfg.SnapLen > pcap.MaxSnapLen {
+		log.Fatalln(fmt.Errorf("snap length %d out of range", cfg.SnapLen))
+	}
+	pcap.SetSnapLen(cfg.SnapLen)
+	if cfg.SnapLen != pcap.DefaultSnapLen {
+		log.Infof("Capture with snap length %d\n", cfg.SnapLen)
+	}
+
+	// Capturing
+	err = pcap.ValidatePcapConfig(&cfg.PcapConfig)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("pcap tuning: %w", err))
+	}
+	pcap.SetPcapConfig(&cfg.PcapConfig)
+	if cfg.PcapConfig.Immediate {
+		log.Infoln("Capture in immediate mode")
+	}
+	if cfg.PcapConfig.Buffer > 0 {
+		log.Infof("Capture with buffer size %d Bytes\n", cfg.PcapConfig.Buffer)
+	}
+	if cfg.PcapConfig.Timeout > 0 {
+		log.Infof("Capture with read timeout %d ms\n", cfg.PcapConfig.Timeout)
+	}
+	if len(cfg.PcapConfig.NoPromisc) > 0 {
+		log.Infof("Capture without promiscuous mode on %s\n", strings.Join(cfg.PcapConfig.NoPromisc, ", "))
+	}
+	if cfg.PcapConfig.Tstamp != "" {
+		log.Infof("Capture with timestamp source %s\n", cfg.PcapConfig.Tstamp)
+	}
+	if cfg.PcapConfig.Ring > 0 {
+		log.Infof("Capture into a ring of %d packets\n", cfg.PcapConfig.Ring)
+	}
+	if cfg.PcapConfig.Mmap {
+		log.Infoln("Capture by mapping the ring of the kernel")
+	}
+
+	// Reorder
+	if cfg.ReorderWindow < 0 {
+		log.Fatalln(fmt.Errorf("reorder window %d out of range", cfg.ReorderWindow))
+	}
+	if cfg.ReorderTimeout <= 0 {
+		log.Fatalln(fmt.Errorf("reorder timeout %d out of range", cfg.ReorderTimeout))
+	}
+	pcap.SetReorder(cfg.ReorderWindow, time.Duration(cfg.ReorderTimeout)*time.Millisecond)
+	if cfg.ReorderWindow > 0 {
+		log.Infof("Reorder segments in a window of %d in %d ms\n", cfg.ReorderWindow, cfg.ReorderTimeout)
+	}
+
+	// Rate limit
+	limit, err := shape.ParseRate(cfg.Limit)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse limit: %w", err))
+	}
+	limitPerFlow, err := shape.ParseRate(cfg.LimitPerFlow)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse limit per flow: %w", err))
+	}
+	limiter = shape.NewLimiter(limit, limitPerFlow)
+	if limit > 0 {
+		log.Infof("Limit throughput to %s\n", shape.FormatRate(limit))
+	}
+	if limitPerFlow > 0 {
+		log.Infof("Limit throughput per flow to %s\n", shape.FormatRate(limitPerFlow))
+	}
+
+	// Priority
+	if len(cfg.Priority) > 0 {
+		priorityRules, err = shape.ParseRules(cfg.Priority)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse priority: %w", err))
+		}
+		scheduler = shape.NewScheduler(limiter, stat.DirectionOut)
+		log.Infof("Schedule packets in priority by %s\n", strings.Join(cfg.Priority, ", "))
+	}
+
+	// Hooks
+	if len(cfg.Hooks) > 0 || cfg.LogFlows || cfg.IPFIX != "" || cfg.LogSample > 1 {
+		hs := make([]hook.Hook, 0)
+		for _, s := range cfg.Hooks {
+			path, arg := s, ""
+			i := strings.Index(s, "@")
+			if i >= 0 {
+				path, arg = s[:i], s[i+1:]
+			}
+
+			h, err := hook.Open(path, arg)
+			if err != nil {
+				log.Fatalln(fmt.Errorf("open hook %s: %w", path, err))
+			}
+			hs = append(hs, h)
+		}
+		if len(hs) > 0 {
+			log.Infof("Attach %d hooks\n", len(hs))
+		}
+		if cfg.LogFlows {
+			hs = append(hs, hook.NewFlowLog())
+
+			log.Infoln("Print summaries of flows")
+		}
+		if cfg.IPFIX != "" {
+			h, err := hook.NewIPFIX(cfg.IPFIX)
+			if err != nil {
+				log.Fatalln(fmt.Errorf("ipfix: %w", err))
+			}
+			hs = append(hs, h)
+
+			log.Infof("Export flows in IPFIX to %s\n", cfg.IPFIX)
+		}
+		hooks = hook.NewChain(hs, 30*time.Second)
+		go hooks.Run(30 * time.Second)
+	}
+
+	// Authentication
+	auth = crypto.CreateAuth(cfg.Password)
+	if auth != nil {
+		log.Infoln("Authenticate with password")
+	}
+
+	// Dump
+	if cfg.Dump != "" {
+		dumper, err = pcap.NewDumper(cfg.Dump)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("create dumper: %w", err))
+		}
+		pcap.SetDumper(dumper)
+		log.Infof("Dump packets to %s\n", cfg.Dump)
+	}
+
+	// Replay
+	if *argReplay != "" {
+		err := replay(*argReplay)
+		if dumper != nil {
+			dumper.Close()
+		}
+		if err != nil {
+			log.Fatalln(fmt.Errorf("replay %s: %w", *argReplay, err))
+		}
+		os.Exit(0)
+	}
+
+	// Statistics
+	if cfg.Stats > 0 || cfg.Monitor != 0 {
+		flows = stat.NewFlowRecorder()
+	}
+	if cfg.Stats > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Duration(cfg.Stats) * time.Second)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				natLock.RLock()
+				n := len(nat)
+				natLock.RUnlock()
+
+				var dropped uint64
+				for _, s := range pcap.AllCaptureStats() {
+					dropped = dropped + s.Dropped
+				}
+
+				log.Infof("%s  NAT entries: %d  Dropped in capturing: %d  Replayed: %d\n", flows.Summary(5), n, dropped, crypto.Replayed())
+			}
+		}()
+
+		log.Infof("Print statistics every %d seconds\n", cfg.Stats)
+	}
+
+	// Status line
+	if cfg.Status > 0 && log.IsTerminal() && !(cfg.LogJSON || *argLogJSON) {
+		if flows == nil {
+			flows = stat.NewFlowRecorder()
+		}
+		meter := stat.NewRateMeter(flows)
+		go func() {
+			ticker := time.NewTicker(time.Duration(cfg.Status) * time.Second)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				natLock.RLock()
+				n := len(nat)
+				natLock.RUnlock()
+				var dropped uint64
+				for _, s := range pcap.AllCaptureStats() {
+					dropped = dropped + s.Dropped
+				}
+
+				log.SetStatus(fmt.Sprintf("%s  NAT %d  Dropped %d", meter.Sample(), n, dropped))
+			}
+		}()
+	}
+
+	// Drop alerts
+	go func() {
+		watcher := pcap.NewDropWatcher()
+		ticker := time.NewTicker(checkDrops)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if isClosed {
+				return
+			}
+			for dev, n := range watcher.Check() {
+				log.Warnf("Kernel drops %d packets in capturing in device %s, try a larger buffer by -pcap-buffer\n", n, dev)
+			}
+		}
+	}()
 
 	// Monitor
 	if cfg.Monitor != 0 {
@@ -360,18 +1068,21 @@ func main() {
 
 		monitor = stat.NewTrafficMonitor()
 
+		mux := http.NewServeMux()
 		go func() {
-			http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+			mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
 				b, err := json.Marshal(&struct {
-					Name    string               `json:"name"`
-					Version string               `json:"version"`
-					Time    int                  `json:"time"`
-					Monitor *stat.TrafficMonitor `json:"monitor"`
+					Name      string               `json:"name"`
+					Version   string               `json:"version"`
+					Time      int                  `json:"time"`
+					Monitor   *stat.TrafficMonitor `json:"monitor"`
+					Corrupted uint64               `json:"corrupted"`
 				}{
-					Name:    name,
-					Version: versionInfo,
-					Time:    int(time.Now().Sub(startTime).Seconds()),
-					Monitor: monitor,
+					Name:      name,
+					Version:   versionInfo,
+					Time:      int(time.Now().Sub(startTime).Seconds()),
+					Monitor:   monitor,
+					Corrupted: atomic.LoadUint64(&corrupted),
 				})
 				if err != nil {
 					log.Errorln(fmt.Errorf("monitor: %w", err))
@@ -387,17 +1098,47 @@ func main() {
 				}
 			})
 
-			http.HandleFunc("/dns", func(w http.ResponseWriter, req *http.Request) {
-				type IPName struct {
-					IP   string `json:"ip"`
-					Name string `json:"name"`
+			mux.HandleFunc("/flows", func(w http.ResponseWriter, req *http.Request) {
+				b, err := json.Marshal(flows.Stats())
+				if err != nil {
+					log.Errorln(fmt.Errorf("monitor: %w", err))
+					return
 				}
 
-				ipNames := make([]IPName, 0)
-				dnsLock.RLock()
-				for ip, name := range dns {
-					ipNames = append(ipNames, IPName{
-						IP:   ip,
+				// Handle CORS
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+
+				_, err = io.WriteString(w, string(b))
+				if err != nil {
+					log.Errorln(fmt.Errorf("monitor: %w", err))
+				}
+			})
+			mux.HandleFunc("/capture", func(w http.ResponseWriter, req *http.Request) {
+				b, err := json.Marshal(pcap.AllCaptureStats())
+				if err != nil {
+					log.Errorln(fmt.Errorf("monitor: %w", err))
+					return
+				}
+
+				// Handle CORS
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+
+				_, err = io.WriteString(w, string(b))
+				if err != nil {
+					log.Errorln(fmt.Errorf("monitor: %w", err))
+				}
+			})
+			mux.HandleFunc("/dns", func(w http.ResponseWriter, req *http.Request) {
+				type IPName struct {
+					IP   string `json:"ip"`
+					Name string `json:"name"`
+				}
+
+				ipNames := make([]IPName, 0)
+				dnsLock.RLock()
+				for ip, name := range dns {
+					ipNames = append(ipNames, IPName{
+						IP:   ip,
 						Name: name,
 					})
 				}
@@ -418,7 +1159,7 @@ type IPName struct {
 				}
 			})
 
-			err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.Monitor), nil)
+			err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.Monitor), mux)
 			if err != nil {
 				log.Errorln(fmt.Errorf("monitor: %w", err))
 			}
@@ -428,6 +1169,82 @@ type IPName struct {
 		log.Infoln("You can now observe traffic on http://ikago.ikas.ink")
 	}
 
+	// Control
+	if cfg.Control != "" {
+		local, err := control.IsLocal(cfg.Control)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse control address %s: %w", cfg.Control, err))
+		}
+		if !local && cfg.ControlToken == "" {
+			log.Warnf("Control API on %s is not local and is not protected by a token\n", cfg.Control)
+		}
+
+		controlServer = control.NewServer(cfg.Control, cfg.ControlToken)
+		handleControl(controlServer)
+
+		go func() {
+			err := controlServer.ListenAndServe()
+			if err != nil {
+				log.Errorln(fmt.Errorf("control: %w", err))
+			}
+		}()
+
+		log.Infof("Control on %s\n", cfg.Control)
+	}
+
+	// Profiling
+	if cfg.Pprof != "" {
+		local, err := control.IsLocal(cfg.Pprof)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse pprof address %s: %w", cfg.Pprof, err))
+		}
+		if !local {
+			log.Warnf("Profiles on %s are not local\n", cfg.Pprof)
+		}
+
+		go func() {
+			err := http.ListenAndServe(cfg.Pprof, prof.Handler())
+			if err != nil {
+				log.Errorln(fmt.Errorf("pprof: %w", err))
+			}
+		}()
+
+		log.Infof("Profile on http://%s/debug/pprof/\n", cfg.Pprof)
+	}
+
+	// Batch
+	batch = cfg.Batch
+	batchInterval = time.Duration(cfg.BatchInterval) * time.Millisecond
+	if batch > 0 {
+		log.Infof("Batch packets up to %d Bytes in %s\n", batch, batchInterval)
+	}
+
+	// Frame
+	isFrame = cfg.Frame || isRekey
+	if isFrame {
+		log.Infoln("Frame packets if the server supports")
+	}
+
+	// Id
+	if len(cfg.Id) > pcap.MaxIdSize {
+		log.Fatalln(fmt.Errorf("id size %d out of range", len(cfg.Id)))
+	}
+	id = cfg.Id
+	if id != "" {
+		log.Infof("Identify as %s to the server\n", id)
+	}
+
+	// Key
+	if cfg.Key != "" {
+		if id == "" {
+			log.Fatalln(errors.New("key must be used with id"))
+		}
+		userAuth = crypto.CreateAuth(cfg.Key)
+		// Challenges are answered in frames
+		isFrame = true
+		log.Infof("Authenticate as user %s\n", id)
+	}
+
 	// MTU
 	mtu = cfg.MTU
 	if mtu != pcap.MaxMTU {
@@ -441,6 +1258,102 @@ type IPName struct {
 		log.Infoln("Enable KCP")
 	}
 
+	// WebSocket
+	wsConfig = &cfg.WebSocket
+	if mode == "websocket" {
+		if !strings.HasPrefix(wsConfig.Path, "/") {
+			log.Fatalln(fmt.Errorf("invalid websocket path %s", wsConfig.Path))
+		}
+		if wsConfig.TLS {
+			log.Infoln("Connect WebSocket in TLS")
+			if wsConfig.Insecure {
+				log.Warnln("Skip verifying the certificate of WebSocket")
+			}
+		}
+	}
+
+	// MTU discovery
+	if cfg.MTUDiscovery < 0 {
+		log.Fatalln(fmt.Errorf("mtu discovery %d out of range", cfg.MTUDiscovery))
+	}
+	mtuDiscovery = time.Duration(cfg.MTUDiscovery) * time.Second
+	if mtuDiscovery > 0 {
+		if mode != "faketcp" || isKCP || batch > 0 {
+			log.Fatalln(errors.New("mtu discovery is only supported in fake TCP without KCP or batching"))
+		}
+		// Probes are sent in frames
+		isFrame = true
+		log.Infof("Discover MTU every %s\n", mtuDiscovery)
+	}
+
+	// FEC
+	if cfg.FECDataShard < 0 || cfg.FECDataShard > 255 {
+		log.Fatalln(fmt.Errorf("fec data shard %d out of range", cfg.FECDataShard))
+	}
+	if cfg.FECParityShard < 0 || cfg.FECDataShard+cfg.FECParityShard > 256 {
+		log.Fatalln(fmt.Errorf("fec parity shard %d out of range", cfg.FECParityShard))
+	}
+	pcap.SetFEC(cfg.FECDataShard, cfg.FECParityShard)
+	if cfg.FECDataShard > 0 {
+		if (mode != "faketcp" && mode != "udp") || isKCP || batch > 0 {
+			log.Fatalln(errors.New("fec is only supported in fake TCP or UDP without KCP or batching"))
+		}
+		// Shards are sent in frames
+		isFrame = true
+		log.Infof("Correct errors in %d data shards and %d parity shards\n", cfg.FECDataShard, cfg.FECParityShard)
+	}
+
+	// Pacing
+	pcap.SetPacing(cfg.Pacing)
+	if cfg.Pacing {
+		if (mode != "faketcp" && mode != "udp") || isKCP {
+			log.Fatalln(errors.New("pacing is only supported in fake TCP or UDP without KCP"))
+		}
+		// Rates are reported in frames
+		isFrame = true
+		log.Infoln("Pace frames by delivery rates")
+	}
+
+	// Speed test
+	if *argSpeedTest < 0 {
+		log.Fatalln(fmt.Errorf("speed test %d out of range", *argSpeedTest))
+	}
+	if *argSpeedTest > 0 {
+		if *argReplay != "" || *argDryRun {
+			log.Fatalln(errors.New("speed test cannot be used with replaying or dry run"))
+		}
+		cost := crypt.Cost()
+		if isKCP {
+			// KCP headers
+			cost = cost + 32
+		}
+		var err error
+		speedTest, err = pcap.NewSpeedTest(int(pcap.TunnelMSS(mtu, cost))+40, speedTestWindow, speedTestTimeout)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("speed test: %w", err))
+		}
+	}
+
+	// MSS clamping
+	if cfg.ClampMSS {
+		cost := crypt.Cost()
+		if isKCP {
+			// KCP headers
+			cost = cost + 32
+		}
+		clampMSS = pcap.TunnelMSS(mtu, cost)
+		if serverIP.To4() == nil {
+			clampMSS = clampMSS - 20
+		}
+		log.Infof("Clamp MSS of TCP SYN segments to %d Bytes\n", clampMSS)
+	}
+
+	// Window clamping
+	if cfg.ClampWindow {
+		windowClamp = pcap.NewWindowClamp()
+		log.Infoln("Clamp receive window of TCP segments to the bandwidth-delay product of the tunnel")
+	}
+
 	if len(sources) == 1 {
 		log.Infof("Proxy %s through :%d to %s\n", sources[0], upPort, serverAddr)
 	} else {
@@ -454,31 +1367,25 @@ type IPName struct {
 		}
 	}
 
-	// Find devices
-	listenDevs, err = pcap.FindListenDevs(cfg.ListenDevs)
-	if err != nil {
-		log.Fatalln(fmt.Errorf("find listen devices: %w", err))
-	}
-	if len(cfg.ListenDevs) <= 0 {
-		// Remove loopback devices by default
-		result := make([]*pcap.Device, 0)
-
-		for _, dev := range listenDevs {
-			if dev.IsLoop() {
-				continue
-			}
-			result = append(result, dev)
+	// Find devices, listen devices are not used with TUN device
+	if !isTun {
+		listenDevs, err = findListenDevs(cfg.ListenDevs)
+		if err != nil {
+			log.Fatalln(err)
 		}
-
-		listenDevs = result
-	}
-	if len(listenDevs) <= 0 {
-		log.Fatalln(errors.New("cannot determine listen device"))
 	}
 
-	upDev, gatewayDev, err = pcap.FindUpstreamDevAndGatewayDev(cfg.UpDev, gateway)
-	if err != nil {
-		log.Fatalln(fmt.Errorf("find upstream device and gateway device: %w", err))
+	if cfg.PPPoE {
+		upDev, gatewayDev, err = pcap.FindPPPoEDevAndGatewayDev(cfg.UpDev)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("find pppoe device and gateway device: %w", err))
+		}
+		log.Infof("Route upstream in PPPoE session %d\n", upDev.PPPoE())
+	} else {
+		upDev, gatewayDev, err = pcap.FindUpstreamDevAndGatewayDev(cfg.UpDev, gateway)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("find upstream device and gateway device: %w", err))
+		}
 	}
 	if upDev == nil && gatewayDev == nil {
 		log.Fatalln(errors.New("cannot determine upstream device and gateway device"))
@@ -489,16 +1396,105 @@ type IPName struct {
 	if gatewayDev == nil {
 		log.Fatalln(errors.New("cannot determine gateway device"))
 	}
+	if cfg.VLAN > 0 {
+		upDev.SetVLAN(uint16(cfg.VLAN))
+		log.Infof("Tag upstream with VLAN %d\n", cfg.VLAN)
+	}
+
+	// Paths in multipath
+	multipathMode, err = pcap.ParseMultipathMode(cfg.Multipath)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse multipath: %w", err))
+	}
+	for _, s := range cfg.Paths {
+		path, err := parsePath(s)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse path %s: %w", s, err))
+		}
+		paths = append(paths, *path)
+	}
+	if len(paths) > 0 {
+		log.Infof("Transmit in multipath by %s\n", multipathMode)
+		for _, path := range paths {
+			log.Infof("  Route upstream from %s to %s\n", path.UpDev, path.GatewayDev)
+		}
+	}
+
+	// Static hardware addresses of next hops
+	macOverrides, err := pcap.ParseMACOverrides(cfg.StaticMAC)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse static mac: %w", err))
+	}
+	if hardwareAddr := macOverrides.OfIP(serverIP); hardwareAddr != nil {
+		gatewayDev.PinHardwareAddr(hardwareAddr)
+	} else if hardwareAddr := macOverrides.OfDev(upDev); hardwareAddr != nil {
+		gatewayDev.PinHardwareAddr(hardwareAddr)
+	}
+	if gatewayDev.IsPinned() {
+		log.Infof("Pin next hop of %s to %s\n", upDev.Alias(), gatewayDev.HardwareAddr())
+	}
+	for _, path := range paths {
+		if hardwareAddr := macOverrides.OfDev(path.UpDev); hardwareAddr != nil {
+			path.GatewayDev.PinHardwareAddr(hardwareAddr)
+			log.Infof("Pin next hop of %s to %s\n", path.UpDev.Alias(), hardwareAddr)
+		}
+	}
+
+	// Offloading
+	offloadDevs := append([]*pcap.Device{upDev}, listenDevs...)
+	for _, path := range paths {
+		offloadDevs = append(offloadDevs, path.UpDev)
+	}
+	checkOffloads(offloadDevs...)
+
+	// Keep the hardware address of the gateway
+	if !gatewayDev.IsLoop() {
+		go pcap.NewResolver(upDev).Keep(gatewayDev, 30*time.Second)
+	}
+	for _, path := range paths {
+		if !path.GatewayDev.IsLoop() {
+			go pcap.NewResolver(path.UpDev).Keep(path.GatewayDev, 30*time.Second)
+		}
+	}
 
 	// Wait signals
-	sig := make(chan os.Signal)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
-		<-sig
-		closeAll()
-		os.Exit(0)
+		for s := range sig {
+			// Reload
+			if s == syscall.SIGHUP {
+				_ = daemon.Reloading()
+				err := reload()
+				if err != nil {
+					log.Errorln(fmt.Errorf("reload: %w", err))
+				}
+				_ = daemon.Ready()
+				continue
+			}
+
+			_ = daemon.Stopping()
+			closeAll()
+			os.Exit(0)
+		}
 	}()
 
+	// Test speed once connected, and exit
+	if speedTest != nil {
+		go func() {
+			runSpeedTest(time.Duration(*argSpeedTest) * time.Second)
+			sig <- syscall.SIGTERM
+		}()
+	}
+
+	// Run as a service if started by the service manager
+	err = daemon.Serve(strings.ToLower(name), func() {
+		sig <- syscall.SIGTERM
+	})
+	if err != nil {
+		log.Errorln(fmt.Errorf("serve: %w", err))
+	}
+
 	// Open pcap
 	err = open()
 	if err != nil {
@@ -509,12 +1505,18 @@ type IPName struct {
 func open() error {
 	var err error
 
-	if len(listenDevs) == 1 {
-		log.Infof("Listen on %s\n", listenDevs[0].String())
+	if isTun {
+		err = openTun()
 	} else {
-		log.Infoln("Listen on:")
-		for _, dev := range listenDevs {
-			log.Infof("  %s\n", dev.String())
+		err = openListen()
+	}
+	if err != nil {
+		return err
+	}
+	if isRoute {
+		err = installRoutes()
+		if err != nil {
+			return fmt.Errorf("install routes: %w", err)
 		}
 	}
 	if !gatewayDev.IsLoop() {
@@ -523,127 +1525,1087 @@ func open() error {
 		log.Infof("Route upstream in %s\n", upDev)
 	}
 
-	// Filters for listening
-	fs := make([]string, 0)
-	for _, f := range sources {
-		s, err := addr.SrcBPFFilter(f)
+	// State
+	if statePath != "" {
+		n, err := restoreState()
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				log.Errorln(fmt.Errorf("restore state: %w", err))
+			}
+		} else if n > 0 {
+			log.Infof("Restore %d NAT entries from %s\n", n, statePath)
+		}
+
+		go func() {
+			ticker := time.NewTicker(30 * time.Second)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				if isClosed {
+					return
+				}
+
+				err := saveState()
+				if err != nil {
+					log.Errorln(fmt.Errorf("save state: %w", err))
+				}
+			}
+		}()
+
+		log.Infof("Save state to %s\n", statePath)
+	}
+
+	// Handle for routing upstream
+	conn, err := dial(&net.TCPAddr{IP: serverIP, Port: int(serverPort)}, currentHop())
+	if err != nil {
+		return fmt.Errorf("open upstream: %w", err)
+	}
+	upLock.Lock()
+	upConn = conn
+	upLock.Unlock()
+
+	// Re-resolve the server by its hostname
+	go resolveServer()
+
+	// Notify the service manager
+	err = daemon.Ready()
+	if err != nil {
+		log.Errorln(fmt.Errorf("notify ready: %w", err))
+	}
+
+	// Hop
+	if hop != nil {
+		go hopUpstream()
+	}
+
+	// MTU discovery
+	if mtuDiscovery > 0 {
+		go discoverMTU()
+	}
+
+	// Key rotation
+	if rekeyInterval > 0 || rekeySize > 0 {
+		go rotateKeys()
+	}
+
+	// Start handling
+	go func() {
+		for cp := range c {
+			cp := cp
+			pool.Submit(pcap.FlowHash(cp.Packet), func() {
+				err := handleListen(cp.Packet, cp.Conn)
+				if err != nil {
+					log.Errorln(fmt.Errorf("handle listen in device %s: %w", cp.Conn.LocalDev().Alias(), err))
+					reportError(err)
+					log.Verboseln(cp.Packet)
+				}
+			})
+		}
+	}()
+
+	go readUpstream(conn)
+
+	select {}
+}
+
+// runSpeedTest exchanges packets with the echo service of the server in the duration once connected, and reports the
+// throughput, the loss and the RTT through the tunnel.
+func runSpeedTest(d time.Duration) {
+	for upstream() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	log.Infof("Test speed with the server for %s\n", d)
+
+	start := time.Now()
+	for time.Since(start) < d {
+		data, err := speedTest.Next()
+		if err != nil {
+			log.Errorln(fmt.Errorf("speed test: %w", err))
+			break
+		}
+		// Wait for replies if the window is full
+		if data == nil {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		limiter.Wait(stat.DirectionOut, len(data))
+		_, err = upstream().Write(data)
+		if err != nil {
+			log.Errorln(fmt.Errorf("speed test: %w", fmt.Errorf("write: %w", err)))
+		}
+	}
+
+	// Wait for replies in flight
+	time.Sleep(speedTestTimeout)
+
+	result := speedTest.Result()
+	log.Infof("Speed test: %s, loss %.2f%% (%d/%d), RTT min/avg/max %s/%s/%s\n",
+		shape.FormatRate(result.Throughput(d)), result.Loss()*100, result.Lost, result.Sent,
+		result.MinRTT.Round(time.Microsecond), result.AvgRTT.Round(time.Microsecond), result.MaxRTT.Round(time.Microsecond))
+}
+
+// readUpstream reads packets from the connection for routing upstream until it is replaced in reloading or hopping.
+func readUpstream(conn *pcap.TunnelConn) {
+	b := make([]byte, pcap.IPv4MaxSize)
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			if isClosed {
+				return
+			}
+			// The connection is replaced in reloading or hopping
+			if conn != upstream() {
+				return
+			}
+			log.Errorln(fmt.Errorf("read upstream: %w", err))
+			continue
+		}
+
+		// The buffer will be reused, so bytes are copied
+		contents := make([]byte, n)
+		copy(contents, b[:n])
+		pool.Submit(pcap.EmbFlowHash(contents), func() {
+			err := handleUpstream(contents)
+			if err != nil {
+				log.Errorln(fmt.Errorf("handle upstream in address %s: %w", conn.LocalAddr().String(), err))
+				reportError(err)
+				log.Verbosef("Source: %s\nSize: %d Bytes\n\n", conn.RemoteAddr().String(), len(contents))
+			}
+		})
+	}
+}
+
+// hopUpstream reconnects to the server in the port of each slice of hopping, and closes the previous connection after
+// an interval, so packets in flight are still received.
+func hopUpstream() {
+	for {
+		time.Sleep(time.Until(currentHop().Next(time.Now())))
+		if isClosed {
+			return
+		}
+
+		upLock.RLock()
+		oldConn, h := upConn, hop
+		upLock.RUnlock()
+		port := h.Port(time.Now())
+		if a, ok := oldConn.RemoteAddr().(*net.TCPAddr); ok && a.Port == int(port) {
+			continue
+		}
+
+		conn, err := dial(&net.TCPAddr{IP: serverIP, Port: int(serverPort)}, h)
 		if err != nil {
-			return fmt.Errorf("parse filter %s: %w", f, err)
+			log.Errorln(fmt.Errorf("hop: %w", err))
+			continue
+		}
+
+		upLock.Lock()
+		replaced := upConn == oldConn
+		if replaced {
+			upConn = conn
 		}
+		upLock.Unlock()
+
+		// The connection is replaced in reloading meanwhile
+		if !replaced {
+			conn.Close()
+			continue
+		}
+		go readUpstream(conn)
+		log.Verbosef("Hop to %s\n", conn.RemoteAddr())
+
+		time.AfterFunc(h.Interval(), func() {
+			oldConn.Close()
+		})
+	}
+}
+
+// discoverMTU discovers the path MTU to the server after framing is negotiated and in every interval.
+func discoverMTU() {
+	// Wait for framing to be negotiated
+	time.Sleep(3 * time.Second)
+
+	var last int
+	for {
+		if isClosed {
+			return
+		}
+
+		n, err := upstream().DiscoverMTU(mtu)
+		if err != nil {
+			log.Errorln(fmt.Errorf("discover mtu: %w", err))
+		} else if n != last {
+			log.Infof("Discover MTU of %d Bytes to the server\n", n)
+			last = n
+		}
+
+		time.Sleep(mtuDiscovery)
+	}
+}
+
+// rotateKeys rotates keys of the connection to the server when the key is used for the interval or encrypts data in
+// the size.
+func rotateKeys() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if isClosed {
+			return
+		}
+
+		err := upstream().Rekey(rekeyInterval, rekeySize)
+		if err != nil {
+			log.Errorln(fmt.Errorf("rekey: %w", err))
+		}
+	}
+}
+
+// currentHop returns the hop of the server.
+func currentHop() *crypto.Hop {
+	upLock.RLock()
+	defer upLock.RUnlock()
+
+	return hop
+}
+
+// openListen opens handles for listening in listen devices.
+func openListen() error {
+	if len(listenDevs) == 1 {
+		log.Infof("Listen on %s\n", listenDevs[0].String())
+	} else {
+		log.Infoln("Listen on:")
+		for _, dev := range listenDevs {
+			log.Infof("  %s\n", dev.String())
+		}
+	}
+
+	// Filters for listening
+	filter, err := listenFilter()
+	if err != nil {
+		return fmt.Errorf("create listen filter: %w", err)
+	}
+
+	// Handles for listening
+	listenLock.Lock()
+	defer listenLock.Unlock()
+
+	for _, dev := range listenDevs {
+		conn, err := listen(dev, filter)
+		if err != nil {
+			return fmt.Errorf("open listen device %s: %w", dev.Alias(), err)
+		}
+
+		listenConns = append(listenConns, conn)
+	}
+
+	return nil
+}
+
+// routeJournal returns the path of the journal recording installed routes.
+func routeJournal() string {
+	return filepath.Join(os.TempDir(), "ikago-routes.json")
+}
+
+// installRoutes pins the route to the server via the gateway, and routes all traffic of the host in families of
+// sources to the TUN device.
+func installRoutes() error {
+	routes = route.NewManager(routeJournal())
+
+	err := pinServerRoute()
+	if err != nil {
+		return err
+	}
+
+	families := make(map[bool]bool)
+	for _, source := range sources {
+		families[source.IP.To4() == nil] = true
+	}
+	for _, ipv6 := range []bool{false, true} {
+		if !families[ipv6] {
+			continue
+		}
+		for _, r := range route.DefaultRoutes(tunDev.Name(), ipv6) {
+			err := routes.Add(r)
+			if err != nil {
+				return err
+			}
+			log.Infof("Add route %s\n", r)
+		}
+	}
+
+	return nil
+}
+
+// pinServerRoute pins the route to the server via the gateway, so packets to the server are not routed to the TUN
+// device.
+func pinServerRoute() error {
+	if gatewayDev.IsLoop() {
+		return nil
+	}
+
+	gateway := gatewayDev.IPAddrOf(serverIP)
+	if gateway == nil {
+		return nil
+	}
+	r := route.HostRoute(serverIP, gateway.IP, upDev.Alias())
+	err := routes.Add(r)
+	if err != nil {
+		return err
+	}
+	log.Infof("Add route %s\n", r)
+
+	return nil
+}
+
+// openTun opens a TUN device with addresses of sources, or a WinDivert handle intercepting them, and starts reading
+// from it.
+func openTun() error {
+	ips := make([]net.IP, 0, len(sources))
+	for _, source := range sources {
+		ips = append(ips, source.IP)
+	}
+
+	var dev hostDevice
+	if isDivert {
+		d, err := divert.Open(divert.Filter(ips, serverIP))
+		if err != nil {
+			return fmt.Errorf("open windivert: %w", err)
+		}
+		dev = d
+	} else {
+		d, err := tun.Open(ips)
+		if err != nil {
+			return fmt.Errorf("open tun device: %w", err)
+		}
+		dev = d
+	}
+	tunDev = dev
+	log.Infof("Listen on %s\n", dev.Name())
+
+	go func() {
+		for {
+			b := make([]byte, pcap.IPv4MaxSize)
+
+			n, err := dev.Read(b)
+			if err != nil {
+				if isClosed {
+					return
+				}
+				log.Errorln(fmt.Errorf("read tun device %s: %w", dev.Name(), err))
+				continue
+			}
+
+			contents := b[:n]
+			pool.Submit(pcap.EmbFlowHash(contents), func() {
+				err := handleTun(contents)
+				if err != nil {
+					log.Errorln(fmt.Errorf("handle tun device %s: %w", dev.Name(), err))
+					reportError(err)
+					log.Verbosef("Size: %d Bytes\n\n", len(contents))
+				}
+			})
+		}
+	}()
+
+	return nil
+}
+
+// listenFilter returns the BPF filter for listening.
+func listenFilter() (string, error) {
+	fs := make([]string, 0)
+	for _, f := range sources {
+		s, err := addr.SrcBPFFilter(f)
+		if err != nil {
+			return "", fmt.Errorf("parse filter %s: %w", f, err)
+		}
+
+		fs = append(fs, s)
+	}
+	f := strings.Join(fs, " || ")
+	ports := fmt.Sprintf("port %d", serverPort)
+	if h := currentHop(); h != nil {
+		min, max := h.Range()
+		ports = fmt.Sprintf("portrange %d-%d", min, max)
+	}
+	filter := fmt.Sprintf("ip && (((tcp || udp) && (%s) && not (src host %s && src %s)) || ((not (tcp || udp) || (ip[6:2] & 0x1fff) != 0) && (%s) && not src host %s))",
+		f, serverIP, ports, f, serverIP)
+	if customFilter != "" {
+		filter = fmt.Sprintf("(%s) && (%s)", filter, customFilter)
+	}
+	// Who-has queries for published addresses
+	for _, ip := range publishIPs {
+		s, err := addr.DstBPFFilter(&net.IPAddr{IP: ip})
+		if err != nil {
+			return "", fmt.Errorf("parse filter %s: %w", ip, err)
+		}
+		filter = filter + fmt.Sprintf(" || (arp[6:2] = 1 && %s)", s)
+	}
+
+	return filter, nil
+}
+
+// listen opens a handle for listening in the device and starts reading from it.
+func listen(dev *pcap.Device, filter string) (pcap.PacketConn, error) {
+	var (
+		err  error
+		conn *pcap.RawConn
+	)
+
+	if dev.IsLoop() {
+		conn, err = pcap.CreateRawConn(dev, dev, filter)
+	} else {
+		conn, err = pcap.CreateRawConn(dev, gatewayDev, filter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.EnableSegmentation()
+
+	go func() {
+		for {
+			packet, err := conn.ReadPacket()
+			if err != nil {
+				if isClosed || !isListening(conn) {
+					return
+				}
+				log.Errorln(fmt.Errorf("read listen device %s: %w", conn.LocalDev().Alias(), err))
+				continue
+			}
+
+			c <- pcap.ConnPacket{Packet: packet, Conn: conn}
+		}
+	}()
+
+	return conn, nil
+}
+
+// isListening returns if the handle is still used for listening.
+func isListening(conn pcap.PacketConn) bool {
+	listenLock.RLock()
+	defer listenLock.RUnlock()
+
+	for _, listenConn := range listenConns {
+		if listenConn == conn {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dial opens a connection for routing upstream to the server, in the port of the current slice if hopping.
+func dial(serverAddr *net.TCPAddr, h *crypto.Hop) (*pcap.TunnelConn, error) {
+	// Dial the port of the slice in hopping
+	if h != nil {
+		serverAddr = &net.TCPAddr{IP: serverAddr.IP, Port: int(h.Port(time.Now()))}
+	}
+
+	tunnelConfig := &pcap.TunnelConfig{
+		UpDev:         upDev,
+		GatewayDev:    gatewayDev,
+		Port:          upPort,
+		Mode:          mode,
+		Crypt:         crypt,
+		Auth:          auth,
+		MTU:           mtu,
+		Batch:         batch,
+		BatchInterval: batchInterval,
+		Frame:         isFrame,
+		Id:            id,
+		UserAuth:      userAuth,
+		Paths:         paths,
+		MultipathMode: multipathMode,
+		Token:         resumeToken(),
+	}
+	if isKCP {
+		tunnelConfig.KCPConfig = kcpConfig
+	}
+	if mode == "websocket" {
+		tunnelConfig.WebSocketConfig = wsConfig
+	}
+
+	return pcap.DialTunnel(serverAddr, tunnelConfig)
+}
+
+// resumeToken returns the token of resumption issued by the server in the connection for routing upstream, or the one
+// restored from the state file if there is not.
+func resumeToken() []byte {
+	up := upstream()
+	if up != nil {
+		token := up.Token()
+		if token != nil {
+			return token
+		}
+	}
+
+	return savedToken
+}
+
+// upstream returns the connection for routing upstream.
+func upstream() *pcap.TunnelConn {
+	upLock.RLock()
+	defer upLock.RUnlock()
+
+	return upConn
+}
+
+// switchServer reconnects to the server in the address, and closes the previous connection. It should be called with
+// the server locked.
+func switchServer(serverAddr *net.TCPAddr) error {
+	if isRule {
+		err := exec.AddSpecificFirewallRule(serverAddr.IP, uint16(serverAddr.Port))
+		if err != nil {
+			log.Errorln(fmt.Errorf("add firewall rule: %w", err))
+		} else {
+			log.Infoln("Add firewall rule")
+		}
+	}
+
+	// Hop from the new port
+	newHop := currentHop()
+	if newHop != nil {
+		newHop = newHop.WithBase(uint16(serverAddr.Port))
+		_, max := newHop.Range()
+		if max < uint16(serverAddr.Port) {
+			return fmt.Errorf("hop ports of server %s out of range", serverAddr)
+		}
+	}
+
+	conn, err := dial(serverAddr, newHop)
+	if err != nil {
+		return fmt.Errorf("open upstream: %w", err)
+	}
+
+	upLock.Lock()
+	oldConn := upConn
+	upConn = conn
+	hop = newHop
+	upLock.Unlock()
+	serverIP = serverAddr.IP
+	serverPort = uint16(serverAddr.Port)
+
+	oldConn.Close()
+	go readUpstream(conn)
+
+	log.Infof("Proxy to %s\n", serverAddr)
+
+	return nil
+}
+
+// resolveServer re-resolves the server by its hostname in the interval of the TTL of its records, and switches to a
+// new address once the current one is not in the records any more, so servers behind dynamic DNS keep working.
+func resolveServer() {
+	interval := minResolveServer
+	for {
+		time.Sleep(interval)
+		if isClosed {
+			return
+		}
+
+		serverLock.Lock()
+		host := serverHost
+		serverLock.Unlock()
+		if host == "" {
+			interval = minResolveServer
+			continue
+		}
+
+		ips, ttl, err := addr.LookupIPTTL(host)
+		if err != nil {
+			log.Errorln(fmt.Errorf("resolve server %s: %w", host, err))
+			interval = minResolveServer
+			continue
+		}
+		interval = ttl
+		if interval < minResolveServer {
+			interval = minResolveServer
+		} else if interval > maxResolveServer {
+			interval = maxResolveServer
+		}
+
+		err = switchServerIP(host, ips)
+		if err != nil {
+			log.Errorln(fmt.Errorf("switch server %s: %w", host, err))
+			interval = minResolveServer
+		}
+	}
+}
+
+// switchServerIP switches to an IP of the server resolved by its hostname if the current IP is not one of them. IPs in
+// the family of the current one are preferred, so filters of sources still apply.
+func switchServerIP(host string, ips []net.IP) error {
+	serverLock.Lock()
+	defer serverLock.Unlock()
+
+	// The server is changed in reloading meanwhile
+	if host != serverHost {
+		return nil
+	}
+
+	var ip net.IP
+	for _, i := range ips {
+		if i.Equal(serverIP) {
+			return nil
+		}
+		if ip == nil && (i.To4() == nil) == (serverIP.To4() == nil) {
+			ip = i
+		}
+	}
+	if ip == nil {
+		ip = ips[0]
+	}
+	log.Infof("Server %s resolves to %s\n", host, ip)
+
+	err := switchServer(&net.TCPAddr{IP: ip, Port: int(serverPort)})
+	if err != nil {
+		return err
+	}
+
+	// Filters of listen devices exclude packets from the server
+	if isDivert {
+		log.Warnln("Filter of WinDivert cannot be updated, restart to apply the new server")
+		return nil
+	}
+	if isTun {
+		if isRoute {
+			return pinServerRoute()
+		}
+		return nil
+	}
+	filter, err := listenFilter()
+	if err != nil {
+		return fmt.Errorf("create listen filter: %w", err)
+	}
+
+	listenLock.Lock()
+	defer listenLock.Unlock()
+
+	for _, conn := range listenConns {
+		err := conn.SetBPFFilter(filter)
+		if err != nil {
+			log.Errorln(fmt.Errorf("set filter of listen device %s: %w", conn.LocalDev().Alias(), err))
+		}
+	}
+
+	return nil
+}
+
+// hostOf returns the hostname of the server, empty if the server is designated by its IP.
+func hostOf(server string) string {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil || net.ParseIP(host) != nil {
+		return ""
+	}
+
+	return host
+}
+
+// reload reloads sources, listen devices and the server from the configuration file. Handles of listen devices which
+// are not changed are kept with their filters recompiled, and the connection to the server is reopened only if the
+// server is changed. NAT is kept in reloading.
+func reload() error {
+	if *argConfig == "" {
+		return errors.New("missing configuration file")
+	}
+
+	cfg, err := config.ParseFile(*argConfig)
+	if err != nil {
+		return fmt.Errorf("parse config file %s: %w", *argConfig, err)
+	}
+	log.Infof("Reload configuration from %s\n", *argConfig)
+
+	newSources, err := parseSources(cfg.Sources)
+	if err != nil {
+		return err
+	}
+
+	var newListenDevs []*pcap.Device
+	if !isTun {
+		newListenDevs, err = findListenDevs(cfg.ListenDevs)
+		if err != nil {
+			return err
+		}
+	}
+
+	serverAddr, err := addr.ParseTCPAddr(cfg.Server)
+	if err != nil {
+		return fmt.Errorf("parse server %s: %w", cfg.Server, err)
+	}
+
+	// Server
+	serverLock.Lock()
+	isRule = cfg.Rule
+	serverHost = hostOf(cfg.Server)
+	if !serverAddr.IP.Equal(serverIP) || uint16(serverAddr.Port) != serverPort {
+		err := switchServer(serverAddr)
+		if err != nil {
+			serverLock.Unlock()
+			return err
+		}
+	}
+	serverLock.Unlock()
+
+	// Sources, addresses of the TUN device are kept
+	if isTun {
+		changed := len(newSources) != len(sources)
+		for i := 0; !changed && i < len(sources); i++ {
+			changed = !newSources[i].IP.Equal(sources[i].IP)
+		}
+		if changed {
+			log.Warnln("Sources of TUN device cannot be reloaded")
+		}
+		return nil
+	}
+	sources = newSources
+
+	filter, err := listenFilter()
+	if err != nil {
+		return fmt.Errorf("create listen filter: %w", err)
+	}
+
+	// Listen devices
+	listenLock.Lock()
+	defer listenLock.Unlock()
+
+	conns := make([]pcap.PacketConn, 0)
+	opened := make(map[string]bool)
+	for _, conn := range listenConns {
+		if !containsDev(newListenDevs, conn.LocalDev()) {
+			conn.Close()
+			log.Infof("Stop listening on %s\n", conn.LocalDev())
+			continue
+		}
+
+		err := conn.SetBPFFilter(filter)
+		if err != nil {
+			log.Errorln(fmt.Errorf("set filter of listen device %s: %w", conn.LocalDev().Alias(), err))
+		}
+		conns = append(conns, conn)
+		opened[conn.LocalDev().Name()] = true
+	}
+	for _, dev := range newListenDevs {
+		if opened[dev.Name()] {
+			continue
+		}
+
+		conn, err := listen(dev, filter)
+		if err != nil {
+			log.Errorln(fmt.Errorf("open listen device %s: %w", dev.Alias(), err))
+			continue
+		}
+		conns = append(conns, conn)
+		log.Infof("Listen on %s\n", dev)
+	}
+	listenConns = conns
+	listenDevs = newListenDevs
+
+	return nil
+}
+
+// parseSources returns the addresses of sources.
+// parsePath returns the path in multipath of the device, or of the device and the gateway in the form of
+// device@gateway.
+func parsePath(s string) (*pcap.TunnelPath, error) {
+	name, gw := s, ""
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		name, gw = s[:i], s[i+1:]
+	}
+
+	var gateway net.IP
+	if gw != "" {
+		gateway = net.ParseIP(gw)
+		if gateway == nil {
+			return nil, fmt.Errorf("invalid gateway %s", gw)
+		}
+	}
+
+	upDev, gatewayDev, err := pcap.FindUpstreamDevAndGatewayDev(name, gateway)
+	if err != nil {
+		return nil, fmt.Errorf("find upstream device and gateway device: %w", err)
+	}
+	if upDev == nil || gatewayDev == nil {
+		return nil, errors.New("cannot determine upstream device and gateway device")
+	}
+
+	return &pcap.TunnelPath{UpDev: upDev, GatewayDev: gatewayDev}, nil
+}
+
+func parseSources(ss []string) ([]*net.IPAddr, error) {
+	result := make([]*net.IPAddr, 0)
+
+	for _, source := range ss {
+		ip := net.ParseIP(source)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid source %s", source)
+		}
+		result = append(result, &net.IPAddr{IP: ip})
+	}
+
+	return result, nil
+}
+
+// findListenDevs returns the devices for listening, loopback devices are excluded if no device is designated.
+func findListenDevs(names []string) ([]*pcap.Device, error) {
+	devs, err := pcap.FindListenDevs(names)
+	if err != nil {
+		return nil, fmt.Errorf("find listen devices: %w", err)
+	}
+	if len(names) <= 0 {
+		// Remove loopback devices by default
+		result := make([]*pcap.Device, 0)
+
+		for _, dev := range devs {
+			if dev.IsLoop() {
+				continue
+			}
+			result = append(result, dev)
+		}
+
+		devs = result
+	}
+	if len(devs) <= 0 {
+		return nil, errors.New("cannot determine listen device")
+	}
+
+	return devs, nil
+}
+
+func containsDev(devs []*pcap.Device, dev *pcap.Device) bool {
+	for _, d := range devs {
+		if d.Name() == dev.Name() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func closeAll() {
+	isClosed = true
+	log.StopStatus()
+	if statePath != "" {
+		err := saveState()
+		if err != nil {
+			log.Errorln(fmt.Errorf("save state: %w", err))
+		}
+	}
+	if controlServer != nil {
+		controlServer.Close()
+	}
+	if hooks != nil {
+		hooks.Close()
+	}
+	listenLock.RLock()
+	for _, handle := range listenConns {
+		if handle != nil {
+			handle.Close()
+		}
+	}
+	listenLock.RUnlock()
+	if routes != nil {
+		err := routes.Revert()
+		if err != nil {
+			log.Errorln(fmt.Errorf("revert routes: %w", err))
+		}
+	}
+	if tunDev != nil {
+		tunDev.Close()
+	}
+	if conn := upstream(); conn != nil {
+		conn.Close()
+	}
+	if dumper != nil {
+		dumper.Close()
+	}
+	if isRSTRule {
+		err := exec.DeleteRSTRule(upPort)
+		if err != nil {
+			log.Errorln(fmt.Errorf("delete rst rule: %w", err))
+		}
+	}
+}
+
+// saveState saves the upstream port and sources in NAT to the state file.
+func saveState() error {
+	state := clientState{
+		Port:  upPort,
+		Token: hex.EncodeToString(resumeToken()),
+		NAT:   make([]natEntryState, 0),
+	}
+
+	natLock.RLock()
+	for src, ni := range nat {
+		state.NAT = append(state.NAT, natEntryState{
+			Source:          src,
+			SrcHardwareAddr: ni.srcHardwareAddr.String(),
+			VLAN:            ni.vlan,
+			Device:          ni.conn.LocalDev().Name(),
+		})
+	}
+	natLock.RUnlock()
 
-		fs = append(fs, s)
+	return config.SaveState(statePath, &state)
+}
+
+// restoreState restores sources in NAT from the state file, and returns the number of restored sources. Sources in
+// devices which are not listened any more are skipped.
+func restoreState() (int, error) {
+	var state clientState
+	err := config.LoadState(statePath, &state)
+	if err != nil {
+		return 0, err
 	}
-	f := strings.Join(fs, " || ")
-	filter := fmt.Sprintf("ip && (((tcp || udp) && (%s) && not (src host %s && src port %d)) || ((icmp || (ip[6:2] & 0x1fff) != 0) && (%s) && not src host %s))",
-		f, serverIP, serverPort, f, serverIP)
-	if publishIP != nil {
-		s, err := addr.DstBPFFilter(publishIP)
+
+	// Resume the session in the server even if the address is changed
+	if state.Token != "" {
+		token, err := hex.DecodeString(state.Token)
 		if err != nil {
-			return fmt.Errorf("parse filter %s: %w", f, err)
+			return 0, fmt.Errorf("parse token: %w", err)
 		}
-		filter = filter + fmt.Sprintf(" || (arp[6:2] = 1 && %s)", s)
+		savedToken = token
 	}
 
-	// Handles for listening
-	for _, dev := range listenDevs {
-		var (
-			err  error
-			conn *pcap.RawConn
-		)
+	listenLock.RLock()
+	defer listenLock.RUnlock()
+	natLock.Lock()
+	defer natLock.Unlock()
 
-		if dev.IsLoop() {
-			conn, err = pcap.CreateRawConn(dev, dev, filter)
-		} else {
-			conn, err = pcap.CreateRawConn(dev, gatewayDev, filter)
-		}
-		if err != nil {
-			return fmt.Errorf("open listen device %s: %w", conn.LocalDev().Alias(), err)
+	n := 0
+	for _, e := range state.NAT {
+		if _, ok := nat[e.Source]; ok {
+			continue
 		}
 
-		listenConns = append(listenConns, conn)
-	}
+		var conn pcap.PacketConn
+		for _, listenConn := range listenConns {
+			if listenConn.LocalDev().Name() == e.Device {
+				conn = listenConn
+				break
+			}
+		}
+		if conn == nil {
+			continue
+		}
 
-	// Handle for routing upstream
-	switch mode {
-	case "faketcp":
-		if isKCP {
-			upConn, err = pcap.DialFakeTCPWithKCP(upDev, gatewayDev, upPort, &net.TCPAddr{IP: serverIP, Port: int(serverPort)}, crypt, mtu, kcpConfig)
-		} else {
-			upConn, err = pcap.DialFakeTCP(upDev, gatewayDev, upPort, &net.TCPAddr{IP: serverIP, Port: int(serverPort)}, crypt, mtu)
+		// Sources in loopback devices have no hardware addresses
+		var hardwareAddr net.HardwareAddr
+		if e.SrcHardwareAddr != "" {
+			hardwareAddr, err = net.ParseMAC(e.SrcHardwareAddr)
+			if err != nil {
+				return n, fmt.Errorf("parse hardware address %s: %w", e.SrcHardwareAddr, err)
+			}
 		}
-	case "tcp":
-		upConn, err = pcap.DialTCP(upDev, upPort, &net.TCPAddr{IP: serverIP, Port: int(serverPort)}, crypt)
-	default:
-		err = fmt.Errorf("mode %s not support", mode)
+
+		nat[e.Source] = &natIndicator{srcHardwareAddr: hardwareAddr, vlan: e.VLAN, conn: conn}
+		n++
 	}
+
+	return n, nil
+}
+
+// replay reads packets from a pcap file and passes them through the encapsulation and the decapsulation offline.
+func replay(path string) error {
+	var total, passed, skipped, failed int
+
+	reader, err := pcap.CreateReader(path)
 	if err != nil {
-		return fmt.Errorf("open upstream: %w", err)
+		return fmt.Errorf("open: %w", err)
 	}
+	defer reader.Close()
 
-	// Start handling
-	for i := 0; i < len(listenConns); i++ {
-		conn := listenConns[i]
-
-		go func() {
-			for {
-				packet, err := conn.ReadPacket()
-				if err != nil {
-					if isClosed {
-						return
-					}
-					log.Errorln(fmt.Errorf("read listen device %s: %w", conn.LocalDev().Alias(), err))
-					continue
-				}
+	log.Infof("Replay packets from %s\n", path)
 
-				c <- pcap.ConnPacket{Packet: packet, Conn: conn}
+	for {
+		packet, err := reader.ReadPacket()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
 			}
-		}()
-	}
+			return fmt.Errorf("read packet: %w", err)
+		}
+		total++
 
-	go func() {
-		for cp := range c {
-			err := handleListen(cp.Packet, cp.Conn)
+		if dumper != nil {
+			err := dumper.Write("replay", reader.LinkType(), packet.Data())
 			if err != nil {
-				log.Errorln(fmt.Errorf("handle listen in device %s: %w", cp.Conn.LocalDev().Alias(), err))
-				log.Verboseln(cp.Packet)
-				continue
+				log.Errorln(fmt.Errorf("dump: %w", err))
 			}
 		}
-	}()
 
-	b := make([]byte, pcap.IPv4MaxSize)
-	for {
-		n, err := upConn.Read(b)
+		// Parse packet
+		indicator, err := pcap.ParsePacket(packet)
 		if err != nil {
-			if isClosed {
-				return nil
-			}
-			log.Errorln(fmt.Errorf("read upstream: %w", err))
+			skipped++
+			log.Verbosef("Skip packet %d: %v\n", total, err)
+			continue
+		}
+		if indicator.NetworkLayer().LayerType() == layers.LayerTypeARP {
+			skipped++
+			log.Verbosef("Skip packet %d: %s\n", total, indicator.NetworkLayer().LayerType())
 			continue
 		}
 
-		err = handleUpstream(b[:n])
+		err = replayPacket(indicator)
 		if err != nil {
-			log.Errorln(fmt.Errorf("handle upstream in address %s: %w", upConn.LocalAddr().String(), err))
-			log.Verbosef("Source: %s\nSize: %d Bytes\n\n", upConn.RemoteAddr().String(), n)
+			failed++
+			log.Errorln(fmt.Errorf("replay packet %d: %w", total, err))
 			continue
 		}
+		passed++
+
+		log.Verbosef("Replay an outbound %s packet: %s -> %s (%d Bytes)\n",
+			indicator.TransportProtocol(), indicator.Src().String(), indicator.Dst().String(), indicator.MTU())
 	}
+
+	log.Infof("Replay %d packets: %d passed, %d skipped, %d failed\n", total, passed, skipped, failed)
+
+	return nil
 }
 
-func closeAll() {
-	isClosed = true
-	for _, handle := range listenConns {
-		if handle != nil {
-			handle.Close()
+// replayPacket encapsulates a packet as it is sent to the server, decapsulates it as it is received from the client,
+// and verifies the result.
+func replayPacket(indicator *pcap.PacketIndicator) error {
+	data := make([]byte, 0, indicator.MTU())
+	data = append(data, indicator.NetworkData()...)
+
+	// Encapsulate
+	encrypted, err := crypt.Encrypt(data)
+	if err != nil {
+		return fmt.Errorf("encrypt: %w", err)
+	}
+
+	// Decapsulate
+	decrypted, err := crypt.Decrypt(encrypted)
+	if err != nil {
+		return fmt.Errorf("decrypt: %w", err)
+	}
+	if !bytes.Equal(decrypted, data) {
+		return errors.New("decapsulated packet mismatch")
+	}
+
+	if dumper != nil {
+		err := dumper.Write("replay-decapsulated", layers.LinkTypeRaw, decrypted)
+		if err != nil {
+			log.Errorln(fmt.Errorf("dump: %w", err))
 		}
 	}
-	if upConn != nil {
-		upConn.Close()
+
+	// Parse embedded packet
+	embIndicator, err := pcap.ParseEmbPacket(decrypted)
+	if err != nil {
+		return fmt.Errorf("parse embedded packet: %w", err)
+	}
+	err = embIndicator.VerifyChecksum()
+	if err != nil {
+		return fmt.Errorf("verify checksum: %w", err)
 	}
+
+	return nil
 }
 
-func publish(packet gopacket.Packet, conn *pcap.RawConn) error {
+func publish(packet gopacket.Packet, conn pcap.PacketConn) error {
 	var (
 		indicator    *pcap.PacketIndicator
 		arpLayer     *layers.ARP
@@ -659,11 +2621,17 @@ func publish(packet gopacket.Packet, conn *pcap.RawConn) error {
 	}
 
 	if t := indicator.NetworkLayer().LayerType(); t != layers.LayerTypeARP {
-		return fmt.Errorf("network layer type %s not support", t)
+		return pcap.NewError(pcap.ErrUnsupportedLayer, "network layer type %s not support", t)
 	}
 
-	// Create new ARP layer
+	// Only who-has queries for published addresses are replied, excluding gratuitous ones announced by their owners
 	arpLayer = indicator.ARPLayer()
+	if arpLayer.Operation != layers.ARPRequest || !isPublished(arpLayer.DstProtAddress) ||
+		net.IP(arpLayer.SourceProtAddress).Equal(arpLayer.DstProtAddress) {
+		return nil
+	}
+
+	// Create new ARP layer
 	newARPLayer = &layers.ARP{
 		AddrType:          arpLayer.AddrType,
 		Protocol:          arpLayer.Protocol,
@@ -687,11 +2655,21 @@ func publish(packet gopacket.Packet, conn *pcap.RawConn) error {
 			EthernetType: linkLayer.(*layers.Ethernet).EthernetType,
 		}
 	default:
-		return fmt.Errorf("link layer type %s not support", t)
+		return pcap.NewError(pcap.ErrUnsupportedLayer, "link layer type %s not support", t)
+	}
+
+	// Serialize layers, with the tag of the request preserved
+	var data []byte
+	dot1qLayer := indicator.Dot1QLayer()
+	if dot1qLayer != nil {
+		data, err = pcap.Serialize(newLinkLayer, &layers.Dot1Q{
+			Priority:       dot1qLayer.Priority,
+			VLANIdentifier: dot1qLayer.VLANIdentifier,
+			Type:           dot1qLayer.Type,
+		}, newARPLayer)
+	} else {
+		data, err = pcap.Serialize(newLinkLayer, newARPLayer)
 	}
-
-	// Serialize layers
-	data, err := pcap.Serialize(newLinkLayer, newARPLayer)
 	if err != nil {
 		return fmt.Errorf("serialize: %w", err)
 	}
@@ -699,17 +2677,13 @@ func publish(packet gopacket.Packet, conn *pcap.RawConn) error {
 	// Write packet data
 	_, err = conn.Write(data)
 	if err != nil {
-		return fmt.Errorf("write: %w", err)
+		return pcap.WrapError(pcap.ErrWrite, fmt.Errorf("write: %w", err))
 	}
 
 	// Reconnect
-	if upConn != nil {
-		switch upConn.(type) {
-		case *pcap.FakeTCPConn:
-			err = upConn.(*pcap.FakeTCPConn).Reconnect()
-		default:
-			break
-		}
+	up := upstream()
+	if up != nil {
+		err = up.Reconnect()
 	}
 	if err != nil {
 		return fmt.Errorf("reconnect: %w", err)
@@ -721,12 +2695,28 @@ func publish(packet gopacket.Packet, conn *pcap.RawConn) error {
 	return nil
 }
 
-func handleListen(packet gopacket.Packet, conn *pcap.RawConn) error {
+// isPublished returns if the IP is published in ARP.
+func isPublished(ip net.IP) bool {
+	for _, publishIP := range publishIPs {
+		if publishIP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func handleListen(packet gopacket.Packet, conn pcap.PacketConn) error {
 	var (
 		hardwareAddr net.HardwareAddr
 		data         []byte
 	)
 
+	// Skip packets injected by itself
+	if loopGuard.Seen(packet.Data()) {
+		return nil
+	}
+
 	// Parse packet
 	indicator, err := pcap.ParsePacket(packet)
 	if err != nil {
@@ -742,25 +2732,177 @@ func handleListen(packet gopacket.Packet, conn *pcap.RawConn) error {
 		return nil
 	}
 
+	// Multicast and broadcast packets are only tunneled in multicast mode
+	if !isMulticast && pcap.IsMulticast(indicator.DstIP()) {
+		log.Packetf(false, "Drop an outbound %s multicast packet: %s -> %s\n",
+			indicator.TransportProtocol(), indicator.Src().String(), indicator.Dst().String())
+		return nil
+	}
+
 	// Record source hardware address
 	hardwareAddr = indicator.SrcHardwareAddr()
 
-	data = make([]byte, 0)
-	data = append(data, packet.NetworkLayer().LayerContents()...)
-	data = append(data, packet.NetworkLayer().LayerPayload()...)
+	// Network layers are copied as they are, so options of inner packets pass through
+	data = make([]byte, 0, indicator.MTU())
+	data = append(data, indicator.NetworkData()...)
+
+	// Clamp MSS of SYN segments from sources
+	if clampMSS > 0 {
+		pcap.ClampMSS(data, clampMSS)
+	}
+
+	// Clamp window of segments from sources
+	if windowClamp != nil {
+		windowClamp.Clamp(data)
+	}
+
+	// Hooks
+	first := false
+	if hooks != nil {
+		var allowed bool
+		allowed, first = hooks.Packet(indicator.TransportProtocol().String(), indicator.Src().String(), indicator.Dst().String(), stat.DirectionOut, data)
+		if !allowed {
+			log.Packetf(first, "Drop an outbound %s packet by hooks: %s -> %s\n",
+				indicator.TransportProtocol(), indicator.Src().String(), indicator.Dst().String())
+			return nil
+		}
+	}
+
+	// Rate limit
+	if !limiter.Allow(indicator.SrcIP().String(), stat.DirectionOut, len(data)) {
+		log.Packetf(false, "Drop an outbound %s packet exceeding the limit: %s -> %s (%d Bytes)\n",
+			indicator.TransportProtocol(), indicator.Src().String(), indicator.Dst().String(), len(data))
+		return nil
+	}
 
 	// Write packet data
-	_, err = upConn.Write(data)
+	err = writeUpstream(indicator, data)
 	if err != nil {
-		return fmt.Errorf("write: %w", err)
+		return pcap.WrapError(pcap.ErrWrite, fmt.Errorf("write: %w", err))
 	}
 
 	// Record the connection of the packet
+	natLock.Lock()
 	ni, ok := nat[indicator.SrcIP().String()]
-	if !ok || ni.srcHardwareAddr.String() != hardwareAddr.String() {
-		natLock.Lock()
-		nat[indicator.SrcIP().String()] = &natIndicator{srcHardwareAddr: hardwareAddr, conn: conn}
-		natLock.Unlock()
+	if !ok || ni.srcHardwareAddr.String() != hardwareAddr.String() || ni.vlan != indicator.VLAN() {
+		nat[indicator.SrcIP().String()] = &natIndicator{srcHardwareAddr: hardwareAddr, vlan: indicator.VLAN(), conn: conn}
+	}
+	natLock.Unlock()
+
+	// Statistics
+	size := indicator.MTU()
+	if monitor != nil {
+		monitor.AddBidirectional(indicator.SrcIP().String(), indicator.DstIP().String(), stat.DirectionOut, uint(size))
+	}
+	if flows != nil {
+		flows.Add(indicator.TransportProtocol().String(), indicator.Src().String(), indicator.Dst().String(), stat.DirectionOut, uint(size))
+	}
+
+	log.Packetf(first, "Redirect an outbound %s packet: %s -> %s (%d Bytes)\n",
+		indicator.TransportProtocol(), indicator.Src().String(), indicator.Dst().String(), size)
+
+	return nil
+}
+
+// classify returns the class of the packet in scheduling by rules of priority.
+func classify(indicator *pcap.PacketIndicator, size int) shape.Class {
+	p := &shape.Packet{Size: size}
+	if ipv4Layer := indicator.IPv4Layer(); ipv4Layer != nil {
+		p.DSCP = ipv4Layer.TOS >> 2
+	} else if ipv6Layer := indicator.IPv6Layer(); ipv6Layer != nil {
+		p.DSCP = ipv6Layer.TrafficClass >> 2
+	}
+
+	// Ports are only available in unfragmented packets
+	if !indicator.IsFrag() {
+		switch t := indicator.TransportProtocol(); t {
+		case layers.LayerTypeTCP:
+			p.Protocol, p.SrcPort, p.DstPort = t, indicator.SrcPort(), indicator.DstPort()
+			p.Payload = len(indicator.TCPLayer().Payload)
+		case layers.LayerTypeUDP:
+			p.Protocol, p.SrcPort, p.DstPort = t, indicator.SrcPort(), indicator.DstPort()
+		}
+	}
+
+	return shape.Classify(priorityRules, p)
+}
+
+// writeUpstream writes the packet data to the upstream. The packet is scheduled in its class if rules of priority exist,
+// in which errors are only logged as it is written asynchronously.
+func writeUpstream(indicator *pcap.PacketIndicator, data []byte) error {
+	if scheduler == nil {
+		limiter.Wait(stat.DirectionOut, len(data))
+
+		_, err := upstream().Write(data)
+		return err
+	}
+
+	scheduler.Schedule(classify(indicator, len(data)), len(data), func() {
+		_, err := upstream().Write(data)
+		if err != nil {
+			err = pcap.WrapError(pcap.ErrWrite, fmt.Errorf("write: %w", err))
+			log.Errorln(err)
+			reportError(err)
+		}
+	})
+
+	return nil
+}
+
+// reportError notifies hooks of the error in handling packets.
+func reportError(err error) {
+	if hooks != nil {
+		hooks.Error(err)
+	}
+}
+
+func handleTun(contents []byte) error {
+	// Parse packet
+	indicator, err := pcap.ParseEmbPacket(contents)
+	if err != nil {
+		return fmt.Errorf("parse packet: %w", err)
+	}
+
+	// Multicast and broadcast packets are only tunneled in multicast mode
+	if !isMulticast && pcap.IsMulticast(indicator.DstIP()) {
+		log.Packetf(false, "Drop an outbound %s multicast packet: %s -> %s\n",
+			indicator.TransportProtocol(), indicator.Src().String(), indicator.Dst().String())
+		return nil
+	}
+
+	// Hooks
+	first := false
+	if hooks != nil {
+		var allowed bool
+		allowed, first = hooks.Packet(indicator.TransportProtocol().String(), indicator.Src().String(), indicator.Dst().String(), stat.DirectionOut, contents)
+		if !allowed {
+			log.Packetf(first, "Drop an outbound %s packet by hooks: %s -> %s\n",
+				indicator.TransportProtocol(), indicator.Src().String(), indicator.Dst().String())
+			return nil
+		}
+	}
+
+	// Rate limit
+	if !limiter.Allow(indicator.SrcIP().String(), stat.DirectionOut, len(contents)) {
+		log.Packetf(false, "Drop an outbound %s packet exceeding the limit: %s -> %s (%d Bytes)\n",
+			indicator.TransportProtocol(), indicator.Src().String(), indicator.Dst().String(), len(contents))
+		return nil
+	}
+
+	// Clamp MSS of SYN segments from sources
+	if clampMSS > 0 {
+		pcap.ClampMSS(contents, clampMSS)
+	}
+
+	// Clamp window of segments from sources
+	if windowClamp != nil {
+		windowClamp.Clamp(contents)
+	}
+
+	// Write packet data
+	err = writeUpstream(indicator, contents)
+	if err != nil {
+		return pcap.WrapError(pcap.ErrWrite, fmt.Errorf("write: %w", err))
 	}
 
 	// Statistics
@@ -768,19 +2910,29 @@ func handleListen(packet gopacket.Packet, conn *pcap.RawConn) error {
 	if monitor != nil {
 		monitor.AddBidirectional(indicator.SrcIP().String(), indicator.DstIP().String(), stat.DirectionOut, uint(size))
 	}
+	if flows != nil {
+		flows.Add(indicator.TransportProtocol().String(), indicator.Src().String(), indicator.Dst().String(), stat.DirectionOut, uint(size))
+	}
 
-	log.Verbosef("Redirect an outbound %s packet: %s -> %s (%d Bytes)\n",
+	log.Packetf(first, "Redirect an outbound %s packet: %s -> %s (%d Bytes)\n",
 		indicator.TransportProtocol(), indicator.Src().String(), indicator.Dst().String(), size)
 
 	return nil
 }
 
+// isSpoofedSrc returns if the IP cannot be the source of a packet from the server.
+func isSpoofedSrc(ip net.IP) bool {
+	listenLock.RLock()
+	defer listenLock.RUnlock()
+
+	return pcap.IsSpoofedSrc(ip, listenDevs...)
+}
+
 func handleUpstream(contents []byte) error {
 	var (
-		embIndicator     *pcap.PacketIndicator
-		newLinkLayer     gopacket.Layer
-		newLinkLayerType gopacket.LayerType
-		data             []byte
+		embIndicator *pcap.PacketIndicator
+		newLinkLayer gopacket.SerializableLayer
+		data         []byte
 	)
 
 	// Empty payload
@@ -795,52 +2947,98 @@ func handleUpstream(contents []byte) error {
 		return fmt.Errorf("parse embedded packet: %w", err)
 	}
 
-	// Check map
-	natLock.RLock()
-	ni, ok := nat[embIndicator.DstIP().String()]
-	natLock.RUnlock()
-	if !ok {
-		return fmt.Errorf("missing nat to %s", embIndicator.DstIP())
+	// Verify checksum
+	err = embIndicator.VerifyChecksum()
+	if err != nil {
+		atomic.AddUint64(&corrupted, 1)
+		return fmt.Errorf("verify checksum: %w", err)
 	}
 
-	// Decide Loopback or Ethernet
-	if ni.conn.IsLoop() {
-		newLinkLayerType = layers.LayerTypeLoopback
-	} else {
-		newLinkLayerType = layers.LayerTypeEthernet
+	// Replies of speed tests
+	if speedTest != nil && pcap.IsSpeedTestReply(embIndicator) {
+		speedTest.Receive(embIndicator)
+		return nil
 	}
 
-	// Create new link layer
-	switch newLinkLayerType {
-	case layers.LayerTypeLoopback:
-		newLinkLayer = pcap.CreateLoopbackLayer()
-	case layers.LayerTypeEthernet:
-		newLinkLayer, err = pcap.CreateEthernetLayer(ni.conn.LocalDev().HardwareAddr(), ni.srcHardwareAddr, embIndicator.NetworkLayer().(gopacket.NetworkLayer))
-	default:
-		return fmt.Errorf("link layer type %s not support", newLinkLayerType)
+	// Drop packets claiming to be from the local network
+	if isStrict && isSpoofedSrc(embIndicator.SrcIP()) {
+		log.Packetf(false, "Drop an inbound %s packet with spoofed source: %s <- %s\n",
+			embIndicator.TransportProtocol(), embIndicator.Dst().String(), embIndicator.Src().String())
+		return nil
 	}
-	if err != nil {
-		return fmt.Errorf("create link layer: %w", err)
+
+	// Check map, which is not used with TUN device
+	var ni *natIndicator
+	if !isTun {
+		var ok bool
+		natLock.RLock()
+		ni, ok = nat[embIndicator.DstIP().String()]
+		natLock.RUnlock()
+		if !ok {
+			return pcap.NewError(pcap.ErrNoRoute, "missing nat to %s", embIndicator.DstIP())
+		}
 	}
 
-	// Serialize layers
-	data, err = pcap.SerializeRaw(newLinkLayer.(gopacket.SerializableLayer),
-		gopacket.Payload(embIndicator.NetworkLayer().LayerContents()),
-		gopacket.Payload(embIndicator.NetworkPayload()))
-	if err != nil {
-		return fmt.Errorf("serialize: %w", err)
+	// Hooks
+	first := false
+	if hooks != nil {
+		var allowed bool
+		allowed, first = hooks.Packet(embIndicator.TransportProtocol().String(), embIndicator.Dst().String(), embIndicator.Src().String(), stat.DirectionIn, contents)
+		if !allowed {
+			log.Packetf(first, "Drop an inbound %s packet by hooks: %s <- %s\n",
+				embIndicator.TransportProtocol(), embIndicator.Dst().String(), embIndicator.Src().String())
+			return nil
+		}
 	}
 
-	// Write packet data
-	_, err = ni.conn.Write(data)
-	if err != nil {
-		return fmt.Errorf("write: %w", err)
+	// Rate limit
+	if !limiter.Allow(embIndicator.DstIP().String(), stat.DirectionIn, len(contents)) {
+		log.Packetf(false, "Drop an inbound %s packet exceeding the limit: %s <- %s (%d Bytes)\n",
+			embIndicator.TransportProtocol(), embIndicator.Dst().String(), embIndicator.Src().String(), len(contents))
+		return nil
+	}
+	limiter.Wait(stat.DirectionIn, len(contents))
+
+	// Measure the tunnel for clamping windows
+	if windowClamp != nil {
+		windowClamp.Observe(contents)
+	}
+
+	if isTun {
+		// Write packet data to the host stack
+		_, err = tunDev.Write(contents)
+		if err != nil {
+			return pcap.WrapError(pcap.ErrWrite, fmt.Errorf("write: %w", err))
+		}
+	} else {
+		// Create new link layer
+		newLinkLayer, err = pcap.CreateTaggedLinkLayer(ni.conn, ni.srcHardwareAddr, ni.vlan, embIndicator.NetworkLayer().(gopacket.NetworkLayer))
+		if err != nil {
+			return fmt.Errorf("create link layer: %w", err)
+		}
+
+		// Serialize layers
+		data, err = pcap.SerializeRaw(newLinkLayer,
+			gopacket.Payload(embIndicator.NetworkData()))
+		if err != nil {
+			return fmt.Errorf("serialize: %w", err)
+		}
+
+		// Write packet data
+		_, err = ni.conn.Write(data)
+		if err != nil {
+			return pcap.WrapError(pcap.ErrWrite, fmt.Errorf("write: %w", err))
+		}
+		loopGuard.Mark(data)
 	}
 
 	// Statistics
 	if monitor != nil {
 		monitor.AddBidirectional(embIndicator.DstIP().String(), embIndicator.SrcIP().String(), stat.DirectionIn, uint(embIndicator.Size()))
 	}
+	if flows != nil {
+		flows.Add(embIndicator.TransportProtocol().String(), embIndicator.Dst().String(), embIndicator.Src().String(), stat.DirectionIn, uint(embIndicator.Size()))
+	}
 
 	// Record DNS
 	if embIndicator.DNSIndicator() != nil {
@@ -857,12 +3055,145 @@ func handleUpstream(contents []byte) error {
 		}
 	}
 
-	log.Verbosef("Redirect an inbound %s packet: %s <- %s (%d Bytes)\n",
+	log.Packetf(first, "Redirect an inbound %s packet: %s <- %s (%d Bytes)\n",
 		embIndicator.TransportProtocol(), embIndicator.Dst().String(), embIndicator.Src().String(), embIndicator.Size())
 
 	return nil
 }
 
+// handleControl registers handlers of the control API.
+func handleControl(s *control.Server) {
+	s.Handle("/devices", map[string]control.HandlerFunc{
+		http.MethodGet: func(req *http.Request) (interface{}, error) {
+			var tunName string
+			if tunDev != nil {
+				tunName = tunDev.Name()
+			}
+
+			listenLock.RLock()
+			devs := listenDevs
+			listenLock.RUnlock()
+
+			return &struct {
+				Listen   []*pcap.Device `json:"listen"`
+				Tun      string         `json:"tun,omitempty"`
+				Upstream *pcap.Device   `json:"upstream"`
+				Gateway  *pcap.Device   `json:"gateway"`
+			}{
+				Listen:   devs,
+				Tun:      tunName,
+				Upstream: upDev,
+				Gateway:  gatewayDev,
+			}, nil
+		},
+	})
+
+	s.Handle("/nat", map[string]control.HandlerFunc{
+		http.MethodGet: func(req *http.Request) (interface{}, error) {
+			type Mapping struct {
+				Source       string `json:"source"`
+				HardwareAddr string `json:"hardwareAddr,omitempty"`
+				VLAN         uint16 `json:"vlan,omitempty"`
+				Device       string `json:"device"`
+			}
+
+			mappings := make([]Mapping, 0)
+			natLock.RLock()
+			for src, ni := range nat {
+				mapping := Mapping{
+					Source: src,
+					VLAN:   ni.vlan,
+				}
+				if ni.srcHardwareAddr != nil {
+					mapping.HardwareAddr = ni.srcHardwareAddr.String()
+				}
+				if ni.conn != nil {
+					mapping.Device = ni.conn.LocalDev().Alias()
+				}
+				mappings = append(mappings, mapping)
+			}
+			natLock.RUnlock()
+
+			return mappings, nil
+		},
+		http.MethodDelete: func(req *http.Request) (interface{}, error) {
+			natLock.Lock()
+			n := len(nat)
+			nat = make(map[string]*natIndicator)
+			natLock.Unlock()
+			log.Infof("Flush %d NAT entries\n", n)
+
+			return &struct {
+				Flushed int `json:"flushed"`
+			}{
+				Flushed: n,
+			}, nil
+		},
+	})
+
+	s.Handle("/log", map[string]control.HandlerFunc{
+		http.MethodGet: func(req *http.Request) (interface{}, error) {
+			return &logLevel{Level: log.CurrentLevel().String()}, nil
+		},
+		http.MethodPut: func(req *http.Request) (interface{}, error) {
+			var l logLevel
+			err := control.Decode(req, &l)
+			if err != nil {
+				return nil, err
+			}
+
+			level, err := log.ParseLevel(l.Level)
+			if err != nil {
+				return nil, control.BadRequest(err)
+			}
+			log.SetLevel(level)
+			log.Infof("Set log level to %s\n", level)
+
+			return &l, nil
+		},
+	})
+
+	s.Handle("/stats", map[string]control.HandlerFunc{
+		http.MethodGet: func(req *http.Request) (interface{}, error) {
+			var flowStats []stat.FlowStat
+			if flows != nil {
+				flowStats = flows.Stats()
+			}
+
+			natLock.RLock()
+			n := len(nat)
+			natLock.RUnlock()
+
+			return &struct {
+				Name      string               `json:"name"`
+				Version   string               `json:"version"`
+				Time      int                  `json:"time"`
+				NAT       int                  `json:"nat"`
+				Corrupted uint64               `json:"corrupted"`
+				Replayed  uint64               `json:"replayed"`
+				Capture   []pcap.CaptureStats  `json:"capture"`
+				Flows     []stat.FlowStat      `json:"flows,omitempty"`
+				Monitor   *stat.TrafficMonitor `json:"monitor,omitempty"`
+			}{
+				Name:      name,
+				Version:   versionInfo,
+				Time:      int(time.Now().Sub(startTime).Seconds()),
+				NAT:       n,
+				Corrupted: atomic.LoadUint64(&corrupted),
+				Replayed:  crypto.Replayed(),
+				Capture:   pcap.AllCaptureStats(),
+				Flows:     flowStats,
+				Monitor:   monitor,
+			}, nil
+		},
+	})
+}
+
+// logLevel describes the level of logging in the control API.
+type logLevel struct {
+	Level string `json:"level"`
+}
+
 func splitArg(s string) []string {
 	if s == "" {
 		return nil
@@ -878,3 +3209,74 @@ func splitArg(s string) []string {
 
 	return result
 }
+
+// checkOffloads warns if offloading is enabled in devices and super-frames produced by it will be truncated.
+func checkOffloads(devs ...*pcap.Device) {
+	if pcap.SnapLen() >= pcap.IPv4MaxSize {
+		return
+	}
+
+	for _, dev := range devs {
+		if dev.IsLoop() {
+			continue
+		}
+
+		features, err := exec.DetectOffloads(dev.Name())
+		if err != nil {
+			log.Verboseln(fmt.Errorf("detect offloads of device %s: %w", dev.Alias(), err))
+			continue
+		}
+		if len(features) > 0 {
+			log.Warnf("Device %s enables %s, whose super-frames will be truncated. You may disable them by ethtool "+
+				"-K %s tso off gso off gro off lro off, or enlarge the snap length\n",
+				dev.Alias(), strings.Join(features, ", "), dev.Name())
+		}
+	}
+}
+
+// service installs, uninstalls or prints the unit of the service running with the same arguments.
+func service(action string) error {
+	args, err := daemon.Args("service", "c", "log", "log-file", "dump")
+	if err != nil {
+		return fmt.Errorf("parse arguments: %w", err)
+	}
+	if len(args) <= 0 && *argConfig != "" {
+		path, err := filepath.Abs(*argConfig)
+		if err != nil {
+			return fmt.Errorf("abs %s: %w", *argConfig, err)
+		}
+		args = []string{"-c", path}
+	}
+
+	cfg := &daemon.Config{
+		Name:        strings.ToLower(name),
+		Description: "IkaGo client",
+		Args:        args,
+		Reload:      true,
+	}
+
+	switch action {
+	case "install":
+		err := daemon.Install(cfg)
+		if err != nil {
+			return fmt.Errorf("install: %w", err)
+		}
+		log.Infof("Install service %s\n", cfg.Name)
+	case "uninstall":
+		err := daemon.Uninstall(cfg.Name)
+		if err != nil {
+			return fmt.Errorf("uninstall: %w", err)
+		}
+		log.Infof("Uninstall service %s\n", cfg.Name)
+	case "unit":
+		unit, err := daemon.SystemdUnit(cfg)
+		if err != nil {
+			return fmt.Errorf("create unit: %w", err)
+		}
+		fmt.Print(unit)
+	default:
+		return fmt.Errorf("action %s not support", action)
+	}
+
+	return nil
+}
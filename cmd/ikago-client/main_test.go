@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"ikago/internal/pcap"
+	"ikago/internal/shape"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	testClientHW = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	testRemoteIP = net.IPv4(1, 1, 1, 1).To4()
+)
+
+// recordConn is a connection to the server which records data written to it.
+type recordConn struct {
+	net.Conn
+	lock sync.Mutex
+	out  [][]byte
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	data := make([]byte, len(b))
+	copy(data, b)
+	c.out = append(c.out, data)
+
+	return len(b), nil
+}
+
+func (c *recordConn) take() [][]byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	result := c.out
+	c.out = nil
+
+	return result
+}
+
+// setup resets the state of the client to listen in memory and tunnel to a recording connection.
+func setup() (*pcap.MemConn, *recordConn) {
+	srcDev := pcap.NewDevice("eth1", []*net.IPNet{
+		{IP: net.IPv4(10, 0, 0, 1).To4(), Mask: net.CIDRMask(24, 32)},
+	}, testClientHW, false)
+	dstDev := pcap.NewDevice("source", nil, nil, false)
+	conn := pcap.NewMemConn(srcDev, dstDev, layers.LinkTypeEthernet)
+
+	rec := &recordConn{}
+	upConn = &pcap.TunnelConn{Conn: rec}
+	limiter = shape.NewLimiter(0, 0)
+	loopGuard = pcap.NewLoopGuard(keepInjected)
+	nat = make(map[string]*natIndicator)
+	dns = make(map[string]string)
+	isTun = false
+
+	return conn, rec
+}
+
+// sourceHW returns the hardware address of the i-th source.
+func sourceHW(i int) net.HardwareAddr {
+	return net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x01, byte(i)}
+}
+
+// sourceIP returns the IP of the i-th source.
+func sourceIP(i int) net.IP {
+	return net.IPv4(10, 0, 0, byte(10+i)).To4()
+}
+
+// tcpPacket returns the network data of a TCP segment.
+func tcpPacket(t *testing.T, src, dst net.IP, srcPort, dstPort uint16, payload []byte) []byte {
+	ipv4Layer := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    src,
+		DstIP:    dst,
+	}
+	tcpLayer := &layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		Seq:     1,
+		Ack:     1,
+		ACK:     true,
+		PSH:     true,
+		Window:  65535,
+	}
+	err := tcpLayer.SetNetworkLayerForChecksum(ipv4Layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := pcap.Serialize(ipv4Layer, tcpLayer, gopacket.Payload(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+// captureFrom feeds the network data in a frame from the i-th source to the connection and returns the captured packet.
+func captureFrom(t *testing.T, conn *pcap.MemConn, i int, network []byte) gopacket.Packet {
+	ethernetLayer := &layers.Ethernet{
+		SrcMAC:       sourceHW(i),
+		DstMAC:       testClientHW,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	data, err := pcap.SerializeRaw(ethernetLayer, gopacket.Payload(network))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return feed(t, conn, data)
+}
+
+// feed feeds the frame to the connection and returns the captured packet.
+func feed(t *testing.T, conn *pcap.MemConn, data []byte) gopacket.Packet {
+	err := conn.Feed(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := conn.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return packet
+}
+
+func TestHandleListen(t *testing.T) {
+	conn, rec := setup()
+
+	network := tcpPacket(t, sourceIP(0), testRemoteIP, 40000, 80, []byte("request"))
+	err := handleListen(captureFrom(t, conn, 0, network), conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := rec.take()
+	if len(out) != 1 {
+		t.Fatalf("tunneled %d packets, expected 1", len(out))
+	}
+	if !bytes.Equal(out[0], network) {
+		t.Fatalf("tunneled %x, expected %x", out[0], network)
+	}
+
+	ni, ok := nat[sourceIP(0).String()]
+	if !ok {
+		t.Fatalf("missing nat of %s", sourceIP(0))
+	}
+	if ni.srcHardwareAddr.String() != sourceHW(0).String() {
+		t.Fatalf("nat to %s, expected %s", ni.srcHardwareAddr, sourceHW(0))
+	}
+	if ni.conn != conn {
+		t.Fatal("nat to another connection")
+	}
+}
+
+func TestHandleUpstream(t *testing.T) {
+	conn, rec := setup()
+
+	err := handleListen(captureFrom(t, conn, 0, tcpPacket(t, sourceIP(0), testRemoteIP, 40000, 80, []byte("request"))), conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.take()
+
+	reply := tcpPacket(t, testRemoteIP, sourceIP(0), 80, 40000, []byte("reply"))
+	err = handleUpstream(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := conn.Take()
+	if len(out) != 1 {
+		t.Fatalf("injected %d frames, expected 1", len(out))
+	}
+	packet := gopacket.NewPacket(out[0], layers.LinkTypeEthernet, gopacket.Default)
+	ethernetLayer := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if ethernetLayer.DstMAC.String() != sourceHW(0).String() {
+		t.Fatalf("injected to %s, expected %s", ethernetLayer.DstMAC, sourceHW(0))
+	}
+	if ethernetLayer.SrcMAC.String() != testClientHW.String() {
+		t.Fatalf("injected from %s, expected %s", ethernetLayer.SrcMAC, testClientHW)
+	}
+	// Frames are padded to the minimum size of Ethernet
+	if !bytes.HasPrefix(ethernetLayer.Payload, reply) {
+		t.Fatalf("injected %x, expected %x", ethernetLayer.Payload, reply)
+	}
+
+	indicator, err := pcap.ParsePacket(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = indicator.VerifyChecksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Injected frames are skipped when they are captured again
+	err = handleListen(feed(t, conn, out[0]), conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(rec.take()); n != 0 {
+		t.Fatalf("tunneled %d injected packets", n)
+	}
+}
+
+func TestHandleUpstreamMissingNAT(t *testing.T) {
+	setup()
+
+	err := handleUpstream(tcpPacket(t, testRemoteIP, sourceIP(0), 80, 40000, []byte("reply")))
+	if !errors.Is(err, pcap.ErrNoRoute) {
+		t.Fatalf("error %v, expected %v", err, pcap.ErrNoRoute)
+	}
+}
+
+func TestHandleConcurrently(t *testing.T) {
+	const (
+		sources = 8
+		packets = 32
+	)
+
+	conn, rec := setup()
+
+	// Sources are recorded before replies are routed to them
+	for i := 0; i < sources; i++ {
+		err := handleListen(captureFrom(t, conn, i, tcpPacket(t, sourceIP(i), testRemoteIP, 40000, 80, []byte("request"))), conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec.take()
+
+	// Packets are fed in advance, as the connection in memory is read in order
+	captured := make([][]gopacket.Packet, sources)
+	for i := range captured {
+		for j := 0; j < packets; j++ {
+			captured[i] = append(captured[i], captureFrom(t, conn, i, tcpPacket(t, sourceIP(i), testRemoteIP, 40000, 80, []byte("request"))))
+		}
+	}
+
+	replies := make([][]byte, sources)
+	for i := range replies {
+		replies[i] = tcpPacket(t, testRemoteIP, sourceIP(i), 80, 40000, []byte("reply"))
+	}
+
+	// Sources send and receive at the same time
+	var wg sync.WaitGroup
+	for i := 0; i < sources; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+
+			for _, packet := range captured[i] {
+				err := handleListen(packet, conn)
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < packets; j++ {
+				err := handleUpstream(replies[i])
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	if n := len(rec.take()); n != sources*packets {
+		t.Fatalf("tunneled %d packets, expected %d", n, sources*packets)
+	}
+
+	// Replies are injected to their own sources
+	received := make(map[string]int)
+	for _, frame := range conn.Take() {
+		packet := gopacket.NewPacket(frame, layers.LinkTypeEthernet, gopacket.Default)
+		ethernetLayer := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+		ipv4Layer := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		for i := 0; i < sources; i++ {
+			if ipv4Layer.DstIP.Equal(sourceIP(i)) && ethernetLayer.DstMAC.String() != sourceHW(i).String() {
+				t.Fatalf("injected %s to %s, expected %s", ipv4Layer.DstIP, ethernetLayer.DstMAC, sourceHW(i))
+			}
+		}
+		received[ipv4Layer.DstIP.String()]++
+	}
+	for i := 0; i < sources; i++ {
+		if n := received[sourceIP(i).String()]; n != packets {
+			t.Fatalf("injected %d packets to %s, expected %d", n, sourceIP(i), packets)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -10,33 +11,43 @@
 	"github.com/xtaci/kcp-go"
 	"ikago/internal/addr"
 	"ikago/internal/config"
+	"ikago/internal/control"
 	"ikago/internal/crypto"
+	"ikago/internal/daemon"
 	"ikago/internal/exec"
+	"ikago/internal/hook"
 	"ikago/internal/log"
+	"ikago/internal/nat"
+	"ikago/internal/obfs"
 	"ikago/internal/pcap"
+	"ikago/internal/privilege"
+	"ikago/internal/prof"
+	"ikago/internal/shape"
 	"ikago/internal/stat"
+	"ikago/internal/user"
+	"ikago/internal/worker"
 	"io"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"runtime"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
-type quintuple struct {
-	src      string
-	dst      string
-	protocol gopacket.LayerType
-}
-
 type natIndicator struct {
 	src    net.Addr
 	embSrc net.Addr
 	conn   net.Conn
+	id     string
+	q      nat.Flow
+	state  nat.TCPState
 }
 
 func (indicator *natIndicator) embSrcIP() net.IP {
@@ -49,15 +60,93 @@ func (indicator *natIndicator) embSrcIP() net.IP {
 		return indicator.embSrc.(*net.UDPAddr).IP
 	case *addr.ICMPQueryAddr:
 		return indicator.embSrc.(*addr.ICMPQueryAddr).IP
+	case *addr.IPProtocolAddr:
+		return indicator.embSrc.(*addr.IPProtocolAddr).IP
 	default:
 		panic(fmt.Errorf("type %T not support", t))
 	}
 }
 
+// embSrcValue returns the port or the Id of the source, 0 if it has neither.
+func (indicator *natIndicator) embSrcValue() uint16 {
+	switch t := indicator.embSrc.(type) {
+	case *net.TCPAddr:
+		return uint16(t.Port)
+	case *net.UDPAddr:
+		return uint16(t.Port)
+	case *addr.ICMPQueryAddr:
+		return t.Id
+	default:
+		return 0
+	}
+}
+
+// srcIP returns the IP of the client, or nil if it is unknown.
+func (indicator *natIndicator) srcIP() net.IP {
+	switch t := indicator.src.(type) {
+	case *net.TCPAddr:
+		return t.IP
+	case *net.UDPAddr:
+		return t.IP
+	default:
+		return nil
+	}
+}
+
+// forwardKey describes a port of the server forwarded to a client.
+type forwardKey struct {
+	protocol gopacket.LayerType
+	port     uint16
+}
+
+// forward describes a static port forwarding from a port of the server to an address behind a client.
+type forward struct {
+	protocol gopacket.LayerType
+	port     uint16
+	id       string
+	addr     net.Addr
+}
+
+// closingFlow describes a TCP connection which is seen closing.
+type closingFlow struct {
+	client string
+	q      nat.Flow
+	value  uint16
+	finOut bool
+	finIn  bool
+	timer  *time.Timer
+}
+
+// clientProfile describes settings applied to a client by the Id it presents.
+type clientProfile struct {
+	allowedPorts map[uint16]bool
+	limiter      *shape.Limiter
+	idleTimeout  time.Duration
+	minPort      uint16
+	maxPort      uint16
+	upDevName    string
+	upIP         net.IP
+	upDev        *pcap.Device
+	gatewayDev   *pcap.Device
+	upConn       pcap.PacketConn
+}
+
+// clientTraffic describes traffic statistics of a client.
+type clientTraffic struct {
+	id       string
+	inCount  uint64
+	inSize   uint64
+	outCount uint64
+	outSize  uint64
+	lastSeen time.Time
+}
+
 const name string = "IkaGo-server"
 
 const keepAlive time.Duration = 30 * time.Second
 const keepFragments time.Duration = 30 * time.Second
+const keepInjected time.Duration = 2 * time.Second
+const checkDrops time.Duration = 10 * time.Second
 
 var (
 	version     = ""
@@ -69,17 +158,70 @@ func (indicator *natIndicator) embSrcIP() net.IP {
 
 var (
 	argListDevs       = flag.Bool("list-devices", false, "List all valid devices in current computer.")
+	argDryRun         = flag.Bool("dry-run", false, "Print packets instead of sending them.")
+	argService        = flag.String("service", "", "Install, uninstall or print the unit of the service.")
 	argConfig         = flag.String("c", "", "Configuration file.")
 	argListenDevs     = flag.String("listen-devices", "", "Devices for listening.")
 	argUpDev          = flag.String("upstream-device", "", "Device for routing upstream to.")
+	argUpIP           = flag.String("upstream-ip", "", "Source IP for routing upstream from.")
+	argMulticastDev   = flag.String("multicast-device", "", "Device for re-broadcasting multicast packets from clients.")
 	argGateway        = flag.String("gateway", "", "Gateway address.")
+	argStaticMAC      = flag.String("static-mac", "", "Static hardware addresses of next hops.")
+	argVLAN           = flag.Int("vlan", 0, "VLAN identifier of upstream device.")
+	argPPPoE          = flag.Bool("pppoe", false, "Route upstream in the PPPoE session of upstream device.")
+	argPreserveTTL    = flag.Bool("preserve-ttl", false, "Count the server as a hop of embedded packets.")
+	argFilter         = flag.String("f", "", "Custom BPF filter.")
+	argMode           = flag.String("mode", "faketcp", "Mode.")
 	argMethod         = flag.String("method", "plain", "Method of encryption.")
+	argObfs           = flag.String("obfs", "none", "Method of obfuscation.")
+	argIPId           = flag.String("ip-id", "random", "Strategy of IPv4 Id.")
+	argTTL            = flag.Int("ttl", 0, "TTL of crafted packets.")
+	argTCPWindow      = flag.Int("tcp-window", 65535, "Window of TCP segments.")
+	argTCPMSS         = flag.Int("tcp-mss", 0, "MSS option of TCP SYN segments.")
+	argTCPWScale      = flag.Int("tcp-window-scale", 0, "Window scale option of TCP SYN segments.")
+	argTCPTimestamps  = flag.Bool("tcp-timestamps", false, "Timestamps option of TCP segments.")
+	argCopyToS        = flag.String("copy-tos", "none", "Mode of copying ToS of embedded packets.")
+	argClampMSS       = flag.Bool("clamp-mss", false, "Clamp MSS of TCP SYN segments.")
+	argClampWindow    = flag.Bool("clamp-window", false, "Clamp receive window of TCP segments.")
 	argPassword       = flag.String("password", "", "Password of encryption.")
 	argRule           = flag.Bool("rule", false, "Add firewall rule.")
 	argVerbose        = flag.Bool("v", false, "Print verbose messages.")
 	argLog            = flag.String("log", "", "Log.")
+	argLogFile        = flag.String("log-file", "", "Log file.")
+	argLogJSON        = flag.Bool("log-json", false, "Print messages in JSON.")
+	argLogQuiet       = flag.Bool("log-quiet", false, "Suppress per-packet messages.")
+	argColor          = flag.String("color", "auto", "Mode of colorizing messages.")
+	argStatus         = flag.Int("status", 1, "Interval of refreshing the status line.")
+	argLogSample      = flag.Int("log-sample", 1, "Print per-packet messages 1 in n.")
+	argLogFlows       = flag.Bool("log-flows", false, "Print summaries of flows when they are closed.")
+	argIPFIX          = flag.String("ipfix", "", "Collector of flows in IPFIX.")
+	argDump           = flag.String("dump", "", "Pcapng file for dumping packets.")
+	argSnapLen        = flag.Int("snap-len", pcap.DefaultSnapLen, "Snap length of capturing.")
+	argPcapImmediate  = flag.Bool("pcap-immediate", false, "Capture in immediate mode.")
+	argPcapBuffer     = flag.Int("pcap-buffer", 0, "Buffer size of capturing.")
+	argPcapTimeout    = flag.Int("pcap-timeout", 0, "Read timeout of capturing.")
+	argPcapNoPromisc  = flag.String("pcap-no-promisc", "", "Devices capturing without promiscuous mode.")
+	argPcapTstamp     = flag.String("pcap-tstamp", "", "Timestamp source of capturing.")
+	argPcapRing       = flag.Int("pcap-ring", 0, "Packets buffered between capturing and handling.")
+	argPcapMmap       = flag.Bool("pcap-mmap", false, "Capture by mapping the ring of the kernel directly.")
 	argMonitor        = flag.Int("monitor", 0, "Port for monitoring.")
+	argControl        = flag.String("control", "", "Address of control API.")
+	argControlToken   = flag.String("control-token", "", "Token of control API.")
+	argPprof          = flag.String("pprof", "", "Address of serving runtime profiles.")
+	argStats          = flag.Int("stats", 0, "Interval of printing statistics.")
+	argBatch          = flag.Int("batch", 0, "Max size of a batch.")
+	argBatchInterval  = flag.Int("batch-interval", 1, "Interval of flushing a batch.")
+	argWorkers        = flag.Int("workers", 1, "Number of workers handling packets.")
+	argLimit          = flag.String("limit", "", "Max throughput.")
+	argLimitPerFlow   = flag.String("limit-per-flow", "", "Max throughput per flow.")
+	argPriority       = flag.String("priority", "", "Rules of classifying packets in priority.")
+	argHooks          = flag.String("hooks", "", "Go plugins of hooks.")
 	argMTU            = flag.Int("mtu", 0, "MTU.")
+	argReorderWindow  = flag.Int("reorder-window", 0, "Window of reordering segments.")
+	argReorderTimeout = flag.Int("reorder-timeout", 50, "Timeout of reordering segments.")
+	argFECDataShard   = flag.Int("fec-datashard", 0, "Data shards of forward error correction.")
+	argFECParityShard = flag.Int("fec-parityshard", 3, "Parity shards of forward error correction.")
+	argPacing         = flag.Bool("pacing", false, "Pace frames by delivery rates measured by the peer.")
 	argKCP            = flag.Bool("kcp", false, "Enable KCP.")
 	argKCPMTU         = flag.Int("kcp-mtu", kcp.IKCP_MTU_DEF, "KCP tuning option mtu.")
 	argKCPSendWindow  = flag.Int("kcp-sndwnd", kcp.IKCP_WND_SND, "KCP tuning option sndwnd.")
@@ -91,39 +233,121 @@ func (indicator *natIndicator) embSrcIP() net.IP {
 	argKCPInterval    = flag.Int("kcp-interval", kcp.IKCP_INTERVAL, "KCP tuning option interval.")
 	argKCPResend      = flag.Int("kcp-resend", 0, "KCP tuning option resend.")
 	argKCPNC          = flag.Int("kcp-nc", 0, "KCP tuning option nc.")
+	argWSPath         = flag.String("ws-path", "/", "Path of WebSocket.")
+	argWSTLS          = flag.Bool("ws-tls", false, "WebSocket in TLS.")
+	argWSCert         = flag.String("ws-cert", "", "Certificate file of WebSocket.")
+	argWSKey          = flag.String("ws-key", "", "Key file of WebSocket.")
+	argNAT            = flag.String("nat", "full-cone", "Behavior of NAT.")
+	argPreservePort   = flag.Bool("preserve-port", false, "Preserve ports of sources.")
+	argTranslate      = flag.String("translate", "", "Prefix of translation between IPv4 and IPv6.")
+	argNATMaxEntries  = flag.Int("nat-max-entries", 65536, "Max entries in NAT.")
+	argClientMaxConns = flag.Int("client-max-connections", 0, "Max connections of each client.")
+	argCloseTimeout   = flag.Int("close-timeout", 0, "Timeout of tearing down closed TCP connections.")
+	argHalfOpenTTL    = flag.Int("half-open-timeout", 0, "Timeout of TCP connections in handshakes.")
+	argEstablishedTTL = flag.Int("established-timeout", 0, "Timeout of established TCP connections.")
+	argResume         = flag.Bool("resume", false, "Resume sessions of clients from other addresses.")
+	argState          = flag.String("state", "", "File to save NAT in for restoring after restarts.")
+	argUser           = flag.String("user", "", "User to drop privileges to after devices are opened.")
+	argUsers          = flag.String("users", "", "File of users authenticated with their keys.")
+	argUsage          = flag.String("usage", "", "File to save usage of users in.")
 	argPort           = flag.Int("p", 0, "Port for listening.")
+	argHop            = flag.Int("hop", 0, "Interval of hopping ports.")
+	argHopPorts       = flag.Int("hop-ports", 1024, "Number of ports in hopping.")
+	argRekey          = flag.Int("rekey", 0, "Interval of rotating keys.")
+	argStrict         = flag.Bool("strict", false, "Validate inbound packets strictly.")
+	argAntiReplay     = flag.Bool("anti-replay", false, "Drop replayed packets between the client and the server.")
+	argAllow          = flag.String("allow", "", "CIDRs of clients allowed to connect.")
+	argDeny           = flag.String("deny", "", "CIDRs of clients denied to connect.")
 )
 
 var (
-	port       uint16
-	listenDevs []*pcap.Device
-	upDev      *pcap.Device
-	gatewayDev *pcap.Device
-	mode       string
-	crypt      crypto.Crypt
-	mtu        int
-	isKCP      bool
-	kcpConfig  *config.KCPConfig
+	port           uint16
+	listenDevs     []*pcap.Device
+	upDev          *pcap.Device
+	gatewayDev     *pcap.Device
+	mode           string
+	crypt          crypto.Crypt
+	isStrict       bool
+	auth           *crypto.Auth
+	batch          int
+	batchInterval  time.Duration
+	mtu            int
+	clampMSS       uint16
+	windowClamp    *pcap.WindowClamp
+	isKCP          bool
+	kcpConfig      *config.KCPConfig
+	wsConfig       *config.WebSocketConfig
+	natBehavior    nat.Behavior
+	preservePort   bool
+	natMaxEntries  int
+	clientMaxConns int
+	closeTimeout   time.Duration
+	halfOpenTTL    time.Duration
+	establishedTTL time.Duration
+	isResume       bool
+	statePath      string
+	dropUser       string
+	users          user.Users
+	usagePath      string
+	hop            *crypto.Hop
+	clientProfiles map[string]*clientProfile
+	forwards       map[forwardKey]*forward
+	translator     *pcap.Translator
+	macOverrides   pcap.MACOverrides
 )
 
 var (
-	isClosed     bool
-	listeners    []net.Listener
-	upConn       *pcap.RawConn
-	c            chan pcap.ConnBytes
-	defrag       *pcap.EasyDefragmenter
-	nextTCPPort  uint16
-	tcpPortPool  []time.Time
-	nextUDPPort  uint16
-	udpPortPool  []time.Time
-	nextICMPv4Id uint16
-	icmpv4IdPool []time.Time
-	patMap       map[quintuple]uint16
-	natLock      sync.RWMutex
-	nat          map[pcap.NATGuide]*natIndicator
-	monitor      *stat.TrafficMonitor
-	dnsLock      sync.RWMutex
-	dns          map[string]string
+	isClosed       bool
+	isRSTRule      bool
+	listenersLock  sync.RWMutex
+	listeners      []net.Listener
+	extraListeners map[uint16][]net.Listener
+	upConn         pcap.PacketConn
+	extraUpConns   []pcap.PacketConn
+	multicastDev   *pcap.Device
+	multicastConn  pcap.PacketConn
+	c              chan pcap.ConnBytes
+	defrag         *pcap.EasyDefragmenter
+	embDefrag      *pcap.EasyDefragmenter
+	loopGuard      *pcap.LoopGuard
+	poolLock       sync.Mutex
+	nextTCPPort    uint32
+	tcpPortPool    []time.Time
+	nextUDPPort    uint32
+	udpPortPool    []time.Time
+	nextICMPv4Id   uint32
+	icmpv4IdPool   []time.Time
+	nextICMPv6Id   uint32
+	icmpv6IdPool   []time.Time
+	patMapsLock    sync.RWMutex
+	patMaps        map[string]*nat.Table
+	natMap         *nat.Table
+	filterMap      *nat.Table
+	monitor        *stat.TrafficMonitor
+	controlServer  *control.Server
+	portsLock      sync.Mutex
+	flows          *stat.FlowRecorder
+	limiter        *shape.Limiter
+	priorityRules  []*shape.Rule
+	scheduler      *shape.Scheduler
+	hooks          *hook.Chain
+	dumper         *pcap.Dumper
+	pool           *worker.Pool
+	customFilter   string
+	preserveTTL    bool
+	clientsLock    sync.RWMutex
+	clientConns    map[string]net.Conn
+	retired        map[net.Conn]bool
+	resumed        map[net.Conn]net.Addr
+	forwardsLock   sync.RWMutex
+	forwardConns   map[string]net.Conn
+	dnsLock        sync.RWMutex
+	dns            map[string]string
+	trafficLock    sync.Mutex
+	traffic        map[string]*clientTraffic
+	closingLock    sync.Mutex
+	stateLock      sync.Mutex
+	closing        map[pcap.NATGuide]*closingFlow
 )
 
 func init() {
@@ -147,29 +371,29 @@ func init() {
 	// Start time
 	startTime = time.Now()
 
-	// Parse arguments
-	flag.Parse()
-
-	// Load config.json by default
-	if len(os.Args) <= 1 {
-		_, err := os.Stat("config.json")
-		if err == nil {
-			*argConfig = "config.json"
-		}
-	}
-
 	listenDevs = make([]*pcap.Device, 0)
 
 	listeners = make([]net.Listener, 0)
+	extraListeners = make(map[uint16][]net.Listener)
+	clientConns = make(map[string]net.Conn)
+	retired = make(map[net.Conn]bool)
+	resumed = make(map[net.Conn]net.Addr)
 	c = make(chan pcap.ConnBytes, 1000)
 	defrag = pcap.NewEasyDefragmenter()
 	defrag.SetDeadline(keepFragments)
+	embDefrag = pcap.NewEasyDefragmenter()
+	embDefrag.SetDeadline(keepFragments)
+	loopGuard = pcap.NewLoopGuard(keepInjected)
 	tcpPortPool = make([]time.Time, 16384)
 	udpPortPool = make([]time.Time, 16384)
 	icmpv4IdPool = make([]time.Time, 65536)
-	patMap = make(map[quintuple]uint16)
-	nat = make(map[pcap.NATGuide]*natIndicator)
+	icmpv6IdPool = make([]time.Time, 65536)
 	dns = make(map[string]string)
+	clientProfiles = make(map[string]*clientProfile)
+	forwards = make(map[forwardKey]*forward)
+	forwardConns = make(map[string]net.Conn)
+	traffic = make(map[string]*clientTraffic)
+	closing = make(map[pcap.NATGuide]*closingFlow)
 }
 
 func main() {
@@ -179,6 +403,17 @@ func main() {
 		gateway net.IP
 	)
 
+	// Parse arguments
+	flag.Parse()
+
+	// Load config.json by default
+	if len(os.Args) <= 1 {
+		_, err := os.Stat("config.json")
+		if err == nil {
+			*argConfig = "config.json"
+		}
+	}
+
 	// Configuration file
 	if *argConfig != "" {
 		cfg, err = config.ParseFile(*argConfig)
@@ -190,14 +425,67 @@ func main() {
 		cfg = config.NewConfig()
 		cfg.ListenDevs = splitArg(*argListenDevs)
 		cfg.UpDev = *argUpDev
+		cfg.UpIP = *argUpIP
+		cfg.MulticastDev = *argMulticastDev
 		cfg.Gateway = *argGateway
+		cfg.StaticMAC = splitArg(*argStaticMAC)
+		cfg.VLAN = *argVLAN
+		cfg.PPPoE = *argPPPoE
+		cfg.PreserveTTL = *argPreserveTTL
+		cfg.Filter = *argFilter
+		cfg.Mode = *argMode
 		cfg.Method = *argMethod
 		cfg.Password = *argPassword
+		cfg.Obfs = *argObfs
+		cfg.IPId = *argIPId
+		cfg.TTL = *argTTL
+		cfg.TCPWindow = *argTCPWindow
+		cfg.TCPMSS = *argTCPMSS
+		cfg.TCPWindowScale = *argTCPWScale
+		cfg.TCPTimestamps = *argTCPTimestamps
+		cfg.CopyToS = *argCopyToS
+		cfg.ClampMSS = *argClampMSS
+		cfg.ClampWindow = *argClampWindow
 		cfg.Rule = *argRule
 		cfg.Verbose = *argVerbose
 		cfg.Log = *argLog
+		if *argLogFile != "" {
+			cfg.Log = *argLogFile
+		}
+		cfg.LogJSON = *argLogJSON
+		cfg.LogQuiet = *argLogQuiet
+		cfg.LogSample = *argLogSample
+		cfg.LogFlows = *argLogFlows
+		cfg.Color = *argColor
+		cfg.Status = *argStatus
+		cfg.IPFIX = *argIPFIX
+		cfg.Dump = *argDump
+		cfg.SnapLen = *argSnapLen
+		cfg.PcapConfig.Immediate = *argPcapImmediate
+		cfg.PcapConfig.Buffer = *argPcapBuffer
+		cfg.PcapConfig.Timeout = *argPcapTimeout
+		cfg.PcapConfig.NoPromisc = splitArg(*argPcapNoPromisc)
+		cfg.PcapConfig.Tstamp = *argPcapTstamp
+		cfg.PcapConfig.Ring = *argPcapRing
+		cfg.PcapConfig.Mmap = *argPcapMmap
 		cfg.Monitor = *argMonitor
+		cfg.Control = *argControl
+		cfg.ControlToken = *argControlToken
+		cfg.Pprof = *argPprof
+		cfg.Stats = *argStats
+		cfg.Batch = *argBatch
+		cfg.BatchInterval = *argBatchInterval
+		cfg.Workers = *argWorkers
+		cfg.Limit = *argLimit
+		cfg.LimitPerFlow = *argLimitPerFlow
+		cfg.Priority = splitArg(*argPriority)
+		cfg.Hooks = splitArg(*argHooks)
 		cfg.MTU = *argMTU
+		cfg.ReorderWindow = *argReorderWindow
+		cfg.ReorderTimeout = *argReorderTimeout
+		cfg.FECDataShard = *argFECDataShard
+		cfg.FECParityShard = *argFECParityShard
+		cfg.Pacing = *argPacing
 		cfg.KCP = *argKCP
 		cfg.KCPConfig = *config.NewKCPConfig()
 		cfg.KCPConfig.MTU = *argKCPMTU
@@ -210,11 +498,47 @@ func main() {
 		cfg.KCPConfig.Interval = *argKCPInterval
 		cfg.KCPConfig.Resend = *argKCPResend
 		cfg.KCPConfig.NC = *argKCPNC
+		cfg.WebSocket = *config.NewWebSocketConfig()
+		cfg.WebSocket.Path = *argWSPath
+		cfg.WebSocket.TLS = *argWSTLS
+		cfg.WebSocket.Cert = *argWSCert
+		cfg.WebSocket.Key = *argWSKey
+		cfg.NAT = *argNAT
+		cfg.PreservePort = *argPreservePort
+		cfg.Translate = *argTranslate
+		cfg.NATMaxEntries = *argNATMaxEntries
+		cfg.ClientMaxConns = *argClientMaxConns
+		cfg.CloseTimeout = *argCloseTimeout
+		cfg.HalfOpenTTL = *argHalfOpenTTL
+		cfg.EstablishedTTL = *argEstablishedTTL
+		cfg.Resume = *argResume
+		cfg.State = *argState
+		cfg.User = *argUser
+		cfg.Users = *argUsers
+		cfg.Usage = *argUsage
 		cfg.Port = *argPort
+		cfg.Hop = *argHop
+		cfg.HopPorts = *argHopPorts
+		cfg.Rekey = *argRekey
+		cfg.Strict = *argStrict
+		cfg.AntiReplay = *argAntiReplay
+		cfg.Allow = splitArg(*argAllow)
+		cfg.Deny = splitArg(*argDeny)
 	}
 
 	// Log
 	log.SetVerbose(cfg.Verbose || *argVerbose)
+	log.SetJSON(cfg.LogJSON || *argLogJSON)
+	log.SetQuiet(cfg.LogQuiet || *argLogQuiet)
+	colorMode, err := log.ParseColorMode(cfg.Color)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse color: %w", err))
+	}
+	log.SetColor(colorMode)
+	if cfg.LogSample < 0 {
+		log.Fatalln(fmt.Errorf("log sample %d out of range", cfg.LogSample))
+	}
+	log.SetSample(cfg.LogSample)
 	err = log.SetLog(cfg.Log)
 	if err != nil {
 		log.Fatalln(fmt.Errorf("log %s: %w", cfg.Log, err))
@@ -223,40 +547,32 @@ func main() {
 		log.Infof("Save log to file %s\n", cfg.Log)
 	}
 
-	// Check permission
-	switch runtime.GOOS {
-	case "linux":
-		if os.Geteuid() != 0 {
-			ex, err := os.Executable()
-			if err != nil {
-				ex = "path_to_ikago"
-			}
-
-			log.Infoln("You are running IkaGo as non-root, if IkaGo does not work, please run")
-			log.Infof("  sudo setcap cap_net_raw+ep \"%s\"\n", ex)
-			log.Infoln("  before opening IkaGo, or just run as root with sudo.")
-		}
-	case "windows":
-		break
-	default:
-		if os.Geteuid() != 0 {
-			log.Infoln("You are running IkaGo as non-root, if IkaGo does not work, please run IkaGo as root with sudo.")
-		}
-	}
-
 	// Exclusive commands
 	if *argListDevs {
-		log.Infoln("Available devices are listed below, use -listen-devices [devices] or -upstream-device [device] to designate device:")
+		log.Infoln("Available devices are listed below, use -listen-devices [devices] or -upstream-device [device] to designate device by index, name or pattern:")
 		devs, err := pcap.FindAllDevs()
 		if err != nil {
 			log.Fatalln(fmt.Errorf("list devices: %w", err))
 		}
-		for _, dev := range devs {
-			log.Infof("  %s\n", dev)
+		for i, dev := range devs {
+			log.Infof("  [%d] %s\n", i, dev.Detail())
+		}
+		os.Exit(0)
+	}
+	if *argService != "" {
+		err := service(*argService)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("service: %w", err))
 		}
 		os.Exit(0)
 	}
 
+	// Check privileges
+	err = privilege.Check()
+	if err != nil {
+		log.Fatalln(fmt.Errorf("check privileges: %w", err))
+	}
+
 	// Verify parameters
 	if cfg.Port == 0 {
 		log.Fatalln("Please provide listen port by -p port.")
@@ -270,7 +586,31 @@ func main() {
 	if cfg.Monitor < 0 || cfg.Monitor > 65535 {
 		log.Fatalln(fmt.Errorf("monitor port %d out of range", cfg.Monitor))
 	}
-	if cfg.MTU < 576 || cfg.MTU > pcap.MaxMTU {
+	if cfg.Stats < 0 {
+		log.Fatalln(fmt.Errorf("statistics interval %d out of range", cfg.Stats))
+	}
+	if cfg.Status < 0 {
+		log.Fatalln(fmt.Errorf("status interval %d out of range", cfg.Status))
+	}
+	if cfg.Batch < 0 || cfg.Batch > 65535 {
+		log.Fatalln(fmt.Errorf("batch size %d out of range", cfg.Batch))
+	}
+	if cfg.BatchInterval <= 0 {
+		log.Fatalln(fmt.Errorf("batch interval %d out of range", cfg.BatchInterval))
+	}
+	if cfg.VLAN < 0 || cfg.VLAN > 4094 {
+		log.Fatalln(fmt.Errorf("vlan %d out of range", cfg.VLAN))
+	}
+	if cfg.PPPoE && cfg.UpDev == "" {
+		log.Fatalln(errors.New("pppoe requires upstream device"))
+	}
+	if cfg.PPPoE && cfg.VLAN > 0 {
+		log.Fatalln(errors.New("pppoe with vlan not support"))
+	}
+	if cfg.PPPoE && cfg.UpIP != "" {
+		log.Fatalln(errors.New("pppoe with upstream ip not support"))
+	}
+	if cfg.MTU < pcap.MinMTU || cfg.MTU > pcap.MaxMTU {
 		if cfg.MTU == 0 {
 			cfg.MTU = pcap.MaxMTU
 		} else {
@@ -308,930 +648,3706 @@ func main() {
 	// Port
 	port = uint16(cfg.Port)
 
-	// Add firewall rule
-	if cfg.Rule {
-		err := exec.AddGlobalFirewallRule()
-		if err != nil {
-			log.Fatalln(fmt.Errorf("add firewall rule: %w", err))
-		}
-
-		log.Errorln("Add firewall rule")
-	}
-
 	// Mode
 	switch cfg.Mode {
 	case "faketcp":
 		mode = "faketcp"
 		log.Infoln("Use fake TCP")
+	case "kcp":
+		// Mode kcp is normalized to fake TCP with KCP, so checks below see the values it takes
+		cfg.Mode = "faketcp"
+		cfg.KCP = true
+		mode = "faketcp"
+		log.Infoln("Use fake TCP with KCP")
 	case "tcp":
 		mode = "tcp"
 		log.Infoln("Use standard TCP (experimental)")
+	case "websocket":
+		mode = "websocket"
+		log.Infoln("Use WebSocket")
+	case "udp":
+		mode = "udp"
+		log.Infoln("Use UDP")
 	default:
 		log.Fatalln(fmt.Errorf("mode %s not support", cfg.Mode))
 	}
 
-	// Crypt
-	crypt, err = crypto.ParseCrypt(cfg.Method, cfg.Password)
-	if err != nil {
-		log.Fatalln(fmt.Errorf("parse crypt: %w", err))
-	}
-	method := crypt.Method()
-	if method != crypto.MethodPlain {
-		log.Infof("Encrypt with %s\n", method)
+	// Hop
+	if cfg.Hop < 0 {
+		log.Fatalln(fmt.Errorf("hop interval %d out of range", cfg.Hop))
 	}
-
-	// Monitor
-	if cfg.Monitor != 0 {
-		if cfg.Monitor == int(port) {
-			log.Fatalln(fmt.Errorf("same monitor port with listen port"))
+	if cfg.Hop > 0 {
+		if cfg.HopPorts <= 0 || cfg.Port+cfg.HopPorts-1 >= 49152 {
+			log.Fatalln(fmt.Errorf("hop ports %d out of range", cfg.HopPorts))
 		}
+		if cfg.Mode != "faketcp" || cfg.KCP {
+			log.Fatalln(errors.New("hopping is only supported in fake TCP without KCP"))
+		}
+		if cfg.Password == "" {
+			log.Fatalln(errors.New("hopping requires a password"))
+		}
+		hop = crypto.CreateHop(cfg.Password, time.Duration(cfg.Hop)*time.Second, port, uint16(cfg.HopPorts))
+		min, max := hop.Range()
+		log.Infof("Hop in ports %d-%d every %d seconds\n", min, max, cfg.Hop)
+	}
 
-		monitor = stat.NewTrafficMonitor()
-
-		go func() {
-			http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-				b, err := json.Marshal(&struct {
-					Name    string               `json:"name"`
-					Version string               `json:"version"`
-					Time    int                  `json:"time"`
-					Monitor *stat.TrafficMonitor `json:"monitor"`
-				}{
-					Name:    name,
-					Version: versionInfo,
-					Time:    int(time.Now().Sub(startTime).Seconds()),
-					Monitor: monitor,
-				})
-				if err != nil {
-					log.Errorln(fmt.Errorf("monitor: %w", err))
-					return
-				}
-
-				// Handle CORS
-				w.Header().Set("Access-Control-Allow-Origin", "*")
-
-				_, err = io.WriteString(w, string(b))
-				if err != nil {
-					log.Errorln(fmt.Errorf("monitor: %w", err))
-				}
-			})
-
-			http.HandleFunc("/dns", func(w http.ResponseWriter, req *http.Request) {
-				type IPName struct {
-					IP   string `json:"ip"`
-					Name string `json:"name"`
-				}
-
-				ipNames := make([]IPName, 0)
-				dnsLock.RLock()
-				for ip, name := range dns {
-					ipNames = append(ipNames, IPName{
-						IP:   ip,
-						Name: name,
-					})
-				}
-				dnsLock.RUnlock()
-
-				b, err := json.Marshal(ipNames)
-				if err != nil {
-					log.Errorln(fmt.Errorf("monitor: %w", err))
-					return
-				}
-
-				// Handle CORS
-				w.Header().Set("Access-Control-Allow-Origin", "*")
+	// Dry run
+	if *argDryRun {
+		pcap.SetDryRun(true)
+		log.Infoln("Dry run, packets are printed instead of being sent")
+	}
 
-				_, err = io.WriteString(w, string(b))
-				if err != nil {
-					log.Errorln(fmt.Errorf("monitor: %w", err))
-				}
-			})
+	// Add firewall rule
+	if cfg.Rule && !*argDryRun {
+		err := exec.AddGlobalFirewallRule()
+		if err != nil {
+			log.Fatalln(fmt.Errorf("add firewall rule: %w", err))
+		}
 
-			err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.Monitor), nil)
-			if err != nil {
-				log.Errorln(fmt.Errorf("monitor: %w", err))
-			}
-		}()
+		log.Errorln("Add firewall rule")
+	}
 
-		log.Infof("Monitor on :%d\n", cfg.Monitor)
-		log.Infoln("You can now observe traffic on http://ikago.ikas.ink")
+	// Drop RST segments of the listen port sent by the kernel
+	if cfg.Rule && !*argDryRun {
+		err := exec.AddRSTRule(port)
+		if err != nil {
+			log.Errorln(fmt.Errorf("add rst rule: %w", err))
+		} else {
+			isRSTRule = true
+			log.Infof("Drop RST segments from :%d\n", port)
+		}
 	}
 
-	// MTU
-	mtu = cfg.MTU
-	if mtu != pcap.MaxMTU {
-		log.Infof("Set MTU to %d Bytes\n", mtu)
+	// Privileges are dropped once devices are opened, so they cannot be reopened or changed later
+	if cfg.User != "" {
+		if cfg.Rule && !*argDryRun {
+			log.Fatalln(errors.New("dropping privileges is not supported with firewall rules, which are removed at exit"))
+		}
+		if cfg.Hop > 0 {
+			log.Fatalln(errors.New("dropping privileges is not supported with hopping, which opens listeners in new ports"))
+		}
+		dropUser = cfg.User
 	}
 
-	// KCP
-	isKCP = cfg.KCP
-	kcpConfig = &cfg.KCPConfig
-	if isKCP {
-		log.Infoln("Enable KCP")
+	// Key rotation
+	if cfg.Rekey < 0 {
+		log.Fatalln(fmt.Errorf("rekey interval %d out of range", cfg.Rekey))
+	}
+	isRekey := cfg.Rekey > 0
+	if isRekey {
+		if cfg.Mode != "faketcp" || cfg.KCP {
+			log.Fatalln(errors.New("key rotation is only supported in fake TCP without KCP"))
+		}
+		if cfg.Password == "" {
+			log.Fatalln(errors.New("key rotation requires a password"))
+		}
 	}
 
-	log.Infof("Proxy from :%d\n", cfg.Port)
+	// Strict validation
+	isStrict = cfg.Strict
+	if isStrict {
+		if cfg.Password == "" {
+			log.Fatalln(errors.New("strict validation requires a password"))
+		}
+		pcap.SetStrict(true)
+		log.Infoln("Validate inbound packets strictly")
+	}
 
-	// Find devices
-	listenDevs, err = pcap.FindListenDevs(cfg.ListenDevs)
+	// Crypt
+	if isRekey {
+		crypt, err = crypto.CreateRotatingCrypt(cfg.Method, cfg.Password)
+	} else {
+		crypt, err = crypto.ParseCrypt(cfg.Method, cfg.Password)
+	}
 	if err != nil {
-		log.Fatalln(fmt.Errorf("find listen devices: %w", err))
+		log.Fatalln(fmt.Errorf("parse crypt: %w", err))
 	}
-	if len(cfg.ListenDevs) <= 0 {
-		// Remove loopback devices by default
-		result := make([]*pcap.Device, 0)
-
-		for _, dev := range listenDevs {
-			if dev.IsLoop() {
-				continue
-			}
-			result = append(result, dev)
+	if cfg.AntiReplay {
+		if mode != "faketcp" {
+			log.Fatalln(errors.New("anti-replay is only supported in fake TCP"))
 		}
-
-		listenDevs = result
+		// Sequence numbers in malleable methods, like AES-CFB, can be forged
+		if !crypt.Method().IsAEAD() && !isStrict {
+			log.Fatalln(errors.New("anti-replay requires an aead method or strict validation"))
+		}
+		crypt = crypto.WrapReplay(crypt)
+		log.Infof("Drop replayed packets in a window of %d packets\n", crypto.ReplayWindow)
 	}
-	if len(listenDevs) <= 0 {
-		log.Fatalln(errors.New("cannot determine listen device"))
+	if isStrict {
+		crypt = crypto.WrapMAC(crypt, cfg.Password)
 	}
-
-	upDev, gatewayDev, err = pcap.FindUpstreamDevAndGatewayDev(cfg.UpDev, gateway)
+	acl, err := pcap.ParseACL(cfg.Allow, cfg.Deny)
 	if err != nil {
-		log.Fatalln(fmt.Errorf("find upstream device and gateway device: %w", err))
+		log.Fatalln(fmt.Errorf("parse acl: %w", err))
 	}
-	if upDev == nil && gatewayDev == nil {
-		log.Fatalln(errors.New("cannot determine upstream device and gateway device"))
+	if !acl.IsEmpty() {
+		pcap.SetACL(acl)
+		log.Infof("Refuse clients by ACL %s\n", acl)
 	}
-	if upDev == nil {
-		log.Fatalln(errors.New("cannot determine upstream device"))
+	method := crypt.Method()
+	if method != crypto.MethodPlain {
+		log.Infof("Encrypt with %s\n", method)
 	}
-	if gatewayDev == nil {
-		log.Fatalln(errors.New("cannot determine gateway device"))
+	if isRekey {
+		log.Infoln("Rotate keys when clients propose")
 	}
 
-	// Wait signals
-	sig := make(chan os.Signal)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sig
-		closeAll()
-		os.Exit(0)
-	}()
+	// Obfuscation
+	o, err := obfs.ParseObfs(cfg.Obfs)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse obfs: %w", err))
+	}
+	if o.Method() != obfs.MethodNone {
+		log.Infof("Obfuscate with %s\n", o.Method())
+	}
+	crypt = obfs.WrapCrypt(crypt, o)
 
-	// Open pcap
-	err = open()
+	// IPv4 Id
+	idStrategy, err := pcap.ParseIdStrategy(cfg.IPId)
 	if err != nil {
-		log.Fatalln(fmt.Errorf("open pcap: %w", err))
+		log.Fatalln(fmt.Errorf("parse ip id: %w", err))
+	}
+	pcap.SetIdStrategy(idStrategy)
+	if idStrategy != pcap.IdStrategyRandom {
+		log.Infof("Generate IPv4 Id in %s\n", idStrategy)
 	}
-}
 
-func open() error {
-	var err error
+	// TTL of crafted packets
+	if cfg.TTL < 0 || cfg.TTL > 255 {
+		log.Fatalln(fmt.Errorf("ttl %d out of range", cfg.TTL))
+	}
+	if cfg.TTL > 0 {
+		pcap.SetTTL(uint8(cfg.TTL))
+		log.Infof("Craft packets in TTL %d\n", cfg.TTL)
+	}
 
-	// Verify
-	if port <= 0 || port > 65535 {
-		return fmt.Errorf("port %d out of range", port)
+	// TCP options
+	if cfg.TCPWindow <= 0 || cfg.TCPWindow > 65535 {
+		log.Fatalln(fmt.Errorf("tcp window %d out of range", cfg.TCPWindow))
 	}
-	if len(listenDevs) <= 0 {
-		return errors.New("missing listen device")
+	if cfg.TCPMSS < 0 || cfg.TCPMSS > 65535 {
+		log.Fatalln(fmt.Errorf("tcp mss %d out of range", cfg.TCPMSS))
 	}
-	if upDev == nil {
-		return errors.New("missing upstream device")
+	if cfg.TCPWindowScale < 0 || cfg.TCPWindowScale > 14 {
+		log.Fatalln(fmt.Errorf("tcp window scale %d out of range", cfg.TCPWindowScale))
 	}
-	if gatewayDev == nil {
-		return errors.New("missing gateway")
+	pcap.SetTCPOptions(uint16(cfg.TCPWindow), uint16(cfg.TCPMSS), uint8(cfg.TCPWindowScale), cfg.TCPTimestamps)
+	if cfg.TCPWindow != 65535 {
+		log.Infof("Set TCP window to %d\n", cfg.TCPWindow)
 	}
-
-	if len(listenDevs) == 1 {
+	if cfg.TCPMSS > 0 {
+		log.Infof("Set TCP MSS option to %d Bytes\n", cfg.TCPMSS)
+	}
+	if cfg.TCPWindowScale > 0 {
+		log.Infof("Set TCP window scale option to %d\n", cfg.TCPWindowScale)
+	}
+	if cfg.TCPTimestamps {
+		log.Infoln("Enable TCP timestamps option")
+	}
+
+	// ToS
+	tosMode, err := pcap.ParseToSMode(cfg.CopyToS)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse copy tos: %w", err))
+	}
+	pcap.SetToSMode(tosMode)
+	if tosMode != pcap.ToSModeNone {
+		log.Infof("Copy %s of embedded packets to the tunnel\n", strings.ToUpper(cfg.CopyToS))
+	}
+
+	// Custom filter, which needs to be validated after the snap length is set
+	if cfg.Filter != "" {
+		err := pcap.ValidateBPFFilter(cfg.Filter)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse filter %s: %w", cfg.Filter, err))
+		}
+		customFilter = cfg.Filter
+		log.Infof("Filter with %s\n", customFilter)
+	}
+
+	// TTL
+	preserveTTL = cfg.PreserveTTL
+	if preserveTTL {
+		log.Infoln("Preserve TTL of embedded packets")
+	}
+
+	// Workers
+	if cfg.Workers < 1 {
+		log.Fatalln(fmt.Errorf("workers %d out of range", cfg.Workers))
+	}
+	pool = worker.NewPool(cfg.Workers)
+	if cfg.Workers > 1 {
+		log.Infof("Handle packets in %d workers\n", cfg.Workers)
+	}
+
+	// Snap length
+	if cfg.SnapLen < pcap.DefaultSnapLen || cfg.SnapLen > pcap.MaxSnapLen {
+		log.Fatalln(fmt.Errorf("snap length %d out of range", cfg.SnapLen))
+	}
+	pcap.SetSnapLen(cfg.SnapLen)
+	if cfg.SnapLen != pcap.DefaultSnapLen {
+		log.Infof("Capture with snap length %d\n", cfg.SnapLen)
+	}
+
+	// Capturing
+	err = pcap.ValidatePcapConfig(&cfg.PcapConfig)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("pcap tuning: %w", err))
+	}
+	pcap.SetPcapConfig(&cfg.PcapConfig)
+	if cfg.PcapConfig.Immediate {
+		log.Infoln("Capture in immediate mode")
+	}
+	if cfg.PcapConfig.Buffer > 0 {
+		log.Infof("Capture with buffer size %d Bytes\n", cfg.PcapConfig.Buffer)
+	}
+	if cfg.PcapConfig.Timeout > 0 {
+		log.Infof("Capture with read timeout %d ms\n", cfg.PcapConfig.Timeout)
+	}
+	if len(cfg.PcapConfig.NoPromisc) > 0 {
+		log.Infof("Capture without promiscuous mode on %s\n", strings.Join(cfg.PcapConfig.NoPromisc, ", "))
+	}
+	if cfg.PcapConfig.Tstamp != "" {
+		log.Infof("Capture with timestamp source %s\n", cfg.PcapConfig.Tstamp)
+	}
+	if cfg.PcapConfig.Ring > 0 {
+		log.Infof("Capture into a ring of %d packets\n", cfg.PcapConfig.Ring)
+	}
+	if cfg.PcapConfig.Mmap {
+		log.Infoln("Capture by mapping the ring of the kernel")
+	}
+
+	// Reorder
+	if cfg.ReorderWindow < 0 {
+		log.Fatalln(fmt.Errorf("reorder window %d out of range", cfg.ReorderWindow))
+	}
+	if cfg.ReorderTimeout <= 0 {
+		log.Fatalln(fmt.Errorf("reorder timeout %d out of range", cfg.ReorderTimeout))
+	}
+	pcap.SetReorder(cfg.ReorderWindow, time.Duration(cfg.ReorderTimeout)*time.Millisecond)
+	if cfg.ReorderWindow > 0 {
+		log.Infof("Reorder segments in a window of %d in %d ms\n", cfg.ReorderWindow, cfg.ReorderTimeout)
+	}
+
+	// Rate limit
+	limit, err := shape.ParseRate(cfg.Limit)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse limit: %w", err))
+	}
+	limitPerFlow, err := shape.ParseRate(cfg.LimitPerFlow)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse limit per flow: %w", err))
+	}
+	limiter = shape.NewLimiter(limit, limitPerFlow)
+	if limit > 0 {
+		log.Infof("Limit throughput to %s\n", shape.FormatRate(limit))
+	}
+	if limitPerFlow > 0 {
+		log.Infof("Limit throughput per flow to %s\n", shape.FormatRate(limitPerFlow))
+	}
+
+	// Priority
+	if len(cfg.Priority) > 0 {
+		priorityRules, err = shape.ParseRules(cfg.Priority)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse priority: %w", err))
+		}
+		scheduler = shape.NewScheduler(limiter, stat.DirectionIn)
+		log.Infof("Schedule packets in priority by %s\n", strings.Join(cfg.Priority, ", "))
+	}
+
+	// Hooks
+	if len(cfg.Hooks) > 0 || cfg.LogFlows || cfg.IPFIX != "" || cfg.LogSample > 1 {
+		hs := make([]hook.Hook, 0)
+		for _, s := range cfg.Hooks {
+			path, arg := s, ""
+			i := strings.Index(s, "@")
+			if i >= 0 {
+				path, arg = s[:i], s[i+1:]
+			}
+
+			h, err := hook.Open(path, arg)
+			if err != nil {
+				log.Fatalln(fmt.Errorf("open hook %s: %w", path, err))
+			}
+			hs = append(hs, h)
+		}
+		if len(hs) > 0 {
+			log.Infof("Attach %d hooks\n", len(hs))
+		}
+		if cfg.LogFlows {
+			hs = append(hs, hook.NewFlowLog())
+
+			log.Infoln("Print summaries of flows")
+		}
+		if cfg.IPFIX != "" {
+			h, err := hook.NewIPFIX(cfg.IPFIX)
+			if err != nil {
+				log.Fatalln(fmt.Errorf("ipfix: %w", err))
+			}
+			hs = append(hs, h)
+
+			log.Infof("Export flows in IPFIX to %s\n", cfg.IPFIX)
+		}
+		hooks = hook.NewChain(hs, keepAlive)
+		go hooks.Run(keepAlive)
+	}
+
+	// Authentication
+	auth = crypto.CreateAuth(cfg.Password)
+	if auth != nil {
+		log.Infoln("Authenticate with password")
+	}
+
+	// NAT
+	if cfg.NATMaxEntries < 0 {
+		log.Fatalln(fmt.Errorf("nat max entries %d out of range", cfg.NATMaxEntries))
+	}
+	if cfg.ClientMaxConns < 0 {
+		log.Fatalln(fmt.Errorf("client max connections %d out of range", cfg.ClientMaxConns))
+	}
+	if cfg.CloseTimeout < 0 {
+		log.Fatalln(fmt.Errorf("close timeout %d out of range", cfg.CloseTimeout))
+	}
+	if cfg.HalfOpenTTL < 0 {
+		log.Fatalln(fmt.Errorf("half-open timeout %d out of range", cfg.HalfOpenTTL))
+	}
+	if cfg.EstablishedTTL < 0 {
+		log.Fatalln(fmt.Errorf("established timeout %d out of range", cfg.EstablishedTTL))
+	}
+	natMaxEntries = cfg.NATMaxEntries
+	clientMaxConns = cfg.ClientMaxConns
+	patMaps = make(map[string]*nat.Table)
+	natMap = nat.NewTable(keepAlive, natMaxEntries)
+	go natMap.Run(keepAlive)
+	if clientMaxConns > 0 {
+		log.Infof("Limit each client to %d connections\n", clientMaxConns)
+	}
+	closeTimeout = time.Duration(cfg.CloseTimeout) * time.Second
+	if closeTimeout > 0 {
+		log.Infof("Tear down closed TCP connections in %d seconds\n", cfg.CloseTimeout)
+	}
+	halfOpenTTL = time.Duration(cfg.HalfOpenTTL) * time.Second
+	if halfOpenTTL > 0 {
+		log.Infof("Expire TCP connections in handshakes in %d seconds\n", cfg.HalfOpenTTL)
+	}
+	establishedTTL = time.Duration(cfg.EstablishedTTL) * time.Second
+	if establishedTTL > 0 {
+		log.Infof("Expire established TCP connections in %d seconds\n", cfg.EstablishedTTL)
+	}
+	isResume = cfg.Resume
+	if isResume {
+		if cfg.Password == "" {
+			log.Warnln("Tokens of resumption are not protected by a password")
+		}
+		log.Infoln("Resume sessions of clients from other addresses")
+	}
+	natBehavior, err = nat.ParseBehavior(cfg.NAT)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse nat: %w", err))
+	}
+	if natBehavior.IsFiltering() {
+		filterMap = nat.NewTable(keepAlive, 0)
+		go filterMap.Run(keepAlive)
+	}
+	if natBehavior != nat.BehaviorFullCone {
+		log.Infof("Behave as %s NAT\n", natBehavior)
+	}
+	preservePort = cfg.PreservePort
+	if preservePort {
+		log.Infoln("Preserve ports of sources if possible")
+	}
+
+	// Translation
+	if cfg.Translate != "" {
+		translator, err = pcap.ParseTranslator(cfg.Translate)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse translate: %w", err))
+		}
+		log.Infof("Translate between IPv4 and IPv6 with prefix %s\n", translator.Prefix())
+	}
+
+	// Clients
+	for id, clientCfg := range cfg.Clients {
+		if id == "" || len(id) > pcap.MaxIdSize {
+			log.Fatalln(fmt.Errorf("client id size %d out of range", len(id)))
+		}
+		profile, err := parseClientProfile(&clientCfg)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse client %s: %w", id, err))
+		}
+		clientProfiles[id] = profile
+	}
+	err = checkPortRanges()
+	if err != nil {
+		log.Fatalln(fmt.Errorf("check clients: %w", err))
+	}
+	if len(clientProfiles) > 0 {
+		log.Infof("Apply settings to %d clients by their Ids\n", len(clientProfiles))
+	}
+
+	// Port forwarding
+	for _, forwardCfg := range cfg.Forwards {
+		f, err := parseForward(&forwardCfg)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse forward: %w", err))
+		}
+		key := forwardKey{protocol: f.protocol, port: f.port}
+		if _, ok := forwards[key]; ok {
+			log.Fatalln(fmt.Errorf("%s port %d forwarded more than once", f.protocol, f.port))
+		}
+		if f.protocol == layers.LayerTypeTCP && f.port == port {
+			log.Fatalln(fmt.Errorf("forward listen port %d", f.port))
+		}
+		if f.protocol == layers.LayerTypeTCP && hop != nil {
+			min, max := hop.Range()
+			if f.port >= min && f.port <= max {
+				log.Fatalln(fmt.Errorf("forward hopping port %d", f.port))
+			}
+		}
+		forwards[key] = f
+		log.Infof("Forward %s port %d to %s of client %s\n", f.protocol, f.port, f.addr, f.id)
+	}
+
+	// State
+	statePath = cfg.State
+	if statePath != "" {
+		n, err := restoreNAT()
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				log.Errorln(fmt.Errorf("restore nat: %w", err))
+			}
+		} else if n > 0 {
+			log.Infof("Restore %d NAT entries from %s\n", n, statePath)
+		}
+
+		go func() {
+			ticker := time.NewTicker(keepAlive)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				if isClosed {
+					return
+				}
+
+				err := saveNAT()
+				if err != nil {
+					log.Errorln(fmt.Errorf("save nat: %w", err))
+				}
+			}
+		}()
+
+		log.Infof("Save NAT to %s\n", statePath)
+	}
+
+	// Users
+	if cfg.Users != "" {
+		users, err = user.ParseUsers(cfg.Users)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse users: %w", err))
+		}
+		if len(users) <= 0 {
+			log.Fatalln(fmt.Errorf("missing users in %s", cfg.Users))
+		}
+
+		usagePath = cfg.Usage
+		if usagePath == "" {
+			usagePath = cfg.Users + ".usage"
+		}
+		n, err := users.LoadUsage(usagePath)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				log.Errorln(fmt.Errorf("restore usage: %w", err))
+			}
+		} else if n > 0 {
+			log.Infof("Restore usage of %d users from %s\n", n, usagePath)
+		}
+
+		go func() {
+			ticker := time.NewTicker(keepAlive)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				if isClosed {
+					return
+				}
+
+				err := users.SaveUsage(usagePath)
+				if err != nil {
+					log.Errorln(fmt.Errorf("save usage: %w", err))
+				}
+			}
+		}()
+
+		log.Infof("Authenticate %d users and save their usage to %s\n", len(users), usagePath)
+	} else if cfg.Usage != "" {
+		log.Fatalln(errors.New("usage must be used with users"))
+	}
+
+	// Dump
+	if cfg.Dump != "" {
+		dumper, err = pcap.NewDumper(cfg.Dump)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("create dumper: %w", err))
+		}
+		pcap.SetDumper(dumper)
+		log.Infof("Dump packets to %s\n", cfg.Dump)
+	}
+
+	// Statistics
+	if cfg.Stats > 0 || cfg.Monitor != 0 {
+		flows = stat.NewFlowRecorder()
+	}
+	if cfg.Stats > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Duration(cfg.Stats) * time.Second)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				n := natMap.Len()
+
+				var dropped uint64
+				for _, s := range pcap.AllCaptureStats() {
+					dropped = dropped + s.Dropped
+				}
+
+				log.Infof("%s  NAT entries: %d  TCP handshakes: %s  Dropped in capturing: %d  Replayed: %d  Refused: %d\n",
+					flows.Summary(5), n, nat.AllTCPStats(), dropped, crypto.Replayed(), pcap.Refused())
+			}
+		}()
+
+		log.Infof("Print statistics every %d seconds\n", cfg.Stats)
+	}
+
+	// Status line
+	if cfg.Status > 0 && log.IsTerminal() && !(cfg.LogJSON || *argLogJSON) {
+		if flows == nil {
+			flows = stat.NewFlowRecorder()
+		}
+		meter := stat.NewRateMeter(flows)
+		go func() {
+			ticker := time.NewTicker(time.Duration(cfg.Status) * time.Second)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				n := natMap.Len()
+				var dropped uint64
+				for _, s := range pcap.AllCaptureStats() {
+					dropped = dropped + s.Dropped
+				}
+
+				log.SetStatus(fmt.Sprintf("%s  NAT %d  Dropped %d", meter.Sample(), n, dropped))
+			}
+		}()
+	}
+
+	// Drop alerts
+	go func() {
+		watcher := pcap.NewDropWatcher()
+		ticker := time.NewTicker(checkDrops)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if isClosed {
+				return
+			}
+			for dev, n := range watcher.Check() {
+				log.Warnf("Kernel drops %d packets in capturing in device %s, try a larger buffer by -pcap-buffer\n", n, dev)
+			}
+		}
+	}()
+
+	// Monitor
+	if cfg.Monitor != 0 {
+		if cfg.Monitor == int(port) {
+			log.Fatalln(fmt.Errorf("same monitor port with listen port"))
+		}
+
+		monitor = stat.NewTrafficMonitor()
+
+		mux := http.NewServeMux()
+		go func() {
+			mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+				b, err := json.Marshal(&struct {
+					Name    string               `json:"name"`
+					Version string               `json:"version"`
+					Time    int                  `json:"time"`
+					Monitor *stat.TrafficMonitor `json:"monitor"`
+				}{
+					Name:    name,
+					Version: versionInfo,
+					Time:    int(time.Now().Sub(startTime).Seconds()),
+					Monitor: monitor,
+				})
+				if err != nil {
+					log.Errorln(fmt.Errorf("monitor: %w", err))
+					return
+				}
+
+				// Handle CORS
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+
+				_, err = io.WriteString(w, string(b))
+				if err != nil {
+					log.Errorln(fmt.Errorf("monitor: %w", err))
+				}
+			})
+
+			mux.HandleFunc("/flows", func(w http.ResponseWriter, req *http.Request) {
+				b, err := json.Marshal(flows.Stats())
+				if err != nil {
+					log.Errorln(fmt.Errorf("monitor: %w", err))
+					return
+				}
+
+				// Handle CORS
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+
+				_, err = io.WriteString(w, string(b))
+				if err != nil {
+					log.Errorln(fmt.Errorf("monitor: %w", err))
+				}
+			})
+			mux.HandleFunc("/capture", func(w http.ResponseWriter, req *http.Request) {
+				b, err := json.Marshal(pcap.AllCaptureStats())
+				if err != nil {
+					log.Errorln(fmt.Errorf("monitor: %w", err))
+					return
+				}
+
+				// Handle CORS
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+
+				_, err = io.WriteString(w, string(b))
+				if err != nil {
+					log.Errorln(fmt.Errorf("monitor: %w", err))
+				}
+			})
+			mux.HandleFunc("/dns", func(w http.ResponseWriter, req *http.Request) {
+				type IPName struct {
+					IP   string `json:"ip"`
+					Name string `json:"name"`
+				}
+
+				ipNames := make([]IPName, 0)
+				dnsLock.RLock()
+				for ip, name := range dns {
+					ipNames = append(ipNames, IPName{
+						IP:   ip,
+						Name: name,
+					})
+				}
+				dnsLock.RUnlock()
+
+				b, err := json.Marshal(ipNames)
+				if err != nil {
+					log.Errorln(fmt.Errorf("monitor: %w", err))
+					return
+				}
+
+				// Handle CORS
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+
+				_, err = io.WriteString(w, string(b))
+				if err != nil {
+					log.Errorln(fmt.Errorf("monitor: %w", err))
+				}
+			})
+
+			mux.HandleFunc("/clients", func(w http.ResponseWriter, req *http.Request) {
+				b, err := json.Marshal(clientStats())
+				if err != nil {
+					log.Errorln(fmt.Errorf("monitor: %w", err))
+					return
+				}
+
+				// Handle CORS
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+
+				_, err = io.WriteString(w, string(b))
+				if err != nil {
+					log.Errorln(fmt.Errorf("monitor: %w", err))
+				}
+			})
+
+			mux.HandleFunc("/users", func(w http.ResponseWriter, req *http.Request) {
+				b, err := json.Marshal(userStats())
+				if err != nil {
+					log.Errorln(fmt.Errorf("monitor: %w", err))
+					return
+				}
+
+				// Handle CORS
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+
+				_, err = io.WriteString(w, string(b))
+				if err != nil {
+					log.Errorln(fmt.Errorf("monitor: %w", err))
+				}
+			})
+
+			mux.HandleFunc("/nat", func(w http.ResponseWriter, req *http.Request) {
+				b, err := json.Marshal(natMappings())
+				if err != nil {
+					log.Errorln(fmt.Errorf("monitor: %w", err))
+					return
+				}
+
+				// Handle CORS
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+
+				_, err = io.WriteString(w, string(b))
+				if err != nil {
+					log.Errorln(fmt.Errorf("monitor: %w", err))
+				}
+			})
+
+			err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.Monitor), mux)
+			if err != nil {
+				log.Errorln(fmt.Errorf("monitor: %w", err))
+			}
+		}()
+
+		log.Infof("Monitor on :%d\n", cfg.Monitor)
+		log.Infoln("You can now observe traffic on http://ikago.ikas.ink")
+	}
+
+	// Control
+	if cfg.Control != "" {
+		local, err := control.IsLocal(cfg.Control)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse control address %s: %w", cfg.Control, err))
+		}
+		if !local && cfg.ControlToken == "" {
+			log.Warnf("Control API on %s is not local and is not protected by a token\n", cfg.Control)
+		}
+
+		controlServer = control.NewServer(cfg.Control, cfg.ControlToken)
+		handleControl(controlServer)
+
+		go func() {
+			err := controlServer.ListenAndServe()
+			if err != nil {
+				log.Errorln(fmt.Errorf("control: %w", err))
+			}
+		}()
+
+		log.Infof("Control on %s\n", cfg.Control)
+	}
+
+	// Profiling
+	if cfg.Pprof != "" {
+		local, err := control.IsLocal(cfg.Pprof)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse pprof address %s: %w", cfg.Pprof, err))
+		}
+		if !local {
+			log.Warnf("Profiles on %s are not local\n", cfg.Pprof)
+		}
+
+		go func() {
+			err := http.ListenAndServe(cfg.Pprof, prof.Handler())
+			if err != nil {
+				log.Errorln(fmt.Errorf("pprof: %w", err))
+			}
+		}()
+
+		log.Infof("Profile on http://%s/debug/pprof/\n", cfg.Pprof)
+	}
+
+	// Batch
+	batch = cfg.Batch
+	batchInterval = time.Duration(cfg.BatchInterval) * time.Millisecond
+	if batch > 0 {
+		log.Infof("Batch packets up to %d Bytes in %s\n", batch, batchInterval)
+	}
+
+	// MTU
+	mtu = cfg.MTU
+	if mtu != pcap.MaxMTU {
+		log.Infof("Set MTU to %d Bytes\n", mtu)
+	}
+
+	// KCP
+	isKCP = cfg.KCP
+	kcpConfig = &cfg.KCPConfig
+	if isKCP {
+		log.Infoln("Enable KCP")
+	}
+
+	// FEC
+	if cfg.FECDataShard < 0 || cfg.FECDataShard > 255 {
+		log.Fatalln(fmt.Errorf("fec data shard %d out of range", cfg.FECDataShard))
+	}
+	if cfg.FECParityShard < 0 || cfg.FECDataShard+cfg.FECParityShard > 256 {
+		log.Fatalln(fmt.Errorf("fec parity shard %d out of range", cfg.FECParityShard))
+	}
+	pcap.SetFEC(cfg.FECDataShard, cfg.FECParityShard)
+	if cfg.FECDataShard > 0 {
+		if (mode != "faketcp" && mode != "udp") || isKCP || batch > 0 {
+			log.Fatalln(errors.New("fec is only supported in fake TCP or UDP without KCP or batching"))
+		}
+		log.Infof("Correct errors in %d data shards and %d parity shards\n", cfg.FECDataShard, cfg.FECParityShard)
+	}
+
+	// Pacing
+	pcap.SetPacing(cfg.Pacing)
+	if cfg.Pacing {
+		if (mode != "faketcp" && mode != "udp") || isKCP {
+			log.Fatalln(errors.New("pacing is only supported in fake TCP or UDP without KCP"))
+		}
+		log.Infoln("Pace frames by delivery rates")
+	}
+
+	// WebSocket
+	wsConfig = &cfg.WebSocket
+	if mode == "websocket" {
+		if !strings.HasPrefix(wsConfig.Path, "/") {
+			log.Fatalln(fmt.Errorf("invalid websocket path %s", wsConfig.Path))
+		}
+		if wsConfig.TLS {
+			if wsConfig.Cert == "" || wsConfig.Key == "" {
+				log.Fatalln(errors.New("websocket in tls requires a certificate and a key"))
+			}
+			log.Infoln("Accept WebSocket in TLS")
+		}
+	}
+
+	log.Infof("Proxy from :%d\n", cfg.Port)
+
+	// MSS clamping
+	if cfg.ClampMSS {
+		cost := crypt.Cost()
+		if isKCP {
+			// KCP headers
+			cost = cost + 32
+		}
+		clampMSS = pcap.TunnelMSS(mtu, cost)
+		log.Infof("Clamp MSS of TCP SYN segments to %d Bytes, or %d Bytes to clients in IPv6\n", clampMSS, clampMSS-20)
+	}
+
+	// Window clamping
+	if cfg.ClampWindow {
+		windowClamp = pcap.NewWindowClamp()
+		log.Infoln("Clamp receive window of TCP segments to the bandwidth-delay product of the tunnel")
+	}
+
+	// Find devices
+	listenDevs, err = pcap.FindListenDevs(cfg.ListenDevs)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("find listen devices: %w", err))
+	}
+	if len(cfg.ListenDevs) <= 0 {
+		// Remove loopback devices by default
+		result := make([]*pcap.Device, 0)
+
+		for _, dev := range listenDevs {
+			if dev.IsLoop() {
+				continue
+			}
+			result = append(result, dev)
+		}
+
+		listenDevs = result
+	}
+	if len(listenDevs) <= 0 {
+		log.Fatalln(errors.New("cannot determine listen device"))
+	}
+
+	if cfg.PPPoE {
+		upDev, gatewayDev, err = pcap.FindPPPoEDevAndGatewayDev(cfg.UpDev)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("find pppoe device and gateway device: %w", err))
+		}
+		log.Infof("Route upstream in PPPoE session %d\n", upDev.PPPoE())
+	} else {
+		upDev, gatewayDev, err = pcap.FindUpstreamDevAndGatewayDev(cfg.UpDev, gateway)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("find upstream device and gateway device: %w", err))
+		}
+	}
+	if upDev == nil && gatewayDev == nil {
+		log.Fatalln(errors.New("cannot determine upstream device and gateway device"))
+	}
+	if upDev == nil {
+		log.Fatalln(errors.New("cannot determine upstream device"))
+	}
+	if gatewayDev == nil {
+		log.Fatalln(errors.New("cannot determine gateway device"))
+	}
+	if cfg.UpIP != "" {
+		ip := net.ParseIP(cfg.UpIP)
+		if ip == nil {
+			log.Fatalln(fmt.Errorf("invalid upstream ip %s", cfg.UpIP))
+		}
+		upDev, err = pcap.SelectDevIP(upDev, ip)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("select upstream ip: %w", err))
+		}
+	}
+	if cfg.VLAN > 0 {
+		upDev.SetVLAN(uint16(cfg.VLAN))
+		log.Infof("Tag upstream with VLAN %d\n", cfg.VLAN)
+	}
+
+	// Upstream of clients
+	for id, profile := range clientProfiles {
+		if profile.upDevName == "" && profile.upIP == nil {
+			continue
+		}
+
+		dev, gwDev := upDev, gatewayDev
+		if profile.upDevName != "" {
+			dev, gwDev, err = pcap.FindUpstreamDevAndGatewayDev(profile.upDevName, gateway)
+			if err != nil {
+				log.Fatalln(fmt.Errorf("find upstream device and gateway device of client %s: %w", id, err))
+			}
+			if dev == nil || gwDev == nil {
+				log.Fatalln(fmt.Errorf("cannot determine upstream device and gateway device of client %s", id))
+			}
+			if cfg.VLAN > 0 {
+				dev.SetVLAN(uint16(cfg.VLAN))
+			}
+			if !gwDev.IsLoop() && dev.Name() != upDev.Name() {
+				go pcap.NewResolver(dev).Keep(gwDev, 30*time.Second)
+			}
+		}
+		if profile.upIP != nil {
+			dev, err = pcap.SelectDevIP(dev, profile.upIP)
+			if err != nil {
+				log.Fatalln(fmt.Errorf("select upstream ip of client %s: %w", id, err))
+			}
+		}
+
+		profile.upDev, profile.gatewayDev = dev, gwDev
+	}
+
+	// Static hardware addresses of next hops
+	macOverrides, err = pcap.ParseMACOverrides(cfg.StaticMAC)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse static mac: %w", err))
+	}
+	if hardwareAddr := macOverrides.OfDev(upDev); hardwareAddr != nil {
+		gatewayDev.PinHardwareAddr(hardwareAddr)
+		log.Infof("Pin next hop of %s to %s\n", upDev.Alias(), hardwareAddr)
+	}
+	for id, profile := range clientProfiles {
+		if profile.upDevName == "" || profile.gatewayDev == gatewayDev {
+			continue
+		}
+		if hardwareAddr := macOverrides.OfDev(profile.upDev); hardwareAddr != nil {
+			profile.gatewayDev.PinHardwareAddr(hardwareAddr)
+			log.Infof("Pin next hop of %s of client %s to %s\n", profile.upDev.Alias(), id, hardwareAddr)
+		}
+	}
+	for _, o := range macOverrides {
+		if o.IsCIDR() {
+			log.Infof("Pin next hop to %s\n", o)
+		}
+	}
+
+	// Multicast
+	if cfg.MulticastDev != "" {
+		devs, err := pcap.FindListenDevs([]string{cfg.MulticastDev})
+		if err != nil {
+			log.Fatalln(fmt.Errorf("find multicast device: %w", err))
+		}
+		if len(devs) != 1 {
+			log.Fatalln(fmt.Errorf("multicast device %s matches %d devices", cfg.MulticastDev, len(devs)))
+		}
+		multicastDev = devs[0]
+	}
+
+	// Offloading
+	checkOffloads(append([]*pcap.Device{upDev}, listenDevs...)...)
+
+	// Keep the hardware address of the gateway
+	if !gatewayDev.IsLoop() {
+		go pcap.NewResolver(upDev).Keep(gatewayDev, 30*time.Second)
+	}
+
+	// Wait signals
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		_ = daemon.Stopping()
+		closeAll()
+		os.Exit(0)
+	}()
+
+	// Run as a service if started by the service manager
+	err = daemon.Serve(strings.ToLower(name), func() {
+		sig <- syscall.SIGTERM
+	})
+	if err != nil {
+		log.Errorln(fmt.Errorf("serve: %w", err))
+	}
+
+	// Open pcap
+	err = open()
+	if err != nil {
+		log.Fatalln(fmt.Errorf("open pcap: %w", err))
+	}
+}
+
+func open() error {
+	var err error
+
+	// Verify
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("port %d out of range", port)
+	}
+	if len(listenDevs) <= 0 {
+		return errors.New("missing listen device")
+	}
+	if upDev == nil {
+		return errors.New("missing upstream device")
+	}
+	if gatewayDev == nil {
+		return errors.New("missing gateway")
+	}
+
+	if len(listenDevs) == 1 {
 		log.Infof("Listen on %s\n", listenDevs[0].String())
 	} else {
-		log.Infoln("Listen on:")
-		for _, dev := range listenDevs {
-			log.Infof("  %s\n", dev.String())
+		log.Infoln("Listen on:")
+		for _, dev := range listenDevs {
+			log.Infof("  %s\n", dev.String())
+		}
+	}
+	if !gatewayDev.IsLoop() {
+		log.Infof("Route upstream from %s to %s\n", upDev, gatewayDev)
+	} else {
+		log.Infof("Route upstream in %s\n", upDev)
+	}
+
+	for _, dev := range listenDevs {
+		listener, err := listen(dev, port)
+		if err != nil {
+			return fmt.Errorf("open listen device %s: %w", dev.Alias(), err)
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	// Handles for routing upstream
+	rawConn, err := pcap.CreateRawConn(upDev, gatewayDev, upstreamFilter())
+	if err != nil {
+		return fmt.Errorf("open upstream device %s: %w", upDev.Alias(), err)
+	}
+	rawConn.EnableSegmentation()
+	upConn = rawConn
+
+	// Handles for routing upstream of clients, clients with the same upstream share a handle
+	conns := make(map[string]pcap.PacketConn)
+	for id, profile := range clientProfiles {
+		if profile.upDev == nil {
+			continue
+		}
+
+		key := profile.upDev.String()
+		conn, ok := conns[key]
+		if !ok {
+			rawConn, err := pcap.CreateRawConn(profile.upDev, profile.gatewayDev, upstreamFilter())
+			if err != nil {
+				return fmt.Errorf("open upstream device %s of client %s: %w", profile.upDev.Alias(), id, err)
+			}
+			rawConn.EnableSegmentation()
+			conn = rawConn
+			conns[key] = conn
+			extraUpConns = append(extraUpConns, conn)
+		}
+		profile.upConn = conn
+
+		log.Infof("Route upstream of client %s from %s\n", id, profile.upDev)
+	}
+
+	// Hop
+	if hop != nil {
+		go hopListeners()
+	}
+
+	// Notify the service manager
+	err = daemon.Ready()
+	if err != nil {
+		log.Errorln(fmt.Errorf("notify ready: %w", err))
+	}
+
+	// Start handling
+	for _, listener := range listeners {
+		go accept(listener)
+	}
+
+	go func() {
+		for cab := range c {
+			cab := cab
+			pool.Submit(pcap.EmbFlowHash(cab.Bytes), func() {
+				err := handleListen(cab.Bytes, cab.Conn)
+				if err != nil {
+					log.Errorln(fmt.Errorf("handle listen in address %s: %w", cab.Conn.LocalAddr().String(), err))
+					reportError(err)
+					log.Verbosef("Source: %s\nSize: %d Bytes\n\n", cab.Conn.RemoteAddr().String(), len(cab.Bytes))
+				}
+			})
+		}
+	}()
+
+	// Handle for re-broadcasting multicast packets, which also reads replies to the device
+	if multicastDev != nil {
+		rawConn, err := pcap.CreateRawConn(multicastDev, multicastDev, upstreamFilter())
+		if err != nil {
+			return fmt.Errorf("open multicast device %s: %w", multicastDev.Alias(), err)
+		}
+		rawConn.EnableSegmentation()
+		multicastConn = rawConn
+		extraUpConns = append(extraUpConns, rawConn)
+
+		log.Infof("Re-broadcast multicast packets from clients in %s\n", multicastDev)
+	}
+
+	// Drop privileges as all handles are opened
+	if dropUser != "" {
+		err := privilege.Drop(dropUser)
+		if err != nil {
+			return fmt.Errorf("drop privileges: %w", err)
+		}
+
+		log.Infof("Drop privileges to user %s\n", dropUser)
+	}
+
+	// Each device is read once, as handles in the same device capture the same packets
+	read := map[string]bool{upDev.Name(): true}
+	for _, conn := range extraUpConns {
+		if read[conn.LocalDev().Name()] {
+			continue
+		}
+		read[conn.LocalDev().Name()] = true
+
+		go readUpstream(conn)
+	}
+
+	readUpstream(upConn)
+
+	return nil
+}
+
+// readUpstream handles packets read from the upstream connection until it is closed.
+func readUpstream(conn pcap.PacketConn) {
+	for {
+		packet, err := conn.ReadPacket()
+		if err != nil {
+			if isClosed {
+				return
+			}
+			log.Errorln(fmt.Errorf("read upstream in device %s: %w", conn.LocalDev().Alias(), err))
+			continue
+		}
+
+		pool.Submit(pcap.FlowHash(packet), func() {
+			err := handleUpstream(packet)
+			if err != nil {
+				log.Errorln(fmt.Errorf("handle upstream in device %s: %w", conn.LocalDev().Alias(), err))
+				reportError(err)
+				log.Verboseln(packet)
+			}
+		})
+	}
+}
+
+func closeAll() {
+	isClosed = true
+	log.StopStatus()
+	if statePath != "" && natMap != nil {
+		err := saveNAT()
+		if err != nil {
+			log.Errorln(fmt.Errorf("save nat: %w", err))
+		}
+	}
+	if users != nil {
+		err := users.SaveUsage(usagePath)
+		if err != nil {
+			log.Errorln(fmt.Errorf("save usage: %w", err))
+		}
+	}
+	patMapsLock.RLock()
+	for _, patMap := range patMaps {
+		patMap.Close()
+	}
+	patMapsLock.RUnlock()
+	if natMap != nil {
+		natMap.Close()
+	}
+	if filterMap != nil {
+		filterMap.Close()
+	}
+	if controlServer != nil {
+		controlServer.Close()
+	}
+	if hooks != nil {
+		hooks.Close()
+	}
+	listenersLock.RLock()
+	for _, handle := range listeners {
+		if handle != nil {
+			handle.Close()
+		}
+	}
+	for p, handles := range extraListeners {
+		for _, handle := range handles {
+			handle.Close()
+		}
+		if isRSTRule {
+			err := exec.DeleteRSTRule(p)
+			if err != nil {
+				log.Errorln(fmt.Errorf("delete rst rule: %w", err))
+			}
+		}
+	}
+	listenersLock.RUnlock()
+	if upConn != nil {
+		upConn.Close()
+	}
+	for _, conn := range extraUpConns {
+		conn.Close()
+	}
+	if dumper != nil {
+		dumper.Close()
+	}
+	if isRSTRule {
+		err := exec.DeleteRSTRule(port)
+		if err != nil {
+			log.Errorln(fmt.Errorf("delete rst rule: %w", err))
+		}
+	}
+}
+
+func handleListen(contents []byte, conn net.Conn) error {
+	var (
+		err          error
+		embIndicator *pcap.PacketIndicator
+		embFrags     []*pcap.PacketIndicator
+		upValue      uint16
+		upIP         net.IP
+		newLinkLayer gopacket.SerializableLayer
+		data         []byte
+		guide        pcap.NATGuide
+		ni           *natIndicator
+		q            nat.Flow
+	)
+
+	id, profile := profileOf(conn)
+	src := clientAddr(conn)
+	uc := upConn
+	if profile != nil && profile.upConn != nil {
+		uc = profile.upConn
+	}
+
+	// Empty payload
+	if len(contents) <= 0 {
+		// return errors.New("empty payload")
+		return nil
+	}
+
+	// Users
+	var u *user.User
+	if users != nil {
+		u = userOf(conn)
+		if u == nil {
+			log.Packetf(false, "Drop an inbound packet from a client not authenticated: %s\n", conn.RemoteAddr().String())
+			return nil
+		}
+	}
+
+	// Parse embedded packet
+	embIndicator, err = pcap.ParseEmbPacket(contents)
+	if err != nil {
+		return fmt.Errorf("parse embedded packet: %w", err)
+	}
+
+	// Reassemble fragments, so they are mapped in NAT and rewritten as a whole
+	embIndicator, embFrags, err = embDefrag.AppendOriginalFrom(embIndicator, src.String())
+	if err != nil {
+		return fmt.Errorf("defrag: %w", err)
+	}
+	if embIndicator == nil {
+		return nil
+	}
+	if len(embFrags) > 1 {
+		contents = embIndicator.NetworkData()
+	}
+
+	// Echo requests of speed tests
+	if pcap.IsSpeedTestRequest(embIndicator) {
+		return echoSpeedTest(embIndicator, conn)
+	}
+
+	// Replies from forwarded addresses
+	f := forwardFrom(id, embIndicator)
+	if f != nil {
+		setForwardConn(id, conn)
+	}
+
+	// Drop packets with sources which cannot be from clients
+	if isStrict && pcap.IsSpoofedSrc(embIndicator.SrcIP()) {
+		log.Packetf(false, "Drop an inbound %s packet with spoofed source: %s -> %s -> %s\n",
+			embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String())
+		return nil
+	}
+
+	// Measure the tunnel for clamping windows
+	if windowClamp != nil {
+		windowClamp.Observe(contents)
+	}
+
+	// Re-broadcast multicast and broadcast packets in the multicast device
+	isMulticast := pcap.IsMulticast(embIndicator.DstIP())
+	if isMulticast {
+		if multicastConn == nil {
+			log.Packetf(false, "Drop an inbound %s multicast packet: %s -> %s -> %s\n",
+				embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String())
+			return nil
+		}
+		uc = multicastConn
+	}
+
+	// The server is counted as a hop, and TTL expires here
+	if preserveTTL && embIndicator.TTL() <= 1 {
+		return replyTimeExceeded(embIndicator, conn, uc.LocalDev())
+	}
+
+	// Translate packets in the family which the upstream device does not have
+	translated := isTranslated(embIndicator.NetworkLayer().LayerType(), uc.LocalDev())
+	upProtocol := embIndicator.NATProtocol()
+	natDst := embIndicator.NATDst()
+	if translated {
+		if len(embFrags) > 1 {
+			return errors.New("translate fragments not support")
+		}
+		if embIndicator.IsICMPError() {
+			return errors.New("translate icmp errors not support")
+		}
+		switch upProtocol {
+		case layers.LayerTypeICMPv4:
+			upProtocol = layers.LayerTypeICMPv6
+		case layers.LayerTypeICMPv6:
+			upProtocol = layers.LayerTypeICMPv4
+		}
+		natDst, err = translateAddr(natDst)
+		if err != nil {
+			return fmt.Errorf("translate: %w", err)
+		}
+	} else if uc.LocalDev().IPAddrOf(embIndicator.DstIP()) == nil {
+		// Packets are carried in the tunnel in any family, but are routed upstream in their own family
+		return pcap.NewError(pcap.ErrNoRoute, "missing address of device %s in the family of %s", uc.LocalDev().Alias(), embIndicator.DstIP())
+	}
+
+	// Allowed ports of the client, except replies from forwarded addresses
+	if profile != nil && len(profile.allowedPorts) > 0 && !embIndicator.IsFrag() && f == nil {
+		if t := embIndicator.TransportLayer().LayerType(); (t == layers.LayerTypeTCP || t == layers.LayerTypeUDP) && !profile.allowedPorts[embIndicator.DstPort()] {
+			log.Packetf(false, "Drop an inbound %s packet to a port not allowed: %s -> %s -> %s\n",
+				embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String())
+			return nil
+		}
+	}
+
+	// Allowed ports and quotas of the user
+	if u != nil {
+		if t := embIndicator.TransportLayer().LayerType(); (t == layers.LayerTypeTCP || t == layers.LayerTypeUDP) && !embIndicator.IsFrag() && f == nil && !u.IsPortAllowed(embIndicator.DstPort()) {
+			log.Packetf(false, "Drop an inbound %s packet to a port not allowed for user %s: %s -> %s -> %s\n",
+				embIndicator.TransportProtocol(), u.Name(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String())
+			return nil
+		}
+		if !u.Use(len(contents)) {
+			log.Packetf(false, "Drop an inbound %s packet exceeding the quota of user %s: %s -> %s -> %s\n",
+				embIndicator.TransportProtocol(), u.Name(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String())
+			return nil
+		}
+	}
+
+	// Distribute port/Id by source and client address and protocol
+	if !embIndicator.IsFrag() {
+		q, err = newFlow(embIndicator.NATSrc(), src, embIndicator.NATProtocol())
+		if err != nil {
+			return fmt.Errorf("flow: %w", err)
+		}
+		// Each destination is mapped separately in symmetric NAT
+		if natBehavior.IsAddressDependentMapping() {
+			q.Remote, err = nat.NewEndpoint(embIndicator.NATDst())
+			if err != nil {
+				return fmt.Errorf("remote: %w", err)
+			}
+		}
+		// Replies from forwarded addresses leave from the forwarded ports
+		if f != nil {
+			upValue = f.port
+		} else {
+			patMap := patMapOf(src.String(), profile)
+			value, ok := patMap.Get(q)
+			if ok {
+				upValue = value.(uint16)
+			} else {
+				var err error
+
+				// if ICMPv4 error is not in NAT, drop it
+				if t := embIndicator.TransportLayer().LayerType(); t == layers.LayerTypeICMPv4 && !embIndicator.ICMPv4Indicator().IsQuery() {
+					return pcap.NewError(pcap.ErrNoRoute, "missing nat")
+				}
+
+				// Limit connections of the client
+				if clientMaxConns > 0 && patMap.Len() >= clientMaxConns {
+					return fmt.Errorf("client %s exceeds max connections %d", conn.RemoteAddr().String(), clientMaxConns)
+				}
+				// Limit flows of the user in all its clients
+				if u != nil && u.MaxFlows() > 0 && userFlows(u.Name()) >= u.MaxFlows() {
+					return fmt.Errorf("user %s exceeds max flows %d", u.Name(), u.MaxFlows())
+				}
+
+				var preferred uint16
+				if t := embIndicator.TransportLayer().LayerType(); preservePort && (t == layers.LayerTypeTCP || t == layers.LayerTypeUDP) {
+					preferred = embIndicator.SrcPort()
+				}
+				// Opaque protocols have no ports or Ids to distribute
+				if embIndicator.NATProtocol() != pcap.LayerTypeOpaque {
+					upValue, err = dist(upProtocol, preferred, profile)
+					if err != nil {
+						return fmt.Errorf("distribute: %w", err)
+					}
+				}
+
+				patMap.Set(q, upValue)
+			}
+		}
+
+		// Rate limit
+		if !limiter.Allow(q.String(), stat.DirectionOut, len(contents)) {
+			log.Packetf(false, "Drop an inbound %s packet exceeding the limit: %s -> %s -> %s (%d Bytes)\n",
+				embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String(), len(contents))
+			return nil
+		}
+	}
+
+	// Hooks
+	first := false
+	if hooks != nil {
+		var allowed bool
+		allowed, first = hooks.Packet(embIndicator.TransportProtocol().String(), embIndicator.Src().String(), embIndicator.Dst().String(), stat.DirectionOut, contents)
+		if !allowed {
+			log.Packetf(first, "Drop an inbound %s packet by hooks: %s -> %s -> %s\n",
+				embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String())
+			return nil
+		}
+	}
+
+	// Rewrite the source
+	var rewritten *pcap.Rewritten
+	if translated {
+		rewritten, err = translateSrc(embIndicator, uc, upValue)
+		if err != nil {
+			return fmt.Errorf("translate: %w", err)
+		}
+	} else {
+		rewritten, err = pcap.RewriteSrc(embIndicator, uc, upValue, preserveTTL)
+		if err != nil {
+			return fmt.Errorf("rewrite: %w", err)
+		}
+	}
+	upIP = rewritten.SrcIP()
+
+	// Create new link layer
+	dstHardwareAddr := uc.RemoteDev().HardwareAddr()
+	if hardwareAddr := macOverrides.OfIP(rewritten.NetworkLayer.NetworkFlow().Dst().Raw()); hardwareAddr != nil {
+		dstHardwareAddr = hardwareAddr
+	}
+	if isMulticast {
+		dstHardwareAddr = pcap.MulticastHardwareAddr(embIndicator.DstIP())
+	}
+	newLinkLayer, err = pcap.CreateLinkLayer(uc, dstHardwareAddr, rewritten.NetworkLayer)
+	if err != nil {
+		return fmt.Errorf("create link layer: %w", err)
+	}
+
+	// Serialize layers
+	data, err = rewritten.Serialize(newLinkLayer)
+	if err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	// Fragment reassembled packets in the size of the original fragments
+	fragments := [][]byte{data}
+	if len(embFrags) > 1 {
+		size := 0
+		for _, frag := range embFrags {
+			if frag.MTU() > size {
+				size = frag.MTU()
+			}
+		}
+
+		fragments, err = rewritten.Fragment(newLinkLayer, size)
+		if err != nil {
+			return fmt.Errorf("fragment: %w", err)
+		}
+	}
+
+	// Write packet data
+	for _, fragment := range fragments {
+		limiter.Wait(stat.DirectionOut, len(fragment))
+		if profile != nil {
+			profile.limiter.Wait(stat.DirectionOut, len(fragment))
+		}
+		_, err = uc.Write(fragment)
+		if err != nil {
+			return pcap.WrapError(pcap.ErrWrite, fmt.Errorf("write: %w", err))
+		}
+		loopGuard.Mark(fragment)
+	}
+
+	// NAT
+	if embIndicator.TransportLayer() != nil {
+		// Record the source and the source device of the packet
+		var addNAT bool
+		switch t := embIndicator.TransportLayer().LayerType(); t {
+		case layers.LayerTypeTCP:
+			a := net.TCPAddr{
+				IP:   upIP,
+				Port: int(upValue),
+			}
+			guide = pcap.NATGuide{
+				Src:      a.String(),
+				Protocol: t,
+			}
+			addNAT = true
+		case layers.LayerTypeUDP:
+			a := net.UDPAddr{
+				IP:   upIP,
+				Port: int(upValue),
+			}
+			guide = pcap.NATGuide{
+				Src:      a.String(),
+				Protocol: t,
+			}
+			addNAT = true
+		case layers.LayerTypeICMPv4:
+			if embIndicator.ICMPv4Indicator().IsQuery() {
+				guide = pcap.NATGuide{
+					Src: addr.ICMPQueryAddr{
+						IP: upIP,
+						Id: upValue,
+					}.String(),
+					Protocol: upProtocol,
+				}
+				addNAT = true
+			}
+		case layers.LayerTypeICMPv6:
+			guide = pcap.NATGuide{
+				Src: addr.ICMPQueryAddr{
+					IP: upIP,
+					Id: upValue,
+				}.String(),
+				Protocol: upProtocol,
+			}
+			addNAT = true
+		case pcap.LayerTypeOpaque:
+			// Mapped by the protocol only, so each destination is reached by one source at a time
+			guide = pcap.NATGuide{
+				Src: addr.IPProtocolAddr{
+					IP:       upIP,
+					Protocol: uint8(embIndicator.OpaqueLayer().Protocol),
+				}.String(),
+				Protocol: t,
+			}
+			addNAT = true
+		default:
+			return pcap.NewError(pcap.ErrUnsupportedLayer, "transport layer type %s not support", t)
+		}
+		if addNAT {
+			ni = &natIndicator{
+				src:    src,
+				embSrc: embIndicator.NATSrc(),
+				conn:   conn,
+				id:     id,
+				q:      q,
+			}
+			natMap.Set(guide, ni)
+
+			// Allow packets from the destination
+			if filterMap != nil {
+				filterMap.Set(filterKey(guide, natDst), true)
+			}
+		}
+
+		// Keep alive
+		err = refresh(upProtocol, upValue)
+		if err != nil {
+			return fmt.Errorf("keep alive: %w", err)
+		}
+
+		// Track and tear down TCP connections
+		if embIndicator.TransportLayer().LayerType() == layers.LayerTypeTCP && !embIndicator.IsFrag() {
+			observeState(guide, ni, upValue, embIndicator.TCPLayer())
+			observeClose(guide, ni, upValue, embIndicator.TCPLayer(), stat.DirectionOut)
+		}
+	}
+
+	// Statistics
+	if monitor != nil {
+		monitor.Add(src.String(), stat.DirectionOut, uint(embIndicator.Size()))
+	}
+	if flows != nil {
+		flows.Add(embIndicator.TransportProtocol().String(), embIndicator.Src().String(), embIndicator.Dst().String(), stat.DirectionOut, uint(embIndicator.Size()))
+	}
+	addTraffic(id, src, stat.DirectionOut, uint(embIndicator.Size()))
+
+	log.Packetf(first, "Redirect an inbound %s packet: %s -> %s -> %s (%d Bytes)\n",
+		embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String(), embIndicator.Size())
+
+	return nil
+}
+
+// isTranslated returns if packets in the family need to be translated, as the upstream device only has addresses in
+// the other family.
+func isTranslated(t gopacket.LayerType, dev *pcap.Device) bool {
+	if translator == nil {
+		return false
+	}
+
+	switch t {
+	case layers.LayerTypeIPv4:
+		return dev.IPv4Addr() == nil && dev.IPv6Addr() != nil
+	case layers.LayerTypeIPv6:
+		return dev.IPv6Addr() == nil && dev.IPv4Addr() != nil
+	default:
+		return false
+	}
+}
+
+// translateAddr returns the address with its IP translated to the other family.
+func translateAddr(a net.Addr) (net.Addr, error) {
+	var ip net.IP
+	switch t := a.(type) {
+	case *net.TCPAddr:
+		ip = t.IP
+	case *net.UDPAddr:
+		ip = t.IP
+	case *addr.ICMPQueryAddr:
+		ip = t.IP
+	case *addr.IPProtocolAddr:
+		ip = t.IP
+	default:
+		return nil, fmt.Errorf("type %T not support", t)
+	}
+
+	newIP := translator.Translate(ip)
+	if newIP == nil {
+		return nil, fmt.Errorf("address %s not in prefix %s", ip, translator.Prefix())
+	}
+
+	switch t := a.(type) {
+	case *net.TCPAddr:
+		return &net.TCPAddr{IP: newIP, Port: t.Port}, nil
+	case *net.UDPAddr:
+		return &net.UDPAddr{IP: newIP, Port: t.Port}, nil
+	case *addr.ICMPQueryAddr:
+		return &addr.ICMPQueryAddr{IP: newIP, Id: t.Id}, nil
+	default:
+		return &addr.IPProtocolAddr{IP: newIP, Protocol: a.(*addr.IPProtocolAddr).Protocol}, nil
+	}
+}
+
+// translateNetworkLayer returns the network layer of the embedded packet translated to the other family from the
+// upstream device, and the IP of the upstream device.
+func translateNetworkLayer(embIndicator *pcap.PacketIndicator, dev *pcap.Device) (gopacket.NetworkLayer, net.IP, error) {
+	var srcIP net.IP
+	if embIndicator.NetworkLayer().LayerType() == layers.LayerTypeIPv4 {
+		srcIP = dev.IPv6Addr().IP
+	} else {
+		srcIP = dev.IPv4Addr().IP
+	}
+
+	dstIP := translator.Translate(embIndicator.DstIP())
+	if dstIP == nil {
+		return nil, nil, fmt.Errorf("destination %s not in prefix %s", embIndicator.DstIP(), translator.Prefix())
+	}
+
+	networkLayer, err := pcap.TranslateNetworkLayer(embIndicator.NetworkLayer(), srcIP, dstIP)
+	if err != nil {
+		return nil, nil, err
+	}
+	if preserveTTL {
+		switch t := networkLayer.(type) {
+		case *layers.IPv4:
+			t.TTL--
+		case *layers.IPv6:
+			t.HopLimit--
+		}
+	}
+
+	return networkLayer, srcIP, nil
+}
+
+// translateSrc returns the packet from a client translated to the other family, and rewritten to leave from the sink
+// in the port or the Id of the value.
+func translateSrc(embIndicator *pcap.PacketIndicator, sink pcap.PacketSink, value uint16) (*pcap.Rewritten, error) {
+	var err error
+
+	r := &pcap.Rewritten{Payload: embIndicator.Payload()}
+
+	// Create new transport layer
+	if embIndicator.TransportLayer() != nil {
+		switch embIndicator.TransportLayer().LayerType() {
+		case layers.LayerTypeICMPv4:
+			r.TransportLayer, r.ICMPv6EchoLayer, err = pcap.TranslateICMPv4Echo(embIndicator.ICMPv4Indicator().ICMPv4Layer(), value)
+		case layers.LayerTypeICMPv6:
+			r.TransportLayer, err = pcap.TranslateICMPv6Echo(embIndicator.ICMPv6Indicator(), value)
+		default:
+			r.TransportLayer, r.ICMPv6EchoLayer, err = pcap.RewriteSrcTransport(embIndicator, sink, value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("create transport layer: %w", err)
+		}
+	}
+
+	// Create new network layer
+	r.NetworkLayer, _, err = translateNetworkLayer(embIndicator, sink.LocalDev())
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.SetNetworkLayerForChecksum()
+	if err != nil {
+		return nil, fmt.Errorf("set network layer for checksum: %w", err)
+	}
+
+	return r, nil
+}
+
+// translateDst returns the reply to a client translated back to the family of the client, and rewritten back to the
+// source of the client.
+func translateDst(indicator *pcap.PacketIndicator, ni *natIndicator) (*pcap.Rewritten, error) {
+	var err error
+
+	r := &pcap.Rewritten{Payload: indicator.Payload()}
+
+	// Create new transport layer
+	if indicator.TransportLayer() != nil {
+		switch indicator.TransportLayer().LayerType() {
+		case layers.LayerTypeICMPv4:
+			r.TransportLayer, r.ICMPv6EchoLayer, err = pcap.TranslateICMPv4Echo(indicator.ICMPv4Indicator().ICMPv4Layer(), ni.embSrcValue())
+		case layers.LayerTypeICMPv6:
+			r.TransportLayer, err = pcap.TranslateICMPv6Echo(indicator.ICMPv6Indicator(), ni.embSrcValue())
+		default:
+			r.TransportLayer, r.ICMPv6EchoLayer, err = pcap.RewriteDstTransport(indicator, ni.embSrcIP(), ni.embSrcValue())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("create transport layer: %w", err)
+		}
+	}
+
+	// Create new network layer
+	srcIP := translator.Translate(indicator.SrcIP())
+	if srcIP == nil {
+		return nil, fmt.Errorf("source %s not in prefix %s", indicator.SrcIP(), translator.Prefix())
+	}
+	r.NetworkLayer, err = pcap.TranslateNetworkLayer(indicator.NetworkLayer(), srcIP, ni.embSrcIP())
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.SetNetworkLayerForChecksum()
+	if err != nil {
+		return nil, fmt.Errorf("set network layer for checksum: %w", err)
+	}
+
+	return r, nil
+}
+
+// replyTimeExceeded replies an ICMP Time Exceeded message of the embedded packet to the client.
+func replyTimeExceeded(embIndicator *pcap.PacketIndicator, conn net.Conn, dev *pcap.Device) error {
+	if embIndicator.IsICMPError() {
+		return nil
+	}
+
+	var srcIP net.IP
+	if embIndicator.NetworkLayer().LayerType() == layers.LayerTypeIPv4 {
+		srcIP = dev.IPv4Addr().IP
+	} else {
+		ipv6Addr := dev.IPv6Addr()
+		if ipv6Addr == nil {
+			return fmt.Errorf("missing ipv6 address of device %s", dev.Alias())
+		}
+		srcIP = ipv6Addr.IP
+	}
+
+	data, err := pcap.CreateTimeExceededPacket(srcIP, embIndicator)
+	if err != nil {
+		return fmt.Errorf("create time exceeded: %w", err)
+	}
+
+	_, err = conn.Write(data)
+	if err != nil {
+		return pcap.WrapError(pcap.ErrWrite, fmt.Errorf("write: %w", err))
+	}
+
+	log.Verbosef("Reply time exceeded of an inbound %s packet: %s -> %s -> %s\n",
+		embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String())
+
+	return nil
+}
+
+func handleUpstream(packet gopacket.Packet) error {
+	var (
+		err       error
+		indicator *pcap.PacketIndicator
+		frags     []*pcap.PacketIndicator
+		ni        *natIndicator
+		data      []byte
+	)
+
+	// Skip packets injected by itself
+	if loopGuard.Seen(packet.Data()) {
+		return nil
+	}
+
+	// Parse packet
+	indicator, err = pcap.ParsePacket(packet)
+	if err != nil {
+		return fmt.Errorf("parse packet: %w", err)
+	}
+
+	// Handle fragments
+	indicator, frags, err = defrag.AppendOriginal(indicator)
+	if err != nil {
+		return fmt.Errorf("defrag: %w", err)
+	}
+	if indicator == nil {
+		return nil
+	}
+
+	// NAT, or port forwarding
+	guide := pcap.NATGuide{
+		Src:      indicator.NATDst().String(),
+		Protocol: indicator.TransportLayer().LayerType(),
+	}
+	ni, isForwarded := forwardedTo(indicator)
+	if !isForwarded {
+		value, ok := natMap.Get(guide)
+		if !ok {
+			return nil
+		}
+		ni = value.(*natIndicator)
+	} else if ni == nil {
+		log.Packetf(false, "Drop an outbound %s packet to a port forwarded to a client not connected: %s <- %s\n",
+			indicator.TransportProtocol(), indicator.Dst().String(), indicator.Src().String())
+		return nil
+	}
+
+	// Filter packets from destinations the source never sent to, except ICMP errors from routers on the path and
+	// packets to forwarded ports
+	if filterMap != nil && !indicator.IsICMPError() && !isForwarded {
+		_, ok := filterMap.Get(filterKey(guide, indicator.NATSrc()))
+		if !ok {
+			log.Packetf(false, "Drop an outbound %s packet filtered by NAT: %s <- %s\n",
+				indicator.TransportProtocol(), ni.embSrc.String(), indicator.Src().String())
+			return nil
+		}
+	}
+
+	// Keep alive
+	var upValue uint16
+	switch t := indicator.NATDst().(type) {
+	case *net.TCPAddr:
+		upValue = uint16(t.Port)
+	case *net.UDPAddr:
+		upValue = uint16(t.Port)
+	case *addr.ICMPQueryAddr:
+		upValue = t.Id
+	case *addr.IPProtocolAddr:
+		break
+	default:
+		return fmt.Errorf("type %T not support", t)
+	}
+	err = refresh(indicator.NATProtocol(), upValue)
+	if err != nil {
+		return fmt.Errorf("keep alive: %w", err)
+	}
+
+	// Track and tear down TCP connections
+	if indicator.TransportLayer().LayerType() == layers.LayerTypeTCP {
+		observeState(guide, ni, upValue, indicator.TCPLayer())
+		observeClose(guide, ni, upValue, indicator.TCPLayer(), stat.DirectionIn)
+	}
+
+	// Rate limit
+	if !limiter.Allow(ni.q.String(), stat.DirectionIn, indicator.MTU()) {
+		log.Packetf(false, "Drop an outbound %s packet exceeding the limit: %s <- %s <- %s (%d Bytes)\n",
+			indicator.TransportProtocol(), ni.embSrc.String(), ni.src.String(), indicator.Src().String(), indicator.MTU())
+		return nil
+	}
+
+	// Quotas of the user
+	if u, ok := users[ni.id]; ok && !u.Use(indicator.MTU()) {
+		log.Packetf(false, "Drop an outbound %s packet exceeding the quota of user %s: %s <- %s <- %s\n",
+			indicator.TransportProtocol(), u.Name(), ni.embSrc.String(), ni.src.String(), indicator.Src().String())
+		return nil
+	}
+
+	// Hooks
+	first := false
+	if hooks != nil {
+		var allowed bool
+		allowed, first = hooks.Packet(indicator.TransportProtocol().String(), ni.embSrc.String(), indicator.Src().String(), stat.DirectionIn, indicator.NetworkData())
+		if !allowed {
+			log.Packetf(first, "Drop an outbound %s packet by hooks: %s <- %s <- %s\n",
+				indicator.TransportProtocol(), ni.embSrc.String(), ni.src.String(), indicator.Src().String())
+			return nil
+		}
+	}
+
+	// Translate back to the family of the source
+	translated := (ni.embSrcIP().To4() != nil) != (indicator.NetworkLayer().LayerType() == layers.LayerTypeIPv4)
+	if translated {
+		if translator == nil {
+			return errors.New("missing translator")
+		}
+		if len(frags) > 1 {
+			return errors.New("translate fragments not support")
+		}
+		if indicator.IsICMPError() {
+			return errors.New("translate icmp errors not support")
+		}
+	}
+
+	for _, frag := range frags {
+		// Rewrite the destination
+		var rewritten *pcap.Rewritten
+		if translated {
+			rewritten, err = translateDst(frag, ni)
+			if err != nil {
+				return fmt.Errorf("translate: %w", err)
+			}
+		} else {
+			rewritten, err = pcap.RewriteDst(frag, ni.embSrcIP(), ni.embSrcValue())
+			if err != nil {
+				return fmt.Errorf("rewrite: %w", err)
+			}
+		}
+
+		// Serialize layers
+		data, err = rewritten.Serialize(nil)
+		if err != nil {
+			return fmt.Errorf("serialize: %w", err)
+		}
+
+		// Clamp MSS of SYN segments from destinations
+		if clampMSS > 0 {
+			mss := clampMSS
+			if ni.srcIP().To4() == nil {
+				mss = mss - 20
+			}
+			pcap.ClampMSS(data, mss)
+		}
+
+		// Clamp window of segments from destinations
+		if windowClamp != nil {
+			windowClamp.Clamp(data)
+		}
+
+		// Write packet data
+		if profile, ok := clientProfiles[ni.id]; ok {
+			profile.limiter.Wait(stat.DirectionIn, len(data))
+		}
+		conn := clientConn(ni)
+		if conn == nil {
+			return pcap.NewError(pcap.ErrNoRoute, "client %s not connected", ni.src.String())
+		}
+		err = writeClient(conn, frag, data)
+		if err != nil {
+			return pcap.WrapError(pcap.ErrWrite, fmt.Errorf("write: %w", err))
+		}
+
+		// Statistics
+		size := frag.MTU()
+		if monitor != nil {
+			monitor.Add(ni.src.String(), stat.DirectionIn, uint(size))
+		}
+		if flows != nil {
+			flows.Add(frag.TransportProtocol().String(), ni.embSrc.String(), frag.Src().String(), stat.DirectionIn, uint(size))
+		}
+		addTraffic(ni.id, ni.src, stat.DirectionIn, uint(size))
+
+		log.Packetf(first, "Redirect an outbound %s packet: %s <- %s <- %s (%d Bytes)\n",
+			frag.TransportProtocol(), ni.embSrc.String(), ni.src.String(), frag.Src(), size)
+	}
+
+	// Record DNS
+	if indicator.DNSIndicator() != nil {
+		if indicator.DNSIndicator().IsResponse() {
+			name, ips := indicator.DNSIndicator().Answers()
+			if name != "" && len(ips) > 0 {
+				dnsLock.Lock()
+				for _, ip := range ips {
+					dns[ip.String()] = name
+					log.Verbosef("Record DNS record %s = %s\n", name, ip)
+				}
+				dnsLock.Unlock()
+			}
+		}
+	}
+
+	return nil
+}
+
+// listen opens a listener in the device on the port.
+func listen(dev *pcap.Device, port uint16) (net.Listener, error) {
+	srcDev := gatewayDev
+	if dev.IsLoop() {
+		srcDev = dev
+	}
+
+	switch mode {
+	case "faketcp":
+		if isKCP {
+			return pcap.ListenFakeTCPWithKCP(dev, srcDev, port, crypt, auth, mtu, kcpConfig)
 		}
+		return pcap.ListenFakeTCP(dev, srcDev, port, crypt, auth, mtu)
+	case "tcp":
+		return pcap.ListenTCP(dev, port, crypt)
+	case "websocket":
+		return pcap.ListenWebSocket(dev, port, crypt, wsConfig)
+	case "udp":
+		return pcap.ListenUDP(dev, port, crypt)
+	default:
+		return nil, fmt.Errorf("mode %s not support", mode)
 	}
-	if !gatewayDev.IsLoop() {
-		log.Infof("Route upstream from %s to %s\n", upDev, gatewayDev)
-	} else {
-		log.Infof("Route upstream in %s\n", upDev)
+}
+
+// accept accepts connections from the listener until it is closed or removed.
+func accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if isClosed || !isAccepting(listener) {
+				return
+			}
+			log.Errorln(fmt.Errorf("accept: %w", err))
+			continue
+		}
+		if conn == nil {
+			continue
+		}
+
+		// Tune
+		switch conn.(type) {
+		case *kcp.UDPSession:
+			err := pcap.TuneKCP(conn.(*kcp.UDPSession), kcpConfig)
+			if err != nil {
+				conn.Close()
+				log.Errorln(fmt.Errorf("tune: %w", err))
+				continue
+			}
+		default:
+			break
+		}
+
+		if batch > 0 {
+			conn = pcap.NewBatchConn(conn, batch, batchInterval)
+		}
+		// Frame packets if the client says hello
+		frameConn := pcap.NewFrameConn(conn)
+		if users != nil {
+			frameConn.RequireUser(users.Auth)
+		}
+		if isResume {
+			err := frameConn.IssueToken()
+			if err != nil {
+				conn.Close()
+				log.Errorln(fmt.Errorf("issue token: %w", err))
+				continue
+			}
+		}
+		conn = frameConn
+
+		// Packets to the client are sent through its latest connection
+		clientsLock.Lock()
+		oldConn, ok := clientConns[conn.RemoteAddr().String()]
+		clientConns[conn.RemoteAddr().String()] = conn
+		if ok {
+			delete(resumed, oldConn)
+		}
+		clientsLock.Unlock()
+		if ok && hop != nil {
+			retire(oldConn)
+		}
+
+		log.Infof("Connect from client %s\n", conn.RemoteAddr().String())
+
+		go func() {
+			b := make([]byte, pcap.IPv4MaxSize)
+			isPresented := false
+			for {
+				n, err := conn.Read(b)
+				if err != nil {
+					if isClosed {
+						return
+					}
+					if isRetired(conn) {
+						clientsLock.Lock()
+						delete(retired, conn)
+						clientsLock.Unlock()
+						return
+					}
+					// The listener is removed
+					if !isAccepting(listener) {
+						a := clientAddr(conn).String()
+						clientsLock.Lock()
+						if clientConns[a] == conn {
+							delete(clientConns, a)
+						}
+						delete(resumed, conn)
+						clientsLock.Unlock()
+						return
+					}
+					log.Errorln(fmt.Errorf("read listen: %w", err))
+					continue
+				}
+
+				// The token is presented before any packet
+				if isResume && !isPresented {
+					isPresented = resume(conn)
+				}
+
+				newB := make([]byte, n)
+				copy(newB, b[:n])
+				c <- pcap.ConnBytes{
+					Bytes: newB,
+					Conn:  conn,
+				}
+			}
+		}()
 	}
+}
 
-	for _, dev := range listenDevs {
-		var (
-			err      error
-			listener net.Listener
-		)
+// isAccepting returns if the listener is still used for accepting.
+func isAccepting(listener net.Listener) bool {
+	listenersLock.RLock()
+	defer listenersLock.RUnlock()
 
-		switch mode {
-		case "faketcp":
-			if dev.IsLoop() {
-				if isKCP {
-					listener, err = pcap.ListenFakeTCPWithKCP(dev, dev, port, crypt, mtu, kcpConfig)
-				} else {
-					listener, err = pcap.ListenFakeTCP(dev, dev, port, crypt, mtu)
+	for _, l := range listeners {
+		if l == listener {
+			return true
+		}
+	}
+	for _, ls := range extraListeners {
+		for _, l := range ls {
+			if l == listener {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// upstreamFilter returns the BPF filter of the handle for routing upstream, which excludes packets to listen ports.
+func upstreamFilter() string {
+	ports := fmt.Sprintf("dst port %d", port)
+	if hop != nil {
+		min, max := hop.Range()
+		ports = fmt.Sprintf("dst portrange %d-%d", min, max)
+	}
+
+	listenersLock.RLock()
+	extraPorts := make([]int, 0, len(extraListeners))
+	for p := range extraListeners {
+		extraPorts = append(extraPorts, int(p))
+	}
+	listenersLock.RUnlock()
+	sort.Ints(extraPorts)
+	for _, p := range extraPorts {
+		ports = fmt.Sprintf("%s || dst port %d", ports, p)
+	}
+
+	filter := fmt.Sprintf("(ip && (((tcp || udp) && not (%s)) || not (tcp || udp) || (ip[6:2] & 0x1fff) != 0)) || (ip6 && ((ip6[6] == 58 && ip6[40] == 129) || not (tcp || udp || icmp6 || ip6[6] == 0 || ip6[6] == 43 || ip6[6] == 44 || ip6[6] == 60)))", ports)
+	if customFilter != "" {
+		filter = fmt.Sprintf("(%s) && (%s)", filter, customFilter)
+	}
+
+	return filter
+}
+
+// hopListeners updates ports of listeners at the start of each slice of hopping.
+func hopListeners() {
+	for {
+		ports := hop.Ports(time.Now())
+		for _, listener := range listeners {
+			fakeTCPListener, ok := listener.(*pcap.FakeTCPListener)
+			if !ok {
+				continue
+			}
+
+			err := fakeTCPListener.SetPorts(ports)
+			if err != nil {
+				log.Errorln(fmt.Errorf("set ports of listener %s: %w", listener.Addr(), err))
+			}
+		}
+		log.Verbosef("Hop to port %d\n", hop.Port(time.Now()))
+
+		time.Sleep(time.Until(hop.Next(time.Now())))
+		if isClosed {
+			return
+		}
+	}
+}
+
+// classify returns the class of the packet in scheduling by rules of priority.
+func classify(indicator *pcap.PacketIndicator, size int) shape.Class {
+	p := &shape.Packet{Size: size}
+	if ipv4Layer := indicator.IPv4Layer(); ipv4Layer != nil {
+		p.DSCP = ipv4Layer.TOS >> 2
+	} else if ipv6Layer := indicator.IPv6Layer(); ipv6Layer != nil {
+		p.DSCP = ipv6Layer.TrafficClass >> 2
+	}
+
+	// Ports are only available in unfragmented packets
+	if !indicator.IsFrag() {
+		switch t := indicator.TransportProtocol(); t {
+		case layers.LayerTypeTCP:
+			p.Protocol, p.SrcPort, p.DstPort = t, indicator.SrcPort(), indicator.DstPort()
+			p.Payload = len(indicator.TCPLayer().Payload)
+		case layers.LayerTypeUDP:
+			p.Protocol, p.SrcPort, p.DstPort = t, indicator.SrcPort(), indicator.DstPort()
+		}
+	}
+
+	return shape.Classify(priorityRules, p)
+}
+
+// writeClient writes the packet data to the connection of the client. The packet is scheduled in its class if rules of
+// priority exist, in which errors are only logged as it is written asynchronously.
+func writeClient(conn net.Conn, indicator *pcap.PacketIndicator, data []byte) error {
+	if scheduler == nil {
+		limiter.Wait(stat.DirectionIn, len(data))
+
+		_, err := conn.Write(data)
+		return err
+	}
+
+	scheduler.Schedule(classify(indicator, len(data)), len(data), func() {
+		_, err := conn.Write(data)
+		if err != nil {
+			err = pcap.WrapError(pcap.ErrWrite, fmt.Errorf("write: %w", err))
+			log.Errorln(err)
+			reportError(err)
+		}
+	})
+
+	return nil
+}
+
+// echoSpeedTest replies the request of speed tests to the client through the connection.
+func echoSpeedTest(embIndicator *pcap.PacketIndicator, conn net.Conn) error {
+	data, err := pcap.CreateSpeedTestReply(embIndicator)
+	if err != nil {
+		return fmt.Errorf("create speed test reply: %w", err)
+	}
+
+	limiter.Wait(stat.DirectionIn, len(data))
+	_, err = conn.Write(data)
+	if err != nil {
+		return pcap.WrapError(pcap.ErrWrite, fmt.Errorf("write: %w", err))
+	}
+
+	return nil
+}
+
+// reportError notifies hooks of the error in handling packets.
+func reportError(err error) {
+	if hooks != nil {
+		hooks.Error(err)
+	}
+}
+
+// clientConn returns the latest connection of the client in the NAT, or nil if a mapping restored after a restart is
+// not reconnected yet.
+func clientConn(ni *natIndicator) net.Conn {
+	clientsLock.RLock()
+	defer clientsLock.RUnlock()
+
+	conn, ok := clientConns[ni.src.String()]
+	if !ok {
+		return ni.conn
+	}
+
+	return conn
+}
+
+// resume resumes the session of the client of the connection by the token it presents, so packets from its new
+// address are mapped in the NAT of the address the session is started from, and packets to it are sent through the
+// connection. It returns if the client presents a token.
+func resume(conn net.Conn) bool {
+	frameConn, ok := conn.(*pcap.FrameConn)
+	if !ok {
+		return true
+	}
+
+	token := frameConn.PeerToken()
+	if token == nil {
+		return false
+	}
+
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+
+	var src net.Addr
+	for _, c := range clientConns {
+		fc, ok := c.(*pcap.FrameConn)
+		if !ok || c == conn || !bytes.Equal(fc.Token(), token) {
+			continue
+		}
+
+		src = c.RemoteAddr()
+		if alias, ok := resumed[c]; ok {
+			src = alias
+		}
+		break
+	}
+	if src == nil {
+		log.Verbosef("Client %s presents an unknown token\n", conn.RemoteAddr())
+		return true
+	}
+
+	// Reconnect from the same address
+	a := conn.RemoteAddr().String()
+	if src.String() == a {
+		return true
+	}
+
+	if clientConns[a] == conn {
+		delete(clientConns, a)
+	}
+	oldConn, ok := clientConns[src.String()]
+	if ok {
+		delete(resumed, oldConn)
+	}
+	clientConns[src.String()] = conn
+	resumed[conn] = src
+
+	log.Infof("Client %s resumes from %s\n", src, a)
+
+	return true
+}
+
+// clientAddr returns the address of the client of the connection in NAT, which is the address the session is started
+// from if the client resumes it from another address.
+func clientAddr(conn net.Conn) net.Addr {
+	clientsLock.RLock()
+	defer clientsLock.RUnlock()
+
+	a, ok := resumed[conn]
+	if ok {
+		return a
+	}
+
+	return conn.RemoteAddr()
+}
+
+// retire closes the connection replaced in hopping after an interval, so packets in flight are still received.
+func retire(conn net.Conn) {
+	time.AfterFunc(hop.Interval(), func() {
+		clientsLock.Lock()
+		retired[conn] = true
+		clientsLock.Unlock()
+
+		conn.Close()
+	})
+}
+
+// isRetired returns if the connection is closed after hopping.
+func isRetired(conn net.Conn) bool {
+	clientsLock.RLock()
+	defer clientsLock.RUnlock()
+
+	return retired[conn]
+}
+
+// patMapOf returns the PAT of the client, and creates one with the idle timeout of the profile if not exists.
+func patMapOf(client string, profile *clientProfile) *nat.Table {
+	patMapsLock.RLock()
+	patMap, ok := patMaps[client]
+	patMapsLock.RUnlock()
+	if ok {
+		return patMap
+	}
+
+	patMapsLock.Lock()
+	defer patMapsLock.Unlock()
+
+	patMap, ok = patMaps[client]
+	if !ok {
+		ttl := keepAlive
+		if profile != nil {
+			ttl = profile.idleTimeout
+		}
+		patMap = nat.NewTable(ttl, natMaxEntries)
+		patMaps[client] = patMap
+		go patMap.Run(keepAlive)
+	}
+
+	return patMap
+}
+
+// filterKey returns the key of the mapping and the remote in filtering, which is the address of the remote in
+// address-restricted cone NAT, and the address and the port in port-restricted cone and symmetric NAT.
+func filterKey(guide pcap.NATGuide, remote net.Addr) string {
+	var s string
+	switch t := remote.(type) {
+	case *net.TCPAddr:
+		s = t.String()
+		if !natBehavior.IsPortDependentFiltering() {
+			s = t.IP.String()
+		}
+	case *net.UDPAddr:
+		s = t.String()
+		if !natBehavior.IsPortDependentFiltering() {
+			s = t.IP.String()
+		}
+	case *addr.ICMPQueryAddr:
+		s = t.IP.String()
+	default:
+		s = remote.String()
+	}
+
+	return fmt.Sprintf("%s %s <-> %s", guide.Protocol, guide.Src, s)
+}
+
+// dist distributes a port or an Id of the protocol. The preferred one is distributed if it is not in use, or 0 for no
+// preference. Ports are distributed in the static range of the profile if it has one, and ports in static ranges are
+// never distributed to other clients.
+func dist(t gopacket.LayerType, preferred uint16, profile *clientProfile) (uint16, error) {
+	poolLock.Lock()
+	defer poolLock.Unlock()
+
+	now := time.Now()
+
+	var pool []time.Time
+	switch t {
+	case layers.LayerTypeTCP:
+		pool = tcpPortPool
+	case layers.LayerTypeUDP:
+		pool = udpPortPool
+	}
+	hasRange := profile != nil && profile.minPort > 0
+
+	// Preserve the port
+	if preferred >= 49152 && pool != nil && now.Sub(pool[convertFromPort(preferred)]) > keepAlive {
+		if (hasRange && preferred >= profile.minPort && preferred <= profile.maxPort) || (!hasRange && !isReserved(preferred)) {
+			pool[convertFromPort(preferred)] = now
+			return preferred, nil
+		}
+	}
+
+	// Distribute in the static range
+	if pool != nil && hasRange {
+		for p := int(profile.minPort); p <= int(profile.maxPort); p++ {
+			if now.Sub(pool[convertFromPort(uint16(p))]) > keepAlive {
+				pool[convertFromPort(uint16(p))] = now
+				return uint16(p), nil
+			}
+		}
+
+		return 0, fmt.Errorf("%s port range %d-%d empty", t, profile.minPort, profile.maxPort)
+	}
+
+	switch t {
+	case layers.LayerTypeTCP:
+		for i := 0; i < 16384; i++ {
+			// Point to next port
+			s := uint16((atomic.AddUint32(&nextTCPPort, 1) - 1) % 16384)
+
+			// Skip ports in static ranges
+			if isReserved(49152 + s) {
+				continue
+			}
+
+			// Check if the port is alive
+			last := tcpPortPool[s]
+			if now.Sub(last) > keepAlive {
+				if !last.IsZero() {
+					log.Verbosef("Recycle %s port %d\n", t, 49152+s)
 				}
-			} else {
-				if isKCP {
-					listener, err = pcap.ListenFakeTCPWithKCP(dev, gatewayDev, port, crypt, mtu, kcpConfig)
-				} else {
-					listener, err = pcap.ListenFakeTCP(dev, gatewayDev, port, crypt, mtu)
+				return 49152 + s, nil
+			}
+		}
+	case layers.LayerTypeUDP:
+		for i := 0; i < 16384; i++ {
+			// Point to next port
+			s := uint16((atomic.AddUint32(&nextUDPPort, 1) - 1) % 16384)
+
+			// Skip ports in static ranges
+			if isReserved(49152 + s) {
+				continue
+			}
+
+			// Check if the port is alive
+			last := udpPortPool[s]
+			if now.Sub(last) > keepAlive {
+				if !last.IsZero() {
+					log.Verbosef("Recycle %s port %d\n", t, 49152+s)
 				}
+				return 49152 + s, nil
 			}
-		case "tcp":
-			listener, err = pcap.ListenTCP(dev, port, crypt)
-		default:
-			err = fmt.Errorf("mode %s not support", mode)
 		}
-		if err != nil {
-			return fmt.Errorf("open listen device %s: %w", dev.Alias(), err)
+	case layers.LayerTypeICMPv4:
+		for i := 0; i < 65536; i++ {
+			// Point to next Id
+			s := uint16(atomic.AddUint32(&nextICMPv4Id, 1) - 1)
+
+			// Check if the Id is alive
+			last := icmpv4IdPool[s]
+			if now.Sub(last) > keepAlive {
+				if !last.IsZero() {
+					log.Verbosef("Recycle %s ID %d\n", t, s)
+				}
+				return s, nil
+			}
+		}
+	case layers.LayerTypeICMPv6:
+		for i := 0; i < 65536; i++ {
+			// Point to next Id
+			s := uint16(atomic.AddUint32(&nextICMPv6Id, 1) - 1)
+
+			// Check if the Id is alive
+			last := icmpv6IdPool[s]
+			if now.Sub(last) > keepAlive {
+				if !last.IsZero() {
+					log.Verbosef("Recycle %s ID %d\n", t, s)
+				}
+				return s, nil
+			}
+		}
+	default:
+		return 0, pcap.NewError(pcap.ErrUnsupportedLayer, "transport layer type %s not support", t)
+	}
+
+	return 0, fmt.Errorf("%s pool empty", t)
+}
+
+func refresh(t gopacket.LayerType, value uint16) error {
+	poolLock.Lock()
+	defer poolLock.Unlock()
+
+	now := time.Now()
+
+	switch t {
+	case layers.LayerTypeTCP:
+		// Forwarded ports may be out of the pool
+		if value >= 49152 {
+			tcpPortPool[convertFromPort(value)] = now
+		}
+	case layers.LayerTypeUDP:
+		if value >= 49152 {
+			udpPortPool[convertFromPort(value)] = now
 		}
+	case layers.LayerTypeICMPv4:
+		icmpv4IdPool[value] = now
+	case layers.LayerTypeICMPv6:
+		icmpv6IdPool[value] = now
+	case pcap.LayerTypeOpaque:
+		break
+	default:
+		return pcap.NewError(pcap.ErrUnsupportedLayer, "transport layer type %s not support", t)
+	}
 
-		listeners = append(listeners, listener)
+	return nil
+}
+
+// observeState tracks the state of the TCP connection of the guide by flags of its segments, and sets the TTL of its
+// mappings by the state, which is the half-open timeout in handshakes and the established timeout after them.
+func observeState(guide pcap.NATGuide, ni *natIndicator, value uint16, tcpLayer *layers.TCP) {
+	stateLock.Lock()
+	prev := ni.state
+	ni.state = prev.Next(tcpLayer.SYN, tcpLayer.ACK, tcpLayer.FIN, tcpLayer.RST)
+	state := ni.state
+	stateLock.Unlock()
+
+	var ttl time.Duration
+	switch {
+	case state.IsHalfOpen():
+		ttl = halfOpenTTL
+	case state == nat.TCPStateEstablished || state == nat.TCPStateFinWait:
+		ttl = establishedTTL
 	}
 
-	// Handles for routing upstream
-	upConn, err = pcap.CreateRawConn(upDev, gatewayDev, fmt.Sprintf("ip && (((tcp || udp) && not dst port %d) || icmp || (ip[6:2] & 0x1fff) != 0)", port))
-	if err != nil {
-		return fmt.Errorf("open upstream device %s: %w", upDev.Alias(), err)
+	if state != prev {
+		natMap.SetTTL(guide, ttl)
+		patMapsLock.RLock()
+		patMap, ok := patMaps[ni.src.String()]
+		patMapsLock.RUnlock()
+		if ok {
+			patMap.SetTTL(ni.q, ttl)
+		}
 	}
 
-	// Start handling
-	for i := 0; i < len(listeners); i++ {
-		listener := listeners[i]
-		go func() {
-			for {
-				conn, err := listener.Accept()
-				if err != nil {
-					if isClosed {
-						return
-					}
-					log.Errorln(fmt.Errorf("accept: %w", err))
-					continue
-				}
-				if conn == nil {
-					continue
-				}
+	// Ports are recycled once they are not seen in the keep alive, so the port is regarded as seen later to be kept as
+	// long as the mapping
+	if ttl > keepAlive && value >= 49152 {
+		poolLock.Lock()
+		tcpPortPool[convertFromPort(value)] = time.Now().Add(ttl - keepAlive)
+		poolLock.Unlock()
+	}
+}
 
-				// Tune
-				switch conn.(type) {
-				case *kcp.UDPSession:
-					err := pcap.TuneKCP(conn.(*kcp.UDPSession), kcpConfig)
-					if err != nil {
-						conn.Close()
-						log.Errorln(fmt.Errorf("tune: %w", err))
-						continue
-					}
-				default:
-					break
-				}
+// observeClose records the TCP flags of the connection of the guide, and tears the connection down after the close
+// timeout once it is reset or finished in both directions. A new connection of the mapping cancels the tearing down.
+func observeClose(guide pcap.NATGuide, ni *natIndicator, value uint16, tcpLayer *layers.TCP, direction stat.Direction) {
+	if closeTimeout <= 0 {
+		return
+	}
 
-				log.Infof("Connect from client %s\n", conn.RemoteAddr().String())
-
-				go func() {
-					b := make([]byte, pcap.IPv4MaxSize)
-					for {
-						n, err := conn.Read(b)
-						if err != nil {
-							if isClosed {
-								return
-							}
-							log.Errorln(fmt.Errorf("read listen: %w", err))
-							continue
-						}
+	closingLock.Lock()
+	defer closingLock.Unlock()
 
-						newB := make([]byte, n)
-						copy(newB, b[:n])
-						c <- pcap.ConnBytes{
-							Bytes: newB,
-							Conn:  conn,
-						}
-					}
-				}()
-			}
-		}()
-	}
+	flow, ok := closing[guide]
 
-	go func() {
-		for cab := range c {
-			err := handleListen(cab.Bytes, cab.Conn)
-			if err != nil {
-				log.Errorln(fmt.Errorf("handle listen in address %s: %w", cab.Conn.LocalAddr().String(), err))
-				log.Verbosef("Source: %s\nSize: %d Bytes\n\n", cab.Conn.RemoteAddr().String(), len(cab.Bytes))
-				continue
-			}
+	// Reuse of the mapping
+	if tcpLayer.SYN && !tcpLayer.ACK {
+		if ok {
+			flow.timer.Stop()
+			delete(closing, guide)
 		}
-	}()
+		return
+	}
 
-	for {
-		packet, err := upConn.ReadPacket()
-		if err != nil {
-			if isClosed {
-				return nil
-			}
-			log.Errorln(fmt.Errorf("read upstream in device %s: %w", upConn.LocalDev().Alias(), err))
-			continue
+	if !tcpLayer.FIN && !tcpLayer.RST {
+		return
+	}
+	if !ok {
+		flow = &closingFlow{
+			client: ni.src.String(),
+			q:      ni.q,
+			value:  value,
 		}
+		closing[guide] = flow
+	}
+	if flow.timer != nil {
+		return
+	}
 
-		err = handleUpstream(packet)
-		if err != nil {
-			log.Errorln(fmt.Errorf("handle upstream in device %s: %w", upConn.LocalDev().Alias(), err))
-			log.Verboseln(packet)
-			continue
-		}
+	switch direction {
+	case stat.DirectionOut:
+		flow.finOut = flow.finOut || tcpLayer.FIN
+	case stat.DirectionIn:
+		flow.finIn = flow.finIn || tcpLayer.FIN
+	}
+	if tcpLayer.RST || (flow.finOut && flow.finIn) {
+		flow.timer = time.AfterFunc(closeTimeout, func() {
+			tearDown(guide, flow)
+		})
 	}
 }
 
-func closeAll() {
-	isClosed = true
-	for _, handle := range listeners {
-		if handle != nil {
-			handle.Close()
-		}
+// tearDown removes mappings of the closed TCP connection and releases its port.
+func tearDown(guide pcap.NATGuide, flow *closingFlow) {
+	closingLock.Lock()
+	current, ok := closing[guide]
+	if ok && current == flow {
+		delete(closing, guide)
 	}
-	if upConn != nil {
-		upConn.Close()
+	closingLock.Unlock()
+	if current != flow {
+		return
+	}
+
+	natMap.Delete(guide)
+	patMapsLock.RLock()
+	patMap, ok := patMaps[flow.client]
+	patMapsLock.RUnlock()
+	if ok {
+		patMap.Delete(flow.q)
 	}
+
+	if flow.value >= 49152 {
+		poolLock.Lock()
+		tcpPortPool[convertFromPort(flow.value)] = time.Time{}
+		poolLock.Unlock()
+	}
+
+	log.Verbosef("Tear down closed TCP connection %s\n", flow.q.String())
 }
 
-func handleListen(contents []byte, conn net.Conn) error {
+func convertFromPort(port uint16) uint16 {
+	return port - 49152
+}
+
+// newFlow returns the flow from the source in the protocol to the client.
+func newFlow(src, client net.Addr, protocol gopacket.LayerType) (nat.Flow, error) {
 	var (
-		err               error
-		embIndicator      *pcap.PacketIndicator
-		upValue           uint16
-		newTransportLayer gopacket.Layer
-		newNetworkLayer   gopacket.NetworkLayer
-		upIP              net.IP
-		newLinkLayerType  gopacket.LayerType
-		newLinkLayer      gopacket.Layer
-		data              []byte
-		guide             pcap.NATGuide
-		ni                *natIndicator
+		q   = nat.Flow{Protocol: protocol}
+		err error
 	)
 
-	// Empty payload
-	if len(contents) <= 0 {
-		// return errors.New("empty payload")
-		return nil
+	q.Src, err = nat.NewEndpoint(src)
+	if err != nil {
+		return nat.Flow{}, fmt.Errorf("source: %w", err)
 	}
-
-	// Parse embedded packet
-	embIndicator, err = pcap.ParseEmbPacket(contents)
+	q.Dst, err = nat.NewEndpoint(client)
 	if err != nil {
-		return fmt.Errorf("parse embedded packet: %w", err)
+		return nat.Flow{}, fmt.Errorf("client: %w", err)
 	}
 
-	// Distribute port/Id by source and client address and protocol
-	if !embIndicator.IsFrag() {
-		var ok bool
+	return q, nil
+}
 
-		q := quintuple{
-			src:      embIndicator.NATSrc().String(),
-			dst:      conn.RemoteAddr().String(),
-			protocol: embIndicator.NATProtocol(),
+// isReserved returns if the port is in the static range of any client or forwarded.
+func isReserved(port uint16) bool {
+	for _, profile := range clientProfiles {
+		if profile.minPort > 0 && port >= profile.minPort && port <= profile.maxPort {
+			return true
 		}
-		upValue, ok = patMap[q]
-		if !ok {
-			var err error
+	}
+	for key := range forwards {
+		if key.port == port {
+			return true
+		}
+	}
 
-			// if ICMPv4 error is not in NAT, drop it
-			if t := embIndicator.TransportLayer().LayerType(); t == layers.LayerTypeICMPv4 && !embIndicator.ICMPv4Indicator().IsQuery() {
-				return errors.New("missing nat")
-			}
+	return false
+}
 
-			upValue, err = dist(embIndicator.TransportLayer().LayerType())
-			if err != nil {
-				return fmt.Errorf("distribute: %w", err)
-			}
+// parseClientProfile returns the profile parsed from the configuration of a client.
+func parseClientProfile(cfg *config.ClientConfig) (*clientProfile, error) {
+	profile := &clientProfile{
+		allowedPorts: make(map[uint16]bool),
+		idleTimeout:  keepAlive,
+	}
 
-			patMap[q] = upValue
+	for _, p := range cfg.AllowedPorts {
+		if p <= 0 || p > 65535 {
+			return nil, fmt.Errorf("allowed port %d out of range", p)
 		}
+		profile.allowedPorts[uint16(p)] = true
 	}
 
-	// Create new transport layer
-	if embIndicator.TransportLayer() != nil {
-		switch t := embIndicator.TransportLayer().LayerType(); t {
-		case layers.LayerTypeTCP:
-			tcpLayer := embIndicator.TCPLayer()
-			temp := *tcpLayer
-			newTransportLayer = &temp
-
-			newTCPLayer := newTransportLayer.(*layers.TCP)
+	rate, err := shape.ParseRate(cfg.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("parse limit: %w", err)
+	}
+	profile.limiter = shape.NewLimiter(rate, 0)
 
-			newTCPLayer.SrcPort = layers.TCPPort(upValue)
-		case layers.LayerTypeUDP:
-			udpLayer := embIndicator.UDPLayer()
-			temp := *udpLayer
-			newTransportLayer = &temp
+	if cfg.IdleTimeout < 0 || time.Duration(cfg.IdleTimeout)*time.Second > keepAlive {
+		return nil, fmt.Errorf("idle timeout %d out of range", cfg.IdleTimeout)
+	}
+	if cfg.IdleTimeout > 0 {
+		profile.idleTimeout = time.Duration(cfg.IdleTimeout) * time.Second
+	}
 
-			newUDPLayer := newTransportLayer.(*layers.UDP)
+	if cfg.PortRange != "" {
+		strs := strings.SplitN(cfg.PortRange, "-", 2)
+		if len(strs) < 2 {
+			strs = append(strs, strs[0])
+		}
+		min, err := strconv.Atoi(strings.TrimSpace(strs[0]))
+		if err != nil {
+			return nil, fmt.Errorf("parse port range %s: %w", cfg.PortRange, err)
+		}
+		max, err := strconv.Atoi(strings.TrimSpace(strs[1]))
+		if err != nil {
+			return nil, fmt.Errorf("parse port range %s: %w", cfg.PortRange, err)
+		}
+		if min < 49152 || max > 65535 || min > max {
+			return nil, fmt.Errorf("port range %s out of range", cfg.PortRange)
+		}
+		profile.minPort = uint16(min)
+		profile.maxPort = uint16(max)
+	}
 
-			newUDPLayer.SrcPort = layers.UDPPort(upValue)
-		case layers.LayerTypeICMPv4:
-			if embIndicator.ICMPv4Indicator().IsQuery() {
-				temp := *embIndicator.ICMPv4Indicator().ICMPv4Layer()
-				newTransportLayer = &temp
+	profile.upDevName = cfg.UpDev
+	if cfg.UpIP != "" {
+		profile.upIP = net.ParseIP(cfg.UpIP)
+		if profile.upIP == nil {
+			return nil, fmt.Errorf("invalid upstream ip %s", cfg.UpIP)
+		}
+	}
 
-				newICMPv4Layer := newTransportLayer.(*layers.ICMPv4)
+	return profile, nil
+}
 
-				newICMPv4Layer.Id = upValue
-			} else {
-				newTransportLayer = embIndicator.ICMPv4Indicator().NewPureICMPv4Layer()
+// parseForward returns the port forwarding parsed from its configuration.
+func parseForward(cfg *config.ForwardConfig) (*forward, error) {
+	if cfg.Port <= 0 || cfg.Port > 65535 {
+		return nil, fmt.Errorf("port %d out of range", cfg.Port)
+	}
+	if cfg.Client == "" || len(cfg.Client) > pcap.MaxIdSize {
+		return nil, fmt.Errorf("client id size %d out of range", len(cfg.Client))
+	}
 
-				newICMPv4Layer := newTransportLayer.(*layers.ICMPv4)
+	a, err := addr.ParseTCPAddr(cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("parse address %s: %w", cfg.Address, err)
+	}
+	if a.Port <= 0 {
+		return nil, fmt.Errorf("address %s missing port", cfg.Address)
+	}
 
-				temp := *embIndicator.ICMPv4Indicator().EmbIPv4Layer()
-				newEmbIPv4Layer := &temp
+	f := &forward{
+		port: uint16(cfg.Port),
+		id:   cfg.Client,
+	}
+	switch cfg.Protocol {
+	case "", "tcp":
+		f.protocol = layers.LayerTypeTCP
+		f.addr = a
+	case "udp":
+		f.protocol = layers.LayerTypeUDP
+		f.addr = &net.UDPAddr{IP: a.IP, Port: a.Port}
+	default:
+		return nil, fmt.Errorf("protocol %s not support", cfg.Protocol)
+	}
 
-				newEmbIPv4Layer.DstIP = upConn.LocalDev().IPAddr().IP
+	return f, nil
+}
 
-				var (
-					err                  error
-					newEmbTransportLayer gopacket.Layer
-				)
+// forwardFrom returns the port forwarding to the source of the packet from the client of the Id, nil if the source is
+// not forwarded to.
+func forwardFrom(id string, embIndicator *pcap.PacketIndicator) *forward {
+	if id == "" || len(forwards) <= 0 || embIndicator.IsFrag() || embIndicator.TransportLayer() == nil {
+		return nil
+	}
 
-				embTransportLayerType := embIndicator.ICMPv4Indicator().EmbTransportLayer().LayerType()
-				switch embTransportLayerType {
-				case layers.LayerTypeTCP:
-					temp := *embIndicator.ICMPv4Indicator().EmbTCPLayer()
-					newEmbTransportLayer = &temp
+	t := embIndicator.TransportLayer().LayerType()
+	src := embIndicator.NATSrc().String()
+	for _, f := range forwards {
+		if f.id == id && f.protocol == t && f.addr.String() == src {
+			return f
+		}
+	}
 
-					newEmbTCPLayer := newEmbTransportLayer.(*layers.TCP)
+	return nil
+}
 
-					newEmbTCPLayer.DstPort = layers.TCPPort(upValue)
+// forwardedTo returns the NAT indicator of the client the packet is forwarded to by its destination port, and if the
+// port is forwarded. The indicator is nil if the client is not connected.
+func forwardedTo(indicator *pcap.PacketIndicator) (*natIndicator, bool) {
+	if len(forwards) <= 0 || indicator.TransportLayer() == nil {
+		return nil, false
+	}
 
-					err = newEmbTCPLayer.SetNetworkLayerForChecksum(newEmbIPv4Layer)
-				case layers.LayerTypeUDP:
-					temp := *embIndicator.ICMPv4Indicator().EmbUDPLayer()
-					newEmbTransportLayer = &temp
+	t := indicator.TransportLayer().LayerType()
+	if t != layers.LayerTypeTCP && t != layers.LayerTypeUDP {
+		return nil, false
+	}
+	f, ok := forwards[forwardKey{protocol: t, port: indicator.DstPort()}]
+	if !ok {
+		return nil, false
+	}
 
-					newEmbUDPLayer := newEmbTransportLayer.(*layers.UDP)
+	conn, src := forwardConn(f.id)
+	if conn == nil {
+		return nil, true
+	}
+	q, err := newFlow(f.addr, src, t)
+	if err != nil {
+		return nil, true
+	}
 
-					newEmbUDPLayer.DstPort = layers.UDPPort(upValue)
+	return &natIndicator{
+		src:    src,
+		embSrc: f.addr,
+		conn:   conn,
+		id:     f.id,
+		q:      q,
+	}, true
+}
 
-					err = newEmbUDPLayer.SetNetworkLayerForChecksum(newEmbIPv4Layer)
-				case layers.LayerTypeICMPv4:
-					temp := *embIndicator.ICMPv4Indicator().EmbICMPv4Layer()
-					newEmbTransportLayer = &temp
+// setForwardConn records the connection as the latest one of the client of the Id receiving forwarded packets.
+func setForwardConn(id string, conn net.Conn) {
+	forwardsLock.RLock()
+	current := forwardConns[id]
+	forwardsLock.RUnlock()
+	if current == conn {
+		return
+	}
 
-					if embIndicator.ICMPv4Indicator().IsEmbQuery() {
-						newEmbICMPv4Layer := newEmbTransportLayer.(*layers.ICMPv4)
+	forwardsLock.Lock()
+	forwardConns[id] = conn
+	forwardsLock.Unlock()
+}
 
-						newEmbICMPv4Layer.Id = upValue
-					}
-				default:
-					return fmt.Errorf("create transport layer: %w", fmt.Errorf("transport layer type %s not support", embTransportLayerType))
-				}
-				if err != nil {
-					return fmt.Errorf("create transport layer: %w", fmt.Errorf("set network layer for checksum: %w", err))
-				}
+// forwardConn returns a connection of the client of the Id and the address of the client, preferring the one it sends
+// from lately, nil if the client is not connected.
+func forwardConn(id string) (net.Conn, net.Addr) {
+	forwardsLock.RLock()
+	latest := forwardConns[id]
+	forwardsLock.RUnlock()
 
-				payload, err := pcap.Serialize(newEmbIPv4Layer, newEmbTransportLayer.(gopacket.SerializableLayer))
-				if err != nil {
-					return fmt.Errorf("create transport layer: %w", fmt.Errorf("serialize: %w", err))
-				}
+	clientsLock.RLock()
+	defer clientsLock.RUnlock()
 
-				newICMPv4Layer.Payload = payload
+	var (
+		conn net.Conn
+		src  net.Addr
+	)
+	for _, c := range clientConns {
+		frameConn, ok := c.(*pcap.FrameConn)
+		if !ok || frameConn.PeerId() != id {
+			continue
+		}
+		if conn == nil || c == latest {
+			conn = c
+			src = c.RemoteAddr()
+			if alias, ok := resumed[c]; ok {
+				src = alias
 			}
-		default:
-			return fmt.Errorf("transport layer type %s not support", t)
 		}
 	}
 
-	// Create new network layer
-	switch t := embIndicator.NetworkLayer().LayerType(); t {
-	case layers.LayerTypeIPv4:
-		ipv4Layer := embIndicator.NetworkLayer().(*layers.IPv4)
-		temp := *ipv4Layer
-		newNetworkLayer = &temp
+	return conn, src
+}
 
-		newIPv4Layer := newNetworkLayer.(*layers.IPv4)
+// checkPortRanges returns an error if static ranges of clients overlap.
+func checkPortRanges() error {
+	ids := make([]string, 0, len(clientProfiles))
+	for id, profile := range clientProfiles {
+		if profile.minPort > 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return clientProfiles[ids[i]].minPort < clientProfiles[ids[j]].minPort
+	})
 
-		newIPv4Layer.SrcIP = upConn.LocalDev().IPAddr().IP
-		upIP = newIPv4Layer.SrcIP
-	default:
-		return fmt.Errorf("network layer type %s not support", t)
+	for i := 1; i < len(ids); i++ {
+		if clientProfiles[ids[i]].minPort <= clientProfiles[ids[i-1]].maxPort {
+			return fmt.Errorf("port ranges of client %s and %s overlap", ids[i-1], ids[i])
+		}
 	}
 
-	// Set network layer for transport layer
-	if newTransportLayer != nil {
-		switch t := newTransportLayer.LayerType(); t {
-		case layers.LayerTypeTCP:
-			tcpLayer := newTransportLayer.(*layers.TCP)
+	return nil
+}
 
-			err = tcpLayer.SetNetworkLayerForChecksum(newNetworkLayer)
-		case layers.LayerTypeUDP:
-			udpLayer := newTransportLayer.(*layers.UDP)
+// profileOf returns the Id presented by the client of the connection and its profile, nil if the client does not
+// present an Id or the Id is not configured.
+func profileOf(conn net.Conn) (string, *clientProfile) {
+	frameConn, ok := conn.(*pcap.FrameConn)
+	if !ok {
+		return "", nil
+	}
 
-			err = udpLayer.SetNetworkLayerForChecksum(newNetworkLayer)
-		case layers.LayerTypeICMPv4:
-			break
-		default:
-			return fmt.Errorf("transport layer type %s not support", t)
-		}
-		if err != nil {
-			return fmt.Errorf("set network layer for checksum: %w", err)
-		}
+	id := frameConn.PeerId()
+	if id == "" {
+		return "", nil
 	}
 
-	// Decide Loopback or Ethernet
-	if upConn.IsLoop() {
-		newLinkLayerType = layers.LayerTypeLoopback
-	} else {
-		newLinkLayerType = layers.LayerTypeEthernet
+	return id, clientProfiles[id]
+}
+
+// userOf returns the user the client of the connection authenticates as, nil if it does not authenticate.
+func userOf(conn net.Conn) *user.User {
+	frameConn, ok := conn.(*pcap.FrameConn)
+	if !ok {
+		return nil
 	}
 
-	// Create new link layer
-	switch newLinkLayerType {
-	case layers.LayerTypeLoopback:
-		newLinkLayer = pcap.CreateLoopbackLayer()
-	case layers.LayerTypeEthernet:
-		newLinkLayer, err = pcap.CreateEthernetLayer(upConn.LocalDev().HardwareAddr(), upConn.RemoteDev().HardwareAddr(), newNetworkLayer)
-	default:
-		return fmt.Errorf("link layer type %s not support", newLinkLayerType)
+	return users[frameConn.User()]
+}
+
+// userFlows returns the number of flows in NAT of all clients authenticating as the user.
+func userFlows(name string) int {
+	n := 0
+
+	clientsLock.RLock()
+	defer clientsLock.RUnlock()
+
+	patMapsLock.RLock()
+	defer patMapsLock.RUnlock()
+
+	for a, conn := range clientConns {
+		frameConn, ok := conn.(*pcap.FrameConn)
+		if !ok || frameConn.User() != name {
+			continue
+		}
+		patMap, ok := patMaps[a]
+		if ok {
+			n = n + patMap.Len()
+		}
 	}
-	if err != nil {
-		return fmt.Errorf("create link layer: %w", err)
+
+	return n
+}
+
+// clientKey returns the key of a client in statistics, which is its Id, or its address if it does not present one.
+func clientKey(id string, a net.Addr) string {
+	if id != "" {
+		return id
 	}
 
-	// Serialize layers
-	if newTransportLayer == nil {
-		data, err = pcap.Serialize(newLinkLayer.(gopacket.SerializableLayer),
-			newNetworkLayer.(gopacket.SerializableLayer),
-			gopacket.Payload(embIndicator.Payload()))
-	} else {
-		data, err = pcap.Serialize(newLinkLayer.(gopacket.SerializableLayer),
-			newNetworkLayer.(gopacket.SerializableLayer),
-			newTransportLayer.(gopacket.SerializableLayer),
-			gopacket.Payload(embIndicator.Payload()))
+	return a.String()
+}
+
+// addTraffic adds a data of traffic to the client of the Id and the address.
+func addTraffic(id string, a net.Addr, direction stat.Direction, size uint) {
+	key := clientKey(id, a)
+
+	trafficLock.Lock()
+	defer trafficLock.Unlock()
+
+	t, ok := traffic[key]
+	if !ok {
+		t = &clientTraffic{id: id}
+		traffic[key] = t
 	}
-	if err != nil {
-		return fmt.Errorf("serialize: %w", err)
+	switch direction {
+	case stat.DirectionIn:
+		t.inCount++
+		t.inSize += uint64(size)
+	case stat.DirectionOut:
+		t.outCount++
+		t.outSize += uint64(size)
+	default:
+		panic(fmt.Errorf("direction %d out of range", direction))
 	}
+	t.lastSeen = time.Now()
+}
 
-	// Write packet data
-	_, err = upConn.Write(data)
-	if err != nil {
-		return fmt.Errorf("write: %w", err)
+// natMapping describes a mapping in NAT for observing.
+type natMapping struct {
+	NAT      string `json:"nat"`
+	Protocol string `json:"protocol"`
+	Source   string `json:"source"`
+	Client   string `json:"client"`
+	Idle     int    `json:"idle"`
+}
+
+// natMappings returns mappings in NAT from the most recently used one.
+func natMappings() []natMapping {
+	mappings := make([]natMapping, 0)
+	now := time.Now()
+	for _, entry := range natMap.Dump() {
+		guide := entry.Key.(pcap.NATGuide)
+		ni := entry.Value.(*natIndicator)
+
+		mappings = append(mappings, natMapping{
+			NAT:      guide.Src,
+			Protocol: guide.Protocol.String(),
+			Source:   ni.embSrc.String(),
+			Client:   ni.src.String(),
+			Idle:     int(now.Sub(entry.LastSeen).Seconds()),
+		})
 	}
 
-	// NAT
-	if embIndicator.TransportLayer() != nil {
-		// Record the source and the source device of the packet
-		var addNAT bool
-		switch t := embIndicator.TransportLayer().LayerType(); t {
-		case layers.LayerTypeTCP:
-			a := net.TCPAddr{
-				IP:   upIP,
-				Port: int(upValue),
-			}
-			guide = pcap.NATGuide{
-				Src:      a.String(),
-				Protocol: t,
-			}
-			addNAT = true
-		case layers.LayerTypeUDP:
-			a := net.UDPAddr{
-				IP:   upIP,
-				Port: int(upValue),
-			}
-			guide = pcap.NATGuide{
-				Src:      a.String(),
-				Protocol: t,
-			}
-			addNAT = true
-		case layers.LayerTypeICMPv4:
-			if embIndicator.ICMPv4Indicator().IsQuery() {
-				guide = pcap.NATGuide{
-					Src: addr.ICMPQueryAddr{
-						IP: upIP,
-						Id: upValue,
-					}.String(),
-					Protocol: t,
-				}
-				addNAT = true
-			}
-		default:
-			return fmt.Errorf("transport layer type %s not support", t)
+	return mappings
+}
+
+// clientStat describes statistics of a client for observing.
+type clientStat struct {
+	Client    string   `json:"client"`
+	Id        string   `json:"id,omitempty"`
+	Addresses []string `json:"addresses"`
+	NAT       int      `json:"nat"`
+	InCount   uint64   `json:"inCount"`
+	InSize    uint64   `json:"inSize"`
+	OutCount  uint64   `json:"outCount"`
+	OutSize   uint64   `json:"outSize"`
+	LastSeen  int64    `json:"lastSeen"`
+}
+
+// clientStats returns statistics of clients connected or having traffic, sorted by the key.
+func clientStats() []clientStat {
+	stats := make(map[string]*clientStat)
+	statOf := func(key string) *clientStat {
+		s, ok := stats[key]
+		if !ok {
+			s = &clientStat{Client: key, Addresses: make([]string, 0)}
+			stats[key] = s
 		}
-		if addNAT {
-			ni = &natIndicator{
-				src:    conn.RemoteAddr(),
-				embSrc: embIndicator.NATSrc(),
-				conn:   conn,
-			}
-			natLock.Lock()
-			nat[guide] = ni
-			natLock.Unlock()
+		return s
+	}
+
+	clientsLock.RLock()
+	for a, conn := range clientConns {
+		id, _ := profileOf(conn)
+		src := conn.RemoteAddr()
+		if alias, ok := resumed[conn]; ok {
+			src = alias
 		}
+		s := statOf(clientKey(id, src))
+		if id != "" {
+			s.Id = id
+		}
+		s.Addresses = append(s.Addresses, a)
 
-		// Keep alive
-		protocol := embIndicator.NATProtocol()
-		switch protocol {
-		case layers.LayerTypeTCP:
-			tcpPortPool[convertFromPort(upValue)] = time.Now()
-		case layers.LayerTypeUDP:
-			udpPortPool[convertFromPort(upValue)] = time.Now()
-		case layers.LayerTypeICMPv4:
-			icmpv4IdPool[upValue] = time.Now()
-		default:
-			return fmt.Errorf("transport layer type %s not support", protocol)
+		patMapsLock.RLock()
+		patMap, ok := patMaps[a]
+		patMapsLock.RUnlock()
+		if ok {
+			s.NAT += patMap.Len()
 		}
 	}
-
-	// Statistics
-	if monitor != nil {
-		monitor.Add(conn.RemoteAddr().String(), stat.DirectionOut, uint(embIndicator.Size()))
+	clientsLock.RUnlock()
+
+	trafficLock.Lock()
+	for key, t := range traffic {
+		s := statOf(key)
+		s.Id = t.id
+		s.InCount = t.inCount
+		s.InSize = t.inSize
+		s.OutCount = t.outCount
+		s.OutSize = t.outSize
+		s.LastSeen = t.lastSeen.Unix()
 	}
+	trafficLock.Unlock()
 
-	log.Verbosef("Redirect an inbound %s packet: %s -> %s -> %s (%d Bytes)\n",
-		embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String(), embIndicator.Size())
+	result := make([]clientStat, 0, len(stats))
+	for _, s := range stats {
+		sort.Strings(s.Addresses)
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Client < result[j].Client
+	})
 
-	return nil
+	return result
 }
 
-func handleUpstream(packet gopacket.Packet) error {
-	var (
-		err               error
-		indicator         *pcap.PacketIndicator
-		frags             []*pcap.PacketIndicator
-		ni                *natIndicator
-		embTransportLayer gopacket.Layer
-		embNetworkLayer   gopacket.NetworkLayer
-		data              []byte
-	)
+// userStat describes statistics of a user for observing.
+type userStat struct {
+	User         string `json:"user"`
+	DaySize      uint64 `json:"daySize"`
+	DailyQuota   uint64 `json:"dailyQuota"`
+	MonthSize    uint64 `json:"monthSize"`
+	MonthlyQuota uint64 `json:"monthlyQuota"`
+	Flows        int    `json:"flows"`
+}
 
-	// Parse packet
-	indicator, err = pcap.ParsePacket(packet)
-	if err != nil {
-		return fmt.Errorf("parse packet: %w", err)
+// userStats returns statistics of users, sorted by their names.
+func userStats() []userStat {
+	result := make([]userStat, 0, len(users))
+	for _, u := range users.Sorted() {
+		usage := u.Usage()
+		result = append(result, userStat{
+			User:         u.Name(),
+			DaySize:      usage.DayBytes,
+			DailyQuota:   u.DailyQuota(),
+			MonthSize:    usage.MonthBytes,
+			MonthlyQuota: u.MonthlyQuota(),
+			Flows:        userFlows(u.Name()),
+		})
 	}
 
-	// Handle fragments
-	indicator, frags, err = defrag.AppendOriginal(indicator)
-	if err != nil {
-		return fmt.Errorf("defrag: %w", err)
-	}
-	if indicator == nil {
-		return nil
+	return result
+}
+
+// natState describes NAT saved in the state file, so mappings of long-lived connections survive a quick restart.
+type natState struct {
+	NAT       []natEntryState      `json:"nat"`
+	PAT       []patEntryState      `json:"pat"`
+	Filter    map[string]time.Time `json:"filter"`
+	TCPPorts  map[uint16]time.Time `json:"tcp-ports"`
+	UDPPorts  map[uint16]time.Time `json:"udp-ports"`
+	ICMPv4Ids map[uint16]time.Time `json:"icmpv4-ids"`
+	ICMPv6Ids map[uint16]time.Time `json:"icmpv6-ids"`
+}
+
+// natEntryState describes a mapping in NAT in the state file.
+type natEntryState struct {
+	NAT            string             `json:"nat"`
+	Protocol       gopacket.LayerType `json:"protocol"`
+	Client         string             `json:"client"`
+	Id             string             `json:"id"`
+	SourceIP       net.IP             `json:"source-ip"`
+	SourceValue    uint16             `json:"source-value"`
+	SourceProtocol gopacket.LayerType `json:"source-protocol"`
+	Remote         string             `json:"remote"`
+	LastSeen       time.Time          `json:"last-seen"`
+}
+
+// patEntryState describes a distributed port or Id of a client in the state file.
+type patEntryState struct {
+	Client   string             `json:"client"`
+	Id       string             `json:"id"`
+	Source   string             `json:"source"`
+	Remote   string             `json:"remote"`
+	Protocol gopacket.LayerType `json:"protocol"`
+	Value    uint16             `json:"value"`
+	LastSeen time.Time          `json:"last-seen"`
+}
+
+// saveNAT saves mappings in NAT, distributed ports and Ids to the state file.
+func saveNAT() error {
+	state := natState{
+		NAT:    make([]natEntryState, 0),
+		PAT:    make([]patEntryState, 0),
+		Filter: make(map[string]time.Time),
 	}
 
-	// NAT
-	guide := pcap.NATGuide{
-		Src:      indicator.NATDst().String(),
-		Protocol: indicator.TransportLayer().LayerType(),
+	ids := make(map[string]string)
+	for _, entry := range natMap.Dump() {
+		guide := entry.Key.(pcap.NATGuide)
+		ni := entry.Value.(*natIndicator)
+
+		var value uint16
+		switch t := ni.embSrc.(type) {
+		case *net.TCPAddr:
+			value = uint16(t.Port)
+		case *net.UDPAddr:
+			value = uint16(t.Port)
+		case *addr.ICMPQueryAddr:
+			value = t.Id
+		case *addr.IPProtocolAddr:
+			value = uint16(t.Protocol)
+		default:
+			return fmt.Errorf("type %T not support", t)
+		}
+
+		state.NAT = append(state.NAT, natEntryState{
+			NAT:            guide.Src,
+			Protocol:       guide.Protocol,
+			Client:         ni.src.String(),
+			Id:             ni.id,
+			SourceIP:       ni.embSrcIP(),
+			SourceValue:    value,
+			SourceProtocol: ni.q.Protocol,
+			Remote:         remoteOf(ni.q),
+			LastSeen:       entry.LastSeen,
+		})
+		ids[ni.src.String()] = ni.id
 	}
-	natLock.RLock()
-	ni, ok := nat[guide]
-	natLock.RUnlock()
-	if !ok {
-		return nil
+
+	patMapsLock.RLock()
+	for client, patMap := range patMaps {
+		for _, entry := range patMap.Dump() {
+			q := entry.Key.(nat.Flow)
+
+			state.PAT = append(state.PAT, patEntryState{
+				Client:   client,
+				Id:       ids[client],
+				Source:   q.Addr(q.Src).String(),
+				Remote:   remoteOf(q),
+				Protocol: q.Protocol,
+				Value:    entry.Value.(uint16),
+				LastSeen: entry.LastSeen,
+			})
+		}
 	}
+	patMapsLock.RUnlock()
 
-	// Keep alive
-	protocol := indicator.NATProtocol()
-	switch protocol {
-	case layers.LayerTypeTCP:
-		tcpPortPool[convertFromPort(indicator.DstPort())] = time.Now()
-	case layers.LayerTypeUDP:
-		udpPortPool[convertFromPort(indicator.DstPort())] = time.Now()
-	case layers.LayerTypeICMPv4:
-		icmpv4IdPool[indicator.ICMPv4Indicator().Id()] = time.Now()
-	default:
-		return fmt.Errorf("transport layer type %s not support", protocol)
+	if filterMap != nil {
+		for _, entry := range filterMap.Dump() {
+			state.Filter[entry.Key.(string)] = entry.LastSeen
+		}
 	}
 
-	for _, frag := range frags {
-		// Create embedded transport layer
-		if frag.TransportLayer() != nil {
-			switch t := frag.TransportLayer().LayerType(); t {
-			case layers.LayerTypeTCP:
-				embTCPLayer := frag.TCPLayer()
-				temp := *embTCPLayer
-				embTransportLayer = &temp
+	poolLock.Lock()
+	state.TCPPorts = savePool(tcpPortPool)
+	state.UDPPorts = savePool(udpPortPool)
+	state.ICMPv4Ids = savePool(icmpv4IdPool)
+	state.ICMPv6Ids = savePool(icmpv6IdPool)
+	poolLock.Unlock()
 
-				newEmbTCPLayer := embTransportLayer.(*layers.TCP)
+	return config.SaveState(statePath, &state)
+}
+
+// restoreNAT restores mappings in NAT, distributed ports and Ids from the state file, and returns the number of
+// restored mappings. Expired ones are skipped, and clients are served again once they reconnect from the same address.
+func restoreNAT() (int, error) {
+	var state natState
+	err := config.LoadState(statePath, &state)
+	if err != nil {
+		return 0, err
+	}
 
-				newEmbTCPLayer.DstPort = layers.TCPPort(ni.embSrc.(*net.TCPAddr).Port)
-			case layers.LayerTypeUDP:
-				embUDPLayer := frag.UDPLayer()
-				temp := *embUDPLayer
-				embTransportLayer = &temp
+	poolLock.Lock()
+	restorePool(tcpPortPool, state.TCPPorts)
+	restorePool(udpPortPool, state.UDPPorts)
+	restorePool(icmpv4IdPool, state.ICMPv4Ids)
+	restorePool(icmpv6IdPool, state.ICMPv6Ids)
+	poolLock.Unlock()
+
+	for _, e := range state.PAT {
+		q, err := parseFlow(e.Source, e.Client, e.Remote, e.Protocol)
+		if err != nil {
+			return 0, fmt.Errorf("parse flow: %w", err)
+		}
+		patMapOf(e.Client, clientProfiles[e.Id]).Restore(q, e.Value, e.LastSeen)
+	}
 
-				newEmbUDPLayer := embTransportLayer.(*layers.UDP)
+	if filterMap != nil {
+		for key, lastSeen := range state.Filter {
+			filterMap.Restore(key, true, lastSeen)
+		}
+	}
 
-				newEmbUDPLayer.DstPort = layers.UDPPort(ni.embSrc.(*net.UDPAddr).Port)
-			case layers.LayerTypeICMPv4:
-				if frag.ICMPv4Indicator().IsQuery() {
-					embICMPv4Layer := frag.ICMPv4Indicator().ICMPv4Layer()
-					temp := *embICMPv4Layer
-					embTransportLayer = &temp
+	for _, e := range state.NAT {
+		var embSrc net.Addr
+		switch e.SourceProtocol {
+		case layers.LayerTypeTCP:
+			embSrc = &net.TCPAddr{IP: e.SourceIP, Port: int(e.SourceValue)}
+		case layers.LayerTypeUDP:
+			embSrc = &net.UDPAddr{IP: e.SourceIP, Port: int(e.SourceValue)}
+		case layers.LayerTypeICMPv4, layers.LayerTypeICMPv6:
+			embSrc = &addr.ICMPQueryAddr{IP: e.SourceIP, Id: e.SourceValue}
+		case pcap.LayerTypeOpaque:
+			embSrc = &addr.IPProtocolAddr{IP: e.SourceIP, Protocol: uint8(e.SourceValue)}
+		default:
+			return 0, pcap.NewError(pcap.ErrUnsupportedLayer, "transport layer type %s not support", e.SourceProtocol)
+		}
 
-					newEmbICMPv4Layer := embTransportLayer.(*layers.ICMPv4)
+		// Only the address of the client is used to find its latest connection
+		src, err := addr.ParseTCPAddr(e.Client)
+		if err != nil {
+			return 0, fmt.Errorf("parse client %s: %w", e.Client, err)
+		}
 
-					newEmbICMPv4Layer.Id = ni.embSrc.(*addr.ICMPQueryAddr).Id
-				} else {
-					embTransportLayer = frag.ICMPv4Indicator().NewPureICMPv4Layer()
+		q, err := parseFlow(embSrc.String(), e.Client, e.Remote, e.SourceProtocol)
+		if err != nil {
+			return 0, fmt.Errorf("parse flow: %w", err)
+		}
 
-					newEmbICMPv4Layer := embTransportLayer.(*layers.ICMPv4)
+		guide := pcap.NATGuide{
+			Src:      e.NAT,
+			Protocol: e.Protocol,
+		}
+		natMap.Restore(guide, &natIndicator{
+			src:    src,
+			embSrc: embSrc,
+			id:     e.Id,
+			q:      q,
+		}, e.LastSeen)
+	}
 
-					temp := *frag.ICMPv4Indicator().EmbIPv4Layer()
-					newEmbEmbIPv4Layer := &temp
+	return natMap.Len(), nil
+}
 
-					newEmbEmbIPv4Layer.SrcIP = ni.embSrcIP()
+// parseFlow returns the flow by its source, client and remote saved in the state file.
+func parseFlow(src, client, remote string, protocol gopacket.LayerType) (nat.Flow, error) {
+	var (
+		q   = nat.Flow{Protocol: protocol}
+		err error
+	)
 
-					var (
-						err                     error
-						newEmbEmbTransportLayer gopacket.Layer
-					)
+	q.Src, err = nat.ParseEndpoint(src)
+	if err != nil {
+		return nat.Flow{}, fmt.Errorf("parse source %s: %w", src, err)
+	}
+	q.Dst, err = nat.ParseEndpoint(client)
+	if err != nil {
+		return nat.Flow{}, fmt.Errorf("parse client %s: %w", client, err)
+	}
+	if remote != "" {
+		q.Remote, err = nat.ParseEndpoint(remote)
+		if err != nil {
+			return nat.Flow{}, fmt.Errorf("parse remote %s: %w", remote, err)
+		}
+	}
 
-					switch t := frag.ICMPv4Indicator().EmbTransportLayer().LayerType(); t {
-					case layers.LayerTypeTCP:
-						temp := *frag.ICMPv4Indicator().EmbTCPLayer()
-						newEmbEmbTransportLayer = &temp
+	return q, nil
+}
 
-						newEmbEmbTCPLayer := newEmbEmbTransportLayer.(*layers.TCP)
+// remoteOf returns the remote of the flow saved in the state file, empty if mappings do not depend on remotes.
+func remoteOf(q nat.Flow) string {
+	if q.Remote.IsZero() {
+		return ""
+	}
 
-						newEmbEmbTCPLayer.SrcPort = layers.TCPPort(ni.embSrc.(*net.TCPAddr).Port)
+	return q.Addr(q.Remote).String()
+}
 
-						err = newEmbEmbTCPLayer.SetNetworkLayerForChecksum(newEmbEmbIPv4Layer)
-					case layers.LayerTypeUDP:
-						temp := *frag.ICMPv4Indicator().EmbUDPLayer()
-						newEmbEmbTransportLayer = &temp
+// savePool returns ports or Ids in use in the pool by their indexes.
+func savePool(pool []time.Time) map[uint16]time.Time {
+	result := make(map[uint16]time.Time)
+	for i, t := range pool {
+		if !t.IsZero() && time.Since(t) <= keepAlive {
+			result[uint16(i)] = t
+		}
+	}
 
-						newEmbEmbUDPLayer := newEmbEmbTransportLayer.(*layers.UDP)
+	return result
+}
 
-						newEmbEmbUDPLayer.SrcPort = layers.UDPPort(ni.embSrc.(*net.UDPAddr).Port)
+// restorePool marks ports or Ids in the pool in use by their indexes.
+func restorePool(pool []time.Time, saved map[uint16]time.Time) {
+	for i, t := range saved {
+		if int(i) < len(pool) {
+			pool[i] = t
+		}
+	}
+}
 
-						err = newEmbEmbUDPLayer.SetNetworkLayerForChecksum(newEmbEmbIPv4Layer)
-					case layers.LayerTypeICMPv4:
-						temp := *frag.ICMPv4Indicator().EmbICMPv4Layer()
-						newEmbEmbTransportLayer = &temp
+// flushNAT removes all mappings in NAT and returns the number of removed mappings. Distributed ports and Ids are kept
+// until they expire, so late packets of flushed mappings are not mistaken for new ones.
+func flushNAT() int {
+	n := natMap.Flush()
+	if filterMap != nil {
+		filterMap.Flush()
+	}
 
-						if frag.ICMPv4Indicator().IsEmbQuery() {
-							newEmbEmbICMPv4Layer := newEmbEmbTransportLayer.(*layers.ICMPv4)
+	patMapsLock.RLock()
+	for _, patMap := range patMaps {
+		patMap.Flush()
+	}
+	patMapsLock.RUnlock()
 
-							newEmbEmbICMPv4Layer.Id = ni.embSrc.(*addr.ICMPQueryAddr).Id
-						}
-					default:
-						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("transport layer type %s not support", t))
-					}
-					if err != nil {
-						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("set network layer for checksum: %w", err))
-					}
+	return n
+}
 
-					payload, err := pcap.Serialize(newEmbEmbIPv4Layer, newEmbEmbTransportLayer.(gopacket.SerializableLayer))
-					if err != nil {
-						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("serialize: %w", err))
-					}
+// listenPorts returns listen ports, starting with the port from arguments.
+func listenPorts() []uint16 {
+	listenersLock.RLock()
+	defer listenersLock.RUnlock()
 
-					newEmbICMPv4Layer.Payload = payload
-				}
-			default:
-				return fmt.Errorf("embedded transport layer type %s not support", t)
-			}
-		}
+	ports := make([]int, 0, len(extraListeners))
+	for p := range extraListeners {
+		ports = append(ports, int(p))
+	}
+	sort.Ints(ports)
 
-		// Create embedded network layer
-		switch t := frag.NetworkLayer().LayerType(); t {
-		case layers.LayerTypeIPv4:
-			embIPv4Layer := frag.IPv4Layer()
-			temp := *embIPv4Layer
-			embNetworkLayer = &temp
+	result := append(make([]uint16, 0, len(ports)+1), port)
+	for _, p := range ports {
+		result = append(result, uint16(p))
+	}
 
-			newEmbIPv4Layer := embNetworkLayer.(*layers.IPv4)
+	return result
+}
 
-			newEmbIPv4Layer.DstIP = ni.embSrcIP()
-		default:
-			return fmt.Errorf("embedded network layer type %s not support", t)
+// setUpstreamFilters updates filters of all upstream connections.
+func setUpstreamFilters() {
+	for _, conn := range append([]pcap.PacketConn{upConn}, extraUpConns...) {
+		err := conn.SetBPFFilter(upstreamFilter())
+		if err != nil {
+			log.Errorln(fmt.Errorf("set filter of upstream device %s: %w", conn.LocalDev().Alias(), err))
 		}
+	}
+}
 
-		// Set network layer for transport layer
-		if embTransportLayer != nil {
-			switch t := embTransportLayer.LayerType(); t {
-			case layers.LayerTypeTCP:
-				embTCPLayer := embTransportLayer.(*layers.TCP)
+// addPort listens on the port in all listen devices.
+func addPort(p uint16) error {
+	portsLock.Lock()
+	defer portsLock.Unlock()
 
-				err = embTCPLayer.SetNetworkLayerForChecksum(embNetworkLayer)
-			case layers.LayerTypeUDP:
-				embUDPLayer := embTransportLayer.(*layers.UDP)
+	if hop != nil {
+		return control.BadRequest(errors.New("listen ports cannot be changed in hopping"))
+	}
+	if upConn == nil {
+		return errors.New("not opened")
+	}
+	listenersLock.RLock()
+	_, ok := extraListeners[p]
+	listenersLock.RUnlock()
+	if p == port || ok {
+		return control.BadRequest(fmt.Errorf("port %d in use", p))
+	}
 
-				err = embUDPLayer.SetNetworkLayerForChecksum(embNetworkLayer)
-			case layers.LayerTypeICMPv4:
-				break
-			default:
-				return fmt.Errorf("embedded transport layer type %s not support", t)
-			}
-			if err != nil {
-				return fmt.Errorf("set embedded network layer for checksum: %w", err)
+	ls := make([]net.Listener, 0, len(listenDevs))
+	for _, dev := range listenDevs {
+		listener, err := listen(dev, p)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
 			}
+			return fmt.Errorf("open listen device %s: %w", dev.Alias(), err)
 		}
+		ls = append(ls, listener)
+	}
 
-		// Serialize layers
-		if embTransportLayer == nil {
-			data, err = pcap.Serialize(embNetworkLayer.(gopacket.SerializableLayer),
-				gopacket.Payload(frag.Payload()))
-		} else {
-			data, err = pcap.Serialize(embNetworkLayer.(gopacket.SerializableLayer),
-				embTransportLayer.(gopacket.SerializableLayer),
-				gopacket.Payload(frag.Payload()))
-		}
-		if err != nil {
-			return fmt.Errorf("serialize: %w", err)
-		}
+	listenersLock.Lock()
+	extraListeners[p] = ls
+	listenersLock.Unlock()
 
-		// Write packet data
-		_, err = ni.conn.Write(data)
+	setUpstreamFilters()
+	if isRSTRule {
+		err := exec.AddRSTRule(p)
 		if err != nil {
-			return fmt.Errorf("write: %w", err)
+			log.Errorln(fmt.Errorf("add rst rule: %w", err))
 		}
+	}
 
-		// Statistics
-		size := frag.MTU()
-		if monitor != nil {
-			monitor.Add(ni.conn.RemoteAddr().String(), stat.DirectionIn, uint(size))
-		}
+	for _, listener := range ls {
+		go accept(listener)
+	}
 
-		log.Verbosef("Redirect an outbound %s packet: %s <- %s <- %s (%d Bytes)\n",
-			frag.TransportProtocol(), ni.embSrc.String(), ni.src.String(), frag.Src(), size)
+	log.Infof("Listen on port %d\n", p)
+
+	return nil
+}
+
+// removePort stops listening on the port in all listen devices. The port from arguments cannot be removed.
+func removePort(p uint16) error {
+	portsLock.Lock()
+	defer portsLock.Unlock()
+
+	if p == port {
+		return control.BadRequest(fmt.Errorf("port %d cannot be removed", p))
 	}
 
-	// Record DNS
-	if indicator.DNSIndicator() != nil {
-		if indicator.DNSIndicator().IsResponse() {
-			name, ips := indicator.DNSIndicator().Answers()
-			if name != "" && len(ips) > 0 {
-				dnsLock.Lock()
-				for _, ip := range ips {
-					dns[ip.String()] = name
-					log.Verbosef("Record DNS record %s = %s\n", name, ip)
-				}
-				dnsLock.Unlock()
-			}
+	listenersLock.Lock()
+	ls, ok := extraListeners[p]
+	delete(extraListeners, p)
+	listenersLock.Unlock()
+	if !ok {
+		return control.NotFound(fmt.Errorf("port %d not found", p))
+	}
+
+	for _, listener := range ls {
+		listener.Close()
+	}
+
+	setUpstreamFilters()
+	if isRSTRule {
+		err := exec.DeleteRSTRule(p)
+		if err != nil {
+			log.Errorln(fmt.Errorf("delete rst rule: %w", err))
 		}
 	}
 
+	log.Infof("Stop listening on port %d\n", p)
+
 	return nil
 }
 
-func dist(t gopacket.LayerType) (uint16, error) {
-	now := time.Now()
-
-	switch t {
-	case layers.LayerTypeTCP:
-		for i := 0; i < 16384; i++ {
-			s := nextTCPPort % 16384
+// handleControl registers handlers of the control API.
+func handleControl(s *control.Server) {
+	s.Handle("/devices", map[string]control.HandlerFunc{
+		http.MethodGet: func(req *http.Request) (interface{}, error) {
+			return &struct {
+				Listen   []*pcap.Device `json:"listen"`
+				Upstream *pcap.Device   `json:"upstream"`
+				Gateway  *pcap.Device   `json:"gateway"`
+			}{
+				Listen:   listenDevs,
+				Upstream: upDev,
+				Gateway:  gatewayDev,
+			}, nil
+		},
+	})
+
+	s.Handle("/nat", map[string]control.HandlerFunc{
+		http.MethodGet: func(req *http.Request) (interface{}, error) {
+			return natMappings(), nil
+		},
+		http.MethodDelete: func(req *http.Request) (interface{}, error) {
+			n := flushNAT()
+			log.Infof("Flush %d NAT entries\n", n)
+
+			return &struct {
+				Flushed int `json:"flushed"`
+			}{
+				Flushed: n,
+			}, nil
+		},
+	})
+
+	s.Handle("/clients", map[string]control.HandlerFunc{
+		http.MethodGet: func(req *http.Request) (interface{}, error) {
+			return clientStats(), nil
+		},
+	})
+
+	s.Handle("/log", map[string]control.HandlerFunc{
+		http.MethodGet: func(req *http.Request) (interface{}, error) {
+			return &logLevel{Level: log.CurrentLevel().String()}, nil
+		},
+		http.MethodPut: func(req *http.Request) (interface{}, error) {
+			var l logLevel
+			err := control.Decode(req, &l)
+			if err != nil {
+				return nil, err
+			}
 
-			// Point to next port
-			nextTCPPort++
+			level, err := log.ParseLevel(l.Level)
+			if err != nil {
+				return nil, control.BadRequest(err)
+			}
+			log.SetLevel(level)
+			log.Infof("Set log level to %s\n", level)
+
+			return &l, nil
+		},
+	})
+
+	s.Handle("/ports", map[string]control.HandlerFunc{
+		http.MethodGet: func(req *http.Request) (interface{}, error) {
+			return listenPorts(), nil
+		},
+		http.MethodPost: func(req *http.Request) (interface{}, error) {
+			var p listenPort
+			err := control.Decode(req, &p)
+			if err != nil {
+				return nil, err
+			}
+			if p.Port <= 0 || p.Port > 65535 {
+				return nil, control.BadRequest(fmt.Errorf("port %d out of range", p.Port))
+			}
 
-			// Check if the port is alive
-			last := tcpPortPool[s]
-			if now.Sub(last) > keepAlive {
-				if !last.IsZero() {
-					log.Verbosef("Recycle %s port %d\n", t, 49152+s)
-				}
-				return 49152 + s, nil
+			err = addPort(uint16(p.Port))
+			if err != nil {
+				return nil, err
 			}
-		}
-	case layers.LayerTypeUDP:
-		for i := 0; i < 16384; i++ {
-			s := nextUDPPort % 16384
 
-			// Point to next port
-			nextUDPPort++
+			return listenPorts(), nil
+		},
+		http.MethodDelete: func(req *http.Request) (interface{}, error) {
+			p, err := strconv.Atoi(req.URL.Query().Get("port"))
+			if err != nil || p <= 0 || p > 65535 {
+				return nil, control.BadRequest(fmt.Errorf("invalid port %s", req.URL.Query().Get("port")))
+			}
 
-			// Check if the port is alive
-			last := udpPortPool[s]
-			if now.Sub(last) > keepAlive {
-				if !last.IsZero() {
-					log.Verbosef("Recycle %s port %d\n", t, 49152+s)
-				}
-				return 49152 + s, nil
+			err = removePort(uint16(p))
+			if err != nil {
+				return nil, err
 			}
-		}
-	case layers.LayerTypeICMPv4:
-		for i := 0; i < 65536; i++ {
-			s := nextICMPv4Id
 
-			// Point to next Id
-			nextICMPv4Id++
+			return listenPorts(), nil
+		},
+	})
 
-			// Check if the Id is alive
-			last := icmpv4IdPool[s]
-			if now.Sub(last) > keepAlive {
-				if !last.IsZero() {
-					log.Verbosef("Recycle %s ID %d\n", t, s)
-				}
-				return s, nil
+	s.Handle("/stats", map[string]control.HandlerFunc{
+		http.MethodGet: func(req *http.Request) (interface{}, error) {
+			var flowStats []stat.FlowStat
+			if flows != nil {
+				flowStats = flows.Stats()
 			}
-		}
-	default:
-		return 0, fmt.Errorf("transport layer type %s not support", t)
-	}
 
-	return 0, fmt.Errorf("%s pool empty", t)
+			clientsLock.RLock()
+			clients := len(clientConns)
+			clientsLock.RUnlock()
+
+			return &struct {
+				Name     string               `json:"name"`
+				Version  string               `json:"version"`
+				Time     int                  `json:"time"`
+				NAT      int                  `json:"nat"`
+				Clients  int                  `json:"clients"`
+				Replayed uint64               `json:"replayed"`
+				Refused  uint64               `json:"refused"`
+				TCP      nat.TCPStats         `json:"tcp"`
+				Capture  []pcap.CaptureStats  `json:"capture"`
+				Flows    []stat.FlowStat      `json:"flows,omitempty"`
+				Monitor  *stat.TrafficMonitor `json:"monitor,omitempty"`
+			}{
+				Name:     name,
+				Version:  versionInfo,
+				Time:     int(time.Now().Sub(startTime).Seconds()),
+				NAT:      natMap.Len(),
+				Clients:  clients,
+				Replayed: crypto.Replayed(),
+				Refused:  pcap.Refused(),
+				TCP:      nat.AllTCPStats(),
+				Capture:  pcap.AllCaptureStats(),
+				Flows:    flowStats,
+				Monitor:  monitor,
+			}, nil
+		},
+	})
 }
 
-func convertFromPort(port uint16) uint16 {
-	return port - 49152
+// logLevel describes the level of logging in the control API.
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+// listenPort describes a listen port in the control API.
+type listenPort struct {
+	Port int `json:"port"`
 }
 
 func splitArg(s string) []string {
@@ -1249,3 +4365,74 @@ func splitArg(s string) []string {
 
 	return result
 }
+
+// checkOffloads warns if offloading is enabled in devices and super-frames produced by it will be truncated.
+func checkOffloads(devs ...*pcap.Device) {
+	if pcap.SnapLen() >= pcap.IPv4MaxSize {
+		return
+	}
+
+	for _, dev := range devs {
+		if dev.IsLoop() {
+			continue
+		}
+
+		features, err := exec.DetectOffloads(dev.Name())
+		if err != nil {
+			log.Verboseln(fmt.Errorf("detect offloads of device %s: %w", dev.Alias(), err))
+			continue
+		}
+		if len(features) > 0 {
+			log.Warnf("Device %s enables %s, whose super-frames will be truncated. You may disable them by ethtool "+
+				"-K %s tso off gso off gro off lro off, or enlarge the snap length\n",
+				dev.Alias(), strings.Join(features, ", "), dev.Name())
+		}
+	}
+}
+
+// service installs, uninstalls or prints the unit of the service running with the same arguments.
+func service(action string) error {
+	args, err := daemon.Args("service", "c", "log", "log-file", "dump")
+	if err != nil {
+		return fmt.Errorf("parse arguments: %w", err)
+	}
+	if len(args) <= 0 && *argConfig != "" {
+		path, err := filepath.Abs(*argConfig)
+		if err != nil {
+			return fmt.Errorf("abs %s: %w", *argConfig, err)
+		}
+		args = []string{"-c", path}
+	}
+
+	cfg := &daemon.Config{
+		Name:        strings.ToLower(name),
+		Description: "IkaGo server",
+		Args:        args,
+		Reload:      false,
+	}
+
+	switch action {
+	case "install":
+		err := daemon.Install(cfg)
+		if err != nil {
+			return fmt.Errorf("install: %w", err)
+		}
+		log.Infof("Install service %s\n", cfg.Name)
+	case "uninstall":
+		err := daemon.Uninstall(cfg.Name)
+		if err != nil {
+			return fmt.Errorf("uninstall: %w", err)
+		}
+		log.Infof("Uninstall service %s\n", cfg.Name)
+	case "unit":
+		unit, err := daemon.SystemdUnit(cfg)
+		if err != nil {
+			return fmt.Errorf("create unit: %w", err)
+		}
+		fmt.Print(unit)
+	default:
+		return fmt.Errorf("action %s not support", action)
+	}
+
+	return nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"ikago/internal/nat"
+	"ikago/internal/pcap"
+	"ikago/internal/shape"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	testServerHW  = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	testGatewayHW = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+	testServerIP  = net.IPv4(203, 0, 113, 1).To4()
+	testSourceIP  = net.IPv4(10, 0, 0, 2).To4()
+	testRemoteIP  = net.IPv4(1, 1, 1, 1).To4()
+)
+
+// recordConn is a connection from a client which records data written to it.
+type recordConn struct {
+	net.Conn
+	addr *net.TCPAddr
+	lock sync.Mutex
+	out  [][]byte
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	data := make([]byte, len(b))
+	copy(data, b)
+	c.out = append(c.out, data)
+
+	return len(b), nil
+}
+
+func (c *recordConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *recordConn) take() [][]byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	result := c.out
+	c.out = nil
+
+	return result
+}
+
+// setup resets the state of the server to route upstream in memory.
+func setup() *pcap.MemConn {
+	srcDev := pcap.NewDevice("eth0", []*net.IPNet{
+		{IP: testServerIP, Mask: net.CIDRMask(24, 32)},
+	}, testServerHW, false)
+	dstDev := pcap.NewDevice("gateway", nil, testGatewayHW, false)
+	conn := pcap.NewMemConn(srcDev, dstDev, layers.LinkTypeEthernet)
+
+	upConn = conn
+	limiter = shape.NewLimiter(0, 0)
+	natBehavior = nat.BehaviorFullCone
+	natMap = nat.NewTable(keepAlive, 0)
+	patMaps = make(map[string]*nat.Table)
+	filterMap = nil
+	loopGuard = pcap.NewLoopGuard(keepInjected)
+	defrag = pcap.NewEasyDefragmenter()
+	embDefrag = pcap.NewEasyDefragmenter()
+	tcpPortPool = make([]time.Time, 16384)
+	nextTCPPort = 0
+
+	return conn
+}
+
+// clientOf returns the connection of the i-th client.
+func clientOf(i int) *recordConn {
+	return &recordConn{addr: &net.TCPAddr{IP: net.IPv4(198, 51, 100, byte(1+i)).To4(), Port: 40000}}
+}
+
+// tcpPacket returns the network data of a TCP segment.
+func tcpPacket(t *testing.T, src, dst net.IP, srcPort, dstPort uint16, payload []byte) []byte {
+	ipv4Layer := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    src,
+		DstIP:    dst,
+	}
+	tcpLayer := &layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		Seq:     1,
+		Ack:     1,
+		ACK:     true,
+		PSH:     true,
+		Window:  65535,
+	}
+	err := tcpLayer.SetNetworkLayerForChecksum(ipv4Layer)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+
+	data, err := pcap.Serialize(ipv4Layer, tcpLayer, gopacket.Payload(payload))
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+
+	return data
+}
+
+// replyTo returns the frame from the gateway replying the frame routed upstream, with the payload.
+func replyTo(t *testing.T, frame []byte, payload []byte) gopacket.Packet {
+	packet := gopacket.NewPacket(frame, layers.LinkTypeEthernet, gopacket.Default)
+	ipv4Layer := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	tcpLayer := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+
+	network := tcpPacket(t, ipv4Layer.DstIP, ipv4Layer.SrcIP, uint16(tcpLayer.DstPort), uint16(tcpLayer.SrcPort), payload)
+	ethernetLayer := &layers.Ethernet{
+		SrcMAC:       testGatewayHW,
+		DstMAC:       testServerHW,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	data, err := pcap.SerializeRaw(ethernetLayer, gopacket.Payload(network))
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+
+	return gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.Default)
+}
+
+func TestHandleConcurrently(t *testing.T) {
+	const (
+		clients = 8
+		flows   = 16
+	)
+
+	conn := setup()
+
+	conns := make([]*recordConn, clients)
+	for i := range conns {
+		conns[i] = clientOf(i)
+	}
+
+	// Clients send from the same sources at the same time
+	var wg sync.WaitGroup
+	for i := range conns {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < flows; j++ {
+				payload := []byte(fmt.Sprintf("request %d %d", i, j))
+				err := handleListen(tcpPacket(t, testSourceIP, testRemoteIP, uint16(40000+j), 80, payload), conns[i])
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	frames := conn.Take()
+	if len(frames) != clients*flows {
+		t.Fatalf("routed %d packets, expected %d", len(frames), clients*flows)
+	}
+
+	// Each flow is mapped to its own port
+	ports := make(map[layers.TCPPort]bool)
+	for _, frame := range frames {
+		packet := gopacket.NewPacket(frame, layers.LinkTypeEthernet, gopacket.Default)
+		port := packet.Layer(layers.LayerTypeTCP).(*layers.TCP).SrcPort
+		if ports[port] {
+			t.Fatalf("port %d distributed twice", port)
+		}
+		ports[port] = true
+	}
+
+	// Replies are routed back at the same time
+	for _, frame := range frames {
+		wg.Add(1)
+		go func(frame []byte) {
+			defer wg.Done()
+
+			packet := gopacket.NewPacket(frame, layers.LinkTypeEthernet, gopacket.Default)
+			payload := bytes.Replace(packet.ApplicationLayer().Payload(), []byte("request"), []byte("reply"), 1)
+			err := handleUpstream(replyTo(t, frame, payload))
+			if err != nil {
+				t.Error(err)
+			}
+		}(frame)
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	for i, c := range conns {
+		out := c.take()
+		if len(out) != flows {
+			t.Fatalf("client %d received %d replies, expected %d", i, len(out), flows)
+		}
+
+		for _, data := range out {
+			packet := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default)
+			ipv4Layer := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+			tcpLayer := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+			if !ipv4Layer.DstIP.Equal(testSourceIP) {
+				t.Fatalf("replied to %s, expected %s", ipv4Layer.DstIP, testSourceIP)
+			}
+
+			j := int(tcpLayer.DstPort) - 40000
+			expected := fmt.Sprintf("reply %d %d", i, j)
+			if string(tcpLayer.Payload) != expected {
+				t.Fatalf("client %d received %q, expected %q", i, tcpLayer.Payload, expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+#!/bin/sh
+# End-to-end test of IkaGo in network namespaces connected by veth pairs, which requires root in Linux.
+#
+#   source 10.0.1.2 --- 10.0.1.1 client 10.0.2.1 --- 10.0.2.2 server 10.0.3.1 --- 10.0.3.2 destination
+#
+# The client proxies the source to the server, and the server proxies it to the destination. TCP and UDP traffic is
+# echoed by the destination, and the payload, the order and the address translated by the server are verified.
+# Additional arguments are passed to both the client and the server, like ./e2e.sh -method aes-128-gcm -password p.
+
+set -eu
+
+NS_SRC=ikago-e2e-src
+NS_CLIENT=ikago-e2e-client
+NS_SERVER=ikago-e2e-server
+NS_DST=ikago-e2e-dst
+PORT=18081
+WORK=$(mktemp -d)
+
+cleanup() {
+	for pid in $(cat "$WORK"/*.pid 2>/dev/null); do
+		kill "$pid" 2>/dev/null || true
+	done
+	for ns in $NS_SRC $NS_CLIENT $NS_SERVER $NS_DST; do
+		ip netns del $ns 2>/dev/null || true
+	done
+	rm -rf "$WORK"
+}
+trap cleanup EXIT
+
+fail() {
+	echo "FAIL: $1"
+	for log in "$WORK"/*.log; do
+		echo "--- $log"
+		cat "$log"
+	done
+	exit 1
+}
+
+# Build
+go build -o "$WORK/ikago-client" ./cmd/ikago-client
+go build -o "$WORK/ikago-server" ./cmd/ikago-server
+
+# Topology
+for ns in $NS_SRC $NS_CLIENT $NS_SERVER $NS_DST; do
+	ip netns add $ns
+	ip -n $ns link set lo up
+done
+
+link() {
+	ip link add "$2" netns "$1" type veth peer name "$4" netns "$3"
+	ip -n "$1" link set "$2" up
+	ip -n "$3" link set "$4" up
+}
+link $NS_SRC src0 $NS_CLIENT cli0
+link $NS_CLIENT cli1 $NS_SERVER srv0
+link $NS_SERVER srv1 $NS_DST dst0
+
+ip -n $NS_SRC addr add 10.0.1.2/24 dev src0
+ip -n $NS_CLIENT addr add 10.0.1.1/24 dev cli0
+ip -n $NS_CLIENT addr add 10.0.2.1/24 dev cli1
+ip -n $NS_SERVER addr add 10.0.2.2/24 dev srv0
+ip -n $NS_SERVER addr add 10.0.3.1/24 dev srv1
+ip -n $NS_DST addr add 10.0.3.2/24 dev dst0
+ip -n $NS_SRC route add default via 10.0.1.1
+
+# Offloading produces super-frames in veth
+disable_offloads() {
+	ip netns exec "$1" ethtool -K "$2" tso off gso off gro off >/dev/null 2>&1 || true
+}
+disable_offloads $NS_SRC src0
+disable_offloads $NS_CLIENT cli0
+disable_offloads $NS_CLIENT cli1
+disable_offloads $NS_SERVER srv0
+disable_offloads $NS_SERVER srv1
+disable_offloads $NS_DST dst0
+
+# Destination echoes TCP and UDP with the address it sees
+cat > "$WORK/dst.py" <<'EOF'
+import socket, threading
+
+def tcp(conn, addr):
+    conn.sendall((addr[0] + "\n").encode())
+    while True:
+        b = conn.recv(65536)
+        if not b:
+            break
+        conn.sendall(b)
+    conn.close()
+
+def tcp_server():
+    s = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
+    s.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+    s.bind(("10.0.3.2", 8080))
+    s.listen(16)
+    while True:
+        conn, addr = s.accept()
+        threading.Thread(target=tcp, args=(conn, addr), daemon=True).start()
+
+def udp_server():
+    s = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+    s.bind(("10.0.3.2", 8081))
+    while True:
+        b, addr = s.recvfrom(65536)
+        s.sendto(addr[0].encode() + b"|" + b, addr)
+
+threading.Thread(target=tcp_server, daemon=True).start()
+udp_server()
+EOF
+
+# Source pushes traffic and verifies echoes
+cat > "$WORK/src.py" <<'EOF'
+import hashlib, os, socket, sys, threading
+
+expected = sys.argv[1]
+
+# TCP: integrity and address translation
+s = socket.create_connection(("10.0.3.2", 8080), timeout=10)
+f = s.makefile("rb")
+peer = f.readline().decode().strip()
+assert peer == expected, "tcp peer %s, expected %s" % (peer, expected)
+data = os.urandom(4 * 1024 * 1024)
+threading.Thread(target=lambda: s.sendall(data), daemon=True).start()
+received = f.read(len(data))
+assert hashlib.sha256(received).digest() == hashlib.sha256(data).digest(), "tcp payload mismatch"
+s.close()
+print("tcp ok: %d Bytes" % len(data))
+
+# UDP: integrity, order and address translation
+u = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+u.settimeout(5)
+count = 200
+payloads = [i.to_bytes(4, "big") + os.urandom(1000) for i in range(count)]
+for p in payloads:
+    u.sendto(p, ("10.0.3.2", 8081))
+last = -1
+for i in range(count):
+    b, _ = u.recvfrom(65536)
+    peer, p = b.split(b"|", 1)
+    assert peer.decode() == expected, "udp peer %s, expected %s" % (peer.decode(), expected)
+    seq = int.from_bytes(p[:4], "big")
+    assert seq > last, "udp datagram %d after %d" % (seq, last)
+    assert p == payloads[seq], "udp payload %d mismatch" % seq
+    last = seq
+print("udp ok: %d datagrams" % count)
+EOF
+
+ip netns exec $NS_DST python3 "$WORK/dst.py" > "$WORK/dst.log" 2>&1 &
+echo $! > "$WORK/dst.pid"
+
+ip netns exec $NS_SERVER "$WORK/ikago-server" -listen-devices srv0 -upstream-device srv1 -gateway 10.0.3.2 \
+	-p $PORT -rule -v "$@" > "$WORK/server.log" 2>&1 &
+echo $! > "$WORK/server.pid"
+sleep 1
+
+ip netns exec $NS_CLIENT "$WORK/ikago-client" -listen-devices cli0 -upstream-device cli1 -gateway 10.0.2.2 \
+	-r 10.0.1.2 -s 10.0.2.2:$PORT -rule -v "$@" > "$WORK/client.log" 2>&1 &
+echo $! > "$WORK/client.pid"
+sleep 2
+
+for pid in $(cat "$WORK"/*.pid); do
+	kill -0 "$pid" 2>/dev/null || fail "process exited early"
+done
+
+ip netns exec $NS_SRC timeout 60 python3 "$WORK/src.py" 10.0.3.1 || fail "traffic"
+
+echo "PASS"
@@ -0,0 +1,45 @@
+// +build e2e
+
+package ikago_test
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// TestE2E runs e2e.sh with each set of arguments, which requires root in Linux.
+//
+//	sudo -E env "PATH=$PATH" go test -tags e2e -v .
+func TestE2E(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("os %s not support", runtime.GOOS)
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("root required")
+	}
+
+	tests := [][]string{
+		nil,
+		{"-method", "aes-128-gcm", "-password", "ikago"},
+		{"-mode", "kcp"},
+	}
+	for _, args := range tests {
+		name := strings.Join(args, " ")
+		if name == "" {
+			name = "plain"
+		}
+
+		// Namespaces of the script are fixed, so it runs one at a time
+		t.Run(name, func(t *testing.T) {
+			cmd := exec.Command("./e2e.sh", args...)
+			out, err := cmd.CombinedOutput()
+			t.Logf("%s", out)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
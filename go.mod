@@ -1,12 +1,13 @@
 module ikago
 
-go 1.13
+go 1.16
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/google/gopacket v1.1.17
 	github.com/jackpal/gateway v1.0.6-0.20191118043651-5ceb358a720e
 	github.com/klauspost/cpuid v1.2.3 // indirect
-	github.com/klauspost/reedsolomon v1.9.3 // indirect
+	github.com/klauspost/reedsolomon v1.9.3
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/templexxx/cpufeat v0.0.0-20180724012125-cef66df7f161 // indirect
 	github.com/templexxx/xor v0.0.0-20191217153810-f85b25db303b // indirect
@@ -14,4 +15,7 @@ require (
 	github.com/xtaci/kcp-go v5.4.20+incompatible
 	github.com/xtaci/lossyconn v0.0.0-20200209145036-adba10fffc37 // indirect
 	golang.org/x/crypto v0.0.0-20191219195013-becbf705a915
+	golang.org/x/net v0.0.0-20190404232315-eb5bcb51f2a3
+	golang.org/x/sys v0.0.0-20190412213103-97732733099d
+	gopkg.in/yaml.v2 v2.4.0
 )
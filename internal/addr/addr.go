@@ -22,6 +22,20 @@ func (addr ICMPQueryAddr) Network() string {
 	return "icmp query"
 }
 
+// IPProtocolAddr represents the address of an end point of an IP protocol without ports, like GRE, ESP, SCTP and OSPF.
+type IPProtocolAddr struct {
+	IP       net.IP
+	Protocol uint8
+}
+
+func (addr IPProtocolAddr) String() string {
+	return fmt.Sprintf("%s#%d", formatIP(addr.IP), addr.Protocol)
+}
+
+func (addr IPProtocolAddr) Network() string {
+	return "ip"
+}
+
 // MultiTCPAddr represents multiple TCP addresses.
 type MultiTCPAddr struct {
 	Addrs []*net.TCPAddr
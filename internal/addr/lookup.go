@@ -0,0 +1,155 @@
+package addr
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// resolvConf is the configuration file of the resolver which lists name servers.
+	resolvConf = "/etc/resolv.conf"
+	// lookupTimeout is the timeout of querying a name server.
+	lookupTimeout = 3 * time.Second
+	// DefaultTTL is the TTL of IPs looked up by the resolver of the OS, which does not report TTLs.
+	DefaultTTL = time.Minute
+)
+
+// LookupIPTTL returns IPs of the host and the min TTL of their records. Name servers in the configuration of the
+// resolver are queried directly, and the resolver of the OS is used with the default TTL if they are not available,
+// like in Windows.
+func LookupIPTTL(host string) ([]net.IP, time.Duration, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, 0, nil
+	}
+
+	servers := nameServers()
+	for _, server := range servers {
+		ips, ttl, err := queryIP(server, host)
+		if err != nil {
+			continue
+		}
+
+		return ips, ttl, nil
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, 0, fmt.Errorf("lookup: %w", err)
+	}
+
+	return ips, DefaultTTL, nil
+}
+
+// nameServers returns name servers in the configuration of the resolver.
+func nameServers() []string {
+	f, err := os.Open(resolvConf)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	result := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		// Scoped IPv6 addresses are kept as is
+		if net.ParseIP(strings.SplitN(fields[1], "%", 2)[0]) == nil {
+			continue
+		}
+		result = append(result, net.JoinHostPort(fields[1], "53"))
+	}
+
+	return result
+}
+
+// queryIP returns IPs in A and AAAA records of the host and their min TTL by querying the name server.
+func queryIP(server, host string) ([]net.IP, time.Duration, error) {
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return nil, 0, fmt.Errorf("dial %s: %w", server, err)
+	}
+	defer conn.Close()
+
+	var (
+		ips []net.IP
+		ttl uint32
+	)
+	for _, t := range []layers.DNSType{layers.DNSTypeA, layers.DNSTypeAAAA} {
+		var id uint16
+		err := binary.Read(rand.Reader, binary.BigEndian, &id)
+		if err != nil {
+			return nil, 0, fmt.Errorf("generate id: %w", err)
+		}
+		request := &layers.DNS{
+			ID:      id,
+			RD:      true,
+			OpCode:  layers.DNSOpCodeQuery,
+			QDCount: 1,
+			Questions: []layers.DNSQuestion{{
+				Name:  []byte(host),
+				Type:  t,
+				Class: layers.DNSClassIN,
+			}},
+		}
+		b := gopacket.NewSerializeBuffer()
+		err = request.SerializeTo(b, gopacket.SerializeOptions{FixLengths: true})
+		if err != nil {
+			return nil, 0, fmt.Errorf("serialize: %w", err)
+		}
+
+		err = conn.SetDeadline(time.Now().Add(lookupTimeout))
+		if err != nil {
+			return nil, 0, fmt.Errorf("set deadline: %w", err)
+		}
+		_, err = conn.Write(b.Bytes())
+		if err != nil {
+			return nil, 0, fmt.Errorf("write: %w", err)
+		}
+
+		var response layers.DNS
+		buffer := make([]byte, 1500)
+		for {
+			n, err := conn.Read(buffer)
+			if err != nil {
+				return nil, 0, fmt.Errorf("read: %w", err)
+			}
+
+			err = response.DecodeFromBytes(buffer[:n], gopacket.NilDecodeFeedback)
+			if err != nil || !response.QR || response.ID != id {
+				continue
+			}
+			break
+		}
+		if response.ResponseCode != layers.DNSResponseCodeNoErr {
+			return nil, 0, fmt.Errorf("response %s", response.ResponseCode)
+		}
+
+		for _, answer := range response.Answers {
+			if answer.Type != t || answer.IP == nil {
+				continue
+			}
+			ips = append(ips, answer.IP)
+			if ttl == 0 || answer.TTL < ttl {
+				ttl = answer.TTL
+			}
+		}
+	}
+	if len(ips) <= 0 {
+		return nil, 0, errors.New("no record")
+	}
+
+	return ips, time.Duration(ttl) * time.Second, nil
+}
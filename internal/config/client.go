@@ -0,0 +1,11 @@
+package config
+
+// ClientConfig describes the configuration of a client identified by its Id in the server.
+type ClientConfig struct {
+	AllowedPorts []int  `json:"allowed-ports" toml:"allowed-ports" yaml:"allowed-ports"`
+	Limit        string `json:"limit" toml:"limit" yaml:"limit"`
+	IdleTimeout  int    `json:"idle-timeout" toml:"idle-timeout" yaml:"idle-timeout"`
+	PortRange    string `json:"port-range" toml:"port-range" yaml:"port-range"`
+	UpDev        string `json:"upstream-device" toml:"upstream-device" yaml:"upstream-device"`
+	UpIP         string `json:"upstream-ip" toml:"upstream-ip" yaml:"upstream-ip"`
+}
@@ -5,104 +5,283 @@
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 )
 
 // Config describes the configuration of IkaGo.
 type Config struct {
-	ListenDevs []string  `json:"listen-devices"`
-	UpDev      string    `json:"upstream-device"`
-	Gateway    string    `json:"gateway"`
-	Mode       string    `json:"mode"`
-	Method     string    `json:"method"`
-	Password   string    `json:"password"`
-	Rule       bool      `json:"rule"`
-	Verbose    bool      `json:"verbose"`
-	Log        string    `json:"log"`
-	Monitor    int       `json:"monitor"`
-	MTU        int       `json:"mtu"`
-	KCP        bool      `json:"kcp"`
-	KCPConfig  KCPConfig `json:"kcp-tuning"`
-	Port       int       `json:"port"`
-	Publish    string    `json:"publish"`
-	Sources    []string  `json:"sources"`
-	Server     string    `json:"server"`
+	Backend        string                  `json:"backend" toml:"backend" yaml:"backend"`
+	Route          bool                    `json:"route" toml:"route" yaml:"route"`
+	ListenDevs     []string                `json:"listen-devices" toml:"listen-devices" yaml:"listen-devices"`
+	UpDev          string                  `json:"upstream-device" toml:"upstream-device" yaml:"upstream-device"`
+	UpIP           string                  `json:"upstream-ip" toml:"upstream-ip" yaml:"upstream-ip"`
+	MulticastDev   string                  `json:"multicast-device" toml:"multicast-device" yaml:"multicast-device"`
+	Multicast      bool                    `json:"multicast" toml:"multicast" yaml:"multicast"`
+	Gateway        string                  `json:"gateway" toml:"gateway" yaml:"gateway"`
+	StaticMAC      []string                `json:"static-mac" toml:"static-mac" yaml:"static-mac"`
+	Paths          []string                `json:"paths" toml:"paths" yaml:"paths"`
+	Multipath      string                  `json:"multipath" toml:"multipath" yaml:"multipath"`
+	VLAN           int                     `json:"vlan" toml:"vlan" yaml:"vlan"`
+	PPPoE          bool                    `json:"pppoe" toml:"pppoe" yaml:"pppoe"`
+	Filter         string                  `json:"filter" toml:"filter" yaml:"filter"`
+	PreserveTTL    bool                    `json:"preserve-ttl" toml:"preserve-ttl" yaml:"preserve-ttl"`
+	Mode           string                  `json:"mode" toml:"mode" yaml:"mode"`
+	Method         string                  `json:"method" toml:"method" yaml:"method"`
+	Password       string                  `json:"password" toml:"password" yaml:"password"`
+	Obfs           string                  `json:"obfs" toml:"obfs" yaml:"obfs"`
+	IPId           string                  `json:"ip-id" toml:"ip-id" yaml:"ip-id"`
+	TTL            int                     `json:"ttl" toml:"ttl" yaml:"ttl"`
+	TCPWindow      int                     `json:"tcp-window" toml:"tcp-window" yaml:"tcp-window"`
+	TCPMSS         int                     `json:"tcp-mss" toml:"tcp-mss" yaml:"tcp-mss"`
+	TCPWindowScale int                     `json:"tcp-window-scale" toml:"tcp-window-scale" yaml:"tcp-window-scale"`
+	TCPTimestamps  bool                    `json:"tcp-timestamps" toml:"tcp-timestamps" yaml:"tcp-timestamps"`
+	CopyToS        string                  `json:"copy-tos" toml:"copy-tos" yaml:"copy-tos"`
+	ClampMSS       bool                    `json:"clamp-mss" toml:"clamp-mss" yaml:"clamp-mss"`
+	ClampWindow    bool                    `json:"clamp-window" toml:"clamp-window" yaml:"clamp-window"`
+	Rule           bool                    `json:"rule" toml:"rule" yaml:"rule"`
+	Verbose        bool                    `json:"verbose" toml:"verbose" yaml:"verbose"`
+	Log            string                  `json:"log" toml:"log" yaml:"log"`
+	LogJSON        bool                    `json:"log-json" toml:"log-json" yaml:"log-json"`
+	LogQuiet       bool                    `json:"log-quiet" toml:"log-quiet" yaml:"log-quiet"`
+	LogSample      int                     `json:"log-sample" toml:"log-sample" yaml:"log-sample"`
+	LogFlows       bool                    `json:"log-flows" toml:"log-flows" yaml:"log-flows"`
+	Color          string                  `json:"color" toml:"color" yaml:"color"`
+	Status         int                     `json:"status" toml:"status" yaml:"status"`
+	IPFIX          string                  `json:"ipfix" toml:"ipfix" yaml:"ipfix"`
+	Dump           string                  `json:"dump" toml:"dump" yaml:"dump"`
+	SnapLen        int                     `json:"snap-len" toml:"snap-len" yaml:"snap-len"`
+	Monitor        int                     `json:"monitor" toml:"monitor" yaml:"monitor"`
+	Control        string                  `json:"control" toml:"control" yaml:"control"`
+	ControlToken   string                  `json:"control-token" toml:"control-token" yaml:"control-token"`
+	Pprof          string                  `json:"pprof" toml:"pprof" yaml:"pprof"`
+	Stats          int                     `json:"stats" toml:"stats" yaml:"stats"`
+	Batch          int                     `json:"batch" toml:"batch" yaml:"batch"`
+	BatchInterval  int                     `json:"batch-interval" toml:"batch-interval" yaml:"batch-interval"`
+	Workers        int                     `json:"workers" toml:"workers" yaml:"workers"`
+	Frame          bool                    `json:"frame" toml:"frame" yaml:"frame"`
+	Id             string                  `json:"id" toml:"id" yaml:"id"`
+	Key            string                  `json:"key" toml:"key" yaml:"key"`
+	Limit          string                  `json:"limit" toml:"limit" yaml:"limit"`
+	LimitPerFlow   string                  `json:"limit-per-flow" toml:"limit-per-flow" yaml:"limit-per-flow"`
+	Priority       []string                `json:"priority" toml:"priority" yaml:"priority"`
+	Hooks          []string                `json:"hooks" toml:"hooks" yaml:"hooks"`
+	MTU            int                     `json:"mtu" toml:"mtu" yaml:"mtu"`
+	MTUDiscovery   int                     `json:"mtu-discovery" toml:"mtu-discovery" yaml:"mtu-discovery"`
+	ReorderWindow  int                     `json:"reorder-window" toml:"reorder-window" yaml:"reorder-window"`
+	ReorderTimeout int                     `json:"reorder-timeout" toml:"reorder-timeout" yaml:"reorder-timeout"`
+	FECDataShard   int                     `json:"fec-datashard" toml:"fec-datashard" yaml:"fec-datashard"`
+	FECParityShard int                     `json:"fec-parityshard" toml:"fec-parityshard" yaml:"fec-parityshard"`
+	Pacing         bool                    `json:"pacing" toml:"pacing" yaml:"pacing"`
+	KCP            bool                    `json:"kcp" toml:"kcp" yaml:"kcp"`
+	KCPConfig      KCPConfig               `json:"kcp-tuning" toml:"kcp-tuning" yaml:"kcp-tuning"`
+	PcapConfig     PcapConfig              `json:"pcap-tuning" toml:"pcap-tuning" yaml:"pcap-tuning"`
+	WebSocket      WebSocketConfig         `json:"websocket" toml:"websocket" yaml:"websocket"`
+	Port           int                     `json:"port" toml:"port" yaml:"port"`
+	Hop            int                     `json:"hop" toml:"hop" yaml:"hop"`
+	HopPorts       int                     `json:"hop-ports" toml:"hop-ports" yaml:"hop-ports"`
+	Rekey          int                     `json:"rekey" toml:"rekey" yaml:"rekey"`
+	RekeySize      int                     `json:"rekey-size" toml:"rekey-size" yaml:"rekey-size"`
+	Strict         bool                    `json:"strict" toml:"strict" yaml:"strict"`
+	AntiReplay     bool                    `json:"anti-replay" toml:"anti-replay" yaml:"anti-replay"`
+	Allow          []string                `json:"allow" toml:"allow" yaml:"allow"`
+	Deny           []string                `json:"deny" toml:"deny" yaml:"deny"`
+	NAT            string                  `json:"nat" toml:"nat" yaml:"nat"`
+	PreservePort   bool                    `json:"preserve-port" toml:"preserve-port" yaml:"preserve-port"`
+	Translate      string                  `json:"translate" toml:"translate" yaml:"translate"`
+	NATMaxEntries  int                     `json:"nat-max-entries" toml:"nat-max-entries" yaml:"nat-max-entries"`
+	ClientMaxConns int                     `json:"client-max-connections" toml:"client-max-connections" yaml:"client-max-connections"`
+	CloseTimeout   int                     `json:"close-timeout" toml:"close-timeout" yaml:"close-timeout"`
+	HalfOpenTTL    int                     `json:"half-open-timeout" toml:"half-open-timeout" yaml:"half-open-timeout"`
+	EstablishedTTL int                     `json:"established-timeout" toml:"established-timeout" yaml:"established-timeout"`
+	Resume         bool                    `json:"resume" toml:"resume" yaml:"resume"`
+	State          string                  `json:"state" toml:"state" yaml:"state"`
+	User           string                  `json:"user" toml:"user" yaml:"user"`
+	Users          string                  `json:"users" toml:"users" yaml:"users"`
+	Usage          string                  `json:"usage" toml:"usage" yaml:"usage"`
+	Clients        map[string]ClientConfig `json:"clients" toml:"clients" yaml:"clients"`
+	Forwards       []ForwardConfig         `json:"forwards" toml:"forwards" yaml:"forwards"`
+	Publish        string                  `json:"publish" toml:"publish" yaml:"publish"`
+	Sources        []string                `json:"sources" toml:"sources" yaml:"sources"`
+	Server         string                  `json:"server" toml:"server" yaml:"server"`
 }
 
 // NewConfig returns a new config.
 func NewConfig() *Config {
 	return &Config{
-		Mode:      "faketcp",
-		Method:    "plain",
-		KCPConfig: *NewKCPConfig(),
-		Sources:   make([]string, 0),
+		Backend:        "pcap",
+		Paths:          make([]string, 0),
+		Hooks:          make([]string, 0),
+		Multipath:      "stripe",
+		Mode:           "faketcp",
+		Method:         "plain",
+		Obfs:           "none",
+		IPId:           "random",
+		TCPWindow:      65535,
+		LogSample:      1,
+		Color:          "auto",
+		Status:         1,
+		SnapLen:        1600,
+		BatchInterval:  1,
+		Workers:        1,
+		ReorderTimeout: 50,
+		FECParityShard: 3,
+		KCPConfig:      *NewKCPConfig(),
+		PcapConfig:     *NewPcapConfig(),
+		WebSocket:      *NewWebSocketConfig(),
+		HopPorts:       1024,
+		NAT:            "full-cone",
+		NATMaxEntries:  65536,
+		Clients:        make(map[string]ClientConfig),
+		Forwards:       make([]ForwardConfig, 0),
+		Sources:        make([]string, 0),
 	}
 }
 
-// ParseFile returns the config parsed from file.
+// ParseFile returns the config parsed from file. Files with extension .toml are parsed as TOML, files with extension
+// .yaml or .yml are parsed as YAML, and others are parsed as JSON.
 func ParseFile(path string) (*Config, error) {
 	config := NewConfig()
 
+	err := parseFile(path, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// parseFile unmarshals the file into the value. Files with extension .toml are parsed as TOML, files with extension
+// .yaml or .yml are parsed as YAML, and others are parsed as JSON.
+func parseFile(path string, v interface{}) error {
 	// Open file
 	file, err := os.Open(path)
 	if err != nil {
-		return nil, fmt.Errorf("open: %w", err)
+		return fmt.Errorf("open: %w", err)
 	}
+	defer file.Close()
 
 	fi, err := file.Stat()
 	if err != nil {
-		return nil, fmt.Errorf("stat: %w", err)
+		return fmt.Errorf("stat: %w", err)
 	}
 
 	// Empty file
 	size := fi.Size()
 	if size == 0 {
-		return nil, errors.New("empty file")
+		return errors.New("empty file")
 	}
 
 	// Read file
 	buffer := make([]byte, size)
 	_, err = file.Read(buffer)
 	if err != nil {
-		return nil, fmt.Errorf("read: %w", err)
+		return fmt.Errorf("read: %w", err)
 	}
 
 	// Trim comments
 	buffer, err = trimComments(buffer)
 	if err != nil {
-		return nil, fmt.Errorf("trim comments: %w", err)
+		return fmt.Errorf("trim comments: %w", err)
 	}
 
 	// Expand environment variables
 	buffer = []byte(os.ExpandEnv(string(buffer)))
 
 	// Unmarshal
-	err = json.Unmarshal(buffer, config)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		err = unmarshalTOML(buffer, v)
+	case ".yaml", ".yml":
+		err = unmarshalYAML(buffer, v)
+	default:
+		err = unmarshalJSON(buffer, v)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("unmarshal: %w", err)
+		return fmt.Errorf("unmarshal: %w", err)
 	}
 
-	return config, nil
+	return nil
+}
+
+func unmarshalJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(v)
+	if err != nil {
+		var (
+			syntaxError    *json.SyntaxError
+			unmarshalError *json.UnmarshalTypeError
+		)
+
+		if errors.As(err, &syntaxError) {
+			line, col := position(data, syntaxError.Offset)
+			return fmt.Errorf("line %d column %d: %w", line, col, err)
+		}
+		if errors.As(err, &unmarshalError) {
+			line, col := position(data, unmarshalError.Offset)
+			return fmt.Errorf("line %d column %d: field %s expects %s but got %s", line, col, unmarshalError.Field, unmarshalError.Type, unmarshalError.Value)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func unmarshalTOML(data []byte, v interface{}) error {
+	md, err := toml.Decode(string(data), v)
+	if err != nil {
+		return err
+	}
+
+	undecoded := md.Undecoded()
+	if len(undecoded) > 0 {
+		return fmt.Errorf("unknown field %s", undecoded[0])
+	}
+
+	return nil
+}
+
+func unmarshalYAML(data []byte, v interface{}) error {
+	// Unknown fields are rejected like in JSON and TOML
+	return yaml.UnmarshalStrict(data, v)
+}
+
+func position(data []byte, offset int64) (line, col int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+
+	line = 1 + bytes.Count(data[:offset], []byte("\n"))
+	col = int(offset) - bytes.LastIndex(data[:offset], []byte("\n"))
+
+	return line, col
 }
 
+// trimComments blanks lines of comments starting with #. Lines are kept empty rather than removed, so positions in the
+// trimmed data map back to the original file.
 func trimComments(data []byte) ([]byte, error) {
 	// Windows CRLF to Unix LF
 	data = bytes.Replace(data, []byte("\r"), []byte(""), 0)
 
 	lines := bytes.Split(data, []byte("\n"))
 
-	filtered := make([][]byte, 0)
-	for _, line := range lines {
+	for i, line := range lines {
 		match, err := regexp.Match(`^\s*#`, line)
 		if err != nil {
 			return nil, fmt.Errorf("match: %w", err)
 		}
 
-		if !match {
-			filtered = append(filtered, line)
+		if match {
+			lines[i] = nil
 		}
 	}
 
-	return bytes.Join(filtered, []byte("\n")), nil
+	return bytes.Join(lines, []byte("\n")), nil
 }
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// writeTemp writes the data to a temporary file with the extension and returns its path.
+func writeTemp(t *testing.T, ext, data string) string {
+	file, err := ioutil.TempFile("", "ikago-*"+ext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return file.Name()
+}
+
+func TestParseFileLineAfterComment(t *testing.T) {
+	path := writeTemp(t, ".json", `{
+  # Devices to capture
+  # in a list
+  "listen-devices": [],
+  "ttl": "64"
+}
+`)
+	defer os.Remove(path)
+
+	_, err := ParseFile(path)
+	if err == nil {
+		t.Fatal("malformed field parsed")
+	}
+	if !strings.Contains(err.Error(), "line 5 ") {
+		t.Fatalf("error %q, expected at line 5", err)
+	}
+}
+
+func TestParseFileSyntaxAfterComment(t *testing.T) {
+	path := writeTemp(t, ".json", `{
+  # Upstream
+  "upstream-device": "eth0"
+  "ttl": 64
+}
+`)
+	defer os.Remove(path)
+
+	_, err := ParseFile(path)
+	if err == nil {
+		t.Fatal("malformed file parsed")
+	}
+	if !strings.Contains(err.Error(), "line 4 ") {
+		t.Fatalf("error %q, expected at line 4", err)
+	}
+}
+
+func TestParseFileTOMLComment(t *testing.T) {
+	path := writeTemp(t, ".toml", `# Devices
+listen-devices = ["eth1"]
+ttl = 64
+`)
+	defer os.Remove(path)
+
+	cfg, err := ParseFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.ListenDevs) != 1 || cfg.ListenDevs[0] != "eth1" || cfg.TTL != 64 {
+		t.Fatalf("listen devices %v, ttl %d", cfg.ListenDevs, cfg.TTL)
+	}
+}
+
+func TestParseFileYAMLForwards(t *testing.T) {
+	path := writeTemp(t, ".yaml", `# Forward SSH of alice
+forwards:
+  - port: 2222
+    protocol: tcp
+    client: alice
+    address: 192.168.1.10:22
+clients:
+  alice:
+    limit: 10MB
+`)
+	defer os.Remove(path)
+
+	cfg, err := ParseFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Forwards) != 1 {
+		t.Fatalf("%d forwards", len(cfg.Forwards))
+	}
+	forward := cfg.Forwards[0]
+	if forward.Port != 2222 || forward.Protocol != "tcp" || forward.Client != "alice" || forward.Address != "192.168.1.10:22" {
+		t.Fatalf("forward %+v", forward)
+	}
+	if cfg.Clients["alice"].Limit != "10MB" {
+		t.Fatalf("clients %+v", cfg.Clients)
+	}
+	// Defaults are kept
+	if cfg.Mode != "faketcp" {
+		t.Fatalf("mode %s", cfg.Mode)
+	}
+}
+
+func TestParseFileYAMLUnknownField(t *testing.T) {
+	path := writeTemp(t, ".yml", `forwards:
+  - port: 2222
+    client: alice
+    adress: 192.168.1.10:22
+`)
+	defer os.Remove(path)
+
+	_, err := ParseFile(path)
+	if err == nil {
+		t.Fatal("unknown field parsed")
+	}
+	if !strings.Contains(err.Error(), "line 4") {
+		t.Fatalf("error %q, expected at line 4", err)
+	}
+}
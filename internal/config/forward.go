@@ -0,0 +1,10 @@
+package config
+
+// ForwardConfig describes the configuration of a static port forwarding from a port of the server to an address behind
+// a client identified by its Id.
+type ForwardConfig struct {
+	Port     int    `json:"port" toml:"port" yaml:"port"`
+	Protocol string `json:"protocol" toml:"protocol" yaml:"protocol"`
+	Client   string `json:"client" toml:"client" yaml:"client"`
+	Address  string `json:"address" toml:"address" yaml:"address"`
+}
@@ -4,16 +4,16 @@
 
 // KCPConfig describes the configuration of KCP.
 type KCPConfig struct {
-	MTU         int  `json:"mtu"`
-	SendWindow  int  `json:"sndwnd"`
-	RecvWindow  int  `json:"rcvwnd"`
-	DataShard   int  `json:"datashard"`
-	ParityShard int  `json:"parityshard"`
-	ACKNoDelay  bool `json:"acknodelay"`
-	NoDelay     bool `json:"nodelay"`
-	Interval    int  `json:"interval"`
-	Resend      int  `json:"resend"`
-	NC          int  `json:"nc"`
+	MTU         int  `json:"mtu" toml:"mtu" yaml:"mtu"`
+	SendWindow  int  `json:"sndwnd" toml:"sndwnd" yaml:"sndwnd"`
+	RecvWindow  int  `json:"rcvwnd" toml:"rcvwnd" yaml:"rcvwnd"`
+	DataShard   int  `json:"datashard" toml:"datashard" yaml:"datashard"`
+	ParityShard int  `json:"parityshard" toml:"parityshard" yaml:"parityshard"`
+	ACKNoDelay  bool `json:"acknodelay" toml:"acknodelay" yaml:"acknodelay"`
+	NoDelay     bool `json:"nodelay" toml:"nodelay" yaml:"nodelay"`
+	Interval    int  `json:"interval" toml:"interval" yaml:"interval"`
+	Resend      int  `json:"resend" toml:"resend" yaml:"resend"`
+	NC          int  `json:"nc" toml:"nc" yaml:"nc"`
 }
 
 // NewKCPConfig returns a new KCP config.
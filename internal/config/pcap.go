@@ -0,0 +1,19 @@
+package config
+
+// PcapConfig describes the configuration of capturing in pcap.
+type PcapConfig struct {
+	Immediate bool     `json:"immediate" toml:"immediate" yaml:"immediate"`
+	Buffer    int      `json:"buffer" toml:"buffer" yaml:"buffer"`
+	Timeout   int      `json:"timeout" toml:"timeout" yaml:"timeout"`
+	NoPromisc []string `json:"no-promisc" toml:"no-promisc" yaml:"no-promisc"`
+	Tstamp    string   `json:"tstamp" toml:"tstamp" yaml:"tstamp"`
+	Ring      int      `json:"ring" toml:"ring" yaml:"ring"`
+	Mmap      bool     `json:"mmap" toml:"mmap" yaml:"mmap"`
+}
+
+// NewPcapConfig returns a new pcap config.
+func NewPcapConfig() *PcapConfig {
+	return &PcapConfig{
+		NoPromisc: make([]string, 0),
+	}
+}
@@ -0,0 +1,28 @@
+package config
+
+// UserConfig describes the configuration of a user of the server, whose clients authenticate by the key.
+type UserConfig struct {
+	Name         string `json:"name" toml:"name" yaml:"name"`
+	Key          string `json:"key" toml:"key" yaml:"key"`
+	DailyQuota   string `json:"daily-quota" toml:"daily-quota" yaml:"daily-quota"`
+	MonthlyQuota string `json:"monthly-quota" toml:"monthly-quota" yaml:"monthly-quota"`
+	AllowedPorts []int  `json:"allowed-ports" toml:"allowed-ports" yaml:"allowed-ports"`
+	MaxFlows     int    `json:"max-flows" toml:"max-flows" yaml:"max-flows"`
+}
+
+// UsersConfig describes the configuration of users in a users file.
+type UsersConfig struct {
+	Users []UserConfig `json:"users" toml:"users" yaml:"users"`
+}
+
+// ParseUsersFile returns the users parsed from file, in JSON, TOML or YAML like ParseFile.
+func ParseUsersFile(path string) (*UsersConfig, error) {
+	config := &UsersConfig{Users: make([]UserConfig, 0)}
+
+	err := parseFile(path, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
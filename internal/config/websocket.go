@@ -0,0 +1,18 @@
+package config
+
+// WebSocketConfig describes the configuration of WebSocket.
+type WebSocketConfig struct {
+	Path     string `json:"path" toml:"path" yaml:"path"`
+	Host     string `json:"host" toml:"host" yaml:"host"`
+	TLS      bool   `json:"tls" toml:"tls" yaml:"tls"`
+	Insecure bool   `json:"insecure" toml:"insecure" yaml:"insecure"`
+	Cert     string `json:"cert" toml:"cert" yaml:"cert"`
+	Key      string `json:"key" toml:"key" yaml:"key"`
+}
+
+// NewWebSocketConfig returns a new WebSocket config.
+func NewWebSocketConfig() *WebSocketConfig {
+	return &WebSocketConfig{
+		Path: "/",
+	}
+}
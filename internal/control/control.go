@@ -0,0 +1,201 @@
+package control
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ikago/internal/log"
+	"mime"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var logger = log.New("control")
+
+// HandlerFunc handles a request and returns the result, which is responded in JSON.
+type HandlerFunc func(req *http.Request) (interface{}, error)
+
+// Error describes an error of a request with the HTTP status code.
+type Error struct {
+	Code int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// BadRequest returns an error of a bad request.
+func BadRequest(err error) error {
+	return &Error{Code: http.StatusBadRequest, Err: err}
+}
+
+// NotFound returns an error of a resource not found.
+func NotFound(err error) error {
+	return &Error{Code: http.StatusNotFound, Err: err}
+}
+
+// Server is a local HTTP server managing at runtime. Requests and responses are in JSON, and requests are authorized
+// by a bearer token if the token is set.
+type Server struct {
+	token  string
+	mux    *http.ServeMux
+	server *http.Server
+}
+
+// NewServer returns a new control server listening on the address.
+func NewServer(addr, token string) *Server {
+	mux := http.NewServeMux()
+
+	return &Server{
+		token: token,
+		mux:   mux,
+		server: &http.Server{
+			Addr:    addr,
+			Handler: mux,
+		},
+	}
+}
+
+// IsLocal returns if the address of the server is a loopback address.
+func IsLocal(addr string) (bool, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false, err
+	}
+	if host == "localhost" {
+		return true, nil
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback(), nil
+}
+
+// Handle registers handlers of methods for the path.
+func (s *Server) Handle(path string, handlers map[string]HandlerFunc) {
+	methods := make([]string, 0, len(handlers))
+	for method := range handlers {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	allow := strings.Join(methods, ", ")
+
+	s.mux.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+		if !s.authorize(req) {
+			s.write(w, req, nil, &Error{Code: http.StatusUnauthorized, Err: errors.New("invalid token")})
+			return
+		}
+
+		handler, ok := handlers[req.Method]
+		if !ok {
+			w.Header().Set("Allow", allow)
+			s.write(w, req, nil, &Error{
+				Code: http.StatusMethodNotAllowed,
+				Err:  fmt.Errorf("method %s not allowed", req.Method),
+			})
+			return
+		}
+
+		if !isJSON(req) {
+			s.write(w, req, nil, &Error{
+				Code: http.StatusUnsupportedMediaType,
+				Err:  errors.New("content type must be application/json"),
+			})
+			return
+		}
+
+		result, err := handler(req)
+		s.write(w, req, result, err)
+	})
+}
+
+// ListenAndServe listens on the address and serves requests until the server is closed.
+func (s *Server) ListenAndServe() error {
+	err := s.server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
+
+// Close closes the server.
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+func (s *Server) authorize(req *http.Request) bool {
+	if s.token == "" {
+		return true
+	}
+
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+// isJSON returns if the request carrying a body is in JSON. Browsers send POST requests in other content types across
+// origins without preflights, so any page visited on the host could change IkaGo, while requests in JSON or in DELETE
+// are only sent once they are allowed by CORS, which IkaGo never allows.
+func isJSON(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		t, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+
+		return err == nil && t == "application/json"
+	default:
+		return true
+	}
+}
+
+func (s *Server) write(w http.ResponseWriter, req *http.Request, result interface{}, err error) {
+	code := http.StatusOK
+	if err != nil {
+		code = http.StatusInternalServerError
+		var controlErr *Error
+		if errors.As(err, &controlErr) {
+			code = controlErr.Code
+		}
+
+		result = &struct {
+			Error string `json:"error"`
+		}{
+			Error: err.Error(),
+		}
+	}
+	if result == nil {
+		result = struct{}{}
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		logger.Errorln(fmt.Errorf("%s %s: %w", req.Method, req.URL.Path, err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, err = w.Write(b)
+	if err != nil {
+		logger.Errorln(fmt.Errorf("%s %s: %w", req.Method, req.URL.Path, err))
+	}
+}
+
+// Decode decodes the body of the request in JSON.
+func Decode(req *http.Request, v interface{}) error {
+	err := json.NewDecoder(req.Body).Decode(v)
+	if err != nil {
+		return BadRequest(fmt.Errorf("decode: %w", err))
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package control
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleContentType(t *testing.T) {
+	s := NewServer("127.0.0.1:0", "")
+	s.Handle("/log", map[string]HandlerFunc{
+		http.MethodPut: func(req *http.Request) (interface{}, error) {
+			var v struct {
+				Level string `json:"level"`
+			}
+
+			return nil, Decode(req, &v)
+		},
+		http.MethodDelete: func(req *http.Request) (interface{}, error) {
+			return nil, nil
+		},
+	})
+
+	tests := []struct {
+		method      string
+		contentType string
+		code        int
+	}{
+		{http.MethodPut, "application/json", http.StatusOK},
+		{http.MethodPut, "application/json; charset=utf-8", http.StatusOK},
+		{http.MethodPut, "text/plain", http.StatusUnsupportedMediaType},
+		{http.MethodPut, "", http.StatusUnsupportedMediaType},
+		{http.MethodDelete, "", http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "/log", strings.NewReader(`{"level": "info"}`))
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		w := httptest.NewRecorder()
+
+		s.mux.ServeHTTP(w, req)
+		if w.Code != test.code {
+			t.Errorf("%s in %q: code %d, expected %d", test.method, test.contentType, w.Code, test.code)
+		}
+	}
+}
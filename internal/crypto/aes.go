@@ -35,7 +35,7 @@ func CreateAESCFBCrypt(key, iv []byte) (*AESCFBCrypt, error) {
 func (c *AESCFBCrypt) Encrypt(data []byte) ([]byte, error) {
 	result := make([]byte, len(data))
 
-	c.encrypter.XORKeyStream(data, result)
+	c.encrypter.XORKeyStream(result, data)
 
 	return result, nil
 }
@@ -43,7 +43,7 @@ func (c *AESCFBCrypt) Encrypt(data []byte) ([]byte, error) {
 func (c *AESCFBCrypt) Decrypt(data []byte) ([]byte, error) {
 	result := make([]byte, len(data))
 
-	c.decrypter.XORKeyStream(data, result)
+	c.decrypter.XORKeyStream(result, data)
 
 	return result, nil
 }
@@ -0,0 +1,45 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+// ChallengeSize is the size of the challenge in authentication.
+const ChallengeSize = 16
+
+// Auth describes a pre-shared key authentication with HMAC challenge and response.
+type Auth struct {
+	key []byte
+}
+
+// CreateAuth returns an auth by given password, or nil if the password is empty.
+func CreateAuth(password string) *Auth {
+	if password == "" {
+		return nil
+	}
+
+	return &Auth{key: DeriveKey("auth:"+password, 32)}
+}
+
+// Challenge returns a new random challenge, which must be used only once.
+func (a *Auth) Challenge() ([]byte, error) {
+	return GenerateIV(ChallengeSize)
+}
+
+// Respond returns the response of the challenge.
+func (a *Auth) Respond(challenge []byte) []byte {
+	h := hmac.New(sha256.New, a.key)
+	h.Write(challenge)
+
+	return h.Sum(nil)
+}
+
+// Verify returns if the response matches the challenge.
+func (a *Auth) Verify(challenge, response []byte) bool {
+	if len(challenge) != ChallengeSize {
+		return false
+	}
+
+	return hmac.Equal(a.Respond(challenge), response)
+}
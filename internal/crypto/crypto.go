@@ -39,6 +39,17 @@ func (m Method) String() string {
 	}
 }
 
+// IsAEAD returns if the method authenticates data it encrypts, so tampered data fails in decryption. AES-CFB is
+// malleable and does not.
+func (m Method) IsAEAD() bool {
+	switch m {
+	case MethodAESGCM, MethodChaCha20Poly1305, MethodXChaCha20Poly1305:
+		return true
+	default:
+		return false
+	}
+}
+
 // Crypt describes crypt of encryption.
 type Crypt interface {
 	// Encrypt returns the encrypted data.
@@ -53,24 +64,36 @@ type Crypt interface {
 
 // ParseCrypt returns a crypt by given method and password.
 func ParseCrypt(method, password string) (Crypt, error) {
+	method = strings.ToLower(method)
+	if method != "plain" && password == "" {
+		return nil, fmt.Errorf("missing password of method %s", method)
+	}
+
+	return createCrypt(method, func(length int) []byte {
+		return DeriveKey(password, length)
+	})
+}
+
+// createCrypt returns a crypt by given method and a function deriving a key in the length.
+func createCrypt(method string, key func(length int) []byte) (Crypt, error) {
 	var (
 		err error
 		c   Crypt
 	)
 
-	switch strings.ToLower(method) {
+	switch method {
 	case "plain":
 		c = CreatePlainCrypt()
 	case "aes-128-gcm":
-		c, err = CreateAESGCMCrypt(DeriveKey(password, 16))
+		c, err = CreateAESGCMCrypt(key(16))
 	case "aes-192-gcm":
-		c, err = CreateAESGCMCrypt(DeriveKey(password, 24))
+		c, err = CreateAESGCMCrypt(key(24))
 	case "aes-256-gcm":
-		c, err = CreateAESGCMCrypt(DeriveKey(password, 32))
+		c, err = CreateAESGCMCrypt(key(32))
 	case "chacha20-poly1305":
-		c, err = CreateChaCha20Poly1305Crypt(DeriveKey(password, 32))
+		c, err = CreateChaCha20Poly1305Crypt(key(32))
 	case "xchacha20-poly1305":
-		c, err = CreateXChaCha20Poly1305Crypt(DeriveKey(password, 32))
+		c, err = CreateXChaCha20Poly1305Crypt(key(32))
 	default:
 		return nil, fmt.Errorf("method %s not support", method)
 	}
@@ -80,3 +103,25 @@ func ParseCrypt(method, password string) (Crypt, error) {
 
 	return c, nil
 }
+
+// Cloner describes a crypt with states of its own, which is cloned for each connection.
+type Cloner interface {
+	// Clone returns a new crypt in the initial state.
+	Clone() Crypt
+}
+
+// Clone returns a clone of the crypt if it has states of its own, or the crypt itself.
+func Clone(c Crypt) Crypt {
+	cloner, ok := c.(Cloner)
+	if !ok {
+		return c
+	}
+
+	return cloner.Clone()
+}
+
+// Unwrapper describes a crypt wrapping another crypt.
+type Unwrapper interface {
+	// Unwrap returns the wrapped crypt.
+	Unwrap() Crypt
+}
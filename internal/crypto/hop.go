@@ -0,0 +1,97 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+)
+
+// Hop describes a schedule of ports shared by the client and the server. Time is divided into slices of the interval,
+// and the port of each slice is derived from the HMAC of the slice with a pre-shared key.
+type Hop struct {
+	key      []byte
+	interval time.Duration
+	base     uint16
+	n        uint16
+}
+
+// CreateHop returns a hop by given password, hopping in n ports from the base every interval.
+func CreateHop(password string, interval time.Duration, base, n uint16) *Hop {
+	return &Hop{
+		key:      DeriveKey("hop:"+password, 32),
+		interval: interval,
+		base:     base,
+		n:        n,
+	}
+}
+
+// WithBase returns a copy of the hop hopping from another base.
+func (h *Hop) WithBase(base uint16) *Hop {
+	return &Hop{
+		key:      h.key,
+		interval: h.interval,
+		base:     base,
+		n:        h.n,
+	}
+}
+
+// Interval returns the interval of hopping.
+func (h *Hop) Interval() time.Duration {
+	return h.interval
+}
+
+// Range returns the min and the max port of hopping.
+func (h *Hop) Range() (uint16, uint16) {
+	return h.base, h.base + h.n - 1
+}
+
+// slice returns the slice of the time.
+func (h *Hop) slice(t time.Time) int64 {
+	return t.UnixNano() / int64(h.interval)
+}
+
+// port returns the port of the slice.
+func (h *Hop) port(slice int64) uint16 {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(slice))
+
+	m := hmac.New(sha256.New, h.key)
+	m.Write(b)
+
+	return h.base + uint16(binary.BigEndian.Uint32(m.Sum(nil))%uint32(h.n))
+}
+
+// Port returns the port at the time.
+func (h *Hop) Port(t time.Time) uint16 {
+	return h.port(h.slice(t))
+}
+
+// Next returns the start of the slice next to the time.
+func (h *Hop) Next(t time.Time) time.Time {
+	return time.Unix(0, (h.slice(t)+1)*int64(h.interval))
+}
+
+// Ports returns the ports of the slices before, at and after the time, which tolerates clocks of peers differing by an
+// interval.
+func (h *Hop) Ports(t time.Time) []uint16 {
+	slice := h.slice(t)
+
+	result := make([]uint16, 0, 3)
+	for i := slice - 1; i <= slice+1; i++ {
+		port := h.port(i)
+
+		duplicate := false
+		for _, p := range result {
+			if p == port {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			result = append(result, port)
+		}
+	}
+
+	return result
+}
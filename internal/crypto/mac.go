@@ -0,0 +1,80 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+)
+
+// MACSize is the size of the MAC appended to each encrypted data.
+const MACSize = 16
+
+// MACCrypt describes a crypt which appends a MAC of the encrypted data, so data not sent by the peer are rejected
+// before decrypting, even if the wrapped crypt is not authenticated.
+type MACCrypt struct {
+	crypt Crypt
+	key   []byte
+}
+
+// WrapMAC returns a crypt which authenticates data encrypted by the crypt with a key derived from the password.
+func WrapMAC(c Crypt, password string) *MACCrypt {
+	return &MACCrypt{
+		crypt: c,
+		key:   DeriveKey("mac:"+password, 32),
+	}
+}
+
+func (c *MACCrypt) Encrypt(data []byte) ([]byte, error) {
+	data, err := c.crypt.Encrypt(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// The wrapped crypt may return the data itself, which must not be appended in place
+	result := make([]byte, len(data), len(data)+MACSize)
+	copy(result, data)
+
+	return append(result, c.sum(data)...), nil
+}
+
+func (c *MACCrypt) Decrypt(data []byte) ([]byte, error) {
+	if len(data) < MACSize {
+		return nil, errors.New("missing mac")
+	}
+
+	data, mac := data[:len(data)-MACSize], data[len(data)-MACSize:]
+	if !hmac.Equal(c.sum(data), mac) {
+		return nil, errors.New("mac mismatch")
+	}
+
+	return c.crypt.Decrypt(data)
+}
+
+func (c *MACCrypt) Method() Method {
+	return c.crypt.Method()
+}
+
+func (c *MACCrypt) Cost() int {
+	return c.crypt.Cost() + MACSize
+}
+
+// Clone returns a crypt which authenticates data encrypted by a clone of the crypt.
+func (c *MACCrypt) Clone() Crypt {
+	return &MACCrypt{
+		crypt: Clone(c.crypt),
+		key:   c.key,
+	}
+}
+
+// Unwrap returns the crypt.
+func (c *MACCrypt) Unwrap() Crypt {
+	return c.crypt
+}
+
+// sum returns the truncated HMAC-SHA256 of the data.
+func (c *MACCrypt) sum(data []byte) []byte {
+	h := hmac.New(sha256.New, c.key)
+	h.Write(data)
+
+	return h.Sum(nil)[:MACSize]
+}
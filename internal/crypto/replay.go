@@ -0,0 +1,145 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// SeqSize is the size of the sequence number prefixed to each data in anti-replay.
+	SeqSize = 8
+	// ReplayWindow is the number of latest sequence numbers tracked in anti-replay, so data reordered within the
+	// window are still accepted.
+	ReplayWindow = 1024
+)
+
+// ErrReplayed describes data which is received before or is too old to be tracked.
+var ErrReplayed = errors.New("replayed")
+
+// replayed is the number of data dropped as replayed in all crypts.
+var replayed uint64
+
+// Replayed returns the number of data dropped as replayed in all crypts.
+func Replayed() uint64 {
+	return atomic.LoadUint64(&replayed)
+}
+
+// ReplayCrypt describes a crypt which prefixes each data with a sequence number before encrypting, and drops decrypted
+// data whose sequence number is received before or falls behind a sliding window, like the anti-replay service in
+// IPsec. The sequence number is only trusted if the wrapped crypt is authenticated.
+type ReplayCrypt struct {
+	crypt  Crypt
+	seq    uint64
+	lock   sync.Mutex
+	top    uint64
+	bitmap [ReplayWindow / 64]uint64
+}
+
+// WrapReplay returns a crypt which detects replayed data encrypted by the crypt.
+func WrapReplay(c Crypt) *ReplayCrypt {
+	return &ReplayCrypt{crypt: c}
+}
+
+func (c *ReplayCrypt) Encrypt(data []byte) ([]byte, error) {
+	result := make([]byte, SeqSize+len(data))
+	binary.BigEndian.PutUint64(result, atomic.AddUint64(&c.seq, 1))
+	copy(result[SeqSize:], data)
+
+	return c.crypt.Encrypt(result)
+}
+
+func (c *ReplayCrypt) Decrypt(data []byte) ([]byte, error) {
+	data, err := c.crypt.Decrypt(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < SeqSize {
+		return nil, errors.New("missing sequence number")
+	}
+
+	if !c.check(binary.BigEndian.Uint64(data)) {
+		atomic.AddUint64(&replayed, 1)
+		return nil, ErrReplayed
+	}
+
+	return data[SeqSize:], nil
+}
+
+func (c *ReplayCrypt) Method() Method {
+	return c.crypt.Method()
+}
+
+func (c *ReplayCrypt) Cost() int {
+	return c.crypt.Cost() + SeqSize
+}
+
+// Clone returns a crypt which detects replayed data encrypted by a clone of the crypt, with its own sequence numbers
+// and window.
+func (c *ReplayCrypt) Clone() Crypt {
+	return &ReplayCrypt{crypt: Clone(c.crypt)}
+}
+
+// Unwrap returns the crypt.
+func (c *ReplayCrypt) Unwrap() Crypt {
+	return c.crypt
+}
+
+// Reset clears the window, which is used when the connection is re-established as the peer may restart from the first
+// sequence number. Sequence numbers sent are kept increasing.
+func (c *ReplayCrypt) Reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.top = 0
+	c.bitmap = [ReplayWindow / 64]uint64{}
+}
+
+// check returns if the sequence number is not received before and is in the window, and marks it received.
+func (c *ReplayCrypt) check(seq uint64) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Sequence numbers start from 1
+	if seq == 0 {
+		return false
+	}
+
+	if seq > c.top {
+		// Slide the window, clearing bits of skipped sequence numbers
+		diff := seq - c.top
+		if diff >= ReplayWindow {
+			c.bitmap = [ReplayWindow / 64]uint64{}
+		} else {
+			for i := c.top + 1; i <= seq; i++ {
+				c.bitmap[(i/64)%uint64(len(c.bitmap))] &^= 1 << (i % 64)
+			}
+		}
+		c.top = seq
+	} else if c.top-seq >= ReplayWindow {
+		return false
+	}
+
+	word, bit := (seq/64)%uint64(len(c.bitmap)), uint64(1)<<(seq%64)
+	if c.bitmap[word]&bit != 0 {
+		return false
+	}
+	c.bitmap[word] |= bit
+
+	return true
+}
+
+// FindReplayCrypt returns the replay crypt wrapped in the crypt, nil if there is not.
+func FindReplayCrypt(c Crypt) *ReplayCrypt {
+	for {
+		switch t := c.(type) {
+		case *ReplayCrypt:
+			return t
+		case Unwrapper:
+			c = t.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
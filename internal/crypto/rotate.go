@@ -0,0 +1,256 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SaltSize is the size of the salt deriving the key of an epoch.
+const SaltSize = 16
+
+// RotatingCrypt describes a crypt whose key is rotated in epochs. Each encrypted data is prefixed with its epoch in 1
+// Byte. The key of epoch 0 is derived from the password, and the key of each later epoch is derived from the password
+// and a random salt, so a compromised key does not expose keys of other epochs. Keys of the previous and the proposed
+// epochs are kept for decrypting, so data in flight are not dropped during rotation.
+type RotatingCrypt struct {
+	lock      sync.RWMutex
+	method    string
+	password  string
+	base      []byte
+	epoch     uint8
+	crypts    map[uint8]Crypt
+	previous  int
+	proposed  int
+	salt      []byte
+	lastSent  time.Time
+	start     time.Time
+	size      uint64
+	prototype Crypt
+}
+
+// CreateRotatingCrypt returns a rotating crypt by given method and password.
+func CreateRotatingCrypt(method, password string) (*RotatingCrypt, error) {
+	method = strings.ToLower(method)
+	if method == "plain" {
+		return nil, errors.New("method plain not support")
+	}
+
+	c, err := ParseCrypt(method, password)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RotatingCrypt{
+		method:    method,
+		password:  password,
+		base:      DeriveKey("rekey:"+password, 32),
+		crypts:    map[uint8]Crypt{0: c},
+		previous:  -1,
+		proposed:  -1,
+		start:     time.Now(),
+		prototype: c,
+	}, nil
+}
+
+// Clone returns a new rotating crypt in epoch 0 with the same method and password.
+func (c *RotatingCrypt) Clone() Crypt {
+	return &RotatingCrypt{
+		method:    c.method,
+		password:  c.password,
+		base:      c.base,
+		crypts:    map[uint8]Crypt{0: c.prototype},
+		previous:  -1,
+		proposed:  -1,
+		start:     time.Now(),
+		prototype: c.prototype,
+	}
+}
+
+// Reset returns the crypt to epoch 0, which is used when the connection is re-established.
+func (c *RotatingCrypt) Reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.epoch = 0
+	c.crypts = map[uint8]Crypt{0: c.prototype}
+	c.previous = -1
+	c.proposed = -1
+	c.salt = nil
+	c.start = time.Now()
+	c.size = 0
+}
+
+// Epoch returns the current epoch.
+func (c *RotatingCrypt) Epoch() uint8 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.epoch
+}
+
+// Propose returns the next epoch and its salt if the key of the current epoch is used for the interval or encrypts data
+// in the size, or the proposal is not confirmed in the timeout and needs to be resent. The key of the next epoch is
+// accepted for decrypting once it is proposed. Set interval or size 0 to disable the condition.
+func (c *RotatingCrypt) Propose(interval time.Duration, size uint64, timeout time.Duration) (uint8, []byte, bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+
+	// Resend
+	if c.proposed >= 0 {
+		if now.Sub(c.lastSent) < timeout {
+			return 0, nil, false, nil
+		}
+		c.lastSent = now
+
+		return uint8(c.proposed), c.salt, true, nil
+	}
+
+	if (interval <= 0 || now.Sub(c.start) < interval) && (size <= 0 || c.size < size) {
+		return 0, nil, false, nil
+	}
+
+	salt, err := GenerateIV(SaltSize)
+	if err != nil {
+		return 0, nil, false, fmt.Errorf("generate salt: %w", err)
+	}
+
+	epoch := c.epoch + 1
+	crypt, err := c.derive(salt)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	c.crypts[epoch] = crypt
+	c.proposed = int(epoch)
+	c.salt = salt
+	c.lastSent = now
+
+	return epoch, salt, true, nil
+}
+
+// Accept switches to the epoch proposed by the peer with its salt. The key of the current epoch is kept for decrypting
+// data in flight. Proposals resent for the current epoch are accepted again.
+func (c *RotatingCrypt) Accept(epoch uint8, salt []byte) error {
+	if len(salt) != SaltSize {
+		return fmt.Errorf("salt size %d out of range", len(salt))
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if epoch == c.epoch && c.previous >= 0 {
+		return nil
+	}
+	if epoch != c.epoch+1 {
+		return fmt.Errorf("epoch %d out of range", epoch)
+	}
+
+	crypt, err := c.derive(salt)
+	if err != nil {
+		return err
+	}
+	c.crypts[epoch] = crypt
+	c.switchTo(epoch)
+
+	return nil
+}
+
+// Confirm switches to the epoch proposed before, once the peer accepts it.
+func (c *RotatingCrypt) Confirm(epoch uint8) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.proposed < 0 || uint8(c.proposed) != epoch {
+		return false
+	}
+	c.switchTo(epoch)
+
+	return true
+}
+
+func (c *RotatingCrypt) switchTo(epoch uint8) {
+	// Only keys of the current and the previous epochs are kept
+	if c.previous >= 0 {
+		delete(c.crypts, uint8(c.previous))
+	}
+	c.previous = int(c.epoch)
+	c.epoch = epoch
+	c.proposed = -1
+	c.salt = nil
+	c.start = time.Now()
+	c.size = 0
+}
+
+// derive returns the crypt with the key derived from the salt.
+func (c *RotatingCrypt) derive(salt []byte) (Crypt, error) {
+	h := sha256.New()
+	h.Write(c.base)
+	h.Write(salt)
+	key := h.Sum(nil)
+
+	crypt, err := createCrypt(c.method, func(length int) []byte {
+		return key[:length]
+	})
+	if err != nil {
+		return nil, fmt.Errorf("derive: %w", err)
+	}
+
+	return crypt, nil
+}
+
+func (c *RotatingCrypt) Encrypt(data []byte) ([]byte, error) {
+	c.lock.Lock()
+	epoch := c.epoch
+	crypt := c.crypts[epoch]
+	c.size = c.size + uint64(len(data))
+	c.lock.Unlock()
+
+	result, err := crypt.Encrypt(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{epoch}, result...), nil
+}
+
+func (c *RotatingCrypt) Decrypt(data []byte) ([]byte, error) {
+	if len(data) < 1 {
+		return nil, errors.New("missing epoch")
+	}
+
+	c.lock.RLock()
+	crypt, ok := c.crypts[data[0]]
+	c.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("epoch %d not found", data[0])
+	}
+
+	return crypt.Decrypt(data[1:])
+}
+
+func (c *RotatingCrypt) Method() Method {
+	return c.prototype.Method()
+}
+
+func (c *RotatingCrypt) Cost() int {
+	return c.prototype.Cost() + 1
+}
+
+// FindRotatingCrypt returns the rotating crypt in the crypt or crypts it wraps, nil if there is not.
+func FindRotatingCrypt(c Crypt) *RotatingCrypt {
+	for {
+		switch t := c.(type) {
+		case *RotatingCrypt:
+			return t
+		case Unwrapper:
+			c = t.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
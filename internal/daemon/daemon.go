@@ -0,0 +1,173 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Config describes the configuration of a service.
+type Config struct {
+	// Name is the name of the service.
+	Name string
+	// Description is the description of the service.
+	Description string
+	// Args is the arguments the program runs with.
+	Args []string
+	// Reload is if the program reloads on SIGHUP.
+	Reload bool
+}
+
+// Install installs the program as a service which starts at boot and restarts on failure.
+func Install(cfg *Config) error {
+	exe, err := executable()
+	if err != nil {
+		return err
+	}
+
+	return install(cfg, exe)
+}
+
+// Uninstall stops and removes the service.
+func Uninstall(name string) error {
+	return uninstall(name)
+}
+
+// Serve runs the program as a service if it is started by the service manager, and calls stop when the service is
+// requested to stop. It does nothing if the program is not started by the service manager.
+func Serve(name string, stop func()) error {
+	return serve(name, stop)
+}
+
+// Ready notifies the service manager that the program is ready.
+func Ready() error {
+	return ready()
+}
+
+// Reloading notifies the service manager that the program is reloading. Ready should be called after reloading.
+func Reloading() error {
+	return notify("RELOADING=1")
+}
+
+// Stopping notifies the service manager that the program is stopping.
+func Stopping() error {
+	return notify("STOPPING=1")
+}
+
+// SystemdUnit returns the systemd unit of the service. The program is notified to be ready by sd_notify.
+func SystemdUnit(cfg *Config) (string, error) {
+	exe, err := executable()
+	if err != nil {
+		return "", err
+	}
+
+	return systemdUnit(cfg, exe), nil
+}
+
+func systemdUnit(cfg *Config, exe string) string {
+	var b strings.Builder
+
+	execStart := make([]string, 0, len(cfg.Args)+1)
+	execStart = append(execStart, quoteSystemd(exe))
+	for _, arg := range cfg.Args {
+		execStart = append(execStart, quoteSystemd(arg))
+	}
+
+	b.WriteString("[Unit]\n")
+	b.WriteString(fmt.Sprintf("Description=%s\n", cfg.Description))
+	b.WriteString("Wants=network-online.target\n")
+	b.WriteString("After=network-online.target\n")
+	b.WriteString("\n")
+	b.WriteString("[Service]\n")
+	b.WriteString("Type=notify\n")
+	b.WriteString(fmt.Sprintf("ExecStart=%s\n", strings.Join(execStart, " ")))
+	if cfg.Reload {
+		b.WriteString("ExecReload=/bin/kill -HUP $MAINPID\n")
+	}
+	b.WriteString("Restart=on-failure\n")
+	b.WriteString("RestartSec=5\n")
+	b.WriteString("\n")
+	b.WriteString("[Install]\n")
+	b.WriteString("WantedBy=multi-user.target\n")
+
+	return b.String()
+}
+
+// quoteSystemd quotes an argument in the command line of systemd.
+func quoteSystemd(arg string) string {
+	arg = strings.ReplaceAll(arg, "%", "%%")
+	arg = strings.ReplaceAll(arg, "$", "$$")
+	if arg != "" && !strings.ContainsAny(arg, " \t\n\"'\\;") {
+		return arg
+	}
+
+	arg = strings.ReplaceAll(arg, "\\", "\\\\")
+	arg = strings.ReplaceAll(arg, "\"", "\\\"")
+
+	return fmt.Sprintf("\"%s\"", arg)
+}
+
+// Args returns arguments of the program without the given flag, so the program can run as a service with the same
+// arguments. Values of path flags are converted to absolute paths because the working directory of a service differs.
+func Args(exclude string, paths ...string) ([]string, error) {
+	result := make([]string, 0)
+
+	args := os.Args[1:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") || arg == "-" || arg == "--" {
+			result = append(result, arg)
+			continue
+		}
+
+		name := strings.TrimLeft(arg, "-")
+		value, hasValue := "", false
+		if j := strings.Index(name, "="); j >= 0 {
+			name, value, hasValue = name[:j], name[j+1:], true
+		}
+
+		isPath := false
+		for _, path := range paths {
+			if name == path {
+				isPath = true
+				break
+			}
+		}
+		if name != exclude && !isPath {
+			result = append(result, arg)
+			continue
+		}
+
+		// Value in the next argument
+		if !hasValue && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+		if name == exclude {
+			continue
+		}
+
+		abs, err := filepath.Abs(value)
+		if err != nil {
+			return nil, fmt.Errorf("abs %s: %w", value, err)
+		}
+		result = append(result, "-"+name, abs)
+	}
+
+	return result, nil
+}
+
+func executable() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("executable: %w", err)
+	}
+
+	exe, err = filepath.Abs(exe)
+	if err != nil {
+		return "", fmt.Errorf("abs: %w", err)
+	}
+
+	return exe, nil
+}
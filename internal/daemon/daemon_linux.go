@@ -0,0 +1,101 @@
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// systemdPath is the directory of systemd units.
+const systemdPath = "/etc/systemd/system"
+
+func unitPath(name string) string {
+	return fmt.Sprintf("%s/%s.service", systemdPath, name)
+}
+
+func install(cfg *Config, exe string) error {
+	path := unitPath(cfg.Name)
+
+	err := ioutil.WriteFile(path, []byte(systemdUnit(cfg, exe)), 0644)
+	if err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+
+	err = systemctl("daemon-reload")
+	if err != nil {
+		return err
+	}
+
+	return systemctl("enable", cfg.Name)
+}
+
+func uninstall(name string) error {
+	path := unitPath(name)
+
+	_, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", path, err)
+	}
+
+	// The service may not be running
+	_ = systemctl("stop", name)
+
+	err = systemctl("disable", name)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return fmt.Errorf("remove %s: %w", path, err)
+	}
+
+	return systemctl("daemon-reload")
+}
+
+func systemctl(args ...string) error {
+	systemctlCmd := exec.Command("systemctl", args...)
+	out, err := systemctlCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec systemctl %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+func serve(name string, stop func()) error {
+	return nil
+}
+
+func ready() error {
+	return notify("READY=1")
+}
+
+// notify sends the state to systemd by sd_notify. It does nothing if the program is not started by systemd.
+func notify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+
+	// Abstract socket
+	if strings.HasPrefix(path, "@") {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,28 @@
+// +build !linux,!windows
+
+package daemon
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func install(cfg *Config, exe string) error {
+	return fmt.Errorf("os %s not support", runtime.GOOS)
+}
+
+func uninstall(name string) error {
+	return fmt.Errorf("os %s not support", runtime.GOOS)
+}
+
+func serve(name string, stop func()) error {
+	return nil
+}
+
+func ready() error {
+	return nil
+}
+
+func notify(state string) error {
+	return nil
+}
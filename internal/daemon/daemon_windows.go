@@ -0,0 +1,120 @@
+package daemon
+
+import (
+	"fmt"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+	"sync"
+	"time"
+)
+
+var (
+	readyOnce sync.Once
+	readyCh   = make(chan struct{})
+)
+
+func install(cfg *Config, exe string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.CreateService(cfg.Name, exe, mgr.Config{
+		DisplayName: cfg.Name,
+		Description: cfg.Description,
+		StartType:   mgr.StartAutomatic,
+	}, cfg.Args...)
+	if err != nil {
+		return fmt.Errorf("create service: %w", err)
+	}
+	defer s.Close()
+
+	err = s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+	}, 86400)
+	if err != nil {
+		return fmt.Errorf("set recovery actions: %w", err)
+	}
+
+	return nil
+}
+
+func uninstall(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("open service: %w", err)
+	}
+	defer s.Close()
+
+	// The service may not be running
+	_, _ = s.Control(svc.Stop)
+
+	err = s.Delete()
+	if err != nil {
+		return fmt.Errorf("delete service: %w", err)
+	}
+
+	return nil
+}
+
+type handler struct {
+	stop func()
+}
+
+func (h *handler) Execute(args []string, r <-chan svc.ChangeRequest, s chan<- svc.Status) (bool, uint32) {
+	s <- svc.Status{State: svc.StartPending}
+
+	// Report running after handles are opened
+	readyCh := readyCh
+	for {
+		select {
+		case <-readyCh:
+			s <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+			readyCh = nil
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				s <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				s <- svc.Status{State: svc.StopPending}
+				h.stop()
+				return false, 0
+			}
+		}
+	}
+}
+
+func serve(name string, stop func()) error {
+	isInteractive, err := svc.IsAnInteractiveSession()
+	if err != nil {
+		return fmt.Errorf("detect interactive session: %w", err)
+	}
+	if isInteractive {
+		return nil
+	}
+
+	go func() {
+		_ = svc.Run(name, &handler{stop: stop})
+	}()
+
+	return nil
+}
+
+func ready() error {
+	readyOnce.Do(func() {
+		close(readyCh)
+	})
+
+	return nil
+}
+
+func notify(state string) error {
+	return nil
+}
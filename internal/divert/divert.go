@@ -0,0 +1,46 @@
+package divert
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Device describes a WinDivert handle. Each read from it returns an outbound IP packet intercepted from the host, which
+// is consumed instead of leaving the host, and each write to it injects an inbound IP packet to the host.
+type Device struct {
+	handle   uintptr
+	lock     sync.RWMutex
+	ifIdx    uint32
+	subIfIdx uint32
+}
+
+// Open opens a WinDivert handle intercepting outbound packets matching the filter in the filter language of WinDivert.
+func Open(filter string) (*Device, error) {
+	return open(filter)
+}
+
+// Name returns the name of the device.
+func (dev *Device) Name() string {
+	return "WinDivert"
+}
+
+// Filter returns the filter of outbound packets from the sources, excluding packets to the server.
+func Filter(sources []net.IP, server net.IP) string {
+	fs := make([]string, 0, len(sources))
+	for _, ip := range sources {
+		if ip.To4() != nil {
+			fs = append(fs, fmt.Sprintf("ip.SrcAddr == %s", ip))
+		} else {
+			fs = append(fs, fmt.Sprintf("ipv6.SrcAddr == %s", ip))
+		}
+	}
+
+	exclude := fmt.Sprintf("ip.DstAddr == %s", server)
+	if server.To4() == nil {
+		exclude = fmt.Sprintf("ipv6.DstAddr == %s", server)
+	}
+
+	return fmt.Sprintf("outbound and !loopback and (%s) and !(%s)", strings.Join(fs, " or "), exclude)
+}
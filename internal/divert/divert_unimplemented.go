@@ -0,0 +1,25 @@
+//go:build !windows || !amd64
+// +build !windows !amd64
+
+package divert
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func open(filter string) (*Device, error) {
+	return nil, fmt.Errorf("os %s arch %s not support", runtime.GOOS, runtime.GOARCH)
+}
+
+func (dev *Device) Read(b []byte) (n int, err error) {
+	return 0, fmt.Errorf("os %s not support", runtime.GOOS)
+}
+
+func (dev *Device) Write(b []byte) (n int, err error) {
+	return 0, fmt.Errorf("os %s not support", runtime.GOOS)
+}
+
+func (dev *Device) Close() error {
+	return nil
+}
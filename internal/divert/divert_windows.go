@@ -0,0 +1,114 @@
+//go:build windows && amd64
+// +build windows,amd64
+
+package divert
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const layerNetwork = 0
+
+const (
+	flagIPv6        = 1 << 20
+	flagIPChecksum  = 1 << 21
+	flagTCPChecksum = 1 << 22
+	flagUDPChecksum = 1 << 23
+)
+
+// address describes WINDIVERT_ADDRESS in WinDivert 2.x.
+type address struct {
+	timestamp int64
+	flags     uint32
+	_         uint32
+	ifIdx     uint32
+	subIfIdx  uint32
+	_         [56]byte
+}
+
+var (
+	winDivert = syscall.NewLazyDLL("WinDivert.dll")
+	procOpen  = winDivert.NewProc("WinDivertOpen")
+	procRecv  = winDivert.NewProc("WinDivertRecv")
+	procSend  = winDivert.NewProc("WinDivertSend")
+	procClose = winDivert.NewProc("WinDivertClose")
+)
+
+func open(filter string) (*Device, error) {
+	err := winDivert.Load()
+	if err != nil {
+		return nil, fmt.Errorf("load WinDivert.dll: %w", err)
+	}
+
+	p, err := syscall.BytePtrFromString(filter)
+	if err != nil {
+		return nil, fmt.Errorf("parse filter: %w", err)
+	}
+
+	handle, _, err := procOpen.Call(uintptr(unsafe.Pointer(p)), layerNetwork, 0, 0)
+	if syscall.Handle(handle) == syscall.InvalidHandle {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+
+	return &Device{handle: handle}, nil
+}
+
+func (dev *Device) Read(b []byte) (n int, err error) {
+	if len(b) <= 0 {
+		return 0, errors.New("empty buffer")
+	}
+
+	var (
+		recvLen uint32
+		addr    address
+	)
+	r, _, err := procRecv.Call(dev.handle, uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), uintptr(unsafe.Pointer(&recvLen)), uintptr(unsafe.Pointer(&addr)))
+	if r == 0 {
+		return 0, err
+	}
+
+	// Record the interface, so packets to sources are injected in it
+	dev.lock.Lock()
+	dev.ifIdx = addr.ifIdx
+	dev.subIfIdx = addr.subIfIdx
+	dev.lock.Unlock()
+
+	return int(recvLen), nil
+}
+
+func (dev *Device) Write(b []byte) (n int, err error) {
+	if len(b) <= 0 {
+		return 0, errors.New("empty packet")
+	}
+
+	dev.lock.RLock()
+	addr := address{
+		flags:    flagIPChecksum | flagTCPChecksum | flagUDPChecksum,
+		ifIdx:    dev.ifIdx,
+		subIfIdx: dev.subIfIdx,
+	}
+	dev.lock.RUnlock()
+	if b[0]>>4 == 6 {
+		addr.flags |= flagIPv6
+	}
+
+	var sendLen uint32
+	r, _, err := procSend.Call(dev.handle, uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), uintptr(unsafe.Pointer(&sendLen)), uintptr(unsafe.Pointer(&addr)))
+	if r == 0 {
+		return 0, err
+	}
+
+	return int(sendLen), nil
+}
+
+func (dev *Device) Close() error {
+	r, _, err := procClose.Call(dev.handle)
+	if r == 0 {
+		return err
+	}
+
+	return nil
+}
@@ -30,10 +30,15 @@ func addSpecificFirewallRule(ip net.IP, port uint16) error {
 		return fmt.Errorf("exec sysctl: %w", err)
 	}
 
-	routeCmd = exec.Command("iptables", "-A", "OUTPUT", "-s", ip.String(), "-p", "tcp", "--dport", strconv.Itoa(int(port)), "-j", "DROP")
+	iptables := "iptables"
+	if ip.To4() == nil {
+		iptables = "ip6tables"
+	}
+
+	routeCmd = exec.Command(iptables, "-A", "OUTPUT", "-s", ip.String(), "-p", "tcp", "--dport", strconv.Itoa(int(port)), "-j", "DROP")
 	_, err = routeCmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("exec iptables: %w", err)
+		return fmt.Errorf("exec %s: %w", iptables, err)
 	}
 
 	return nil
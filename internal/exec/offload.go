@@ -0,0 +1,16 @@
+package exec
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// DetectOffloads returns offloading features which produce super-frames and are enabled in the device.
+func DetectOffloads(dev string) ([]string, error) {
+	switch t := runtime.GOOS; t {
+	case "linux":
+		return detectOffloads(dev)
+	default:
+		return nil, fmt.Errorf("os %s not support", t)
+	}
+}
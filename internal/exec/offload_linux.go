@@ -0,0 +1,39 @@
+package exec
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// offloadFeatures are features of ethtool which produce super-frames.
+var offloadFeatures = []string{
+	"tcp-segmentation-offload",
+	"generic-segmentation-offload",
+	"generic-receive-offload",
+	"large-receive-offload",
+}
+
+func detectOffloads(dev string) ([]string, error) {
+	ethtoolCmd := exec.Command("ethtool", "-k", dev)
+	out, err := ethtoolCmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("exec ethtool: %w", err)
+	}
+
+	result := make([]string, 0)
+	for _, line := range strings.Split(string(out), "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) < 2 {
+			continue
+		}
+
+		for _, feature := range offloadFeatures {
+			if strings.TrimSpace(kv[0]) == feature && strings.HasPrefix(strings.TrimSpace(kv[1]), "on") {
+				result = append(result, feature)
+			}
+		}
+	}
+
+	return result, nil
+}
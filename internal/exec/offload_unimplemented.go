@@ -0,0 +1,7 @@
+// +build !linux
+
+package exec
+
+func detectOffloads(dev string) ([]string, error) {
+	return nil, nil
+}
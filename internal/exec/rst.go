@@ -0,0 +1,27 @@
+package exec
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// AddRSTRule adds a rule for firewall dropping outgoing TCP RST segments from the local port. The kernel resets fake
+// TCP connections of the port as it has no socket for them.
+func AddRSTRule(port uint16) error {
+	switch t := runtime.GOOS; t {
+	case "linux":
+		return addRSTRule(port)
+	default:
+		return fmt.Errorf("os %s not support", t)
+	}
+}
+
+// DeleteRSTRule deletes the rule added by AddRSTRule.
+func DeleteRSTRule(port uint16) error {
+	switch t := runtime.GOOS; t {
+	case "linux":
+		return deleteRSTRule(port)
+	default:
+		return fmt.Errorf("os %s not support", t)
+	}
+}
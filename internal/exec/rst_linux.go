@@ -0,0 +1,68 @@
+package exec
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+)
+
+func rstRuleArgs(action string, port uint16) []string {
+	return []string{action, "OUTPUT", "-p", "tcp", "--sport", strconv.Itoa(int(port)), "--tcp-flags", "RST", "RST", "-j", "DROP"}
+}
+
+func rstTable(port uint16) string {
+	return fmt.Sprintf("ikago_%d", port)
+}
+
+func addRSTRule(port uint16) error {
+	// Use nftables if iptables is missing
+	_, err := exec.LookPath("iptables")
+	if err != nil {
+		table := rstTable(port)
+		cmds := [][]string{
+			{"add", "table", "inet", table},
+			{"add", "chain", "inet", table, "output", "{ type filter hook output priority 0 ; }"},
+			{"add", "rule", "inet", table, "output", "tcp", "sport", strconv.Itoa(int(port)), "tcp", "flags", "&", "rst", "==", "rst", "drop"},
+		}
+		for _, args := range cmds {
+			out, err := exec.Command("nft", args...).CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("exec nft: %w: %s", err, bytes.TrimSpace(out))
+			}
+		}
+
+		return nil
+	}
+
+	out, err := exec.Command("iptables", rstRuleArgs("-A", port)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec iptables: %w: %s", err, bytes.TrimSpace(out))
+	}
+
+	// IPv6 may not be enabled
+	_, _ = exec.Command("ip6tables", rstRuleArgs("-A", port)...).CombinedOutput()
+
+	return nil
+}
+
+func deleteRSTRule(port uint16) error {
+	_, err := exec.LookPath("iptables")
+	if err != nil {
+		out, err := exec.Command("nft", "delete", "table", "inet", rstTable(port)).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("exec nft: %w: %s", err, bytes.TrimSpace(out))
+		}
+
+		return nil
+	}
+
+	out, err := exec.Command("iptables", rstRuleArgs("-D", port)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec iptables: %w: %s", err, bytes.TrimSpace(out))
+	}
+
+	_, _ = exec.Command("ip6tables", rstRuleArgs("-D", port)...).CombinedOutput()
+
+	return nil
+}
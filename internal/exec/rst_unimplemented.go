@@ -0,0 +1,11 @@
+// +build !linux
+
+package exec
+
+func addRSTRule(port uint16) error {
+	return nil
+}
+
+func deleteRSTRule(port uint16) error {
+	return nil
+}
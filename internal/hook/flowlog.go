@@ -0,0 +1,27 @@
+package hook
+
+import (
+	"ikago/internal/log"
+	"ikago/internal/stat"
+	"time"
+)
+
+// flowLog describes a hook which prints a summary of each flow when it is closed.
+type flowLog struct{}
+
+// NewFlowLog returns a new hook which prints a summary of each flow when it is closed, so flows can be followed without
+// per-packet messages.
+func NewFlowLog() Hook {
+	return &flowLog{}
+}
+
+func (h *flowLog) OnFlowCreated(flow Flow) {}
+
+func (h *flowLog) OnFlowClosed(flow Flow) {
+	log.Infof("Close flow %s after %s: %d packets (%d Bytes) out, %d packets (%d Bytes) in\n",
+		flow, flow.LastSeen.Sub(flow.Start).Round(time.Second), flow.OutCount, flow.OutSize, flow.InCount, flow.InSize)
+}
+
+func (h *flowLog) OnPacket(flow Flow, direction stat.Direction, data []byte) bool {
+	return true
+}
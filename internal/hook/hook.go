@@ -0,0 +1,216 @@
+package hook
+
+import (
+	"fmt"
+	"ikago/internal/log"
+	"ikago/internal/stat"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Flow describes a flow between a source and a destination through the tunnel.
+type Flow struct {
+	Protocol string
+	Src      string
+	Dst      string
+	Start    time.Time
+	LastSeen time.Time
+	InCount  uint64
+	InSize   uint64
+	OutCount uint64
+	OutSize  uint64
+}
+
+func (flow Flow) String() string {
+	return fmt.Sprintf("%s %s <-> %s", flow.Protocol, flow.Src, flow.Dst)
+}
+
+// Hook describes custom logic attached to events of flows and packets, like logging, filtering and accounting. Hooks
+// are called in handling packets, so they must be safe for concurrent use and return quickly.
+type Hook interface {
+	// OnFlowCreated is called when the first packet of a flow is seen.
+	OnFlowCreated(flow Flow)
+	// OnFlowClosed is called when a flow is idle for the timeout or IkaGo exits, with its final statistics.
+	OnFlowClosed(flow Flow)
+	// OnPacket is called for each packet of a flow before it is sent, and the packet is dropped if it returns false.
+	// The direction is from the view of the source, and the data is the packet from its network layer.
+	OnPacket(flow Flow, direction stat.Direction, data []byte) bool
+}
+
+// ErrorHook describes a hook which is also notified of errors in handling packets. Kinds of errors, like
+// pcap.ErrChecksum and pcap.ErrWrite, are matched by errors.Is, so they can be counted, logged or acted on.
+type ErrorHook interface {
+	// OnError is called when handling a packet fails.
+	OnError(err error)
+}
+
+// Open returns the hook created by the Go plugin in the path with the argument. The plugin must export a function New
+// of type func(arg string) (hook.Hook, error). Plugins are supported in Linux and macOS with cgo, and must be built
+// with the same version of Go and packages as IkaGo.
+func Open(path, arg string) (Hook, error) {
+	f, err := lookup(path)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := f(arg)
+	if err != nil {
+		return nil, fmt.Errorf("new: %w", err)
+	}
+
+	return h, nil
+}
+
+// Chain describes hooks called in order, and tracks flows for their events.
+type Chain struct {
+	lock     sync.Mutex
+	hooks    []Hook
+	timeout  time.Duration
+	flows    map[string]*Flow
+	isClosed bool
+}
+
+// NewChain returns a new chain of the hooks, which closes flows idle for the timeout.
+func NewChain(hooks []Hook, timeout time.Duration) *Chain {
+	return &Chain{
+		hooks:   hooks,
+		timeout: timeout,
+		flows:   make(map[string]*Flow),
+	}
+}
+
+// Packet passes a packet of the flow between the source and the destination to hooks, and returns if the packet is
+// allowed by all of them, and if the packet is the first one of the flow. The direction is from the view of the source.
+func (c *Chain) Packet(protocol, src, dst string, direction stat.Direction, data []byte) (bool, bool) {
+	key := strings.Join([]string{protocol, src, dst}, " ")
+	now := time.Now()
+
+	c.lock.Lock()
+	flow, ok := c.flows[key]
+	if !ok {
+		flow = &Flow{
+			Protocol: protocol,
+			Src:      src,
+			Dst:      dst,
+			Start:    now,
+		}
+		c.flows[key] = flow
+	}
+	flow.LastSeen = now
+	switch direction {
+	case stat.DirectionIn:
+		flow.InCount++
+		flow.InSize += uint64(len(data))
+	case stat.DirectionOut:
+		flow.OutCount++
+		flow.OutSize += uint64(len(data))
+	default:
+		c.lock.Unlock()
+		panic(fmt.Errorf("direction %d out of range", direction))
+	}
+	copied := *flow
+	c.lock.Unlock()
+
+	if !ok {
+		for _, h := range c.hooks {
+			c.call(func() { h.OnFlowCreated(copied) })
+		}
+	}
+
+	allowed := true
+	for _, h := range c.hooks {
+		c.call(func() {
+			if !h.OnPacket(copied, direction, data) {
+				allowed = false
+			}
+		})
+		if !allowed {
+			break
+		}
+	}
+
+	return allowed, !ok
+}
+
+// Error passes an error in handling packets to hooks which implement ErrorHook.
+func (c *Chain) Error(err error) {
+	for _, h := range c.hooks {
+		eh, ok := h.(ErrorHook)
+		if !ok {
+			continue
+		}
+		c.call(func() { eh.OnError(err) })
+	}
+}
+
+// Sweep closes flows idle for the timeout and returns the number of closed flows.
+func (c *Chain) Sweep() int {
+	now := time.Now()
+	closed := make([]Flow, 0)
+
+	c.lock.Lock()
+	for key, flow := range c.flows {
+		if now.Sub(flow.LastSeen) > c.timeout {
+			closed = append(closed, *flow)
+			delete(c.flows, key)
+		}
+	}
+	c.lock.Unlock()
+
+	c.closeFlows(closed)
+
+	return len(closed)
+}
+
+// Run sweeps flows in every interval until the chain is closed.
+func (c *Chain) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.lock.Lock()
+		isClosed := c.isClosed
+		c.lock.Unlock()
+		if isClosed {
+			return
+		}
+
+		c.Sweep()
+	}
+}
+
+// Close closes all flows and stops sweeping.
+func (c *Chain) Close() {
+	closed := make([]Flow, 0)
+
+	c.lock.Lock()
+	c.isClosed = true
+	for _, flow := range c.flows {
+		closed = append(closed, *flow)
+	}
+	c.flows = make(map[string]*Flow)
+	c.lock.Unlock()
+
+	c.closeFlows(closed)
+}
+
+func (c *Chain) closeFlows(flows []Flow) {
+	for _, flow := range flows {
+		flow := flow
+		for _, h := range c.hooks {
+			c.call(func() { h.OnFlowClosed(flow) })
+		}
+	}
+}
+
+// call calls the function of a hook, and recovers from its panics so a broken hook does not bring IkaGo down.
+func (c *Chain) call(f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorln(fmt.Errorf("hook: %v", r))
+		}
+	}()
+
+	f()
+}
@@ -0,0 +1,223 @@
+package hook
+
+import (
+	"encoding/binary"
+	"fmt"
+	"ikago/internal/log"
+	"ikago/internal/nat"
+	"ikago/internal/stat"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ipfixVersion is the version of IPFIX in the message header.
+	ipfixVersion = 10
+	// ipfixTemplateSetId is the set Id of template sets.
+	ipfixTemplateSetId = 2
+	// ipfixIPv4TemplateId is the template Id of flow records in IPv4.
+	ipfixIPv4TemplateId = 256
+	// ipfixIPv6TemplateId is the template Id of flow records in IPv6.
+	ipfixIPv6TemplateId = 257
+)
+
+// ipfixField describes a field of a template by its information element and length.
+type ipfixField struct {
+	id     uint16
+	length uint16
+}
+
+// ipfixTemplate returns fields of flow records in the length of IPs, with addresses, ports, protocol, counters, start
+// and end times and direction.
+func ipfixTemplate(ipLength uint16) []ipfixField {
+	src, dst := uint16(8), uint16(12)
+	if ipLength == net.IPv6len {
+		src, dst = 27, 28
+	}
+
+	return []ipfixField{
+		{src, ipLength},
+		{dst, ipLength},
+		// sourceTransportPort and destinationTransportPort
+		{7, 2},
+		{11, 2},
+		// protocolIdentifier
+		{4, 1},
+		// octetDeltaCount and packetDeltaCount
+		{1, 8},
+		{2, 8},
+		// flowStartMilliseconds and flowEndMilliseconds
+		{152, 8},
+		{153, 8},
+		// flowDirection
+		{61, 1},
+	}
+}
+
+// ipfixExporter describes a hook which exports a record of each direction of each flow in IPFIX to a collector when
+// the flow is closed.
+type ipfixExporter struct {
+	lock sync.Mutex
+	conn net.Conn
+	seq  uint32
+}
+
+// NewIPFIX returns a new hook which exports flows in IPFIX over UDP to the collector, so tunneled traffic can be
+// accounted by existing tooling of operators. Each closed flow is exported in a message with templates, as the
+// collector may start after IkaGo.
+func NewIPFIX(collector string) (Hook, error) {
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", collector, err)
+	}
+
+	return &ipfixExporter{conn: conn}, nil
+}
+
+func (h *ipfixExporter) OnFlowCreated(flow Flow) {}
+
+func (h *ipfixExporter) OnFlowClosed(flow Flow) {
+	err := h.export(flow)
+	if err != nil {
+		log.Errorln(fmt.Errorf("export flow %s in ipfix: %w", flow, err))
+	}
+}
+
+func (h *ipfixExporter) OnPacket(flow Flow, direction stat.Direction, data []byte) bool {
+	return true
+}
+
+func (h *ipfixExporter) export(flow Flow) error {
+	src, err := parseEndpoint(flow.Src)
+	if err != nil {
+		return fmt.Errorf("parse source: %w", err)
+	}
+	dst, err := parseEndpoint(flow.Dst)
+	if err != nil {
+		return fmt.Errorf("parse destination: %w", err)
+	}
+
+	// Ports are only for TCP and UDP, and the protocol of others is in their addresses
+	var protocol uint8
+	switch flow.Protocol {
+	case "TCP":
+		protocol = 6
+	case "UDP":
+		protocol = 17
+	case "ICMPv4":
+		protocol, src.Port, dst.Port = 1, 0, 0
+	case "ICMPv6":
+		protocol, src.Port, dst.Port = 58, 0, 0
+	default:
+		if strings.Contains(flow.Dst, "#") {
+			protocol = uint8(dst.Port)
+		}
+		src.Port, dst.Port = 0, 0
+	}
+
+	templateId, ipLength := uint16(ipfixIPv4TemplateId), net.IPv4len
+	if src.IPAddr().To4() == nil || dst.IPAddr().To4() == nil {
+		templateId, ipLength = ipfixIPv6TemplateId, net.IPv6len
+	}
+
+	// Records of outbound and inbound directions of the source, which are ingress and egress of IkaGo
+	records := make([]byte, 0)
+	n := uint32(0)
+	for _, r := range []struct {
+		src, dst    nat.Endpoint
+		size, count uint64
+		direction   uint8
+	}{
+		{src, dst, flow.OutSize, flow.OutCount, 0},
+		{dst, src, flow.InSize, flow.InCount, 1},
+	} {
+		if r.count <= 0 {
+			continue
+		}
+
+		record := make([]byte, 2*ipLength+2+2+1+8+8+8+8+1)
+		i := copy(record, ipOf(r.src, ipLength))
+		i = i + copy(record[i:], ipOf(r.dst, ipLength))
+		binary.BigEndian.PutUint16(record[i:], r.src.Port)
+		binary.BigEndian.PutUint16(record[i+2:], r.dst.Port)
+		record[i+4] = protocol
+		binary.BigEndian.PutUint64(record[i+5:], r.size)
+		binary.BigEndian.PutUint64(record[i+13:], r.count)
+		binary.BigEndian.PutUint64(record[i+21:], uint64(flow.Start.UnixNano()/int64(time.Millisecond)))
+		binary.BigEndian.PutUint64(record[i+29:], uint64(flow.LastSeen.UnixNano()/int64(time.Millisecond)))
+		record[i+37] = r.direction
+
+		records = append(records, record...)
+		n++
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	_, err = h.conn.Write(h.message(templateId, ipLength, records))
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	h.seq = h.seq + n
+
+	return nil
+}
+
+// message returns a message with the template set of the template and the data set of the records.
+func (h *ipfixExporter) message(templateId uint16, ipLength int, records []byte) []byte {
+	fields := ipfixTemplate(uint16(ipLength))
+
+	// Template set
+	templateSet := make([]byte, 4+4+4*len(fields))
+	binary.BigEndian.PutUint16(templateSet, ipfixTemplateSetId)
+	binary.BigEndian.PutUint16(templateSet[2:], uint16(len(templateSet)))
+	binary.BigEndian.PutUint16(templateSet[4:], templateId)
+	binary.BigEndian.PutUint16(templateSet[6:], uint16(len(fields)))
+	for i, field := range fields {
+		binary.BigEndian.PutUint16(templateSet[8+4*i:], field.id)
+		binary.BigEndian.PutUint16(templateSet[10+4*i:], field.length)
+	}
+
+	// Data set
+	dataSet := make([]byte, 4, 4+len(records))
+	binary.BigEndian.PutUint16(dataSet, templateId)
+	binary.BigEndian.PutUint16(dataSet[2:], uint16(4+len(records)))
+	dataSet = append(dataSet, records...)
+
+	// Message header, whose sequence number is the number of data records exported before
+	header := make([]byte, 16)
+	binary.BigEndian.PutUint16(header, ipfixVersion)
+	binary.BigEndian.PutUint16(header[2:], uint16(16+len(templateSet)+len(dataSet)))
+	binary.BigEndian.PutUint32(header[4:], uint32(time.Now().Unix()))
+	binary.BigEndian.PutUint32(header[8:], h.seq)
+
+	result := append(header, templateSet...)
+
+	return append(result, dataSet...)
+}
+
+// parseEndpoint returns the end point of the address, which is only an IP in fragments and ICMP errors.
+func parseEndpoint(s string) (nat.Endpoint, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		var e nat.Endpoint
+		copy(e.IP[:], ip.To16())
+
+		return e, nil
+	}
+
+	return nat.ParseEndpoint(s)
+}
+
+// ipOf returns the IP of the end point in the length.
+func ipOf(e nat.Endpoint, length int) []byte {
+	if length == net.IPv4len {
+		return e.IPAddr().To4()
+	}
+
+	return e.IPAddr().To16()
+}
@@ -0,0 +1,27 @@
+// +build linux,cgo darwin,cgo
+
+package hook
+
+import (
+	"fmt"
+	"plugin"
+)
+
+func lookup(path string) (func(string) (Hook, error), error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+
+	sym, err := p.Lookup("New")
+	if err != nil {
+		return nil, fmt.Errorf("lookup: %w", err)
+	}
+
+	f, ok := sym.(func(string) (Hook, error))
+	if !ok {
+		return nil, fmt.Errorf("type %T of New not support", sym)
+	}
+
+	return f, nil
+}
@@ -0,0 +1,12 @@
+// +build !linux,!darwin !cgo
+
+package hook
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func lookup(path string) (func(string) (Hook, error), error) {
+	return nil, fmt.Errorf("plugin not support in os %s or without cgo", runtime.GOOS)
+}
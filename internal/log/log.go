@@ -1,17 +1,68 @@
 package log
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const warnLogFileSize int64 = 200 * 1024 * 1024
 
+// Level describes the severity of a message.
+type Level int
+
+const (
+	// LevelDebug describes verbose messages which are printed only if verbose message is allowed to print.
+	LevelDebug Level = iota
+	// LevelInfo describes informational messages.
+	LevelInfo
+	// LevelWarn describes messages of recoverable problems.
+	LevelWarn
+	// LevelError describes messages of errors.
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+}
+
+// ParseLevel returns the level of the name.
+func ParseLevel(s string) (Level, error) {
+	for l := LevelDebug; l <= LevelError; l++ {
+		if s == l.String() {
+			return l, nil
+		}
+	}
+
+	return 0, fmt.Errorf("level %s not support", s)
+}
+
 var (
-	allowVerbose bool
+	minLevel  int32
+	allowJSON bool
+)
+
+var (
+	isQuiet     int32
+	sampleRate  uint32
+	sampleCount uint32
 )
 
 var (
@@ -30,28 +81,70 @@ func (l *logger) output(s string) error {
 	_, err := l.out.Write([]byte(s))
 	l.lock.Unlock()
 
-	if logLogger != nil {
-		logLogger.Output(2, s)
-	}
-
 	return err
 }
 
+type entry struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Module  string `json:"module,omitempty"`
+	Message string `json:"message"`
+}
+
 func init() {
-	allowVerbose = false
+	minLevel = int32(LevelInfo)
+	allowJSON = false
+	sampleRate = 1
 	outLogger = &logger{out: os.Stdout}
 	errLogger = &logger{out: os.Stderr}
 }
 
 // SetVerbose sets the state if verbose message is allowed to print.
 func SetVerbose(allow bool) {
-	allowVerbose = allow
+	if allow {
+		SetLevel(LevelDebug)
+	} else {
+		SetLevel(LevelInfo)
+	}
+}
+
+// SetLevel sets the min level of messages to print. It is safe to be called at runtime.
+func SetLevel(l Level) {
+	atomic.StoreInt32(&minLevel, int32(l))
+}
+
+// CurrentLevel returns the min level of messages to print.
+func CurrentLevel() Level {
+	return Level(atomic.LoadInt32(&minLevel))
+}
+
+// SetJSON sets the state if message is printed in JSON, one object per line.
+func SetJSON(allow bool) {
+	allowJSON = allow
+}
+
+// SetQuiet sets the state if per-packet messages are suppressed. It is safe to be called at runtime.
+func SetQuiet(allow bool) {
+	if allow {
+		atomic.StoreInt32(&isQuiet, 1)
+	} else {
+		atomic.StoreInt32(&isQuiet, 0)
+	}
+}
+
+// SetSample sets per-packet messages are printed 1 in n, except messages of the first packets of flows which are
+// always printed. Set 0 or 1 to print all of them.
+func SetSample(n int) {
+	if n < 1 {
+		n = 1
+	}
+	atomic.StoreUint32(&sampleRate, uint32(n))
 }
 
 // SetLog sets the path of log file.
 func SetLog(path string) error {
 	if path != "" {
-		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 755)
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 		if err != nil {
 			return fmt.Errorf("open: %w", err)
 		}
@@ -62,7 +155,7 @@ func SetLog(path string) error {
 		}
 
 		if stat.Size() > warnLogFileSize {
-			Infof("The log file is too large. You may delete %s manually to save disk space.\n", path)
+			Warnf("The log file is too large. You may delete %s manually to save disk space.\n", path)
 		}
 
 		logLogger = log.New(file, "", log.LstdFlags)
@@ -71,70 +164,131 @@ func SetLog(path string) error {
 	return nil
 }
 
-// Verbosef prints message to the stdout if verbose message is allowed to print. Arguments are handled in the manner of fmt.Printf.
-func Verbosef(format string, v ...interface{}) {
-	s := fmt.Sprintf(format, v...)
+func output(level Level, module, s string) {
+	if allowJSON {
+		b, err := json.Marshal(&entry{
+			Time:    time.Now().Format(time.RFC3339),
+			Level:   level.String(),
+			Module:  module,
+			Message: strings.TrimRight(s, "\n"),
+		})
+		if err != nil {
+			return
+		}
+		s = string(b) + "\n"
+	} else if module != "" {
+		s = fmt.Sprintf("[%s] %s", module, s)
+	}
 
-	if allowVerbose {
-		outLogger.output(s)
+	if level >= CurrentLevel() {
+		l := errLogger
+		if level <= LevelInfo {
+			l = outLogger
+		}
+
+		if allowJSON {
+			l.output(s)
+		} else if isColor {
+			writeTerminal(l, levelTag(level)+s)
+		} else {
+			writeTerminal(l, s)
+		}
 	}
-	if !allowVerbose && logLogger != nil {
-		logLogger.Output(2, s)
+
+	if logLogger != nil {
+		if allowJSON {
+			logLogger.Writer().Write([]byte(s))
+		} else {
+			logLogger.Output(3, s)
+		}
 	}
 }
 
+// Verbosef prints message to the stdout if verbose message is allowed to print. Arguments are handled in the manner of fmt.Printf.
+func Verbosef(format string, v ...interface{}) {
+	output(LevelDebug, "", fmt.Sprintf(format, v...))
+}
+
 // Verbose prints message to the stdout if verbose message is allowed to print. Arguments are handled in the manner of fmt.Print.
 func Verbose(v ...interface{}) {
-	s := fmt.Sprint(v...)
-
-	if allowVerbose {
-		outLogger.output(s)
-	}
-	if !allowVerbose && logLogger != nil {
-		logLogger.Output(2, s)
-	}
+	output(LevelDebug, "", fmt.Sprint(v...))
 }
 
 // Verboseln prints message to the stdout if verbose message is allowed to print. Arguments are handled in the manner of fmt.Println.
 func Verboseln(v ...interface{}) {
-	s := fmt.Sprintln(v...)
+	output(LevelDebug, "", fmt.Sprintln(v...))
+}
 
-	if allowVerbose {
-		outLogger.output(s)
+// Packetf prints a per-packet message to the stdout if verbose message is allowed to print, IkaGo is not quiet and the
+// message is sampled. The first describes if the packet is the first one of its flow. Messages which are not printed
+// are not formatted. Arguments are handled in the manner of fmt.Printf.
+func Packetf(first bool, format string, v ...interface{}) {
+	if !allowPacket(first) {
+		return
+	}
+
+	output(LevelDebug, "", fmt.Sprintf(format, v...))
+}
+
+func allowPacket(first bool) bool {
+	if atomic.LoadInt32(&isQuiet) != 0 {
+		return false
+	}
+	if CurrentLevel() > LevelDebug && logLogger == nil {
+		return false
 	}
-	if !allowVerbose && logLogger != nil {
-		logLogger.Output(2, s)
+
+	rate := atomic.LoadUint32(&sampleRate)
+	if first || rate <= 1 {
+		return true
 	}
+
+	return atomic.AddUint32(&sampleCount, 1)%rate == 0
 }
 
 // Infof prints message to the stdout. Arguments are handled in the manner of fmt.Printf.
 func Infof(format string, v ...interface{}) {
-	outLogger.output(fmt.Sprintf(format, v...))
+	output(LevelInfo, "", fmt.Sprintf(format, v...))
 }
 
 // Info prints message to the stdout. Arguments are handled in the manner of fmt.Print.
 func Info(v ...interface{}) {
-	outLogger.output(fmt.Sprint(v...))
+	output(LevelInfo, "", fmt.Sprint(v...))
 }
 
 // Infoln prints message to the stdout. Arguments are handled in the manner of fmt.Println.
 func Infoln(v ...interface{}) {
-	outLogger.output(fmt.Sprintln(v...))
+	output(LevelInfo, "", fmt.Sprintln(v...))
+}
+
+// Warnf prints message to the stderr. Arguments are handled in the manner of fmt.Printf.
+func Warnf(format string, v ...interface{}) {
+	output(LevelWarn, "", fmt.Sprintf(format, v...))
+}
+
+// Warn prints message to the stderr. Arguments are handled in the manner of fmt.Print.
+func Warn(v ...interface{}) {
+	output(LevelWarn, "", fmt.Sprint(v...))
+}
+
+// Warnln prints message to the stderr. Arguments are handled in the manner of fmt.Println.
+func Warnln(v ...interface{}) {
+	output(LevelWarn, "", fmt.Sprintln(v...))
 }
 
 // Errorf prints message to the stderr. Arguments are handled in the manner of fmt.Printf.
 func Errorf(format string, v ...interface{}) {
-	errLogger.output(fmt.Sprintf(format, v...))
+	output(LevelError, "", fmt.Sprintf(format, v...))
 }
 
 // Error prints message to the stderr. Arguments are handled in the manner of fmt.Print.
 func Error(v ...interface{}) {
-	errLogger.output(fmt.Sprint(v...))
+	output(LevelError, "", fmt.Sprint(v...))
 }
 
-// Errorln prints message to the stderr. Arguments are handled in the manner of fmt.Printf.
+// Errorln prints message to the stderr. Arguments are handled in the manner of fmt.Println.
 func Errorln(v ...interface{}) {
-	errLogger.output(fmt.Sprintln(v...))
+	output(LevelError, "", fmt.Sprintln(v...))
 }
 
 // Fatalf prints message to the stderr, and ends with os.Exit(1). Arguments are handled in the manner of fmt.Printf.
@@ -154,3 +308,53 @@ func Fatalln(v ...interface{}) {
 	Errorln(v...)
 	os.Exit(1)
 }
+
+// Logger describes a logger of a module, which prefixes messages with the name of the module.
+type Logger struct {
+	module string
+}
+
+// New returns a new logger of the module.
+func New(module string) *Logger {
+	return &Logger{module: module}
+}
+
+// Verbosef prints message to the stdout if verbose message is allowed to print. Arguments are handled in the manner of fmt.Printf.
+func (l *Logger) Verbosef(format string, v ...interface{}) {
+	output(LevelDebug, l.module, fmt.Sprintf(format, v...))
+}
+
+// Verboseln prints message to the stdout if verbose message is allowed to print. Arguments are handled in the manner of fmt.Println.
+func (l *Logger) Verboseln(v ...interface{}) {
+	output(LevelDebug, l.module, fmt.Sprintln(v...))
+}
+
+// Infof prints message to the stdout. Arguments are handled in the manner of fmt.Printf.
+func (l *Logger) Infof(format string, v ...interface{}) {
+	output(LevelInfo, l.module, fmt.Sprintf(format, v...))
+}
+
+// Infoln prints message to the stdout. Arguments are handled in the manner of fmt.Println.
+func (l *Logger) Infoln(v ...interface{}) {
+	output(LevelInfo, l.module, fmt.Sprintln(v...))
+}
+
+// Warnf prints message to the stderr. Arguments are handled in the manner of fmt.Printf.
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	output(LevelWarn, l.module, fmt.Sprintf(format, v...))
+}
+
+// Warnln prints message to the stderr. Arguments are handled in the manner of fmt.Println.
+func (l *Logger) Warnln(v ...interface{}) {
+	output(LevelWarn, l.module, fmt.Sprintln(v...))
+}
+
+// Errorf prints message to the stderr. Arguments are handled in the manner of fmt.Printf.
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	output(LevelError, l.module, fmt.Sprintf(format, v...))
+}
+
+// Errorln prints message to the stderr. Arguments are handled in the manner of fmt.Println.
+func (l *Logger) Errorln(v ...interface{}) {
+	output(LevelError, l.module, fmt.Sprintln(v...))
+}
@@ -0,0 +1,149 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// ColorMode describes when messages are colorized.
+type ColorMode int
+
+const (
+	// ColorModeAuto describes messages are colorized if the stdout is a terminal.
+	ColorModeAuto ColorMode = iota
+	// ColorModeAlways describes messages are always colorized.
+	ColorModeAlways
+	// ColorModeNever describes messages are never colorized.
+	ColorModeNever
+)
+
+func (mode ColorMode) String() string {
+	switch mode {
+	case ColorModeAuto:
+		return "auto"
+	case ColorModeAlways:
+		return "always"
+	case ColorModeNever:
+		return "never"
+	default:
+		return fmt.Sprintf("mode(%d)", int(mode))
+	}
+}
+
+// ParseColorMode returns the color mode of the name.
+func ParseColorMode(s string) (ColorMode, error) {
+	switch s {
+	case "", "auto":
+		return ColorModeAuto, nil
+	case "always":
+		return ColorModeAlways, nil
+	case "never":
+		return ColorModeNever, nil
+	default:
+		return 0, fmt.Errorf("mode %s not support", s)
+	}
+}
+
+const (
+	escClearLine = "\r\033[K"
+	escReset     = "\033[0m"
+)
+
+var (
+	isColor bool
+	// isEscape is if escape sequences are supported by the stdout, which is a terminal and not the console of Windows,
+	// which may not support them
+	isEscape = IsTerminal() && runtime.GOOS != "windows"
+
+	// termLock guards the status line, which is cleared before messages and redrawn after them
+	termLock    sync.Mutex
+	status      string
+	isStatusOff bool
+)
+
+// IsTerminal returns if the stdout is a terminal.
+func IsTerminal() bool {
+	stat, err := os.Stdout.Stat()
+	if err != nil {
+		return false
+	}
+
+	return stat.Mode()&os.ModeCharDevice != 0
+}
+
+// SetColor sets when levels of messages to the stdout and the stderr are colorized and aligned. Messages are never
+// colorized in JSON, and are not colorized in auto if NO_COLOR is set or in Windows, whose console may not support
+// escape sequences.
+func SetColor(mode ColorMode) {
+	switch mode {
+	case ColorModeAlways:
+		isColor = true
+	case ColorModeNever:
+		isColor = false
+	default:
+		isColor = isEscape && os.Getenv("NO_COLOR") == ""
+	}
+}
+
+// SetStatus sets the status line kept at the bottom of the terminal below messages. The status line is only shown
+// if the stdout is a terminal other than the console of Windows and messages are not printed in JSON. Set empty to
+// remove it.
+func SetStatus(s string) {
+	if allowJSON || !isEscape {
+		return
+	}
+
+	termLock.Lock()
+	defer termLock.Unlock()
+
+	if isStatusOff {
+		return
+	}
+
+	status = s
+	os.Stdout.WriteString(escClearLine + status)
+}
+
+// StopStatus removes the status line, and the status line is not shown any more.
+func StopStatus() {
+	termLock.Lock()
+	defer termLock.Unlock()
+
+	if status != "" {
+		os.Stdout.WriteString(escClearLine)
+	}
+	status = ""
+	isStatusOff = true
+}
+
+// levelTag returns the colorized tag of the level in the same width.
+func levelTag(level Level) string {
+	switch level {
+	case LevelDebug:
+		return "\033[90mDEBUG" + escReset + " "
+	case LevelInfo:
+		return "\033[36mINFO " + escReset + " "
+	case LevelWarn:
+		return "\033[33mWARN " + escReset + " "
+	case LevelError:
+		return "\033[31mERROR" + escReset + " "
+	default:
+		return ""
+	}
+}
+
+// writeTerminal writes the message to the logger below which the status line is redrawn.
+func writeTerminal(l *logger, s string) {
+	termLock.Lock()
+	defer termLock.Unlock()
+
+	if status != "" {
+		os.Stdout.WriteString(escClearLine)
+	}
+	l.output(s)
+	if status != "" {
+		os.Stdout.WriteString(status)
+	}
+}
@@ -0,0 +1,63 @@
+package nat
+
+import "fmt"
+
+// Behavior describes the behavior of NAT in mapping and filtering.
+type Behavior int
+
+const (
+	// BehaviorFullCone describes endpoint-independent mapping and endpoint-independent filtering.
+	BehaviorFullCone Behavior = iota
+	// BehaviorAddressRestricted describes endpoint-independent mapping and address-dependent filtering.
+	BehaviorAddressRestricted
+	// BehaviorPortRestricted describes endpoint-independent mapping and address and port-dependent filtering.
+	BehaviorPortRestricted
+	// BehaviorSymmetric describes address and port-dependent mapping and address and port-dependent filtering.
+	BehaviorSymmetric
+)
+
+func (b Behavior) String() string {
+	switch b {
+	case BehaviorFullCone:
+		return "full-cone"
+	case BehaviorAddressRestricted:
+		return "address-restricted"
+	case BehaviorPortRestricted:
+		return "port-restricted"
+	case BehaviorSymmetric:
+		return "symmetric"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(b))
+	}
+}
+
+// ParseBehavior returns the behavior of NAT by given string.
+func ParseBehavior(s string) (Behavior, error) {
+	switch s {
+	case "", "full-cone":
+		return BehaviorFullCone, nil
+	case "address-restricted":
+		return BehaviorAddressRestricted, nil
+	case "port-restricted":
+		return BehaviorPortRestricted, nil
+	case "symmetric":
+		return BehaviorSymmetric, nil
+	default:
+		return 0, fmt.Errorf("nat %s not support", s)
+	}
+}
+
+// IsAddressDependentMapping returns if mappings depend on addresses and ports of remotes.
+func (b Behavior) IsAddressDependentMapping() bool {
+	return b == BehaviorSymmetric
+}
+
+// IsFiltering returns if packets from remotes are filtered.
+func (b Behavior) IsFiltering() bool {
+	return b != BehaviorFullCone
+}
+
+// IsPortDependentFiltering returns if packets from remotes are filtered by their ports as well as their addresses.
+func (b Behavior) IsPortDependentFiltering() bool {
+	return b == BehaviorPortRestricted || b == BehaviorSymmetric
+}
@@ -0,0 +1,158 @@
+package nat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"ikago/internal/addr"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Endpoint describes an end point of a flow by its IP and its port, ICMP query Id or IP protocol. IPv4 addresses are
+// stored in their IPv4-mapped IPv6 form, so an IPv4 address and its mapped form are the same end point.
+type Endpoint struct {
+	IP   [16]byte
+	Port uint16
+}
+
+// NewEndpoint returns the end point of the address, which is a TCP, UDP, ICMP query or IP protocol address.
+func NewEndpoint(a net.Addr) (Endpoint, error) {
+	var e Endpoint
+
+	var ip net.IP
+	switch t := a.(type) {
+	case *net.TCPAddr:
+		ip, e.Port = t.IP, uint16(t.Port)
+	case *net.UDPAddr:
+		ip, e.Port = t.IP, uint16(t.Port)
+	case *addr.ICMPQueryAddr:
+		ip, e.Port = t.IP, t.Id
+	case *addr.IPProtocolAddr:
+		ip, e.Port = t.IP, uint16(t.Protocol)
+	case *net.IPAddr:
+		ip = t.IP
+	default:
+		return ParseEndpoint(a.String())
+	}
+
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return Endpoint{}, fmt.Errorf("invalid ip %s", ip)
+	}
+	copy(e.IP[:], ip16)
+
+	return e, nil
+}
+
+// ParseEndpoint returns the end point by the given address, like 1.2.3.4:80, 1.2.3.4@1 of an ICMP query or 1.2.3.4#47
+// of an IP protocol.
+func ParseEndpoint(s string) (Endpoint, error) {
+	var (
+		e       Endpoint
+		host    string
+		portStr string
+		err     error
+	)
+
+	if i := strings.LastIndexAny(s, "@#"); i >= 0 {
+		host, portStr = strings.Trim(s[:i], "[]"), s[i+1:]
+	} else {
+		host, portStr, err = net.SplitHostPort(s)
+		if err != nil {
+			return Endpoint{}, fmt.Errorf("split host port: %w", err)
+		}
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return Endpoint{}, fmt.Errorf("invalid ip %s", host)
+	}
+	copy(e.IP[:], ip.To16())
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return Endpoint{}, fmt.Errorf("parse port %s: %w", portStr, err)
+	}
+	e.Port = uint16(port)
+
+	return e, nil
+}
+
+// IsZero returns if the end point is unspecified.
+func (e Endpoint) IsZero() bool {
+	return e == Endpoint{}
+}
+
+// IPAddr returns the IP of the end point, which is in 4 bytes for IPv4 addresses.
+func (e Endpoint) IPAddr() net.IP {
+	ip := net.IP(append([]byte(nil), e.IP[:]...))
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+
+	return ip
+}
+
+func (e Endpoint) String() string {
+	return net.JoinHostPort(e.IPAddr().String(), strconv.Itoa(int(e.Port)))
+}
+
+// Flow describes a flow in NAT by its source, the client it is from and the remote it is to, which is only set if
+// mappings depend on remotes. Flows are comparable, so they are used as keys of maps without allocations.
+type Flow struct {
+	Src      Endpoint
+	Dst      Endpoint
+	Remote   Endpoint
+	Protocol gopacket.LayerType
+}
+
+// Addr returns the address of the end point in the protocol of the flow.
+func (f Flow) Addr(e Endpoint) net.Addr {
+	switch f.Protocol {
+	case layers.LayerTypeTCP:
+		return &net.TCPAddr{IP: e.IPAddr(), Port: int(e.Port)}
+	case layers.LayerTypeUDP:
+		return &net.UDPAddr{IP: e.IPAddr(), Port: int(e.Port)}
+	case layers.LayerTypeICMPv4, layers.LayerTypeICMPv6:
+		return &addr.ICMPQueryAddr{IP: e.IPAddr(), Id: e.Port}
+	default:
+		return &addr.IPProtocolAddr{IP: e.IPAddr(), Protocol: uint8(e.Port)}
+	}
+}
+
+// Hash returns the 32-bit FNV-1a hash of the flow, which is independent of the byte order and the layout of the
+// platform, like for choosing shards of tables.
+func (f Flow) Hash() uint32 {
+	const (
+		offset = 2166136261
+		prime  = 16777619
+	)
+
+	var b [2*(16+2) + 16 + 2 + 4]byte
+	n := copy(b[:], f.Src.IP[:])
+	binary.BigEndian.PutUint16(b[n:], f.Src.Port)
+	n = n + 2
+	n = n + copy(b[n:], f.Dst.IP[:])
+	binary.BigEndian.PutUint16(b[n:], f.Dst.Port)
+	n = n + 2
+	n = n + copy(b[n:], f.Remote.IP[:])
+	binary.BigEndian.PutUint16(b[n:], f.Remote.Port)
+	n = n + 2
+	binary.BigEndian.PutUint32(b[n:], uint32(f.Protocol))
+
+	h := uint32(offset)
+	for _, c := range b {
+		h = h ^ uint32(c)
+		h = h * prime
+	}
+
+	return h
+}
+
+func (f Flow) String() string {
+	return fmt.Sprintf("%s %s <-> %s", f.Protocol, f.Addr(f.Src), f.Dst)
+}
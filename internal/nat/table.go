@@ -0,0 +1,256 @@
+package nat
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Entry describes a mapping in the NAT table.
+type Entry struct {
+	Key      interface{}
+	Value    interface{}
+	LastSeen time.Time
+	// TTL overrides the TTL of the table for the entry if it is not 0
+	TTL time.Duration
+}
+
+// Table describes a NAT table. Entries not used in the TTL are expired, and the least recently used entry is evicted
+// if the table is full.
+type Table struct {
+	lock     sync.Mutex
+	ttl      time.Duration
+	max      int
+	entries  map[interface{}]*list.Element
+	lru      *list.List
+	isClosed bool
+	// hasTTLs is set once an entry overrides the TTL, so entries are not expired in the order of the LRU
+	hasTTLs bool
+}
+
+// NewTable returns a new NAT table. A max of 0 means the number of entries is unlimited.
+func NewTable(ttl time.Duration, max int) *Table {
+	return &Table{
+		ttl:     ttl,
+		max:     max,
+		entries: make(map[interface{}]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Get returns the value of the key and refreshes the entry.
+func (t *Table) Get(key interface{}) (interface{}, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	elem, ok := t.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*Entry)
+	now := time.Now()
+	if t.isExpired(entry, now) {
+		t.remove(elem)
+		return nil, false
+	}
+
+	entry.LastSeen = now
+	t.lru.MoveToFront(elem)
+
+	return entry.Value, true
+}
+
+// Set sets the value of the key, and evicts the least recently used entry if the table is full.
+func (t *Table) Set(key, value interface{}) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+
+	elem, ok := t.entries[key]
+	if ok {
+		entry := elem.Value.(*Entry)
+		entry.Value = value
+		entry.LastSeen = now
+		t.lru.MoveToFront(elem)
+		return
+	}
+
+	for t.max > 0 && t.lru.Len() >= t.max {
+		t.remove(t.lru.Back())
+	}
+
+	t.entries[key] = t.lru.PushFront(&Entry{
+		Key:      key,
+		Value:    value,
+		LastSeen: now,
+	})
+}
+
+// SetTTL overrides the TTL of the entry of the key, and returns if the entry exists. A TTL of 0 restores the TTL of
+// the table.
+func (t *Table) SetTTL(key interface{}, ttl time.Duration) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	elem, ok := t.entries[key]
+	if !ok {
+		return false
+	}
+
+	elem.Value.(*Entry).TTL = ttl
+	if ttl > 0 {
+		t.hasTTLs = true
+	}
+
+	return true
+}
+
+// Restore adds an entry of the key with the time it was last seen, like one saved before a restart, as the least
+// recently used entry. The entry is skipped if it is expired or the table is full.
+func (t *Table) Restore(key, value interface{}, lastSeen time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.ttl > 0 && time.Since(lastSeen) > t.ttl {
+		return
+	}
+	if t.max > 0 && t.lru.Len() >= t.max {
+		return
+	}
+	_, ok := t.entries[key]
+	if ok {
+		return
+	}
+
+	t.entries[key] = t.lru.PushBack(&Entry{
+		Key:      key,
+		Value:    value,
+		LastSeen: lastSeen,
+	})
+}
+
+// Delete deletes the entry of the key.
+func (t *Table) Delete(key interface{}) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	elem, ok := t.entries[key]
+	if ok {
+		t.lru.Remove(elem)
+		delete(t.entries, key)
+	}
+}
+
+// Len returns the number of entries.
+func (t *Table) Len() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.lru.Len()
+}
+
+// Sweep removes expired entries and returns the number of removed entries.
+func (t *Table) Sweep() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.ttl <= 0 && !t.hasTTLs {
+		return 0
+	}
+
+	now := time.Now()
+	n := 0
+
+	// Entries overriding the TTL may expire in any order
+	if t.hasTTLs {
+		for elem := t.lru.Back(); elem != nil; {
+			prev := elem.Prev()
+			if t.isExpired(elem.Value.(*Entry), now) {
+				t.remove(elem)
+				n++
+			}
+			elem = prev
+		}
+
+		return n
+	}
+
+	for elem := t.lru.Back(); elem != nil; elem = t.lru.Back() {
+		if now.Sub(elem.Value.(*Entry).LastSeen) <= t.ttl {
+			break
+		}
+
+		t.remove(elem)
+		n++
+	}
+
+	return n
+}
+
+// Run sweeps the table in every interval until the table is closed.
+func (t *Table) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		t.lock.Lock()
+		isClosed := t.isClosed
+		t.lock.Unlock()
+		if isClosed {
+			return
+		}
+
+		t.Sweep()
+	}
+}
+
+// Close stops sweeping the table.
+func (t *Table) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.isClosed = true
+}
+
+// Flush removes all entries and returns the number of removed entries.
+func (t *Table) Flush() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	n := t.lru.Len()
+	t.entries = make(map[interface{}]*list.Element)
+	t.lru.Init()
+
+	return n
+}
+
+// Dump returns copies of all entries from the most recently used one.
+func (t *Table) Dump() []Entry {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	result := make([]Entry, 0, t.lru.Len())
+	for elem := t.lru.Front(); elem != nil; elem = elem.Next() {
+		result = append(result, *elem.Value.(*Entry))
+	}
+
+	return result
+}
+
+func (t *Table) isExpired(entry *Entry, now time.Time) bool {
+	ttl := t.ttl
+	if entry.TTL > 0 {
+		ttl = entry.TTL
+	}
+
+	return ttl > 0 && now.Sub(entry.LastSeen) > ttl
+}
+
+func (t *Table) remove(elem *list.Element) {
+	entry := elem.Value.(*Entry)
+
+	t.lru.Remove(elem)
+	delete(t.entries, entry.Key)
+}
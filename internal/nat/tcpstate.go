@@ -0,0 +1,128 @@
+package nat
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// TCPState describes the state of a TCP connection in NAT, which is tracked by flags of its segments in both
+// directions.
+type TCPState int
+
+const (
+	// TCPStateNone is the state of connections whose handshakes are not seen.
+	TCPStateNone TCPState = iota
+	// TCPStateSynSent is the state of connections whose SYN is seen.
+	TCPStateSynSent
+	// TCPStateSynReceived is the state of connections whose SYN-ACK is seen.
+	TCPStateSynReceived
+	// TCPStateEstablished is the state of connections whose handshakes complete.
+	TCPStateEstablished
+	// TCPStateFinWait is the state of connections finished by either side.
+	TCPStateFinWait
+	// TCPStateClosed is the state of connections reset by either side.
+	TCPStateClosed
+)
+
+func (s TCPState) String() string {
+	switch s {
+	case TCPStateNone:
+		return "none"
+	case TCPStateSynSent:
+		return "syn-sent"
+	case TCPStateSynReceived:
+		return "syn-received"
+	case TCPStateEstablished:
+		return "established"
+	case TCPStateFinWait:
+		return "fin-wait"
+	case TCPStateClosed:
+		return "closed"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+// IsHalfOpen returns if the handshake of the connection is in progress.
+func (s TCPState) IsHalfOpen() bool {
+	return s == TCPStateSynSent || s == TCPStateSynReceived
+}
+
+var (
+	tcpAttempted   uint64
+	tcpEstablished uint64
+	tcpFailed      uint64
+)
+
+// Next returns the state after a segment with the flags in either direction, and counts handshakes attempted,
+// established and failed. Connections seen in the middle are regarded as established without being counted.
+func (s TCPState) Next(syn, ack, fin, rst bool) TCPState {
+	switch {
+	case rst:
+		if s.IsHalfOpen() {
+			atomic.AddUint64(&tcpFailed, 1)
+		}
+		return TCPStateClosed
+	case syn && !ack:
+		// Retransmitted SYNs are the same attempt
+		if s != TCPStateSynSent {
+			atomic.AddUint64(&tcpAttempted, 1)
+		}
+		return TCPStateSynSent
+	case syn:
+		if s == TCPStateSynSent {
+			return TCPStateSynReceived
+		}
+		return s
+	case fin:
+		if s == TCPStateClosed {
+			return s
+		}
+		if s == TCPStateSynReceived {
+			atomic.AddUint64(&tcpEstablished, 1)
+		}
+		return TCPStateFinWait
+	case ack:
+		switch s {
+		case TCPStateSynReceived:
+			atomic.AddUint64(&tcpEstablished, 1)
+			return TCPStateEstablished
+		case TCPStateNone:
+			return TCPStateEstablished
+		default:
+			return s
+		}
+	default:
+		return s
+	}
+}
+
+// TCPStats describes results of handshakes of TCP connections in NAT.
+type TCPStats struct {
+	Attempted   uint64 `json:"attempted"`
+	Established uint64 `json:"established"`
+	Failed      uint64 `json:"failed"`
+}
+
+// AllTCPStats returns results of handshakes of all TCP connections tracked.
+func AllTCPStats() TCPStats {
+	return TCPStats{
+		Attempted:   atomic.LoadUint64(&tcpAttempted),
+		Established: atomic.LoadUint64(&tcpEstablished),
+		Failed:      atomic.LoadUint64(&tcpFailed),
+	}
+}
+
+// SuccessRate returns the rate of handshakes established in attempted ones, 0 if there is no attempt.
+func (s TCPStats) SuccessRate() float64 {
+	if s.Attempted <= 0 {
+		return 0
+	}
+
+	return float64(s.Established) / float64(s.Attempted)
+}
+
+func (s TCPStats) String() string {
+	return fmt.Sprintf("%d/%d (%.1f%%) established, %d failed", s.Established, s.Attempted, s.SuccessRate()*100,
+		s.Failed)
+}
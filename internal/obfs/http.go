@@ -0,0 +1,60 @@
+package obfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+var crlf = []byte("\r\n")
+
+// HTTPObfs describes an obfs which wraps data as a chunk in HTTP chunked responses.
+type HTTPObfs struct {
+}
+
+// CreateHTTPObfs returns an HTTP obfs.
+func CreateHTTPObfs() *HTTPObfs {
+	return &HTTPObfs{}
+}
+
+func (o *HTTPObfs) Obfuscate(data []byte) ([]byte, error) {
+	size := strconv.FormatInt(int64(len(data)), 16)
+
+	result := make([]byte, 0, len(size)+len(data)+2*len(crlf))
+	result = append(result, size...)
+	result = append(result, crlf...)
+	result = append(result, data...)
+	result = append(result, crlf...)
+
+	return result, nil
+}
+
+func (o *HTTPObfs) Deobfuscate(data []byte) ([]byte, error) {
+	// Chunk size
+	i := bytes.Index(data, crlf)
+	if i < 0 {
+		return nil, errors.New("missing chunk size")
+	}
+	size, err := strconv.ParseUint(string(data[:i]), 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("parse chunk size: %w", err)
+	}
+
+	// Chunk data
+	data = data[i+len(crlf):]
+	if uint64(len(data)) != size+uint64(len(crlf)) || !bytes.HasSuffix(data, crlf) {
+		return nil, fmt.Errorf("chunk size %d mismatch", size)
+	}
+
+	return data[:size], nil
+}
+
+func (o *HTTPObfs) Method() Method {
+	return MethodHTTP
+}
+
+func (o *HTTPObfs) Cost() int {
+	// Chunk size of at most 4 hexadecimal digits and 2 CRLFs
+	return 8
+}
@@ -0,0 +1,26 @@
+package obfs
+
+// NoneObfs describes a none obfs which will not obfuscate the data.
+type NoneObfs struct {
+}
+
+// CreateNoneObfs returns a none obfs.
+func CreateNoneObfs() *NoneObfs {
+	return &NoneObfs{}
+}
+
+func (o *NoneObfs) Obfuscate(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (o *NoneObfs) Deobfuscate(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (o *NoneObfs) Method() Method {
+	return MethodNone
+}
+
+func (o *NoneObfs) Cost() int {
+	return 0
+}
@@ -0,0 +1,121 @@
+package obfs
+
+import (
+	"fmt"
+	"ikago/internal/crypto"
+	"strconv"
+	"strings"
+)
+
+// Method describes the method of the obfuscation.
+type Method int
+
+const (
+	// MethodNone describes the obfuscation is none which will not obfuscate the data.
+	MethodNone Method = iota
+	// MethodHTTP describes the obfuscation mimics HTTP chunked responses.
+	MethodHTTP
+	// MethodTLS describes the obfuscation mimics a TLS 1.3 record stream.
+	MethodTLS
+)
+
+func (m Method) String() string {
+	switch m {
+	case MethodNone:
+		return "None"
+	case MethodHTTP:
+		return "HTTP"
+	case MethodTLS:
+		return "TLS"
+	default:
+		return strconv.Itoa(int(m))
+	}
+}
+
+// Obfs describes obfs of obfuscation.
+type Obfs interface {
+	// Obfuscate returns the obfuscated data.
+	Obfuscate([]byte) ([]byte, error)
+	// Deobfuscate returns the deobfuscated data.
+	Deobfuscate([]byte) ([]byte, error)
+	// Method returns the method of obfs.
+	Method() Method
+	// Cost returns the size of cost.
+	Cost() int
+}
+
+// ParseObfs returns an obfs by given method.
+func ParseObfs(method string) (Obfs, error) {
+	switch strings.ToLower(method) {
+	case "", "none":
+		return CreateNoneObfs(), nil
+	case "http":
+		return CreateHTTPObfs(), nil
+	case "tls":
+		return CreateTLSObfs(), nil
+	default:
+		return nil, fmt.Errorf("obfs %s not support", method)
+	}
+}
+
+// Crypt describes a crypt which obfuscates the encrypted data.
+type Crypt struct {
+	crypt crypto.Crypt
+	obfs  Obfs
+}
+
+// WrapCrypt returns a crypt which obfuscates data encrypted by the crypt, or the crypt itself if the obfs is none.
+func WrapCrypt(crypt crypto.Crypt, obfs Obfs) crypto.Crypt {
+	if obfs.Method() == MethodNone {
+		return crypt
+	}
+
+	return &Crypt{
+		crypt: crypt,
+		obfs:  obfs,
+	}
+}
+
+func (c *Crypt) Encrypt(data []byte) ([]byte, error) {
+	data, err := c.crypt.Encrypt(data)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = c.obfs.Obfuscate(data)
+	if err != nil {
+		return nil, fmt.Errorf("obfuscate: %w", err)
+	}
+
+	return data, nil
+}
+
+func (c *Crypt) Decrypt(data []byte) ([]byte, error) {
+	data, err := c.obfs.Deobfuscate(data)
+	if err != nil {
+		return nil, fmt.Errorf("deobfuscate: %w", err)
+	}
+
+	return c.crypt.Decrypt(data)
+}
+
+func (c *Crypt) Method() crypto.Method {
+	return c.crypt.Method()
+}
+
+func (c *Crypt) Cost() int {
+	return c.crypt.Cost() + c.obfs.Cost()
+}
+
+// Clone returns a crypt which obfuscates data encrypted by a clone of the crypt.
+func (c *Crypt) Clone() crypto.Crypt {
+	return &Crypt{
+		crypt: crypto.Clone(c.crypt),
+		obfs:  c.obfs,
+	}
+}
+
+// Unwrap returns the crypt.
+func (c *Crypt) Unwrap() crypto.Crypt {
+	return c.crypt
+}
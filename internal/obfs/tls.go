@@ -0,0 +1,88 @@
+package obfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	tlsRecordHeaderSize      = 5
+	tlsRecordMaxSize         = 1 << 14
+	tlsContentTypeAppData    = 23
+	tlsLegacyRecordVersion   = 0x0303
+	tlsRecordMaxSizeExpanded = tlsRecordMaxSize + 256
+)
+
+// TLSObfs describes an obfs which wraps data as application data records in a TLS 1.3 record stream.
+type TLSObfs struct {
+}
+
+// CreateTLSObfs returns a TLS obfs.
+func CreateTLSObfs() *TLSObfs {
+	return &TLSObfs{}
+}
+
+func (o *TLSObfs) Obfuscate(data []byte) ([]byte, error) {
+	n := (len(data) + tlsRecordMaxSize - 1) / tlsRecordMaxSize
+	if n == 0 {
+		n = 1
+	}
+
+	result := make([]byte, 0, n*tlsRecordHeaderSize+len(data))
+	for i := 0; i < n; i++ {
+		end := (i + 1) * tlsRecordMaxSize
+		if end > len(data) {
+			end = len(data)
+		}
+		record := data[i*tlsRecordMaxSize : end]
+
+		header := make([]byte, tlsRecordHeaderSize)
+		header[0] = tlsContentTypeAppData
+		binary.BigEndian.PutUint16(header[1:], tlsLegacyRecordVersion)
+		binary.BigEndian.PutUint16(header[3:], uint16(len(record)))
+
+		result = append(result, header...)
+		result = append(result, record...)
+	}
+
+	return result, nil
+}
+
+func (o *TLSObfs) Deobfuscate(data []byte) ([]byte, error) {
+	result := make([]byte, 0, len(data))
+
+	for len(data) > 0 {
+		if len(data) < tlsRecordHeaderSize {
+			return nil, errors.New("missing record header")
+		}
+		if data[0] != tlsContentTypeAppData {
+			return nil, fmt.Errorf("record type %d not support", data[0])
+		}
+		if v := binary.BigEndian.Uint16(data[1:]); v != tlsLegacyRecordVersion {
+			return nil, fmt.Errorf("record version %#04x not support", v)
+		}
+
+		size := int(binary.BigEndian.Uint16(data[3:]))
+		if size > tlsRecordMaxSizeExpanded {
+			return nil, fmt.Errorf("record size %d out of range", size)
+		}
+		data = data[tlsRecordHeaderSize:]
+		if len(data) < size {
+			return nil, fmt.Errorf("record size %d mismatch", size)
+		}
+
+		result = append(result, data[:size]...)
+		data = data[size:]
+	}
+
+	return result, nil
+}
+
+func (o *TLSObfs) Method() Method {
+	return MethodTLS
+}
+
+func (o *TLSObfs) Cost() int {
+	return tlsRecordHeaderSize
+}
@@ -0,0 +1,140 @@
+package pcap
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// ACL describes access control lists of sources in CIDRs. Sources in the deny list are always refused, and sources
+// not in the allow list are refused if it is not empty.
+type ACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// ParseACL returns an ACL by given strings of CIDRs allowed and denied, an IP is treated as a CIDR of its single
+// address.
+func ParseACL(allow, deny []string) (*ACL, error) {
+	a, err := parseCIDRs(allow)
+	if err != nil {
+		return nil, fmt.Errorf("parse allow: %w", err)
+	}
+	d, err := parseCIDRs(deny)
+	if err != nil {
+		return nil, fmt.Errorf("parse deny: %w", err)
+	}
+
+	return &ACL{allow: a, deny: d}, nil
+}
+
+func parseCIDRs(s []string) ([]*net.IPNet, error) {
+	result := make([]*net.IPNet, 0, len(s))
+	for _, str := range s {
+		str = strings.TrimSpace(str)
+
+		if _, ipNet, err := net.ParseCIDR(str); err == nil {
+			result = append(result, ipNet)
+			continue
+		}
+
+		ip := net.ParseIP(str)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid cidr %s", str)
+		}
+		bits := net.IPv6len * 8
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), net.IPv4len*8
+		}
+		result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+
+	return result, nil
+}
+
+// IsEmpty returns if the ACL permits any source.
+func (acl *ACL) IsEmpty() bool {
+	return acl == nil || len(acl.allow) <= 0 && len(acl.deny) <= 0
+}
+
+// Permits returns if the source is permitted by the ACL.
+func (acl *ACL) Permits(ip net.IP) bool {
+	if acl.IsEmpty() {
+		return true
+	}
+
+	for _, ipNet := range acl.deny {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	if len(acl.allow) <= 0 {
+		return true
+	}
+	for _, ipNet := range acl.allow {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (acl *ACL) String() string {
+	s := make([]string, 0, len(acl.allow)+len(acl.deny))
+	for _, ipNet := range acl.allow {
+		s = append(s, "+"+ipNet.String())
+	}
+	for _, ipNet := range acl.deny {
+		s = append(s, "-"+ipNet.String())
+	}
+
+	return strings.Join(s, ", ")
+}
+
+var (
+	acl *ACL
+
+	// refused is the number of packets and connections refused by the ACL.
+	refused uint64
+)
+
+// SetACL sets the ACL of sources of listeners. Packets and connections from sources refused are dropped before any
+// handshake or decryption. It should be called before any listener is created.
+func SetACL(a *ACL) {
+	acl = a
+}
+
+// Refused returns the number of packets and connections refused by the ACL.
+func Refused() uint64 {
+	return atomic.LoadUint64(&refused)
+}
+
+// permits returns if the source is permitted by the ACL of listeners, and counts it if not.
+func permits(ip net.IP) bool {
+	if acl.Permits(ip) {
+		return true
+	}
+	atomic.AddUint64(&refused, 1)
+
+	return false
+}
+
+// permitsAddr returns if the source address is permitted by the ACL of listeners, and counts it if not.
+func permitsAddr(a net.Addr) bool {
+	if acl.IsEmpty() {
+		return true
+	}
+
+	switch t := a.(type) {
+	case *net.TCPAddr:
+		return permits(t.IP)
+	case *net.UDPAddr:
+		return permits(t.IP)
+	case *net.IPAddr:
+		return permits(t.IP)
+	default:
+		return true
+	}
+}
@@ -0,0 +1,169 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// batchHeaderSize is the size of the length prefix of each packet in a batch.
+const batchHeaderSize = 2
+
+// BatchConn is a connection which coalesces packets written in an interval into a segment with length-prefixed framing,
+// and splits segments back apart on read.
+type BatchConn struct {
+	net.Conn
+	size       int
+	interval   time.Duration
+	lock       sync.Mutex
+	buffer     []byte
+	timer      *time.Timer
+	readBuffer []byte
+	pending    [][]byte
+}
+
+// NewBatchConn returns a new batch connection over the connection. Packets are coalesced until the segment reaches the
+// size or the interval elapses.
+func NewBatchConn(conn net.Conn, size int, interval time.Duration) *BatchConn {
+	return &BatchConn{
+		Conn:       conn,
+		size:       size,
+		interval:   interval,
+		buffer:     make([]byte, 0, size),
+		readBuffer: make([]byte, IPv4MaxSize),
+		pending:    make([][]byte, 0),
+	}
+}
+
+func (c *BatchConn) Read(b []byte) (n int, err error) {
+	for len(c.pending) <= 0 {
+		n, err := c.Conn.Read(c.readBuffer)
+		if err != nil {
+			return 0, err
+		}
+
+		c.pending, err = splitBatch(c.readBuffer[:n])
+		if err != nil {
+			return 0, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   c.RemoteAddr(),
+				Err:    fmt.Errorf("split batch: %w", err),
+			}
+		}
+	}
+
+	p := c.pending[0]
+	c.pending = c.pending[1:]
+
+	return copy(b, p), nil
+}
+
+func (c *BatchConn) Write(b []byte) (n int, err error) {
+	if len(b) > 65535 {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    fmt.Errorf("packet size %d out of range", len(b)),
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Flush if the packet cannot be appended to the segment
+	if len(c.buffer) > 0 && len(c.buffer)+batchHeaderSize+len(b) > c.size {
+		err := c.flush()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	header := make([]byte, batchHeaderSize)
+	binary.BigEndian.PutUint16(header, uint16(len(b)))
+	c.buffer = append(c.buffer, header...)
+	c.buffer = append(c.buffer, b...)
+
+	if len(c.buffer) >= c.size {
+		err := c.flush()
+		if err != nil {
+			return 0, err
+		}
+	} else if c.timer == nil {
+		c.timer = time.AfterFunc(c.interval, func() {
+			c.lock.Lock()
+			defer c.lock.Unlock()
+
+			c.timer = nil
+			err := c.flush()
+			if err != nil {
+				logger.Errorln(fmt.Errorf("flush batch to %s: %w", c.RemoteAddr(), err))
+			}
+		})
+	}
+
+	return len(b), nil
+}
+
+// Close flushes packets not written yet and closes the connection.
+func (c *BatchConn) Close() error {
+	c.lock.Lock()
+	err := c.flush()
+	c.lock.Unlock()
+	if err != nil {
+		logger.Errorln(fmt.Errorf("flush batch to %s: %w", c.RemoteAddr(), err))
+	}
+
+	return c.Conn.Close()
+}
+
+// flush writes the segment to the connection. The lock must be held.
+func (c *BatchConn) flush() error {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+
+	if len(c.buffer) <= 0 {
+		return nil
+	}
+
+	// The segment may be kept by the connection for retransmission, so it is not reused
+	b := c.buffer
+	c.buffer = make([]byte, 0, c.size)
+
+	_, err := c.Conn.Write(b)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// splitBatch splits a segment into packets.
+func splitBatch(b []byte) ([][]byte, error) {
+	result := make([][]byte, 0)
+
+	for len(b) > 0 {
+		if len(b) < batchHeaderSize {
+			return nil, errors.New("missing length")
+		}
+
+		size := int(binary.BigEndian.Uint16(b))
+		b = b[batchHeaderSize:]
+		if len(b) < size {
+			return nil, fmt.Errorf("length %d out of range", size)
+		}
+
+		result = append(result, b[:size])
+		b = b[size:]
+	}
+
+	return result, nil
+}
@@ -0,0 +1,141 @@
+package pcap
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// CaptureStats describes statistics of capturing in a device.
+type CaptureStats struct {
+	// Device is the name of the device.
+	Device string `json:"device"`
+	// Received is the number of packets received by the filter.
+	Received uint64 `json:"received"`
+	// Dropped is the number of packets dropped by the kernel for lack of buffer.
+	Dropped uint64 `json:"dropped"`
+	// IfDropped is the number of packets dropped by the interface or its driver.
+	IfDropped uint64 `json:"ifDropped"`
+	// Truncated is the number of packets truncated in capturing.
+	Truncated uint64 `json:"truncated"`
+	// Reopened is the number of times the device is reopened after capturing fails.
+	Reopened uint64 `json:"reopened"`
+	// Overflowed is the number of packets dropped as the ring between capturing and handling is full.
+	Overflowed uint64 `json:"overflowed"`
+}
+
+// add adds statistics of a handle.
+func (s *CaptureStats) add(stats *pcap.Stats) {
+	s.Received = s.Received + uint64(stats.PacketsReceived)
+	s.Dropped = s.Dropped + uint64(stats.PacketsDropped)
+	s.IfDropped = s.IfDropped + uint64(stats.PacketsIfDropped)
+}
+
+var (
+	rawConnsLock sync.Mutex
+	rawConns     = make(map[*RawConn]bool)
+)
+
+// Stats returns statistics of capturing in the connection, which are accumulated across reopening.
+func (c *RawConn) Stats() (*CaptureStats, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	result := c.stats
+	result.Device = c.name
+	result.Truncated = c.truncated
+	result.Reopened = c.reopened
+	result.Overflowed = atomic.LoadUint64(&c.overflowed)
+	if c.isClosed() {
+		return &result, nil
+	}
+
+	stats, err := c.handle.Stats()
+	if err != nil {
+		return nil, err
+	}
+	result.add(stats)
+
+	return &result, nil
+}
+
+// AllCaptureStats returns statistics of capturing in all open raw connections, sorted by the device. Connections in
+// the same device are summed up.
+func AllCaptureStats() []CaptureStats {
+	rawConnsLock.Lock()
+	conns := make([]*RawConn, 0, len(rawConns))
+	for conn := range rawConns {
+		conns = append(conns, conn)
+	}
+	rawConnsLock.Unlock()
+
+	devs := make(map[string]*CaptureStats)
+	for _, conn := range conns {
+		stats, err := conn.Stats()
+		if err != nil {
+			continue
+		}
+
+		s, ok := devs[stats.Device]
+		if !ok {
+			s = &CaptureStats{Device: stats.Device}
+			devs[stats.Device] = s
+		}
+		s.Received = s.Received + stats.Received
+		s.Dropped = s.Dropped + stats.Dropped
+		s.IfDropped = s.IfDropped + stats.IfDropped
+		s.Truncated = s.Truncated + stats.Truncated
+		s.Reopened = s.Reopened + stats.Reopened
+		s.Overflowed = s.Overflowed + stats.Overflowed
+	}
+
+	result := make([]CaptureStats, 0, len(devs))
+	for _, s := range devs {
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Device < result[j].Device
+	})
+
+	return result
+}
+
+// DropWatcher watches packets dropped by the kernel in capturing in all open raw connections.
+type DropWatcher struct {
+	last map[*RawConn]uint64
+}
+
+// NewDropWatcher returns a new drop watcher.
+func NewDropWatcher() *DropWatcher {
+	return &DropWatcher{last: make(map[*RawConn]uint64)}
+}
+
+// Check returns the number of packets dropped by the kernel in each device since the last check, in which devices
+// without new drops are omitted.
+func (w *DropWatcher) Check() map[string]uint64 {
+	rawConnsLock.Lock()
+	conns := make([]*RawConn, 0, len(rawConns))
+	for conn := range rawConns {
+		conns = append(conns, conn)
+	}
+	rawConnsLock.Unlock()
+
+	result := make(map[string]uint64)
+	last := make(map[*RawConn]uint64)
+	for _, conn := range conns {
+		stats, err := conn.Stats()
+		if err != nil {
+			continue
+		}
+
+		last[conn] = stats.Dropped
+		if stats.Dropped > w.last[conn] {
+			result[stats.Device] = result[stats.Device] + stats.Dropped - w.last[conn]
+		}
+	}
+	w.last = last
+
+	return result
+}
@@ -0,0 +1,98 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket/layers"
+)
+
+// VerifyChecksum verifies checksums of the network layer and the transport layer in the packet. Checksum of transport
+// layer in fragments is not verified.
+func (indicator *PacketIndicator) VerifyChecksum() error {
+	var pseudoHeader []byte
+
+	switch t := indicator.NetworkLayer().LayerType(); t {
+	case layers.LayerTypeIPv4:
+		ipv4Layer := indicator.IPv4Layer()
+
+		if sum(0, ipv4Layer.LayerContents()) != 0xffff {
+			return NewError(ErrChecksum, "invalid ipv4 checksum")
+		}
+
+		pseudoHeader = make([]byte, 12)
+		copy(pseudoHeader[0:4], ipv4Layer.SrcIP.To4())
+		copy(pseudoHeader[4:8], ipv4Layer.DstIP.To4())
+		pseudoHeader[9] = byte(ipv4Layer.Protocol)
+		binary.BigEndian.PutUint16(pseudoHeader[10:], uint16(len(indicator.NetworkPayload())))
+	case layers.LayerTypeIPv6:
+		ipv6Layer := indicator.IPv6Layer()
+
+		pseudoHeader = make([]byte, 40)
+		copy(pseudoHeader[0:16], ipv6Layer.SrcIP.To16())
+		copy(pseudoHeader[16:32], ipv6Layer.DstIP.To16())
+		binary.BigEndian.PutUint32(pseudoHeader[32:], uint32(len(indicator.NetworkPayload())))
+		pseudoHeader[39] = byte(indicator.NextHeader())
+	default:
+		return NewError(ErrUnsupportedLayer, "network layer type %s not support", t)
+	}
+
+	if indicator.IsFrag() || indicator.TransportLayer() == nil {
+		return nil
+	}
+
+	switch t := indicator.TransportLayer().LayerType(); t {
+	case layers.LayerTypeTCP, layers.LayerTypeICMPv6:
+		if sum(sum(0, pseudoHeader), indicator.NetworkPayload()) != 0xffff {
+			return NewError(ErrChecksum, "invalid %s checksum", t)
+		}
+	case layers.LayerTypeUDP:
+		// Checksum of UDP is optional in IPv4
+		if indicator.UDPLayer().Checksum == 0 && indicator.NetworkLayer().LayerType() == layers.LayerTypeIPv4 {
+			return nil
+		}
+
+		if sum(sum(0, pseudoHeader), indicator.NetworkPayload()) != 0xffff {
+			return NewError(ErrChecksum, "invalid %s checksum", t)
+		}
+	case layers.LayerTypeICMPv4:
+		if sum(0, indicator.NetworkPayload()) != 0xffff {
+			return NewError(ErrChecksum, "invalid %s checksum", t)
+		}
+	case LayerTypeOpaque:
+		// Opaque protocols are not parsed, and their checksums are left to the end points
+		break
+	default:
+		return NewError(ErrUnsupportedLayer, "transport layer type %s not support", t)
+	}
+
+	return nil
+}
+
+// sum returns the folded one's complement sum of data added to the initial value.
+func sum(initial uint16, data []byte) uint16 {
+	s := uint32(initial)
+
+	for i := 0; i+1 < len(data); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		s += uint32(data[len(data)-1]) << 8
+	}
+
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+
+	return uint16(s)
+}
+
+// updateChecksum returns the checksum updated incrementally after a 16 bits word changes from a value to another, as
+// RFC 1624 describes.
+func updateChecksum(checksum, from, to uint16) uint16 {
+	s := uint32(^checksum) + uint32(^from) + uint32(to)
+
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+
+	return ^uint16(s)
+}
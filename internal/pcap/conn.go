@@ -0,0 +1,37 @@
+package pcap
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// PacketSource describes a source of packets captured in a device.
+type PacketSource interface {
+	// ReadPacket reads a packet from the device.
+	ReadPacket() (gopacket.Packet, error)
+}
+
+// PacketSink describes a sink of packets injected into a device.
+type PacketSink interface {
+	// Write injects a packet with its link layer into the device.
+	Write(b []byte) (n int, err error)
+	// LinkType returns the link type of the device.
+	LinkType() layers.LinkType
+	// LocalDev returns the local device.
+	LocalDev() *Device
+	// RemoteDev returns the remote device.
+	RemoteDev() *Device
+	// IsLoop returns if the sink is to a loopback device.
+	IsLoop() bool
+}
+
+// PacketConn describes a connection capturing and injecting packets in a device, which is a raw connection in pcap,
+// or a connection in memory without devices.
+type PacketConn interface {
+	PacketSource
+	PacketSink
+	// SetBPFFilter sets the BPF filter of capturing.
+	SetBPFFilter(filter string) error
+	// Close closes the connection.
+	Close() error
+}
@@ -1,6 +1,7 @@
 package pcap
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/google/gopacket"
@@ -8,19 +9,29 @@
 	"github.com/google/gopacket/pcap"
 	"github.com/jackpal/gateway"
 	"ikago/internal/addr"
-	"ikago/internal/log"
 	"net"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// hardwareAddrLock guards hardware addresses of devices, which may be updated by resolvers.
+var hardwareAddrLock sync.RWMutex
+
 // Device describes an network device.
 type Device struct {
 	name         string
 	alias        string
+	description  string
 	ipAddrs      []*net.IPNet
 	hardwareAddr net.HardwareAddr
+	isPinned     bool
 	isLoop       bool
+	isUp         bool
+	vlan         uint16
+	pppoe        uint16
 }
 
 // Name returns the pcap name of the device.
@@ -33,6 +44,11 @@ func (dev *Device) Alias() string {
 	return dev.alias
 }
 
+// Description returns the friendly name of the device given by pcap, which may be empty.
+func (dev *Device) Description() string {
+	return dev.description
+}
+
 // IPAddrs returns all IP address of the device.
 func (dev *Device) IPAddrs() []*net.IPNet {
 	return dev.ipAddrs
@@ -40,14 +56,61 @@ func (dev *Device) IPAddrs() []*net.IPNet {
 
 // HardwareAddr returns the hardware address of the device.
 func (dev *Device) HardwareAddr() net.HardwareAddr {
+	hardwareAddrLock.RLock()
+	defer hardwareAddrLock.RUnlock()
+
 	return dev.hardwareAddr
 }
 
+func (dev *Device) setHardwareAddr(hardwareAddr net.HardwareAddr) {
+	hardwareAddrLock.Lock()
+	defer hardwareAddrLock.Unlock()
+
+	dev.hardwareAddr = hardwareAddr
+}
+
+// PinHardwareAddr overrides the hardware address of the device, which will not be updated by resolvers any more.
+func (dev *Device) PinHardwareAddr(hardwareAddr net.HardwareAddr) {
+	hardwareAddrLock.Lock()
+	defer hardwareAddrLock.Unlock()
+
+	dev.hardwareAddr = hardwareAddr
+	dev.isPinned = true
+}
+
+// IsPinned returns if the hardware address of the device is overridden.
+func (dev *Device) IsPinned() bool {
+	hardwareAddrLock.RLock()
+	defer hardwareAddrLock.RUnlock()
+
+	return dev.isPinned
+}
+
+// VLAN returns the VLAN identifier of packets sent in the device, 0 if packets are not tagged.
+func (dev *Device) VLAN() uint16 {
+	return dev.vlan
+}
+
+// SetVLAN sets the VLAN identifier of packets sent in the device. It should be called before any connection is opened.
+func (dev *Device) SetVLAN(id uint16) {
+	dev.vlan = id
+}
+
+// PPPoE returns the PPPoE session of packets sent in the device, 0 if packets are not in PPPoE.
+func (dev *Device) PPPoE() uint16 {
+	return dev.pppoe
+}
+
 // IsLoop returns if the device is a loopback device.
 func (dev *Device) IsLoop() bool {
 	return dev.isLoop
 }
 
+// IsUp returns if the device is up.
+func (dev *Device) IsUp() bool {
+	return dev.isUp
+}
+
 // IPAddr returns the first IP address of the device.
 func (dev *Device) IPAddr() *net.IPNet {
 	if len(dev.ipAddrs) > 0 {
@@ -57,11 +120,51 @@ func (dev *Device) IPAddr() *net.IPNet {
 	return nil
 }
 
+// IPv4Addr returns the first IPv4 address of the device.
+func (dev *Device) IPv4Addr() *net.IPNet {
+	for _, a := range dev.ipAddrs {
+		if a.IP.To4() != nil {
+			return a
+		}
+	}
+
+	return nil
+}
+
+// IPv6Addr returns the first IPv6 address of the device, global unicast addresses are preferred.
+func (dev *Device) IPv6Addr() *net.IPNet {
+	var result *net.IPNet
+
+	for _, a := range dev.ipAddrs {
+		if a.IP.To4() != nil {
+			continue
+		}
+		if !a.IP.IsLinkLocalUnicast() {
+			return a
+		}
+		if result == nil {
+			result = a
+		}
+	}
+
+	return result
+}
+
+// IPAddrOf returns the IP address of the device in the same family of the given IP.
+func (dev *Device) IPAddrOf(ip net.IP) *net.IPNet {
+	if ip.To4() != nil {
+		return dev.IPv4Addr()
+	}
+
+	return dev.IPv6Addr()
+}
+
 func (dev Device) String() string {
 	var result string
 
-	if dev.hardwareAddr != nil {
-		result = dev.alias + " [" + dev.hardwareAddr.String() + "]: "
+	hardwareAddr := dev.HardwareAddr()
+	if hardwareAddr != nil {
+		result = dev.alias + " [" + hardwareAddr.String() + "]: "
 	} else {
 		result = dev.alias + ": "
 	}
@@ -79,8 +182,127 @@ func (dev Device) String() string {
 	return result
 }
 
+// Detail returns the description of the device in detail, including its pcap name, friendly name, addresses and flags.
+func (dev *Device) Detail() string {
+	var b strings.Builder
+
+	b.WriteString(dev.alias)
+	if dev.name != "" && dev.name != dev.alias {
+		b.WriteString(" " + dev.name)
+	}
+	if dev.description != "" {
+		b.WriteString(" (" + dev.description + ")")
+	}
+	if hardwareAddr := dev.HardwareAddr(); hardwareAddr != nil {
+		b.WriteString(" [" + hardwareAddr.String() + "]")
+	}
+	b.WriteString(": ")
+
+	addrs := make([]string, 0)
+	for _, a := range dev.ipAddrs {
+		addrs = append(addrs, a.String())
+	}
+	b.WriteString(strings.Join(addrs, ", "))
+
+	flags := make([]string, 0)
+	if dev.isUp {
+		flags = append(flags, "Up")
+	} else {
+		flags = append(flags, "Down")
+	}
+	if dev.isLoop {
+		flags = append(flags, "Loopback")
+	}
+	b.WriteString(" (" + strings.Join(flags, ", ") + ")")
+
+	return b.String()
+}
+
+func (dev *Device) MarshalJSON() ([]byte, error) {
+	var hardwareAddr string
+	if a := dev.HardwareAddr(); a != nil {
+		hardwareAddr = a.String()
+	}
+
+	addrs := make([]string, 0)
+	for _, a := range dev.ipAddrs {
+		addrs = append(addrs, a.String())
+	}
+
+	return json.Marshal(&struct {
+		Name         string   `json:"name"`
+		Alias        string   `json:"alias"`
+		Description  string   `json:"description,omitempty"`
+		HardwareAddr string   `json:"hardwareAddr,omitempty"`
+		IPAddrs      []string `json:"ipAddrs"`
+		VLAN         uint16   `json:"vlan,omitempty"`
+		PPPoE        uint16   `json:"pppoe,omitempty"`
+		Loop         bool     `json:"loop"`
+		Up           bool     `json:"up"`
+	}{
+		Name:         dev.name,
+		Alias:        dev.alias,
+		Description:  dev.description,
+		HardwareAddr: hardwareAddr,
+		IPAddrs:      addrs,
+		VLAN:         dev.vlan,
+		PPPoE:        dev.pppoe,
+		Loop:         dev.isLoop,
+		Up:           dev.isUp,
+	})
+}
+
+// narrow returns a copy of the device which prefers the given IP address. IP addresses of the other family are kept
+// so that the device can still route upstream in both IPv4 and IPv6, and so are global addresses if the given IP
+// address is a link-local one.
+func (dev *Device) narrow(a *net.IPNet) *Device {
+	addrs := append(make([]*net.IPNet, 0), a)
+	for _, ipnet := range dev.ipAddrs {
+		if ipnet == a {
+			continue
+		}
+		if (ipnet.IP.To4() == nil) != (a.IP.To4() == nil) ||
+			(a.IP.IsLinkLocalUnicast() && !ipnet.IP.IsLinkLocalUnicast()) {
+			addrs = append(addrs, ipnet)
+		}
+	}
+
+	return &Device{
+		name:         dev.name,
+		alias:        dev.alias,
+		description:  dev.description,
+		ipAddrs:      addrs,
+		hardwareAddr: dev.hardwareAddr,
+		isPinned:     dev.isPinned,
+		isLoop:       dev.isLoop,
+		isUp:         dev.isUp,
+		vlan:         dev.vlan,
+		pppoe:        dev.pppoe,
+	}
+}
+
+// Select returns the device which uses the IP as the source address of its family.
+func (dev *Device) Select(ip net.IP) (*Device, error) {
+	for _, a := range dev.ipAddrs {
+		if a.IP.Equal(ip) {
+			return dev.narrow(a), nil
+		}
+	}
+
+	return nil, fmt.Errorf("missing address %s in device %s", ip, dev.alias)
+}
+
 const flagPcapLoopback = 1
 
+// npcapLoopbackName is the pcap name of the Npcap Loopback Adapter in Windows.
+const npcapLoopbackName = "\\Device\\NPF_Loopback"
+
+// isPcapLoop returns if the pcap device is a loopback device. Early versions of Npcap do not flag the Npcap Loopback
+// Adapter as a loopback device, so it is recognized by its name.
+func isPcapLoop(dev pcap.Interface) bool {
+	return dev.Flags&flagPcapLoopback != 0 || strings.EqualFold(dev.Name, npcapLoopbackName)
+}
+
 var blacklist map[string]bool
 
 // FindAllDevs returns all valid network devices in current computer.
@@ -110,27 +332,36 @@ func FindAllDevs() ([]*Device, error) {
 
 		addrs, err := inter.Addrs()
 		if err != nil {
-			log.Errorln(fmt.Errorf("parse interface %s: %w", inter.Name, err))
+			logger.Errorln(fmt.Errorf("parse interface %s: %w", inter.Name, err))
 			continue
 		}
 
 		as := make([]*net.IPNet, 0)
+		as6 := make([]*net.IPNet, 0)
 		for _, a := range addrs {
 			ipnet, ok := a.(*net.IPNet)
 			if !ok {
-				log.Errorln(fmt.Errorf("parse interface %s: %w", inter.Name, errors.New("invalid address")))
+				logger.Errorln(fmt.Errorf("parse interface %s: %w", inter.Name, errors.New("invalid address")))
 				continue
 			}
 
-			// Only pass IPv4 address
+			// IPv4 addresses always take precedence over IPv6 addresses
 			if ipnet.IP.To4() == nil {
+				as6 = append(as6, ipnet)
 				continue
 			}
 
 			as = append(as, ipnet)
 		}
-
-		t = append(t, &Device{alias: inter.Name, ipAddrs: as, hardwareAddr: inter.HardwareAddr, isLoop: isLoop})
+		as = append(as, as6...)
+
+		t = append(t, &Device{
+			alias:        inter.Name,
+			ipAddrs:      as,
+			hardwareAddr: inter.HardwareAddr,
+			isLoop:       isLoop,
+			isUp:         inter.Flags&net.FlagUp != 0,
+		})
 	}
 
 	// Enumerate pcap devices
@@ -147,7 +378,7 @@ func FindAllDevs() ([]*Device, error) {
 		}
 
 		// Match pcap device with interface
-		if dev.Flags&flagPcapLoopback != 0 {
+		if isPcapLoop(dev) {
 			d := FindLoopDev(t)
 			if d == nil {
 				continue
@@ -156,9 +387,10 @@ func FindAllDevs() ([]*Device, error) {
 				// return nil, errors.New("too many loopback devices")
 				blacklist[dev.Name] = true
 				blacklist[d.name] = true
-				log.Infof("Device %s is a loopback device but so is %s, these devices will not be used\n", dev.Name, d.name)
+				logger.Infof("Device %s is a loopback device but so is %s, these devices will not be used\n", dev.Name, d.name)
 			}
 			d.name = dev.Name
+			d.description = dev.Description
 			mid = append(mid, d)
 		} else {
 			if len(dev.Addresses) <= 0 {
@@ -173,10 +405,11 @@ func FindAllDevs() ([]*Device, error) {
 					// return nil, fmt.Errorf("parse pcap device %s: %w", dev.Name, fmt.Errorf("same address with %s", d.Name))
 					blacklist[dev.Name] = true
 					blacklist[d.name] = true
-					log.Infof("Device %s has the same address with %s, these devices will not be used\n", dev.Name, d.name)
+					logger.Infof("Device %s has the same address with %s, these devices will not be used\n", dev.Name, d.name)
 					break
 				}
 				d.name = dev.Name
+				d.description = dev.Description
 				mid = append(mid, d)
 				break
 			}
@@ -194,6 +427,47 @@ func FindAllDevs() ([]*Device, error) {
 	return result, nil
 }
 
+// MatchDevs returns devices matching the pattern in designated devices. The pattern is either the alias or the pcap
+// name of a device, the index of a device in the list of FindAllDevs, or a pattern of aliases and friendly names in the
+// manner of path.Match, which is case insensitive, like "eth*" or "*Wi-Fi*".
+func MatchDevs(devs []*Device, pattern string) ([]*Device, error) {
+	result := make([]*Device, 0)
+
+	// Name
+	for _, dev := range devs {
+		if dev.alias == pattern || dev.name == pattern {
+			return append(result, dev), nil
+		}
+	}
+
+	// Index
+	i, err := strconv.Atoi(pattern)
+	if err == nil {
+		if i < 0 || i >= len(devs) {
+			return nil, fmt.Errorf("index %d out of range", i)
+		}
+
+		return append(result, devs[i]), nil
+	}
+
+	// Pattern
+	p := strings.ToLower(pattern)
+	for _, dev := range devs {
+		ok, err := path.Match(p, strings.ToLower(dev.alias))
+		if err != nil {
+			return nil, fmt.Errorf("parse pattern %s: %w", pattern, err)
+		}
+		if !ok && dev.description != "" {
+			ok, _ = path.Match(p, strings.ToLower(dev.description))
+		}
+		if ok {
+			result = append(result, dev)
+		}
+	}
+
+	return result, nil
+}
+
 // FindLoopDev returns the loop device in designated devices.
 func FindLoopDev(devs []*Device) *Device {
 	for _, dev := range devs {
@@ -228,8 +502,26 @@ func FindGatewayAddr() (net.IP, error) {
 	return ip, nil
 }
 
-// FindGatewayDev returns the gateway device.
+// FindGatewayDev returns the gateway device. The hardware address of the gateway is resolved by ARP or NDP, or by
+// capturing a packet sent to the gateway if the gateway does not respond.
 func FindGatewayDev(dev *Device, ip net.IP) (*Device, error) {
+	hardwareAddr, err := resolve(dev, ip, resolveTimeout)
+	if err != nil {
+		logger.Verbosef("Resolve gateway %s: %s, capture a packet instead\n", ip, err)
+
+		hardwareAddr, err = captureGatewayHardwareAddr(dev, ip)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	addrs := append(make([]*net.IPNet, 0), &net.IPNet{IP: ip})
+
+	return &Device{alias: "Gateway", ipAddrs: addrs, hardwareAddr: hardwareAddr}, nil
+}
+
+// captureGatewayHardwareAddr returns the hardware address of the gateway by capturing a packet sent to it.
+func captureGatewayHardwareAddr(dev *Device, ip net.IP) (net.HardwareAddr, error) {
 	f, err := addr.DstBPFFilter(&net.TCPAddr{
 		IP:   ip,
 		Port: 65535,
@@ -238,7 +530,12 @@ func FindGatewayDev(dev *Device, ip net.IP) (*Device, error) {
 		return nil, fmt.Errorf("parse filter %s: %w", ip, err)
 	}
 
-	conn, err := createPureRawConn(dev.Name(), fmt.Sprintf("ip && udp && %s", f))
+	proto := "ip"
+	if ip.To4() == nil {
+		proto = "ip6"
+	}
+
+	conn, err := createPureRawConn(dev.Name(), fmt.Sprintf("%s && udp && %s", proto, f))
 	if err != nil {
 		return nil, fmt.Errorf("open device %s: %w", dev.Alias(), err)
 	}
@@ -257,7 +554,12 @@ func FindGatewayDev(dev *Device, ip net.IP) (*Device, error) {
 	}()
 
 	// Attempt to send and capture a UDP packet
-	err = SendUDPPacket(ip.String()+":65535", []byte("0"))
+	host := ip.String()
+	if ip.IsLinkLocalUnicast() {
+		// Link-local addresses require a zone
+		host = host + "%" + dev.Alias()
+	}
+	err = SendUDPPacket(net.JoinHostPort(host, "65535"), []byte("0"))
 	if err != nil {
 		return nil, fmt.Errorf("send udp packet: %w", err)
 	}
@@ -276,9 +578,7 @@ func FindGatewayDev(dev *Device, ip net.IP) (*Device, error) {
 		return nil, errors.New("invalid packet")
 	}
 
-	addrs := append(make([]*net.IPNet, 0), &net.IPNet{IP: ip})
-
-	return &Device{alias: "Gateway", ipAddrs: addrs, hardwareAddr: ethernetPacket.DstMAC}, nil
+	return ethernetPacket.DstMAC, nil
 }
 
 // FindListenDevs returns all valid pcap devices for listening.
@@ -293,17 +593,23 @@ func FindListenDevs(names []string) ([]*Device, error) {
 	if len(names) <= 0 {
 		result = devs
 	} else {
-		m := make(map[string]*Device)
-		for _, dev := range devs {
-			m[dev.alias] = dev
-		}
-
+		m := make(map[string]bool)
 		for _, name := range names {
-			dev, ok := m[name]
-			if !ok {
+			matches, err := MatchDevs(devs, name)
+			if err != nil {
+				return nil, fmt.Errorf("match listen device %s: %w", name, err)
+			}
+			if len(matches) <= 0 {
 				return nil, fmt.Errorf("unknown listen device %s", name)
 			}
-			result = append(result, dev)
+
+			for _, dev := range matches {
+				if m[dev.name] {
+					continue
+				}
+				m[dev.name] = true
+				result = append(result, dev)
+			}
 		}
 	}
 
@@ -319,14 +625,17 @@ func FindUpstreamDevAndGatewayDev(name string, gateway net.IP) (upDev, gatewayDe
 
 	if name != "" {
 		// Find upstream device
-		for _, dev := range devs {
-			if dev.alias == name {
-				upDev = dev
-				break
-			}
+		matches, err := MatchDevs(devs, name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("match upstream device %s: %w", name, err)
 		}
-		if upDev == nil {
+		switch len(matches) {
+		case 0:
 			return nil, nil, fmt.Errorf("unknown upstream device %s", name)
+		case 1:
+			upDev = matches[0]
+		default:
+			return nil, nil, fmt.Errorf("upstream device %s matches %d devices", name, len(matches))
 		}
 
 		// Find gateway device
@@ -350,13 +659,7 @@ func FindUpstreamDevAndGatewayDev(name string, gateway net.IP) (upDev, gatewayDe
 			var newUpDev *Device
 			for _, a := range upDev.ipAddrs {
 				if a.Contains(gatewayDev.ipAddrs[0].IP) {
-					newUpDev = &Device{
-						name:         upDev.name,
-						alias:        upDev.alias,
-						ipAddrs:      append(make([]*net.IPNet, 0), a),
-						hardwareAddr: upDev.hardwareAddr,
-						isLoop:       upDev.isLoop,
-					}
+					newUpDev = upDev.narrow(a)
 					break
 				}
 			}
@@ -388,13 +691,7 @@ func FindUpstreamDevAndGatewayDev(name string, gateway net.IP) (upDev, gatewayDe
 					if err != nil {
 						continue
 					}
-					upDev = &Device{
-						name:         dev.name,
-						alias:        dev.alias,
-						ipAddrs:      append(make([]*net.IPNet, 0), a),
-						hardwareAddr: dev.hardwareAddr,
-						isLoop:       dev.isLoop,
-					}
+					upDev = dev.narrow(a)
 					break
 				}
 			}
@@ -406,3 +703,28 @@ func FindUpstreamDevAndGatewayDev(name string, gateway net.IP) (upDev, gatewayDe
 
 	return upDev, gatewayDev, nil
 }
+
+// SelectDevIP returns the device which uses the IP as the source address of its family. Addresses of the device which
+// are not in the same domain of the gateway can also be selected.
+func SelectDevIP(dev *Device, ip net.IP) (*Device, error) {
+	devs, err := FindAllDevs()
+	if err != nil {
+		return nil, fmt.Errorf("find all devices: %w", err)
+	}
+
+	for _, d := range devs {
+		if d.name != dev.name {
+			continue
+		}
+
+		result, err := d.Select(ip)
+		if err != nil {
+			return nil, err
+		}
+		result.vlan = dev.vlan
+
+		return result, nil
+	}
+
+	return nil, fmt.Errorf("unknown device %s", dev.alias)
+}
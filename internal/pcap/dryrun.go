@@ -0,0 +1,28 @@
+package pcap
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var isDryRun bool
+
+// SetDryRun sets if packets are printed instead of being written in raw connections, so capturing, parsing and
+// rewriting can be validated without sending anything. It should be called before any connection is created.
+func SetDryRun(dryRun bool) {
+	isDryRun = dryRun
+}
+
+// printDryRun prints the summary of a packet which would be written in the device, and its hex dump in verbose.
+func printDryRun(name string, linkType layers.LinkType, b []byte) {
+	packet := gopacket.NewPacket(b, linkType, gopacket.Default)
+
+	indicator, err := ParsePacket(packet)
+	if err != nil {
+		logger.Infof("Dry run in %s: %d Bytes\n", name, len(b))
+	} else {
+		logger.Infof("Dry run in %s: %s %s -> %s (%d Bytes)\n", name,
+			indicator.TransportProtocol(), indicator.Src().String(), indicator.Dst().String(), len(b))
+	}
+	logger.Verboseln(packet.Dump())
+}
@@ -0,0 +1,182 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// dumpMaxSize is the size of a dump file after which it is rotated.
+const dumpMaxSize = 64 * 1024 * 1024
+
+// dumpMaxFiles is the number of rotated dump files kept besides the current one.
+const dumpMaxFiles = 4
+
+type countWriter struct {
+	file *os.File
+	size int64
+}
+
+func (w *countWriter) Write(b []byte) (n int, err error) {
+	n, err = w.file.Write(b)
+	w.size = w.size + int64(n)
+
+	return n, err
+}
+
+// Dumper describes a writer writes packets to rotating pcapng files. Each device is recorded as an interface, and a
+// file is rotated to path.1, path.2 and so on when it exceeds 64 MB.
+type Dumper struct {
+	lock       sync.Mutex
+	path       string
+	w          *countWriter
+	ngw        *pcapgo.NgWriter
+	interfaces map[string]int
+	isClosed   bool
+}
+
+// NewDumper returns a new dumper writing to the path.
+func NewDumper(path string) (*Dumper, error) {
+	d := &Dumper{path: path}
+
+	err := d.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// open creates the dump file and its section header. The lock must be held.
+func (d *Dumper) open() error {
+	file, err := os.Create(d.path)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", d.path, err)
+	}
+
+	d.w = &countWriter{file: file}
+	d.ngw = nil
+	d.interfaces = make(map[string]int)
+
+	return nil
+}
+
+// rotate closes the dump file, renames it and older ones, and creates a new one. The lock must be held.
+func (d *Dumper) rotate() error {
+	err := d.close()
+	if err != nil {
+		return err
+	}
+
+	for i := dumpMaxFiles - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", d.path, i), fmt.Sprintf("%s.%d", d.path, i+1))
+	}
+	err = os.Rename(d.path, d.path+".1")
+	if err != nil {
+		return fmt.Errorf("rename %s: %w", d.path, err)
+	}
+
+	return d.open()
+}
+
+// Write writes a packet captured in the device with the link type.
+func (d *Dumper) Write(name string, linkType layers.LinkType, data []byte) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.isClosed {
+		return nil
+	}
+
+	if d.w.size >= dumpMaxSize {
+		err := d.rotate()
+		if err != nil {
+			return fmt.Errorf("rotate: %w", err)
+		}
+	}
+
+	// Interface
+	key := fmt.Sprintf("%s %s", name, linkType)
+	id, ok := d.interfaces[key]
+	if !ok {
+		var err error
+
+		intf := pcapgo.NgInterface{
+			Name:                name,
+			OS:                  runtime.GOOS,
+			LinkType:            linkType,
+			TimestampResolution: 9,
+		}
+		if d.ngw == nil {
+			d.ngw, err = pcapgo.NewNgWriterInterface(d.w, intf, pcapgo.DefaultNgWriterOptions)
+			id = 0
+		} else {
+			id, err = d.ngw.AddInterface(intf)
+		}
+		if err != nil {
+			return fmt.Errorf("add interface %s: %w", name, err)
+		}
+		d.interfaces[key] = id
+	}
+
+	err := d.ngw.WritePacket(gopacket.CaptureInfo{
+		Timestamp:      time.Now(),
+		CaptureLength:  len(data),
+		Length:         len(data),
+		InterfaceIndex: id,
+	}, data)
+	if err != nil {
+		return fmt.Errorf("write packet: %w", err)
+	}
+
+	return d.ngw.Flush()
+}
+
+// Close closes the dump file. Packets written after closing are ignored.
+func (d *Dumper) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.isClosed {
+		return nil
+	}
+	d.isClosed = true
+
+	return d.close()
+}
+
+// close flushes and closes the dump file. The lock must be held.
+func (d *Dumper) close() error {
+	if d.ngw != nil {
+		err := d.ngw.Flush()
+		if err != nil {
+			return fmt.Errorf("flush: %w", err)
+		}
+	}
+
+	return d.w.file.Close()
+}
+
+var dumper *Dumper
+
+// SetDumper sets the dumper of packets read from and written to raw connections. It should be called before any
+// connection is opened.
+func SetDumper(d *Dumper) {
+	dumper = d
+}
+
+func dump(name string, linkType layers.LinkType, data []byte) {
+	if dumper == nil {
+		return
+	}
+
+	err := dumper.Write(name, linkType, data)
+	if err != nil {
+		logger.Errorln(fmt.Errorf("dump: %w", err))
+	}
+}
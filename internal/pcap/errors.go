@@ -0,0 +1,48 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of errors in handling packets, which are matched by errors.Is through wrapped errors.
+var (
+	// ErrUnsupportedLayer describes a packet with a layer type which is not supported.
+	ErrUnsupportedLayer = errors.New("layer not support")
+	// ErrNoRoute describes a packet which cannot be routed, like one missing NAT or to a client not connected.
+	ErrNoRoute = errors.New("no route")
+	// ErrChecksum describes a packet with an invalid checksum.
+	ErrChecksum = errors.New("invalid checksum")
+	// ErrWrite describes a packet which fails in writing.
+	ErrWrite = errors.New("write")
+)
+
+// Error describes an error of a kind, whose message is kept as the error it wraps.
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func (err *Error) Error() string {
+	return err.Err.Error()
+}
+
+// Unwrap returns the error it wraps.
+func (err *Error) Unwrap() error {
+	return err.Err
+}
+
+// Is returns if the target is the kind of the error.
+func (err *Error) Is(target error) bool {
+	return target == err.Kind
+}
+
+// NewError returns an error of the kind formatted by the format specifier.
+func NewError(kind error, format string, a ...interface{}) error {
+	return &Error{Kind: kind, Err: fmt.Errorf(format, a...)}
+}
+
+// WrapError returns an error of the kind which wraps the error.
+func WrapError(kind, err error) error {
+	return &Error{Kind: kind, Err: err}
+}
@@ -1,6 +1,9 @@
 package pcap
 
 import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -8,20 +11,103 @@
 	"ikago/internal/addr"
 	"ikago/internal/config"
 	"ikago/internal/crypto"
-	"ikago/internal/log"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// tcpState describes the state of the TCP emulation with a peer.
+type tcpState int
+
+const (
+	// tcpStateClosed describes there is no connection with the peer.
+	tcpStateClosed tcpState = iota
+	// tcpStateSYNSent describes a TCP SYN is sent and is waiting for a TCP SYN+ACK.
+	tcpStateSYNSent
+	// tcpStateSYNReceived describes a TCP SYN is received and a TCP SYN+ACK is sent, and is waiting for a TCP ACK.
+	tcpStateSYNReceived
+	// tcpStateEstablished describes the connection is established.
+	tcpStateEstablished
+)
+
+func (s tcpState) String() string {
+	switch s {
+	case tcpStateClosed:
+		return "CLOSED"
+	case tcpStateSYNSent:
+		return "SYN-SENT"
+	case tcpStateSYNReceived:
+		return "SYN-RECEIVED"
+	case tcpStateEstablished:
+		return "ESTABLISHED"
+	default:
+		return strconv.Itoa(int(s))
+	}
+}
+
+// tcpSegment describes a sent TCP segment which is not acknowledged.
+type tcpSegment struct {
+	seq      uint32
+	length   uint32
+	frags    [][]byte
+	lastSent time.Time
+	retries  int
+}
+
+// clientIndicator describes the state of TCP with a peer, whose Seq is accessed atomically.
 type clientIndicator struct {
-	crypt crypto.Crypt
-	seq   uint32
-	ack   uint32
+	addr      net.Addr
+	crypt     crypto.Crypt
+	state     tcpState
+	seq       uint32
+	ack       uint32
+	ackTimer  *time.Timer
+	unacked   []*tcpSegment
+	challenge []byte
+	reorder   reorderBuffer
+	tsRecent  uint32
 }
 
+// randomSeq returns a random initial TCP Seq, so every connection starts at its own sequence like the one in TCP.
+func randomSeq() uint32 {
+	b := make([]byte, 4)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		logger.Warnln(fmt.Errorf("generate random TCP Seq: %w", err))
+		return uint32(time.Now().UnixNano())
+	}
+
+	return binary.BigEndian.Uint32(b)
+}
+
+// readySegment describes a segment released from the reordering buffer which is not read yet.
+type readySegment struct {
+	client  *clientIndicator
+	payload []byte
+	ce      bool
+}
+
+type packetResult struct {
+	packet gopacket.Packet
+	err    error
+}
+
+// errWake describes the read is woken up by segments released from the reordering buffer.
+var errWake = errors.New("wake")
+
 const establishDeadline = 3 * time.Second
 const keepFragments = 30 * time.Second
+const delayedACK = 200 * time.Millisecond
+const retransmitInterval = 100 * time.Millisecond
+const retransmitTimeout = 1 * time.Second
+const maxRetransmissions = 3
+const maxUnackedSegments = 1024
+const keepAliveInterval = 10 * time.Second
+const maxKeepAliveProbes = 3
 
 // FakeTCPConn is a packet pcap network connection add fake TCP header to all traffic.
 type FakeTCPConn struct {
@@ -31,14 +117,21 @@ type FakeTCPConn struct {
 	srcPort       uint16
 	dstAddr       *net.TCPAddr
 	crypt         crypto.Crypt
+	auth          *crypto.Auth
 	mtu           int
 	appear        time.Time
+	isActive      bool
 	isConnected   bool
 	isReconnected bool
 	isClosed      bool
+	lastReceived  time.Time
 	clientsLock   sync.RWMutex
 	clients       map[string]*clientIndicator
-	id            uint16
+	ids           *idPool
+	readOnce      sync.Once
+	packets       chan packetResult
+	ready         []*readySegment
+	wake          chan struct{}
 	readDeadline  time.Time
 	writeDeadline time.Time
 }
@@ -48,19 +141,25 @@ func newConn() *FakeTCPConn {
 		defrag:  NewEasyDefragmenter(),
 		mtu:     MaxMTU,
 		clients: make(map[string]*clientIndicator),
+		ids:     newIdPool(),
+		packets: make(chan packetResult, 1),
+		wake:    make(chan struct{}, 1),
 	}
 	conn.defrag.SetDeadline(keepFragments)
 	return conn
 }
 
 // DialFakeTCP establishes FakeTCP connection for pcap networks.
-func DialFakeTCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, mtu int) (*FakeTCPConn, error) {
+func DialFakeTCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, auth *crypto.Auth, mtu int) (*FakeTCPConn, error) {
 	srcAddr := &net.TCPAddr{
 		IP:   srcDev.IPAddr().IP,
 		Port: int(srcPort),
 	}
+	if ipnet := srcDev.IPAddrOf(dstAddr.IP); ipnet != nil {
+		srcAddr.IP = ipnet.IP
+	}
 
-	conn, err := dialFakeTCPPassive(srcDev, dstDev, srcPort, dstAddr, crypt, mtu)
+	conn, err := dialFakeTCPPassive(srcDev, dstDev, srcPort, dstAddr, crypt, auth, mtu)
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "dial",
@@ -71,9 +170,11 @@ func DialFakeTCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, c
 		}
 	}
 
-	log.Infof("Connect to server %s\n", dstAddr.String())
+	logger.Infof("Connect to server %s\n", dstAddr.String())
 
+	conn.isActive = true
 	conn.appear = time.Now()
+	conn.lastReceived = conn.appear
 
 	// Handshake
 	err = conn.handshakeSYN()
@@ -91,16 +192,22 @@ func DialFakeTCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, c
 		time.Sleep(establishDeadline)
 
 		if !conn.isConnected {
-			log.Errorf("Cannot receive response from server %s, is it down?\n", dstAddr.String())
+			logger.Errorf("Cannot receive response from server %s, is it down?\n", dstAddr.String())
 		}
 	}()
 
+	go conn.keepAlive()
+
 	return conn, nil
 }
 
-func dialFakeTCPPassive(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, mtu int) (*FakeTCPConn, error) {
+func dialFakeTCPPassive(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, auth *crypto.Auth, mtu int) (*FakeTCPConn, error) {
+	srcIP := srcDev.IPAddrOf(dstAddr.IP)
+	if srcIP == nil {
+		return nil, fmt.Errorf("missing source address for %s", dstAddr.IP)
+	}
 	srcAddr := &net.TCPAddr{
-		IP:   srcDev.IPAddr().IP,
+		IP:   srcIP.IP,
 		Port: int(srcPort),
 	}
 
@@ -114,7 +221,14 @@ func dialFakeTCPPassive(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCP
 		return nil, fmt.Errorf("parse filter %s: %w", dstIP, err)
 	}
 
-	rawConn, err := CreateRawConn(srcDev, dstDev, fmt.Sprintf("ip && ((tcp && dst port %d && %s) || ((ip[6:2] & 0x1fff) != 0 && %s))", srcAddr.Port, filter, filter2))
+	var f string
+	if dstAddr.IP.To4() != nil {
+		f = fmt.Sprintf("ip && ((tcp && dst port %d && %s) || ((ip[6:2] & 0x1fff) != 0 && %s))", srcAddr.Port, filter, filter2)
+	} else {
+		f = fmt.Sprintf("ip6 && ((tcp && dst port %d && %s) || (ip6[6] == 44 && %s))", srcAddr.Port, filter, filter2)
+	}
+
+	rawConn, err := CreateRawConn(srcDev, dstDev, f)
 	if err != nil {
 		return nil, fmt.Errorf("create raw connection: %w", err)
 	}
@@ -122,14 +236,18 @@ func dialFakeTCPPassive(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCP
 	conn := newConn()
 	conn.srcPort = srcPort
 	conn.dstAddr = dstAddr
-	conn.crypt = crypt
+	// Crypts with states, like keys in rotation, are of each connection
+	conn.crypt = crypto.Clone(crypt)
+	conn.auth = auth
 	conn.mtu = mtu
 	conn.conn = rawConn
 
+	go conn.retransmit()
+
 	return conn, nil
 }
 
-func listenFakeTCPMulticast(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, mtu int) (*FakeTCPConn, error) {
+func listenFakeTCPMulticast(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, auth *crypto.Auth, mtu int) (*FakeTCPConn, error) {
 	addrs := make([]*net.TCPAddr, 0)
 	for _, ip := range srcDev.IPAddrs() {
 		addrs = append(addrs, &net.TCPAddr{IP: ip.IP, Port: int(srcPort)})
@@ -149,9 +267,12 @@ func listenFakeTCPMulticast(srcDev, dstDev *Device, srcPort uint16, crypt crypto
 	conn := newConn()
 	conn.srcPort = srcPort
 	conn.crypt = crypt
+	conn.auth = auth
 	conn.mtu = mtu
 	conn.conn = rawConn
 
+	go conn.retransmit()
+
 	return conn, nil
 }
 
@@ -178,8 +299,9 @@ func (c *FakeTCPConn) handshakeSYN() error {
 	if !ok {
 		// Initial TCP Seq
 		client = &clientIndicator{
+			addr:  c.RemoteAddr(),
 			crypt: c.crypt,
-			seq:   0,
+			seq:   randomSeq(),
 		}
 
 		// Map client
@@ -187,15 +309,26 @@ func (c *FakeTCPConn) handshakeSYN() error {
 		c.clients[c.RemoteAddr().String()] = client
 		c.clientsLock.Unlock()
 	}
+	client.unacked = nil
+
+	// Keys are rotated from epoch 0 in each handshake
+	if r := crypto.FindRotatingCrypt(c.crypt); r != nil {
+		r.Reset()
+	}
+	// The peer may restart from the first sequence number in each handshake
+	if r := crypto.FindReplayCrypt(c.crypt); r != nil {
+		r.Reset()
+	}
 
 	// Create layers
-	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, uint16(c.dstAddr.Port), client.seq, client.ack, c.conn, c.dstAddr.IP, c.id, 128, c.RemoteDev().HardwareAddr())
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, uint16(c.dstAddr.Port), atomic.LoadUint32(&client.seq), client.ack, c.conn, c.dstAddr.IP, c.ids.Next(c.dstAddr.IP), c.RemoteDev().HardwareAddr())
 	if err != nil {
 		return err
 	}
 
 	// Make TCP layer SYN
 	FlagTCPLayer(transportLayer.(*layers.TCP), true, false, false)
+	optionTCPLayer(transportLayer.(*layers.TCP), client.tsRecent)
 
 	// Serialize layers
 	data, err := Serialize(linkLayer, networkLayer, transportLayer)
@@ -210,18 +343,10 @@ func (c *FakeTCPConn) handshakeSYN() error {
 	}
 
 	// TCP Seq
-	client.seq++
+	atomic.AddUint32(&client.seq, 1)
+	client.state = tcpStateSYNSent
 
-	// IPv4 Id
-	if networkLayer.LayerType() == layers.LayerTypeIPv4 {
-		c.id++
-	}
-
-	srcAddr := &net.TCPAddr{
-		IP:   c.LocalDev().IPAddr().IP,
-		Port: int(c.srcPort),
-	}
-	log.Verbosef("Send TCP SYN: %s -> %s\n", srcAddr.String(), c.RemoteAddr().String())
+	logger.Verbosef("Send TCP SYN: %s -> %s\n", c.LocalAddr().String(), c.RemoteAddr().String())
 
 	return nil
 }
@@ -244,8 +369,9 @@ func (c *FakeTCPConn) handshakeSYNACK(indicator *PacketIndicator) error {
 	if !ok {
 		// Initial TCP Seq
 		client = &clientIndicator{
+			addr:  indicator.Src(),
 			crypt: c.crypt,
-			seq:   0,
+			seq:   randomSeq(),
 		}
 
 		// Map client
@@ -254,18 +380,39 @@ func (c *FakeTCPConn) handshakeSYNACK(indicator *PacketIndicator) error {
 		c.clientsLock.Unlock()
 	}
 	client.ack = indicator.TCPLayer().Seq + 1
+	client.unacked = nil
+	client.challenge = nil
+	client.tsRecent, _ = parseTimestamp(indicator.TCPLayer().Options)
+
+	// Keys are rotated from epoch 0 in each handshake
+	if r := crypto.FindRotatingCrypt(c.crypt); r != nil {
+		r.Reset()
+	}
+	// The peer may restart from the first sequence number in each handshake
+	if r := crypto.FindReplayCrypt(c.crypt); r != nil {
+		r.Reset()
+	}
+
+	// Challenge
+	if c.auth != nil {
+		client.challenge, err = c.auth.Challenge()
+		if err != nil {
+			return fmt.Errorf("challenge: %w", err)
+		}
+	}
 
 	// Create layers
-	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), client.seq, client.ack, c.conn, indicator.SrcIP(), c.id, 64, indicator.SrcHardwareAddr())
+	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), atomic.LoadUint32(&client.seq), client.ack, c.conn, indicator.SrcIP(), c.ids.Next(indicator.SrcIP()), indicator.SrcHardwareAddr())
 	if err != nil {
 		return fmt.Errorf("create layers: %w", err)
 	}
 
 	// Make TCP layer SYN & ACK
 	FlagTCPLayer(newTransportLayer.(*layers.TCP), true, false, true)
+	optionTCPLayer(newTransportLayer.(*layers.TCP), client.tsRecent)
 
 	// Serialize layers
-	data, err := Serialize(newLinkLayer, newNetworkLayer, newTransportLayer)
+	data, err := Serialize(newLinkLayer, newNetworkLayer, newTransportLayer, gopacket.Payload(client.challenge))
 	if err != nil {
 		return fmt.Errorf("serialize: %w", err)
 	}
@@ -277,18 +424,10 @@ func (c *FakeTCPConn) handshakeSYNACK(indicator *PacketIndicator) error {
 	}
 
 	// TCP Seq
-	client.seq++
-
-	// IPv4 Id
-	if newNetworkLayer.LayerType() == layers.LayerTypeIPv4 {
-		c.id++
-	}
+	atomic.AddUint32(&client.seq, 1+uint32(len(client.challenge)))
+	client.state = tcpStateSYNReceived
 
-	srcAddr := &net.TCPAddr{
-		IP:   c.LocalDev().IPAddr().IP,
-		Port: int(indicator.DstPort()),
-	}
-	log.Verbosef("Send TCP SYN+ACK: %s <- %s\n", indicator.Src().String(), srcAddr.String())
+	logger.Verbosef("Send TCP SYN+ACK: %s <- %s\n", indicator.Src().String(), indicator.Dst().String())
 
 	return nil
 }
@@ -313,19 +452,31 @@ func (c *FakeTCPConn) handshakeACK(indicator *PacketIndicator) error {
 	}
 
 	// TCP Ack
-	client.ack = indicator.TCPLayer().Seq + 1
+	client.ack = indicator.TCPLayer().Seq + 1 + uint32(len(indicator.Payload()))
+	client.tsRecent, _ = parseTimestamp(indicator.TCPLayer().Options)
+
+	// Response
+	var response []byte
+	if c.auth != nil {
+		if len(indicator.Payload()) <= 0 {
+			return fmt.Errorf("missing challenge from %s", indicator.Src().String())
+		}
+
+		response = c.auth.Respond(indicator.Payload())
+	}
 
 	// Create layers
-	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), client.seq, client.ack, c.conn, indicator.SrcIP(), c.id, 128, indicator.SrcHardwareAddr())
+	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), atomic.LoadUint32(&client.seq), client.ack, c.conn, indicator.SrcIP(), c.ids.Next(indicator.SrcIP()), indicator.SrcHardwareAddr())
 	if err != nil {
 		return fmt.Errorf("create layers: %w", err)
 	}
 
 	// Make TCP layer ACK
 	FlagTCPLayer(newTransportLayer.(*layers.TCP), false, false, true)
+	optionTCPLayer(newTransportLayer.(*layers.TCP), client.tsRecent)
 
 	// Serialize layers
-	data, err := Serialize(newLinkLayer, newNetworkLayer, newTransportLayer)
+	data, err := Serialize(newLinkLayer, newNetworkLayer, newTransportLayer, gopacket.Payload(response))
 	if err != nil {
 		return fmt.Errorf("serialize: %w", err)
 	}
@@ -336,16 +487,11 @@ func (c *FakeTCPConn) handshakeACK(indicator *PacketIndicator) error {
 		return fmt.Errorf("write: %w", err)
 	}
 
-	// IPv4 Id
-	if newNetworkLayer.LayerType() == layers.LayerTypeIPv4 {
-		c.id++
-	}
+	// TCP Seq
+	atomic.AddUint32(&client.seq, uint32(len(response)))
+	client.state = tcpStateEstablished
 
-	srcAddr := &net.TCPAddr{
-		IP:   c.LocalDev().IPAddr().IP,
-		Port: int(indicator.DstPort()),
-	}
-	log.Verbosef("Send TCP ACK: %s -> %s\n", srcAddr.String(), indicator.Src().String())
+	logger.Verbosef("Send TCP ACK: %s -> %s\n", indicator.Dst().String(), indicator.Src().String())
 
 	return nil
 }
@@ -355,7 +501,21 @@ func (c *FakeTCPConn) Write(b []byte) (n int, err error) {
 }
 
 func (c *FakeTCPConn) ReadFrom(p []byte) (n int, a net.Addr, err error) {
+	// Segments released from the reordering buffer
+	c.lock.Lock()
+	if len(c.ready) > 0 {
+		segment := c.ready[0]
+		c.ready = c.ready[1:]
+		c.lock.Unlock()
+
+		return c.decrypt(p, segment.client, segment.client.addr, segment.payload, segment.ce)
+	}
+	c.lock.Unlock()
+
 	packet, a, err := c.readPacketFrom()
+	if err == errWake {
+		return c.ReadFrom(p)
+	}
 	if err != nil {
 		return 0, a, &net.OpError{
 			Op:     "read",
@@ -366,6 +526,10 @@ func (c *FakeTCPConn) ReadFrom(p []byte) (n int, a net.Addr, err error) {
 		}
 	}
 
+	c.lock.Lock()
+	c.lastReceived = time.Now()
+	c.lock.Unlock()
+
 	// Parse packet
 	indicator, err := ParsePacket(packet)
 	if err != nil {
@@ -378,10 +542,22 @@ func (c *FakeTCPConn) ReadFrom(p []byte) (n int, a net.Addr, err error) {
 		}
 	}
 
+	// Drop segments from sources refused by the ACL before decrypting
+	if !permits(indicator.SrcIP()) {
+		return 0, a, nil
+	}
+
+	// Drop segments out of the window in strict mode
+	if c.isSpoofed(indicator, a) {
+		logger.Verbosef("Drop TCP segment out of window: %s <- %s\n", indicator.Dst().String(), a.String())
+
+		return 0, a, nil
+	}
+
 	// Check TCP flags
 	if indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP {
 		if indicator.IsRST() {
-			log.Errorf("Receive TCP RST: %s <- %s\n", indicator.Dst().String(), a.String())
+			logger.Errorf("Receive TCP RST: %s <- %s\n", indicator.Dst().String(), a.String())
 
 			// Re-establish connection
 			err := c.Reconnect()
@@ -396,7 +572,20 @@ func (c *FakeTCPConn) ReadFrom(p []byte) (n int, a net.Addr, err error) {
 			}
 		}
 		if indicator.IsFIN() {
-			log.Infof("Receive TCP FIN: %s <- %s\n", indicator.Dst().String(), a.String())
+			logger.Infof("Receive TCP FIN: %s <- %s\n", indicator.Dst().String(), a.String())
+
+			err := c.handshakeFINACK(indicator, a)
+			if err != nil {
+				return 0, a, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   a,
+					Err:    fmt.Errorf("handshake: %w", err),
+				}
+			}
+
+			return 0, a, nil
 		}
 	}
 
@@ -405,13 +594,13 @@ func (c *FakeTCPConn) ReadFrom(p []byte) (n int, a net.Addr, err error) {
 		if indicator.IsSYN() {
 			// SYN+ACK
 			if indicator.IsACK() {
-				log.Verbosef("Receive TCP SYN+ACK: %s <- %s\n", indicator.Dst().String(), a.String())
+				logger.Verbosef("Receive TCP SYN+ACK: %s <- %s\n", indicator.Dst().String(), a.String())
 
 				if !c.isConnected {
 					t := time.Now()
 					duration := t.Sub(c.appear)
 
-					log.Infof("Connected to server %s in %.3f ms (RTT)\n", a.String(), float64(duration.Microseconds())/1000)
+					logger.Infof("Connected to server %s in %.3f ms (RTT)\n", a.String(), float64(duration.Microseconds())/1000)
 
 					c.isConnected = true
 				}
@@ -419,7 +608,7 @@ func (c *FakeTCPConn) ReadFrom(p []byte) (n int, a net.Addr, err error) {
 
 				err = c.handshakeACK(indicator)
 			} else {
-				log.Verbosef("Receive TCP SYN: %s -> %s\n", a.String(), indicator.Dst().String())
+				logger.Verbosef("Receive TCP SYN: %s -> %s\n", a.String(), indicator.Dst().String())
 
 				err = c.handshakeSYNACK(indicator)
 			}
@@ -437,15 +626,21 @@ func (c *FakeTCPConn) ReadFrom(p []byte) (n int, a net.Addr, err error) {
 		}
 	}
 
-	if indicator.Payload() == nil {
-		return 0, a, nil
-	}
-
 	// Client
 	c.clientsLock.RLock()
 	client, ok := c.clients[a.String()]
 	c.clientsLock.RUnlock()
 	if !ok {
+		if indicator.Payload() == nil {
+			return 0, a, nil
+		}
+
+		// Reset the unknown connection
+		err := c.reset(indicator, a)
+		if err != nil {
+			logger.Errorln(fmt.Errorf("reset %s: %w", a.String(), err))
+		}
+
 		return 0, a, &net.OpError{
 			Op:     "read",
 			Net:    "pcap",
@@ -455,16 +650,94 @@ func (c *FakeTCPConn) ReadFrom(p []byte) (n int, a net.Addr, err error) {
 		}
 	}
 
-	// TCP Ack, always use the expected one
 	if indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP {
-		expectedAck := indicator.TCPLayer().Seq + uint32(len(indicator.Payload()))
-		if expectedAck > client.ack || (4294967295-indicator.TCPLayer().Seq < uint32(len(indicator.Payload()))) {
-			client.ack = expectedAck
+		c.lock.Lock()
+
+		// Establish
+		if client.state == tcpStateSYNReceived && indicator.IsACK() {
+			if c.auth != nil {
+				ok := c.auth.Verify(client.challenge, indicator.Payload())
+				client.challenge = nil
+				if !ok {
+					c.lock.Unlock()
+
+					return 0, a, c.reject(indicator, a)
+				}
+
+				// The response is not data
+				client.ack = indicator.TCPLayer().Seq + uint32(len(indicator.Payload()))
+				client.state = tcpStateEstablished
+				c.lock.Unlock()
+
+				logger.Verbosef("Authenticate client %s\n", a.String())
+
+				return 0, a, nil
+			}
+
+			client.state = tcpStateEstablished
+			logger.Verbosef("Establish TCP connection: %s <- %s\n", indicator.Dst().String(), a.String())
 		}
+
+		// Drop traffic from clients not authenticated
+		if c.auth != nil && client.state != tcpStateEstablished {
+			c.lock.Unlock()
+
+			return 0, a, nil
+		}
+
+		// Timestamps to echo
+		if ts, ok := parseTimestamp(indicator.TCPLayer().Options); ok {
+			client.tsRecent = ts
+		}
+
+		// Remove acknowledged segments
+		if indicator.IsACK() {
+			client.acknowledge(indicator.TCPLayer().Ack)
+			client.acknowledgeSelectively(parseSACK(indicator.TCPLayer().Options))
+		}
+
+		// Reply keep-alive probes from clients immediately
+		if !c.isActive && indicator.Payload() == nil && indicator.TCPLayer().Seq == client.ack-1 {
+			err := c.writeFlags(client, false, false)
+			if err != nil {
+				logger.Errorln(fmt.Errorf("reply keep-alive to %s: %w", a.String(), err))
+			}
+		}
+
+		// Reorder segments, or always use the expected TCP Ack
+		if indicator.Payload() != nil {
+			if reorderWindow > 0 && client.state == tcpStateEstablished {
+				isInOrder := c.reorderSegment(client, indicator.TCPLayer().Seq, indicator.Payload(), isCE(indicator))
+				c.delayACK(client)
+				if !isInOrder {
+					c.lock.Unlock()
+
+					return 0, a, nil
+				}
+			} else {
+				expectedAck := indicator.TCPLayer().Seq + uint32(len(indicator.Payload()))
+				if expectedAck > client.ack || (4294967295-indicator.TCPLayer().Seq < uint32(len(indicator.Payload()))) {
+					client.ack = expectedAck
+				}
+
+				c.delayACK(client)
+			}
+		}
+
+		c.lock.Unlock()
+	}
+
+	if indicator.Payload() == nil {
+		return 0, a, nil
 	}
 
-	// Decrypt
-	contents, err := client.crypt.Decrypt(indicator.Payload())
+	return c.decrypt(p, client, a, indicator.Payload(), isCE(indicator))
+}
+
+// decrypt decrypts the payload from the client into the buffer. Congestion experienced in the outer header is restored
+// to the embedded packet if ce is set.
+func (c *FakeTCPConn) decrypt(p []byte, client *clientIndicator, a net.Addr, payload []byte, ce bool) (int, net.Addr, error) {
+	contents, err := client.crypt.Decrypt(payload)
 	if err != nil {
 		return 0, a, &net.OpError{
 			Op:     "read",
@@ -476,80 +749,185 @@ func (c *FakeTCPConn) ReadFrom(p []byte) (n int, a net.Addr, err error) {
 	}
 
 	copy(p, contents)
+	if ce {
+		markCE(p)
+	}
 
-	return len(contents), a, err
+	return len(contents), a, nil
 }
 
-func (c *FakeTCPConn) readPacketFrom() (gopacket.Packet, net.Addr, error) {
-	type tuple struct {
-		packet gopacket.Packet
-		err    error
+// reorderSegment updates the TCP Ack by a segment from the client, and returns if the segment is the expected one and
+// can be read now. Segments ahead of the expected one are buffered, and released in order when the gap is filled, or
+// the gap times out or the buffer is full. Segments received already are dropped. The lock must be held.
+func (c *FakeTCPConn) reorderSegment(client *clientIndicator, seq uint32, payload []byte, ce bool) bool {
+	switch {
+	case seq == client.ack:
+		client.ack = seq + uint32(len(payload))
+		c.release(client)
+
+		return true
+	case seqLess(seq, client.ack):
+		logger.Verbosef("Drop duplicated TCP segment %d from %s\n", seq, client.addr.String())
+
+		return false
+	default:
+		client.reorder.push(seq, payload, ce)
+
+		if len(client.reorder.segments) >= reorderWindow {
+			c.skipGap(client)
+		} else if client.reorder.timer == nil {
+			c.waitGap(client, reorderTimeout)
+		}
+
+		return false
 	}
+}
 
-	ch := make(chan tuple)
-	go func() {
-		for {
-			packet, err := c.conn.ReadPacket()
-			if err != nil {
-				ch <- tuple{err: err}
-				return
-			}
+// release moves segments continuous from the TCP Ack in the reordering buffer to the ready queue. The lock must be
+// held.
+func (c *FakeTCPConn) release(client *clientIndicator) {
+	segments, ack := client.reorder.pop(client.ack)
+	if len(segments) <= 0 {
+		return
+	}
 
-			// Parse packet
-			indicator, err := ParsePacket(packet)
-			if err != nil {
-				ch <- tuple{err: fmt.Errorf("parse packet: %w", err)}
-				return
-			}
+	client.ack = ack
+	for _, segment := range segments {
+		c.ready = append(c.ready, &readySegment{client: client, payload: segment.payload, ce: segment.ce})
+	}
 
-			// Handle fragments
-			indicator, err = c.defrag.Append(indicator)
-			if err != nil {
-				ch <- tuple{err: fmt.Errorf("defrag: %w", err)}
-				return
-			}
-			if indicator != nil {
-				ch <- tuple{packet: indicator.packet}
-				return
-			}
+	// Wake up the read
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// skipGap gives up the missing segments before the first buffered one, and releases segments after them. The lock
+// must be held.
+func (c *FakeTCPConn) skipGap(client *clientIndicator) {
+	segment := client.reorder.first()
+	if segment == nil {
+		return
+	}
+
+	logger.Verbosef("Skip TCP Seq %d to %d from %s\n", client.ack, segment.seq, client.addr.String())
+
+	client.ack = segment.seq
+	c.release(client)
+}
+
+// waitGap skips the gap if it is not filled in the duration. The lock must be held.
+func (c *FakeTCPConn) waitGap(client *clientIndicator, d time.Duration) {
+	client.reorder.timer = time.AfterFunc(d, func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		client.reorder.timer = nil
+		if c.isClosed {
+			return
 		}
-	}()
+
+		segment := client.reorder.first()
+		if segment == nil {
+			return
+		}
+		if elapsed := time.Since(segment.arrival); elapsed < reorderTimeout {
+			c.waitGap(client, reorderTimeout-elapsed)
+			return
+		}
+
+		c.skipGap(client)
+		if client.reorder.first() != nil {
+			c.waitGap(client, reorderTimeout)
+		}
+	})
+}
+
+// readPackets reads packets from the raw connection and reassembles fragments until the raw connection is closed.
+func (c *FakeTCPConn) readPackets() {
+	for {
+		packet, err := c.conn.ReadPacket()
+		if err != nil {
+			c.packets <- packetResult{err: err}
+			return
+		}
+
+		// Parse packet
+		indicator, err := ParsePacket(packet)
+		if err != nil {
+			c.packets <- packetResult{err: fmt.Errorf("parse packet: %w", err)}
+			continue
+		}
+
+		// Handle fragments
+		indicator, err = c.defrag.Append(indicator)
+		if err != nil {
+			c.packets <- packetResult{err: fmt.Errorf("defrag: %w", err)}
+			continue
+		}
+		if indicator != nil {
+			c.packets <- packetResult{packet: indicator.packet}
+		}
+	}
+}
+
+func (c *FakeTCPConn) readPacketFrom() (gopacket.Packet, net.Addr, error) {
+	c.readOnce.Do(func() {
+		go c.readPackets()
+	})
+
 	// Timeout
+	var timeout <-chan time.Time
 	if !c.readDeadline.IsZero() {
-		go func() {
-			duration := c.readDeadline.Sub(time.Now())
-			if duration > 0 {
-				time.Sleep(duration)
-			}
-			ch <- tuple{err: &timeoutError{Err: "timeout"}}
-		}()
+		timer := time.NewTimer(c.readDeadline.Sub(time.Now()))
+		defer timer.Stop()
+		timeout = timer.C
 	}
 
-	tu := <-ch
-	if tu.err != nil {
-		return nil, nil, tu.err
+	var result packetResult
+	select {
+	case result = <-c.packets:
+		break
+	case <-c.wake:
+		return nil, nil, errWake
+	case <-timeout:
+		return nil, nil, &timeoutError{Err: "timeout"}
+	}
+	if result.err != nil {
+		return nil, nil, result.err
 	}
 
 	// Parse packet
-	indicator, err := ParsePacket(tu.packet)
+	indicator, err := ParsePacket(result.packet)
 	if err != nil {
 		return nil, nil, fmt.Errorf("parse packet: %w", err)
 	}
 
 	switch t := indicator.TransportLayer().LayerType(); t {
 	case layers.LayerTypeTCP:
-		return tu.packet, &net.UDPAddr{
+		return result.packet, &net.UDPAddr{
 			IP:   indicator.SrcIP(),
 			Port: int(indicator.SrcPort()),
 		}, nil
 	case layers.LayerTypeUDP:
-		return tu.packet, indicator.Src(), nil
+		return result.packet, indicator.Src(), nil
 	default:
-		return nil, indicator.Src(), fmt.Errorf("transport layer type %s not support", t)
+		return nil, indicator.Src(), NewError(ErrUnsupportedLayer, "transport layer type %s not support", t)
 	}
 }
 
 func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	return c.writeTo(p, addr, false)
+}
+
+// writeDF writes to the server in a single packet with DF set, which is neither fragmented nor retransmitted, so it is
+// dropped if it exceeds the path MTU.
+func (c *FakeTCPConn) writeDF(b []byte) (n int, err error) {
+	return c.writeTo(b, c.RemoteAddr(), true)
+}
+
+func (c *FakeTCPConn) writeTo(p []byte, addr net.Addr, df bool) (n int, err error) {
 	var (
 		dstIP   net.IP
 		dstPort uint16
@@ -595,11 +973,13 @@ func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 		}
 
 		// Create layers
-		transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, dstPort, client.seq, client.ack, c.conn, dstIP, c.id, 128, c.conn.RemoteDev().HardwareAddr())
+		transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, dstPort, atomic.LoadUint32(&client.seq), client.ack, c.conn, dstIP, c.ids.Next(dstIP), c.conn.RemoteDev().HardwareAddr())
 		if err != nil {
 			ch <- fmt.Errorf("create layers: %w", err)
 			return
 		}
+		optionTCPLayer(transportLayer.(*layers.TCP), client.tsRecent)
+		copyToS(networkLayer, p)
 
 		// Encrypt
 		contents, err := client.crypt.Encrypt(p)
@@ -609,7 +989,14 @@ func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 		}
 
 		// Fragment
-		fragments, err = CreateFragmentPackets(linkLayer.(gopacket.Layer), networkLayer.(gopacket.Layer), transportLayer.(gopacket.Layer), gopacket.Payload(contents), c.mtu)
+		mtu := c.mtu
+		if df {
+			mtu = IPv4MaxSize
+			if ipv4Layer, ok := networkLayer.(*layers.IPv4); ok {
+				FlagIPv4Layer(ipv4Layer, true, false, 0)
+			}
+		}
+		fragments, err = CreateFragmentPackets(linkLayer, networkLayer.(gopacket.Layer), transportLayer.(gopacket.Layer), gopacket.Payload(contents), mtu)
 		if err != nil {
 			ch <- fmt.Errorf("fragment: %w", err)
 			return
@@ -624,14 +1011,28 @@ func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 			}
 		}
 
-		// TCP Seq
-		client.seq = client.seq + uint32(len(contents))
+		// Keep the segment for retransmission
+		if !df {
+			client.unacked = append(client.unacked, &tcpSegment{
+				seq:      atomic.LoadUint32(&client.seq),
+				length:   uint32(len(contents)),
+				frags:    fragments,
+				lastSent: time.Now(),
+			})
+			if len(client.unacked) > maxUnackedSegments {
+				client.unacked = client.unacked[1:]
+			}
+		}
 
-		// IPv4 Id
-		if networkLayer.LayerType() == layers.LayerTypeIPv4 {
-			c.id++
+		// The TCP ACK is carried with the segment
+		if client.ackTimer != nil {
+			client.ackTimer.Stop()
+			client.ackTimer = nil
 		}
 
+		// TCP Seq
+		atomic.AddUint32(&client.seq, uint32(len(contents)))
+
 		ch <- nil
 		return
 	}()
@@ -661,7 +1062,25 @@ func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 }
 
 func (c *FakeTCPConn) Close() error {
+	// Tear down connections
+	c.lock.Lock()
+	c.clientsLock.RLock()
+	for _, client := range c.clients {
+		if client.state != tcpStateEstablished {
+			continue
+		}
+
+		err := c.writeFlags(client, true, false)
+		if err != nil {
+			logger.Errorln(fmt.Errorf("handshake: %w", err))
+		}
+		client.state = tcpStateClosed
+
+		logger.Verbosef("Send TCP FIN: %s -> %s\n", c.LocalAddr().String(), client.addr.String())
+	}
+	c.clientsLock.RUnlock()
 	c.isClosed = true
+	c.lock.Unlock()
 
 	err := c.conn.Close()
 	if err != nil {
@@ -676,13 +1095,49 @@ func (c *FakeTCPConn) Close() error {
 	return nil
 }
 
+// MTU returns the MTU of the connection.
+func (c *FakeTCPConn) MTU() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.mtu
+}
+
+// SetMTU sets the MTU of the connection, packets written later are fragmented in the MTU.
+func (c *FakeTCPConn) SetMTU(mtu int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.mtu = mtu
+}
+
+// overhead returns the size of headers and the cost of crypt in a packet to the server.
+func (c *FakeTCPConn) overhead() int {
+	size := 20 + 20 + TCPOptionsSize()
+	if c.dstAddr != nil && c.dstAddr.IP.To4() == nil {
+		size = size + 20
+	}
+	if c.crypt != nil {
+		size = size + c.crypt.Cost()
+	}
+
+	return size
+}
+
 // LocalDev returns the local device.
 func (c *FakeTCPConn) LocalDev() *Device {
 	return c.conn.LocalDev()
 }
 
 func (c *FakeTCPConn) LocalAddr() net.Addr {
-	return &net.UDPAddr{IP: c.LocalDev().IPAddr().IP, Port: int(c.srcPort)}
+	ip := c.LocalDev().IPAddr().IP
+	if c.dstAddr != nil {
+		if ipnet := c.LocalDev().IPAddrOf(c.dstAddr.IP); ipnet != nil {
+			ip = ipnet.IP
+		}
+	}
+
+	return &net.UDPAddr{IP: ip, Port: int(c.srcPort)}
 }
 
 // RemoteDev returns the remote device.
@@ -723,6 +1178,300 @@ func (c *FakeTCPConn) SetWriteDeadline(t time.Time) error {
 	return nil
 }
 
+func (c *FakeTCPConn) handshakeFINACK(indicator *PacketIndicator, a net.Addr) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Client
+	c.clientsLock.RLock()
+	client, ok := c.clients[a.String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("client %s unauthorized", a.String())
+	}
+
+	// TCP Ack, FIN takes a sequence
+	client.ack = indicator.TCPLayer().Seq + uint32(len(indicator.Payload())) + 1
+
+	// Reply TCP ACK
+	if client.state == tcpStateEstablished {
+		err := c.writeFlags(client, false, false)
+		if err != nil {
+			return err
+		}
+
+		logger.Verbosef("Send TCP ACK: %s -> %s\n", indicator.Dst().String(), a.String())
+	}
+
+	client.state = tcpStateClosed
+	client.unacked = nil
+	if client.ackTimer != nil {
+		client.ackTimer.Stop()
+		client.ackTimer = nil
+	}
+
+	return nil
+}
+
+// reject resets a client failed in authentication and forgets it.
+func (c *FakeTCPConn) reject(indicator *PacketIndicator, a net.Addr) error {
+	c.clientsLock.Lock()
+	delete(c.clients, a.String())
+	c.clientsLock.Unlock()
+
+	err := c.reset(indicator, a)
+	if err != nil {
+		logger.Errorln(fmt.Errorf("reset %s: %w", a.String(), err))
+	}
+
+	return &net.OpError{
+		Op:     "read",
+		Net:    "pcap",
+		Source: c.LocalAddr(),
+		Addr:   a,
+		Err:    fmt.Errorf("client %s authentication failed", a.String()),
+	}
+}
+
+// reset sends a TCP RST to a peer which is not connected.
+func (c *FakeTCPConn) reset(indicator *PacketIndicator, a net.Addr) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	client := &clientIndicator{
+		addr: a,
+		seq:  indicator.TCPLayer().Ack,
+		ack:  indicator.TCPLayer().Seq + uint32(len(indicator.Payload())),
+	}
+
+	err := c.writeFlags(client, false, true)
+	if err != nil {
+		return err
+	}
+
+	logger.Verbosef("Send TCP RST: %s -> %s\n", indicator.Dst().String(), a.String())
+
+	return nil
+}
+
+// writeFlags writes a TCP segment without payload to the peer, with FIN or RST if required. The lock must be held.
+func (c *FakeTCPConn) writeFlags(client *clientIndicator, fin, rst bool) error {
+	var (
+		dstIP   net.IP
+		dstPort uint16
+	)
+
+	switch t := client.addr.(type) {
+	case *net.TCPAddr:
+		dstIP = client.addr.(*net.TCPAddr).IP
+		dstPort = uint16(client.addr.(*net.TCPAddr).Port)
+	case *net.UDPAddr:
+		dstIP = client.addr.(*net.UDPAddr).IP
+		dstPort = uint16(client.addr.(*net.UDPAddr).Port)
+	default:
+		return fmt.Errorf("type %T not support", t)
+	}
+
+	// Create layers
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, dstPort, atomic.LoadUint32(&client.seq), client.ack, c.conn, dstIP, c.ids.Next(dstIP), c.conn.RemoteDev().HardwareAddr())
+	if err != nil {
+		return fmt.Errorf("create layers: %w", err)
+	}
+
+	// Make TCP layer ACK, with FIN or RST
+	tcpLayer := transportLayer.(*layers.TCP)
+	FlagTCPLayer(tcpLayer, false, false, true)
+	tcpLayer.FIN = fin
+	tcpLayer.RST = rst
+	optionTCPLayer(tcpLayer, client.tsRecent)
+
+	// Segments received out of order
+	if option := client.reorder.sack(); option != nil && !fin && !rst {
+		tcpLayer.Options = append(tcpLayer.Options, *option)
+	}
+
+	// Serialize layers
+	data, err := Serialize(linkLayer, networkLayer, transportLayer)
+	if err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	// Write packet data
+	_, err = c.conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// TCP Seq, FIN takes a sequence
+	if fin {
+		atomic.AddUint32(&client.seq, 1)
+	}
+
+	return nil
+}
+
+// delayACK sends a TCP ACK to the peer if no segment is sent in a while. The lock must be held.
+func (c *FakeTCPConn) delayACK(client *clientIndicator) {
+	if client.ackTimer != nil {
+		return
+	}
+
+	client.ackTimer = time.AfterFunc(delayedACK, func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		client.ackTimer = nil
+		if c.isClosed || client.state != tcpStateEstablished {
+			return
+		}
+
+		err := c.writeFlags(client, false, false)
+		if err != nil {
+			logger.Errorln(fmt.Errorf("ack %s: %w", client.addr.String(), err))
+		}
+	})
+}
+
+// retransmit retransmits segments which are not acknowledged in time until the connection is closed.
+func (c *FakeTCPConn) retransmit() {
+	ticker := time.NewTicker(retransmitInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+
+		c.lock.Lock()
+		if c.isClosed {
+			c.lock.Unlock()
+			return
+		}
+		c.clientsLock.RLock()
+		for _, client := range c.clients {
+			segments := client.unacked[:0]
+			for _, segment := range client.unacked {
+				if now.Sub(segment.lastSent) < retransmitTimeout {
+					segments = append(segments, segment)
+					continue
+				}
+				if segment.retries >= maxRetransmissions {
+					logger.Verbosef("Drop TCP segment %d to %s after %d retransmissions\n", segment.seq, client.addr.String(), segment.retries)
+					continue
+				}
+
+				for _, frag := range segment.frags {
+					_, err := c.conn.Write(frag)
+					if err != nil {
+						logger.Errorln(fmt.Errorf("retransmit to %s: %w", client.addr.String(), err))
+						break
+					}
+				}
+				segment.retries++
+				segment.lastSent = now
+				segments = append(segments, segment)
+
+				logger.Verbosef("Retransmit TCP segment %d to %s\n", segment.seq, client.addr.String())
+			}
+			client.unacked = segments
+		}
+		c.clientsLock.RUnlock()
+		c.lock.Unlock()
+	}
+}
+
+// keepAlive probes the server if nothing is received from it in an interval, and reconnects to the server if several
+// probes in a row are not responded.
+func (c *FakeTCPConn) keepAlive() {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	probes := 0
+	isLost := false
+	for range ticker.C {
+		c.lock.Lock()
+		if c.isClosed {
+			c.lock.Unlock()
+			return
+		}
+
+		// Alive
+		if time.Since(c.lastReceived) < keepAliveInterval {
+			c.lock.Unlock()
+			if isLost {
+				logger.Infof("Server %s is back\n", c.RemoteAddr().String())
+			}
+			probes = 0
+			isLost = false
+			continue
+		}
+
+		// Lost
+		if probes >= maxKeepAliveProbes {
+			c.lock.Unlock()
+			if !isLost {
+				logger.Errorf("Lost server %s after %d keep-alive probes, reconnecting\n", c.RemoteAddr().String(), probes)
+				isLost = true
+			}
+
+			err := c.handshakeSYN()
+			if err != nil {
+				logger.Errorln(fmt.Errorf("reconnect to %s: %w", c.RemoteAddr().String(), err))
+			}
+			continue
+		}
+
+		// Probe with the last acknowledged TCP Seq, like the one in TCP
+		c.clientsLock.RLock()
+		client, ok := c.clients[c.RemoteAddr().String()]
+		c.clientsLock.RUnlock()
+		if ok && client.state == tcpStateEstablished {
+			atomic.AddUint32(&client.seq, ^uint32(0))
+			err := c.writeFlags(client, false, false)
+			atomic.AddUint32(&client.seq, 1)
+			if err != nil {
+				logger.Errorln(fmt.Errorf("keep alive to %s: %w", c.RemoteAddr().String(), err))
+			}
+		}
+		probes++
+		c.lock.Unlock()
+	}
+}
+
+// acknowledge removes segments acknowledged by the given TCP Ack.
+func (indicator *clientIndicator) acknowledge(ack uint32) {
+	i := 0
+	for ; i < len(indicator.unacked); i++ {
+		segment := indicator.unacked[i]
+		if int32(ack-(segment.seq+segment.length)) < 0 {
+			break
+		}
+	}
+
+	indicator.unacked = indicator.unacked[i:]
+}
+
+// acknowledgeSelectively removes segments acknowledged by the given SACK blocks.
+func (indicator *clientIndicator) acknowledgeSelectively(blocks [][2]uint32) {
+	if len(blocks) <= 0 {
+		return
+	}
+
+	segments := indicator.unacked[:0]
+	for _, segment := range indicator.unacked {
+		isAcked := false
+		for _, block := range blocks {
+			if !seqLess(segment.seq, block[0]) && !seqLess(block[1], segment.seq+segment.length) {
+				isAcked = true
+				break
+			}
+		}
+		if !isAcked {
+			segments = append(segments, segment)
+		}
+	}
+
+	indicator.unacked = segments
+}
+
 // Reconnect reconnects the connection by sending TCP SYN.
 func (c *FakeTCPConn) Reconnect() error {
 	c.isReconnected = false
@@ -736,7 +1485,7 @@ func (c *FakeTCPConn) Reconnect() error {
 		time.Sleep(establishDeadline)
 
 		if !c.isReconnected {
-			log.Errorf("Cannot receive response from server %s, is it down?\n", c.RemoteAddr().String())
+			logger.Errorf("Cannot receive response from server %s, is it down?\n", c.RemoteAddr().String())
 		}
 	}()
 
@@ -748,12 +1497,13 @@ type FakeTCPListener struct {
 	conn    *RawConn
 	srcPort uint16
 	crypt   crypto.Crypt
+	auth    *crypto.Auth
 	mtu     int
 	clients map[string]net.Conn
 }
 
 // ListenFakeTCP announces on the local network address in FakeTCP network.
-func ListenFakeTCP(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, mtu int) (*FakeTCPListener, error) {
+func ListenFakeTCP(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, auth *crypto.Auth, mtu int) (*FakeTCPListener, error) {
 	addrs := make([]*net.TCPAddr, 0)
 	for _, ip := range srcDev.IPAddrs() {
 		addrs = append(addrs, &net.TCPAddr{IP: ip.IP, Port: int(srcPort)})
@@ -774,6 +1524,7 @@ func ListenFakeTCP(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, m
 		conn:    conn,
 		srcPort: srcPort,
 		crypt:   crypt,
+		auth:    auth,
 		mtu:     mtu,
 		clients: make(map[string]net.Conn),
 	}
@@ -803,13 +1554,34 @@ func (l *FakeTCPListener) Accept() (net.Conn, error) {
 		}
 	}
 
-	_, ok := l.clients[indicator.Src().String()]
+	// Refuse sources by the ACL before handshaking
+	if !permits(indicator.SrcIP()) {
+		logger.Verbosef("Refuse FakeTCP from %s\n", indicator.Src().String())
+		return nil, nil
+	}
+
+	// Clients are distinguished by ports of the listener as well, as a client connects to each port in hopping
+	key := fmt.Sprintf("%s:%d", indicator.Src().String(), indicator.DstPort())
+	_, ok := l.clients[key]
 	if ok {
 		// Duplicate
 		return nil, nil
 	}
 
-	conn, err := dialFakeTCPPassive(l.Dev(), l.conn.RemoteDev(), l.srcPort, indicator.Src().(*net.TCPAddr), l.crypt, l.mtu)
+	// Forget closed clients
+	for k, conn := range l.clients {
+		if conn.(*FakeTCPConn).isClosed {
+			delete(l.clients, k)
+		}
+	}
+
+	// Reply from the address the client connects to in multi-homed devices
+	dev, err := l.Dev().Select(indicator.DstIP())
+	if err != nil {
+		dev = l.Dev()
+	}
+
+	conn, err := dialFakeTCPPassive(dev, l.conn.RemoteDev(), indicator.DstPort(), indicator.Src().(*net.TCPAddr), l.crypt, l.auth, l.mtu)
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "dial",
@@ -821,8 +1593,9 @@ func (l *FakeTCPListener) Accept() (net.Conn, error) {
 	}
 
 	conn.clients[indicator.Src().String()] = &clientIndicator{
-		crypt: l.crypt,
-		seq:   0,
+		addr:  indicator.Src(),
+		crypt: conn.crypt,
+		seq:   randomSeq(),
 		ack:   0,
 	}
 
@@ -839,12 +1612,29 @@ func (l *FakeTCPListener) Accept() (net.Conn, error) {
 	}
 
 	// Map client
-	l.clients[indicator.Src().String()] = conn
+	l.clients[key] = conn
 
 	return conn, nil
 }
 
+// SetPorts sets the ports the listener accepts connections in besides its own port.
+func (l *FakeTCPListener) SetPorts(ports []uint16) error {
+	fs := []string{fmt.Sprintf("dst port %d", l.srcPort)}
+	for _, port := range ports {
+		if port == l.srcPort {
+			continue
+		}
+		fs = append(fs, fmt.Sprintf("dst port %d", port))
+	}
+
+	return l.conn.SetBPFFilter(fmt.Sprintf("tcp && tcp[tcpflags] & tcp-syn != 0 && (%s)", strings.Join(fs, " || ")))
+}
+
 func (l *FakeTCPListener) Close() error {
+	for _, conn := range l.clients {
+		_ = conn.Close()
+	}
+
 	err := l.conn.Close()
 	if err != nil {
 		return &net.OpError{
@@ -871,8 +1661,8 @@ func (l *FakeTCPListener) Addr() net.Addr {
 }
 
 // DialFakeTCPWithKCP connects to the remote address in the FakeTCP network with KCP support.
-func DialFakeTCPWithKCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, mtu int, config *config.KCPConfig) (*kcp.UDPSession, error) {
-	conn, err := DialFakeTCP(srcDev, dstDev, srcPort, dstAddr, crypt, mtu)
+func DialFakeTCPWithKCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, auth *crypto.Auth, mtu int, config *config.KCPConfig) (*kcp.UDPSession, error) {
+	conn, err := DialFakeTCP(srcDev, dstDev, srcPort, dstAddr, crypt, auth, mtu)
 	if err != nil {
 		return nil, err
 	}
@@ -905,8 +1695,8 @@ func DialFakeTCPWithKCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCP
 }
 
 // ListenFakeTCPWithKCP listens for incoming packets addressed to the local address in the FakeTCP network with KCP support.
-func ListenFakeTCPWithKCP(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, mtu int, config *config.KCPConfig) (*kcp.Listener, error) {
-	conn, err := listenFakeTCPMulticast(srcDev, dstDev, srcPort, crypt, mtu)
+func ListenFakeTCPWithKCP(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, auth *crypto.Auth, mtu int, config *config.KCPConfig) (*kcp.Listener, error) {
+	conn, err := listenFakeTCPMulticast(srcDev, dstDev, srcPort, crypt, auth, mtu)
 	if err != nil {
 		return nil, err
 	}
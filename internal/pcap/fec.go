@@ -0,0 +1,366 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/klauspost/reedsolomon"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// fecHeaderSize is the size of the header of a FEC frame, which consists of the index of the shard, the number of
+	// data shards, the number of parity shards and the number of data shards written in the group, in 1 Byte each.
+	fecHeaderSize = 4
+	// fecTimeout is the duration after which parity shards of a group not full are written, so packets at the end of a
+	// burst are protected without waiting for following packets.
+	fecTimeout = 20 * time.Millisecond
+	// fecGroups is the max number of groups kept for reconstruction in a connection.
+	fecGroups = 64
+)
+
+var (
+	fecDataShards   = 0
+	fecParityShards = 0
+)
+
+// SetFEC sets numbers of data shards and parity shards of forward error correction in Reed-Solomon. Every data shards
+// of packets written to a framed connection are followed by parity shards, and any data shards lost in a group can be
+// reconstructed by the peer from the same number of parity shards without retransmission. 0 data shards disables
+// forward error correction. It should be called before any connection is established.
+func SetFEC(dataShards, parityShards int) {
+	fecDataShards = dataShards
+	fecParityShards = parityShards
+}
+
+// fecOverhead returns the cost of forward error correction in each frame.
+func fecOverhead() int {
+	if fecDataShards <= 0 {
+		return 0
+	}
+
+	// Header and the length of the packet
+	return fecHeaderSize + 2
+}
+
+// fecEncoder describes the group of data shards being written.
+type fecEncoder struct {
+	lock    sync.Mutex
+	encoder reedsolomon.Encoder
+	group   uint32
+	shards  [][]byte
+	timer   *time.Timer
+}
+
+// fecGroup describes shards received in a group.
+type fecGroup struct {
+	id     uint32
+	data   int
+	parity int
+	count  int
+	shards [][]byte
+	done   bool
+}
+
+// fecDecoder describes groups received for reconstruction. It is only accessed in reads.
+type fecDecoder struct {
+	groups   map[uint32]*fecGroup
+	ring     [fecGroups]*fecGroup
+	next     int
+	encoders map[int]reedsolomon.Encoder
+	pending  [][]byte
+}
+
+func newFECDecoder() *fecDecoder {
+	return &fecDecoder{
+		groups:   make(map[uint32]*fecGroup),
+		encoders: make(map[int]reedsolomon.Encoder),
+	}
+}
+
+// group returns the group in the numbers of shards, a new group replaces the oldest kept one.
+func (d *fecDecoder) group(id uint32, data, parity int) *fecGroup {
+	g, ok := d.groups[id]
+	if ok && g.data == data && g.parity == parity {
+		return g
+	}
+
+	if old := d.ring[d.next]; old != nil && d.groups[old.id] == old {
+		delete(d.groups, old.id)
+	}
+	g = &fecGroup{
+		id:     id,
+		data:   data,
+		parity: parity,
+		count:  data,
+		shards: make([][]byte, data+parity),
+	}
+	d.groups[id] = g
+	d.ring[d.next] = g
+	d.next = (d.next + 1) % fecGroups
+
+	return g
+}
+
+// push buffers the shard of the frame, and queues packets in data shards received or reconstructed to be read.
+func (d *fecDecoder) push(frame *Frame) error {
+	if len(frame.Payload) < fecHeaderSize {
+		return errors.New("missing header")
+	}
+
+	index, data, parity, count := int(frame.Payload[0]), int(frame.Payload[1]), int(frame.Payload[2]),
+		int(frame.Payload[3])
+	if data <= 0 || data+parity > 256 {
+		return fmt.Errorf("shards %d+%d out of range", data, parity)
+	}
+	if index >= data+parity {
+		return fmt.Errorf("index %d out of range", index)
+	}
+	if count > data {
+		return fmt.Errorf("count %d out of range", count)
+	}
+
+	g := d.group(frame.FlowId, data, parity)
+	if g.done || g.shards[index] != nil {
+		return nil
+	}
+
+	// The payload refers to the buffer of reads
+	shard := make([]byte, len(frame.Payload)-fecHeaderSize)
+	copy(shard, frame.Payload[fecHeaderSize:])
+	g.shards[index] = shard
+
+	if index < data {
+		packet, err := unpackFECShard(shard)
+		if err != nil {
+			return err
+		}
+		d.pending = append(d.pending, packet)
+	} else if count > 0 {
+		g.count = count
+	}
+
+	return d.reconstruct(g)
+}
+
+// reconstruct reconstructs data shards lost in the group once enough shards are received.
+func (d *fecDecoder) reconstruct(g *fecGroup) error {
+	received, lost, size := 0, 0, 0
+	for i, shard := range g.shards {
+		// Data shards not written in the group are empty
+		if i >= g.count && i < g.data {
+			received++
+			continue
+		}
+		if shard == nil {
+			if i < g.data {
+				lost++
+			}
+			continue
+		}
+		received++
+		if len(shard) > size {
+			size = len(shard)
+		}
+	}
+	if lost <= 0 {
+		if received >= g.data+g.parity {
+			g.done = true
+		}
+		return nil
+	}
+	if received < g.data {
+		return nil
+	}
+	g.done = true
+
+	key := g.data<<8 | g.parity
+	encoder, ok := d.encoders[key]
+	if !ok {
+		var err error
+		encoder, err = reedsolomon.New(g.data, g.parity)
+		if err != nil {
+			return fmt.Errorf("create encoder: %w", err)
+		}
+		d.encoders[key] = encoder
+	}
+
+	shards := make([][]byte, len(g.shards))
+	for i, shard := range g.shards {
+		if i >= g.count && i < g.data {
+			shards[i] = make([]byte, size)
+			continue
+		}
+		if shard != nil {
+			shards[i] = padFECShard(shard, size)
+		}
+	}
+	err := encoder.ReconstructData(shards)
+	if err != nil {
+		return fmt.Errorf("reconstruct: %w", err)
+	}
+
+	for i := 0; i < g.count; i++ {
+		if g.shards[i] != nil {
+			continue
+		}
+		packet, err := unpackFECShard(shards[i])
+		if err != nil {
+			return err
+		}
+		d.pending = append(d.pending, packet)
+	}
+
+	return nil
+}
+
+// pop returns a packet queued to be read, nil if there is not.
+func (d *fecDecoder) pop() []byte {
+	if len(d.pending) <= 0 {
+		return nil
+	}
+
+	packet := d.pending[0]
+	d.pending[0] = nil
+	d.pending = d.pending[1:]
+
+	return packet
+}
+
+// packFECShard returns the data shard of the packet, which is the packet prefixed by its length in 2 Bytes in big
+// endian, so shards padded in reconstruction can be restored.
+func packFECShard(b []byte) []byte {
+	shard := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(shard, uint16(len(b)))
+	copy(shard[2:], b)
+
+	return shard
+}
+
+func unpackFECShard(shard []byte) ([]byte, error) {
+	if len(shard) < 2 {
+		return nil, errors.New("missing length")
+	}
+
+	size := int(binary.BigEndian.Uint16(shard))
+	if 2+size > len(shard) {
+		return nil, fmt.Errorf("length %d out of range", size)
+	}
+
+	return shard[2 : 2+size], nil
+}
+
+func padFECShard(shard []byte, size int) []byte {
+	if len(shard) >= size {
+		return shard
+	}
+
+	result := make([]byte, size)
+	copy(result, shard)
+
+	return result
+}
+
+// writeFEC writes the packet as a data shard in the current group, and parity shards of the group once it is full.
+func (c *FrameConn) writeFEC(b []byte) error {
+	if len(b) > 65535-fecOverhead() {
+		return &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    fmt.Errorf("size %d out of range", len(b)),
+		}
+	}
+
+	e := c.fecEncoder
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	shard := packFECShard(b)
+	index := len(e.shards)
+	e.shards = append(e.shards, shard)
+
+	header := []byte{uint8(index), uint8(fecDataShards), uint8(fecParityShards), 0}
+	err := c.writeFrame(FrameTypeFEC, e.group, append(header, shard...))
+	if err != nil {
+		return err
+	}
+
+	if len(e.shards) >= fecDataShards {
+		return c.flushFEC()
+	}
+	if index == 0 && fecParityShards > 0 {
+		group := e.group
+		e.timer = time.AfterFunc(fecTimeout, func() {
+			e.lock.Lock()
+			defer e.lock.Unlock()
+
+			if e.group != group || len(e.shards) <= 0 {
+				return
+			}
+			err := c.flushFEC()
+			if err != nil {
+				logger.Verbosef("Write parity to %s: %v\n", c.RemoteAddr(), err)
+			}
+		})
+	}
+
+	return nil
+}
+
+// flushFEC writes parity shards of the current group and starts the next group. Data shards not written in the group
+// are regarded as empty. It should be called with the lock of the encoder held.
+func (c *FrameConn) flushFEC() error {
+	e := c.fecEncoder
+	shards, group := e.shards, e.group
+	e.shards = nil
+	e.group++
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+	if fecParityShards <= 0 {
+		return nil
+	}
+
+	if e.encoder == nil {
+		encoder, err := reedsolomon.New(fecDataShards, fecParityShards)
+		if err != nil {
+			return fmt.Errorf("create encoder: %w", err)
+		}
+		e.encoder = encoder
+	}
+
+	size := 0
+	for _, shard := range shards {
+		if len(shard) > size {
+			size = len(shard)
+		}
+	}
+
+	all := make([][]byte, fecDataShards+fecParityShards)
+	for i := range all {
+		if i < len(shards) {
+			all[i] = padFECShard(shards[i], size)
+		} else {
+			all[i] = make([]byte, size)
+		}
+	}
+	err := e.encoder.Encode(all)
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+
+	for i := fecDataShards; i < len(all); i++ {
+		header := []byte{uint8(i), uint8(fecDataShards), uint8(fecParityShards), uint8(len(shards))}
+		err := c.writeFrame(FrameTypeFEC, group, append(header, all[i]...))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
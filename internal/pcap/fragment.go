@@ -1,19 +1,22 @@
 package pcap
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/ip4defrag"
 	"github.com/google/gopacket/layers"
-	"ikago/internal/log"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type fragFlow struct {
-	id  uint16
-	src string
+	id   uint32
+	src  string
+	peer string
 }
 
 type fragIndicator struct {
@@ -75,8 +78,15 @@ func (indicator *fragIndicator) concatenate() (*PacketIndicator, error) {
 		newNetworkLayer = &temp
 
 		FlagIPv4Layer(newNetworkLayer.(*layers.IPv4), false, false, 0)
+	case layers.LayerTypeIPv6:
+		ipv6Layer := indicator.frags[0].IPv6Layer()
+		temp := *ipv6Layer
+		newNetworkLayer = &temp
+
+		// Remove the IPv6 fragment layer
+		setIPv6NextHeader(newNetworkLayer.(*layers.IPv6), indicator.frags[0].NextHeader())
 	default:
-		return nil, fmt.Errorf("network layer type %s not support", t)
+		return nil, NewError(ErrUnsupportedLayer, "network layer type %s not support", t)
 	}
 
 	// Concatenate network payloads
@@ -128,6 +138,7 @@ type Defragmenter interface {
 
 // EasyDefragmenter is a machine defragments packets which also accepts non-standard packets.
 type EasyDefragmenter struct {
+	lock     sync.Mutex
 	frags    map[fragFlow]*fragIndicator
 	deadline time.Duration
 }
@@ -145,13 +156,24 @@ func (defrag *EasyDefragmenter) Append(ind *PacketIndicator) (*PacketIndicator,
 
 // AppendOriginal adds a fragment to the defragmenter and returns packets with and without defragmentation.
 func (defrag *EasyDefragmenter) AppendOriginal(ind *PacketIndicator) (*PacketIndicator, []*PacketIndicator, error) {
+	return defrag.AppendOriginalFrom(ind, "")
+}
+
+// AppendOriginalFrom adds a fragment from the peer to the defragmenter and returns packets with and without
+// defragmentation. Fragments from different peers are kept apart, like embedded packets of different clients which may
+// have the same source.
+func (defrag *EasyDefragmenter) AppendOriginalFrom(ind *PacketIndicator, peer string) (*PacketIndicator, []*PacketIndicator, error) {
 	if !ind.IsFrag() {
 		return ind, append(make([]*PacketIndicator, 0), ind), nil
 	}
 
+	defrag.lock.Lock()
+	defer defrag.lock.Unlock()
+
 	flow := fragFlow{
-		id:  ind.NetworkId(),
-		src: ind.SrcIP().String(),
+		id:   ind.NetworkId(),
+		src:  ind.SrcIP().String(),
+		peer: peer,
 	}
 	fragIndicator, ok := defrag.frags[flow]
 	if !ok || fragIndicator == nil {
@@ -161,7 +183,7 @@ func (defrag *EasyDefragmenter) AppendOriginal(ind *PacketIndicator) (*PacketInd
 
 	// Replace old fragments
 	if defrag.deadline > 0 && time.Now().Sub(fragIndicator.lastSeen) > defrag.deadline {
-		log.Verbosef("Recycle fragments %d from %s\n", flow.id, flow.src)
+		logger.Verbosef("Recycle fragments %d from %s\n", flow.id, flow.src)
 		fragIndicator = newFragIndicator()
 		defrag.frags[flow] = fragIndicator
 	}
@@ -173,7 +195,7 @@ func (defrag *EasyDefragmenter) AppendOriginal(ind *PacketIndicator) (*PacketInd
 	}
 
 	// Remove completed fragments
-	defrag.frags[flow] = nil
+	delete(defrag.frags, flow)
 
 	// Concatenate fragments
 	indicator, err := fragIndicator.concatenate()
@@ -185,6 +207,9 @@ func (defrag *EasyDefragmenter) AppendOriginal(ind *PacketIndicator) (*PacketInd
 }
 
 func (defrag *EasyDefragmenter) SetDeadline(t time.Duration) {
+	defrag.lock.Lock()
+	defer defrag.lock.Unlock()
+
 	defrag.deadline = t
 }
 
@@ -204,6 +229,10 @@ func (defrag *StrictDefragmenter) Append(ind *PacketIndicator) (*PacketIndicator
 		return ind, nil
 	}
 
+	if t := ind.NetworkLayer().LayerType(); t != layers.LayerTypeIPv4 {
+		return nil, NewError(ErrUnsupportedLayer, "network layer type %s not support", t)
+	}
+
 	// Discard old fragments
 	if defrag.deadline > 0 {
 		defrag.defragmenter.DiscardOlderThan(time.Now().Add(-defrag.deadline))
@@ -237,7 +266,7 @@ func (defrag *StrictDefragmenter) SetDeadline(t time.Duration) {
 }
 
 // CreateFragmentPackets creates fragments by given layers and fragment size.
-func CreateFragmentPackets(linkLayer, networkLayer, transportLayer, payload gopacket.Layer, fragment int) ([][]byte, error) {
+func CreateFragmentPackets(linkLayer gopacket.SerializableLayer, networkLayer, transportLayer, payload gopacket.Layer, fragment int) ([][]byte, error) {
 	var (
 		err                 error
 		networkLayerData    []byte
@@ -267,7 +296,12 @@ func CreateFragmentPackets(linkLayer, networkLayer, transportLayer, payload gopa
 
 	// Fragment
 	if len(networkLayerData)+len(networkLayerPayload) > fragment {
-		var newNetworkLayer gopacket.NetworkLayer
+		var (
+			newNetworkLayer gopacket.NetworkLayer
+			nextHeader      layers.IPProtocol
+			id              uint32
+			headerLength    int
+		)
 
 		// Create new network layer
 		switch t := networkLayer.LayerType(); t {
@@ -275,8 +309,19 @@ func CreateFragmentPackets(linkLayer, networkLayer, transportLayer, payload gopa
 			newIPv4Layer := networkLayer.(*layers.IPv4)
 			temp := *newIPv4Layer
 			newNetworkLayer = &temp
+
+			headerLength = len(networkLayerData)
+		case layers.LayerTypeIPv6:
+			newIPv6Layer := networkLayer.(*layers.IPv6)
+			temp := *newIPv6Layer
+			newNetworkLayer = &temp
+
+			nextHeader = ipv6NextHeader(newIPv6Layer)
+			id = atomic.AddUint32(&ipv6FragmentId, 1)
+			// The IPv6 fragment layer takes another 8 Bytes
+			headerLength = len(networkLayerData) + 8
 		default:
-			return nil, fmt.Errorf("network layer type %s not support", t)
+			return nil, NewError(ErrUnsupportedLayer, "network layer type %s not support", t)
 		}
 
 		// Create fragments
@@ -285,7 +330,7 @@ func CreateFragmentPackets(linkLayer, networkLayer, transportLayer, payload gopa
 				err  error
 				data []byte
 			)
-			length := min(fragment-len(networkLayerData), len(networkLayerPayload)-i)
+			length := min(fragment-headerLength, len(networkLayerPayload)-i)
 			remain := len(networkLayerPayload) - i - length
 
 			// Align
@@ -300,6 +345,8 @@ func CreateFragmentPackets(linkLayer, networkLayer, transportLayer, payload gopa
 				remain = len(networkLayerPayload) - i - length
 			}
 
+			contents := networkLayerPayload[i : i+length]
+
 			switch t := newNetworkLayer.LayerType(); t {
 			case layers.LayerTypeIPv4:
 				ipv4Layer := newNetworkLayer.(*layers.IPv4)
@@ -309,18 +356,23 @@ func CreateFragmentPackets(linkLayer, networkLayer, transportLayer, payload gopa
 				} else {
 					FlagIPv4Layer(ipv4Layer, false, true, uint16(i/8))
 				}
+			case layers.LayerTypeIPv6:
+				ipv6Layer := newNetworkLayer.(*layers.IPv6)
+				setIPv6NextHeader(ipv6Layer, layers.IPProtocolIPv6Fragment)
+
+				contents = append(createIPv6FragmentHeader(nextHeader, id, remain > 0, uint16(i/8)), contents...)
 			default:
-				return nil, fmt.Errorf("network layer type %s not support", t)
+				return nil, NewError(ErrUnsupportedLayer, "network layer type %s not support", t)
 			}
 
 			// Serialize layers
 			if linkLayer == nil {
 				data, err = Serialize(newNetworkLayer.(gopacket.SerializableLayer),
-					gopacket.Payload(networkLayerPayload[i:i+length]))
+					gopacket.Payload(contents))
 			} else {
-				data, err = Serialize(linkLayer.(gopacket.SerializableLayer),
+				data, err = Serialize(linkLayer,
 					newNetworkLayer.(gopacket.SerializableLayer),
-					gopacket.Payload(networkLayerPayload[i:i+length]))
+					gopacket.Payload(contents))
 			}
 			if err != nil {
 				return nil, fmt.Errorf("serialize: %w", err)
@@ -341,7 +393,7 @@ func CreateFragmentPackets(linkLayer, networkLayer, transportLayer, payload gopa
 			data, err = Serialize(networkLayer.(gopacket.SerializableLayer),
 				gopacket.Payload(networkLayerPayload))
 		} else {
-			data, err = Serialize(linkLayer.(gopacket.SerializableLayer),
+			data, err = Serialize(linkLayer,
 				networkLayer.(gopacket.SerializableLayer),
 				gopacket.Payload(networkLayerPayload))
 		}
@@ -355,6 +407,21 @@ func CreateFragmentPackets(linkLayer, networkLayer, transportLayer, payload gopa
 	return fragments, nil
 }
 
+var ipv6FragmentId uint32
+
+func createIPv6FragmentHeader(nextHeader layers.IPProtocol, id uint32, mf bool, offset uint16) []byte {
+	header := make([]byte, 8)
+
+	header[0] = byte(nextHeader)
+	binary.BigEndian.PutUint16(header[2:4], offset<<3)
+	if mf {
+		header[3] = header[3] | 0x1
+	}
+	binary.BigEndian.PutUint32(header[4:8], id)
+
+	return header
+}
+
 func min(a, b int) int {
 	if a > b {
 		return b
@@ -0,0 +1,673 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"ikago/internal/crypto"
+	"net"
+	"sync"
+	"time"
+)
+
+// FrameType is the type of a frame.
+type FrameType uint8
+
+const (
+	// FrameTypeData is the type of frames carrying an embedded packet.
+	FrameTypeData FrameType = iota
+	// FrameTypeKeepAlive is the type of frames keeping the tunnel alive, which are discarded on read.
+	FrameTypeKeepAlive
+	// FrameTypeHello is the type of frames negotiating the version of framing.
+	FrameTypeHello
+	// FrameTypeMultipath is the type of frames carrying an embedded packet with a sequence in a session of multipath,
+	// whose flow Id is the session. Frames with a sequence received before are discarded on read.
+	FrameTypeMultipath
+	// FrameTypeProbe is the type of frames probing the path MTU, whose flow Id is the Id of the probe and whose payload
+	// is padding. The peer replies with a probe reply in the same Id.
+	FrameTypeProbe
+	// FrameTypeProbeReply is the type of frames replying a probe, whose flow Id is the Id of the probe.
+	FrameTypeProbeReply
+	// FrameTypeMTU is the type of frames telling the peer the path MTU in 2 Bytes in big endian.
+	FrameTypeMTU
+	// FrameTypeRekey is the type of frames proposing the next epoch of keys in 1 Byte and its salt.
+	FrameTypeRekey
+	// FrameTypeRekeyAck is the type of frames accepting the epoch of keys in 1 Byte.
+	FrameTypeRekeyAck
+	// FrameTypeToken is the type of frames issuing a token of resumption to the peer.
+	FrameTypeToken
+	// FrameTypeResume is the type of frames presenting a token of resumption to resume a session from another address.
+	FrameTypeResume
+	// FrameTypeFEC is the type of frames carrying a data shard or a parity shard of forward error correction, whose
+	// flow Id is the group of the shard. Data shards carry an embedded packet, and lost ones are reconstructed from
+	// parity shards in the group on read.
+	FrameTypeFEC
+	// FrameTypeRate is the type of frames reporting the delivery rate measured by the peer and timestamps for RTT, by
+	// which frames are paced.
+	FrameTypeRate
+	// FrameTypeChallenge is the type of frames challenging the peer to authenticate as the user in its Id.
+	FrameTypeChallenge
+	// FrameTypeResponse is the type of frames answering a challenge by the key of the user.
+	FrameTypeResponse
+)
+
+func (t FrameType) String() string {
+	switch t {
+	case FrameTypeData:
+		return "data"
+	case FrameTypeKeepAlive:
+		return "keep-alive"
+	case FrameTypeHello:
+		return "hello"
+	case FrameTypeMultipath:
+		return "multipath"
+	case FrameTypeProbe:
+		return "probe"
+	case FrameTypeProbeReply:
+		return "probe-reply"
+	case FrameTypeMTU:
+		return "mtu"
+	case FrameTypeRekey:
+		return "rekey"
+	case FrameTypeRekeyAck:
+		return "rekey-ack"
+	case FrameTypeToken:
+		return "token"
+	case FrameTypeResume:
+		return "resume"
+	case FrameTypeFEC:
+		return "fec"
+	case FrameTypeRate:
+		return "rate"
+	case FrameTypeChallenge:
+		return "challenge"
+	case FrameTypeResponse:
+		return "response"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(t))
+	}
+}
+
+const (
+	// FrameVersion is the latest version of framing.
+	FrameVersion = 8
+	// MultipathFrameVersion is the version of framing since which multipath frames are supported.
+	MultipathFrameVersion = 2
+	// ProbeFrameVersion is the version of framing since which probe, probe reply and MTU frames are supported.
+	ProbeFrameVersion = 3
+	// RekeyFrameVersion is the version of framing since which rekey and rekey ack frames are supported.
+	RekeyFrameVersion = 4
+	// ResumeFrameVersion is the version of framing since which token and resume frames are supported.
+	ResumeFrameVersion = 5
+	// FECFrameVersion is the version of framing since which FEC frames are supported.
+	FECFrameVersion = 6
+	// PacingFrameVersion is the version of framing since which rate frames are supported.
+	PacingFrameVersion = 7
+	// UserFrameVersion is the version of framing since which challenge and response frames are supported.
+	UserFrameVersion = 8
+	// FrameHeaderSize is the size of the header of a frame.
+	FrameHeaderSize = 10
+	// MaxIdSize is the max size of the Id presented in hello.
+	MaxIdSize = 64
+)
+
+const (
+	// helloInterval is the interval of resending hello on writes until the peer replies.
+	helloInterval = time.Second
+	// maxHellos is the max number of hellos sent before the peer is regarded as not supporting framing.
+	maxHellos = 8
+)
+
+// frameMagic is the magic of frames, whose first nibble never collides with the version of an IPv4 or IPv6 packet, so
+// frames and raw packets can be told apart.
+const frameMagic uint16 = 0xa1c0
+
+// Frame describes a frame in the tunnel. The header of a frame consists of the magic in 2 Bytes, the version in 1 Byte,
+// the type in 1 Byte, the length of the payload in 2 Bytes and the flow Id in 4 Bytes, all in big endian.
+type Frame struct {
+	Version uint8
+	Type    FrameType
+	FlowId  uint32
+	Payload []byte
+}
+
+// IsFrame returns if the bytes are a frame rather than a raw packet.
+func IsFrame(b []byte) bool {
+	return len(b) >= 2 && binary.BigEndian.Uint16(b) == frameMagic
+}
+
+// EncodeFrame returns the bytes of the frame.
+func EncodeFrame(frame *Frame) ([]byte, error) {
+	if len(frame.Payload) > 65535 {
+		return nil, fmt.Errorf("payload size %d out of range", len(frame.Payload))
+	}
+
+	b := make([]byte, FrameHeaderSize+len(frame.Payload))
+	binary.BigEndian.PutUint16(b[0:], frameMagic)
+	b[2] = frame.Version
+	b[3] = uint8(frame.Type)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(frame.Payload)))
+	binary.BigEndian.PutUint32(b[6:], frame.FlowId)
+	copy(b[FrameHeaderSize:], frame.Payload)
+
+	return b, nil
+}
+
+// DecodeFrame returns the frame decoded from bytes. The payload of the frame refers to the bytes.
+func DecodeFrame(b []byte) (*Frame, error) {
+	if len(b) < FrameHeaderSize {
+		return nil, errors.New("missing header")
+	}
+	if !IsFrame(b) {
+		return nil, errors.New("invalid magic")
+	}
+	if b[2] <= 0 {
+		return nil, fmt.Errorf("version %d out of range", b[2])
+	}
+
+	size := int(binary.BigEndian.Uint16(b[4:]))
+	if len(b)-FrameHeaderSize != size {
+		return nil, fmt.Errorf("length %d out of range", size)
+	}
+
+	return &Frame{
+		Version: b[2],
+		Type:    FrameType(b[3]),
+		FlowId:  binary.BigEndian.Uint32(b[6:]),
+		Payload: b[FrameHeaderSize:],
+	}, nil
+}
+
+// FrameConn is a connection which frames packets written to it once the peer agrees on a version of framing. Frames
+// and raw packets are both accepted on read, so a peer not supporting framing keeps working with raw packets.
+type FrameConn struct {
+	net.Conn
+	lock       sync.RWMutex
+	version    uint8
+	initiator  bool
+	id         string
+	peerId     string
+	token      []byte
+	peerToken  []byte
+	hellos     int
+	lastHello  time.Time
+	readBuffer []byte
+	probes     chan uint32
+	fecEncoder *fecEncoder
+	fecDecoder *fecDecoder
+	pacer      *pacer
+	userAuth   *crypto.Auth
+	userLookup func(id string) *crypto.Auth
+	challenge  []byte
+	user       string
+	challenged time.Time
+}
+
+// NewFrameConn returns a new frame connection over the connection. Packets are written raw until a version is
+// negotiated.
+func NewFrameConn(conn net.Conn) *FrameConn {
+	return &FrameConn{
+		Conn:       conn,
+		readBuffer: make([]byte, IPv4MaxSize),
+		probes:     make(chan uint32, 16),
+		fecEncoder: &fecEncoder{},
+		fecDecoder: newFECDecoder(),
+		pacer:      newPacer(),
+	}
+}
+
+// SetId sets the Id presented to the peer in hello.
+func (c *FrameConn) SetId(id string) error {
+	if len(id) > MaxIdSize {
+		return fmt.Errorf("id size %d out of range", len(id))
+	}
+
+	c.lock.Lock()
+	c.id = id
+	c.lock.Unlock()
+
+	return nil
+}
+
+// PeerId returns the Id presented by the peer in hello, empty if the peer does not present one.
+func (c *FrameConn) PeerId() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.peerId
+}
+
+// Hello sends a hello frame with the latest version and the Id to the peer. Peers supporting framing reply with the
+// version they agree on, and peers not supporting framing drop the frame as a malformed packet. Hello is resent on
+// writes until the peer replies, as the frame may be lost.
+func (c *FrameConn) Hello() error {
+	c.lock.Lock()
+	c.initiator = true
+	c.version = 0
+	c.hellos = 1
+	c.lastHello = time.Now()
+	id, token := c.id, c.token
+	c.lock.Unlock()
+
+	return c.writeHello(id, token)
+}
+
+// retryHello resends hello if the peer has not replied in the interval.
+func (c *FrameConn) retryHello() error {
+	c.lock.Lock()
+	if !c.initiator || c.version > 0 || c.hellos >= maxHellos || time.Since(c.lastHello) < helloInterval {
+		c.lock.Unlock()
+		return nil
+	}
+	c.hellos++
+	c.lastHello = time.Now()
+	id, token := c.id, c.token
+	c.lock.Unlock()
+
+	return c.writeHello(id, token)
+}
+
+// writeHello writes a hello frame with the Id, followed by a resume frame with the token if there is one, so the
+// session is resumed before any packet is written.
+func (c *FrameConn) writeHello(id string, token []byte) error {
+	err := c.writeFrame(FrameTypeHello, 0, append([]byte{FrameVersion}, id...))
+	if err != nil {
+		return err
+	}
+	if len(token) <= 0 {
+		return nil
+	}
+
+	return c.writeFrame(FrameTypeResume, 0, token)
+}
+
+// Version returns the negotiated version of framing, 0 if packets are written raw.
+func (c *FrameConn) Version() uint8 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.version
+}
+
+func (c *FrameConn) Read(b []byte) (n int, err error) {
+	for {
+		// Packets reconstructed by forward error correction
+		if packet := c.fecDecoder.pop(); packet != nil {
+			return copy(b, packet), nil
+		}
+
+		n, err := c.Conn.Read(c.readBuffer)
+		if err != nil {
+			return 0, err
+		}
+		c.pacer.receive(n)
+		err = c.writeRate()
+		if err != nil {
+			return 0, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   c.RemoteAddr(),
+				Err:    fmt.Errorf("report rate: %w", err),
+			}
+		}
+		err = c.retryChallenge()
+		if err != nil {
+			return 0, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   c.RemoteAddr(),
+				Err:    fmt.Errorf("challenge: %w", err),
+			}
+		}
+
+		// Raw packet
+		if !IsFrame(c.readBuffer[:n]) {
+			return copy(b, c.readBuffer[:n]), nil
+		}
+
+		frame, err := DecodeFrame(c.readBuffer[:n])
+		if err != nil {
+			return 0, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   c.RemoteAddr(),
+				Err:    fmt.Errorf("decode frame: %w", err),
+			}
+		}
+
+		switch frame.Type {
+		case FrameTypeData:
+			return copy(b, frame.Payload), nil
+		case FrameTypeKeepAlive:
+			continue
+		case FrameTypeMultipath:
+			if len(frame.Payload) < 4 {
+				return 0, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   c.RemoteAddr(),
+					Err:    errors.New("missing sequence"),
+				}
+			}
+			if isDuplicated(frame.FlowId, binary.BigEndian.Uint32(frame.Payload)) {
+				continue
+			}
+			return copy(b, frame.Payload[4:]), nil
+		case FrameTypeProbe:
+			err := c.writeFrame(FrameTypeProbeReply, frame.FlowId, nil)
+			if err != nil {
+				return 0, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   c.RemoteAddr(),
+					Err:    fmt.Errorf("reply probe: %w", err),
+				}
+			}
+		case FrameTypeProbeReply:
+			select {
+			case c.probes <- frame.FlowId:
+			default:
+			}
+		case FrameTypeMTU:
+			if len(frame.Payload) < 2 {
+				return 0, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   c.RemoteAddr(),
+					Err:    errors.New("missing mtu"),
+				}
+			}
+			c.handleMTU(int(binary.BigEndian.Uint16(frame.Payload)))
+		case FrameTypeRekey:
+			err := c.handleRekey(frame)
+			if err != nil {
+				return 0, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   c.RemoteAddr(),
+					Err:    fmt.Errorf("handle rekey: %w", err),
+				}
+			}
+		case FrameTypeRekeyAck:
+			if len(frame.Payload) < 1 {
+				return 0, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   c.RemoteAddr(),
+					Err:    errors.New("missing epoch"),
+				}
+			}
+			if r := c.rotatingCrypt(); r != nil && r.Confirm(frame.Payload[0]) {
+				logger.Verbosef("Rotate keys to epoch %d to %s\n", frame.Payload[0], c.RemoteAddr())
+			}
+		case FrameTypeToken:
+			err := c.handleToken(frame)
+			if err != nil {
+				return 0, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   c.RemoteAddr(),
+					Err:    fmt.Errorf("handle token: %w", err),
+				}
+			}
+		case FrameTypeResume:
+			err := c.handleResume(frame)
+			if err != nil {
+				return 0, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   c.RemoteAddr(),
+					Err:    fmt.Errorf("handle resume: %w", err),
+				}
+			}
+		case FrameTypeFEC:
+			err := c.fecDecoder.push(frame)
+			if err != nil {
+				return 0, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   c.RemoteAddr(),
+					Err:    fmt.Errorf("handle fec: %w", err),
+				}
+			}
+		case FrameTypeRate:
+			err := c.pacer.handleRate(frame.Payload)
+			if err != nil {
+				return 0, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   c.RemoteAddr(),
+					Err:    fmt.Errorf("handle rate: %w", err),
+				}
+			}
+		case FrameTypeChallenge:
+			err := c.handleChallenge(frame)
+			if err != nil {
+				return 0, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   c.RemoteAddr(),
+					Err:    fmt.Errorf("handle challenge: %w", err),
+				}
+			}
+		case FrameTypeResponse:
+			err := c.handleResponse(frame)
+			if err != nil {
+				return 0, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   c.RemoteAddr(),
+					Err:    fmt.Errorf("handle response: %w", err),
+				}
+			}
+		case FrameTypeHello:
+			err := c.handleHello(frame)
+			if err != nil {
+				return 0, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   c.RemoteAddr(),
+					Err:    fmt.Errorf("handle hello: %w", err),
+				}
+			}
+		default:
+			logger.Verbosef("Drop a frame with type %s from %s\n", frame.Type, c.RemoteAddr())
+		}
+	}
+}
+
+func (c *FrameConn) Write(b []byte) (n int, err error) {
+	if c.Version() <= 0 {
+		err := c.retryHello()
+		if err != nil {
+			return 0, fmt.Errorf("hello: %w", err)
+		}
+
+		return c.Conn.Write(b)
+	}
+
+	if isPacing && c.Version() >= PacingFrameVersion {
+		err := c.writeRate()
+		if err != nil {
+			return 0, fmt.Errorf("report rate: %w", err)
+		}
+
+		wait, ok := c.pacer.pace(len(b) + FrameHeaderSize)
+		if !ok {
+			// Dropped as if it is lost in the queue of the bottleneck
+			return len(b), nil
+		}
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+
+	if fecDataShards > 0 && c.Version() >= FECFrameVersion {
+		err = c.writeFEC(b)
+	} else {
+		err = c.writeFrame(FrameTypeData, uint32(EmbFlowHash(b)), b)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// WriteMultipath writes a multipath frame with the sequence in the session if the negotiated version supports, and
+// writes like Write otherwise.
+func (c *FrameConn) WriteMultipath(session, seq uint32, b []byte) (n int, err error) {
+	if c.Version() < MultipathFrameVersion {
+		return c.Write(b)
+	}
+
+	payload := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(payload, seq)
+	copy(payload[4:], b)
+
+	err = c.writeFrame(FrameTypeMultipath, session, payload)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// WriteKeepAlive writes a keep-alive frame if a version is negotiated.
+func (c *FrameConn) WriteKeepAlive() error {
+	if c.Version() <= 0 {
+		return nil
+	}
+
+	return c.writeFrame(FrameTypeKeepAlive, 0, nil)
+}
+
+// WriteMTU tells the peer the path MTU if the negotiated version supports.
+func (c *FrameConn) WriteMTU(mtu int) error {
+	if c.Version() < ProbeFrameVersion {
+		return nil
+	}
+
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(mtu))
+
+	return c.writeFrame(FrameTypeMTU, 0, b)
+}
+
+func (c *FrameConn) handleMTU(mtu int) {
+	fakeTCPConn, ok := c.Conn.(*FakeTCPConn)
+	if !ok {
+		return
+	}
+	if mtu < MinMTU || mtu > MaxMTU {
+		logger.Verbosef("Ignore MTU %d from %s out of range\n", mtu, c.RemoteAddr())
+		return
+	}
+
+	if fakeTCPConn.MTU() != mtu {
+		fakeTCPConn.SetMTU(mtu)
+		logger.Verbosef("Set MTU to %d Bytes to %s\n", mtu, c.RemoteAddr())
+	}
+}
+
+func (c *FrameConn) handleHello(frame *Frame) error {
+	if len(frame.Payload) < 1 || frame.Payload[0] <= 0 {
+		return errors.New("missing version")
+	}
+
+	version := frame.Payload[0]
+	if version > FrameVersion {
+		version = FrameVersion
+	}
+
+	var id string
+	if len(frame.Payload) > 1 {
+		if len(frame.Payload)-1 > MaxIdSize {
+			return fmt.Errorf("id size %d out of range", len(frame.Payload)-1)
+		}
+		id = string(frame.Payload[1:])
+	}
+
+	c.lock.Lock()
+	initiator := c.initiator
+	token := c.token
+	changed := c.version != version
+	c.version = version
+	idChanged := !initiator && c.peerId != id
+	if !initiator {
+		c.peerId = id
+	}
+	c.lock.Unlock()
+
+	if changed {
+		logger.Verbosef("Frame packets to %s in version %d\n", c.RemoteAddr(), version)
+	}
+	if idChanged && id != "" {
+		logger.Verbosef("Peer %s identifies as %s\n", c.RemoteAddr(), id)
+	}
+
+	if initiator {
+		return nil
+	}
+
+	// Reply with the agreed version
+	err := c.writeFrame(FrameTypeHello, 0, []byte{version})
+	if err != nil {
+		return err
+	}
+
+	// Issue the token after the reply, so the peer already frames in the version
+	if version >= ResumeFrameVersion && len(token) > 0 {
+		err := c.writeFrame(FrameTypeToken, 0, token)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.challengeUser()
+}
+
+func (c *FrameConn) writeFrame(t FrameType, flowId uint32, payload []byte) error {
+	version := c.Version()
+	if version <= 0 {
+		version = FrameVersion
+	}
+
+	b, err := EncodeFrame(&Frame{
+		Version: version,
+		Type:    t,
+		FlowId:  flowId,
+		Payload: payload,
+	})
+	if err != nil {
+		return &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    fmt.Errorf("encode frame: %w", err),
+		}
+	}
+
+	_, err = c.Conn.Write(b)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,170 @@
+// +build gofuzz
+
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Fuzz parses the data as an embedded packet decapsulated from a peer, and rewrites it as the server does in NAT. It is
+// the entry of go-fuzz, which is built by go-fuzz-build with the gofuzz tag.
+//
+//	go-fuzz-build ikago/internal/pcap
+//	go-fuzz -bin pcap-fuzz.zip -workdir internal/pcap/testdata/fuzz/parse
+func Fuzz(data []byte) int {
+	indicator, err := ParseEmbPacket(data)
+	if err != nil {
+		return 0
+	}
+
+	// Fragments are reassembled before they are handled, like atomic fragments
+	indicator, err = NewEasyDefragmenter().Append(indicator)
+	if err != nil || indicator == nil {
+		return 0
+	}
+
+	_ = indicator.NATSrc()
+	_ = indicator.NATDst()
+	_ = indicator.MTU()
+	_ = indicator.Payload()
+	_ = indicator.NetworkData()
+
+	srcDev := NewDevice("eth0", []*net.IPNet{
+		{IP: net.IPv4(192, 168, 1, 2).To4(), Mask: net.CIDRMask(24, 32)},
+		{IP: net.ParseIP("2001:db8::2"), Mask: net.CIDRMask(64, 128)},
+	}, net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}, false)
+	dstDev := NewDevice("gateway", nil, net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}, false)
+	conn := NewMemConn(srcDev, dstDev, layers.LinkTypeEthernet)
+	defer conn.Close()
+
+	r, err := RewriteSrc(indicator, conn, 49152, true)
+	if err != nil {
+		return 0
+	}
+	_, err = r.Serialize(nil)
+	if err != nil {
+		return 0
+	}
+	r, err = RewriteDst(indicator, indicator.SrcIP(), 49152)
+	if err != nil {
+		return 0
+	}
+	_, err = r.Serialize(nil)
+	if err != nil {
+		return 0
+	}
+
+	return 1
+}
+
+// FuzzFrame reads the data as datagrams from a peer through a framed connection, each of which is prefixed by its
+// length in 2 Bytes in big endian.
+//
+//	go-fuzz -bin pcap-fuzz.zip -func FuzzFrame -workdir internal/pcap/testdata/fuzz/frame
+func FuzzFrame(data []byte) int {
+	conn := NewFrameConn(&fuzzConn{datagrams: splitDatagrams(data)})
+	defer conn.Close()
+
+	result := 0
+	b := make([]byte, IPv4MaxSize)
+	for {
+		_, err := conn.Read(b)
+		if err == io.EOF {
+			return result
+		}
+		if err == nil {
+			result = 1
+		}
+	}
+}
+
+// FuzzFEC pushes the data as frames of forward error correction, each of which is prefixed by its length in 2 Bytes
+// in big endian, and pops packets received and reconstructed.
+//
+//	go-fuzz -bin pcap-fuzz.zip -func FuzzFEC -workdir internal/pcap/testdata/fuzz/fec
+func FuzzFEC(data []byte) int {
+	d := newFECDecoder()
+
+	result := 0
+	for _, b := range splitDatagrams(data) {
+		frame, err := DecodeFrame(b)
+		if err != nil {
+			continue
+		}
+		err = d.push(frame)
+		if err != nil {
+			continue
+		}
+		for packet := d.pop(); packet != nil; packet = d.pop() {
+			result = 1
+		}
+	}
+
+	return result
+}
+
+// splitDatagrams splits the data into datagrams prefixed by their lengths in 2 Bytes in big endian.
+func splitDatagrams(data []byte) [][]byte {
+	datagrams := make([][]byte, 0)
+	for len(data) >= 2 {
+		size := int(binary.BigEndian.Uint16(data))
+		data = data[2:]
+		if size > len(data) {
+			size = len(data)
+		}
+		datagrams = append(datagrams, data[:size])
+		data = data[size:]
+	}
+
+	return datagrams
+}
+
+// fuzzConn is a connection whose reads return datagrams in order and then io.EOF, and whose writes are discarded.
+type fuzzConn struct {
+	datagrams [][]byte
+}
+
+func (c *fuzzConn) Read(b []byte) (n int, err error) {
+	if len(c.datagrams) <= 0 {
+		return 0, io.EOF
+	}
+
+	n = copy(b, c.datagrams[0])
+	c.datagrams = c.datagrams[1:]
+
+	return n, nil
+}
+
+func (c *fuzzConn) Write(b []byte) (n int, err error) {
+	return len(b), nil
+}
+
+func (c *fuzzConn) Close() error {
+	return nil
+}
+
+func (c *fuzzConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 49152}
+}
+
+func (c *fuzzConn) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 80}
+}
+
+func (c *fuzzConn) SetDeadline(t time.Time) error {
+	return errors.New("not supported")
+}
+
+func (c *fuzzConn) SetReadDeadline(t time.Time) error {
+	return errors.New("not supported")
+}
+
+func (c *fuzzConn) SetWriteDeadline(t time.Time) error {
+	return errors.New("not supported")
+}
@@ -52,7 +52,7 @@ func ParseICMPv4Layer(layer *layers.ICMPv4) (*ICMPv4Indicator, error) {
 		// Parse network layer
 		networkLayer := packet.Layers()[0]
 		if t := networkLayer.LayerType(); t != layers.LayerTypeIPv4 {
-			return nil, fmt.Errorf("network layer type %s not support", t)
+			return nil, NewError(ErrUnsupportedLayer, "network layer type %s not support", t)
 		}
 
 		embIPv4Layer = networkLayer.(*layers.IPv4)
@@ -68,10 +68,15 @@ func ParseICMPv4Layer(layer *layers.ICMPv4) (*ICMPv4Indicator, error) {
 		// Parse transport layer
 		embTransportLayer = packet.Layers()[1]
 		switch t := embTransportLayer.LayerType(); t {
-		case layers.LayerTypeTCP, layers.LayerTypeUDP, layers.LayerTypeICMPv4:
+		case layers.LayerTypeTCP, layers.LayerTypeUDP:
 			break
+		case layers.LayerTypeICMPv4:
+			_, err := isICMPv4Query(embTransportLayer.(*layers.ICMPv4).TypeCode.Type())
+			if err != nil {
+				return nil, err
+			}
 		default:
-			return nil, fmt.Errorf("transport layer type %s not support", t)
+			return nil, NewError(ErrUnsupportedLayer, "transport layer type %s not support", t)
 		}
 	default:
 		return nil, fmt.Errorf("icmpv4 type %d not support", t)
@@ -100,27 +105,12 @@ func (indicator *ICMPv4Indicator) ICMPv4Layer() *layers.ICMPv4 {
 
 // IsQuery returns if the ICMPv4 layer is a query.
 func (indicator *ICMPv4Indicator) IsQuery() bool {
-	switch t := indicator.layer.TypeCode.Type(); t {
-	case layers.ICMPv4TypeEchoReply,
-		layers.ICMPv4TypeEchoRequest,
-		layers.ICMPv4TypeRouterAdvertisement,
-		layers.ICMPv4TypeRouterSolicitation,
-		layers.ICMPv4TypeTimestampRequest,
-		layers.ICMPv4TypeTimestampReply,
-		layers.ICMPv4TypeInfoRequest,
-		layers.ICMPv4TypeInfoReply,
-		layers.ICMPv4TypeAddressMaskRequest,
-		layers.ICMPv4TypeAddressMaskReply:
-		return true
-	case layers.ICMPv4TypeDestinationUnreachable,
-		layers.ICMPv4TypeSourceQuench,
-		layers.ICMPv4TypeRedirect,
-		layers.ICMPv4TypeTimeExceeded,
-		layers.ICMPv4TypeParameterProblem:
-		return false
-	default:
-		panic(fmt.Errorf("icmpv4 type %d not support", t))
+	isQuery, err := isICMPv4Query(indicator.layer.TypeCode.Type())
+	if err != nil {
+		panic(err)
 	}
+
+	return isQuery
 }
 
 // Id returns the ICMPv4 Id.
@@ -191,7 +181,7 @@ func (indicator *ICMPv4Indicator) EmbId() uint16 {
 	case layers.LayerTypeICMPv4:
 		return indicator.EmbICMPv4Layer().Id
 	default:
-		panic(fmt.Errorf("transport layer type %s not support", t))
+		panic(NewError(ErrUnsupportedLayer, "transport layer type %s not support", t))
 	}
 }
 
@@ -203,7 +193,7 @@ func (indicator *ICMPv4Indicator) EmbSrcPort() uint16 {
 	case layers.LayerTypeUDP:
 		return uint16(indicator.EmbUDPLayer().SrcPort)
 	default:
-		panic(fmt.Errorf("transport layer type %s not support", t))
+		panic(NewError(ErrUnsupportedLayer, "transport layer type %s not support", t))
 	}
 }
 
@@ -215,13 +205,23 @@ func (indicator *ICMPv4Indicator) EmbDstPort() uint16 {
 	case layers.LayerTypeUDP:
 		return uint16(indicator.EmbUDPLayer().DstPort)
 	default:
-		panic(fmt.Errorf("transport layer type %s not support", t))
+		panic(NewError(ErrUnsupportedLayer, "transport layer type %s not support", t))
 	}
 }
 
 // IsEmbQuery returns if the embedded ICMPv4 layer is a query.
 func (indicator *ICMPv4Indicator) IsEmbQuery() bool {
-	switch t := indicator.EmbICMPv4Layer().TypeCode.Type(); t {
+	isQuery, err := isICMPv4Query(indicator.EmbICMPv4Layer().TypeCode.Type())
+	if err != nil {
+		panic(err)
+	}
+
+	return isQuery
+}
+
+// isICMPv4Query returns if the ICMPv4 type is a query.
+func isICMPv4Query(t uint8) (bool, error) {
+	switch t {
 	case layers.ICMPv4TypeEchoReply,
 		layers.ICMPv4TypeEchoRequest,
 		layers.ICMPv4TypeRouterAdvertisement,
@@ -232,15 +232,15 @@ func (indicator *ICMPv4Indicator) IsEmbQuery() bool {
 		layers.ICMPv4TypeInfoReply,
 		layers.ICMPv4TypeAddressMaskRequest,
 		layers.ICMPv4TypeAddressMaskReply:
-		return true
+		return true, nil
 	case layers.ICMPv4TypeDestinationUnreachable,
 		layers.ICMPv4TypeSourceQuench,
 		layers.ICMPv4TypeRedirect,
 		layers.ICMPv4TypeTimeExceeded,
 		layers.ICMPv4TypeParameterProblem:
-		return false
+		return false, nil
 	default:
-		panic(fmt.Errorf("icmpv4 type %d not support", t))
+		return false, fmt.Errorf("icmpv4 type %d not support", t)
 	}
 }
 
@@ -273,7 +273,7 @@ func (indicator *ICMPv4Indicator) EmbSrc() net.Addr {
 				IP: indicator.EmbDstIP(),
 			}
 		default:
-			panic(fmt.Errorf("transport layer type %s not support", t))
+			panic(NewError(ErrUnsupportedLayer, "transport layer type %s not support", t))
 		}
 	}
 }
@@ -307,7 +307,7 @@ func (indicator *ICMPv4Indicator) EmbDst() net.Addr {
 				IP: indicator.EmbSrcIP(),
 			}
 		default:
-			panic(fmt.Errorf("transport layer type %s not support", t))
+			panic(NewError(ErrUnsupportedLayer, "transport layer type %s not support", t))
 		}
 	}
 }
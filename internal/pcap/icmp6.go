@@ -0,0 +1,83 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket/layers"
+)
+
+// ICMPv6Indicator indicates an ICMPv6 layer. Only echo request and echo reply are supported.
+type ICMPv6Indicator struct {
+	layer    *layers.ICMPv6
+	id       uint16
+	seq      uint16
+	contents []byte
+}
+
+// ParseICMPv6Layer parses an ICMPv6 layer and returns an ICMPv6 indicator.
+func ParseICMPv6Layer(layer *layers.ICMPv6) (*ICMPv6Indicator, error) {
+	switch t := layer.TypeCode.Type(); t {
+	case layers.ICMPv6TypeEchoRequest, layers.ICMPv6TypeEchoReply:
+		break
+	default:
+		return nil, fmt.Errorf("icmpv6 type %d not support", t)
+	}
+
+	// Parse echo identifier and sequence number
+	payload := layer.LayerPayload()
+	if len(payload) < 4 {
+		return nil, errors.New("missing icmpv6 echo")
+	}
+
+	return &ICMPv6Indicator{
+		layer:    layer,
+		id:       uint16(payload[0])<<8 | uint16(payload[1]),
+		seq:      uint16(payload[2])<<8 | uint16(payload[3]),
+		contents: payload[4:],
+	}, nil
+}
+
+// NewPureICMPv6Layer returns an new ICMPv6 layer copied from the original ICMPv6 layer without any encapped layers.
+func (indicator *ICMPv6Indicator) NewPureICMPv6Layer() *layers.ICMPv6 {
+	return &layers.ICMPv6{
+		TypeCode: indicator.layer.TypeCode,
+	}
+}
+
+// NewEchoLayer returns a new ICMPv6 echo layer with the given Id.
+func (indicator *ICMPv6Indicator) NewEchoLayer(id uint16) *layers.ICMPv6Echo {
+	return &layers.ICMPv6Echo{
+		Identifier: id,
+		SeqNumber:  indicator.seq,
+	}
+}
+
+// ICMPv6Layer returns the ICMPv6 layer.
+func (indicator *ICMPv6Indicator) ICMPv6Layer() *layers.ICMPv6 {
+	return indicator.layer
+}
+
+// IsQuery returns if the ICMPv6 layer is a query.
+func (indicator *ICMPv6Indicator) IsQuery() bool {
+	switch t := indicator.layer.TypeCode.Type(); t {
+	case layers.ICMPv6TypeEchoRequest, layers.ICMPv6TypeEchoReply:
+		return true
+	default:
+		panic(fmt.Errorf("icmpv6 type %d not support", t))
+	}
+}
+
+// Id returns the ICMPv6 echo identifier.
+func (indicator *ICMPv6Indicator) Id() uint16 {
+	return indicator.id
+}
+
+// Seq returns the ICMPv6 echo sequence number.
+func (indicator *ICMPv6Indicator) Seq() uint16 {
+	return indicator.seq
+}
+
+// Contents returns the data of the ICMPv6 echo.
+func (indicator *ICMPv6Indicator) Contents() []byte {
+	return indicator.contents
+}
@@ -0,0 +1,134 @@
+package pcap
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IdStrategy describes the strategy of generating IPv4 Ids.
+type IdStrategy int
+
+const (
+	// IdStrategyRandom describes Ids are generated by a counter per destination starting at a random value, as RFC
+	// 6864 suggests.
+	IdStrategyRandom IdStrategy = iota
+	// IdStrategyIncremental describes Ids are generated by a single counter per connection starting at 0.
+	IdStrategyIncremental
+)
+
+func (strategy IdStrategy) String() string {
+	switch strategy {
+	case IdStrategyRandom:
+		return "random"
+	case IdStrategyIncremental:
+		return "incremental"
+	default:
+		return ""
+	}
+}
+
+// ParseIdStrategy returns the IPv4 Id strategy of the name.
+func ParseIdStrategy(s string) (IdStrategy, error) {
+	switch s {
+	case "", "random":
+		return IdStrategyRandom, nil
+	case "incremental":
+		return IdStrategyIncremental, nil
+	default:
+		return 0, fmt.Errorf("strategy %s not support", s)
+	}
+}
+
+var idStrategy = IdStrategyRandom
+
+// SetIdStrategy sets the strategy of generating IPv4 Ids. It should be called before any connection is established.
+func SetIdStrategy(strategy IdStrategy) {
+	idStrategy = strategy
+}
+
+// maxIdCounters is the number of destinations after which idle counters are removed.
+const maxIdCounters = 4096
+
+// keepIdCounters is the duration after which a counter without use may be removed.
+const keepIdCounters = 2 * time.Minute
+
+type idCounter struct {
+	next     uint16
+	used     uint32
+	appear   time.Time
+	lastUsed time.Time
+}
+
+// idPool describes a pool of IPv4 Ids of a connection.
+type idPool struct {
+	// next is accessed atomically, as incremental Ids are generated without the lock
+	next     uint32
+	lock     sync.Mutex
+	counters map[string]*idCounter
+}
+
+func newIdPool() *idPool {
+	return &idPool{counters: make(map[string]*idCounter)}
+}
+
+// Next returns the next IPv4 Id to the destination.
+func (p *idPool) Next(dstIP net.IP) uint16 {
+	if idStrategy == IdStrategyIncremental {
+		return uint16(atomic.AddUint32(&p.next, 1) - 1)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	key := dstIP.String()
+	counter, ok := p.counters[key]
+	if !ok {
+		if len(p.counters) >= maxIdCounters {
+			p.expire(now)
+		}
+
+		counter = &idCounter{next: randomId(), appear: now}
+		p.counters[key] = counter
+	}
+
+	id := counter.next
+	counter.next++
+	counter.used++
+	counter.lastUsed = now
+
+	// Ids to the destination may collide from now on if the previous ones are still alive
+	if counter.used > 0xffff {
+		logger.Verbosef("IPv4 Id to %s wraps around in %.0f s\n", key, now.Sub(counter.appear).Seconds())
+		counter.used = 0
+		counter.appear = now
+	}
+
+	return id
+}
+
+// expire removes counters which are not used recently. The lock must be held.
+func (p *idPool) expire(now time.Time) {
+	for key, counter := range p.counters {
+		if now.Sub(counter.lastUsed) > keepIdCounters {
+			delete(p.counters, key)
+		}
+	}
+}
+
+func randomId() uint16 {
+	b := make([]byte, 2)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		logger.Warnln(fmt.Errorf("generate random IPv4 Id: %w", err))
+		return uint16(time.Now().UnixNano())
+	}
+
+	return binary.BigEndian.Uint16(b)
+}
@@ -1,10 +1,13 @@
 package pcap
 
 import (
+	"encoding/binary"
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"net"
+	"runtime"
+	"sync"
 )
 
 // CreateTCPLayer returns a TCP layer.
@@ -17,7 +20,7 @@ func CreateTCPLayer(srcPort, dstPort uint16, seq, ack uint32) *layers.TCP {
 		DataOffset: 5,
 		PSH:        true,
 		ACK:        true,
-		Window:     65535,
+		Window:     tcpWindow,
 		// Checksum: 0,
 	}
 }
@@ -74,12 +77,99 @@ func CreateIPv4Layer(srcIP, dstIP net.IP, id uint16, ttl uint8, transportLayer g
 			return nil, fmt.Errorf("set network layer for checksum: %w", err)
 		}
 	default:
-		return nil, fmt.Errorf("transport layer type %s not support", t)
+		return nil, NewError(ErrUnsupportedLayer, "transport layer type %s not support", t)
 	}
 
 	return ipv4Layer, nil
 }
 
+// CreateIPv6Layer returns an IPv6 layer.
+func CreateIPv6Layer(srcIP, dstIP net.IP, hopLimit uint8, transportLayer gopacket.TransportLayer) (*layers.IPv6, error) {
+	ipv6Layer := &layers.IPv6{
+		Version: 6,
+		// Length: 0,
+		// NextHeader: 0,
+		HopLimit: hopLimit,
+		SrcIP:    srcIP,
+		DstIP:    dstIP,
+	}
+
+	// Protocol
+	switch t := transportLayer.LayerType(); t {
+	case layers.LayerTypeTCP:
+		ipv6Layer.NextHeader = layers.IPProtocolTCP
+
+		// Checksum of transport layer
+		tcpLayer := transportLayer.(*layers.TCP)
+		err := tcpLayer.SetNetworkLayerForChecksum(ipv6Layer)
+		if err != nil {
+			return nil, fmt.Errorf("set network layer for checksum: %w", err)
+		}
+	case layers.LayerTypeUDP:
+		ipv6Layer.NextHeader = layers.IPProtocolUDP
+
+		// Checksum of transport layer
+		udpLayer := transportLayer.(*layers.UDP)
+		err := udpLayer.SetNetworkLayerForChecksum(ipv6Layer)
+		if err != nil {
+			return nil, fmt.Errorf("set network layer for checksum: %w", err)
+		}
+	default:
+		return nil, NewError(ErrUnsupportedLayer, "transport layer type %s not support", t)
+	}
+
+	return ipv6Layer, nil
+}
+
+// CreateTimeExceededPacket returns an ICMP Time Exceeded message from the source to the sender of the packet, quoting as
+// much of the packet as RFC 1812 and RFC 4443 allow.
+func CreateTimeExceededPacket(srcIP net.IP, indicator *PacketIndicator) ([]byte, error) {
+	quote := make([]byte, 0, indicator.MTU())
+	quote = append(quote, indicator.NetworkData()...)
+
+	switch t := indicator.NetworkLayer().LayerType(); t {
+	case layers.LayerTypeIPv4:
+		// Messages do not exceed 576 Bytes
+		quote = quote[:min(len(quote), 576-20-8)]
+
+		ipv4Layer := &layers.IPv4{
+			Version:  4,
+			IHL:      5,
+			TTL:      64,
+			Protocol: layers.IPProtocolICMPv4,
+			SrcIP:    srcIP,
+			DstIP:    indicator.SrcIP(),
+		}
+		icmpv4Layer := &layers.ICMPv4{
+			TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeTimeExceeded, layers.ICMPv4CodeTTLExceeded),
+		}
+
+		return Serialize(ipv4Layer, icmpv4Layer, gopacket.Payload(quote))
+	case layers.LayerTypeIPv6:
+		// Messages do not exceed the minimum IPv6 MTU, and 4 Bytes are unused
+		quote = append(make([]byte, 4), quote[:min(len(quote), 1280-40-4-4)]...)
+
+		ipv6Layer := &layers.IPv6{
+			Version:    6,
+			NextHeader: layers.IPProtocolICMPv6,
+			HopLimit:   64,
+			SrcIP:      srcIP,
+			DstIP:      indicator.SrcIP(),
+		}
+		icmpv6Layer := &layers.ICMPv6{
+			TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeTimeExceeded, layers.ICMPv6CodeHopLimitExceeded),
+		}
+		err := icmpv6Layer.SetNetworkLayerForChecksum(ipv6Layer)
+		if err != nil {
+			return nil, fmt.Errorf("set network layer for checksum: %w", err)
+		}
+
+		return Serialize(ipv6Layer, icmpv6Layer, gopacket.Payload(quote))
+	default:
+		return nil, NewError(ErrUnsupportedLayer, "network layer type %s not support", t)
+	}
+}
+
 // FlagIPv4Layer reflags flags in an IPv4 layer.
 func FlagIPv4Layer(layer *layers.IPv4, df, mf bool, offset uint16) {
 	if df {
@@ -96,89 +186,211 @@ func FlagIPv4Layer(layer *layers.IPv4, df, mf bool, offset uint16) {
 }
 
 // CreateLoopbackLayer returns a loopback layer.
-func CreateLoopbackLayer() *layers.Loopback {
-	return &layers.Loopback{}
+func CreateLoopbackLayer(networkLayer gopacket.NetworkLayer) (*layers.Loopback, error) {
+	loopbackLayer := &layers.Loopback{}
+
+	// Protocol family, AF_INET6 differs in systems
+	switch t := networkLayer.LayerType(); t {
+	case layers.LayerTypeIPv4:
+		loopbackLayer.Family = layers.ProtocolFamilyIPv4
+	case layers.LayerTypeIPv6:
+		switch runtime.GOOS {
+		case "darwin":
+			loopbackLayer.Family = layers.ProtocolFamilyIPv6Darwin
+		case "freebsd":
+			loopbackLayer.Family = layers.ProtocolFamilyIPv6FreeBSD
+		default:
+			// Npcap Loopback Adapter in Windows uses the same value as BSD
+			loopbackLayer.Family = layers.ProtocolFamilyIPv6BSD
+		}
+	default:
+		return nil, NewError(ErrUnsupportedLayer, "network layer type %s not support", t)
+	}
+
+	return loopbackLayer, nil
+}
+
+// CreateLoopLayer returns a loopback layer of DLT_LOOP, whose protocol family is in network byte order.
+func CreateLoopLayer(networkLayer gopacket.NetworkLayer) (*Loop, error) {
+	loopbackLayer, err := CreateLoopbackLayer(networkLayer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Loop{Loopback: loopbackLayer}, nil
+}
+
+// Loop is a loopback layer of DLT_LOOP, like loopback devices in OpenBSD and some in macOS. Unlike DLT_NULL, the
+// protocol family is serialized in network byte order.
+type Loop struct {
+	*layers.Loopback
+}
+
+// SerializeTo writes the protocol family in network byte order.
+func (l *Loop) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	bytes, err := b.PrependBytes(4)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(bytes, uint32(l.Family))
+
+	return nil
+}
+
+// TaggedEthernet is an Ethernet layer followed by an 802.1Q header, which are serialized together as a link layer.
+type TaggedEthernet struct {
+	Ethernet *layers.Ethernet
+	Dot1Q    *layers.Dot1Q
+}
+
+// LayerType returns the type of the Ethernet layer.
+func (layer *TaggedEthernet) LayerType() gopacket.LayerType {
+	return layers.LayerTypeEthernet
 }
 
-// CreateEthernetLayer returns an Ethernet layer.
-func CreateEthernetLayer(srcMAC, dstMAC net.HardwareAddr, networkLayer gopacket.NetworkLayer) (*layers.Ethernet, error) {
-	ethernetLayer := &layers.Ethernet{
-		SrcMAC: srcMAC,
-		DstMAC: dstMAC,
-		// EthernetType: 0,
+// SerializeTo serializes the 802.1Q header and the Ethernet layer in front of it.
+func (layer *TaggedEthernet) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	err := layer.Dot1Q.SerializeTo(b, opts)
+	if err != nil {
+		return err
 	}
 
+	return layer.Ethernet.SerializeTo(b, opts)
+}
+
+// CreateEthernetLayer returns an Ethernet layer. If the VLAN identifier is not 0, an 802.1Q header is appended.
+func CreateEthernetLayer(srcMAC, dstMAC net.HardwareAddr, vlan uint16, networkLayer gopacket.NetworkLayer) (gopacket.SerializableLayer, error) {
+	var t layers.EthernetType
+
 	// Protocol
-	switch t := networkLayer.LayerType(); t {
+	switch networkLayerType := networkLayer.LayerType(); networkLayerType {
 	case layers.LayerTypeIPv4:
-		ethernetLayer.EthernetType = layers.EthernetTypeIPv4
+		t = layers.EthernetTypeIPv4
+	case layers.LayerTypeIPv6:
+		t = layers.EthernetTypeIPv6
 	default:
-		return nil, fmt.Errorf("network layer type %s not support", t)
+		return nil, NewError(ErrUnsupportedLayer, "network layer type %s not support", networkLayerType)
+	}
+
+	if vlan == 0 {
+		return &layers.Ethernet{
+			SrcMAC:       srcMAC,
+			DstMAC:       dstMAC,
+			EthernetType: t,
+		}, nil
 	}
 
-	return ethernetLayer, nil
+	return &TaggedEthernet{
+		Ethernet: &layers.Ethernet{
+			SrcMAC:       srcMAC,
+			DstMAC:       dstMAC,
+			EthernetType: layers.EthernetTypeDot1Q,
+		},
+		Dot1Q: &layers.Dot1Q{
+			VLANIdentifier: vlan,
+			Type:           t,
+		},
+	}, nil
 }
 
-// Serialize serializes layers to byte array.
-func Serialize(layers ...gopacket.SerializableLayer) ([]byte, error) {
-	// Recalculate checksum and length
-	options := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
-	buffer := gopacket.NewSerializeBuffer()
+// CreateLinkLayer returns a link layer of the sink by its link type, tagged with the VLAN identifier of the local
+// device. Loopback devices with DLT_NULL, like the Npcap Loopback Adapter in Windows and lo0 and utun devices in macOS,
+// and with DLT_LOOP have a loopback layer instead of an Ethernet layer.
+func CreateLinkLayer(conn PacketSink, dstHardwareAddr net.HardwareAddr, networkLayer gopacket.NetworkLayer) (gopacket.SerializableLayer, error) {
+	return CreateTaggedLinkLayer(conn, dstHardwareAddr, conn.LocalDev().VLAN(), networkLayer)
+}
 
-	err := gopacket.SerializeLayers(buffer, options, layers...)
-	if err != nil {
-		return nil, err
+// CreateTaggedLinkLayer returns a link layer of the sink by its link type, tagged with the VLAN identifier.
+func CreateTaggedLinkLayer(conn PacketSink, dstHardwareAddr net.HardwareAddr, vlan uint16, networkLayer gopacket.NetworkLayer) (gopacket.SerializableLayer, error) {
+	switch t := conn.LinkType(); t {
+	case layers.LinkTypeNull:
+		return CreateLoopbackLayer(networkLayer)
+	case layers.LinkTypeLoop:
+		return CreateLoopLayer(networkLayer)
+	case layers.LinkTypeEthernet:
+		srcHardwareAddr := conn.LocalDev().HardwareAddr()
+
+		// Loopback devices in Ethernet, like the one in Linux, have no hardware address
+		if conn.IsLoop() {
+			if len(srcHardwareAddr) == 0 {
+				srcHardwareAddr = make(net.HardwareAddr, 6)
+			}
+			if len(dstHardwareAddr) == 0 {
+				dstHardwareAddr = make(net.HardwareAddr, 6)
+			}
+		}
+
+		// Upstream in PPPoE
+		if session := conn.LocalDev().PPPoE(); session != 0 {
+			return CreatePPPoELayer(srcHardwareAddr, dstHardwareAddr, session, networkLayer)
+		}
+
+		return CreateEthernetLayer(srcHardwareAddr, dstHardwareAddr, vlan, networkLayer)
+	default:
+		return nil, NewError(ErrUnsupportedLayer, "link type %s not support", t)
 	}
+}
+
+// bufferPool is a pool of serialize buffers reused across packets. Results are copied out of buffers once, as callers
+// keep them, so serializing costs a single allocation. Layers are not pooled, as they are built in several goroutines
+// and are kept by callers too.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return gopacket.NewSerializeBuffer()
+	},
+}
 
-	return buffer.Bytes(), nil
+// Serialize serializes layers to byte array.
+func Serialize(layers ...gopacket.SerializableLayer) ([]byte, error) {
+	// Recalculate checksum and length
+	return serialize(gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}, layers...)
 }
 
 // SerializeRaw serializes layers to byte array without computing checksums and updating lengths.
 func SerializeRaw(layers ...gopacket.SerializableLayer) ([]byte, error) {
-	// Recalculate checksum and length
-	options := gopacket.SerializeOptions{}
-	buffer := gopacket.NewSerializeBuffer()
+	return serialize(gopacket.SerializeOptions{}, layers...)
+}
+
+func serialize(options gopacket.SerializeOptions, layers ...gopacket.SerializableLayer) ([]byte, error) {
+	buffer := bufferPool.Get().(gopacket.SerializeBuffer)
+	defer bufferPool.Put(buffer)
 
 	err := gopacket.SerializeLayers(buffer, options, layers...)
 	if err != nil {
 		return nil, err
 	}
 
-	return buffer.Bytes(), nil
+	// The buffer will be reused, so bytes are copied
+	b := buffer.Bytes()
+	result := make([]byte, len(b))
+	copy(result, b)
+
+	return result, nil
 }
 
-// CreateLayers return layers of transmission between client and server.
-func CreateLayers(srcPort, dstPort uint16, seq, ack uint32, conn *RawConn, dstIP net.IP, id uint16, hop uint8,
+// CreateLayers return layers of transmission between client and server, whose network layer is in the TTL set by
+// SetTTL.
+func CreateLayers(srcPort, dstPort uint16, seq, ack uint32, conn *RawConn, dstIP net.IP, id uint16,
 	dstHardwareAddr net.HardwareAddr) (transportLayer, networkLayer, linkLayer gopacket.SerializableLayer, err error) {
-	var (
-		linkLayerType gopacket.LayerType
-	)
-
 	// Create transport layer
 	transportLayer = CreateTCPLayer(srcPort, dstPort, seq, ack)
 
 	// Create new network layer
-	networkLayer, err = CreateIPv4Layer(conn.LocalDev().IPAddr().IP, dstIP, id, hop-1, transportLayer.(gopacket.TransportLayer))
-	if err != nil {
-		return nil, nil, nil, fmt.Errorf("create network layer: %w", err)
+	srcIP := conn.LocalDev().IPAddrOf(dstIP)
+	if srcIP == nil {
+		return nil, nil, nil, fmt.Errorf("create network layer: %w", fmt.Errorf("missing source address for %s", dstIP))
 	}
-
-	// Decide Loopback or Ethernet
-	if conn.IsLoop() {
-		linkLayerType = layers.LayerTypeLoopback
+	if dstIP.To4() != nil {
+		networkLayer, err = CreateIPv4Layer(srcIP.IP, dstIP, id, ttl, transportLayer.(gopacket.TransportLayer))
 	} else {
-		linkLayerType = layers.LayerTypeEthernet
+		networkLayer, err = CreateIPv6Layer(srcIP.IP, dstIP, ttl, transportLayer.(gopacket.TransportLayer))
+	}
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("create network layer: %w", err)
 	}
 
 	// Create new link layer
-	switch linkLayerType {
-	case layers.LayerTypeLoopback:
-		linkLayer = CreateLoopbackLayer()
-	case layers.LayerTypeEthernet:
-		linkLayer, err = CreateEthernetLayer(conn.LocalDev().HardwareAddr(), dstHardwareAddr, networkLayer.(gopacket.NetworkLayer))
-	default:
-		return nil, nil, nil, fmt.Errorf("link layer type %s not support", linkLayerType)
-	}
+	linkLayer, err = CreateLinkLayer(conn, dstHardwareAddr, networkLayer.(gopacket.NetworkLayer))
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("create link layer: %w", err)
 	}
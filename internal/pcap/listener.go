@@ -0,0 +1,156 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"ikago/internal/addr"
+	"net"
+	"sync"
+)
+
+// sourceIP returns the IP of the device as the source to the destination, which is in the family of the destination,
+// so the tunnel runs in the family of the peer regardless of families of packets it carries.
+func sourceIP(dev *Device, dst net.IP) net.IP {
+	if ipnet := dev.IPAddrOf(dst); ipnet != nil {
+		return ipnet.IP
+	}
+
+	return dev.IPAddr().IP
+}
+
+// listenIPs returns IPs of the device to listen on, excluding link-local addresses which cannot be bound without
+// zones.
+func listenIPs(dev *Device) []net.IP {
+	result := make([]net.IP, 0)
+	for _, ipnet := range dev.IPAddrs() {
+		if ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		result = append(result, ipnet.IP)
+	}
+	if len(result) <= 0 && dev.IPAddr() != nil {
+		result = append(result, dev.IPAddr().IP)
+	}
+
+	return result
+}
+
+// listenTCP listens on the port in all IPs of the device, so clients connect in either family.
+func listenTCP(dev *Device, srcPort uint16) (net.Listener, error) {
+	ips := listenIPs(dev)
+	if len(ips) <= 0 {
+		return nil, fmt.Errorf("missing address of device %s", dev.Alias())
+	}
+
+	addrs := make([]*net.TCPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, &net.TCPAddr{IP: ip, Port: int(srcPort)})
+	}
+
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, srcAddr := range addrs {
+		listener, err := net.ListenTCP("tcp", srcAddr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+
+			return nil, &net.OpError{
+				Op:     "listen",
+				Net:    "pcap",
+				Source: srcAddr,
+				Err:    err,
+			}
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) == 1 {
+		return listeners[0], nil
+	}
+
+	return newMultiListener(listeners, addr.MultiTCPAddr{Addrs: addrs}), nil
+}
+
+type acceptedConn struct {
+	conn net.Conn
+	err  error
+}
+
+// multiListener is a listener accepting connections from multiple listeners.
+type multiListener struct {
+	listeners []net.Listener
+	addr      net.Addr
+	accepted  chan acceptedConn
+	closed    chan struct{}
+	once      sync.Once
+}
+
+func newMultiListener(listeners []net.Listener, addr net.Addr) *multiListener {
+	l := &multiListener{
+		listeners: listeners,
+		addr:      addr,
+		accepted:  make(chan acceptedConn),
+		closed:    make(chan struct{}),
+	}
+
+	for _, listener := range listeners {
+		go l.run(listener)
+	}
+
+	return l
+}
+
+func (l *multiListener) run(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+
+		select {
+		case l.accepted <- acceptedConn{conn: conn, err: err}:
+		case <-l.closed:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				continue
+			}
+			return
+		}
+	}
+}
+
+func (l *multiListener) Accept() (net.Conn, error) {
+	select {
+	case a := <-l.accepted:
+		return a.conn, a.err
+	case <-l.closed:
+		return nil, &net.OpError{
+			Op:     "accept",
+			Net:    "pcap",
+			Source: l.addr,
+			Err:    errors.New("listener closed"),
+		}
+	}
+}
+
+func (l *multiListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.closed)
+		for _, listener := range l.listeners {
+			e := listener.Close()
+			if e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+
+	return err
+}
+
+func (l *multiListener) Addr() net.Addr {
+	return l.addr
+}
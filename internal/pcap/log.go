@@ -0,0 +1,5 @@
+package pcap
+
+import "ikago/internal/log"
+
+var logger = log.New("pcap")
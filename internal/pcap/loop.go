@@ -0,0 +1,67 @@
+package pcap
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// LoopGuard remembers packets written recently, so packets re-captured after they are injected can be recognized and
+// skipped instead of being redirected in a loop, which happens when devices of listening and upstream are the same.
+type LoopGuard struct {
+	ttl        time.Duration
+	lock       sync.Mutex
+	sent       map[uint64]time.Time
+	lastExpire time.Time
+}
+
+// NewLoopGuard returns a new loop guard which remembers packets for the duration.
+func NewLoopGuard(ttl time.Duration) *LoopGuard {
+	return &LoopGuard{
+		ttl:        ttl,
+		sent:       make(map[uint64]time.Time),
+		lastExpire: time.Now(),
+	}
+}
+
+// Mark remembers the packet data as written.
+func (g *LoopGuard) Mark(data []byte) {
+	key := hashData(data)
+	now := time.Now()
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.sent[key] = now
+
+	if now.Sub(g.lastExpire) > g.ttl {
+		for k, t := range g.sent {
+			if now.Sub(t) > g.ttl {
+				delete(g.sent, k)
+			}
+		}
+		g.lastExpire = now
+	}
+}
+
+// Seen returns if the packet data is written recently.
+func (g *LoopGuard) Seen(data []byte) bool {
+	key := hashData(data)
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	t, ok := g.sent[key]
+	if !ok {
+		return false
+	}
+
+	return time.Since(t) <= g.ttl
+}
+
+func hashData(data []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(data)
+
+	return h.Sum64()
+}
@@ -0,0 +1,113 @@
+package pcap
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// MACOverride describes a static hardware address of the next hop, which overrides the resolved hardware address of
+// the gateway for an upstream device or for destinations in a CIDR.
+type MACOverride struct {
+	dev          string
+	ipNet        *net.IPNet
+	hardwareAddr net.HardwareAddr
+}
+
+// HardwareAddr returns the hardware address of the override.
+func (o *MACOverride) HardwareAddr() net.HardwareAddr {
+	return o.hardwareAddr
+}
+
+// IsCIDR returns if the override is for destinations in a CIDR.
+func (o *MACOverride) IsCIDR() bool {
+	return o.ipNet != nil
+}
+
+func (o *MACOverride) String() string {
+	if o.ipNet != nil {
+		return fmt.Sprintf("%s=%s", o.ipNet, o.hardwareAddr)
+	}
+
+	return fmt.Sprintf("%s=%s", o.dev, o.hardwareAddr)
+}
+
+// ParseMACOverride returns a MAC override by given string. Overrides can be dev=mac for the upstream device in name or
+// in alias, or cidr=mac for destinations in the CIDR, an IP is treated as a CIDR of its single address.
+func ParseMACOverride(s string) (*MACOverride, error) {
+	str := strings.TrimSpace(s)
+
+	i := strings.LastIndex(str, "=")
+	if i <= 0 {
+		return nil, fmt.Errorf("override %s not support", s)
+	}
+	target, mac := strings.TrimSpace(str[:i]), strings.TrimSpace(str[i+1:])
+
+	hardwareAddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil, fmt.Errorf("parse hardware address %s: %w", mac, err)
+	}
+
+	o := &MACOverride{hardwareAddr: hardwareAddr}
+	if _, ipNet, err := net.ParseCIDR(target); err == nil {
+		o.ipNet = ipNet
+	} else if ip := net.ParseIP(target); ip != nil {
+		bits := net.IPv6len * 8
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), net.IPv4len*8
+		}
+		o.ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else {
+		o.dev = target
+	}
+
+	return o, nil
+}
+
+// MACOverrides describes MAC overrides.
+type MACOverrides []*MACOverride
+
+// ParseMACOverrides returns MAC overrides by given strings.
+func ParseMACOverrides(s []string) (MACOverrides, error) {
+	result := make(MACOverrides, 0, len(s))
+	for _, str := range s {
+		o, err := ParseMACOverride(str)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, o)
+	}
+
+	return result, nil
+}
+
+// OfDev returns the hardware address overriding the gateway of the upstream device, nil if there is no such override.
+func (overrides MACOverrides) OfDev(dev *Device) net.HardwareAddr {
+	for _, o := range overrides {
+		if o.dev != "" && (o.dev == dev.Name() || o.dev == dev.Alias()) {
+			return o.hardwareAddr
+		}
+	}
+
+	return nil
+}
+
+// OfIP returns the hardware address overriding the next hop to the destination by the longest matched CIDR, nil if
+// there is no such override.
+func (overrides MACOverrides) OfIP(ip net.IP) net.HardwareAddr {
+	var (
+		result net.HardwareAddr
+		length = -1
+	)
+	for _, o := range overrides {
+		if o.ipNet == nil || !o.ipNet.Contains(ip) {
+			continue
+		}
+		ones, _ := o.ipNet.Mask.Size()
+		if ones > length {
+			result, length = o.hardwareAddr, ones
+		}
+	}
+
+	return result
+}
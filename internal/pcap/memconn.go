@@ -0,0 +1,144 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"sync"
+)
+
+// MemConn is a packet connection in memory. Packets fed to it are read in order, and packets written to it are kept
+// until they are taken, so handling of packets can be exercised without root privileges and devices.
+type MemConn struct {
+	srcDev   *Device
+	dstDev   *Device
+	linkType layers.LinkType
+	lock     sync.Mutex
+	in       chan gopacket.Packet
+	out      [][]byte
+	filter   string
+	closed   chan struct{}
+}
+
+// NewDevice returns a new device, which is used with connections in memory.
+func NewDevice(name string, ipAddrs []*net.IPNet, hardwareAddr net.HardwareAddr, isLoop bool) *Device {
+	return &Device{
+		name:         name,
+		alias:        name,
+		ipAddrs:      ipAddrs,
+		hardwareAddr: hardwareAddr,
+		isLoop:       isLoop,
+	}
+}
+
+// NewMemConn returns a new connection in memory between devices in the link type.
+func NewMemConn(srcDev, dstDev *Device, linkType layers.LinkType) *MemConn {
+	return &MemConn{
+		srcDev:   srcDev,
+		dstDev:   dstDev,
+		linkType: linkType,
+		in:       make(chan gopacket.Packet, 1000),
+		out:      make([][]byte, 0),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Feed decodes the data in the link type of the connection as a captured packet to be read.
+func (c *MemConn) Feed(data []byte) error {
+	packet := gopacket.NewPacket(data, c.linkType, gopacket.Default)
+	if errLayer := packet.ErrorLayer(); errLayer != nil {
+		return fmt.Errorf("decode: %w", errLayer.Error())
+	}
+
+	select {
+	case <-c.closed:
+		return errors.New("closed")
+	case c.in <- packet:
+		return nil
+	}
+}
+
+// Take returns packets written to the connection since the last take.
+func (c *MemConn) Take() [][]byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	result := c.out
+	c.out = make([][]byte, 0)
+
+	return result
+}
+
+// Filter returns the BPF filter set to the connection, which is not applied in memory.
+func (c *MemConn) Filter() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.filter
+}
+
+func (c *MemConn) ReadPacket() (gopacket.Packet, error) {
+	select {
+	case <-c.closed:
+		return nil, errors.New("closed")
+	case packet := <-c.in:
+		return packet, nil
+	}
+}
+
+func (c *MemConn) Write(b []byte) (n int, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	select {
+	case <-c.closed:
+		return 0, errors.New("closed")
+	default:
+	}
+
+	data := make([]byte, len(b))
+	copy(data, b)
+	c.out = append(c.out, data)
+
+	return len(b), nil
+}
+
+func (c *MemConn) LinkType() layers.LinkType {
+	return c.linkType
+}
+
+func (c *MemConn) LocalDev() *Device {
+	return c.srcDev
+}
+
+func (c *MemConn) RemoteDev() *Device {
+	return c.dstDev
+}
+
+func (c *MemConn) IsLoop() bool {
+	return c.dstDev.IsLoop()
+}
+
+func (c *MemConn) SetBPFFilter(filter string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.filter = filter
+
+	return nil
+}
+
+func (c *MemConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package pcap
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// mmapHandle is a handle of an AF_PACKET socket capturing by TPACKET_V3, whose ring shared with the kernel is mapped
+// into the process and read without libpcap.
+type mmapHandle struct {
+	tpacket *afpacket.TPacket
+	// promisc is a socket holding the device in promiscuous mode until it is closed, or -1
+	promisc int
+}
+
+// openMmap opens a handle of the device capturing by TPACKET_V3 with options of capturing. The ring is sized by the
+// buffer size.
+func openMmap(dev string) (*mmapHandle, error) {
+	iface, err := net.InterfaceByName(dev)
+	if err != nil {
+		return nil, fmt.Errorf("find interface: %w", err)
+	}
+	// Only devices in Ethernet are supported, as AF_PACKET does not tell the link type. Loopback is framed in Ethernet
+	// in Linux
+	if len(iface.HardwareAddr) != 6 && iface.Flags&net.FlagLoopback == 0 {
+		return nil, NewError(ErrUnsupportedLayer, "link type of device %s not support in mmap", dev)
+	}
+
+	blocks := afpacket.DefaultNumBlocks
+	if pcapConfig.Buffer > 0 {
+		blocks = pcapConfig.Buffer / afpacket.DefaultBlockSize
+		if blocks < 1 {
+			blocks = 1
+		}
+	}
+
+	blockTimeout := afpacket.DefaultBlockTimeout
+	if pcapConfig.Timeout > 0 {
+		blockTimeout = time.Duration(pcapConfig.Timeout) * time.Millisecond
+	}
+	if pcapConfig.Immediate {
+		blockTimeout = time.Millisecond
+	}
+
+	pollTimeout := afpacket.DefaultPollTimeout
+	if pcapConfig.Timeout > 0 {
+		pollTimeout = time.Duration(pcapConfig.Timeout) * time.Millisecond
+	}
+
+	tpacket, err := afpacket.NewTPacket(
+		afpacket.OptInterface(dev),
+		afpacket.OptFrameSize(afpacket.DefaultFrameSize),
+		afpacket.OptBlockSize(afpacket.DefaultBlockSize),
+		afpacket.OptNumBlocks(blocks),
+		afpacket.OptBlockTimeout(blockTimeout),
+		afpacket.OptPollTimeout(pollTimeout),
+		afpacket.TPacketVersion3,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("open tpacket: %w", err)
+	}
+
+	handle := &mmapHandle{tpacket: tpacket, promisc: -1}
+
+	promisc := true
+	for _, name := range pcapConfig.NoPromisc {
+		if name == dev {
+			promisc = false
+			break
+		}
+	}
+	if promisc {
+		fd, err := openPromisc(iface.Index)
+		if err != nil {
+			tpacket.Close()
+			return nil, fmt.Errorf("set promisc: %w", err)
+		}
+		handle.promisc = fd
+	}
+
+	return handle, nil
+}
+
+// openPromisc opens a socket which puts the device in promiscuous mode as long as it is open.
+func openPromisc(index int) (int, error) {
+	// Protocol 0 receives nothing, so the socket is only for the membership
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("socket: %w", err)
+	}
+
+	err = unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &unix.PacketMreq{
+		Ifindex: int32(index),
+		Type:    unix.PACKET_MR_PROMISC,
+	})
+	if err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("add membership: %w", err)
+	}
+
+	return fd, nil
+}
+
+func (h *mmapHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	d, ci, err := h.tpacket.ReadPacketData()
+	// Timeouts are told like in pcap, so they are skipped the same
+	if err == afpacket.ErrTimeout {
+		return d, ci, pcap.NextErrorTimeoutExpired
+	}
+	if err != nil {
+		return d, ci, err
+	}
+	// The snap length is not applied by the kernel, so packets are truncated like in pcap
+	if len(d) > snapLen {
+		d = d[:snapLen]
+		ci.CaptureLength = snapLen
+	}
+
+	return d, ci, nil
+}
+
+func (h *mmapHandle) WritePacketData(data []byte) error {
+	return h.tpacket.WritePacketData(data)
+}
+
+func (h *mmapHandle) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+// SetBPFFilter compiles the BPF filter by libpcap and attaches it to the socket.
+func (h *mmapHandle) SetBPFFilter(filter string) error {
+	instructions, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, snapLen, filter)
+	if err != nil {
+		return err
+	}
+
+	raw := make([]bpf.RawInstruction, len(instructions))
+	for i, instruction := range instructions {
+		raw[i] = bpf.RawInstruction{
+			Op: instruction.Code,
+			Jt: instruction.Jt,
+			Jf: instruction.Jf,
+			K:  instruction.K,
+		}
+	}
+
+	return h.tpacket.SetBPF(raw)
+}
+
+// Stats returns statistics of the socket in the form of pcap. Drops of the interface are unknown.
+func (h *mmapHandle) Stats() (*pcap.Stats, error) {
+	_, stats, err := h.tpacket.SocketStats()
+	if err != nil {
+		return nil, err
+	}
+
+	return &pcap.Stats{
+		PacketsReceived: int(stats.Packets()),
+		PacketsDropped:  int(stats.Drops()),
+	}, nil
+}
+
+func (h *mmapHandle) Close() {
+	h.tpacket.Close()
+	if h.promisc >= 0 {
+		unix.Close(h.promisc)
+	}
+}
@@ -0,0 +1,59 @@
+package pcap
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestMmapLoopback(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mmap requires root")
+	}
+
+	pcapConfig.Timeout = 100
+	defer func() {
+		pcapConfig.Timeout = 0
+	}()
+
+	handle, err := openMmap("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+
+	conn, err := net.Dial("udp", "127.0.0.1:9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write(testPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		d, ci, err := handle.ReadPacketData()
+		if err != nil {
+			continue
+		}
+		if !bytes.Contains(d, testPayload) {
+			continue
+		}
+		if ci.CaptureLength != len(d) {
+			t.Fatalf("capture length %d, expected %d", ci.CaptureLength, len(d))
+		}
+
+		stats, err := handle.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.PacketsReceived <= 0 {
+			t.Fatalf("received %d", stats.PacketsReceived)
+		}
+
+		return
+	}
+	t.Fatal("not captured")
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package pcap
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func openMmap(dev string) (captureHandle, error) {
+	return nil, fmt.Errorf("mmap in os %s not support", runtime.GOOS)
+}
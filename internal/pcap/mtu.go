@@ -0,0 +1,138 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// probeTimeout is the duration of waiting for the reply of a probe.
+	probeTimeout = time.Second
+	// maxProbes is the max number of probes sent in a size before the size is regarded as exceeding the path MTU.
+	maxProbes = 2
+	// probeStep is the precision of discovering the path MTU.
+	probeStep = 8
+)
+
+var probeId uint32
+
+// DiscoverMTU discovers the path MTU to the server by probing frames in binary search between MinMTU and the max MTU,
+// then fragments packets in the path MTU and tells the server to do the same. Probes are written in a single packet with
+// DF set, so a probe exceeding the path MTU is dropped instead of being fragmented by routers. Discovering is only
+// supported in mode faketcp without KCP or batching, with framing negotiated in version 3 or later. Paths in multipath
+// are discovered respectively, and the min path MTU in them is returned.
+func (c *TunnelConn) DiscoverMTU(max int) (int, error) {
+	multipathConn, ok := c.Conn.(*MultipathConn)
+	if !ok {
+		return discoverMTU(c.Conn, max)
+	}
+
+	result := max
+	for _, path := range multipathConn.Paths() {
+		mtu, err := discoverMTU(path, max)
+		if err != nil {
+			return 0, fmt.Errorf("discover in %s: %w", path.LocalAddr(), err)
+		}
+		if mtu < result {
+			result = mtu
+		}
+	}
+
+	return result, nil
+}
+
+func discoverMTU(conn net.Conn, max int) (int, error) {
+	frameConn, ok := conn.(*FrameConn)
+	if !ok {
+		return 0, errors.New("missing framing")
+	}
+	if version := frameConn.Version(); version < ProbeFrameVersion {
+		return 0, fmt.Errorf("framing version %d not support", version)
+	}
+	fakeTCPConn, ok := frameConn.Conn.(*FakeTCPConn)
+	if !ok {
+		return 0, errors.New("mode not support")
+	}
+
+	overhead := fakeTCPConn.overhead() + FrameHeaderSize + fecOverhead()
+
+	// The max MTU is tried first as it fits in most paths
+	ok, err := frameConn.probe(fakeTCPConn, max-overhead)
+	if err != nil {
+		return 0, err
+	}
+
+	low, high := MinMTU, max
+	if ok {
+		low = max
+	}
+	for high-low > probeStep {
+		mid := (low + high) / 2
+
+		ok, err := frameConn.probe(fakeTCPConn, mid-overhead)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			low = mid
+		} else {
+			high = mid
+		}
+	}
+
+	if fakeTCPConn.MTU() != low {
+		fakeTCPConn.SetMTU(low)
+	}
+	err = frameConn.WriteMTU(low)
+	if err != nil {
+		return 0, fmt.Errorf("write mtu: %w", err)
+	}
+
+	return low, nil
+}
+
+// probe writes probes with padding in the size, and returns if any of them is replied.
+func (c *FrameConn) probe(conn *FakeTCPConn, size int) (bool, error) {
+	if size < 0 {
+		size = 0
+	}
+
+	for i := 0; i < maxProbes; i++ {
+		id := atomic.AddUint32(&probeId, 1)
+
+		b, err := EncodeFrame(&Frame{
+			Version: c.Version(),
+			Type:    FrameTypeProbe,
+			FlowId:  id,
+			Payload: make([]byte, size),
+		})
+		if err != nil {
+			return false, fmt.Errorf("encode frame: %w", err)
+		}
+
+		_, err = conn.writeDF(b)
+		if err != nil {
+			return false, fmt.Errorf("write probe: %w", err)
+		}
+
+		timer := time.NewTimer(probeTimeout)
+	wait:
+		for {
+			select {
+			case reply := <-c.probes:
+				// Replies of earlier probes are late and discarded
+				if reply == id {
+					timer.Stop()
+					return true, nil
+				}
+			case <-timer.C:
+				break wait
+			}
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,28 @@
+package pcap
+
+import (
+	"github.com/google/gopacket/layers"
+	"net"
+)
+
+// IsMulticast returns if the IP is a multicast address or the limited broadcast address, whose packets are delivered
+// to all hosts in the segment instead of being routed.
+func IsMulticast(ip net.IP) bool {
+	return ip.IsMulticast() || ip.Equal(net.IPv4bcast)
+}
+
+// MulticastHardwareAddr returns the hardware address which packets to the multicast or broadcast IP are sent to.
+func MulticastHardwareAddr(ip net.IP) net.HardwareAddr {
+	ip4 := ip.To4()
+	if ip4 != nil {
+		if ip4.Equal(net.IPv4bcast) {
+			return layers.EthernetBroadcast
+		}
+
+		// RFC 1112
+		return net.HardwareAddr{0x01, 0x00, 0x5e, ip4[1] & 0x7f, ip4[2], ip4[3]}
+	}
+
+	// RFC 2464
+	return net.HardwareAddr{0x33, 0x33, ip[12], ip[13], ip[14], ip[15]}
+}
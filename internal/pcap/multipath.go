@@ -0,0 +1,263 @@
+package pcap
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MultipathMode describes how frames are transmitted across paths.
+type MultipathMode int
+
+const (
+	// MultipathModeStripe describes each frame is transmitted over one of the paths in turn, which increases the
+	// bandwidth.
+	MultipathModeStripe MultipathMode = iota
+	// MultipathModeDuplicate describes each frame is transmitted over all paths, and duplicates are dropped by the
+	// peer, which reduces the loss.
+	MultipathModeDuplicate
+)
+
+func (mode MultipathMode) String() string {
+	switch mode {
+	case MultipathModeStripe:
+		return "stripe"
+	case MultipathModeDuplicate:
+		return "duplicate"
+	default:
+		return ""
+	}
+}
+
+// ParseMultipathMode returns the multipath mode of the name.
+func ParseMultipathMode(s string) (MultipathMode, error) {
+	switch s {
+	case "", "stripe":
+		return MultipathModeStripe, nil
+	case "duplicate":
+		return MultipathModeDuplicate, nil
+	default:
+		return 0, fmt.Errorf("mode %s not support", s)
+	}
+}
+
+// multipathWindow is the number of latest sequences remembered in a session for dropping duplicates.
+const multipathWindow = 4096
+
+// keepMultipathSessions is the duration after which a session without frames may be removed.
+const keepMultipathSessions = 2 * time.Minute
+
+// multipathSession describes sequences received in a session of multipath.
+type multipathSession struct {
+	max      uint32
+	seqs     [multipathWindow]uint32
+	valid    [multipathWindow]bool
+	lastSeen time.Time
+}
+
+var (
+	multipathLock     sync.Mutex
+	multipathSessions = make(map[uint32]*multipathSession)
+)
+
+// isDuplicated returns if the sequence is received in the session before, or is too old to be told.
+func isDuplicated(session, seq uint32) bool {
+	multipathLock.Lock()
+	defer multipathLock.Unlock()
+
+	now := time.Now()
+
+	s, ok := multipathSessions[session]
+	if !ok {
+		for key, s := range multipathSessions {
+			if now.Sub(s.lastSeen) > keepMultipathSessions {
+				delete(multipathSessions, key)
+			}
+		}
+
+		s = &multipathSession{max: seq}
+		multipathSessions[session] = s
+	}
+	s.lastSeen = now
+
+	if int32(seq-s.max) > 0 {
+		s.max = seq
+	} else if s.max-seq >= multipathWindow {
+		return true
+	}
+
+	i := seq % multipathWindow
+	if s.valid[i] && s.seqs[i] == seq {
+		return true
+	}
+	s.seqs[i] = seq
+	s.valid[i] = true
+
+	return false
+}
+
+type multipathResult struct {
+	b   []byte
+	err error
+}
+
+// MultipathConn is a connection over several paths to the same peer. Each write sends a frame with a sequence in the
+// session over the paths by the mode, and reads return packets from any path.
+type MultipathConn struct {
+	paths     []*FrameConn
+	mode      MultipathMode
+	session   uint32
+	seq       uint32
+	next      uint32
+	in        chan multipathResult
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMultipathConn returns a new multipath connection over the paths, and starts reading from them.
+func NewMultipathConn(paths []*FrameConn, mode MultipathMode) (*MultipathConn, error) {
+	if len(paths) <= 0 {
+		return nil, errors.New("missing paths")
+	}
+
+	b := make([]byte, 4)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, fmt.Errorf("generate session: %w", err)
+	}
+
+	c := &MultipathConn{
+		paths:   paths,
+		mode:    mode,
+		session: binary.BigEndian.Uint32(b),
+		in:      make(chan multipathResult, 1000),
+		closed:  make(chan struct{}),
+	}
+	for _, path := range paths {
+		go c.read(path)
+	}
+
+	return c, nil
+}
+
+func (c *MultipathConn) read(path *FrameConn) {
+	for {
+		b := make([]byte, IPv4MaxSize)
+		n, err := path.Read(b)
+
+		select {
+		case <-c.closed:
+			return
+		case c.in <- multipathResult{b: b[:n], err: err}:
+		}
+	}
+}
+
+// Paths returns the paths of the connection.
+func (c *MultipathConn) Paths() []*FrameConn {
+	return c.paths
+}
+
+func (c *MultipathConn) Read(b []byte) (n int, err error) {
+	select {
+	case <-c.closed:
+		return 0, errors.New("closed")
+	case result := <-c.in:
+		if result.err != nil {
+			return 0, result.err
+		}
+
+		return copy(b, result.b), nil
+	}
+}
+
+func (c *MultipathConn) Write(b []byte) (n int, err error) {
+	seq := atomic.AddUint32(&c.seq, 1)
+
+	switch c.mode {
+	case MultipathModeStripe:
+		path := c.paths[atomic.AddUint32(&c.next, 1)%uint32(len(c.paths))]
+
+		return path.WriteMultipath(c.session, seq, b)
+	case MultipathModeDuplicate:
+		// Succeed if any path succeeds
+		sent := false
+		for _, path := range c.paths {
+			_, err = path.WriteMultipath(c.session, seq, b)
+			if err != nil {
+				logger.Verbosef("Write to path %s: %v\n", path.LocalAddr(), err)
+				continue
+			}
+			sent = true
+		}
+		if !sent {
+			return 0, err
+		}
+
+		return len(b), nil
+	default:
+		return 0, fmt.Errorf("mode %s not support", c.mode)
+	}
+}
+
+func (c *MultipathConn) Close() error {
+	var err error
+
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		for _, path := range c.paths {
+			e := path.Close()
+			if e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+
+	return err
+}
+
+func (c *MultipathConn) LocalAddr() net.Addr {
+	return c.paths[0].LocalAddr()
+}
+
+func (c *MultipathConn) RemoteAddr() net.Addr {
+	return c.paths[0].RemoteAddr()
+}
+
+func (c *MultipathConn) SetDeadline(t time.Time) error {
+	for _, path := range c.paths {
+		err := path.SetDeadline(t)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *MultipathConn) SetReadDeadline(t time.Time) error {
+	for _, path := range c.paths {
+		err := path.SetReadDeadline(t)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *MultipathConn) SetWriteDeadline(t time.Time) error {
+	for _, path := range c.paths {
+		err := path.SetWriteDeadline(t)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
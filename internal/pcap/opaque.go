@@ -0,0 +1,101 @@
+package pcap
+
+import (
+	"encoding/binary"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// LayerTypeOpaque is the layer type of IP protocols carried opaquely.
+var LayerTypeOpaque = gopacket.RegisterLayerType(2001, gopacket.LayerTypeMetadata{
+	Name:    "Opaque",
+	Decoder: gopacket.DecodeFunc(decodeOpaque),
+})
+
+// Opaque is the transport layer of an IP protocol other than TCP, UDP and ICMP, like GRE, ESP, SCTP and OSPF. Its
+// contents are carried as is, and it is mapped in NAT by the protocol and IP addresses only.
+type Opaque struct {
+	layers.BaseLayer
+	Protocol layers.IPProtocol
+}
+
+// LayerType returns the layer type of the opaque layer.
+func (o *Opaque) LayerType() gopacket.LayerType {
+	return LayerTypeOpaque
+}
+
+// SerializeTo writes the contents of the opaque layer.
+func (o *Opaque) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	bytes, err := b.PrependBytes(len(o.Contents))
+	if err != nil {
+		return err
+	}
+	copy(bytes, o.Contents)
+
+	return nil
+}
+
+func decodeOpaque(data []byte, p gopacket.PacketBuilder) error {
+	p.AddLayer(&Opaque{BaseLayer: layers.BaseLayer{Contents: data}})
+
+	return nil
+}
+
+// isOpaque returns if the IP protocol is carried opaquely. IPv6 extension headers, which are followed by other
+// headers, are not.
+func isOpaque(protocol layers.IPProtocol) bool {
+	switch protocol {
+	case layers.IPProtocolTCP, layers.IPProtocolUDP, layers.IPProtocolICMPv4, layers.IPProtocolICMPv6,
+		layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Routing, layers.IPProtocolIPv6Fragment,
+		layers.IPProtocolIPv6Destination, layers.IPProtocolNoNextHeader:
+		return false
+	default:
+		return true
+	}
+}
+
+// parseOpaque returns the opaque layer of the packet if its IP protocol is carried opaquely. Fragments are not, as they
+// are handled in defragmentation.
+func parseOpaque(packet gopacket.Packet, networkLayer gopacket.Layer) (*Opaque, bool) {
+	if isFragment(networkLayer) {
+		return nil, false
+	}
+
+	var protocol layers.IPProtocol
+	switch t := networkLayer.(type) {
+	case *layers.IPv4:
+		protocol = t.Protocol
+	case *layers.IPv6:
+		protocol = ipv6NextHeader(t)
+	default:
+		return nil, false
+	}
+	if !isOpaque(protocol) {
+		return nil, false
+	}
+
+	return &Opaque{
+		BaseLayer: layers.BaseLayer{Contents: networkLayer.LayerPayload()},
+		Protocol:  protocol,
+	}, true
+}
+
+// isFragment returns if the network layer itself is a fragment. Fragment layers decoded from payloads, like packets
+// tunneled in GRE, are not taken into account, and so are atomic fragments in IPv6 whose offset is 0 without more
+// fragments.
+func isFragment(networkLayer gopacket.Layer) bool {
+	switch t := networkLayer.(type) {
+	case *layers.IPv4:
+		return t.Flags&layers.IPv4MoreFragments != 0 || t.FragOffset != 0
+	case *layers.IPv6:
+		if ipv6NextHeader(t) != layers.IPProtocolIPv6Fragment || len(t.Payload) < 8 {
+			return false
+		}
+
+		// Fragment offset and M flag
+		return binary.BigEndian.Uint16(t.Payload[2:])&0xfff9 != 0
+	default:
+		return false
+	}
+}
@@ -0,0 +1,337 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// rateFrameSize is the size of the payload of a rate frame, which consists of flags in 1 Byte, the delivery rate in
+	// Bytes per second, the timestamp and the echoed timestamp of the peer in milliseconds, in 4 Bytes each.
+	rateFrameSize = 13
+	// ackInterval is the min interval of rate frames.
+	ackInterval = 25 * time.Millisecond
+	// rateFlagPacing is the flag of rate frames from a pacing peer, which requests rate frames in reply.
+	rateFlagPacing = 0x01
+
+	// startupGain is the gain of pacing in startup, which doubles the delivery rate each round.
+	startupGain = 2.885
+	// bwRounds is the number of rounds the max delivery rate is kept.
+	bwRounds = 10
+	// minRTTWindow is the duration the min RTT is kept.
+	minRTTWindow = 10 * time.Second
+	// minRound is the min duration of a round, used before RTT is measured and for short paths.
+	minRound = 50 * time.Millisecond
+	// minPacingRate is the min rate of pacing in Bytes per second.
+	minPacingRate = 64 * 1024
+	// minQueueDelay and maxQueueDelay bound the delay of frames waiting for pacing, frames waiting longer are dropped.
+	minQueueDelay = 10 * time.Millisecond
+	maxQueueDelay = 200 * time.Millisecond
+)
+
+// probeGains are gains of pacing in cycles of probing bandwidth, which probe for more bandwidth in a round and drain
+// the queue built in the next round.
+var probeGains = [...]float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+// pacerState describes the state of a pacer.
+type pacerState int
+
+const (
+	pacerStateStartup pacerState = iota
+	pacerStateDrain
+	pacerStateProbeBW
+)
+
+func (s pacerState) String() string {
+	switch s {
+	case pacerStateStartup:
+		return "startup"
+	case pacerStateDrain:
+		return "drain"
+	case pacerStateProbeBW:
+		return "probe-bw"
+	default:
+		return ""
+	}
+}
+
+var (
+	isPacing bool
+
+	// paceDropped is the number of frames dropped in pacing for waiting too long.
+	paceDropped uint64
+)
+
+// SetPacing sets if frames are paced by a congestion controller inspired by BBR. If pacing is enabled, the peer reports
+// the delivery rate it measures and echoes timestamps in rate frames, and frames are sent at a rate around the max
+// delivery rate recently measured, so a congested uplink builds no queue. Frames which would wait too long are
+// dropped, as if they were lost in the queue. It should be called before any connection is established.
+func SetPacing(pacing bool) {
+	isPacing = pacing
+}
+
+// PaceDropped returns the number of frames dropped in pacing in all connections.
+func PaceDropped() uint64 {
+	return atomic.LoadUint64(&paceDropped)
+}
+
+// rateSample describes a delivery rate reported by the peer.
+type rateSample struct {
+	rate float64
+	time time.Time
+}
+
+// pacer describes the state of pacing and of measuring the delivery rate of a connection.
+type pacer struct {
+	lock  sync.Mutex
+	start time.Time
+
+	// Measuring of frames received
+	trainStart time.Time
+	trainLast  time.Time
+	trainBytes int
+	trainCount int
+	lastAck    time.Time
+	peerTS     uint32
+	peerTSTime time.Time
+	peerPacing bool
+
+	// Pacing of frames written
+	state      pacerState
+	samples    []rateSample
+	bw         float64
+	minRTT     time.Duration
+	minRTTTime time.Time
+	roundStart time.Time
+	fullBW     float64
+	fullRounds int
+	cycle      int
+	next       time.Time
+}
+
+func newPacer() *pacer {
+	now := time.Now()
+
+	return &pacer{
+		start:      now,
+		roundStart: now,
+	}
+}
+
+// timestamp returns the timestamp of the time in milliseconds since the pacer starts, which is never 0.
+func (p *pacer) timestamp(t time.Time) uint32 {
+	return uint32(t.Sub(p.start)/time.Millisecond) + 1
+}
+
+// round returns the duration of a round. The lock must be held.
+func (p *pacer) round() time.Duration {
+	if p.minRTT < minRound {
+		return minRound
+	}
+
+	return p.minRTT
+}
+
+// gain returns the gain of pacing in the current state. The lock must be held.
+func (p *pacer) gain() float64 {
+	switch p.state {
+	case pacerStateStartup:
+		return startupGain
+	case pacerStateDrain:
+		return 1 / startupGain
+	default:
+		return probeGains[p.cycle]
+	}
+}
+
+// receive counts a frame of the size received from the peer.
+func (p *pacer) receive(size int) {
+	now := time.Now()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	// The first frame of a train only marks its start, as the rate is measured by the dispersion of the train
+	if p.trainCount <= 0 {
+		p.trainStart = now
+	} else {
+		p.trainBytes = p.trainBytes + size
+	}
+	p.trainLast = now
+	p.trainCount++
+}
+
+// ack returns the payload of a rate frame if it is time to report to the peer, nil otherwise.
+func (p *pacer) ack() []byte {
+	now := time.Now()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !isPacing && !p.peerPacing {
+		return nil
+	}
+	if now.Sub(p.lastAck) < ackInterval {
+		return nil
+	}
+	p.lastAck = now
+
+	var rate uint32
+	if d := p.trainLast.Sub(p.trainStart); p.trainCount >= 2 && d >= time.Millisecond {
+		r := float64(p.trainBytes) / d.Seconds()
+		if r > float64(^uint32(0)) {
+			r = float64(^uint32(0))
+		}
+		rate = uint32(r)
+	}
+	p.trainBytes, p.trainCount = 0, 0
+
+	var echo uint32
+	if p.peerTS != 0 {
+		// The time the timestamp is held is added, so the peer measures the RTT without it
+		echo = p.peerTS + uint32(now.Sub(p.peerTSTime)/time.Millisecond)
+	}
+
+	b := make([]byte, rateFrameSize)
+	if isPacing {
+		b[0] = rateFlagPacing
+	}
+	binary.BigEndian.PutUint32(b[1:], rate)
+	binary.BigEndian.PutUint32(b[5:], p.timestamp(now))
+	binary.BigEndian.PutUint32(b[9:], echo)
+
+	return b
+}
+
+// handleRate updates the state of pacing by a rate frame from the peer.
+func (p *pacer) handleRate(payload []byte) error {
+	if len(payload) < rateFrameSize {
+		return errors.New("missing rate")
+	}
+
+	now := time.Now()
+	flags := payload[0]
+	rate := float64(binary.BigEndian.Uint32(payload[1:]))
+	ts := binary.BigEndian.Uint32(payload[5:])
+	echo := binary.BigEndian.Uint32(payload[9:])
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.peerPacing = flags&rateFlagPacing != 0
+	p.peerTS, p.peerTSTime = ts, now
+	if !isPacing {
+		return nil
+	}
+
+	// RTT
+	if echo != 0 {
+		if d := p.timestamp(now) - echo; d < 1<<31 {
+			rtt := time.Duration(d) * time.Millisecond
+			if p.minRTT <= 0 || rtt <= p.minRTT || now.Sub(p.minRTTTime) > minRTTWindow {
+				p.minRTT, p.minRTTTime = rtt, now
+			}
+		}
+	}
+
+	// Max delivery rate in recent rounds
+	if rate > 0 {
+		p.samples = append(p.samples, rateSample{rate: rate, time: now})
+	}
+	window := bwRounds * p.round()
+	i := 0
+	for i < len(p.samples) && now.Sub(p.samples[i].time) > window {
+		i++
+	}
+	p.samples = p.samples[i:]
+	p.bw = 0
+	for _, sample := range p.samples {
+		if sample.rate > p.bw {
+			p.bw = sample.rate
+		}
+	}
+
+	// Rounds
+	if now.Sub(p.roundStart) < p.round() {
+		return nil
+	}
+	p.roundStart = now
+	state := p.state
+	switch p.state {
+	case pacerStateStartup:
+		// The pipe is full once the delivery rate stops growing in 3 rounds
+		if p.bw >= p.fullBW*1.25 {
+			p.fullBW, p.fullRounds = p.bw, 0
+		} else if p.bw > 0 {
+			p.fullRounds++
+		}
+		if p.fullRounds >= 3 {
+			p.state = pacerStateDrain
+		}
+	case pacerStateDrain:
+		p.state = pacerStateProbeBW
+		p.cycle = 0
+	default:
+		p.cycle = (p.cycle + 1) % len(probeGains)
+	}
+	if p.state != state {
+		logger.Verbosef("Pace in %s at %.0f Bytes/s with RTT %s\n", p.state, p.bw, p.minRTT)
+	}
+
+	return nil
+}
+
+// pace returns the duration to wait before a frame of the size is written, and false if the frame should be dropped
+// as it would wait too long.
+func (p *pacer) pace(size int) (time.Duration, bool) {
+	now := time.Now()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	// Frames are not paced before the delivery rate is measured
+	if p.bw <= 0 {
+		return 0, true
+	}
+
+	rate := p.bw * p.gain()
+	if rate < minPacingRate {
+		rate = minPacingRate
+	}
+
+	if p.next.Before(now) {
+		p.next = now
+	}
+	wait := p.next.Sub(now)
+
+	maxDelay := p.minRTT
+	if maxDelay < minQueueDelay {
+		maxDelay = minQueueDelay
+	} else if maxDelay > maxQueueDelay {
+		maxDelay = maxQueueDelay
+	}
+	if wait > maxDelay {
+		atomic.AddUint64(&paceDropped, 1)
+		return 0, false
+	}
+	p.next = p.next.Add(time.Duration(float64(size) / rate * float64(time.Second)))
+
+	return wait, true
+}
+
+// writeRate writes a rate frame if it is time to report to the peer and the negotiated version supports.
+func (c *FrameConn) writeRate() error {
+	if c.Version() < PacingFrameVersion {
+		return nil
+	}
+
+	b := c.pacer.ack()
+	if b == nil {
+		return nil
+	}
+
+	return c.writeFrame(FrameTypeRate, 0, b)
+}
@@ -14,7 +14,7 @@ type ConnPacket struct {
 	// Packet is a packet.
 	Packet gopacket.Packet
 	// Conn is the connection of the packet.
-	Conn *RawConn
+	Conn PacketConn
 }
 
 // ConnBytes describes an array of bytes and its connection.
@@ -35,13 +35,18 @@ type NATGuide struct {
 
 // PacketIndicator indicates a packet.
 type PacketIndicator struct {
-	packet           gopacket.Packet
-	linkLayer        gopacket.Layer
-	networkLayer     gopacket.Layer
-	transportLayer   gopacket.Layer
-	icmpv4Indicator  *ICMPv4Indicator
-	applicationLayer gopacket.ApplicationLayer
-	dnsIndicator     *DNSIndicator
+	packet            gopacket.Packet
+	linkLayer         gopacket.Layer
+	dot1qLayer        *layers.Dot1Q
+	pppoeLayer        *layers.PPPoE
+	pppLayer          *layers.PPP
+	networkLayer      gopacket.Layer
+	ipv6FragmentLayer *layers.IPv6Fragment
+	transportLayer    gopacket.Layer
+	icmpv4Indicator   *ICMPv4Indicator
+	icmpv6Indicator   *ICMPv6Indicator
+	applicationLayer  gopacket.ApplicationLayer
+	dnsIndicator      *DNSIndicator
 }
 
 // LinkLayer returns the link layer.
@@ -62,7 +67,7 @@ func (indicator *PacketIndicator) SrcHardwareAddr() net.HardwareAddr {
 	case layers.LayerTypeEthernet:
 		return indicator.linkLayer.(*layers.Ethernet).SrcMAC
 	default:
-		panic(fmt.Errorf("link layer type %s not support", t))
+		panic(NewError(ErrUnsupportedLayer, "link layer type %s not support", t))
 	}
 }
 
@@ -74,10 +79,34 @@ func (indicator *PacketIndicator) DstHardwareAddr() net.HardwareAddr {
 	case layers.LayerTypeEthernet:
 		return indicator.linkLayer.(*layers.Ethernet).DstMAC
 	default:
-		panic(fmt.Errorf("link layer type %s not support", t))
+		panic(NewError(ErrUnsupportedLayer, "link layer type %s not support", t))
 	}
 }
 
+// Dot1QLayer returns the 802.1Q layer, nil if the packet is not tagged.
+func (indicator *PacketIndicator) Dot1QLayer() *layers.Dot1Q {
+	return indicator.dot1qLayer
+}
+
+// PPPoELayer returns the PPPoE layer, nil if the packet is not in a PPPoE session.
+func (indicator *PacketIndicator) PPPoELayer() *layers.PPPoE {
+	return indicator.pppoeLayer
+}
+
+// PPPLayer returns the PPP layer in the PPPoE session, nil if the packet is not in a PPPoE session.
+func (indicator *PacketIndicator) PPPLayer() *layers.PPP {
+	return indicator.pppLayer
+}
+
+// VLAN returns the VLAN identifier, 0 if the packet is not tagged.
+func (indicator *PacketIndicator) VLAN() uint16 {
+	if indicator.dot1qLayer == nil {
+		return 0
+	}
+
+	return indicator.dot1qLayer.VLANIdentifier
+}
+
 // NetworkLayer returns the network layer.
 func (indicator *PacketIndicator) NetworkLayer() gopacket.Layer {
 	return indicator.networkLayer
@@ -92,6 +121,20 @@ func (indicator *PacketIndicator) IPv4Layer() *layers.IPv4 {
 	return nil
 }
 
+// IPv6Layer returns the IPv6 layer.
+func (indicator *PacketIndicator) IPv6Layer() *layers.IPv6 {
+	if indicator.NetworkLayer().LayerType() == layers.LayerTypeIPv6 {
+		return indicator.networkLayer.(*layers.IPv6)
+	}
+
+	return nil
+}
+
+// IPv6FragmentLayer returns the IPv6 fragment layer.
+func (indicator *PacketIndicator) IPv6FragmentLayer() *layers.IPv6Fragment {
+	return indicator.ipv6FragmentLayer
+}
+
 // ARPLayer returns the ARP layer.
 func (indicator *PacketIndicator) ARPLayer() *layers.ARP {
 	if indicator.NetworkLayer().LayerType() == layers.LayerTypeARP {
@@ -106,10 +149,12 @@ func (indicator *PacketIndicator) SrcIP() net.IP {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
 		return indicator.IPv4Layer().SrcIP
+	case layers.LayerTypeIPv6:
+		return indicator.IPv6Layer().SrcIP
 	case layers.LayerTypeARP:
 		return indicator.ARPLayer().SourceProtAddress
 	default:
-		panic(fmt.Errorf("network layer type %s not support", t))
+		panic(NewError(ErrUnsupportedLayer, "network layer type %s not support", t))
 	}
 }
 
@@ -118,30 +163,40 @@ func (indicator *PacketIndicator) DstIP() net.IP {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
 		return indicator.IPv4Layer().DstIP
+	case layers.LayerTypeIPv6:
+		return indicator.IPv6Layer().DstIP
 	case layers.LayerTypeARP:
 		return indicator.ARPLayer().DstProtAddress
 	default:
-		panic(fmt.Errorf("network layer type %s not support", t))
+		panic(NewError(ErrUnsupportedLayer, "network layer type %s not support", t))
 	}
 }
 
-// TTL returns the TTL.
+// TTL returns the TTL, or the hop limit in IPv6.
 func (indicator *PacketIndicator) TTL() uint8 {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
 		return indicator.IPv4Layer().TTL
+	case layers.LayerTypeIPv6:
+		return indicator.IPv6Layer().HopLimit
 	default:
-		panic(fmt.Errorf("network layer type %s not support", t))
+		panic(NewError(ErrUnsupportedLayer, "network layer type %s not support", t))
 	}
 }
 
-// Id returns the Id in the network layer.
-func (indicator *PacketIndicator) NetworkId() uint16 {
+// NetworkId returns the Id in the network layer, or the identification in the IPv6 fragment layer.
+func (indicator *PacketIndicator) NetworkId() uint32 {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
-		return indicator.IPv4Layer().Id
+		return uint32(indicator.IPv4Layer().Id)
+	case layers.LayerTypeIPv6:
+		if indicator.ipv6FragmentLayer == nil {
+			return 0
+		}
+
+		return indicator.ipv6FragmentLayer.Identification
 	default:
-		panic(fmt.Errorf("network layer type %s not support", t))
+		panic(NewError(ErrUnsupportedLayer, "network layer type %s not support", t))
 	}
 }
 
@@ -156,8 +211,14 @@ func (indicator *PacketIndicator) IsFrag() bool {
 		}
 
 		return ipv4Layer.FragOffset != 0
+	case layers.LayerTypeIPv6:
+		if indicator.ipv6FragmentLayer == nil {
+			return false
+		}
+
+		return indicator.ipv6FragmentLayer.MoreFragments || indicator.ipv6FragmentLayer.FragmentOffset != 0
 	default:
-		panic(fmt.Errorf("network layer type %s not support", t))
+		panic(NewError(ErrUnsupportedLayer, "network layer type %s not support", t))
 	}
 }
 
@@ -166,8 +227,14 @@ func (indicator *PacketIndicator) FragOffset() uint16 {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
 		return indicator.IPv4Layer().FragOffset
+	case layers.LayerTypeIPv6:
+		if indicator.ipv6FragmentLayer == nil {
+			return 0
+		}
+
+		return indicator.ipv6FragmentLayer.FragmentOffset
 	default:
-		panic(fmt.Errorf("network layer type %s not support", t))
+		panic(NewError(ErrUnsupportedLayer, "network layer type %s not support", t))
 	}
 }
 
@@ -176,8 +243,14 @@ func (indicator *PacketIndicator) MoreFragments() bool {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
 		return indicator.IPv4Layer().Flags&layers.IPv4MoreFragments != 0
+	case layers.LayerTypeIPv6:
+		if indicator.ipv6FragmentLayer == nil {
+			return false
+		}
+
+		return indicator.ipv6FragmentLayer.MoreFragments
 	default:
-		panic(fmt.Errorf("network layer type %s not support", t))
+		panic(NewError(ErrUnsupportedLayer, "network layer type %s not support", t))
 	}
 }
 
@@ -190,12 +263,51 @@ func (indicator *PacketIndicator) TransportProtocol() gopacket.LayerType {
 			panic(err)
 		}
 
+		return p
+	case layers.LayerTypeIPv6:
+		p, err := parseIPProtocol(indicator.NextHeader())
+		if err != nil {
+			panic(err)
+		}
+
 		return p
 	default:
-		panic(fmt.Errorf("network layer type %s not support", t))
+		panic(NewError(ErrUnsupportedLayer, "network layer type %s not support", t))
 	}
 }
 
+// NextHeader returns the next header of the IPv6 layer, hop-by-hop options and the IPv6 fragment layer are skipped.
+func (indicator *PacketIndicator) NextHeader() layers.IPProtocol {
+	if indicator.ipv6FragmentLayer != nil {
+		return indicator.ipv6FragmentLayer.NextHeader
+	}
+
+	return ipv6NextHeader(indicator.IPv6Layer())
+}
+
+// ipv6NextHeader returns the next header of the IPv6 layer, or of its hop-by-hop options if any, which gopacket decodes
+// as a part of the IPv6 layer.
+func ipv6NextHeader(layer *layers.IPv6) layers.IPProtocol {
+	if layer.HopByHop != nil {
+		return layer.HopByHop.NextHeader
+	}
+
+	return layer.NextHeader
+}
+
+// setIPv6NextHeader sets the next header of the IPv6 layer, or of its hop-by-hop options if any, which are serialized
+// in front of other headers. Hop-by-hop options are copied, as they may be shared with the layer it is copied from.
+func setIPv6NextHeader(layer *layers.IPv6, nextHeader layers.IPProtocol) {
+	if layer.HopByHop == nil {
+		layer.NextHeader = nextHeader
+		return
+	}
+
+	hopByHop := *layer.HopByHop
+	hopByHop.NextHeader = nextHeader
+	layer.HopByHop = &hopByHop
+}
+
 // TransportLayer returns the transport layer.
 func (indicator *PacketIndicator) TransportLayer() gopacket.Layer {
 	return indicator.transportLayer
@@ -219,11 +331,25 @@ func (indicator *PacketIndicator) UDPLayer() *layers.UDP {
 	return nil
 }
 
+// OpaqueLayer returns the opaque layer.
+func (indicator *PacketIndicator) OpaqueLayer() *Opaque {
+	if indicator.TransportLayer().LayerType() == LayerTypeOpaque {
+		return indicator.transportLayer.(*Opaque)
+	}
+
+	return nil
+}
+
 // ICMPv4Indicator returns the ICMPv4 indicator.
 func (indicator *PacketIndicator) ICMPv4Indicator() *ICMPv4Indicator {
 	return indicator.icmpv4Indicator
 }
 
+// ICMPv6Indicator returns the ICMPv6 indicator.
+func (indicator *PacketIndicator) ICMPv6Indicator() *ICMPv6Indicator {
+	return indicator.icmpv6Indicator
+}
+
 // SrcPort returns the source port.
 func (indicator *PacketIndicator) SrcPort() uint16 {
 	switch t := indicator.TransportLayer().LayerType(); t {
@@ -232,7 +358,7 @@ func (indicator *PacketIndicator) SrcPort() uint16 {
 	case layers.LayerTypeUDP:
 		return uint16(indicator.UDPLayer().SrcPort)
 	default:
-		panic(fmt.Errorf("transport layer type %s not support", t))
+		panic(NewError(ErrUnsupportedLayer, "transport layer type %s not support", t))
 	}
 }
 
@@ -244,7 +370,7 @@ func (indicator *PacketIndicator) DstPort() uint16 {
 	case layers.LayerTypeUDP:
 		return uint16(indicator.UDPLayer().DstPort)
 	default:
-		panic(fmt.Errorf("transport layer type %s not support", t))
+		panic(NewError(ErrUnsupportedLayer, "transport layer type %s not support", t))
 	}
 }
 
@@ -254,7 +380,7 @@ func (indicator *PacketIndicator) IsACK() bool {
 	case layers.LayerTypeTCP:
 		return indicator.TCPLayer().ACK
 	default:
-		panic(fmt.Errorf("transport layer type %s not support", t))
+		panic(NewError(ErrUnsupportedLayer, "transport layer type %s not support", t))
 	}
 }
 
@@ -264,7 +390,7 @@ func (indicator *PacketIndicator) IsRST() bool {
 	case layers.LayerTypeTCP:
 		return indicator.TCPLayer().RST
 	default:
-		panic(fmt.Errorf("transport layer type %s not support", t))
+		panic(NewError(ErrUnsupportedLayer, "transport layer type %s not support", t))
 	}
 }
 
@@ -274,7 +400,7 @@ func (indicator *PacketIndicator) IsSYN() bool {
 	case layers.LayerTypeTCP:
 		return indicator.TCPLayer().SYN
 	default:
-		panic(fmt.Errorf("transport layer type %s not support", t))
+		panic(NewError(ErrUnsupportedLayer, "transport layer type %s not support", t))
 	}
 }
 
@@ -284,10 +410,22 @@ func (indicator *PacketIndicator) IsFIN() bool {
 	case layers.LayerTypeTCP:
 		return indicator.TCPLayer().FIN
 	default:
-		panic(fmt.Errorf("transport layer type %s not support", t))
+		panic(NewError(ErrUnsupportedLayer, "transport layer type %s not support", t))
 	}
 }
 
+// IsICMPError returns if the packet is an ICMP error message, which is never replied with an ICMP error message.
+func (indicator *PacketIndicator) IsICMPError() bool {
+	if indicator.icmpv4Indicator != nil {
+		return !indicator.icmpv4Indicator.IsQuery()
+	}
+	if indicator.icmpv6Indicator != nil {
+		return indicator.icmpv6Indicator.ICMPv6Layer().TypeCode.Type() < 128
+	}
+
+	return false
+}
+
 // NATSrc returns the source used in NAT.
 func (indicator *PacketIndicator) NATSrc() net.Addr {
 	switch t := indicator.TransportLayer().LayerType(); t {
@@ -310,8 +448,18 @@ func (indicator *PacketIndicator) NATSrc() net.Addr {
 		}
 
 		return indicator.icmpv4Indicator.EmbSrc()
+	case LayerTypeOpaque:
+		return &addr.IPProtocolAddr{
+			IP:       indicator.SrcIP(),
+			Protocol: uint8(indicator.OpaqueLayer().Protocol),
+		}
+	case layers.LayerTypeICMPv6:
+		return &addr.ICMPQueryAddr{
+			IP: indicator.SrcIP(),
+			Id: indicator.icmpv6Indicator.Id(),
+		}
 	default:
-		panic(fmt.Errorf("transport layer type %s not support", t))
+		panic(NewError(ErrUnsupportedLayer, "transport layer type %s not support", t))
 	}
 }
 
@@ -337,8 +485,18 @@ func (indicator *PacketIndicator) NATDst() net.Addr {
 		}
 
 		return indicator.icmpv4Indicator.EmbDst()
+	case LayerTypeOpaque:
+		return &addr.IPProtocolAddr{
+			IP:       indicator.DstIP(),
+			Protocol: uint8(indicator.OpaqueLayer().Protocol),
+		}
+	case layers.LayerTypeICMPv6:
+		return &addr.ICMPQueryAddr{
+			IP: indicator.DstIP(),
+			Id: indicator.icmpv6Indicator.Id(),
+		}
 	default:
-		panic(fmt.Errorf("transport layer type %s not support", t))
+		panic(NewError(ErrUnsupportedLayer, "transport layer type %s not support", t))
 	}
 }
 
@@ -353,8 +511,10 @@ func (indicator *PacketIndicator) NATProtocol() gopacket.LayerType {
 		}
 
 		return indicator.icmpv4Indicator.EmbTransportLayer().LayerType()
+	case layers.LayerTypeICMPv6, LayerTypeOpaque:
+		return t
 	default:
-		panic(fmt.Errorf("transport layer type %s not support", t))
+		panic(NewError(ErrUnsupportedLayer, "transport layer type %s not support", t))
 	}
 }
 
@@ -386,8 +546,18 @@ func (indicator *PacketIndicator) Src() net.Addr {
 		}
 
 		return &net.IPAddr{IP: indicator.SrcIP()}
+	case LayerTypeOpaque:
+		return &addr.IPProtocolAddr{
+			IP:       indicator.SrcIP(),
+			Protocol: uint8(indicator.OpaqueLayer().Protocol),
+		}
+	case layers.LayerTypeICMPv6:
+		return &addr.ICMPQueryAddr{
+			IP: indicator.SrcIP(),
+			Id: indicator.icmpv6Indicator.Id(),
+		}
 	default:
-		panic(fmt.Errorf("transport layer type %s not support", t))
+		panic(NewError(ErrUnsupportedLayer, "transport layer type %s not support", t))
 	}
 }
 
@@ -419,8 +589,18 @@ func (indicator *PacketIndicator) Dst() net.Addr {
 		}
 
 		return &net.IPAddr{IP: indicator.DstIP()}
+	case LayerTypeOpaque:
+		return &addr.IPProtocolAddr{
+			IP:       indicator.DstIP(),
+			Protocol: uint8(indicator.OpaqueLayer().Protocol),
+		}
+	case layers.LayerTypeICMPv6:
+		return &addr.ICMPQueryAddr{
+			IP: indicator.DstIP(),
+			Id: indicator.icmpv6Indicator.Id(),
+		}
 	default:
-		panic(fmt.Errorf("transport layer type %s not support", t))
+		panic(NewError(ErrUnsupportedLayer, "transport layer type %s not support", t))
 	}
 }
 
@@ -435,11 +615,29 @@ func (indicator *PacketIndicator) NetworkPayload() []byte {
 		return nil
 	}
 
+	if indicator.ipv6FragmentLayer != nil {
+		return indicator.ipv6FragmentLayer.LayerPayload()
+	}
+
 	return indicator.NetworkLayer().LayerPayload()
 }
 
 // Payload returns the payload of transport layer, or layer contents in application layer.
 func (indicator *PacketIndicator) Payload() []byte {
+	// Payloads of TCP and UDP are taken from the transport layer as a whole, as they may be decoded as layers other
+	// than application layers, like VXLAN, or fail to decode, like DNS over TCP, and would be lost
+	if indicator.transportLayer != nil {
+		switch indicator.transportLayer.LayerType() {
+		case layers.LayerTypeTCP, layers.LayerTypeUDP:
+			payload := indicator.transportLayer.LayerPayload()
+			if len(payload) <= 0 {
+				return nil
+			}
+
+			return payload
+		}
+	}
+
 	if indicator.applicationLayer == nil {
 		return nil
 	}
@@ -449,7 +647,29 @@ func (indicator *PacketIndicator) Payload() []byte {
 
 // MTU returns the required MTU of the packet.
 func (indicator *PacketIndicator) MTU() int {
-	return len(indicator.NetworkLayer().LayerContents()) + len(indicator.NetworkPayload())
+	size := len(indicator.NetworkLayer().LayerContents()) + len(indicator.NetworkLayer().LayerPayload())
+	// Hop-by-hop options are decoded as a part of the IPv6 layer, but are neither in its contents nor in its payload
+	if ipv6Layer, ok := indicator.NetworkLayer().(*layers.IPv6); ok && ipv6Layer.HopByHop != nil {
+		size = size + len(ipv6Layer.HopByHop.LayerContents())
+	}
+
+	return size
+}
+
+// NetworkData returns the data of the packet from its network layer.
+func (indicator *PacketIndicator) NetworkData() []byte {
+	offset := 0
+	if indicator.linkLayer != nil {
+		offset = offset + len(indicator.linkLayer.LayerContents())
+	}
+	if indicator.dot1qLayer != nil {
+		offset = offset + len(indicator.dot1qLayer.LayerContents())
+	}
+	if indicator.pppoeLayer != nil {
+		offset = offset + len(indicator.pppoeLayer.LayerContents()) + len(indicator.pppLayer.LayerContents())
+	}
+
+	return indicator.packet.Data()[offset : offset+indicator.MTU()]
 }
 
 // Size returns the size of the packet.
@@ -460,12 +680,17 @@ func (indicator *PacketIndicator) Size() int {
 // ParsePacket parses a packet and returns a packet indicator.
 func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 	var (
-		linkLayer        gopacket.Layer
-		networkLayer     gopacket.Layer
-		transportLayer   gopacket.Layer
-		icmpv4Indicator  *ICMPv4Indicator
-		applicationLayer gopacket.ApplicationLayer
-		dnsIndicator     *DNSIndicator
+		linkLayer         gopacket.Layer
+		dot1qLayer        *layers.Dot1Q
+		pppoeLayer        *layers.PPPoE
+		pppLayer          *layers.PPP
+		networkLayer      gopacket.Layer
+		ipv6FragmentLayer *layers.IPv6Fragment
+		transportLayer    gopacket.Layer
+		icmpv4Indicator   *ICMPv4Indicator
+		icmpv6Indicator   *ICMPv6Indicator
+		applicationLayer  gopacket.ApplicationLayer
+		dnsIndicator      *DNSIndicator
 	)
 
 	// Parse packet
@@ -474,6 +699,15 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 		// Guess loopback
 		linkLayer = packet.Layer(layers.LayerTypeLoopback)
 	}
+	if layer := packet.Layer(layers.LayerTypeDot1Q); layer != nil {
+		dot1qLayer = layer.(*layers.Dot1Q)
+	}
+	if layer := packet.Layer(layers.LayerTypePPPoE); layer != nil {
+		pppoeLayer = layer.(*layers.PPPoE)
+	}
+	if layer := packet.Layer(layers.LayerTypePPP); layer != nil {
+		pppLayer = layer.(*layers.PPP)
+	}
 	networkLayer = packet.NetworkLayer()
 	if networkLayer == nil {
 		// Guess ARP
@@ -483,6 +717,7 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 		}
 
 		return &PacketIndicator{
+			dot1qLayer:       dot1qLayer,
 			networkLayer:     networkLayer,
 			transportLayer:   nil,
 			icmpv4Indicator:  nil,
@@ -490,17 +725,27 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 		}, nil
 	}
 	transportLayer = packet.TransportLayer()
-	if transportLayer == nil {
+	// Layers decoded from payloads of opaque protocols, like packets tunneled in GRE, are ignored
+	opaqueLayer, isOpaque := parseOpaque(packet, networkLayer)
+	if isOpaque {
+		transportLayer = opaqueLayer
+	} else if transportLayer == nil {
 		// Guess ICMPv4
 		transportLayer = packet.Layer(layers.LayerTypeICMPv4)
+		if transportLayer == nil {
+			// Guess ICMPv6
+			transportLayer = packet.Layer(layers.LayerTypeICMPv6)
+		}
 		if transportLayer == nil {
 			// Guess fragment
-			if packet.Layer(gopacket.LayerTypeFragment) == nil {
+			if !isFragment(networkLayer) {
 				return nil, errors.New("missing transport layer")
 			}
 		}
 	}
-	applicationLayer = packet.ApplicationLayer()
+	if !isOpaque {
+		applicationLayer = packet.ApplicationLayer()
+	}
 
 	// Parse link layer
 	if linkLayer != nil {
@@ -510,12 +755,34 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 		case layers.LayerTypeEthernet:
 			ethernetLayer := linkLayer.(*layers.Ethernet)
 
-			_, err := parseEthernetType(ethernetLayer.EthernetType)
+			ethernetType := ethernetLayer.EthernetType
+			if ethernetType == layers.EthernetTypeDot1Q {
+				if dot1qLayer == nil {
+					return nil, errors.New("missing dot1q layer")
+				}
+				ethernetType = dot1qLayer.Type
+			}
+			// Packets in PPPoE sessions carry IP in PPP
+			if ethernetType == layers.EthernetTypePPPoESession {
+				if pppoeLayer == nil || pppLayer == nil {
+					return nil, errors.New("missing pppoe layer")
+				}
+				switch pppLayer.PPPType {
+				case layers.PPPTypeIPv4:
+					ethernetType = layers.EthernetTypeIPv4
+				case layers.PPPTypeIPv6:
+					ethernetType = layers.EthernetTypeIPv6
+				default:
+					return nil, fmt.Errorf("ppp type %s not support", pppLayer.PPPType)
+				}
+			}
+
+			_, err := parseEthernetType(ethernetType)
 			if err != nil {
 				return nil, err
 			}
 		default:
-			return nil, fmt.Errorf("link layer type %s not support", t)
+			return nil, NewError(ErrUnsupportedLayer, "link layer type %s not support", t)
 		}
 	}
 
@@ -528,16 +795,40 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 		if err != nil {
 			return nil, err
 		}
+	case layers.LayerTypeIPv6:
+		ipv6Layer := networkLayer.(*layers.IPv6)
+
+		// Jumbograms, whose lengths are 0 in headers, are not supported, and gopacket does not separate hop-by-hop
+		// options from the payload of one without the jumbo payload option
+		if ipv6Layer.Length <= 0 {
+			return nil, errors.New("jumbogram not support")
+		}
+
+		nextHeader := ipv6NextHeader(ipv6Layer)
+		if nextHeader == layers.IPProtocolIPv6Fragment {
+			layer := packet.Layer(layers.LayerTypeIPv6Fragment)
+			if layer == nil {
+				return nil, errors.New("missing ipv6 fragment layer")
+			}
+			ipv6FragmentLayer = layer.(*layers.IPv6Fragment)
+
+			nextHeader = ipv6FragmentLayer.NextHeader
+		}
+
+		_, err := parseIPProtocol(nextHeader)
+		if err != nil {
+			return nil, err
+		}
 	case layers.LayerTypeARP:
 		break
 	default:
-		return nil, fmt.Errorf("network layer type %s not support", t)
+		return nil, NewError(ErrUnsupportedLayer, "network layer type %s not support", t)
 	}
 
 	// Parse transport layer
 	if transportLayer != nil {
 		switch t := transportLayer.LayerType(); t {
-		case layers.LayerTypeTCP, layers.LayerTypeUDP:
+		case layers.LayerTypeTCP, layers.LayerTypeUDP, LayerTypeOpaque:
 			break
 		case layers.LayerTypeICMPv4:
 			var err error
@@ -545,8 +836,17 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 			if err != nil {
 				return nil, fmt.Errorf("parse icmpv4 layer: %w", err)
 			}
+		case layers.LayerTypeICMPv6:
+			var err error
+			icmpv6Indicator, err = ParseICMPv6Layer(transportLayer.(*layers.ICMPv6))
+			if err != nil {
+				return nil, fmt.Errorf("parse icmpv6 layer: %w", err)
+			}
+
+			// Contents of ICMPv6 echo is not decoded as an application layer
+			applicationLayer = gopacket.Payload(icmpv6Indicator.Contents())
 		default:
-			return nil, fmt.Errorf("transport layer type %s not support", t)
+			return nil, NewError(ErrUnsupportedLayer, "transport layer type %s not support", t)
 		}
 	}
 
@@ -558,33 +858,53 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 	}
 
 	return &PacketIndicator{
-		packet:           packet,
-		linkLayer:        linkLayer,
-		networkLayer:     networkLayer,
-		transportLayer:   transportLayer,
-		icmpv4Indicator:  icmpv4Indicator,
-		applicationLayer: applicationLayer,
-		dnsIndicator:     dnsIndicator,
+		packet:            packet,
+		linkLayer:         linkLayer,
+		dot1qLayer:        dot1qLayer,
+		pppoeLayer:        pppoeLayer,
+		pppLayer:          pppLayer,
+		networkLayer:      networkLayer,
+		ipv6FragmentLayer: ipv6FragmentLayer,
+		transportLayer:    transportLayer,
+		icmpv4Indicator:   icmpv4Indicator,
+		icmpv6Indicator:   icmpv6Indicator,
+		applicationLayer:  applicationLayer,
+		dnsIndicator:      dnsIndicator,
 	}, nil
 }
 
 // ParseEmbPacket parses an embedded packet used in transmission between client and server without link layer.
 func ParseEmbPacket(contents []byte) (*PacketIndicator, error) {
-	// Guess network layer type
-	packet := gopacket.NewPacket(contents, layers.LayerTypeIPv4, gopacket.NoCopy)
-	networkLayer := packet.NetworkLayer()
-	if networkLayer == nil {
+	var packet gopacket.Packet
+
+	if len(contents) <= 0 {
 		return nil, errors.New("missing network layer")
 	}
-	if networkLayer.LayerType() != layers.LayerTypeIPv4 {
-		return nil, errors.New("network layer type not support")
-	}
-	switch networkLayer.(*layers.IPv4).Version {
+
+	// Guess network layer type by version
+	switch contents[0] >> 4 {
 	case 4:
-		break
+		packet = gopacket.NewPacket(contents, layers.LayerTypeIPv4, gopacket.NoCopy)
+	case 6:
+		packet = gopacket.NewPacket(contents, layers.LayerTypeIPv6, gopacket.NoCopy)
 	default:
 		return nil, errors.New("network layer type not support")
 	}
+	networkLayer := packet.NetworkLayer()
+	if networkLayer == nil {
+		return nil, errors.New("missing network layer")
+	}
+	// Embedded packets are always complete, so one shorter than the length in its header is malformed
+	switch t := networkLayer.(type) {
+	case *layers.IPv4:
+		if int(t.Length) > len(contents) {
+			return nil, fmt.Errorf("length %d out of range", t.Length)
+		}
+	case *layers.IPv6:
+		if 40+int(t.Length) > len(contents) {
+			return nil, fmt.Errorf("length %d out of range", t.Length)
+		}
+	}
 
 	// Parse packet
 	indicator, err := ParsePacket(packet)
@@ -616,7 +936,7 @@ func ParseRawPacket(contents []byte) (gopacket.Packet, error) {
 	}
 
 	if t := linkLayer.LayerType(); t != layers.LayerTypeEthernet {
-		return nil, fmt.Errorf("link layer type %s not support", t)
+		return nil, NewError(ErrUnsupportedLayer, "link layer type %s not support", t)
 	}
 
 	return packet, nil
@@ -664,7 +984,13 @@ func parseIPProtocol(protocol layers.IPProtocol) (gopacket.LayerType, error) {
 		return layers.LayerTypeUDP, nil
 	case layers.IPProtocolICMPv4:
 		return layers.LayerTypeICMPv4, nil
+	case layers.IPProtocolICMPv6:
+		return layers.LayerTypeICMPv6, nil
 	default:
+		if isOpaque(protocol) {
+			return LayerTypeOpaque, nil
+		}
+
 		return gopacket.LayerTypeZero, fmt.Errorf("ip protocol %s not support", protocol)
 	}
 }
@@ -673,9 +999,51 @@ func parseEthernetType(t layers.EthernetType) (gopacket.LayerType, error) {
 	switch t {
 	case layers.EthernetTypeIPv4:
 		return layers.LayerTypeIPv4, nil
+	case layers.EthernetTypeIPv6:
+		return layers.LayerTypeIPv6, nil
 	case layers.EthernetTypeARP:
 		return layers.LayerTypeARP, nil
 	default:
 		return gopacket.LayerTypeZero, fmt.Errorf("ethernet type %s not support", t)
 	}
 }
+
+// FlowHash returns a hash of the flow of the packet. Fragments, which may miss transport layers, are hashed by their
+// network flows only.
+func FlowHash(packet gopacket.Packet) uint64 {
+	networkLayer := packet.NetworkLayer()
+	if networkLayer == nil {
+		return 0
+	}
+
+	h := networkLayer.NetworkFlow().FastHash()
+
+	isFrag := packet.Layer(layers.LayerTypeIPv6Fragment) != nil
+	ipv4Layer, ok := networkLayer.(*layers.IPv4)
+	if ok {
+		isFrag = ipv4Layer.Flags&layers.IPv4MoreFragments != 0 || ipv4Layer.FragOffset != 0
+	}
+
+	transportLayer := packet.TransportLayer()
+	if transportLayer != nil && !isFrag {
+		h = h*31 + transportLayer.TransportFlow().FastHash()
+	}
+
+	return h
+}
+
+// EmbFlowHash returns a hash of the flow of the embedded packet, 0 if the packet cannot be parsed.
+func EmbFlowHash(contents []byte) uint64 {
+	if len(contents) <= 0 {
+		return 0
+	}
+
+	switch contents[0] >> 4 {
+	case 4:
+		return FlowHash(gopacket.NewPacket(contents, layers.LayerTypeIPv4, gopacket.DecodeOptions{Lazy: true, NoCopy: true}))
+	case 6:
+		return FlowHash(gopacket.NewPacket(contents, layers.LayerTypeIPv6, gopacket.DecodeOptions{Lazy: true, NoCopy: true}))
+	default:
+		return 0
+	}
+}
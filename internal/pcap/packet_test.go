@@ -0,0 +1,319 @@
+package pcap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	testClientIPv6 = net.ParseIP("fd00::2")
+	testServerIPv6 = net.ParseIP("2001:db8::2")
+	testRemoteIPv6 = net.ParseIP("2001:db8:1::1")
+)
+
+// testSourceConn returns a connection in memory from the client to a source, which captures packets from sources.
+func testSourceConn() *MemConn {
+	srcDev := NewDevice("eth1", []*net.IPNet{
+		{IP: net.IPv4(10, 0, 0, 1).To4(), Mask: net.CIDRMask(24, 32)},
+		{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(64, 128)},
+	}, testGatewayHW, false)
+	dstDev := NewDevice("source", nil, testServerHW, false)
+
+	return NewMemConn(srcDev, dstDev, layers.LinkTypeEthernet)
+}
+
+// testDualUpConn returns a connection in memory from the server to the gateway in both IPv4 and IPv6.
+func testDualUpConn() *MemConn {
+	srcDev := NewDevice("eth0", []*net.IPNet{
+		{IP: testServerIP, Mask: net.CIDRMask(24, 32)},
+		{IP: testServerIPv6, Mask: net.CIDRMask(64, 128)},
+	}, testServerHW, false)
+	dstDev := NewDevice("gateway", nil, testGatewayHW, false)
+
+	return NewMemConn(srcDev, dstDev, layers.LinkTypeEthernet)
+}
+
+// capture feeds the frame of layers to the connection and returns the captured packet with the data of its network
+// layer, which is what the client encapsulates.
+func capture(t *testing.T, conn *MemConn, l ...gopacket.SerializableLayer) (*PacketIndicator, []byte) {
+	networkLayer := l[0].(gopacket.NetworkLayer)
+	linkLayer, err := CreateEthernetLayer(testServerHW, testGatewayHW, 0, networkLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	network, err := Serialize(l...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Serialize(append([]gopacket.SerializableLayer{linkLayer}, l...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = conn.Feed(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := conn.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	indicator, err := ParsePacket(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(indicator.NetworkData(), network) {
+		t.Fatalf("encapsulated %x, expected %x", indicator.NetworkData(), network)
+	}
+
+	return indicator, network
+}
+
+// testTCPOptions returns TCP options of timestamps and SACK.
+func testTCPOptions() []layers.TCPOption {
+	return []layers.TCPOption{
+		{OptionType: layers.TCPOptionKindNop, OptionLength: 1},
+		{OptionType: layers.TCPOptionKindNop, OptionLength: 1},
+		{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: []byte{0, 0, 0, 1, 0, 0, 0, 2}},
+		{OptionType: layers.TCPOptionKindNop, OptionLength: 1},
+		{OptionType: layers.TCPOptionKindNop, OptionLength: 1},
+		{OptionType: layers.TCPOptionKindSACK, OptionLength: 10, OptionData: []byte{0, 0, 1, 0, 0, 0, 2, 0}},
+	}
+}
+
+func TestIPv4OptionsThroughEncapsulation(t *testing.T) {
+	srcConn := testSourceConn()
+	defer srcConn.Close()
+	upConn := testDualUpConn()
+	defer upConn.Close()
+
+	ipv4Options := []layers.IPv4Option{
+		// Record route
+		{OptionType: 7, OptionLength: 7, OptionData: []byte{4, 0, 0, 0, 0}},
+		// Router alert
+		{OptionType: 148, OptionLength: 4, OptionData: []byte{0, 0}},
+		{OptionType: 0, OptionLength: 1},
+	}
+
+	transportLayer := CreateTCPLayer(testClientPort, 80, 1, 1)
+	transportLayer.Options = testTCPOptions()
+	networkLayer, err := CreateIPv4Layer(testClientIP, testRemoteIP, 1, 64, transportLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	networkLayer.Options = ipv4Options
+	err = transportLayer.SetNetworkLayerForChecksum(networkLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, network := capture(t, srcConn, networkLayer, transportLayer, gopacket.Payload(testPayload))
+
+	// Server
+	embIndicator, err := ParseEmbPacket(network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := RewriteSrc(embIndicator, upConn, testValue, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indicator := writeAndRead(t, upConn, r)
+
+	if !reflect.DeepEqual(indicator.IPv4Layer().Options, embIndicator.IPv4Layer().Options) {
+		t.Fatalf("ipv4 options %v, expected %v", indicator.IPv4Layer().Options, embIndicator.IPv4Layer().Options)
+	}
+	if !bytes.Equal(indicator.IPv4Layer().Contents[20:], network[20:32]) {
+		t.Fatalf("ipv4 options %x, expected %x", indicator.IPv4Layer().Contents[20:], network[20:32])
+	}
+	if !bytes.Equal(indicator.TCPLayer().Contents[20:], embIndicator.TCPLayer().Contents[20:]) {
+		t.Fatalf("tcp options %x, expected %x", indicator.TCPLayer().Contents[20:], embIndicator.TCPLayer().Contents[20:])
+	}
+	if !bytes.Equal(indicator.Payload(), testPayload) {
+		t.Fatalf("payload %x", indicator.Payload())
+	}
+}
+
+// testHopByHopLayers returns layers of a UDP datagram with the payload behind hop-by-hop options of router alert.
+func testHopByHopLayers(t *testing.T, payload []byte) []gopacket.SerializableLayer {
+	transportLayer := CreateUDPLayer(testClientPort, 9)
+	networkLayer, err := CreateIPv6Layer(testClientIPv6, testRemoteIPv6, 64, transportLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	networkLayer.HopByHop = &layers.IPv6HopByHop{}
+	networkLayer.HopByHop.NextHeader = layers.IPProtocolUDP
+	networkLayer.HopByHop.Options = []*layers.IPv6HopByHopOption{
+		// Router alert
+		{OptionType: 5, OptionLength: 2, OptionData: []byte{0, 0}},
+		// PadN
+		{OptionType: 1, OptionLength: 0, OptionData: []byte{}},
+	}
+	err = transportLayer.SetNetworkLayerForChecksum(networkLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []gopacket.SerializableLayer{networkLayer, transportLayer, gopacket.Payload(payload)}
+}
+
+func TestIPv6HopByHopThroughEncapsulation(t *testing.T) {
+	srcConn := testSourceConn()
+	defer srcConn.Close()
+	upConn := testDualUpConn()
+	defer upConn.Close()
+
+	_, network := capture(t, srcConn, testHopByHopLayers(t, testPayload)...)
+
+	// Server
+	embIndicator, err := ParseEmbPacket(network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if embIndicator.NextHeader() != layers.IPProtocolUDP {
+		t.Fatalf("next header %s", embIndicator.NextHeader())
+	}
+	r, err := RewriteSrc(embIndicator, upConn, testValue, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indicator := writeAndRead(t, upConn, r)
+
+	if indicator.IPv6Layer().HopByHop == nil {
+		t.Fatal("missing hop-by-hop options")
+	}
+	if !bytes.Equal(indicator.IPv6Layer().HopByHop.Contents, embIndicator.IPv6Layer().HopByHop.Contents) {
+		t.Fatalf("hop-by-hop options %x, expected %x", indicator.IPv6Layer().HopByHop.Contents, embIndicator.IPv6Layer().HopByHop.Contents)
+	}
+	if !indicator.SrcIP().Equal(testServerIPv6) || indicator.SrcPort() != testValue {
+		t.Fatalf("source %s:%d", indicator.SrcIP(), indicator.SrcPort())
+	}
+	if !bytes.Equal(indicator.Payload(), testPayload) {
+		t.Fatalf("payload %x", indicator.Payload())
+	}
+}
+
+func TestIPv6HopByHopFragments(t *testing.T) {
+	upConn := testDualUpConn()
+	defer upConn.Close()
+
+	payload := make([]byte, 3000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	data, err := Serialize(testHopByHopLayers(t, payload)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	embIndicator, err := ParseEmbPacket(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := RewriteSrc(embIndicator, upConn, testValue, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frags, err := r.Fragment(nil, 1280)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frags) < 3 {
+		t.Fatalf("%d fragments", len(frags))
+	}
+
+	defrag := NewEasyDefragmenter()
+	var indicator *PacketIndicator
+	for _, frag := range frags {
+		fragIndicator, err := ParseEmbPacket(frag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fragIndicator.IPv6Layer().HopByHop == nil {
+			t.Fatal("missing hop-by-hop options in fragment")
+		}
+		if fragIndicator.IPv6FragmentLayer() == nil {
+			t.Fatal("missing fragment header")
+		}
+
+		indicator, err = defrag.Append(fragIndicator)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if indicator == nil {
+		t.Fatal("not reassembled")
+	}
+
+	if indicator.IPv6Layer().HopByHop == nil {
+		t.Fatal("missing hop-by-hop options")
+	}
+	if indicator.NextHeader() != layers.IPProtocolUDP {
+		t.Fatalf("next header %s", indicator.NextHeader())
+	}
+	if indicator.SrcPort() != testValue {
+		t.Fatalf("source port %d", indicator.SrcPort())
+	}
+	if !bytes.Equal(indicator.Payload(), payload) {
+		t.Fatal("payload mismatch")
+	}
+}
+
+func TestUDPPayloadThroughEncapsulation(t *testing.T) {
+	srcConn := testSourceConn()
+	defer srcConn.Close()
+
+	// VXLAN is decoded as layers rather than an application layer
+	payload := []byte{0x08, 0, 0, 0, 0, 0, 0x01, 0, 0x02, 0, 0, 0, 0, 0x01, 0x02, 0, 0, 0, 0, 0x02, 0x08, 0x06}
+	transportLayer := CreateUDPLayer(testClientPort, 4789)
+	networkLayer, err := CreateIPv4Layer(testClientIP, testRemoteIP, 1, 64, transportLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = transportLayer.SetNetworkLayerForChecksum(networkLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, network := capture(t, srcConn, networkLayer, transportLayer, gopacket.Payload(payload))
+
+	embIndicator, err := ParseEmbPacket(network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(embIndicator.Payload(), payload) {
+		t.Fatalf("payload %x, expected %x", embIndicator.Payload(), payload)
+	}
+}
+
+// TestParseCrashers parses inputs which crashed in fuzzing, which must be rejected or be handled without panics.
+func TestParseCrashers(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "fuzz", "parse", "crashers", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		indicator, err := ParseEmbPacket(data)
+		if err != nil {
+			continue
+		}
+		if indicator.MTU() > len(data) {
+			t.Errorf("%s: mtu %d out of range", filepath.Base(file), indicator.MTU())
+			continue
+		}
+		_ = indicator.NetworkData()
+	}
+}
@@ -0,0 +1,174 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// pppoeProbe is the address of the packet sent to trigger traffic in the PPPoE session, which is in TEST-NET-1 and is
+// routed by the default route and dropped by the access concentrator.
+const pppoeProbe = "192.0.2.1:65535"
+
+// isPPPoE describes if the upstream is in a PPPoE session, in which filters are extended to match packets in sessions.
+var isPPPoE bool
+
+// PPPoEEthernet is an Ethernet layer followed by a PPPoE session header and a PPP header, which are serialized together
+// as a link layer.
+type PPPoEEthernet struct {
+	Ethernet *layers.Ethernet
+	PPPoE    *layers.PPPoE
+	PPP      *layers.PPP
+}
+
+// LayerType returns the type of the Ethernet layer.
+func (layer *PPPoEEthernet) LayerType() gopacket.LayerType {
+	return layers.LayerTypeEthernet
+}
+
+// SerializeTo serializes the PPP header, the PPPoE header and the Ethernet layer in front of it.
+func (layer *PPPoEEthernet) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	err := layer.PPP.SerializeTo(b, opts)
+	if err != nil {
+		return err
+	}
+
+	err = layer.PPPoE.SerializeTo(b, opts)
+	if err != nil {
+		return err
+	}
+
+	return layer.Ethernet.SerializeTo(b, opts)
+}
+
+// CreatePPPoELayer returns an Ethernet layer followed by a PPPoE session header of the session and a PPP header.
+func CreatePPPoELayer(srcMAC, dstMAC net.HardwareAddr, session uint16, networkLayer gopacket.NetworkLayer) (*PPPoEEthernet, error) {
+	var t layers.PPPType
+
+	// Protocol
+	switch networkLayerType := networkLayer.LayerType(); networkLayerType {
+	case layers.LayerTypeIPv4:
+		t = layers.PPPTypeIPv4
+	case layers.LayerTypeIPv6:
+		t = layers.PPPTypeIPv6
+	default:
+		return nil, NewError(ErrUnsupportedLayer, "network layer type %s not support", networkLayerType)
+	}
+
+	return &PPPoEEthernet{
+		Ethernet: &layers.Ethernet{
+			SrcMAC:       srcMAC,
+			DstMAC:       dstMAC,
+			EthernetType: layers.EthernetTypePPPoESession,
+		},
+		PPPoE: &layers.PPPoE{
+			Version:   1,
+			Type:      1,
+			Code:      layers.PPPoECodeSession,
+			SessionId: session,
+		},
+		PPP: &layers.PPP{
+			PPPType: t,
+		},
+	}, nil
+}
+
+// FindPPPoEDevAndGatewayDev returns the pcap device carrying the PPPoE session for routing upstream and the access
+// concentrator as the gateway. The session, the hardware address of the access concentrator and the IP of the session
+// are detected by capturing a packet sent in the session, so the session must be established by the OS in advance.
+func FindPPPoEDevAndGatewayDev(name string) (upDev, gatewayDev *Device, err error) {
+	if name == "" {
+		return nil, nil, errors.New("missing upstream device")
+	}
+
+	devs, err := FindAllDevs()
+	if err != nil {
+		return nil, nil, fmt.Errorf("find all devices: %w", err)
+	}
+
+	matches, err := MatchDevs(devs, name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("match upstream device %s: %w", name, err)
+	}
+	switch len(matches) {
+	case 0:
+		return nil, nil, fmt.Errorf("unknown upstream device %s", name)
+	case 1:
+		break
+	default:
+		return nil, nil, fmt.Errorf("upstream device %s matches %d devices", name, len(matches))
+	}
+	dev := matches[0]
+	if len(dev.HardwareAddr()) == 0 {
+		return nil, nil, fmt.Errorf("upstream device %s not in ethernet", dev.Alias())
+	}
+
+	conn, err := createPureRawConn(dev.Name(), fmt.Sprintf("ether src %s && pppoes && (ip || ip6)", dev.HardwareAddr()))
+	if err != nil {
+		return nil, nil, fmt.Errorf("open device %s: %w", dev.Alias(), err)
+	}
+	defer conn.Close()
+
+	c := make(chan gopacket.Packet, 2)
+	go func() {
+		packet, err := conn.ReadPacket()
+		if err != nil {
+			c <- nil
+		}
+		c <- packet
+	}()
+	go func() {
+		time.Sleep(3 * time.Second)
+		c <- nil
+	}()
+
+	// Attempt to send and capture a UDP packet in the session
+	err = SendUDPPacket(pppoeProbe, []byte("0"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("send udp packet: %w", err)
+	}
+
+	// Analyze the packet and get the session
+	packet := <-c
+	if packet == nil {
+		return nil, nil, errors.New("timeout")
+	}
+	ethernetLayer, ok := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !ok {
+		return nil, nil, errors.New("missing ethernet layer")
+	}
+	pppoeLayer, ok := packet.Layer(layers.LayerTypePPPoE).(*layers.PPPoE)
+	if !ok {
+		return nil, nil, errors.New("missing pppoe layer")
+	}
+	var ip net.IP
+	switch networkLayer := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		ip = networkLayer.SrcIP
+	case *layers.IPv6:
+		ip = networkLayer.SrcIP
+	default:
+		return nil, nil, errors.New("missing network layer")
+	}
+
+	isPPPoE = true
+
+	upDev = &Device{
+		name:         dev.name,
+		alias:        dev.alias,
+		description:  dev.description,
+		ipAddrs:      []*net.IPNet{{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}},
+		hardwareAddr: dev.hardwareAddr,
+		isLoop:       dev.isLoop,
+		isUp:         dev.isUp,
+		vlan:         dev.vlan,
+		pppoe:        pppoeLayer.SessionId,
+	}
+	gatewayDev = &Device{alias: "Gateway", hardwareAddr: ethernetLayer.DstMAC}
+
+	return upDev, gatewayDev, nil
+}
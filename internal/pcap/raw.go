@@ -1,8 +1,15 @@
 package pcap
 
 import (
+	"errors"
+	"fmt"
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"ikago/internal/config"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type timeoutError struct {
@@ -20,33 +27,232 @@ func (err *timeoutError) Timeout() bool {
 // MaxMTU is the max transmission and receive unit in pcap raw conn.
 const MaxMTU = 1500
 
+// MinMTU is the min transmission and receive unit in pcap raw conn, which every IPv4 host must accept.
+const MinMTU = 576
+
 // IPv4MaxSize is the max size of an IPv4 packet.
 const IPv4MaxSize = 65535
 
-// maxSnapLen is the max size of each packet in pcap raw conn.
-const maxSnapLen = 1600
+// DefaultSnapLen is the default max size of each packet in pcap raw conn.
+const DefaultSnapLen = 1600
+
+// MaxSnapLen is the max size of each packet in pcap raw conn, which is enough for super-frames produced by offloading.
+const MaxSnapLen = 262144
+
+var snapLen = DefaultSnapLen
+
+// SetSnapLen sets the max size of each packet captured in raw connections. It should be called before any connection
+// is opened.
+func SetSnapLen(n int) {
+	snapLen = n
+}
+
+// SnapLen returns the max size of each packet captured in raw connections.
+func SnapLen() int {
+	return snapLen
+}
+
+// TruncatedError describes a packet is truncated in capturing because it is larger than the snap length.
+type TruncatedError struct {
+	CaptureLength int
+	Length        int
+}
+
+func (err *TruncatedError) Error() string {
+	return fmt.Sprintf("truncated from %d to %d Bytes", err.Length, err.CaptureLength)
+}
+
+// MinReopenInterval is the min interval of reopening a device whose capturing fails.
+const MinReopenInterval = time.Second
 
-// RawConn is a raw network connection.
+// MaxReopenInterval is the max interval of reopening a device whose capturing fails.
+const MaxReopenInterval = 32 * time.Second
+
+// RawConn is a raw network connection. The device is reopened with backoff if capturing fails, like when the device
+// goes down, and packets are sent by a raw socket instead once injecting by pcap fails.
 type RawConn struct {
-	srcDev *Device
-	dstDev *Device
-	handle *pcap.Handle
+	name      string
+	srcDev    *Device
+	dstDev    *Device
+	lock      sync.RWMutex
+	handle    captureHandle
+	filter    string
+	closed    chan struct{}
+	reopened  uint64
+	segment   bool
+	truncated uint64
+	stats     CaptureStats
+	pending   []gopacket.Packet
+	sender    sender
+	noSender  bool
+
+	// ring buffers packets captured in its own goroutine, which starts in the first read, until they are read
+	ring       chan ringItem
+	ringOnce   sync.Once
+	ringDone   chan struct{}
+	ringErr    error
+	overflowed uint64
 }
 
-func createPureRawConn(dev, filter string) (*RawConn, error) {
-	handle, err := pcap.OpenLive(dev, maxSnapLen, true, pcap.BlockForever)
+// captureHandle is a handle capturing and injecting packets in a device, which is a handle of pcap, or of an AF_PACKET
+// socket whose ring is mapped directly.
+type captureHandle interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	WritePacketData(data []byte) error
+	LinkType() layers.LinkType
+	SetBPFFilter(filter string) error
+	Stats() (*pcap.Stats, error)
+	Close()
+}
+
+// ringItem describes a packet captured into the ring of a connection.
+type ringItem struct {
+	data     []byte
+	ci       gopacket.CaptureInfo
+	linkType layers.LinkType
+}
+
+var pcapConfig = config.NewPcapConfig()
+
+// SetPcapConfig sets the options of capturing in raw connections. It should be called before any connection is opened.
+func SetPcapConfig(cfg *config.PcapConfig) {
+	pcapConfig = cfg
+}
+
+// ValidatePcapConfig returns an error if the options of capturing are invalid.
+func ValidatePcapConfig(cfg *config.PcapConfig) error {
+	if cfg.Buffer < 0 {
+		return fmt.Errorf("buffer %d out of range", cfg.Buffer)
+	}
+	if cfg.Timeout < 0 {
+		return fmt.Errorf("timeout %d out of range", cfg.Timeout)
+	}
+	if cfg.Ring < 0 {
+		return fmt.Errorf("ring %d out of range", cfg.Ring)
+	}
+	if cfg.Mmap && cfg.Tstamp != "" {
+		return errors.New("tstamp not support in mmap")
+	}
+	if cfg.Tstamp != "" {
+		_, err := pcap.TimestampSourceFromString(cfg.Tstamp)
+		if err != nil {
+			return fmt.Errorf("parse tstamp %s: %w", cfg.Tstamp, err)
+		}
+	}
+
+	return nil
+}
+
+// openLive opens a handle of the device with options of capturing.
+func openLive(dev string) (*pcap.Handle, error) {
+	inactive, err := pcap.NewInactiveHandle(dev)
 	if err != nil {
 		return nil, err
 	}
+	defer inactive.CleanUp()
+
+	err = inactive.SetSnapLen(snapLen)
+	if err != nil {
+		return nil, fmt.Errorf("set snap length: %w", err)
+	}
+
+	promisc := true
+	for _, name := range pcapConfig.NoPromisc {
+		if name == dev {
+			promisc = false
+			break
+		}
+	}
+	err = inactive.SetPromisc(promisc)
+	if err != nil {
+		return nil, fmt.Errorf("set promisc: %w", err)
+	}
+
+	timeout := pcap.BlockForever
+	if pcapConfig.Timeout > 0 {
+		timeout = time.Duration(pcapConfig.Timeout) * time.Millisecond
+	}
+	err = inactive.SetTimeout(timeout)
+	if err != nil {
+		return nil, fmt.Errorf("set timeout: %w", err)
+	}
+
+	if pcapConfig.Immediate {
+		err = inactive.SetImmediateMode(true)
+		if err != nil {
+			return nil, fmt.Errorf("set immediate mode: %w", err)
+		}
+	}
 
-	err = handle.SetBPFFilter(filter)
+	if pcapConfig.Buffer > 0 {
+		err = inactive.SetBufferSize(pcapConfig.Buffer)
+		if err != nil {
+			return nil, fmt.Errorf("set buffer size: %w", err)
+		}
+	}
+
+	if pcapConfig.Tstamp != "" {
+		source, err := pcap.TimestampSourceFromString(pcapConfig.Tstamp)
+		if err != nil {
+			return nil, fmt.Errorf("parse tstamp %s: %w", pcapConfig.Tstamp, err)
+		}
+
+		err = inactive.SetTimestampSource(source)
+		if err != nil {
+			return nil, fmt.Errorf("set tstamp: %w", err)
+		}
+	}
+
+	return inactive.Activate()
+}
+
+func createPureRawConn(dev, filter string) (*RawConn, error) {
+	handle, err := openHandle(dev, filter)
 	if err != nil {
 		return nil, err
 	}
 
-	return &RawConn{
+	conn := &RawConn{
+		name:   dev,
 		handle: handle,
-	}, nil
+		filter: filter,
+		closed: make(chan struct{}),
+	}
+
+	rawConnsLock.Lock()
+	rawConns[conn] = true
+	rawConnsLock.Unlock()
+
+	if pcapConfig.Ring > 0 {
+		conn.ring = make(chan ringItem, pcapConfig.Ring)
+		conn.ringDone = make(chan struct{})
+	}
+
+	return conn, nil
+}
+
+// openHandle opens a handle of the device with the BPF filter.
+func openHandle(dev, filter string) (captureHandle, error) {
+	var (
+		handle captureHandle
+		err    error
+	)
+	if pcapConfig.Mmap {
+		handle, err = openMmap(dev)
+	} else {
+		handle, err = openLive(dev)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = handle.SetBPFFilter(vlanFilter(filter))
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+
+	return handle, nil
 }
 
 // CreateRawConn creates a raw connection between devices with BPF filter.
@@ -62,42 +268,292 @@ func CreateRawConn(srcDev, dstDev *Device, filter string) (*RawConn, error) {
 	return conn, nil
 }
 
+// readHandle reads a packet from the current handle, which is reopened if capturing fails.
+func (c *RawConn) readHandle() ([]byte, gopacket.CaptureInfo, layers.LinkType, error) {
+	for {
+		handle := c.currentHandle()
+		d, ci, err := handle.ReadPacketData()
+		// The buffer is delivered empty when the timeout expires
+		if err == pcap.NextErrorTimeoutExpired {
+			continue
+		}
+		if err == nil || c.isClosed() {
+			return d, ci, handle.LinkType(), err
+		}
+
+		err = c.reopen(handle, err)
+		if err != nil {
+			return nil, ci, 0, err
+		}
+	}
+}
+
+// capture captures packets into the ring until the connection is closed, so the buffer of the kernel is drained even
+// if packets are read slowly. Packets are dropped if the ring is full.
+func (c *RawConn) capture() {
+	for {
+		d, ci, linkType, err := c.readHandle()
+		if err != nil {
+			c.ringErr = err
+			close(c.ringDone)
+			return
+		}
+
+		select {
+		case c.ring <- ringItem{data: d, ci: ci, linkType: linkType}:
+		default:
+			if atomic.AddUint64(&c.overflowed, 1) == 1 {
+				logger.Warnf("Ring of device %s overflows as packets are handled slowly, enlarge the ring or add "+
+					"workers\n", c.name)
+			}
+		}
+	}
+}
+
 func (c *RawConn) Read(b []byte) (n int, err error) {
-	d, _, err := c.handle.ReadPacketData()
-	if err != nil {
-		return 0, err
+	var (
+		d        []byte
+		ci       gopacket.CaptureInfo
+		linkType layers.LinkType
+	)
+
+	if c.ring != nil {
+		c.ringOnce.Do(func() {
+			go c.capture()
+		})
+
+		select {
+		case item := <-c.ring:
+			d, ci, linkType = item.data, item.ci, item.linkType
+		case <-c.ringDone:
+			return 0, c.ringErr
+		}
+	} else {
+		d, ci, linkType, err = c.readHandle()
+		if err != nil {
+			return 0, err
+		}
 	}
 
 	copy(b, d)
+	dump(c.name, linkType, d)
+
+	if ci.CaptureLength < ci.Length {
+		return len(d), &TruncatedError{CaptureLength: ci.CaptureLength, Length: ci.Length}
+	}
 
 	return len(d), nil
 }
 
-// ReadPacket reads packet from the connection.
+// ReadPacket reads packet from the connection. Truncated packets are dropped, and super-frames are segmented if
+// segmentation is enabled.
 func (c *RawConn) ReadPacket() (gopacket.Packet, error) {
-	b := make([]byte, maxSnapLen)
+	if len(c.pending) > 0 {
+		packet := c.pending[0]
+		c.pending = c.pending[1:]
 
-	_, err := c.Read(b)
-	if err != nil {
-		return nil, err
+		return packet, nil
 	}
 
-	packet := gopacket.NewPacket(b, c.handle.LinkType(), gopacket.NoCopy)
+	b := make([]byte, snapLen)
+
+	for {
+		n, err := c.Read(b)
+		if err != nil {
+			var truncatedErr *TruncatedError
+			if errors.As(err, &truncatedErr) {
+				c.truncated++
+				if c.truncated == 1 {
+					logger.Warnf("Packet in device %s is %s, enlarge snap length or disable offloading of the "+
+						"device\n", c.name, truncatedErr)
+				} else {
+					logger.Verbosef("Drop a packet in device %s which is %s\n", c.name, truncatedErr)
+				}
+				continue
+			}
+
+			return nil, err
+		}
+
+		packet := gopacket.NewPacket(b[:n], c.LinkType(), gopacket.NoCopy)
+		if !c.segment {
+			return packet, nil
+		}
+
+		packets, err := Segment(packet, MaxMTU)
+		if err != nil {
+			return nil, fmt.Errorf("segment: %w", err)
+		}
+		c.pending = packets[1:]
+
+		return packets[0], nil
+	}
+}
 
-	return packet, nil
+// EnableSegmentation splits TCP super-frames read from the connection, which are produced by TSO or GRO, into
+// packets fitting in the MTU.
+func (c *RawConn) EnableSegmentation() {
+	c.segment = true
+}
+
+// Truncated returns the number of packets truncated in capturing.
+func (c *RawConn) Truncated() uint64 {
+	return c.truncated
+}
+
+// Reopened returns the number of times the device is reopened after capturing fails.
+func (c *RawConn) Reopened() uint64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.reopened
+}
+
+func (c *RawConn) currentHandle() captureHandle {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.handle
+}
+
+func (c *RawConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// reopen reopens the device whose handle fails in capturing, retrying with backoff until it succeeds or the
+// connection is closed.
+func (c *RawConn) reopen(handle captureHandle, cause error) error {
+	logger.Errorln(fmt.Errorf("capture in device %s: %w", c.name, cause))
+
+	interval := MinReopenInterval
+	for {
+		logger.Warnf("Reopen device %s in %s\n", c.name, interval)
+
+		select {
+		case <-c.closed:
+			return cause
+		case <-time.After(interval):
+		}
+
+		c.lock.RLock()
+		filter := c.filter
+		c.lock.RUnlock()
+
+		newHandle, err := openHandle(c.name, filter)
+		if err != nil {
+			logger.Errorln(fmt.Errorf("reopen device %s: %w", c.name, err))
+
+			interval *= 2
+			if interval > MaxReopenInterval {
+				interval = MaxReopenInterval
+			}
+			continue
+		}
+
+		c.lock.Lock()
+		// The connection is closed meanwhile
+		if c.isClosed() {
+			c.lock.Unlock()
+			newHandle.Close()
+			return cause
+		}
+		// Statistics of the failed handle are kept
+		stats, err := handle.Stats()
+		if err == nil {
+			c.stats.add(stats)
+		}
+		c.handle = newHandle
+		c.reopened++
+		c.lock.Unlock()
+		handle.Close()
+
+		logger.Infof("Resume capturing in device %s\n", c.name)
+
+		return nil
+	}
 }
 
 func (c *RawConn) Write(b []byte) (n int, err error) {
-	err = c.handle.WritePacketData(b)
-	if err != nil {
-		return 0, err
+	handle := c.currentHandle()
+
+	if isDryRun {
+		printDryRun(c.name, handle.LinkType(), b)
+	} else {
+		err = c.write(handle, b)
+		if err != nil {
+			return 0, err
+		}
 	}
+	dump(c.name, handle.LinkType(), b)
 
 	return len(b), nil
 }
 
+// write injects the packet data by pcap, or sends it by the fallback sender once injecting fails.
+func (c *RawConn) write(handle captureHandle, b []byte) error {
+	c.lock.RLock()
+	s := c.sender
+	c.lock.RUnlock()
+	if s != nil {
+		return s.Send(b)
+	}
+
+	err := handle.WritePacketData(b)
+	if err == nil {
+		return nil
+	}
+
+	s = c.fallback(handle.LinkType(), err)
+	if s == nil {
+		return err
+	}
+
+	return s.Send(b)
+}
+
+// fallback returns the sender used instead of injecting by pcap which fails, or nil if it cannot be opened. It is
+// only attempted once.
+func (c *RawConn) fallback(t layers.LinkType, cause error) sender {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.sender != nil || c.noSender || c.isClosed() {
+		return c.sender
+	}
+
+	s, err := openSender(c.name, t)
+	if err != nil {
+		c.noSender = true
+		logger.Errorln(fmt.Errorf("fallback from injecting in device %s: %w", c.name, err))
+		return nil
+	}
+	c.sender = s
+
+	logger.Warnf("Send in device %s by a raw socket as injecting fails: %v\n", c.name, cause)
+
+	return s
+}
+
 func (c *RawConn) Close() error {
-	c.handle.Close()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.isClosed() {
+		close(c.closed)
+		c.handle.Close()
+		if c.sender != nil {
+			c.sender.Close()
+		}
+
+		rawConnsLock.Lock()
+		delete(rawConns, c)
+		rawConnsLock.Unlock()
+	}
 
 	return nil
 }
@@ -112,6 +568,47 @@ func (c *RawConn) RemoteDev() *Device {
 	return c.dstDev
 }
 
+// SetBPFFilter compiles and sets the BPF filter of the connection.
+func (c *RawConn) SetBPFFilter(filter string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	err := c.handle.SetBPFFilter(vlanFilter(filter))
+	if err != nil {
+		return err
+	}
+	c.filter = filter
+
+	return nil
+}
+
+// vlanFilter extends the BPF filter to match packets with an 802.1Q header as well, whose offsets are shifted by the
+// tag, or packets in PPPoE sessions if the upstream is in PPPoE.
+func vlanFilter(filter string) string {
+	if filter == "" {
+		return filter
+	}
+
+	// Offsets are shifted for the remainder of the filter, so only one of them is matched
+	if isPPPoE {
+		return fmt.Sprintf("(%s) || (pppoes && (%s))", filter, filter)
+	}
+
+	return fmt.Sprintf("(%s) || (vlan && (%s))", filter, filter)
+}
+
+// ValidateBPFFilter returns an error if the BPF filter cannot be compiled.
+func ValidateBPFFilter(filter string) error {
+	_, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, snapLen, vlanFilter(filter))
+
+	return err
+}
+
+// LinkType returns the link type of the connection.
+func (c *RawConn) LinkType() layers.LinkType {
+	return c.currentHandle().LinkType()
+}
+
 // IsLoop returns if the connection is to a loopback device.
 func (c *RawConn) IsLoop() bool {
 	return c.dstDev.IsLoop()
@@ -158,6 +655,11 @@ func (r *Reader) ReadPacket() (gopacket.Packet, error) {
 	return packet, nil
 }
 
+// LinkType returns the link type of the pcap file.
+func (r *Reader) LinkType() layers.LinkType {
+	return r.handle.LinkType()
+}
+
 func (r *Reader) Close() error {
 	r.handle.Close()
 
@@ -0,0 +1,98 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"ikago/internal/crypto"
+	"net"
+	"time"
+)
+
+// rekeyTimeout is the duration after which a proposal of rotating keys not accepted is resent.
+const rekeyTimeout = 3 * time.Second
+
+// Rekey rotates keys of the tunnel if the key of the current epoch is used for the interval or encrypts data in the
+// size, and resends the proposal if the server has not accepted it. It should be called periodically. Rotating is only
+// supported in mode faketcp without KCP with a rotating crypt, and does nothing until framing is negotiated in version 4
+// or later. Paths in multipath are rotated respectively.
+func (c *TunnelConn) Rekey(interval time.Duration, size uint64) error {
+	multipathConn, ok := c.Conn.(*MultipathConn)
+	if !ok {
+		return rekey(c.Conn, interval, size)
+	}
+
+	for _, path := range multipathConn.Paths() {
+		err := rekey(path, interval, size)
+		if err != nil {
+			return fmt.Errorf("rekey in %s: %w", path.LocalAddr(), err)
+		}
+	}
+
+	return nil
+}
+
+func rekey(conn net.Conn, interval time.Duration, size uint64) error {
+	frameConn, ok := conn.(*FrameConn)
+	if !ok {
+		return errors.New("missing framing")
+	}
+	if frameConn.Version() < RekeyFrameVersion {
+		return nil
+	}
+
+	r := frameConn.rotatingCrypt()
+	if r == nil {
+		return errors.New("missing rotating crypt")
+	}
+
+	epoch, salt, ok, err := r.Propose(interval, size, rekeyTimeout)
+	if err != nil {
+		return fmt.Errorf("propose: %w", err)
+	}
+	if !ok {
+		return nil
+	}
+
+	return frameConn.writeFrame(FrameTypeRekey, 0, append([]byte{epoch}, salt...))
+}
+
+// rotatingCrypt returns the rotating crypt of the connection in mode faketcp, nil if there is not.
+func (c *FrameConn) rotatingCrypt() *crypto.RotatingCrypt {
+	conn := c.Conn
+
+	batchConn, ok := conn.(*BatchConn)
+	if ok {
+		conn = batchConn.Conn
+	}
+
+	fakeTCPConn, ok := conn.(*FakeTCPConn)
+	if !ok {
+		return nil
+	}
+
+	return crypto.FindRotatingCrypt(fakeTCPConn.crypt)
+}
+
+func (c *FrameConn) handleRekey(frame *Frame) error {
+	if len(frame.Payload) < 1 {
+		return errors.New("missing epoch")
+	}
+
+	r := c.rotatingCrypt()
+	if r == nil {
+		logger.Verbosef("Drop a rekey frame from %s without key rotation\n", c.RemoteAddr())
+		return nil
+	}
+
+	epoch := frame.Payload[0]
+	isNew := r.Epoch() != epoch
+	err := r.Accept(epoch, frame.Payload[1:])
+	if err != nil {
+		return fmt.Errorf("accept: %w", err)
+	}
+	if isNew {
+		logger.Verbosef("Rotate keys to epoch %d from %s\n", epoch, c.RemoteAddr())
+	}
+
+	return c.writeFrame(FrameTypeRekeyAck, 0, []byte{epoch})
+}
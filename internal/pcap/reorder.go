@@ -0,0 +1,161 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket/layers"
+	"time"
+)
+
+var (
+	reorderWindow  = 0
+	reorderTimeout = 50 * time.Millisecond
+)
+
+// SetReorder sets the window in segments and the timeout of reordering segments received in FakeTCP connections. A
+// window of 0 disables reordering. It should be called before any connection is established.
+func SetReorder(window int, timeout time.Duration) {
+	reorderWindow = window
+	reorderTimeout = timeout
+}
+
+// maxSACKBlocks is the max number of SACK blocks in a TCP ACK, limited by the space of TCP options.
+const maxSACKBlocks = 4
+
+// seqLess returns if TCP Seq a is before b.
+func seqLess(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+type reorderSegment struct {
+	seq     uint32
+	payload []byte
+	arrival time.Time
+	ce      bool
+}
+
+func (segment *reorderSegment) end() uint32 {
+	return segment.seq + uint32(len(segment.payload))
+}
+
+// reorderBuffer describes segments received ahead of the expected TCP Seq, sorted by their TCP Seq.
+type reorderBuffer struct {
+	segments []*reorderSegment
+	timer    *time.Timer
+}
+
+// push buffers a segment. Segments buffered already are ignored.
+func (b *reorderBuffer) push(seq uint32, payload []byte, ce bool) {
+	i := 0
+	for ; i < len(b.segments); i++ {
+		if b.segments[i].seq == seq {
+			return
+		}
+		if seqLess(seq, b.segments[i].seq) {
+			break
+		}
+	}
+
+	// The payload is kept after the packet is released
+	p := make([]byte, len(payload))
+	copy(p, payload)
+
+	b.segments = append(b.segments, nil)
+	copy(b.segments[i+1:], b.segments[i:])
+	b.segments[i] = &reorderSegment{seq: seq, payload: p, arrival: time.Now(), ce: ce}
+}
+
+// pop removes segments which are continuous from the TCP Ack, and returns them and the TCP Ack after them. Segments
+// before the TCP Ack are dropped.
+func (b *reorderBuffer) pop(ack uint32) ([]*reorderSegment, uint32) {
+	result := make([]*reorderSegment, 0)
+
+	i := 0
+	for ; i < len(b.segments); i++ {
+		segment := b.segments[i]
+		if !seqLess(segment.seq, ack) && segment.seq != ack {
+			break
+		}
+		if segment.seq == ack {
+			result = append(result, segment)
+			ack = segment.end()
+		}
+	}
+	b.segments = b.segments[i:]
+
+	return result, ack
+}
+
+// first returns the first buffered segment, nil if the buffer is empty.
+func (b *reorderBuffer) first() *reorderSegment {
+	if len(b.segments) <= 0 {
+		return nil
+	}
+
+	return b.segments[0]
+}
+
+// sack returns the SACK option describing buffered ranges, nil if the buffer is empty.
+func (b *reorderBuffer) sack() *layers.TCPOption {
+	// Timestamps leave space for one block less
+	limit := maxSACKBlocks
+	if tcpTimestamps {
+		limit--
+	}
+
+	data := make([]byte, 0, limit*8)
+
+	var left, right uint32
+	blocks := 0
+	for i, segment := range b.segments {
+		if i > 0 && segment.seq == right {
+			right = segment.end()
+			continue
+		}
+		if i > 0 {
+			data = appendSACKBlock(data, left, right)
+			blocks++
+			if blocks >= limit {
+				break
+			}
+		}
+		left, right = segment.seq, segment.end()
+	}
+	if len(b.segments) > 0 && blocks < limit {
+		data = appendSACKBlock(data, left, right)
+	}
+
+	if len(data) <= 0 {
+		return nil
+	}
+
+	return &layers.TCPOption{
+		OptionType:   layers.TCPOptionKindSACK,
+		OptionLength: uint8(2 + len(data)),
+		OptionData:   data,
+	}
+}
+
+func appendSACKBlock(data []byte, left, right uint32) []byte {
+	block := make([]byte, 8)
+	binary.BigEndian.PutUint32(block[0:4], left)
+	binary.BigEndian.PutUint32(block[4:8], right)
+
+	return append(data, block...)
+}
+
+// parseSACK returns SACK blocks in the TCP options as pairs of the left and the right edge.
+func parseSACK(options []layers.TCPOption) [][2]uint32 {
+	result := make([][2]uint32, 0)
+
+	for _, option := range options {
+		if option.OptionType != layers.TCPOptionKindSACK {
+			continue
+		}
+
+		for data := option.OptionData; len(data) >= 8; data = data[8:] {
+			result = append(result, [2]uint32{binary.BigEndian.Uint32(data[0:4]), binary.BigEndian.Uint32(data[4:8])})
+		}
+	}
+
+	return result
+}
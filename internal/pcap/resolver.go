@@ -0,0 +1,282 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"sync"
+	"time"
+)
+
+// resolveTimeout is the timeout of waiting for an ARP reply or a neighbor advertisement.
+const resolveTimeout = 3 * time.Second
+
+// Resolver describes a resolver which resolves hardware addresses by ARP in IPv4 and NDP in IPv6 in a device, and
+// caches the results.
+type Resolver struct {
+	dev     *Device
+	timeout time.Duration
+	lock    sync.Mutex
+	cache   map[string]net.HardwareAddr
+}
+
+// NewResolver returns a new resolver sending requests in the device.
+func NewResolver(dev *Device) *Resolver {
+	return &Resolver{
+		dev:     dev,
+		timeout: resolveTimeout,
+		cache:   make(map[string]net.HardwareAddr),
+	}
+}
+
+// Resolve returns the hardware address of the IP, from the cache if it was resolved.
+func (r *Resolver) Resolve(ip net.IP) (net.HardwareAddr, error) {
+	r.lock.Lock()
+	hardwareAddr, ok := r.cache[ip.String()]
+	r.lock.Unlock()
+	if ok {
+		return hardwareAddr, nil
+	}
+
+	return r.Refresh(ip)
+}
+
+// Refresh resolves the hardware address of the IP regardless of the cache. The cached result is removed if the IP does
+// not respond.
+func (r *Resolver) Refresh(ip net.IP) (net.HardwareAddr, error) {
+	hardwareAddr, err := resolve(r.dev, ip, r.timeout)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if err != nil {
+		delete(r.cache, ip.String())
+		return nil, err
+	}
+	r.cache[ip.String()] = hardwareAddr
+
+	return hardwareAddr, nil
+}
+
+// Keep refreshes the hardware address of the gateway device in every interval, and updates the gateway device if its
+// hardware address changes. If the gateway stops responding, it will be refreshed again in a shorter interval.
+func (r *Resolver) Keep(gatewayDev *Device, interval time.Duration) {
+	// Access concentrators in PPPoE are not resolved by ARP or NDP
+	if r.dev.PPPoE() != 0 {
+		return
+	}
+	// Pinned hardware addresses are kept as they are
+	if gatewayDev.IsPinned() {
+		return
+	}
+
+	ip := gatewayDev.IPAddr().IP
+	isResponding := true
+
+	for {
+		if isResponding {
+			time.Sleep(interval)
+		} else {
+			time.Sleep(r.timeout)
+		}
+
+		hardwareAddr, err := r.Refresh(ip)
+		if err != nil {
+			if isResponding {
+				logger.Warnln(fmt.Errorf("refresh gateway %s: %w", ip, err))
+			}
+			isResponding = false
+			continue
+		}
+		if !isResponding {
+			logger.Infof("Gateway %s responds again\n", ip)
+		}
+		isResponding = true
+
+		if hardwareAddr.String() != gatewayDev.HardwareAddr().String() {
+			gatewayDev.setHardwareAddr(hardwareAddr)
+			logger.Infof("Gateway %s changes its hardware address to %s\n", ip, hardwareAddr)
+		}
+	}
+}
+
+func resolve(dev *Device, ip net.IP, timeout time.Duration) (net.HardwareAddr, error) {
+	var (
+		filter        string
+		requestLayers []gopacket.SerializableLayer
+		err           error
+	)
+
+	srcIP := dev.IPAddrOf(ip)
+	if srcIP == nil {
+		return nil, fmt.Errorf("missing source address for %s", ip)
+	}
+
+	if ip.To4() != nil {
+		filter = fmt.Sprintf("arp && arp[6:2] = 2 && src host %s", ip)
+		requestLayers, err = createARPRequest(dev.HardwareAddr(), srcIP.IP, ip)
+	} else {
+		filter = fmt.Sprintf("icmp6 && ip6[40] = 136 && src host %s", ip)
+		requestLayers, err = createNeighborSolicitation(dev.HardwareAddr(), srcIP.IP, ip)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	if vlan := dev.VLAN(); vlan != 0 {
+		requestLayers = tagRequest(requestLayers, vlan)
+	}
+
+	data, err := Serialize(requestLayers...)
+	if err != nil {
+		return nil, fmt.Errorf("serialize: %w", err)
+	}
+
+	conn, err := createPureRawConn(dev.Name(), filter)
+	if err != nil {
+		return nil, fmt.Errorf("open device %s: %w", dev.Alias(), err)
+	}
+	defer conn.Close()
+
+	c := make(chan net.HardwareAddr, 1)
+	go func() {
+		for {
+			packet, err := conn.ReadPacket()
+			if err != nil {
+				return
+			}
+
+			hardwareAddr := parseResolveReply(packet, ip)
+			if hardwareAddr != nil {
+				c <- hardwareAddr
+				return
+			}
+		}
+	}()
+
+	_, err = conn.Write(data)
+	if err != nil {
+		return nil, fmt.Errorf("write: %w", err)
+	}
+
+	select {
+	case hardwareAddr := <-c:
+		return hardwareAddr, nil
+	case <-time.After(timeout):
+		return nil, errors.New("timeout")
+	}
+}
+
+func createARPRequest(srcHardwareAddr net.HardwareAddr, srcIP, dstIP net.IP) ([]gopacket.SerializableLayer, error) {
+	if len(srcHardwareAddr) != 6 {
+		return nil, errors.New("missing hardware address")
+	}
+
+	ethernetLayer := &layers.Ethernet{
+		SrcMAC:       srcHardwareAddr,
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeARP,
+	}
+	arpLayer := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   srcHardwareAddr,
+		SourceProtAddress: srcIP.To4(),
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    dstIP.To4(),
+	}
+
+	return []gopacket.SerializableLayer{ethernetLayer, arpLayer}, nil
+}
+
+func createNeighborSolicitation(srcHardwareAddr net.HardwareAddr, srcIP, dstIP net.IP) ([]gopacket.SerializableLayer, error) {
+	if len(srcHardwareAddr) != 6 {
+		return nil, errors.New("missing hardware address")
+	}
+
+	// Solicited-node multicast address
+	dstIP = dstIP.To16()
+	multicastIP := net.ParseIP("ff02::1:ff00:0")
+	copy(multicastIP[13:], dstIP[13:])
+	multicastHardwareAddr := net.HardwareAddr{0x33, 0x33, multicastIP[12], multicastIP[13], multicastIP[14], multicastIP[15]}
+
+	ethernetLayer := &layers.Ethernet{
+		SrcMAC:       srcHardwareAddr,
+		DstMAC:       multicastHardwareAddr,
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ipv6Layer := &layers.IPv6{
+		Version:    6,
+		NextHeader: layers.IPProtocolICMPv6,
+		HopLimit:   255,
+		SrcIP:      srcIP,
+		DstIP:      multicastIP,
+	}
+	icmpv6Layer := &layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborSolicitation, 0),
+	}
+	err := icmpv6Layer.SetNetworkLayerForChecksum(ipv6Layer)
+	if err != nil {
+		return nil, fmt.Errorf("set network layer for checksum: %w", err)
+	}
+	solicitationLayer := &layers.ICMPv6NeighborSolicitation{
+		TargetAddress: dstIP,
+		Options: layers.ICMPv6Options{
+			layers.ICMPv6Option{Type: layers.ICMPv6OptSourceAddress, Data: srcHardwareAddr},
+		},
+	}
+
+	return []gopacket.SerializableLayer{ethernetLayer, ipv6Layer, icmpv6Layer, solicitationLayer}, nil
+}
+
+// tagRequest inserts an 802.1Q header after the Ethernet layer of the request.
+func tagRequest(requestLayers []gopacket.SerializableLayer, vlan uint16) []gopacket.SerializableLayer {
+	ethernetLayer := requestLayers[0].(*layers.Ethernet)
+	dot1qLayer := &layers.Dot1Q{
+		VLANIdentifier: vlan,
+		Type:           ethernetLayer.EthernetType,
+	}
+	ethernetLayer.EthernetType = layers.EthernetTypeDot1Q
+
+	result := []gopacket.SerializableLayer{ethernetLayer, dot1qLayer}
+
+	return append(result, requestLayers[1:]...)
+}
+
+func parseResolveReply(packet gopacket.Packet, ip net.IP) net.HardwareAddr {
+	// ARP
+	arpLayer, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP)
+	if ok {
+		if arpLayer.Operation != layers.ARPReply || !net.IP(arpLayer.SourceProtAddress).Equal(ip) {
+			return nil
+		}
+
+		return net.HardwareAddr(arpLayer.SourceHwAddress)
+	}
+
+	// NDP
+	advertisementLayer, ok := packet.Layer(layers.LayerTypeICMPv6NeighborAdvertisement).(*layers.ICMPv6NeighborAdvertisement)
+	if ok {
+		if !advertisementLayer.TargetAddress.Equal(ip) {
+			return nil
+		}
+
+		for _, option := range advertisementLayer.Options {
+			if option.Type == layers.ICMPv6OptTargetAddress && len(option.Data) == 6 {
+				return net.HardwareAddr(option.Data)
+			}
+		}
+
+		// Fall back to the source of the link layer
+		ethernetLayer, ok := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+		if ok {
+			return ethernetLayer.SrcMAC
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package pcap
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// TokenSize is the size of a token of resumption.
+const TokenSize = 16
+
+// IssueToken generates a token of resumption, which is issued to the peer once framing is negotiated in version 5 or
+// later. The peer presents the token in hello when it connects again, even from another address.
+func (c *FrameConn) IssueToken() error {
+	token := make([]byte, TokenSize)
+	_, err := rand.Read(token)
+	if err != nil {
+		return fmt.Errorf("generate token: %w", err)
+	}
+
+	c.lock.Lock()
+	c.token = token
+	c.lock.Unlock()
+
+	return nil
+}
+
+// Token returns the token of resumption issued to the peer, or the one issued by the peer if the connection initiates
+// hello, nil if there is not.
+func (c *FrameConn) Token() []byte {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.token
+}
+
+// SetToken sets the token of resumption presented to the peer in hello, which is replaced once the peer issues another
+// one.
+func (c *FrameConn) SetToken(token []byte) error {
+	if len(token) != 0 && len(token) != TokenSize {
+		return fmt.Errorf("token size %d out of range", len(token))
+	}
+
+	c.lock.Lock()
+	c.token = token
+	c.lock.Unlock()
+
+	return nil
+}
+
+// PeerToken returns the token of resumption presented by the peer, nil if the peer does not present one.
+func (c *FrameConn) PeerToken() []byte {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.peerToken
+}
+
+func (c *FrameConn) handleToken(frame *Frame) error {
+	if len(frame.Payload) != TokenSize {
+		return fmt.Errorf("token size %d out of range", len(frame.Payload))
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Only peers replying hello issue tokens
+	if !c.initiator {
+		return nil
+	}
+	c.token = append([]byte(nil), frame.Payload...)
+
+	return nil
+}
+
+func (c *FrameConn) handleResume(frame *Frame) error {
+	if len(frame.Payload) != TokenSize {
+		return fmt.Errorf("token size %d out of range", len(frame.Payload))
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Only peers initiating hello present tokens
+	if c.initiator {
+		return nil
+	}
+	c.peerToken = append([]byte(nil), frame.Payload...)
+
+	return nil
+}
+
+// Token returns the token of resumption issued by the server, nil if there is not. The token of the path in the
+// upstream device is returned in multipath.
+func (c *TunnelConn) Token() []byte {
+	conn := c.Conn
+
+	multipathConn, ok := conn.(*MultipathConn)
+	if ok {
+		conn = multipathConn.Paths()[0]
+	}
+
+	frameConn, ok := conn.(*FrameConn)
+	if !ok {
+		return nil
+	}
+
+	return frameConn.Token()
+}
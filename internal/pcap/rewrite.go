@@ -0,0 +1,324 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+)
+
+// Rewritten describes layers of a packet rewritten in NAT, which are serialized in order.
+type Rewritten struct {
+	NetworkLayer    gopacket.NetworkLayer
+	TransportLayer  gopacket.Layer
+	ICMPv6EchoLayer *layers.ICMPv6Echo
+	Payload         []byte
+}
+
+// RewriteSrc returns the packet from a client rewritten to leave from the sink, whose source is the address of the
+// local device of the sink in its family, and the port or the Id of the value. ICMPv4 errors quoting packets to the
+// client are rewritten to quote packets to the sink. If decrementTTL is set, the TTL or the hop limit is decremented.
+func RewriteSrc(indicator *PacketIndicator, sink PacketSink, value uint16, decrementTTL bool) (*Rewritten, error) {
+	var err error
+
+	r := &Rewritten{Payload: indicator.Payload()}
+
+	r.TransportLayer, r.ICMPv6EchoLayer, err = RewriteSrcTransport(indicator, sink, value)
+	if err != nil {
+		return nil, fmt.Errorf("create transport layer: %w", err)
+	}
+	r.setQuote()
+
+	// Create new network layer
+	switch t := indicator.NetworkLayer().LayerType(); t {
+	case layers.LayerTypeIPv4:
+		ipv4Addr := sink.LocalDev().IPv4Addr()
+		if ipv4Addr == nil {
+			return nil, fmt.Errorf("missing ipv4 address of device %s", sink.LocalDev().Alias())
+		}
+
+		temp := *indicator.IPv4Layer()
+		temp.SrcIP = ipv4Addr.IP
+		if decrementTTL {
+			temp.TTL--
+		}
+		r.NetworkLayer = &temp
+	case layers.LayerTypeIPv6:
+		ipv6Addr := sink.LocalDev().IPv6Addr()
+		if ipv6Addr == nil {
+			return nil, fmt.Errorf("missing ipv6 address of device %s", sink.LocalDev().Alias())
+		}
+
+		temp := *indicator.IPv6Layer()
+		temp.SrcIP = ipv6Addr.IP
+		if decrementTTL {
+			temp.HopLimit--
+		}
+		r.NetworkLayer = &temp
+	default:
+		return nil, NewError(ErrUnsupportedLayer, "network layer type %s not support", t)
+	}
+
+	err = r.SetNetworkLayerForChecksum()
+	if err != nil {
+		return nil, fmt.Errorf("set network layer for checksum: %w", err)
+	}
+
+	return r, nil
+}
+
+// RewriteSrcTransport returns the transport layer of the packet from a client rewritten to leave from the port or the
+// Id of the value in the sink, and the ICMPv6 echo layer if it is an ICMPv6 echo message. Packets without transport
+// layers, like fragments, have neither.
+func RewriteSrcTransport(indicator *PacketIndicator, sink PacketSink, value uint16) (gopacket.Layer, *layers.ICMPv6Echo, error) {
+	if indicator.TransportLayer() == nil {
+		return nil, nil, nil
+	}
+
+	switch t := indicator.TransportLayer().LayerType(); t {
+	case layers.LayerTypeTCP:
+		temp := *indicator.TCPLayer()
+		temp.SrcPort = layers.TCPPort(value)
+
+		return &temp, nil, nil
+	case layers.LayerTypeUDP:
+		temp := *indicator.UDPLayer()
+		temp.SrcPort = layers.UDPPort(value)
+
+		return &temp, nil, nil
+	case layers.LayerTypeICMPv4:
+		if indicator.ICMPv4Indicator().IsQuery() {
+			temp := *indicator.ICMPv4Indicator().ICMPv4Layer()
+			temp.Id = value
+
+			return &temp, nil, nil
+		}
+
+		ipv4Addr := sink.LocalDev().IPv4Addr()
+		if ipv4Addr == nil {
+			return nil, nil, fmt.Errorf("missing ipv4 address of device %s", sink.LocalDev().Alias())
+		}
+
+		layer, err := rewriteICMPv4Error(indicator.ICMPv4Indicator(), nil, ipv4Addr.IP, value)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return layer, nil, nil
+	case layers.LayerTypeICMPv6:
+		return indicator.ICMPv6Indicator().NewPureICMPv6Layer(), indicator.ICMPv6Indicator().NewEchoLayer(value), nil
+	case LayerTypeOpaque:
+		return indicator.OpaqueLayer(), nil, nil
+	default:
+		return nil, nil, NewError(ErrUnsupportedLayer, "transport layer type %s not support", t)
+	}
+}
+
+// RewriteDst returns the reply to a client rewritten back to the source of the client, whose destination is the IP
+// and the port or the Id of the value. ICMPv4 errors quoting packets from the sink are rewritten to quote packets
+// from the client.
+func RewriteDst(indicator *PacketIndicator, ip net.IP, value uint16) (*Rewritten, error) {
+	var err error
+
+	r := &Rewritten{Payload: indicator.Payload()}
+
+	r.TransportLayer, r.ICMPv6EchoLayer, err = RewriteDstTransport(indicator, ip, value)
+	if err != nil {
+		return nil, fmt.Errorf("create transport layer: %w", err)
+	}
+	r.setQuote()
+
+	// Create new network layer
+	switch t := indicator.NetworkLayer().LayerType(); t {
+	case layers.LayerTypeIPv4:
+		temp := *indicator.IPv4Layer()
+		temp.DstIP = ip
+		r.NetworkLayer = &temp
+	case layers.LayerTypeIPv6:
+		temp := *indicator.IPv6Layer()
+		temp.DstIP = ip
+		r.NetworkLayer = &temp
+	default:
+		return nil, NewError(ErrUnsupportedLayer, "network layer type %s not support", t)
+	}
+
+	err = r.SetNetworkLayerForChecksum()
+	if err != nil {
+		return nil, fmt.Errorf("set network layer for checksum: %w", err)
+	}
+
+	return r, nil
+}
+
+// RewriteDstTransport returns the transport layer of the reply to a client rewritten back to the port or the Id of
+// the value, and the ICMPv6 echo layer if it is an ICMPv6 echo message. ICMPv4 errors quote packets from the IP.
+// Packets without transport layers, like fragments, have neither.
+func RewriteDstTransport(indicator *PacketIndicator, ip net.IP, value uint16) (gopacket.Layer, *layers.ICMPv6Echo, error) {
+	if indicator.TransportLayer() == nil {
+		return nil, nil, nil
+	}
+
+	switch t := indicator.TransportLayer().LayerType(); t {
+	case layers.LayerTypeTCP:
+		temp := *indicator.TCPLayer()
+		temp.DstPort = layers.TCPPort(value)
+
+		return &temp, nil, nil
+	case layers.LayerTypeUDP:
+		temp := *indicator.UDPLayer()
+		temp.DstPort = layers.UDPPort(value)
+
+		return &temp, nil, nil
+	case layers.LayerTypeICMPv4:
+		if indicator.ICMPv4Indicator().IsQuery() {
+			temp := *indicator.ICMPv4Indicator().ICMPv4Layer()
+			temp.Id = value
+
+			return &temp, nil, nil
+		}
+
+		layer, err := rewriteICMPv4Error(indicator.ICMPv4Indicator(), ip, nil, value)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return layer, nil, nil
+	case layers.LayerTypeICMPv6:
+		return indicator.ICMPv6Indicator().NewPureICMPv6Layer(), indicator.ICMPv6Indicator().NewEchoLayer(value), nil
+	case LayerTypeOpaque:
+		return indicator.OpaqueLayer(), nil, nil
+	default:
+		return nil, nil, NewError(ErrUnsupportedLayer, "transport layer type %s not support", t)
+	}
+}
+
+// rewriteICMPv4Error returns the ICMPv4 error whose quoted packet is rewritten. If srcIP is set, the quoted packet is
+// from the IP and the port or the Id of the value, otherwise it is to dstIP and the port or the Id of the value.
+func rewriteICMPv4Error(indicator *ICMPv4Indicator, srcIP, dstIP net.IP, value uint16) (*layers.ICMPv4, error) {
+	var err error
+
+	newICMPv4Layer := indicator.NewPureICMPv4Layer()
+
+	temp := *indicator.EmbIPv4Layer()
+	newEmbIPv4Layer := &temp
+	if srcIP != nil {
+		newEmbIPv4Layer.SrcIP = srcIP
+	} else {
+		newEmbIPv4Layer.DstIP = dstIP
+	}
+
+	var newEmbTransportLayer gopacket.Layer
+	switch t := indicator.EmbTransportLayer().LayerType(); t {
+	case layers.LayerTypeTCP:
+		temp := *indicator.EmbTCPLayer()
+		if srcIP != nil {
+			temp.SrcPort = layers.TCPPort(value)
+		} else {
+			temp.DstPort = layers.TCPPort(value)
+		}
+		newEmbTransportLayer = &temp
+
+		err = temp.SetNetworkLayerForChecksum(newEmbIPv4Layer)
+	case layers.LayerTypeUDP:
+		temp := *indicator.EmbUDPLayer()
+		if srcIP != nil {
+			temp.SrcPort = layers.UDPPort(value)
+		} else {
+			temp.DstPort = layers.UDPPort(value)
+		}
+		newEmbTransportLayer = &temp
+
+		err = temp.SetNetworkLayerForChecksum(newEmbIPv4Layer)
+	case layers.LayerTypeICMPv4:
+		temp := *indicator.EmbICMPv4Layer()
+		if indicator.IsEmbQuery() {
+			temp.Id = value
+		}
+		newEmbTransportLayer = &temp
+	default:
+		return nil, NewError(ErrUnsupportedLayer, "transport layer type %s not support", t)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("set network layer for checksum: %w", err)
+	}
+
+	payload, err := Serialize(newEmbIPv4Layer, newEmbTransportLayer.(gopacket.SerializableLayer),
+		gopacket.Payload(indicator.EmbTransportLayer().LayerPayload()))
+	if err != nil {
+		return nil, fmt.Errorf("serialize: %w", err)
+	}
+
+	newICMPv4Layer.Payload = payload
+
+	return newICMPv4Layer, nil
+}
+
+// setQuote takes the quoted packet rewritten in an ICMPv4 error as the payload, as ICMPv4 layers serialize their
+// headers only.
+func (r *Rewritten) setQuote() {
+	if r.TransportLayer == nil || r.TransportLayer.LayerType() != layers.LayerTypeICMPv4 {
+		return
+	}
+
+	layer := r.TransportLayer.(*layers.ICMPv4)
+	if layer.Payload != nil {
+		r.Payload = layer.Payload
+	}
+}
+
+// SetNetworkLayerForChecksum sets the network layer for computing the checksum of the transport layer.
+func (r *Rewritten) SetNetworkLayerForChecksum() error {
+	if r.TransportLayer == nil {
+		return nil
+	}
+
+	switch t := r.TransportLayer.LayerType(); t {
+	case layers.LayerTypeTCP:
+		return r.TransportLayer.(*layers.TCP).SetNetworkLayerForChecksum(r.NetworkLayer)
+	case layers.LayerTypeUDP:
+		return r.TransportLayer.(*layers.UDP).SetNetworkLayerForChecksum(r.NetworkLayer)
+	case layers.LayerTypeICMPv4, LayerTypeOpaque:
+		return nil
+	case layers.LayerTypeICMPv6:
+		return r.TransportLayer.(*layers.ICMPv6).SetNetworkLayerForChecksum(r.NetworkLayer)
+	default:
+		return NewError(ErrUnsupportedLayer, "transport layer type %s not support", t)
+	}
+}
+
+// SrcIP returns the source IP of the packet.
+func (r *Rewritten) SrcIP() net.IP {
+	return r.NetworkLayer.NetworkFlow().Src().Raw()
+}
+
+// Serialize serializes the packet behind the link layer, which is nil for embedded packets.
+func (r *Rewritten) Serialize(linkLayer gopacket.SerializableLayer) ([]byte, error) {
+	l := make([]gopacket.SerializableLayer, 0, 5)
+	if linkLayer != nil {
+		l = append(l, linkLayer)
+	}
+	l = append(l, r.NetworkLayer.(gopacket.SerializableLayer))
+	if r.TransportLayer != nil {
+		l = append(l, r.TransportLayer.(gopacket.SerializableLayer))
+	}
+	if r.ICMPv6EchoLayer != nil {
+		l = append(l, r.ICMPv6EchoLayer)
+	}
+	l = append(l, gopacket.Payload(r.Payload))
+
+	return Serialize(l...)
+}
+
+// Fragment serializes the packet behind the link layer in fragments of the size.
+func (r *Rewritten) Fragment(linkLayer gopacket.SerializableLayer, size int) ([][]byte, error) {
+	var payload gopacket.Layer = gopacket.Payload(r.Payload)
+	if r.ICMPv6EchoLayer != nil {
+		b, err := Serialize(r.ICMPv6EchoLayer, gopacket.Payload(r.Payload))
+		if err != nil {
+			return nil, fmt.Errorf("serialize: %w", err)
+		}
+		payload = gopacket.Payload(b)
+	}
+
+	return CreateFragmentPackets(linkLayer, r.NetworkLayer, r.TransportLayer, payload, size)
+}
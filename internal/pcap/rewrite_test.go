@@ -0,0 +1,364 @@
+package pcap
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	testClientIP   = net.IPv4(10, 0, 0, 2).To4()
+	testServerIP   = net.IPv4(192, 168, 1, 2).To4()
+	testRemoteIP   = net.IPv4(1, 1, 1, 1).To4()
+	testServerHW   = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	testGatewayHW  = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+	testPayload    = []byte("ikago")
+	testClientPort = uint16(1234)
+	testValue      = uint16(40000)
+)
+
+// testUpConn returns a connection in memory from the server to the gateway.
+func testUpConn() *MemConn {
+	srcDev := NewDevice("eth0", []*net.IPNet{{IP: testServerIP, Mask: net.CIDRMask(24, 32)}}, testServerHW, false)
+	dstDev := NewDevice("gateway", nil, testGatewayHW, false)
+
+	return NewMemConn(srcDev, dstDev, layers.LinkTypeEthernet)
+}
+
+// testTCPPacket returns a TCP segment carrying the test payload without link layers.
+func testTCPPacket(tb testing.TB, srcIP, dstIP net.IP, srcPort, dstPort uint16) []byte {
+	transportLayer := CreateTCPLayer(srcPort, dstPort, 1, 1)
+	networkLayer, err := CreateIPv4Layer(srcIP, dstIP, 1, 64, transportLayer)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	err = transportLayer.SetNetworkLayerForChecksum(networkLayer)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	data, err := Serialize(networkLayer, transportLayer, gopacket.Payload(testPayload))
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return data
+}
+
+// writeAndRead writes the packet behind a link layer to the connection, and reads it back as it is captured.
+func writeAndRead(t *testing.T, conn *MemConn, r *Rewritten) *PacketIndicator {
+	linkLayer, err := CreateLinkLayer(conn, conn.RemoteDev().HardwareAddr(), r.NetworkLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := r.Serialize(linkLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := conn.Take()
+	if len(out) != 1 {
+		t.Fatalf("written %d packets", len(out))
+	}
+	err = conn.Feed(out[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := conn.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	indicator, err := ParsePacket(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = indicator.VerifyChecksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return indicator
+}
+
+func TestRewriteSrc(t *testing.T) {
+	conn := testUpConn()
+	defer conn.Close()
+
+	embIndicator, err := ParseEmbPacket(testTCPPacket(t, testClientIP, testRemoteIP, testClientPort, 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := RewriteSrc(embIndicator, conn, testValue, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.SrcIP().Equal(testServerIP) {
+		t.Fatalf("source %s", r.SrcIP())
+	}
+
+	indicator := writeAndRead(t, conn, r)
+	if !bytes.Equal(indicator.SrcHardwareAddr(), testServerHW) || !bytes.Equal(indicator.DstHardwareAddr(), testGatewayHW) {
+		t.Fatalf("link %s -> %s", indicator.SrcHardwareAddr(), indicator.DstHardwareAddr())
+	}
+	if !indicator.SrcIP().Equal(testServerIP) || indicator.SrcPort() != testValue {
+		t.Fatalf("source %s:%d", indicator.SrcIP(), indicator.SrcPort())
+	}
+	if !indicator.DstIP().Equal(testRemoteIP) || indicator.DstPort() != 80 {
+		t.Fatalf("destination %s:%d", indicator.DstIP(), indicator.DstPort())
+	}
+	if indicator.TTL() != 63 {
+		t.Fatalf("ttl %d", indicator.TTL())
+	}
+	if !bytes.Equal(indicator.Payload(), testPayload) {
+		t.Fatalf("payload %x", indicator.Payload())
+	}
+}
+
+func TestRewriteSrcMissingAddr(t *testing.T) {
+	conn := testUpConn()
+	defer conn.Close()
+
+	transportLayer := CreateUDPLayer(testClientPort, 53)
+	networkLayer, err := CreateIPv6Layer(net.ParseIP("fd00::2"), net.ParseIP("2001:db8::1"), 64, transportLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = transportLayer.SetNetworkLayerForChecksum(networkLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Serialize(networkLayer, transportLayer, gopacket.Payload(testPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	embIndicator, err := ParseEmbPacket(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = RewriteSrc(embIndicator, conn, testValue, false)
+	if err == nil {
+		t.Fatal("rewritten without ipv6 address")
+	}
+}
+
+func TestRewriteDst(t *testing.T) {
+	conn := testUpConn()
+	defer conn.Close()
+
+	// Reply from the remote to the server
+	transportLayer := CreateTCPLayer(80, testValue, 1, 2)
+	networkLayer, err := CreateIPv4Layer(testRemoteIP, testServerIP, 1, 64, transportLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = transportLayer.SetNetworkLayerForChecksum(networkLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linkLayer, err := CreateEthernetLayer(testGatewayHW, testServerHW, 0, networkLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Serialize(linkLayer, networkLayer, transportLayer, gopacket.Payload(testPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.Feed(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := conn.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	indicator, err := ParsePacket(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := RewriteDst(indicator, testClientIP, testClientPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = r.Serialize(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	embIndicator, err := ParseEmbPacket(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = embIndicator.VerifyChecksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !embIndicator.SrcIP().Equal(testRemoteIP) || embIndicator.SrcPort() != 80 {
+		t.Fatalf("source %s:%d", embIndicator.SrcIP(), embIndicator.SrcPort())
+	}
+	if !embIndicator.DstIP().Equal(testClientIP) || embIndicator.DstPort() != testClientPort {
+		t.Fatalf("destination %s:%d", embIndicator.DstIP(), embIndicator.DstPort())
+	}
+	if !bytes.Equal(embIndicator.Payload(), testPayload) {
+		t.Fatalf("payload %x", embIndicator.Payload())
+	}
+}
+
+func TestRewriteDstICMPv4Error(t *testing.T) {
+	conn := testUpConn()
+	defer conn.Close()
+
+	// Destination unreachable from the remote quoting a whole segment from the server, as Linux does
+	quoted := testTCPPacket(t, testServerIP, testRemoteIP, testValue, 80)
+	icmpLayer := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort)}
+	networkLayer := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolICMPv4,
+		SrcIP:    testRemoteIP,
+		DstIP:    testServerIP,
+	}
+	linkLayer, err := CreateEthernetLayer(testGatewayHW, testServerHW, 0, networkLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Serialize(linkLayer, networkLayer, icmpLayer, gopacket.Payload(quoted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.Feed(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := conn.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	indicator, err := ParsePacket(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := RewriteDst(indicator, testClientIP, testClientPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = r.Serialize(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	embIndicator, err := ParseEmbPacket(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !embIndicator.DstIP().Equal(testClientIP) {
+		t.Fatalf("destination %s", embIndicator.DstIP())
+	}
+	icmpv4Indicator := embIndicator.ICMPv4Indicator()
+	if icmpv4Indicator == nil || icmpv4Indicator.IsQuery() {
+		t.Fatal("not an icmpv4 error")
+	}
+	if !icmpv4Indicator.EmbSrcIP().Equal(testClientIP) || icmpv4Indicator.EmbSrcPort() != testClientPort {
+		t.Fatalf("quoted source %s:%d", icmpv4Indicator.EmbSrcIP(), icmpv4Indicator.EmbSrcPort())
+	}
+	if !icmpv4Indicator.EmbDstIP().Equal(testRemoteIP) || icmpv4Indicator.EmbDstPort() != 80 {
+		t.Fatalf("quoted destination %s:%d", icmpv4Indicator.EmbDstIP(), icmpv4Indicator.EmbDstPort())
+	}
+}
+
+// benchmarkPayload is the payload of packets in benchmarks, which is about the size of a full segment.
+var benchmarkPayload = make([]byte, 1400)
+
+// BenchmarkRewriteSrc measures the path of packets from clients to remotes: an embedded packet is parsed, rewritten to
+// leave from the server and serialized behind a link layer.
+func BenchmarkRewriteSrc(b *testing.B) {
+	conn := testUpConn()
+	defer conn.Close()
+
+	transportLayer := CreateTCPLayer(testClientPort, 80, 1, 1)
+	networkLayer, err := CreateIPv4Layer(testClientIP, testRemoteIP, 1, 64, transportLayer)
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = transportLayer.SetNetworkLayerForChecksum(networkLayer)
+	if err != nil {
+		b.Fatal(err)
+	}
+	data, err := Serialize(networkLayer, transportLayer, gopacket.Payload(benchmarkPayload))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		embIndicator, err := ParseEmbPacket(data)
+		if err != nil {
+			b.Fatal(err)
+		}
+		r, err := RewriteSrc(embIndicator, conn, testValue, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		linkLayer, err := CreateLinkLayer(conn, testGatewayHW, r.NetworkLayer)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = r.Serialize(linkLayer)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkRewriteDst measures the path of packets from remotes to clients: a captured frame is parsed, rewritten back
+// to the client and serialized to be embedded.
+func BenchmarkRewriteDst(b *testing.B) {
+	transportLayer := CreateTCPLayer(80, testValue, 1, 2)
+	networkLayer, err := CreateIPv4Layer(testRemoteIP, testServerIP, 1, 64, transportLayer)
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = transportLayer.SetNetworkLayerForChecksum(networkLayer)
+	if err != nil {
+		b.Fatal(err)
+	}
+	linkLayer, err := CreateEthernetLayer(testGatewayHW, testServerHW, 0, networkLayer)
+	if err != nil {
+		b.Fatal(err)
+	}
+	data, err := Serialize(linkLayer, networkLayer, transportLayer, gopacket.Payload(benchmarkPayload))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		packet := gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.NoCopy)
+		indicator, err := ParsePacket(packet)
+		if err != nil {
+			b.Fatal(err)
+		}
+		r, err := RewriteDst(indicator, testClientIP, testClientPort)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = r.Serialize(nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Segment splits a TCP packet whose network layer exceeds the MTU, like a super-frame produced by TSO or GRO, into
+// packets fitting in the MTU. Other packets are returned as is.
+func Segment(packet gopacket.Packet, mtu int) ([]gopacket.Packet, error) {
+	indicator, err := ParsePacket(packet)
+	if err != nil {
+		return nil, fmt.Errorf("parse packet: %w", err)
+	}
+
+	if indicator.MTU() <= mtu || indicator.IsFrag() || indicator.TCPLayer() == nil {
+		return []gopacket.Packet{packet}, nil
+	}
+	if indicator.IPv6Layer() != nil && indicator.IPv6Layer().NextHeader != layers.IPProtocolTCP {
+		// IPv6 extension headers are not supported
+		return []gopacket.Packet{packet}, nil
+	}
+
+	tcpLayer := indicator.TCPLayer()
+	mss := mtu - len(indicator.NetworkLayer().LayerContents()) - len(tcpLayer.Contents)
+	if mss <= 0 {
+		return nil, fmt.Errorf("mtu %d too small", mtu)
+	}
+
+	// Link layers are reused as is
+	linkLayers := make([]gopacket.SerializableLayer, 0)
+	if indicator.LinkLayer() != nil {
+		linkLayers = append(linkLayers, indicator.LinkLayer().(gopacket.SerializableLayer))
+	}
+	if indicator.Dot1QLayer() != nil {
+		linkLayers = append(linkLayers, indicator.Dot1QLayer())
+	}
+	if indicator.PPPoELayer() != nil {
+		linkLayers = append(linkLayers, indicator.PPPoELayer(), indicator.PPPLayer())
+	}
+
+	payload := tcpLayer.Payload
+	result := make([]gopacket.Packet, 0, (len(payload)+mss-1)/mss)
+	for i := 0; i < len(payload); i = i + mss {
+		j := min(i+mss, len(payload))
+		isLast := j >= len(payload)
+
+		// Transport layer
+		temp := *tcpLayer
+		newTCPLayer := &temp
+		newTCPLayer.Seq = tcpLayer.Seq + uint32(i)
+		newTCPLayer.FIN = tcpLayer.FIN && isLast
+		newTCPLayer.PSH = tcpLayer.PSH && isLast
+		newTCPLayer.CWR = tcpLayer.CWR && i == 0
+
+		// Network layer
+		var newNetworkLayer gopacket.NetworkLayer
+		if indicator.IPv4Layer() != nil {
+			temp := *indicator.IPv4Layer()
+			temp.Id = indicator.IPv4Layer().Id + uint16(i/mss)
+			newNetworkLayer = &temp
+		} else {
+			temp := *indicator.IPv6Layer()
+			newNetworkLayer = &temp
+		}
+
+		err := newTCPLayer.SetNetworkLayerForChecksum(newNetworkLayer)
+		if err != nil {
+			return nil, fmt.Errorf("set network layer for checksum: %w", err)
+		}
+
+		layers := append(append(make([]gopacket.SerializableLayer, 0), linkLayers...),
+			newNetworkLayer.(gopacket.SerializableLayer), newTCPLayer, gopacket.Payload(payload[i:j]))
+		data, err := Serialize(layers...)
+		if err != nil {
+			return nil, fmt.Errorf("serialize: %w", err)
+		}
+
+		result = append(result, gopacket.NewPacket(data, packet.Layers()[0].LayerType(), gopacket.NoCopy))
+	}
+
+	logger.Verbosef("Segment a %d Bytes TCP packet %s -> %s into %d packets\n",
+		indicator.MTU(), indicator.Src().String(), indicator.Dst().String(), len(result))
+
+	return result, nil
+}
@@ -0,0 +1,26 @@
+package pcap
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket/layers"
+)
+
+// sender describes a socket which sends packet data with link layers in a device, which is used instead of injecting
+// by pcap when it fails, like in containers or restricted kernels.
+type sender interface {
+	// Send sends the packet data.
+	Send(b []byte) error
+	// Close closes the socket.
+	Close() error
+}
+
+// openSender returns a sender in the device of the link type.
+func openSender(dev string, t layers.LinkType) (sender, error) {
+	s, err := openPlatformSender(dev, t)
+	if err != nil {
+		return nil, fmt.Errorf("open sender in device %s: %w", dev, err)
+	}
+
+	return s, nil
+}
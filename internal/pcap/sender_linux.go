@@ -0,0 +1,45 @@
+package pcap
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/google/gopacket/layers"
+)
+
+// packetSender is a sender of an AF_PACKET socket, which sends packet data with Ethernet layers as they are.
+type packetSender struct {
+	fd   int
+	addr *syscall.SockaddrLinklayer
+}
+
+func openPlatformSender(dev string, t layers.LinkType) (sender, error) {
+	if t != layers.LinkTypeEthernet {
+		return nil, NewError(ErrUnsupportedLayer, "link type %s not support", t)
+	}
+
+	iface, err := net.InterfaceByName(dev)
+	if err != nil {
+		return nil, fmt.Errorf("find interface: %w", err)
+	}
+
+	// Protocol 0 receives nothing, so the socket is only for sending
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("socket: %w", err)
+	}
+
+	return &packetSender{
+		fd:   fd,
+		addr: &syscall.SockaddrLinklayer{Ifindex: iface.Index},
+	}, nil
+}
+
+func (s *packetSender) Send(b []byte) error {
+	return syscall.Sendto(s.fd, b, 0, s.addr)
+}
+
+func (s *packetSender) Close() error {
+	return syscall.Close(s.fd)
+}
@@ -0,0 +1,14 @@
+// +build !linux
+
+package pcap
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/google/gopacket/layers"
+)
+
+func openPlatformSender(dev string, t layers.LinkType) (sender, error) {
+	return nil, fmt.Errorf("os %s not support", runtime.GOOS)
+}
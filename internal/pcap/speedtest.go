@@ -0,0 +1,229 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// SpeedTestPort is the port of the echo service of the server in speed tests.
+	SpeedTestPort = 7
+	// speedTestHeaderSize is the size of the sequence number in the payload of a speed test packet.
+	speedTestHeaderSize = 4
+	// speedTestOverhead is the size of IPv4 and UDP headers of a speed test packet.
+	speedTestOverhead = 28
+)
+
+var (
+	// speedTestServerIP is the address of the echo service of the server in speed tests, which is in the block for
+	// benchmarking, so it is never routed to a destination.
+	speedTestServerIP = net.IPv4(198, 18, 0, 1).To4()
+	// speedTestClientIP is the address of the client in speed tests, which is in the block for benchmarking, so
+	// replies are never mistaken for packets to sources.
+	speedTestClientIP = net.IPv4(198, 18, 0, 2).To4()
+)
+
+// IsSpeedTestRequest returns if the embedded packet is a request of speed tests to the echo service of the server.
+func IsSpeedTestRequest(indicator *PacketIndicator) bool {
+	return indicator.NetworkLayer().LayerType() == layers.LayerTypeIPv4 && !indicator.IsFrag() &&
+		indicator.TransportProtocol() == layers.LayerTypeUDP && indicator.DstIP().Equal(speedTestServerIP) &&
+		indicator.DstPort() == SpeedTestPort
+}
+
+// IsSpeedTestReply returns if the embedded packet is a reply of speed tests from the echo service of the server.
+func IsSpeedTestReply(indicator *PacketIndicator) bool {
+	return indicator.NetworkLayer().LayerType() == layers.LayerTypeIPv4 && !indicator.IsFrag() &&
+		indicator.TransportProtocol() == layers.LayerTypeUDP && indicator.SrcIP().Equal(speedTestServerIP) &&
+		indicator.SrcPort() == SpeedTestPort
+}
+
+// CreateSpeedTestReply returns the embedded packet echoing the request of speed tests.
+func CreateSpeedTestReply(indicator *PacketIndicator) ([]byte, error) {
+	if !IsSpeedTestRequest(indicator) {
+		return nil, errors.New("not a speed test request")
+	}
+
+	ipv4Layer := *indicator.IPv4Layer()
+	ipv4Layer.SrcIP, ipv4Layer.DstIP = ipv4Layer.DstIP, ipv4Layer.SrcIP
+
+	udpLayer := *indicator.UDPLayer()
+	udpLayer.SrcPort, udpLayer.DstPort = udpLayer.DstPort, udpLayer.SrcPort
+	err := udpLayer.SetNetworkLayerForChecksum(&ipv4Layer)
+	if err != nil {
+		return nil, fmt.Errorf("set network layer for checksum: %w", err)
+	}
+
+	return Serialize(&ipv4Layer, &udpLayer, gopacket.Payload(udpLayer.Payload))
+}
+
+// SpeedTestResult describes the result of a speed test.
+type SpeedTestResult struct {
+	Sent     uint64
+	Received uint64
+	Lost     uint64
+	// Size is the size of embedded packets received in Bytes.
+	Size   uint64
+	MinRTT time.Duration
+	AvgRTT time.Duration
+	MaxRTT time.Duration
+}
+
+// Loss returns the ratio of packets lost.
+func (result SpeedTestResult) Loss() float64 {
+	if result.Sent <= 0 {
+		return 0
+	}
+
+	return float64(result.Lost) / float64(result.Sent)
+}
+
+// Throughput returns the throughput in bits per second of packets received in the duration.
+func (result SpeedTestResult) Throughput(d time.Duration) uint64 {
+	if d <= 0 {
+		return 0
+	}
+
+	return uint64(float64(result.Size*8) / d.Seconds())
+}
+
+// SpeedTest describes a speed test which exchanges embedded packets with the echo service of the server. Packets in
+// flight are limited by the window, and a packet not echoed in the timeout is counted as lost, so the tunnel is
+// saturated without overflowing queues in the path.
+type SpeedTest struct {
+	lock    sync.Mutex
+	size    int
+	window  int
+	timeout time.Duration
+	seq     uint32
+	pending map[uint32]time.Time
+	result  SpeedTestResult
+	rttSum  time.Duration
+}
+
+// NewSpeedTest returns a speed test of embedded packets in the size, with the window of packets in flight and the
+// timeout of echoing.
+func NewSpeedTest(size, window int, timeout time.Duration) (*SpeedTest, error) {
+	if size < speedTestOverhead+speedTestHeaderSize || size > IPv4MaxSize {
+		return nil, fmt.Errorf("size %d out of range", size)
+	}
+	if window <= 0 {
+		return nil, fmt.Errorf("window %d out of range", window)
+	}
+
+	return &SpeedTest{
+		size:    size,
+		window:  window,
+		timeout: timeout,
+		pending: make(map[uint32]time.Time),
+	}, nil
+}
+
+// Next returns the next embedded packet to send, or nil if the window is full.
+func (t *SpeedTest) Next() ([]byte, error) {
+	now := time.Now()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if len(t.pending) >= t.window {
+		t.expire(now, t.timeout)
+		if len(t.pending) >= t.window {
+			return nil, nil
+		}
+	}
+
+	t.seq++
+	payload := make([]byte, t.size-speedTestOverhead)
+	binary.BigEndian.PutUint32(payload, t.seq)
+
+	ipv4Layer := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		Id:       uint16(t.seq),
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    speedTestClientIP,
+		DstIP:    speedTestServerIP,
+	}
+	udpLayer := &layers.UDP{
+		SrcPort: layers.UDPPort(49152 + t.seq%16384),
+		DstPort: SpeedTestPort,
+	}
+	err := udpLayer.SetNetworkLayerForChecksum(ipv4Layer)
+	if err != nil {
+		return nil, fmt.Errorf("set network layer for checksum: %w", err)
+	}
+
+	data, err := Serialize(ipv4Layer, udpLayer, gopacket.Payload(payload))
+	if err != nil {
+		return nil, fmt.Errorf("serialize: %w", err)
+	}
+
+	t.pending[t.seq] = now
+	t.result.Sent++
+
+	return data, nil
+}
+
+// Receive records the reply of the speed test.
+func (t *SpeedTest) Receive(indicator *PacketIndicator) {
+	now := time.Now()
+
+	payload := indicator.UDPLayer().Payload
+	if len(payload) < speedTestHeaderSize {
+		return
+	}
+	seq := binary.BigEndian.Uint32(payload)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	sent, ok := t.pending[seq]
+	if !ok {
+		return
+	}
+	delete(t.pending, seq)
+
+	rtt := now.Sub(sent)
+	if t.result.Received == 0 || rtt < t.result.MinRTT {
+		t.result.MinRTT = rtt
+	}
+	if rtt > t.result.MaxRTT {
+		t.result.MaxRTT = rtt
+	}
+	t.rttSum = t.rttSum + rtt
+	t.result.Received++
+	t.result.Size = t.result.Size + uint64(indicator.MTU())
+}
+
+// Result returns the result of the speed test, where packets still in flight are counted as lost.
+func (t *SpeedTest) Result() SpeedTestResult {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.expire(time.Now(), 0)
+
+	result := t.result
+	if result.Received > 0 {
+		result.AvgRTT = t.rttSum / time.Duration(result.Received)
+	}
+
+	return result
+}
+
+// expire counts packets sent before the timeout as lost.
+func (t *SpeedTest) expire(now time.Time, timeout time.Duration) {
+	for seq, sent := range t.pending {
+		if now.Sub(sent) >= timeout {
+			delete(t.pending, seq)
+			t.result.Lost++
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package pcap
+
+import (
+	"github.com/google/gopacket/layers"
+	"net"
+)
+
+// strictWindow is the max distance in Bytes of the TCP Seq of a segment from the expected one in strict mode.
+const strictWindow = 1 << 22
+
+var isStrict bool
+
+// SetStrict sets if FakeTCP connections only accept segments whose TCP Seq is in the window of the established
+// connection, so RSTs, FINs and data spoofed by off-path attackers are dropped. It should be called before any
+// connection is established.
+func SetStrict(strict bool) {
+	isStrict = strict
+}
+
+// isSpoofed returns if the TCP segment from the address is out of the window of the established connection in strict
+// mode. Segments of unknown or not established connections are left to handshaking.
+func (c *FakeTCPConn) isSpoofed(indicator *PacketIndicator, a net.Addr) bool {
+	if !isStrict || indicator.TransportLayer() == nil || indicator.TransportLayer().LayerType() != layers.LayerTypeTCP ||
+		indicator.IsSYN() {
+		return false
+	}
+
+	c.clientsLock.RLock()
+	client, ok := c.clients[a.String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if client.state != tcpStateEstablished {
+		return false
+	}
+	d := int32(indicator.TCPLayer().Seq - client.ack)
+
+	return d <= -strictWindow || d >= strictWindow
+}
+
+// IsSpoofedSrc returns if the IP cannot be the source of a packet from the other side of the tunnel, which is
+// unspecified, loopback, multicast, broadcast, or in the networks of the devices.
+func IsSpoofedSrc(ip net.IP, devs ...*Device) bool {
+	if ip.IsUnspecified() || ip.IsLoopback() || ip.IsMulticast() || ip.Equal(net.IPv4bcast) {
+		return true
+	}
+
+	for _, dev := range devs {
+		for _, a := range dev.ipAddrs {
+			if a.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
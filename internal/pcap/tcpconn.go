@@ -15,11 +15,11 @@ type TCPConn struct {
 // DialTCP acts like DialTCP for pcap networks.
 func DialTCP(dev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt) (*TCPConn, error) {
 	srcAddr := &net.TCPAddr{
-		IP:   dev.IPAddr().IP,
+		IP:   sourceIP(dev, dstAddr.IP),
 		Port: int(srcPort),
 	}
 
-	conn, err := net.DialTCP("tcp4", srcAddr, dstAddr)
+	conn, err := net.DialTCP("tcp", srcAddr, dstAddr)
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "dial",
@@ -100,25 +100,15 @@ func (c *TCPConn) SetWriteDeadline(t time.Time) error {
 }
 
 type TCPListener struct {
-	listener *net.TCPListener
+	listener net.Listener
 	crypt    crypto.Crypt
 }
 
-// ListenTCP acts like ListenTCP for pcap networks.
+// ListenTCP acts like ListenTCP for pcap networks, and listens in all addresses of the device.
 func ListenTCP(dev *Device, srcPort uint16, crypt crypto.Crypt) (*TCPListener, error) {
-	srcAddr := &net.TCPAddr{
-		IP:   dev.IPAddr().IP,
-		Port: int(srcPort),
-	}
-
-	listener, err := net.ListenTCP("tcp4", srcAddr)
+	listener, err := listenTCP(dev, srcPort)
 	if err != nil {
-		return nil, &net.OpError{
-			Op:     "listen",
-			Net:    "pcap",
-			Source: srcAddr,
-			Err:    err,
-		}
+		return nil, err
 	}
 
 	return &TCPListener{
@@ -127,16 +117,26 @@ func ListenTCP(dev *Device, srcPort uint16, crypt crypto.Crypt) (*TCPListener, e
 	}, nil
 }
 
+// Accept waits for and returns the next connection. Connections from sources refused by the ACL are closed and
+// skipped.
 func (l *TCPListener) Accept() (net.Conn, error) {
-	conn, err := l.listener.AcceptTCP()
-	if err != nil {
-		return nil, err
-	}
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return nil, err
+		}
 
-	return &TCPConn{
-		conn:  conn,
-		crypt: l.crypt,
-	}, nil
+		if !permitsAddr(conn.RemoteAddr()) {
+			logger.Verbosef("Refuse TCP from %s\n", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		return &TCPConn{
+			conn:  conn.(*net.TCPConn),
+			crypt: l.crypt,
+		}, nil
+	}
 }
 
 func (l *TCPListener) Close() error {
@@ -0,0 +1,188 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	tcpWindow      uint16 = 65535
+	tcpMSS         uint16
+	tcpWindowScale uint8
+	tcpTimestamps  bool
+)
+
+// SetTCPOptions sets the window in headers of segments crafted in FakeTCP, the MSS and the window scale in options of
+// SYN segments, and if timestamps are in options of all segments, so segments look like ones of common TCP stacks. An
+// MSS or a window scale of 0 is not carried. It should be called before any connection is established.
+func SetTCPOptions(window, mss uint16, windowScale uint8, timestamps bool) {
+	tcpWindow = window
+	tcpMSS = mss
+	tcpWindowScale = windowScale
+	tcpTimestamps = timestamps
+}
+
+// TCPOptionsSize returns the size of options in segments crafted in FakeTCP except SYN segments.
+func TCPOptionsSize() int {
+	if tcpTimestamps {
+		// NOP, NOP and timestamps
+		return 12
+	}
+
+	return 0
+}
+
+// tsStart is the time from which timestamps in TCP options are counted in milliseconds.
+var tsStart = time.Now().Add(-time.Duration(randomSeq()%(1<<30)) * time.Millisecond)
+
+// optionTCPLayer appends options to a TCP layer crafted in FakeTCP after it is flagged. The recent timestamp is the
+// latest one received from the peer, which is echoed.
+func optionTCPLayer(layer *layers.TCP, tsRecent uint32) {
+	nop := layers.TCPOption{OptionType: layers.TCPOptionKindNop, OptionLength: 1}
+
+	if layer.SYN {
+		if tcpMSS > 0 {
+			data := make([]byte, 2)
+			binary.BigEndian.PutUint16(data, tcpMSS)
+			layer.Options = append(layer.Options, layers.TCPOption{
+				OptionType:   layers.TCPOptionKindMSS,
+				OptionLength: 4,
+				OptionData:   data,
+			})
+		}
+		if reorderWindow > 0 {
+			layer.Options = append(layer.Options, nop, nop, layers.TCPOption{
+				OptionType:   layers.TCPOptionKindSACKPermitted,
+				OptionLength: 2,
+			})
+		}
+		if tcpWindowScale > 0 {
+			layer.Options = append(layer.Options, nop, layers.TCPOption{
+				OptionType:   layers.TCPOptionKindWindowScale,
+				OptionLength: 3,
+				OptionData:   []byte{tcpWindowScale},
+			})
+		}
+	}
+
+	if tcpTimestamps {
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint32(data[0:4], uint32(time.Since(tsStart)/time.Millisecond))
+		if layer.ACK {
+			binary.BigEndian.PutUint32(data[4:8], tsRecent)
+		}
+		layer.Options = append(layer.Options, nop, nop, layers.TCPOption{
+			OptionType:   layers.TCPOptionKindTimestamps,
+			OptionLength: 10,
+			OptionData:   data,
+		})
+	}
+}
+
+// parseTimestamp returns the timestamp value in TCP options, and if it exists.
+func parseTimestamp(options []layers.TCPOption) (uint32, bool) {
+	for _, option := range options {
+		if option.OptionType == layers.TCPOptionKindTimestamps && len(option.OptionData) >= 8 {
+			return binary.BigEndian.Uint32(option.OptionData[0:4]), true
+		}
+	}
+
+	return 0, false
+}
+
+// TunnelMSS returns the MSS of inner TCP segments in IPv4 which fit in a FakeTCP segment in IPv4 in the MTU without
+// fragmenting, with the cost of crypt, framing and forward error correction.
+func TunnelMSS(mtu, cost int) uint16 {
+	// Outer IPv4 and TCP headers, options, cost, frame header and FEC, and inner IPv4 and TCP headers
+	mss := mtu - 40 - TCPOptionsSize() - cost - FrameHeaderSize - fecOverhead() - 40
+	if mss <= 0 {
+		return 1
+	}
+
+	return uint16(mss)
+}
+
+// ClampMSS lowers the MSS option of the TCP SYN segment in the IP packet data to the MSS in IPv4, which is 20 Bytes
+// less in IPv6, and updates the checksum in place. It returns if the segment is clamped.
+func ClampMSS(data []byte, mss uint16) bool {
+	if len(data) <= 0 {
+		return false
+	}
+
+	var offset int
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 || layers.IPProtocol(data[9]) != layers.IPProtocolTCP {
+			return false
+		}
+		// Fragments except the first one have no TCP headers
+		if binary.BigEndian.Uint16(data[6:8])&0x1fff != 0 {
+			return false
+		}
+		offset = int(data[0]&0x0f) * 4
+	case 6:
+		// Extension headers are not parsed
+		if len(data) < 40 || layers.IPProtocol(data[6]) != layers.IPProtocolTCP {
+			return false
+		}
+		offset = 40
+		mss = mss - 20
+	default:
+		return false
+	}
+	if len(data) < offset+20 {
+		return false
+	}
+
+	tcp := data[offset:]
+	if tcp[13]&0x02 == 0 {
+		return false
+	}
+	headerLength := int(tcp[12]>>4) * 4
+	if headerLength < 20 || len(tcp) < headerLength {
+		return false
+	}
+
+	for i := 20; i < headerLength; {
+		kind := layers.TCPOptionKind(tcp[i])
+		switch kind {
+		case layers.TCPOptionKindEndList:
+			return false
+		case layers.TCPOptionKindNop:
+			i++
+			continue
+		}
+		if i+1 >= headerLength {
+			return false
+		}
+		length := int(tcp[i+1])
+		if length < 2 || i+length > headerLength {
+			return false
+		}
+
+		if kind == layers.TCPOptionKindMSS && length == 4 {
+			old := binary.BigEndian.Uint16(tcp[i+2:])
+			if old <= mss {
+				return false
+			}
+			binary.BigEndian.PutUint16(tcp[i+2:], mss)
+			checksum := binary.BigEndian.Uint16(tcp[16:18])
+			// The checksum is in 16 bits words, so a value in an odd offset is added in swapped bytes
+			if (i+2)%2 == 1 {
+				checksum = updateChecksum(checksum, bits.ReverseBytes16(old), bits.ReverseBytes16(mss))
+			} else {
+				checksum = updateChecksum(checksum, old, mss)
+			}
+			binary.BigEndian.PutUint16(tcp[16:18], checksum)
+
+			return true
+		}
+
+		i = i + length
+	}
+
+	return false
+}
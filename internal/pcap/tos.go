@@ -0,0 +1,167 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"strings"
+)
+
+// ToSMode describes which bits of the traffic class of embedded packets are copied to the outer header.
+type ToSMode uint8
+
+const (
+	// ToSModeNone describes outer headers are in the default traffic class.
+	ToSModeNone ToSMode = 0
+	// ToSModeDSCP describes the DSCP of embedded packets is copied.
+	ToSModeDSCP ToSMode = 1 << 0
+	// ToSModeECN describes the ECN of embedded packets is copied, and congestion experienced in the outer header is
+	// restored to embedded packets.
+	ToSModeECN ToSMode = 1 << 1
+	// ToSModeAll describes both the DSCP and the ECN of embedded packets are copied.
+	ToSModeAll = ToSModeDSCP | ToSModeECN
+)
+
+const (
+	ecnMask = 0x03
+	ecnCE   = 0x03
+)
+
+var tosMode = ToSModeNone
+
+// ParseToSMode returns the mode of copying traffic class from its name, which can be none, dscp, ecn and all.
+func ParseToSMode(s string) (ToSMode, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return ToSModeNone, nil
+	case "dscp":
+		return ToSModeDSCP, nil
+	case "ecn":
+		return ToSModeECN, nil
+	case "all":
+		return ToSModeAll, nil
+	default:
+		return ToSModeNone, fmt.Errorf("tos mode %s not support", s)
+	}
+}
+
+// SetToSMode sets which bits of the traffic class of embedded packets are copied to outer headers of FakeTCP
+// connections. It should be called before any connection is established.
+func SetToSMode(mode ToSMode) {
+	tosMode = mode
+}
+
+// innerToS returns the traffic class of the packet, or the packet embedded in the data or multipath frame.
+func innerToS(b []byte) (uint8, bool) {
+	b = embedded(b)
+	if len(b) < 2 {
+		return 0, false
+	}
+
+	switch b[0] >> 4 {
+	case 4:
+		return b[1], true
+	case 6:
+		return b[0]<<4 | b[1]>>4, true
+	default:
+		return 0, false
+	}
+}
+
+// embedded returns the packet in the bytes, which is the payload of a data, multipath or FEC frame, or the bytes
+// themselves if they are not a frame, and nil if there is not.
+func embedded(b []byte) []byte {
+	if !IsFrame(b) {
+		return b
+	}
+	if len(b) < FrameHeaderSize {
+		return nil
+	}
+
+	switch FrameType(b[3]) {
+	case FrameTypeData:
+		return b[FrameHeaderSize:]
+	case FrameTypeMultipath:
+		if len(b) < FrameHeaderSize+4 {
+			return nil
+		}
+		return b[FrameHeaderSize+4:]
+	case FrameTypeFEC:
+		// Parity shards carry no packet
+		if len(b) < FrameHeaderSize+fecHeaderSize+2 || b[FrameHeaderSize] >= b[FrameHeaderSize+1] {
+			return nil
+		}
+		return b[FrameHeaderSize+fecHeaderSize+2:]
+	default:
+		return nil
+	}
+}
+
+// copyToS sets the traffic class of the outer network layer from the embedded packet in the bytes.
+func copyToS(networkLayer gopacket.SerializableLayer, b []byte) {
+	if tosMode == ToSModeNone {
+		return
+	}
+
+	tos, ok := innerToS(b)
+	if !ok {
+		return
+	}
+
+	var mask uint8
+	if tosMode&ToSModeDSCP != 0 {
+		mask = mask | ^uint8(ecnMask)
+	}
+	if tosMode&ToSModeECN != 0 {
+		mask = mask | ecnMask
+	}
+
+	switch t := networkLayer.(type) {
+	case *layers.IPv4:
+		t.TOS = tos & mask
+	case *layers.IPv6:
+		t.TrafficClass = tos & mask
+	}
+}
+
+// isCE returns if the outer network layer of the packet is marked congestion experienced.
+func isCE(indicator *PacketIndicator) bool {
+	if tosMode&ToSModeECN == 0 {
+		return false
+	}
+
+	switch indicator.NetworkLayer().LayerType() {
+	case layers.LayerTypeIPv4:
+		return indicator.IPv4Layer().TOS&ecnMask == ecnCE
+	case layers.LayerTypeIPv6:
+		return indicator.IPv6Layer().TrafficClass&ecnMask == ecnCE
+	default:
+		return false
+	}
+}
+
+// markCE marks the embedded packet in the bytes congestion experienced if it is ECN-capable, as RFC 6040 describes.
+func markCE(b []byte) {
+	b = embedded(b)
+	if len(b) < 2 {
+		return
+	}
+
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 || b[1]&ecnMask == 0 || b[1]&ecnMask == ecnCE {
+			return
+		}
+		from := binary.BigEndian.Uint16(b[0:2])
+		b[1] = b[1] | ecnCE
+		to := binary.BigEndian.Uint16(b[0:2])
+		binary.BigEndian.PutUint16(b[10:12], updateChecksum(binary.BigEndian.Uint16(b[10:12]), from, to))
+	case 6:
+		// The ECN is in the lower 2 bits of the traffic class, across the first 2 Bytes
+		if b[1]>>4&ecnMask == 0 || b[1]>>4&ecnMask == ecnCE {
+			return
+		}
+		b[1] = b[1] | ecnCE<<4
+	}
+}
@@ -0,0 +1,152 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+)
+
+// DefaultTranslatePrefix is the well-known prefix of IPv4-embedded IPv6 addresses in RFC 6052.
+const DefaultTranslatePrefix = "64:ff9b::/96"
+
+// Translator translates addresses between IPv4 and IPv6 by embedding IPv4 addresses in an IPv6 prefix of length 96 as
+// RFC 6052 describes.
+type Translator struct {
+	prefix *net.IPNet
+}
+
+// ParseTranslator returns a translator of the prefix in CIDR notation.
+func ParseTranslator(s string) (*Translator, error) {
+	_, prefix, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("parse cidr: %w", err)
+	}
+	if prefix.IP.To4() != nil {
+		return nil, fmt.Errorf("prefix %s is not ipv6", s)
+	}
+	if ones, _ := prefix.Mask.Size(); ones != 96 {
+		return nil, fmt.Errorf("prefix length %d not support", ones)
+	}
+
+	return &Translator{prefix: prefix}, nil
+}
+
+// Prefix returns the prefix of the translator.
+func (t *Translator) Prefix() *net.IPNet {
+	return t.prefix
+}
+
+// To6 returns the IPv6 address embedding the IPv4 address.
+func (t *Translator) To6(ip net.IP) net.IP {
+	result := make(net.IP, net.IPv6len)
+	copy(result, t.prefix.IP.To16())
+	copy(result[12:], ip.To4())
+
+	return result
+}
+
+// To4 returns the IPv4 address embedded in the IPv6 address, or nil if the address is not in the prefix.
+func (t *Translator) To4(ip net.IP) net.IP {
+	if !t.prefix.Contains(ip) {
+		return nil
+	}
+
+	return net.IPv4(ip[12], ip[13], ip[14], ip[15]).To4()
+}
+
+// Translate returns the address in the other family, or nil if an IPv6 address is not in the prefix.
+func (t *Translator) Translate(ip net.IP) net.IP {
+	if ip.To4() != nil {
+		return t.To6(ip)
+	}
+
+	return t.To4(ip)
+}
+
+// TranslateNetworkLayer returns a network layer in the other family of the layer from the source to the destination
+// as RFC 7915 describes. The TTL or the hop limit, the type of service or the traffic class, and the protocol are
+// preserved, with ICMPv4 and ICMPv6 exchanged. Fragments are not supported.
+func TranslateNetworkLayer(layer gopacket.Layer, srcIP, dstIP net.IP) (gopacket.NetworkLayer, error) {
+	switch t := layer.LayerType(); t {
+	case layers.LayerTypeIPv4:
+		ipv4Layer := layer.(*layers.IPv4)
+		if ipv4Layer.Flags&layers.IPv4MoreFragments != 0 || ipv4Layer.FragOffset != 0 {
+			return nil, errors.New("fragment not support")
+		}
+		if srcIP.To4() != nil || dstIP.To4() != nil {
+			return nil, errors.New("address family mismatch")
+		}
+
+		protocol := ipv4Layer.Protocol
+		if protocol == layers.IPProtocolICMPv4 {
+			protocol = layers.IPProtocolICMPv6
+		}
+
+		return &layers.IPv6{
+			Version:      6,
+			TrafficClass: ipv4Layer.TOS,
+			NextHeader:   protocol,
+			HopLimit:     ipv4Layer.TTL,
+			SrcIP:        srcIP,
+			DstIP:        dstIP,
+		}, nil
+	case layers.LayerTypeIPv6:
+		ipv6Layer := layer.(*layers.IPv6)
+		if srcIP.To4() == nil || dstIP.To4() == nil {
+			return nil, errors.New("address family mismatch")
+		}
+
+		protocol := ipv6Layer.NextHeader
+		switch protocol {
+		case layers.IPProtocolICMPv6:
+			protocol = layers.IPProtocolICMPv4
+		case layers.IPProtocolIPv6Fragment:
+			return nil, errors.New("fragment not support")
+		}
+
+		return &layers.IPv4{
+			Version:  4,
+			IHL:      5,
+			TOS:      ipv6Layer.TrafficClass,
+			Flags:    layers.IPv4DontFragment,
+			TTL:      ipv6Layer.HopLimit,
+			Protocol: protocol,
+			SrcIP:    srcIP.To4(),
+			DstIP:    dstIP.To4(),
+		}, nil
+	default:
+		return nil, NewError(ErrUnsupportedLayer, "network layer type %s not support", t)
+	}
+}
+
+// TranslateICMPv4Echo returns ICMPv6 layers of the echo message translated from the ICMPv4 echo message with the Id.
+func TranslateICMPv4Echo(layer *layers.ICMPv4, id uint16) (*layers.ICMPv6, *layers.ICMPv6Echo, error) {
+	var typeCode layers.ICMPv6TypeCode
+	switch t := layer.TypeCode.Type(); t {
+	case layers.ICMPv4TypeEchoRequest:
+		typeCode = layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoRequest, 0)
+	case layers.ICMPv4TypeEchoReply:
+		typeCode = layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoReply, 0)
+	default:
+		return nil, nil, fmt.Errorf("icmpv4 type %d not support", t)
+	}
+
+	return &layers.ICMPv6{TypeCode: typeCode}, &layers.ICMPv6Echo{Identifier: id, SeqNumber: layer.Seq}, nil
+}
+
+// TranslateICMPv6Echo returns an ICMPv4 layer of the echo message translated from the ICMPv6 echo message with the Id.
+func TranslateICMPv6Echo(indicator *ICMPv6Indicator, id uint16) (*layers.ICMPv4, error) {
+	var typeCode layers.ICMPv4TypeCode
+	switch t := indicator.ICMPv6Layer().TypeCode.Type(); t {
+	case layers.ICMPv6TypeEchoRequest:
+		typeCode = layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0)
+	case layers.ICMPv6TypeEchoReply:
+		typeCode = layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0)
+	default:
+		return nil, fmt.Errorf("icmpv6 type %d not support", t)
+	}
+
+	return &layers.ICMPv4{TypeCode: typeCode, Id: id, Seq: indicator.Seq()}, nil
+}
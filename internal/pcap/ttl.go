@@ -0,0 +1,21 @@
+package pcap
+
+import "runtime"
+
+// DefaultTTL returns the TTL of crafted packets by convention of the platform, which is 128 in Windows and 64 in
+// others.
+func DefaultTTL() uint8 {
+	if runtime.GOOS == "windows" {
+		return 128
+	}
+
+	return 64
+}
+
+var ttl = DefaultTTL()
+
+// SetTTL sets the TTL, or the hop limit in IPv6, of crafted packets between the client and the server, which is
+// independent of embedded packets. It should be called before any connection is established.
+func SetTTL(t uint8) {
+	ttl = t
+}
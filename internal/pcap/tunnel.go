@@ -0,0 +1,231 @@
+package pcap
+
+import (
+	"fmt"
+	"ikago/internal/config"
+	"ikago/internal/crypto"
+	"net"
+	"time"
+)
+
+// TunnelConfig describes the configuration of a tunnel.
+type TunnelConfig struct {
+	// UpDev is the device for routing upstream.
+	UpDev *Device
+	// GatewayDev is the gateway device.
+	GatewayDev *Device
+	// Port is the port for routing upstream.
+	Port uint16
+	// Mode is the mode of the tunnel, can be faketcp, tcp, websocket or udp.
+	Mode string
+	// Crypt is the crypt of the tunnel.
+	Crypt crypto.Crypt
+	// Auth is the authentication in handshaking, nil if the server does not authenticate clients.
+	Auth *crypto.Auth
+	// MTU is the MTU of the tunnel.
+	MTU int
+	// KCPConfig is the KCP tuning options in mode faketcp, nil if KCP is disabled.
+	KCPConfig *config.KCPConfig
+	// WebSocketConfig is the WebSocket options in mode websocket, the default options if nil.
+	WebSocketConfig *config.WebSocketConfig
+	// Batch is the max size of a batch, 0 if batching is disabled.
+	Batch int
+	// BatchInterval is the interval of flushing a batch.
+	BatchInterval time.Duration
+	// Frame is whether packets are framed if the server supports framing.
+	Frame bool
+	// Id is the Id presented to the server in hello, which enables framing if it is set.
+	Id string
+	// UserAuth is the authentication of the user in the Id, which answers challenges of the server, nil if the client
+	// does not authenticate as a user.
+	UserAuth *crypto.Auth
+	// Paths is the additional paths transmitting packets with the upstream device in multipath, which enables framing
+	// if it is set.
+	Paths []TunnelPath
+	// MultipathMode is the mode of transmitting packets across paths.
+	MultipathMode MultipathMode
+	// Token is the token of resumption issued by the server in a previous connection, which is presented in hello to
+	// resume the session from another address.
+	Token []byte
+}
+
+// TunnelPath describes a path for routing upstream in multipath.
+type TunnelPath struct {
+	// UpDev is the device for routing upstream.
+	UpDev *Device
+	// GatewayDev is the gateway device.
+	GatewayDev *Device
+}
+
+// TunnelConn is a tunnel to a server. Each write sends a raw IP packet through the tunnel, and each read returns a raw
+// IP packet sent back by the server.
+type TunnelConn struct {
+	net.Conn
+}
+
+// DialTunnel establishes a tunnel to the server.
+func DialTunnel(serverAddr *net.TCPAddr, cfg *TunnelConfig) (*TunnelConn, error) {
+	var (
+		err  error
+		conn net.Conn
+	)
+
+	if len(cfg.Paths) > 0 {
+		return dialMultipathTunnel(serverAddr, cfg)
+	}
+
+	switch cfg.Mode {
+	case "faketcp":
+		if cfg.KCPConfig != nil {
+			conn, err = DialFakeTCPWithKCP(cfg.UpDev, cfg.GatewayDev, cfg.Port, serverAddr, cfg.Crypt, cfg.Auth, cfg.MTU, cfg.KCPConfig)
+		} else {
+			conn, err = DialFakeTCP(cfg.UpDev, cfg.GatewayDev, cfg.Port, serverAddr, cfg.Crypt, cfg.Auth, cfg.MTU)
+		}
+	case "tcp":
+		conn, err = DialTCP(cfg.UpDev, cfg.Port, serverAddr, cfg.Crypt)
+	case "websocket":
+		wsConfig := cfg.WebSocketConfig
+		if wsConfig == nil {
+			wsConfig = config.NewWebSocketConfig()
+		}
+		conn, err = DialWebSocket(cfg.UpDev, cfg.Port, serverAddr, cfg.Crypt, wsConfig)
+	case "udp":
+		conn, err = DialUDP(cfg.UpDev, cfg.Port, &net.UDPAddr{IP: serverAddr.IP, Port: serverAddr.Port}, cfg.Crypt)
+	default:
+		err = fmt.Errorf("mode %s not support", cfg.Mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Batch > 0 {
+		conn = NewBatchConn(conn, cfg.Batch, cfg.BatchInterval)
+	}
+	if cfg.Frame || cfg.Id != "" {
+		frameConn := NewFrameConn(conn)
+		err := frameConn.SetId(cfg.Id)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		frameConn.SetUserAuth(cfg.UserAuth)
+		err = frameConn.SetToken(cfg.Token)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		err = frameConn.Hello()
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("hello: %w", err)
+		}
+		conn = frameConn
+	}
+
+	return &TunnelConn{Conn: conn}, nil
+}
+
+// dialMultipathTunnel establishes a tunnel to the server over the upstream device and the additional paths.
+func dialMultipathTunnel(serverAddr *net.TCPAddr, cfg *TunnelConfig) (*TunnelConn, error) {
+	paths := append([]TunnelPath{{UpDev: cfg.UpDev, GatewayDev: cfg.GatewayDev}}, cfg.Paths...)
+
+	frameConns := make([]*FrameConn, 0, len(paths))
+	closeAll := func() {
+		for _, conn := range frameConns {
+			conn.Close()
+		}
+	}
+	for i, path := range paths {
+		pathConfig := *cfg
+		pathConfig.UpDev = path.UpDev
+		pathConfig.GatewayDev = path.GatewayDev
+		pathConfig.Paths = nil
+		pathConfig.Frame = true
+		// Only the path in the upstream device resumes the session
+		if i > 0 {
+			pathConfig.Token = nil
+		}
+
+		conn, err := DialTunnel(serverAddr, &pathConfig)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("dial in %s: %w", path.UpDev.Alias(), err)
+		}
+		frameConns = append(frameConns, conn.Conn.(*FrameConn))
+	}
+
+	conn, err := NewMultipathConn(frameConns, cfg.MultipathMode)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+
+	return &TunnelConn{Conn: conn}, nil
+}
+
+// ReadPacket reads a packet from the tunnel and returns a packet indicator with its checksum verified.
+func (c *TunnelConn) ReadPacket() (*PacketIndicator, error) {
+	b := make([]byte, IPv4MaxSize)
+
+	n, err := c.Read(b)
+	if err != nil {
+		return nil, err
+	}
+
+	indicator, err := ParseEmbPacket(b[:n])
+	if err != nil {
+		return nil, fmt.Errorf("parse embedded packet: %w", err)
+	}
+
+	err = indicator.VerifyChecksum()
+	if err != nil {
+		return nil, fmt.Errorf("verify checksum: %w", err)
+	}
+
+	return indicator, nil
+}
+
+// Reconnect re-establishes the tunnel in mode faketcp without KCP, and does nothing in other modes.
+func (c *TunnelConn) Reconnect() error {
+	multipathConn, ok := c.Conn.(*MultipathConn)
+	if !ok {
+		return reconnect(c.Conn)
+	}
+
+	for _, path := range multipathConn.Paths() {
+		err := reconnect(path)
+		if err != nil {
+			return fmt.Errorf("reconnect in %s: %w", path.LocalAddr(), err)
+		}
+	}
+
+	return nil
+}
+
+func reconnect(conn net.Conn) error {
+	frameConn, ok := conn.(*FrameConn)
+	if ok {
+		conn = frameConn.Conn
+	}
+
+	batchConn, ok := conn.(*BatchConn)
+	if ok {
+		conn = batchConn.Conn
+	}
+
+	fakeTCPConn, ok := conn.(*FakeTCPConn)
+	if !ok {
+		return nil
+	}
+
+	err := fakeTCPConn.Reconnect()
+	if err != nil {
+		return err
+	}
+
+	// Negotiate again with the new connection in the server
+	if frameConn != nil {
+		return frameConn.Hello()
+	}
+
+	return nil
+}
@@ -0,0 +1,342 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"ikago/internal/crypto"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// udpBacklog is the number of datagrams buffered for each client of a UDP listener.
+const udpBacklog = 1000
+
+// UDPConn is a connection over a UDP socket of the OS, so packets in the tunnel are not crafted by pcap. Each write
+// sends a datagram, and each read returns a datagram.
+type UDPConn struct {
+	conn     *net.UDPConn
+	crypt    crypto.Crypt
+	addr     *net.UDPAddr
+	listener *UDPListener
+	packets  chan []byte
+	closed   chan struct{}
+	once     sync.Once
+	deadline time.Time
+	lock     sync.RWMutex
+	// buffer is reused in reads of a dialed connection
+	buffer   []byte
+	readLock sync.Mutex
+}
+
+// DialUDP acts like DialUDP for pcap networks.
+func DialUDP(dev *Device, srcPort uint16, dstAddr *net.UDPAddr, crypt crypto.Crypt) (*UDPConn, error) {
+	srcAddr := &net.UDPAddr{
+		IP:   sourceIP(dev, dstAddr.IP),
+		Port: int(srcPort),
+	}
+
+	conn, err := net.DialUDP("udp", srcAddr, dstAddr)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    err,
+		}
+	}
+
+	return &UDPConn{
+		conn:   conn,
+		crypt:  crypt,
+		addr:   dstAddr,
+		buffer: make([]byte, 65535),
+	}, nil
+}
+
+func (c *UDPConn) Read(b []byte) (n int, err error) {
+	var p []byte
+
+	if c.listener == nil {
+		// The buffer is decrypted and copied before it is read again
+		c.readLock.Lock()
+		defer c.readLock.Unlock()
+
+		n, err := c.conn.Read(c.buffer)
+		if err != nil {
+			return 0, err
+		}
+		p = c.buffer[:n]
+	} else {
+		// Datagrams still buffered are not read once the connection is closed
+		select {
+		case <-c.closed:
+			return 0, io.EOF
+		default:
+		}
+
+		c.lock.RLock()
+		deadline := c.deadline
+		c.lock.RUnlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case p = <-c.packets:
+		case <-c.closed:
+			return 0, io.EOF
+		case <-timeout:
+			return 0, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   c.RemoteAddr(),
+				Err:    errors.New("timeout"),
+			}
+		}
+	}
+
+	dp, err := c.crypt.Decrypt(p)
+	if err != nil {
+		return 0, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    fmt.Errorf("decrypt: %w", err),
+		}
+	}
+
+	return copy(b, dp), nil
+}
+
+func (c *UDPConn) Write(b []byte) (n int, err error) {
+	// Encrypt
+	contents, err := c.crypt.Encrypt(b)
+	if err != nil {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    fmt.Errorf("encrypt: %w", err),
+		}
+	}
+
+	if c.listener == nil {
+		_, err = c.conn.Write(contents)
+	} else {
+		_, err = c.conn.WriteToUDP(contents, c.addr)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// Close closes the connection. Connections accepted by a listener share its socket, so only the connection is removed
+// from the listener.
+func (c *UDPConn) Close() error {
+	if c.listener == nil {
+		return c.conn.Close()
+	}
+
+	c.once.Do(func() {
+		close(c.closed)
+		c.listener.remove(c)
+	})
+
+	return nil
+}
+
+func (c *UDPConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *UDPConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *UDPConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *UDPConn) SetReadDeadline(t time.Time) error {
+	if c.listener == nil {
+		return c.conn.SetReadDeadline(t)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.deadline = t
+
+	return nil
+}
+
+func (c *UDPConn) SetWriteDeadline(t time.Time) error {
+	if c.listener == nil {
+		return c.conn.SetWriteDeadline(t)
+	}
+
+	return nil
+}
+
+// UDPListener is a listener over UDP sockets of the OS in all addresses of the device, which accepts a connection for
+// each address datagrams are received from.
+type UDPListener struct {
+	sockets []*net.UDPConn
+	crypt   crypto.Crypt
+	lock    sync.Mutex
+	conns   map[string]*UDPConn
+	accept  chan *UDPConn
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// ListenUDP acts like ListenUDP for pcap networks.
+func ListenUDP(dev *Device, srcPort uint16, crypt crypto.Crypt) (*UDPListener, error) {
+	sockets := make([]*net.UDPConn, 0)
+	for _, ip := range listenIPs(dev) {
+		srcAddr := &net.UDPAddr{
+			IP:   ip,
+			Port: int(srcPort),
+		}
+
+		socket, err := net.ListenUDP("udp", srcAddr)
+		if err != nil {
+			for _, s := range sockets {
+				s.Close()
+			}
+
+			return nil, &net.OpError{
+				Op:     "listen",
+				Net:    "pcap",
+				Source: srcAddr,
+				Err:    err,
+			}
+		}
+		sockets = append(sockets, socket)
+	}
+	if len(sockets) <= 0 {
+		return nil, fmt.Errorf("missing address of device %s", dev.Alias())
+	}
+
+	l := &UDPListener{
+		sockets: sockets,
+		crypt:   crypt,
+		conns:   make(map[string]*UDPConn),
+		accept:  make(chan *UDPConn, udpBacklog),
+		closed:  make(chan struct{}),
+	}
+
+	for _, socket := range sockets {
+		go l.run(socket)
+	}
+
+	return l, nil
+}
+
+func (l *UDPListener) run(socket *net.UDPConn) {
+	for {
+		b := make([]byte, 65535)
+
+		n, addr, err := socket.ReadFromUDP(b)
+		if err != nil {
+			select {
+			case <-l.closed:
+				return
+			default:
+			}
+			logger.Verbosef("Read UDP in %s: %v\n", socket.LocalAddr(), err)
+			continue
+		}
+
+		// Drop datagrams from sources refused by the ACL before decrypting
+		if !permitsAddr(addr) {
+			continue
+		}
+
+		l.lock.Lock()
+		conn, ok := l.conns[addr.String()]
+		if !ok {
+			conn = &UDPConn{
+				conn:     socket,
+				crypt:    l.crypt,
+				addr:     addr,
+				listener: l,
+				packets:  make(chan []byte, udpBacklog),
+				closed:   make(chan struct{}),
+			}
+			l.conns[addr.String()] = conn
+		}
+		l.lock.Unlock()
+
+		if !ok {
+			select {
+			case l.accept <- conn:
+			default:
+				// Drop the client as connections are not accepted in time
+				conn.Close()
+				continue
+			}
+		}
+
+		// Datagrams are dropped if the connection is not read in time, like in a socket
+		select {
+		case conn.packets <- b[:n]:
+		default:
+		}
+	}
+}
+
+// Accept waits for and returns the next connection from an address datagrams are received from.
+func (l *UDPListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.closed:
+		return nil, &net.OpError{
+			Op:     "accept",
+			Net:    "pcap",
+			Source: l.Addr(),
+			Err:    errors.New("listener closed"),
+		}
+	}
+}
+
+func (l *UDPListener) remove(conn *UDPConn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.conns[conn.addr.String()] == conn {
+		delete(l.conns, conn.addr.String())
+	}
+}
+
+func (l *UDPListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.closed)
+		for _, socket := range l.sockets {
+			e := socket.Close()
+			if e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+
+	return err
+}
+
+func (l *UDPListener) Addr() net.Addr {
+	return l.sockets[0].LocalAddr()
+}
@@ -0,0 +1,219 @@
+package pcap
+
+import (
+	"bytes"
+	"errors"
+	"ikago/internal/crypto"
+	"net"
+	"testing"
+	"time"
+)
+
+// testLoopDev returns a device of loopback in IPv4.
+func testLoopDev() *Device {
+	return NewDevice("lo", []*net.IPNet{
+		{IP: net.IPv4(127, 0, 0, 1).To4(), Mask: net.CIDRMask(8, 32)},
+	}, nil, true)
+}
+
+// testCrypt returns a crypt in AES-128-GCM.
+func testCrypt(t *testing.T) crypto.Crypt {
+	crypt, err := crypto.ParseCrypt("aes-128-gcm", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return crypt
+}
+
+// testUDPPair returns a listener in loopback, a connection dialed to it and the connection it accepts.
+func testUDPPair(t *testing.T) (*UDPListener, *UDPConn, *UDPConn) {
+	crypt := testCrypt(t)
+
+	l, err := ListenUDP(testLoopDev(), 0, crypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := DialUDP(testLoopDev(), 0, l.Addr().(*net.UDPAddr), crypt)
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+
+	_, err = conn.Write(testPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return l, conn, accepted.(*UDPConn)
+}
+
+func TestUDPRoundTrip(t *testing.T) {
+	l, conn, accepted := testUDPPair(t)
+	defer l.Close()
+	defer conn.Close()
+
+	if accepted.RemoteAddr().String() != conn.LocalAddr().String() {
+		t.Fatalf("accepted from %s, expected %s", accepted.RemoteAddr(), conn.LocalAddr())
+	}
+
+	b := make([]byte, 1500)
+	n, err := accepted.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b[:n], testPayload) {
+		t.Fatalf("read %x, expected %x", b[:n], testPayload)
+	}
+
+	reply := []byte("reply from the server")
+	_, err = accepted.Write(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads of the dialed connection reuse a buffer, so they are read twice
+	for i := 0; i < 2; i++ {
+		err = conn.SetReadDeadline(time.Now().Add(time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err = conn.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b[:n], reply) {
+			t.Fatalf("read %x, expected %x", b[:n], reply)
+		}
+
+		if i == 0 {
+			_, err = accepted.Write(reply)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestUDPEncrypted(t *testing.T) {
+	crypt := testCrypt(t)
+
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	conn, err := DialUDP(testLoopDev(), 0, socket.LocalAddr().(*net.UDPAddr), crypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(testPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = socket.SetReadDeadline(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1500)
+	n, err := socket.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b[:n], testPayload) {
+		t.Fatal("datagram in plaintext")
+	}
+
+	d, err := crypt.Decrypt(b[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d, testPayload) {
+		t.Fatalf("decrypted %x, expected %x", d, testPayload)
+	}
+}
+
+func TestUDPAcceptedReadDeadline(t *testing.T) {
+	l, conn, accepted := testUDPPair(t)
+	defer l.Close()
+	defer conn.Close()
+
+	b := make([]byte, 1500)
+	_, err := accepted.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = accepted.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = accepted.Read(b)
+	if err == nil {
+		t.Fatal("read without timeout")
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "read" {
+		t.Fatalf("error %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("timeout in %s", time.Since(start))
+	}
+}
+
+func TestUDPCloseRemovesPeer(t *testing.T) {
+	l, conn, accepted := testUDPPair(t)
+	defer l.Close()
+	defer conn.Close()
+
+	addr := accepted.RemoteAddr().String()
+
+	l.lock.Lock()
+	_, ok := l.conns[addr]
+	l.lock.Unlock()
+	if !ok {
+		t.Fatalf("missing peer %s", addr)
+	}
+
+	err := accepted.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.lock.Lock()
+	_, ok = l.conns[addr]
+	l.lock.Unlock()
+	if ok {
+		t.Fatalf("peer %s not removed", addr)
+	}
+
+	b := make([]byte, 1500)
+	_, err = accepted.Read(b)
+	if err == nil {
+		t.Fatal("read from closed connection")
+	}
+
+	// A datagram from the peer is accepted as a new connection
+	_, err = conn.Write(testPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == net.Conn(accepted) {
+		t.Fatal("closed connection accepted again")
+	}
+}
@@ -0,0 +1,109 @@
+package pcap
+
+import (
+	"errors"
+	"ikago/internal/crypto"
+	"time"
+)
+
+// SetUserAuth sets the authentication of the user in the Id, which answers challenges of the peer.
+func (c *FrameConn) SetUserAuth(auth *crypto.Auth) {
+	c.lock.Lock()
+	c.userAuth = auth
+	c.lock.Unlock()
+}
+
+// RequireUser requires the peer to authenticate as the user in its Id, whose authentication is returned by the lookup,
+// nil if there is no such user. The peer is challenged once it says hello, and User returns the user once it answers.
+func (c *FrameConn) RequireUser(lookup func(id string) *crypto.Auth) {
+	c.lock.Lock()
+	c.userLookup = lookup
+	c.lock.Unlock()
+}
+
+// User returns the user the peer authenticates as, empty if it does not authenticate.
+func (c *FrameConn) User() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.user
+}
+
+// challengeUser challenges the peer to authenticate as the user in its Id if users are required.
+func (c *FrameConn) challengeUser() error {
+	c.lock.Lock()
+	if c.userLookup == nil || c.version < UserFrameVersion {
+		c.lock.Unlock()
+		return nil
+	}
+	c.lock.Unlock()
+
+	challenge, err := crypto.GenerateIV(crypto.ChallengeSize)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	c.challenge = challenge
+	c.challenged = time.Now()
+	c.lock.Unlock()
+
+	return c.writeFrame(FrameTypeChallenge, 0, challenge)
+}
+
+// retryChallenge challenges the peer again if it has not authenticated in the interval, as the challenge or the
+// response may be lost.
+func (c *FrameConn) retryChallenge() error {
+	c.lock.RLock()
+	retry := c.userLookup != nil && c.user == "" && c.version >= UserFrameVersion &&
+		time.Since(c.challenged) >= helloInterval
+	c.lock.RUnlock()
+	if !retry {
+		return nil
+	}
+
+	return c.challengeUser()
+}
+
+func (c *FrameConn) handleChallenge(frame *Frame) error {
+	if len(frame.Payload) != crypto.ChallengeSize {
+		return errors.New("invalid challenge")
+	}
+
+	c.lock.RLock()
+	auth := c.userAuth
+	c.lock.RUnlock()
+	if auth == nil {
+		logger.Verbosef("Cannot answer challenge from %s without a key\n", c.RemoteAddr())
+		return nil
+	}
+
+	return c.writeFrame(FrameTypeResponse, 0, auth.Respond(frame.Payload))
+}
+
+func (c *FrameConn) handleResponse(frame *Frame) error {
+	c.lock.Lock()
+	lookup, challenge, id := c.userLookup, c.challenge, c.peerId
+	c.lock.Unlock()
+	if lookup == nil || challenge == nil {
+		return nil
+	}
+
+	auth := lookup(id)
+	if auth == nil || !auth.Verify(challenge, frame.Payload) {
+		return errors.New("authentication failed")
+	}
+
+	c.lock.Lock()
+	// Each challenge is answered only once
+	c.challenge = nil
+	changed := c.user != id
+	c.user = id
+	c.lock.Unlock()
+
+	if changed {
+		logger.Verbosef("Peer %s authenticates as user %s\n", c.RemoteAddr(), id)
+	}
+
+	return nil
+}
@@ -0,0 +1,294 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// windowFlowTimeout is the duration after which a TCP connection without segments is forgotten in clamping.
+	windowFlowTimeout = 2 * time.Minute
+	// rttExpiry is the duration after which the min RTT is replaced by a new sample, so the window follows changes of
+	// the path.
+	rttExpiry = 10 * time.Second
+	// minRateInterval is the min interval of measuring the throughput.
+	minRateInterval = 100 * time.Millisecond
+	// rateIntervals is the number of latest intervals in which the max throughput is kept.
+	rateIntervals = 10
+	// minClampedWindow is the min window clamped to, so connections in a tunnel just opened are not stalled.
+	minClampedWindow = 16 * 1024
+)
+
+// windowFlow describes a TCP connection in clamping.
+type windowFlow struct {
+	scale       uint8
+	isScaled    bool
+	isPeerScale bool
+	synTime     time.Time
+	lastSeen    time.Time
+}
+
+// shift returns the shift of windows in segments of the local host, which is only applied if both sides carry the
+// window scale option.
+func (f *windowFlow) shift() uint8 {
+	if !f.isScaled || !f.isPeerScale {
+		return 0
+	}
+
+	return f.scale
+}
+
+// WindowClamp clamps receive windows of inner TCP connections to the bandwidth-delay product of the tunnel, which
+// limits data in flight in the tunnel and reduces queueing delay for interactive traffic sharing it with bulk
+// transfers. The RTT is measured by segments replying SYN through the tunnel, and the throughput is measured by data
+// received from the tunnel. The window is clamped to twice the product, so the throughput can still grow.
+type WindowClamp struct {
+	lock      sync.Mutex
+	flows     map[string]*windowFlow
+	lastSweep time.Time
+	minRTT    time.Duration
+	rttTime   time.Time
+	start     time.Time
+	size      uint64
+	rates     [rateIntervals]float64
+	index     int
+}
+
+// NewWindowClamp returns a new window clamp.
+func NewWindowClamp() *WindowClamp {
+	return &WindowClamp{
+		flows:     make(map[string]*windowFlow),
+		lastSweep: time.Now(),
+		start:     time.Now(),
+	}
+}
+
+// Window returns the window clamped to in Bytes, 0 if no RTT is measured yet.
+func (w *WindowClamp) Window() uint32 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.window()
+}
+
+func (w *WindowClamp) window() uint32 {
+	if w.minRTT <= 0 {
+		return 0
+	}
+
+	var rate float64
+	for _, r := range w.rates {
+		if r > rate {
+			rate = r
+		}
+	}
+
+	window := 2 * rate * w.minRTT.Seconds()
+	if window < minClampedWindow {
+		return minClampedWindow
+	}
+	if window > float64(65535<<14) {
+		return 65535 << 14
+	}
+
+	return uint32(window)
+}
+
+// Clamp lowers the window of the TCP segment in the IP packet data, which is sent into the tunnel by a local host, to
+// the clamped window, and updates the checksum in place. It returns if the segment is clamped. Segments of
+// connections whose SYN segments are not seen are not clamped, as their window scales are unknown.
+func (w *WindowClamp) Clamp(data []byte) bool {
+	src, dst, tcp, ok := parseTCP(data)
+	if !ok {
+		return false
+	}
+	key := windowKey(src, dst, tcp[0:2], tcp[2:4])
+	now := time.Now()
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.sweep(now)
+
+	flow, ok := w.flows[key]
+	if tcp[13]&0x02 != 0 {
+		if !ok {
+			flow = &windowFlow{}
+			w.flows[key] = flow
+		}
+		option, ok := tcpOption(tcp, layers.TCPOptionKindWindowScale)
+		flow.isScaled = ok && len(option) >= 1
+		if flow.isScaled {
+			flow.scale = option[0]
+		}
+		// The reply of SYN measures the RTT
+		flow.synTime = now
+		flow.lastSeen = now
+
+		// Windows in SYN segments are never scaled
+		return false
+	}
+	if !ok {
+		return false
+	}
+	flow.lastSeen = now
+
+	window := w.window()
+	if window <= 0 {
+		return false
+	}
+	value := window >> flow.shift()
+	if value > 65535 {
+		value = 65535
+	}
+	if value <= 0 {
+		value = 1
+	}
+
+	old := binary.BigEndian.Uint16(tcp[14:16])
+	if uint32(old) <= value {
+		return false
+	}
+	binary.BigEndian.PutUint16(tcp[14:16], uint16(value))
+	checksum := binary.BigEndian.Uint16(tcp[16:18])
+	binary.BigEndian.PutUint16(tcp[16:18], updateChecksum(checksum, old, uint16(value)))
+
+	return true
+}
+
+// Observe measures the RTT and the throughput of the tunnel by the TCP segment in the IP packet data, which is received
+// from the tunnel to a local host.
+func (w *WindowClamp) Observe(data []byte) {
+	src, dst, tcp, ok := parseTCP(data)
+	if !ok {
+		return
+	}
+	key := windowKey(dst, src, tcp[2:4], tcp[0:2])
+	now := time.Now()
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	flow, ok := w.flows[key]
+	if tcp[13]&0x02 != 0 {
+		if !ok {
+			flow = &windowFlow{}
+			w.flows[key] = flow
+			ok = true
+		}
+		_, flow.isPeerScale = tcpOption(tcp, layers.TCPOptionKindWindowScale)
+		flow.lastSeen = now
+	}
+	if ok && !flow.synTime.IsZero() {
+		rtt := now.Sub(flow.synTime)
+		flow.synTime = time.Time{}
+		if w.minRTT <= 0 || rtt < w.minRTT || now.Sub(w.rttTime) > rttExpiry {
+			w.minRTT = rtt
+			w.rttTime = now
+		}
+	}
+
+	// Throughput in intervals of the RTT
+	w.size = w.size + uint64(len(data))
+	interval := w.minRTT
+	if interval < minRateInterval {
+		interval = minRateInterval
+	}
+	elapsed := now.Sub(w.start)
+	if elapsed >= interval {
+		w.rates[w.index] = float64(w.size) / elapsed.Seconds()
+		w.index = (w.index + 1) % rateIntervals
+		w.size = 0
+		w.start = now
+	}
+}
+
+// sweep removes connections without segments in the timeout.
+func (w *WindowClamp) sweep(now time.Time) {
+	if now.Sub(w.lastSweep) < windowFlowTimeout {
+		return
+	}
+	w.lastSweep = now
+
+	for key, flow := range w.flows {
+		if now.Sub(flow.lastSeen) > windowFlowTimeout {
+			delete(w.flows, key)
+		}
+	}
+}
+
+// windowKey returns the key of a TCP connection by the address and the port of the local host and the remote.
+func windowKey(localIP, remoteIP, localPort, remotePort []byte) string {
+	return string(localIP) + string(localPort) + string(remoteIP) + string(remotePort)
+}
+
+// parseTCP returns the source and the destination IP and the TCP header and payload of the IP packet data, and if
+// it carries a TCP header. Extension headers in IPv6 are not parsed.
+func parseTCP(data []byte) (src, dst, tcp []byte, ok bool) {
+	if len(data) <= 0 {
+		return nil, nil, nil, false
+	}
+
+	var offset int
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 || layers.IPProtocol(data[9]) != layers.IPProtocolTCP {
+			return nil, nil, nil, false
+		}
+		// Fragments except the first one have no TCP headers
+		if binary.BigEndian.Uint16(data[6:8])&0x1fff != 0 {
+			return nil, nil, nil, false
+		}
+		src, dst = data[12:16], data[16:20]
+		offset = int(data[0]&0x0f) * 4
+	case 6:
+		if len(data) < 40 || layers.IPProtocol(data[6]) != layers.IPProtocolTCP {
+			return nil, nil, nil, false
+		}
+		src, dst = data[8:24], data[24:40]
+		offset = 40
+	default:
+		return nil, nil, nil, false
+	}
+	if offset < 20 || len(data) < offset+20 {
+		return nil, nil, nil, false
+	}
+
+	return src, dst, data[offset:], true
+}
+
+// tcpOption returns the data of the option of the kind in the TCP header, and if it exists.
+func tcpOption(tcp []byte, kind layers.TCPOptionKind) ([]byte, bool) {
+	headerLength := int(tcp[12]>>4) * 4
+	if headerLength < 20 || len(tcp) < headerLength {
+		return nil, false
+	}
+
+	for i := 20; i < headerLength; {
+		k := layers.TCPOptionKind(tcp[i])
+		switch k {
+		case layers.TCPOptionKindEndList:
+			return nil, false
+		case layers.TCPOptionKindNop:
+			i++
+			continue
+		}
+		if i+1 >= headerLength {
+			return nil, false
+		}
+		length := int(tcp[i+1])
+		if length < 2 || i+length > headerLength {
+			return nil, false
+		}
+		if k == kind {
+			return tcp[i+2 : i+length], true
+		}
+
+		i = i + length
+	}
+
+	return nil, false
+}
@@ -0,0 +1,439 @@
+package pcap
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"ikago/internal/config"
+	"ikago/internal/crypto"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wsGUID is the GUID appended to the key in the WebSocket handshake as RFC 6455 describes.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsHandshakeTimeout is the timeout of the WebSocket handshake.
+const wsHandshakeTimeout = 10 * time.Second
+
+// wsMaxFrameSize is the max size of a WebSocket frame, which is enough for an encrypted IP packet.
+const wsMaxFrameSize = 2 * IPv4MaxSize
+
+const (
+	wsOpContinuation = 0x0
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+// WSConn is a WebSocket connection, optionally in TLS. Each write sends a binary message, and each read returns a
+// message.
+type WSConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	crypt     crypto.Crypt
+	isClient  bool
+	writeLock sync.Mutex
+}
+
+// DialWebSocket acts like DialTCP for pcap networks, and upgrades the connection to WebSocket.
+func DialWebSocket(dev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, cfg *config.WebSocketConfig) (*WSConn, error) {
+	srcAddr := &net.TCPAddr{
+		IP:   sourceIP(dev, dstAddr.IP),
+		Port: int(srcPort),
+	}
+
+	tcpConn, err := net.DialTCP("tcp", srcAddr, dstAddr)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    err,
+		}
+	}
+
+	host := cfg.Host
+	if host == "" {
+		host = dstAddr.String()
+	}
+
+	var conn net.Conn = tcpConn
+	if cfg.TLS {
+		serverName := host
+		h, _, err := net.SplitHostPort(host)
+		if err == nil {
+			serverName = h
+		}
+		conn = tls.Client(tcpConn, &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: cfg.Insecure,
+		})
+	}
+
+	reader, err := handshakeWSClient(conn, host, cfg.Path)
+	if err != nil {
+		conn.Close()
+		return nil, &net.OpError{
+			Op:     "handshake",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    err,
+		}
+	}
+
+	return &WSConn{
+		conn:     conn,
+		reader:   reader,
+		crypt:    crypt,
+		isClient: true,
+	}, nil
+}
+
+func handshakeWSClient(conn net.Conn, host, path string) (*bufio.Reader, error) {
+	err := conn.SetDeadline(time.Now().Add(wsHandshakeTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("set deadline: %w", err)
+	}
+
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		return nil, fmt.Errorf("generate key: %w", err)
+	}
+	key := base64.StdEncoding.EncodeToString(b)
+
+	_, err = fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n",
+		path, host, key)
+	if err != nil {
+		return nil, fmt.Errorf("write request: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		return nil, errors.New("accept mismatch")
+	}
+
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("set deadline: %w", err)
+	}
+
+	return reader, nil
+}
+
+func handshakeWSServer(conn net.Conn, path string) (*bufio.Reader, error) {
+	err := conn.SetDeadline(time.Now().Add(wsHandshakeTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("set deadline: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, fmt.Errorf("read request: %w", err)
+	}
+
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if req.Method != http.MethodGet || req.URL.Path != path || !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") || key == "" {
+		// Respond like a web server without the path
+		_, _ = io.WriteString(conn, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return nil, fmt.Errorf("unexpected request %s %s", req.Method, req.URL.Path)
+	}
+
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		wsAccept(key))
+	if err != nil {
+		return nil, fmt.Errorf("write response: %w", err)
+	}
+
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("set deadline: %w", err)
+	}
+
+	return reader, nil
+}
+
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// readFrame reads a frame and returns its FIN, its opcode and its unmasked payload.
+func (c *WSConn) readFrame() (bool, byte, []byte, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(c.reader, header)
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+
+	size := uint64(header[1] & 0x7f)
+	switch size {
+	case 126:
+		b := make([]byte, 2)
+		_, err = io.ReadFull(c.reader, b)
+		if err != nil {
+			return false, 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(b))
+	case 127:
+		b := make([]byte, 8)
+		_, err = io.ReadFull(c.reader, b)
+		if err != nil {
+			return false, 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(b)
+	}
+	if size > wsMaxFrameSize {
+		return false, 0, nil, fmt.Errorf("frame size %d out of range", size)
+	}
+
+	var mask []byte
+	if masked {
+		mask = make([]byte, 4)
+		_, err = io.ReadFull(c.reader, mask)
+		if err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload := make([]byte, size)
+	_, err = io.ReadFull(c.reader, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	for i := range mask {
+		for j := i; j < len(payload); j += 4 {
+			payload[j] ^= mask[i]
+		}
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// writeFrame writes a frame with FIN set, which is masked if the connection is a client.
+func (c *WSConn) writeFrame(opcode byte, payload []byte) error {
+	header := make([]byte, 2, 14)
+	header[0] = 0x80 | opcode
+
+	switch size := len(payload); {
+	case size < 126:
+		header[1] = byte(size)
+	case size <= 65535:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(size))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(size))
+	}
+
+	data := payload
+	if c.isClient {
+		mask := make([]byte, 4)
+		_, err := rand.Read(mask)
+		if err != nil {
+			return fmt.Errorf("generate mask: %w", err)
+		}
+		header[1] |= 0x80
+		header = append(header, mask...)
+
+		data = make([]byte, len(payload))
+		for i := range payload {
+			data[i] = payload[i] ^ mask[i%4]
+		}
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	_, err := c.conn.Write(append(header, data...))
+
+	return err
+}
+
+func (c *WSConn) Read(b []byte) (n int, err error) {
+	message := make([]byte, 0)
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+
+		switch opcode {
+		case wsOpPing:
+			err := c.writeFrame(wsOpPong, payload)
+			if err != nil {
+				return 0, fmt.Errorf("write pong: %w", err)
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			_ = c.writeFrame(wsOpClose, nil)
+			return 0, io.EOF
+		}
+
+		if len(message)+len(payload) > wsMaxFrameSize {
+			return 0, fmt.Errorf("message size %d out of range", len(message)+len(payload))
+		}
+		message = append(message, payload...)
+		if !fin {
+			continue
+		}
+
+		dp, err := c.crypt.Decrypt(message)
+		if err != nil {
+			return 0, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   c.RemoteAddr(),
+				Err:    fmt.Errorf("decrypt: %w", err),
+			}
+		}
+
+		return copy(b, dp), nil
+	}
+}
+
+func (c *WSConn) Write(b []byte) (n int, err error) {
+	// Encrypt
+	contents, err := c.crypt.Encrypt(b)
+	if err != nil {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    fmt.Errorf("encrypt: %w", err),
+		}
+	}
+
+	err = c.writeFrame(wsOpBinary, contents)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (c *WSConn) Close() error {
+	_ = c.writeFrame(wsOpClose, nil)
+
+	return c.conn.Close()
+}
+
+func (c *WSConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *WSConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *WSConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *WSConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *WSConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+type WSListener struct {
+	listener net.Listener
+	crypt    crypto.Crypt
+	path     string
+}
+
+// ListenWebSocket acts like ListenTCP for pcap networks, and accepts connections upgraded to WebSocket in the path.
+func ListenWebSocket(dev *Device, srcPort uint16, crypt crypto.Crypt, cfg *config.WebSocketConfig) (*WSListener, error) {
+	listener, err := listenTCP(dev, srcPort)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.TLS {
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("load key pair: %w", err)
+		}
+		listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+
+	return &WSListener{
+		listener: listener,
+		crypt:    crypt,
+		path:     cfg.Path,
+	}, nil
+}
+
+// Accept waits for and returns the next connection which is upgraded to WebSocket. Connections from sources refused by
+// the ACL or failing in the handshake are closed and skipped.
+func (l *WSListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if !permitsAddr(conn.RemoteAddr()) {
+			logger.Verbosef("Refuse WebSocket from %s\n", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		reader, err := handshakeWSServer(conn, l.path)
+		if err != nil {
+			logger.Verbosef("Refuse WebSocket from %s: %v\n", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+
+		return &WSConn{
+			conn:   conn,
+			reader: reader,
+			crypt:  l.crypt,
+		}, nil
+	}
+}
+
+func (l *WSListener) Close() error {
+	return l.listener.Close()
+}
+
+func (l *WSListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
@@ -0,0 +1,10 @@
+// +build !go1.16
+
+package privilege
+
+import "errors"
+
+// drop is not supported before Go 1.16, when setuid and setgid only switch the calling thread and fail in Linux.
+func drop(uid, gid int) error {
+	return errors.New("dropping privileges requires go 1.16 or later")
+}
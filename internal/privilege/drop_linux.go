@@ -0,0 +1,26 @@
+// +build go1.16
+
+package privilege
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// drop switches all threads of the process to the user and the group, which is supported since Go 1.16.
+func drop(uid, gid int) error {
+	err := syscall.Setgroups([]int{gid})
+	if err != nil {
+		return fmt.Errorf("set groups: %w", err)
+	}
+	err = syscall.Setgid(gid)
+	if err != nil {
+		return fmt.Errorf("set gid %d: %w", gid, err)
+	}
+	err = syscall.Setuid(uid)
+	if err != nil {
+		return fmt.Errorf("set uid %d: %w", uid, err)
+	}
+
+	return nil
+}
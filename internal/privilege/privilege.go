@@ -0,0 +1,37 @@
+package privilege
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+)
+
+// Check returns an error describing how to grant privileges of capturing and injecting packets if the process lacks
+// them, nil if the process is privileged enough or privileges cannot be detected.
+func Check() error {
+	return check()
+}
+
+// Drop drops privileges of the process to the user designated by name or by uid, and to its primary group. Handles
+// opened before are kept usable, but new handles cannot be opened afterwards.
+func Drop(name string) error {
+	u, err := user.Lookup(name)
+	if err != nil {
+		var e error
+		u, e = user.LookupId(name)
+		if e != nil {
+			return fmt.Errorf("lookup user %s: %w", name, err)
+		}
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("parse uid %s: %w", u.Uid, err)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return fmt.Errorf("parse gid %s: %w", u.Gid, err)
+	}
+
+	return drop(uid, gid)
+}
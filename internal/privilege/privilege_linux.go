@@ -0,0 +1,74 @@
+package privilege
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	capNetAdmin = 12
+	capNetRaw   = 13
+)
+
+// effectiveCaps returns effective capabilities of the process in /proc/self/status.
+func effectiveCaps() (uint64, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+
+		caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parse: %w", err)
+		}
+
+		return caps, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("read: %w", err)
+	}
+
+	return 0, fmt.Errorf("missing effective capabilities")
+}
+
+func check() error {
+	caps, err := effectiveCaps()
+	if err != nil {
+		// Privileges are unknown, like in a system without procfs
+		return nil
+	}
+
+	missing := make([]string, 0)
+	if caps&(1<<capNetRaw) == 0 {
+		missing = append(missing, "cap_net_raw")
+	}
+	if caps&(1<<capNetAdmin) == 0 {
+		missing = append(missing, "cap_net_admin")
+	}
+	if len(missing) <= 0 {
+		return nil
+	}
+
+	ex, err := os.Executable()
+	if err != nil {
+		ex = "path_to_ikago"
+	}
+	if os.Geteuid() == 0 {
+		return fmt.Errorf("missing capabilities %s, please run IkaGo as root without dropping them, like in a container "+
+			"started with --cap-add=NET_RAW --cap-add=NET_ADMIN", strings.Join(missing, ", "))
+	}
+
+	return fmt.Errorf("missing capabilities %s, please run\n  sudo setcap cap_net_raw,cap_net_admin+ep \"%s\"\n"+
+		"before opening IkaGo, or just run as root with sudo", strings.Join(missing, ", "), ex)
+}
@@ -0,0 +1,35 @@
+// +build !linux,!windows
+
+package privilege
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func check() error {
+	if os.Geteuid() != 0 {
+		return errors.New("missing privileges of root, please run IkaGo as root with sudo")
+	}
+
+	return nil
+}
+
+func drop(uid, gid int) error {
+	err := syscall.Setgroups([]int{gid})
+	if err != nil {
+		return fmt.Errorf("set groups: %w", err)
+	}
+	err = syscall.Setgid(gid)
+	if err != nil {
+		return fmt.Errorf("set gid %d: %w", gid, err)
+	}
+	err = syscall.Setuid(uid)
+	if err != nil {
+		return fmt.Errorf("set uid %d: %w", uid, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package privilege
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/windows"
+	"os"
+	"path/filepath"
+	"runtime"
+	"unsafe"
+)
+
+// seGroupEnabled is the attribute of groups enabled in a token, administrators in a token not elevated in UAC are
+// for deny only.
+const seGroupEnabled = 0x00000004
+
+// isNpcapInstalled returns if wpcap.dll of Npcap, or of WinPcap in early installations, is found.
+func isNpcapInstalled() bool {
+	root := os.Getenv("SystemRoot")
+	if root == "" {
+		root = `C:\Windows`
+	}
+
+	for _, path := range []string{
+		filepath.Join(root, "System32", "Npcap", "wpcap.dll"),
+		filepath.Join(root, "System32", "wpcap.dll"),
+	} {
+		_, err := os.Stat(path)
+		if err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isElevated returns if the process runs as an administrator elevated in UAC.
+func isElevated() (bool, error) {
+	admins, err := windows.CreateWellKnownSid(windows.WinBuiltinAdministratorsSid)
+	if err != nil {
+		return false, fmt.Errorf("create sid: %w", err)
+	}
+
+	token, err := windows.OpenCurrentProcessToken()
+	if err != nil {
+		return false, fmt.Errorf("open token: %w", err)
+	}
+	defer token.Close()
+
+	groups, err := token.GetTokenGroups()
+	if err != nil {
+		return false, fmt.Errorf("get groups: %w", err)
+	}
+	// Groups are in a variable array after the count
+	all := (*[1 << 20]windows.SIDAndAttributes)(unsafe.Pointer(&groups.Groups[0]))[:groups.GroupCount:groups.GroupCount]
+	for _, group := range all {
+		if group.Attributes&seGroupEnabled != 0 && windows.EqualSid(group.Sid, admins) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func check() error {
+	if !isNpcapInstalled() {
+		return errors.New("missing Npcap, please install Npcap from https://nmap.org/npcap/ before opening IkaGo")
+	}
+
+	ok, err := isElevated()
+	if err != nil {
+		// Privileges are unknown
+		return nil
+	}
+	if !ok {
+		return errors.New("missing privileges of administrators, please run IkaGo in a prompt run as administrator")
+	}
+
+	return nil
+}
+
+func drop(uid, gid int) error {
+	return fmt.Errorf("os %s not support", runtime.GOOS)
+}
@@ -0,0 +1,19 @@
+// Package prof serves runtime profiles for profiling CPU and allocations on real traffic.
+package prof
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// Handler returns a handler serving runtime profiles under /debug/pprof/, which can be read by go tool pprof.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return mux
+}
@@ -0,0 +1,139 @@
+// Package route installs routes in the routing table of the OS and reverts them.
+package route
+
+import (
+	"errors"
+	"fmt"
+	"ikago/internal/config"
+	"net"
+	"os"
+	"sync"
+)
+
+// Route describes a route to the destination network via the gateway, or to the device directly if the gateway is
+// empty.
+type Route struct {
+	Dst     string `json:"dst"`
+	Gateway string `json:"gateway,omitempty"`
+	Dev     string `json:"dev,omitempty"`
+}
+
+func (r *Route) String() string {
+	if r.Gateway != "" {
+		return fmt.Sprintf("%s via %s", r.Dst, r.Gateway)
+	}
+
+	return fmt.Sprintf("%s dev %s", r.Dst, r.Dev)
+}
+
+// isIPv6 returns if the destination of the route is in IPv6.
+func (r *Route) isIPv6() bool {
+	_, ipNet, err := net.ParseCIDR(r.Dst)
+
+	return err == nil && ipNet.IP.To4() == nil
+}
+
+// HostRoute returns the route to the host via the gateway in the device.
+func HostRoute(host, gateway net.IP, dev string) *Route {
+	prefix := 32
+	if host.To4() == nil {
+		prefix = 128
+	}
+
+	return &Route{
+		Dst:     fmt.Sprintf("%s/%d", host, prefix),
+		Gateway: gateway.String(),
+		Dev:     dev,
+	}
+}
+
+// DefaultRoutes returns routes covering all destinations in the family to the device. They are split into two halves,
+// which are preferred to the default route of the OS, so the default route is kept as it is.
+func DefaultRoutes(dev string, ipv6 bool) []*Route {
+	if ipv6 {
+		return []*Route{{Dst: "::/1", Dev: dev}, {Dst: "8000::/1", Dev: dev}}
+	}
+
+	return []*Route{{Dst: "0.0.0.0/1", Dev: dev}, {Dst: "128.0.0.0/1", Dev: dev}}
+}
+
+// Manager installs routes and reverts them. Installed routes are recorded in a journal, so routes left by a process
+// which did not revert them, like after a crash, can be recovered.
+type Manager struct {
+	lock    sync.Mutex
+	journal string
+	routes  []*Route
+}
+
+// NewManager returns a new manager recording routes in the journal.
+func NewManager(journal string) *Manager {
+	return &Manager{journal: journal}
+}
+
+// Add installs the route.
+func (m *Manager) Add(r *Route) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	err := add(r)
+	if err != nil {
+		return fmt.Errorf("add route %s: %w", r, err)
+	}
+	m.routes = append(m.routes, r)
+
+	err = config.SaveState(m.journal, m.routes)
+	if err != nil {
+		return fmt.Errorf("save journal: %w", err)
+	}
+
+	return nil
+}
+
+// Revert deletes installed routes in reverse order and removes the journal.
+func (m *Manager) Revert() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var errs []error
+	for i := len(m.routes) - 1; i >= 0; i-- {
+		err := del(m.routes[i])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("delete route %s: %w", m.routes[i], err))
+		}
+	}
+	m.routes = nil
+
+	err := os.Remove(m.journal)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		errs = append(errs, fmt.Errorf("remove journal: %w", err))
+	}
+	if len(errs) > 0 {
+		return errs[0]
+	}
+
+	return nil
+}
+
+// Recover deletes routes recorded in the journal which are not reverted, and returns the number of them.
+func Recover(journal string) (int, error) {
+	var routes []*Route
+	err := config.LoadState(journal, &routes)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("load journal: %w", err)
+	}
+
+	// Routes may be deleted with their devices
+	for i := len(routes) - 1; i >= 0; i-- {
+		_ = del(routes[i])
+	}
+
+	err = os.Remove(journal)
+	if err != nil {
+		return 0, fmt.Errorf("remove journal: %w", err)
+	}
+
+	return len(routes), nil
+}
@@ -0,0 +1,40 @@
+package route
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+)
+
+func args(action string, r *Route) []string {
+	result := []string{"-n", action}
+	if r.isIPv6() {
+		result = append(result, "-inet6")
+	}
+	result = append(result, "-net", r.Dst)
+	if r.Gateway != "" {
+		result = append(result, r.Gateway)
+	} else {
+		result = append(result, "-interface", r.Dev)
+	}
+
+	return result
+}
+
+func add(r *Route) error {
+	out, err := exec.Command("route", args("add", r)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec route: %w: %s", err, bytes.TrimSpace(out))
+	}
+
+	return nil
+}
+
+func del(r *Route) error {
+	out, err := exec.Command("route", args("delete", r)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec route: %w: %s", err, bytes.TrimSpace(out))
+	}
+
+	return nil
+}
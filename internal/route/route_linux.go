@@ -0,0 +1,40 @@
+package route
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+)
+
+func args(action string, r *Route) []string {
+	result := []string{"route", action, r.Dst}
+	if r.isIPv6() {
+		result = append([]string{"-6"}, result...)
+	}
+	if r.Gateway != "" {
+		result = append(result, "via", r.Gateway)
+	}
+	if r.Dev != "" {
+		result = append(result, "dev", r.Dev)
+	}
+
+	return result
+}
+
+func add(r *Route) error {
+	out, err := exec.Command("ip", args("replace", r)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec ip: %w: %s", err, bytes.TrimSpace(out))
+	}
+
+	return nil
+}
+
+func del(r *Route) error {
+	out, err := exec.Command("ip", args("del", r)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec ip: %w: %s", err, bytes.TrimSpace(out))
+	}
+
+	return nil
+}
@@ -0,0 +1,16 @@
+// +build !linux,!darwin,!windows
+
+package route
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func add(r *Route) error {
+	return fmt.Errorf("os %s not support", runtime.GOOS)
+}
+
+func del(r *Route) error {
+	return fmt.Errorf("os %s not support", runtime.GOOS)
+}
@@ -0,0 +1,57 @@
+package route
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+)
+
+// args returns arguments of netsh, which handles routes in both families.
+func args(action string, r *Route) ([]string, error) {
+	family := "ipv4"
+	if r.isIPv6() {
+		family = "ipv6"
+	}
+
+	inter, err := net.InterfaceByName(r.Dev)
+	if err != nil {
+		return nil, fmt.Errorf("find interface %s: %w", r.Dev, err)
+	}
+
+	result := []string{"interface", family, action, "route", r.Dst, "interface=" + strconv.Itoa(inter.Index)}
+	if r.Gateway != "" {
+		result = append(result, "nexthop="+r.Gateway)
+	}
+
+	return result, nil
+}
+
+func add(r *Route) error {
+	a, err := args("add", r)
+	if err != nil {
+		return err
+	}
+
+	out, err := exec.Command("netsh", a...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec netsh: %w: %s", err, bytes.TrimSpace(out))
+	}
+
+	return nil
+}
+
+func del(r *Route) error {
+	a, err := args("delete", r)
+	if err != nil {
+		return err
+	}
+
+	out, err := exec.Command("netsh", a...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec netsh: %w: %s", err, bytes.TrimSpace(out))
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package shape
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minBurst is the min burst of a bucket in Bytes, which allows the largest packet or batch to pass.
+const minBurst = 65535
+
+// Bucket describes a token bucket refilled at a rate in Bytes per second.
+type Bucket struct {
+	lock       sync.Mutex
+	rate       float64
+	burst      float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+// NewBucket returns a new token bucket with the rate in bits per second. Its burst is the traffic in 100 ms.
+func NewBucket(rate uint64) *Bucket {
+	bytesRate := float64(rate) / 8
+	burst := bytesRate / 10
+	if burst < minBurst {
+		burst = minBurst
+	}
+
+	return &Bucket{
+		rate:       bytesRate,
+		burst:      burst,
+		tokens:     burst,
+		lastRefill: time.Now(),
+	}
+}
+
+// refill adds tokens generated since the last refill. The lock must be held.
+func (b *Bucket) refill() {
+	now := time.Now()
+
+	b.tokens = b.tokens + now.Sub(b.lastRefill).Seconds()*b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.lastRefill = now
+}
+
+// Reserve takes tokens of the size and returns the duration to wait before the data can be sent. Tokens may be
+// borrowed, and the debt is paid by the following refills.
+func (b *Bucket) Reserve(size int) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill()
+	b.tokens = b.tokens - float64(size)
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Wait takes tokens of the size and blocks until the data can be sent.
+func (b *Bucket) Wait(size int) {
+	d := b.Reserve(size)
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// Allow takes tokens of the size and returns true if there are enough tokens, otherwise returns false without taking
+// any.
+func (b *Bucket) Allow(size int) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill()
+	if b.tokens < float64(size) {
+		return false
+	}
+	b.tokens = b.tokens - float64(size)
+
+	return true
+}
+
+// ParseRate returns the rate in bits per second of a string like 10mbps. Units bps, kbps, mbps and gbps are supported,
+// and a number without unit is in bps.
+func ParseRate(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	str := strings.ToLower(s)
+	var unit uint64 = 1
+	for _, u := range []struct {
+		suffix string
+		unit   uint64
+	}{
+		{"gbps", 1000 * 1000 * 1000},
+		{"mbps", 1000 * 1000},
+		{"kbps", 1000},
+		{"bps", 1},
+	} {
+		if strings.HasSuffix(str, u.suffix) {
+			str = strings.TrimSuffix(str, u.suffix)
+			unit = u.unit
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse %s: %w", s, err)
+	}
+	if value < 0 {
+		return 0, errors.New("negative rate")
+	}
+
+	return uint64(value * float64(unit)), nil
+}
+
+// FormatRate returns a human-readable string of the rate in bits per second.
+func FormatRate(rate uint64) string {
+	switch {
+	case rate >= 1000*1000*1000:
+		return fmt.Sprintf("%.1f Gbps", float64(rate)/1000/1000/1000)
+	case rate >= 1000*1000:
+		return fmt.Sprintf("%.1f Mbps", float64(rate)/1000/1000)
+	case rate >= 1000:
+		return fmt.Sprintf("%.1f Kbps", float64(rate)/1000)
+	default:
+		return fmt.Sprintf("%d bps", rate)
+	}
+}
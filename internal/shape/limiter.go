@@ -0,0 +1,99 @@
+package shape
+
+import (
+	"fmt"
+	"ikago/internal/stat"
+	"sync"
+	"time"
+)
+
+// keepFlows is the duration after which a bucket of a flow without traffic is removed.
+const keepFlows = time.Minute
+
+type flowBuckets struct {
+	in       *Bucket
+	out      *Bucket
+	lastSeen time.Time
+}
+
+// Limiter describes a traffic shaper limits throughput globally and per flow in each direction. Traffic exceeding the
+// global rate is delayed, and traffic exceeding the rate of its flow is dropped.
+type Limiter struct {
+	rate        uint64
+	flowRate    uint64
+	in          *Bucket
+	out         *Bucket
+	lock        sync.Mutex
+	flows       map[string]*flowBuckets
+	lastExpired time.Time
+}
+
+// NewLimiter returns a new limiter with the global rate and the rate per flow in bits per second. A rate of 0 means
+// the throughput is unlimited.
+func NewLimiter(rate, flowRate uint64) *Limiter {
+	l := &Limiter{
+		rate:        rate,
+		flowRate:    flowRate,
+		flows:       make(map[string]*flowBuckets),
+		lastExpired: time.Now(),
+	}
+	if rate > 0 {
+		l.in = NewBucket(rate)
+		l.out = NewBucket(rate)
+	}
+
+	return l
+}
+
+// Wait blocks until the data of the size in the direction is allowed by the global rate.
+func (l *Limiter) Wait(direction stat.Direction, size int) {
+	if l.rate <= 0 {
+		return
+	}
+
+	switch direction {
+	case stat.DirectionIn:
+		l.in.Wait(size)
+	case stat.DirectionOut:
+		l.out.Wait(size)
+	default:
+		panic(fmt.Errorf("direction %d out of range", direction))
+	}
+}
+
+// Allow returns if the data of the size in the direction of the flow is allowed by the rate per flow.
+func (l *Limiter) Allow(flow string, direction stat.Direction, size int) bool {
+	if l.flowRate <= 0 {
+		return true
+	}
+
+	l.lock.Lock()
+	now := time.Now()
+	if now.Sub(l.lastExpired) > keepFlows {
+		for f, buckets := range l.flows {
+			if now.Sub(buckets.lastSeen) > keepFlows {
+				delete(l.flows, f)
+			}
+		}
+		l.lastExpired = now
+	}
+	buckets, ok := l.flows[flow]
+	if !ok {
+		buckets = &flowBuckets{
+			in:  NewBucket(l.flowRate),
+			out: NewBucket(l.flowRate),
+		}
+		l.flows[flow] = buckets
+	}
+	buckets.lastSeen = now
+	l.lock.Unlock()
+
+	switch direction {
+	case stat.DirectionIn:
+		return buckets.in.Allow(size)
+	case stat.DirectionOut:
+		return buckets.out.Allow(size)
+	default:
+		panic(fmt.Errorf("direction %d out of range", direction))
+	}
+}
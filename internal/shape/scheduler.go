@@ -0,0 +1,238 @@
+package shape
+
+import (
+	"fmt"
+	"ikago/internal/stat"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// schedulerQueueSize is the number of packets buffered in each class of a scheduler.
+const schedulerQueueSize = 1000
+
+// Class describes the class of a packet in scheduling.
+type Class int
+
+const (
+	// ClassBulk describes packets of bulk data, which are sent after packets in priority.
+	ClassBulk Class = iota
+	// ClassPriority describes small and latency-sensitive packets, like TCP ACKs, DNS and UDP of games.
+	ClassPriority
+)
+
+// Packet describes the properties of a packet in classifying.
+type Packet struct {
+	// Protocol is the transport protocol.
+	Protocol gopacket.LayerType
+	// SrcPort is the source port of TCP or UDP.
+	SrcPort uint16
+	// DstPort is the destination port of TCP or UDP.
+	DstPort uint16
+	// Size is the size of the packet.
+	Size int
+	// Payload is the size of the payload of TCP.
+	Payload int
+	// DSCP is the DSCP in the IP header.
+	DSCP uint8
+}
+
+// ruleKind describes the kind of a rule of classifying.
+type ruleKind int
+
+const (
+	ruleACK ruleKind = iota
+	ruleSize
+	ruleTCP
+	ruleUDP
+	ruleDSCP
+)
+
+// Rule describes a rule of classifying packets in priority.
+type Rule struct {
+	kind ruleKind
+	min  int
+	max  int
+}
+
+// ParseRule returns a rule by given string. Rules can be ack for TCP segments without payload, like pure ACKs, SYNs
+// and FINs, size:n for packets no larger than n Bytes, tcp:port or tcp:min-max for TCP segments from or to the ports,
+// udp:port or udp:min-max for UDP datagrams from or to the ports, and dscp:n for packets marked with the DSCP.
+func ParseRule(s string) (*Rule, error) {
+	str := strings.ToLower(strings.TrimSpace(s))
+	if str == "ack" {
+		return &Rule{kind: ruleACK}, nil
+	}
+
+	parts := strings.SplitN(str, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("rule %s not support", s)
+	}
+
+	var (
+		kind     ruleKind
+		min, max int
+		err      error
+	)
+	switch parts[0] {
+	case "size":
+		kind = ruleSize
+		max, err = strconv.Atoi(parts[1])
+		if err != nil || max <= 0 {
+			return nil, fmt.Errorf("size %s out of range", parts[1])
+		}
+	case "dscp":
+		kind = ruleDSCP
+		min, err = strconv.Atoi(parts[1])
+		if err != nil || min < 0 || min > 63 {
+			return nil, fmt.Errorf("dscp %s out of range", parts[1])
+		}
+		max = min
+	case "tcp", "udp":
+		kind = ruleTCP
+		if parts[0] == "udp" {
+			kind = ruleUDP
+		}
+		min, max, err = parsePortRange(parts[1])
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("rule %s not support", s)
+	}
+
+	return &Rule{kind: kind, min: min, max: max}, nil
+}
+
+// ParseRules returns rules by given strings.
+func ParseRules(s []string) ([]*Rule, error) {
+	result := make([]*Rule, 0, len(s))
+	for _, str := range s {
+		rule, err := ParseRule(str)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, rule)
+	}
+
+	return result, nil
+}
+
+func parsePortRange(s string) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+	min, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil || min <= 0 {
+		return 0, 0, fmt.Errorf("port %s out of range", parts[0])
+	}
+	max := min
+	if len(parts) > 1 {
+		max, err = strconv.ParseUint(parts[1], 10, 16)
+		if err != nil || max < min {
+			return 0, 0, fmt.Errorf("port range %s out of range", s)
+		}
+	}
+
+	return int(min), int(max), nil
+}
+
+// Match returns if the packet matches the rule.
+func (r *Rule) Match(p *Packet) bool {
+	switch r.kind {
+	case ruleACK:
+		return p.Protocol == layers.LayerTypeTCP && p.Payload <= 0
+	case ruleSize:
+		return p.Size <= r.max
+	case ruleTCP:
+		return p.Protocol == layers.LayerTypeTCP && (r.inRange(p.SrcPort) || r.inRange(p.DstPort))
+	case ruleUDP:
+		return p.Protocol == layers.LayerTypeUDP && (r.inRange(p.SrcPort) || r.inRange(p.DstPort))
+	case ruleDSCP:
+		return int(p.DSCP) == r.min
+	default:
+		return false
+	}
+}
+
+func (r *Rule) inRange(port uint16) bool {
+	return int(port) >= r.min && int(port) <= r.max
+}
+
+// Classify returns the class of the packet, in priority if it matches any of the rules.
+func Classify(rules []*Rule, p *Packet) Class {
+	for _, rule := range rules {
+		if rule.Match(p) {
+			return ClassPriority
+		}
+	}
+
+	return ClassBulk
+}
+
+type scheduledPacket struct {
+	size int
+	send func()
+}
+
+// Scheduler describes a scheduler in a direction of the tunnel, which sends packets in priority before packets of bulk
+// data queueing when the tunnel is congested, like being limited by the global rate of the limiter or blocked in
+// writing. Packets in the same class are sent in order.
+type Scheduler struct {
+	limiter   *Limiter
+	direction stat.Direction
+	priority  chan scheduledPacket
+	bulk      chan scheduledPacket
+}
+
+// NewScheduler returns a new scheduler which waits for the global rate of the limiter in the direction before sending
+// each packet.
+func NewScheduler(limiter *Limiter, direction stat.Direction) *Scheduler {
+	s := &Scheduler{
+		limiter:   limiter,
+		direction: direction,
+		priority:  make(chan scheduledPacket, schedulerQueueSize),
+		bulk:      make(chan scheduledPacket, schedulerQueueSize),
+	}
+
+	go s.run()
+
+	return s
+}
+
+// Schedule queues the packet of the size in the class, and send is called once it is its turn. It blocks if the queue
+// of the class is full.
+func (s *Scheduler) Schedule(class Class, size int, send func()) {
+	p := scheduledPacket{size: size, send: send}
+	if class == ClassPriority {
+		s.priority <- p
+	} else {
+		s.bulk <- p
+	}
+}
+
+// Len returns the number of packets queueing in the class.
+func (s *Scheduler) Len(class Class) int {
+	if class == ClassPriority {
+		return len(s.priority)
+	}
+
+	return len(s.bulk)
+}
+
+func (s *Scheduler) run() {
+	for {
+		var p scheduledPacket
+		select {
+		case p = <-s.priority:
+		default:
+			select {
+			case p = <-s.priority:
+			case p = <-s.bulk:
+			}
+		}
+
+		s.limiter.Wait(s.direction, p.size)
+		p.send()
+	}
+}
@@ -0,0 +1,209 @@
+package stat
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// flowExpiration is the duration after which a flow without traffic is no longer tracked.
+const flowExpiration = 5 * time.Minute
+
+// FlowStat describes traffic statistics of a flow.
+type FlowStat struct {
+	Flow       string  `json:"flow"`
+	InCount    uint64  `json:"inCount"`
+	InSize     uint64  `json:"inSize"`
+	OutCount   uint64  `json:"outCount"`
+	OutSize    uint64  `json:"outSize"`
+	InRate     float64 `json:"inRate"`
+	OutRate    float64 `json:"outRate"`
+	LastSeen   int64   `json:"lastSeen"`
+	windowSize uint64
+}
+
+type flowIndicator struct {
+	in             TrafficIndicator
+	out            TrafficIndicator
+	windowInSize   uint64
+	windowOutSize  uint64
+	windowLastSeen time.Time
+}
+
+// FlowRecorder describes traffic statistics of flows. Rates are measured in the window since the last summary.
+type FlowRecorder struct {
+	lock          sync.Mutex
+	flows         map[string]*flowIndicator
+	windowStart   time.Time
+	windowInSize  uint64
+	windowOutSize uint64
+	inSize        uint64
+	outSize       uint64
+}
+
+// NewFlowRecorder returns a new flow recorder.
+func NewFlowRecorder() *FlowRecorder {
+	return &FlowRecorder{
+		flows:       make(map[string]*flowIndicator),
+		windowStart: time.Now(),
+	}
+}
+
+// Add adds a data of traffic to the flow between the source and the destination. The direction is from the view of the
+// source.
+func (r *FlowRecorder) Add(protocol, src, dst string, direction Direction, size uint) {
+	flow := fmt.Sprintf("%s %s <-> %s", protocol, src, dst)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	indicator, ok := r.flows[flow]
+	if !ok {
+		now := time.Now()
+		indicator = &flowIndicator{
+			in:  TrafficIndicator{appear: now, lastSeen: now},
+			out: TrafficIndicator{appear: now, lastSeen: now},
+		}
+		r.flows[flow] = indicator
+	}
+
+	switch direction {
+	case DirectionIn:
+		indicator.in.Add(size)
+		indicator.windowInSize = indicator.windowInSize + uint64(size)
+		indicator.windowLastSeen = indicator.in.lastSeen
+		r.windowInSize = r.windowInSize + uint64(size)
+		r.inSize = r.inSize + uint64(size)
+	case DirectionOut:
+		indicator.out.Add(size)
+		indicator.windowOutSize = indicator.windowOutSize + uint64(size)
+		indicator.windowLastSeen = indicator.out.lastSeen
+		r.windowOutSize = r.windowOutSize + uint64(size)
+		r.outSize = r.outSize + uint64(size)
+	default:
+		panic(fmt.Errorf("direction %d out of range", direction))
+	}
+}
+
+// Stats returns statistics of all flows, sorted by the size in the current window in descending order.
+func (r *FlowRecorder) Stats() []FlowStat {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.stats()
+}
+
+// Totals returns the total size of traffic out and in, and the number of flows tracked, regardless of windows.
+func (r *FlowRecorder) Totals() (outSize, inSize uint64, flows int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.outSize, r.inSize, len(r.flows)
+}
+
+// Summary returns a human-readable summary of the total throughput and the top flows in the current window, and
+// starts a new window.
+func (r *FlowRecorder) Summary(top int) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	stats := r.stats()
+	elapsed := time.Since(r.windowStart).Seconds()
+
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("Statistics in %.0f s: %s out (%s/s), %s in (%s/s), %d flows\n",
+		elapsed, formatSize(r.windowOutSize), formatSize(uint64(float64(r.windowOutSize)/elapsed)),
+		formatSize(r.windowInSize), formatSize(uint64(float64(r.windowInSize)/elapsed)), len(stats)))
+	for i, stat := range stats {
+		if i >= top || stat.windowSize <= 0 {
+			break
+		}
+
+		sb.WriteString(fmt.Sprintf("  %s: %s out (%s/s), %s in (%s/s)\n", stat.Flow,
+			formatSize(stat.OutSize), formatSize(uint64(stat.OutRate)), formatSize(stat.InSize), formatSize(uint64(stat.InRate))))
+	}
+
+	// Start a new window and remove expired flows
+	now := time.Now()
+	for flow, indicator := range r.flows {
+		if now.Sub(indicator.windowLastSeen) > flowExpiration {
+			delete(r.flows, flow)
+			continue
+		}
+
+		indicator.windowInSize = 0
+		indicator.windowOutSize = 0
+	}
+	r.windowStart = now
+	r.windowInSize = 0
+	r.windowOutSize = 0
+
+	return sb.String()
+}
+
+// stats returns statistics of all flows. The lock must be held.
+func (r *FlowRecorder) stats() []FlowStat {
+	elapsed := time.Since(r.windowStart).Seconds()
+	if elapsed <= 0 {
+		elapsed = 1
+	}
+
+	result := make([]FlowStat, 0, len(r.flows))
+	for flow, indicator := range r.flows {
+		result = append(result, FlowStat{
+			Flow:       flow,
+			InCount:    indicator.in.Count(),
+			InSize:     indicator.in.Size(),
+			OutCount:   indicator.out.Count(),
+			OutSize:    indicator.out.Size(),
+			InRate:     float64(indicator.windowInSize) / elapsed,
+			OutRate:    float64(indicator.windowOutSize) / elapsed,
+			LastSeen:   indicator.windowLastSeen.Unix(),
+			windowSize: indicator.windowInSize + indicator.windowOutSize,
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].windowSize != result[j].windowSize {
+			return result[i].windowSize > result[j].windowSize
+		}
+
+		return result[i].Flow < result[j].Flow
+	})
+
+	return result
+}
+
+// RateMeter describes rates of traffic in a flow recorder measured between samples.
+type RateMeter struct {
+	recorder *FlowRecorder
+	outSize  uint64
+	inSize   uint64
+	last     time.Time
+}
+
+// NewRateMeter returns a new rate meter of the flow recorder.
+func NewRateMeter(recorder *FlowRecorder) *RateMeter {
+	m := &RateMeter{recorder: recorder, last: time.Now()}
+	m.outSize, m.inSize, _ = recorder.Totals()
+
+	return m
+}
+
+// Sample returns a human-readable status of rates out and in since the last sample, and the number of flows.
+func (m *RateMeter) Sample() string {
+	outSize, inSize, flows := m.recorder.Totals()
+	now := time.Now()
+
+	elapsed := now.Sub(m.last).Seconds()
+	if elapsed <= 0 {
+		elapsed = 1
+	}
+	outRate := float64(outSize-m.outSize) / elapsed
+	inRate := float64(inSize-m.inSize) / elapsed
+	m.outSize, m.inSize, m.last = outSize, inSize, now
+
+	return fmt.Sprintf("Out %s/s  In %s/s  Flows %d", formatSize(uint64(outRate)), formatSize(uint64(inRate)), flows)
+}
@@ -0,0 +1,102 @@
+package tun
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+)
+
+const (
+	// familySize is the size of the protocol family header of packets in utun devices in macOS.
+	familySize = 4
+	// familyIPv4 is AF_INET in the protocol family header.
+	familyIPv4 = 2
+	// familyIPv6 is AF_INET6 in macOS in the protocol family header.
+	familyIPv6 = 30
+)
+
+// Device describes a TUN device. Each read from it returns an IP packet routed to it by the host, and each write to it
+// sends an IP packet to the host.
+type Device struct {
+	name string
+	file *os.File
+	// family is true if packets are prefixed with a protocol family header in network byte order, like in utun
+	// devices in macOS
+	family bool
+	buffer []byte
+}
+
+// Open creates a TUN device with the addresses and brings it up. The name is assigned by the OS.
+func Open(ips []net.IP) (*Device, error) {
+	dev, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	err = setup(dev.name, ips)
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+
+	return dev, nil
+}
+
+// Name returns the name of the device.
+func (dev *Device) Name() string {
+	return dev.name
+}
+
+func (dev *Device) Read(b []byte) (n int, err error) {
+	if !dev.family {
+		return dev.file.Read(b)
+	}
+
+	// Reads are from a single goroutine, so the buffer is reused
+	if len(dev.buffer) < familySize+len(b) {
+		dev.buffer = make([]byte, familySize+len(b))
+	}
+	n, err = dev.file.Read(dev.buffer[:familySize+len(b)])
+	if err != nil {
+		return 0, err
+	}
+	if n < familySize {
+		return 0, errors.New("missing protocol family")
+	}
+
+	return copy(b, dev.buffer[familySize:n]), nil
+}
+
+func (dev *Device) Write(b []byte) (n int, err error) {
+	if !dev.family {
+		return dev.file.Write(b)
+	}
+	if len(b) <= 0 {
+		return 0, errors.New("empty packet")
+	}
+
+	data := make([]byte, familySize+len(b))
+	switch b[0] >> 4 {
+	case 4:
+		binary.BigEndian.PutUint32(data, familyIPv4)
+	case 6:
+		binary.BigEndian.PutUint32(data, familyIPv6)
+	default:
+		return 0, errors.New("ip version not support")
+	}
+	copy(data[familySize:], b)
+
+	n, err = dev.file.Write(data)
+	if n >= familySize {
+		n = n - familySize
+	} else {
+		n = 0
+	}
+
+	return n, err
+}
+
+func (dev *Device) Close() error {
+	return dev.file.Close()
+}
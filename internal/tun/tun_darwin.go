@@ -0,0 +1,111 @@
+package tun
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	sysprotoControl = 2
+	afSysControl    = 2
+	ctlIOCGInfo     = 0xc0644e03
+	utunControlName = "com.apple.net.utun_control"
+	utunOptIfName   = 2
+)
+
+type ctlInfo struct {
+	id   uint32
+	name [96]byte
+}
+
+type sockaddrCtl struct {
+	len      uint8
+	family   uint8
+	sysaddr  uint16
+	id       uint32
+	unit     uint32
+	reserved [5]uint32
+}
+
+// open creates a utun device by the kernel control of utun, whose packets are prefixed with a protocol family header.
+func open() (*Device, error) {
+	fd, err := syscall.Socket(syscall.AF_SYSTEM, syscall.SOCK_DGRAM, sysprotoControl)
+	if err != nil {
+		return nil, fmt.Errorf("socket: %w", err)
+	}
+	syscall.CloseOnExec(fd)
+
+	info := ctlInfo{}
+	copy(info.name[:], utunControlName)
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), ctlIOCGInfo, uintptr(unsafe.Pointer(&info)))
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("ioctl: %w", errno)
+	}
+
+	// Unit 0 lets the OS assign the next available utun device
+	addr := sockaddrCtl{
+		len:     uint8(unsafe.Sizeof(sockaddrCtl{})),
+		family:  syscall.AF_SYSTEM,
+		sysaddr: afSysControl,
+		id:      info.id,
+	}
+	_, _, errno = syscall.Syscall(syscall.SYS_CONNECT, uintptr(fd), uintptr(unsafe.Pointer(&addr)), unsafe.Sizeof(addr))
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("connect: %w", errno)
+	}
+
+	var name [syscall.IFNAMSIZ]byte
+	nameLen := uint32(len(name))
+	_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), sysprotoControl, utunOptIfName,
+		uintptr(unsafe.Pointer(&name[0])), uintptr(unsafe.Pointer(&nameLen)), 0)
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("getsockopt: %w", errno)
+	}
+
+	// Reads are unblocked by closing in non-blocking mode
+	err = syscall.SetNonblock(fd, true)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("set non-block: %w", err)
+	}
+
+	ifName := string(name[:bytes.IndexByte(name[:], 0)])
+
+	return &Device{
+		name:   ifName,
+		file:   os.NewFile(uintptr(fd), ifName),
+		family: true,
+	}, nil
+}
+
+func setup(name string, ips []net.IP) error {
+	for _, ip := range ips {
+		// utun devices are point-to-point, so IPv4 addresses are paired with themselves
+		args := []string{name, "inet", fmt.Sprintf("%s/32", ip), ip.String(), "alias"}
+		if ip.To4() == nil {
+			args = []string{name, "inet6", ip.String(), "prefixlen", "128", "alias"}
+		}
+
+		ifconfigCmd := exec.Command("ifconfig", args...)
+		out, err := ifconfigCmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("exec ifconfig: %w: %s", err, bytes.TrimSpace(out))
+		}
+	}
+
+	ifconfigCmd := exec.Command("ifconfig", name, "up")
+	out, err := ifconfigCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec ifconfig: %w: %s", err, bytes.TrimSpace(out))
+	}
+
+	return nil
+}
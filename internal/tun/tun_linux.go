@@ -0,0 +1,75 @@
+package tun
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	iffTun    = 0x0001
+	iffNoPI   = 0x1000
+	tunSetIff = 0x400454ca
+)
+
+type ifReq struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+func open() (*Device, error) {
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open /dev/net/tun: %w", err)
+	}
+
+	req := ifReq{flags: iffTun | iffNoPI}
+	copy(req.name[:], "ikago%d")
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tunSetIff, uintptr(unsafe.Pointer(&req)))
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("ioctl: %w", errno)
+	}
+
+	// Reads are unblocked by closing in non-blocking mode
+	err = syscall.SetNonblock(fd, true)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("set non-block: %w", err)
+	}
+
+	name := string(req.name[:bytes.IndexByte(req.name[:], 0)])
+
+	return &Device{
+		name: name,
+		file: os.NewFile(uintptr(fd), name),
+	}, nil
+}
+
+func setup(name string, ips []net.IP) error {
+	for _, ip := range ips {
+		prefix := 32
+		if ip.To4() == nil {
+			prefix = 128
+		}
+
+		ipCmd := exec.Command("ip", "addr", "add", fmt.Sprintf("%s/%d", ip, prefix), "dev", name)
+		out, err := ipCmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("exec ip: %w: %s", err, bytes.TrimSpace(out))
+		}
+	}
+
+	ipCmd := exec.Command("ip", "link", "set", "dev", name, "up")
+	out, err := ipCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec ip: %w: %s", err, bytes.TrimSpace(out))
+	}
+
+	return nil
+}
@@ -0,0 +1,17 @@
+// +build !linux,!darwin
+
+package tun
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+func open() (*Device, error) {
+	return nil, fmt.Errorf("os %s not support", runtime.GOOS)
+}
+
+func setup(name string, ips []net.IP) error {
+	return nil
+}
@@ -0,0 +1,302 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"ikago/internal/config"
+	"ikago/internal/crypto"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxNameSize is the max size of the name of a user, which is presented as the Id of its clients.
+const MaxNameSize = 64
+
+// Usage describes traffic of a user in the current day and month in local time.
+type Usage struct {
+	Day        string `json:"day"`
+	DayBytes   uint64 `json:"day-bytes"`
+	Month      string `json:"month"`
+	MonthBytes uint64 `json:"month-bytes"`
+}
+
+// User describes a user of the server, whose clients authenticate by its key, and whose traffic in both directions is
+// limited by quotas.
+type User struct {
+	name         string
+	auth         *crypto.Auth
+	dailyQuota   uint64
+	monthlyQuota uint64
+	allowedPorts map[uint16]bool
+	maxFlows     int
+	lock         sync.Mutex
+	usage        Usage
+}
+
+// Parse returns a user parsed from its configuration.
+func Parse(cfg *config.UserConfig) (*User, error) {
+	if cfg.Name == "" || len(cfg.Name) > MaxNameSize {
+		return nil, fmt.Errorf("name size %d out of range", len(cfg.Name))
+	}
+	if cfg.Key == "" {
+		return nil, errors.New("missing key")
+	}
+
+	u := &User{
+		name:         cfg.Name,
+		auth:         crypto.CreateAuth(cfg.Key),
+		allowedPorts: make(map[uint16]bool),
+		maxFlows:     cfg.MaxFlows,
+	}
+
+	var err error
+	u.dailyQuota, err = ParseSize(cfg.DailyQuota)
+	if err != nil {
+		return nil, fmt.Errorf("parse daily quota: %w", err)
+	}
+	u.monthlyQuota, err = ParseSize(cfg.MonthlyQuota)
+	if err != nil {
+		return nil, fmt.Errorf("parse monthly quota: %w", err)
+	}
+
+	for _, p := range cfg.AllowedPorts {
+		if p <= 0 || p > 65535 {
+			return nil, fmt.Errorf("allowed port %d out of range", p)
+		}
+		u.allowedPorts[uint16(p)] = true
+	}
+
+	if cfg.MaxFlows < 0 {
+		return nil, fmt.Errorf("max flows %d out of range", cfg.MaxFlows)
+	}
+
+	return u, nil
+}
+
+// Name returns the name of the user.
+func (u *User) Name() string {
+	return u.name
+}
+
+// Auth returns the authentication of the user.
+func (u *User) Auth() *crypto.Auth {
+	return u.auth
+}
+
+// DailyQuota returns the daily quota of the user in Bytes, 0 if unlimited.
+func (u *User) DailyQuota() uint64 {
+	return u.dailyQuota
+}
+
+// MonthlyQuota returns the monthly quota of the user in Bytes, 0 if unlimited.
+func (u *User) MonthlyQuota() uint64 {
+	return u.monthlyQuota
+}
+
+// IsPortAllowed returns if the TCP or UDP destination port may be reached by the user.
+func (u *User) IsPortAllowed(port uint16) bool {
+	return len(u.allowedPorts) <= 0 || u.allowedPorts[port]
+}
+
+// MaxFlows returns the max concurrent flows of the user, 0 if unlimited.
+func (u *User) MaxFlows() int {
+	return u.maxFlows
+}
+
+// roll starts new periods of the usage if the day or the month changes. The lock must be held.
+func (u *User) roll(now time.Time) {
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+	if u.usage.Day != day {
+		u.usage.Day, u.usage.DayBytes = day, 0
+	}
+	if u.usage.Month != month {
+		u.usage.Month, u.usage.MonthBytes = month, 0
+	}
+}
+
+// Use counts traffic of the size, and returns false without counting if the user exceeds its quotas.
+func (u *User) Use(size int) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.roll(time.Now())
+	if u.dailyQuota > 0 && u.usage.DayBytes >= u.dailyQuota {
+		return false
+	}
+	if u.monthlyQuota > 0 && u.usage.MonthBytes >= u.monthlyQuota {
+		return false
+	}
+	u.usage.DayBytes = u.usage.DayBytes + uint64(size)
+	u.usage.MonthBytes = u.usage.MonthBytes + uint64(size)
+
+	return true
+}
+
+// Usage returns the usage of the user.
+func (u *User) Usage() Usage {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.roll(time.Now())
+
+	return u.usage
+}
+
+// Restore restores the usage of the user, which is discarded in periods passed.
+func (u *User) Restore(usage Usage) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.usage = usage
+	u.roll(time.Now())
+}
+
+func (u *User) String() string {
+	usage := u.Usage()
+
+	quota := func(n, q uint64) string {
+		if q <= 0 {
+			return FormatSize(n)
+		}
+		return fmt.Sprintf("%s/%s", FormatSize(n), FormatSize(q))
+	}
+
+	return fmt.Sprintf("%s: %s today, %s this month", u.name, quota(usage.DayBytes, u.dailyQuota),
+		quota(usage.MonthBytes, u.monthlyQuota))
+}
+
+// Users describes users by their names.
+type Users map[string]*User
+
+// ParseUsers returns users parsed from the users file.
+func ParseUsers(path string) (Users, error) {
+	cfg, err := config.ParseUsersFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(Users)
+	for _, userCfg := range cfg.Users {
+		u, err := Parse(&userCfg)
+		if err != nil {
+			return nil, fmt.Errorf("parse user %s: %w", userCfg.Name, err)
+		}
+		if _, ok := users[u.name]; ok {
+			return nil, fmt.Errorf("duplicate user %s", u.name)
+		}
+		users[u.name] = u
+	}
+
+	return users, nil
+}
+
+// Auth returns the authentication of the user in the name, nil if there is no such user.
+func (users Users) Auth(name string) *crypto.Auth {
+	u, ok := users[name]
+	if !ok {
+		return nil
+	}
+
+	return u.auth
+}
+
+// Sorted returns users sorted by their names.
+func (users Users) Sorted() []*User {
+	result := make([]*User, 0, len(users))
+	for _, u := range users {
+		result = append(result, u)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].name < result[j].name
+	})
+
+	return result
+}
+
+// SaveUsage saves usage of users to the file.
+func (users Users) SaveUsage(path string) error {
+	usages := make(map[string]Usage)
+	for name, u := range users {
+		usages[name] = u.Usage()
+	}
+
+	return config.SaveState(path, usages)
+}
+
+// LoadUsage restores usage of users from the file, and returns the number of users restored. Usage of users not in
+// the users file any more is discarded.
+func (users Users) LoadUsage(path string) (int, error) {
+	var usages map[string]Usage
+	err := config.LoadState(path, &usages)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for name, usage := range usages {
+		u, ok := users[name]
+		if !ok {
+			continue
+		}
+		u.Restore(usage)
+		n++
+	}
+
+	return n, nil
+}
+
+// ParseSize returns the size in Bytes of a string like 10GB. Units B, KB, MB, GB and TB in powers of 1000 are
+// supported, and a number without unit is in Bytes.
+func ParseSize(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	str := strings.ToUpper(strings.TrimSpace(s))
+	var unit uint64 = 1
+	for _, u := range []struct {
+		suffix string
+		unit   uint64
+	}{
+		{"TB", 1000 * 1000 * 1000 * 1000},
+		{"GB", 1000 * 1000 * 1000},
+		{"MB", 1000 * 1000},
+		{"KB", 1000},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(str, u.suffix) {
+			str = strings.TrimSuffix(str, u.suffix)
+			unit = u.unit
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse %s: %w", s, err)
+	}
+	if value < 0 {
+		return 0, errors.New("negative size")
+	}
+
+	return uint64(value * float64(unit)), nil
+}
+
+// FormatSize returns a human-readable string of the size in Bytes.
+func FormatSize(size uint64) string {
+	switch {
+	case size >= 1000*1000*1000*1000:
+		return fmt.Sprintf("%.1f TB", float64(size)/1000/1000/1000/1000)
+	case size >= 1000*1000*1000:
+		return fmt.Sprintf("%.1f GB", float64(size)/1000/1000/1000)
+	case size >= 1000*1000:
+		return fmt.Sprintf("%.1f MB", float64(size)/1000/1000)
+	case size >= 1000:
+		return fmt.Sprintf("%.1f KB", float64(size)/1000)
+	default:
+		return fmt.Sprintf("%d B", size)
+	}
+}
@@ -0,0 +1,36 @@
+package worker
+
+// queueSize is the number of tasks each worker buffers.
+const queueSize = 1000
+
+// Pool describes a pool of workers. Tasks are sharded to workers by their keys, so tasks with the same key are handled
+// in order by the same worker.
+type Pool struct {
+	queues []chan func()
+}
+
+// NewPool returns a new pool with n workers.
+func NewPool(n int) *Pool {
+	if n < 1 {
+		n = 1
+	}
+
+	p := &Pool{queues: make([]chan func(), n)}
+	for i := range p.queues {
+		queue := make(chan func(), queueSize)
+		p.queues[i] = queue
+
+		go func() {
+			for task := range queue {
+				task()
+			}
+		}()
+	}
+
+	return p
+}
+
+// Submit submits a task to the worker of the key. It blocks if the worker is busy and its queue is full.
+func (p *Pool) Submit(key uint64, task func()) {
+	p.queues[key%uint64(len(p.queues))] <- task
+}
@@ -0,0 +1,89 @@
+// Netflow is a sample hook of IkaGo, which writes a NetFlow-style record of each flow in CSV when it is closed.
+//
+// Build it as a Go plugin with the same version of Go as IkaGo, and load it with the path of records as the argument:
+//
+//	go build -buildmode=plugin -o netflow.so ./plugins/netflow
+//	ikago-server -p 18081 -hooks netflow.so@flows.csv
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"ikago/internal/hook"
+	"ikago/internal/stat"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type recorder struct {
+	lock sync.Mutex
+	w    *csv.Writer
+	f    io.Closer
+}
+
+// New returns a new hook writing records to the file in the argument, or to the standard output if it is empty.
+func New(arg string) (hook.Hook, error) {
+	var (
+		w io.Writer = os.Stdout
+		f io.Closer
+	)
+	if arg != "" {
+		file, err := os.OpenFile(arg, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("open: %w", err)
+		}
+		w, f = file, file
+	}
+
+	r := &recorder{w: csv.NewWriter(w), f: f}
+
+	err := r.write([]string{"first", "last", "duration", "protocol", "source", "destination",
+		"out-packets", "out-bytes", "in-packets", "in-bytes"})
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return nil, fmt.Errorf("write: %w", err)
+	}
+
+	return r, nil
+}
+
+func (r *recorder) OnFlowCreated(flow hook.Flow) {}
+
+func (r *recorder) OnFlowClosed(flow hook.Flow) {
+	_ = r.write([]string{
+		flow.Start.UTC().Format(time.RFC3339),
+		flow.LastSeen.UTC().Format(time.RFC3339),
+		strconv.FormatInt(int64(flow.LastSeen.Sub(flow.Start)/time.Millisecond), 10),
+		flow.Protocol,
+		flow.Src,
+		flow.Dst,
+		strconv.FormatUint(flow.OutCount, 10),
+		strconv.FormatUint(flow.OutSize, 10),
+		strconv.FormatUint(flow.InCount, 10),
+		strconv.FormatUint(flow.InSize, 10),
+	})
+}
+
+func (r *recorder) OnPacket(flow hook.Flow, direction stat.Direction, data []byte) bool {
+	return true
+}
+
+func (r *recorder) write(record []string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err := r.w.Write(record)
+	if err != nil {
+		return err
+	}
+	r.w.Flush()
+
+	return r.w.Error()
+}
+
+func main() {}
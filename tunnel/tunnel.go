@@ -0,0 +1,120 @@
+// Package tunnel embeds IkaGo in other programs. A tunnel carries raw IP packets between the program and an IkaGo
+// server, without capturing packets in listen devices like the client.
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"ikago/internal/addr"
+	"ikago/internal/config"
+	"ikago/internal/crypto"
+	"ikago/internal/obfs"
+	"ikago/internal/pcap"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// Config describes the configuration of a tunnel. Options are the same as ones of the client, and zero values are
+// their defaults.
+type Config struct {
+	// UpDev is the name of the device for routing upstream.
+	UpDev string
+	// Gateway is the gateway address.
+	Gateway string
+	// Port is the port for routing upstream, a random port from 49152 to 65535 if 0.
+	Port uint16
+	// Mode is the mode, can be faketcp, kcp or tcp.
+	Mode string
+	// Method is the method of encryption.
+	Method string
+	// Password is the password of encryption and authentication.
+	Password string
+	// Obfs is the method of obfuscation.
+	Obfs string
+	// MTU is the MTU between the client and the server.
+	MTU int
+	// Batch is the max size of a batch.
+	Batch int
+	// BatchInterval is the interval of flushing a batch.
+	BatchInterval time.Duration
+	// Frame is whether packets are framed if the server supports framing.
+	Frame bool
+	// Id is the Id presented to the server, which enables framing if it is set.
+	Id string
+}
+
+// Dial establishes a tunnel to the server. Each write to the connection sends a raw IP packet, and each read returns a
+// raw IP packet sent back by the server, whose destination is the address of the upstream device.
+func Dial(server string, cfg *Config) (net.Conn, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	serverAddr, err := addr.ParseTCPAddr(server)
+	if err != nil {
+		return nil, fmt.Errorf("parse server %s: %w", server, err)
+	}
+
+	// Devices
+	var gateway net.IP
+	if cfg.Gateway != "" {
+		gateway = net.ParseIP(cfg.Gateway)
+		if gateway == nil {
+			return nil, fmt.Errorf("invalid gateway %s", cfg.Gateway)
+		}
+	}
+	upDev, gatewayDev, err := pcap.FindUpstreamDevAndGatewayDev(cfg.UpDev, gateway)
+	if err != nil {
+		return nil, fmt.Errorf("find upstream device and gateway device: %w", err)
+	}
+	if upDev == nil || gatewayDev == nil {
+		return nil, errors.New("cannot determine upstream device and gateway device")
+	}
+
+	// Crypt
+	method := cfg.Method
+	if method == "" {
+		method = "plain"
+	}
+	crypt, err := crypto.ParseCrypt(method, cfg.Password)
+	if err != nil {
+		return nil, fmt.Errorf("parse crypt: %w", err)
+	}
+	o, err := obfs.ParseObfs(cfg.Obfs)
+	if err != nil {
+		return nil, fmt.Errorf("parse obfs: %w", err)
+	}
+
+	tunnelConfig := &pcap.TunnelConfig{
+		UpDev:         upDev,
+		GatewayDev:    gatewayDev,
+		Port:          cfg.Port,
+		Mode:          cfg.Mode,
+		Crypt:         obfs.WrapCrypt(crypt, o),
+		Auth:          crypto.CreateAuth(cfg.Password),
+		MTU:           cfg.MTU,
+		Batch:         cfg.Batch,
+		BatchInterval: cfg.BatchInterval,
+		Frame:         cfg.Frame,
+		Id:            cfg.Id,
+	}
+	switch tunnelConfig.Mode {
+	case "":
+		tunnelConfig.Mode = "faketcp"
+	case "kcp":
+		tunnelConfig.Mode = "faketcp"
+		tunnelConfig.KCPConfig = config.NewKCPConfig()
+	}
+	if tunnelConfig.Port == 0 {
+		tunnelConfig.Port = uint16(49152 + rand.New(rand.NewSource(time.Now().UnixNano())).Intn(16384))
+	}
+	if tunnelConfig.MTU == 0 {
+		tunnelConfig.MTU = pcap.MaxMTU
+	}
+	if tunnelConfig.Batch > 0 && tunnelConfig.BatchInterval <= 0 {
+		tunnelConfig.BatchInterval = time.Millisecond
+	}
+
+	return pcap.DialTunnel(serverAddr, tunnelConfig)
+}